@@ -0,0 +1,404 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/sirupsen/logrus"
+)
+
+// BackupVersion is the version of the backup archive format, which is
+// bumped whenever restoring would need to do something different.
+const BackupVersion = 1
+
+// The archive starts with a manifest, followed by the files of the data
+// directory under data/, a dump of each database under databases/, and the
+// media files under media/ if the media are kept in their own directory.
+const (
+	backupManifestName = "manifest.json"
+	backupDataDir      = "data/"
+	backupDatabasesDir = "databases/"
+	backupMediaDir     = "media/"
+)
+
+type backupManifest struct {
+	Version   int      `json:"version"`
+	CreatedTS int64    `json:"created_ts"`
+	Databases []string `json:"databases"`
+}
+
+// componentDatabase is the database of one of the Dendrite components, by
+// the name that it has in backups and, by default, in Postgres.
+type componentDatabase struct {
+	name string
+	dsn  *config.DataSource
+}
+
+func componentDatabases(cfg *config.Dendrite) []componentDatabase {
+	return []componentDatabase{
+		{"account", &cfg.Database.Account},
+		{"device", &cfg.Database.Device},
+		{"mediaapi", &cfg.Database.MediaAPI},
+		{"syncapi", &cfg.Database.SyncAPI},
+		{"roomserver", &cfg.Database.RoomServer},
+		{"serverkey", &cfg.Database.ServerKey},
+		{"federationsender", &cfg.Database.FederationSender},
+		{"appservice", &cfg.Database.AppService},
+		{"publicroomsapi", &cfg.Database.PublicRoomsAPI},
+		{"naffka", &cfg.Database.Naffka},
+	}
+}
+
+// backup is everything that a node keeps, so that it can be moved to
+// another machine as a single archive. The node mustn't be running while it
+// is backed up or restored, as the databases and files wouldn't match.
+type backup struct {
+	dataDir string
+	// The libp2p identity key, which is restored to wherever -key says.
+	identityFile string
+	// Where the media files are kept, or empty if that isn't a directory of
+	// their own.
+	mediaDir  string
+	databases []componentDatabase
+}
+
+// write writes the archive to a file, which is only put in place once the
+// whole archive has been written.
+func (b *backup) write(archive string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(archive), filepath.Base(archive)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // nolint: errcheck
+	defer tmp.Close()           // nolint: errcheck
+	gz := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gz)
+
+	// Components can share a database, which is then only dumped once.
+	var databases []componentDatabase
+	dumped := make(map[config.DataSource]bool)
+	for _, db := range b.databases {
+		if !dumped[*db.dsn] {
+			dumped[*db.dsn] = true
+			databases = append(databases, db)
+		}
+	}
+	manifest := backupManifest{Version: BackupVersion, CreatedTS: time.Now().Unix()}
+	for _, db := range databases {
+		manifest.Databases = append(manifest.Databases, db.name)
+	}
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err = tw.WriteHeader(&tar.Header{
+		Name: backupManifestName, Mode: 0600, Size: int64(len(manifestJSON)), ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	if _, err = tw.Write(manifestJSON); err != nil {
+		return err
+	}
+
+	identityName := backupDataDir + PrivateKeyFileName
+	if err = addFile(tw, identityName, b.identityFile); err != nil {
+		return err
+	}
+	skip := make(map[string]bool)
+	for _, file := range []string{archive, tmp.Name(), b.identityFile, filepath.Join(b.dataDir, PrivateKeyFileName)} {
+		if abs, err := filepath.Abs(file); err == nil {
+			skip[abs] = true
+		}
+	}
+	if err = addDir(tw, backupDataDir, b.dataDir, skip); err != nil {
+		return err
+	}
+	for _, db := range databases {
+		logrus.Infof("Dumping the %s database", db.name)
+		if err = addDatabase(tw, db); err != nil {
+			return fmt.Errorf("failed to dump the %s database: %s", db.name, err)
+		}
+	}
+	// Media kept in the data directory are in the archive already.
+	if b.mediaDir != "" && !within(b.mediaDir, b.dataDir) {
+		if err = addDir(tw, backupMediaDir, b.mediaDir, skip); err != nil {
+			return err
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), archive)
+}
+
+// addDir adds the regular files under a directory to the archive, other than
+// those to skip.
+func addDir(tw *tar.Writer, prefix, dir string, skip map[string]bool) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || skip[file] {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		return addFile(tw, prefix+filepath.ToSlash(rel), file)
+	})
+}
+
+// within returns whether a path is a directory or is under it.
+func within(file, dir string) bool {
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return false
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, file)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func addFile(tw *tar.Writer, name, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint: errcheck
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err = tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// addDatabase dumps a database with pg_dump into the archive. It is dumped
+// to a temporary file first, as the size has to be known up front.
+func addDatabase(tw *tar.Writer, db componentDatabase) error {
+	dump, err := ioutil.TempFile("", "dendrite-p2p-"+db.name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dump.Name()) // nolint: errcheck
+	if err = dump.Close(); err != nil {
+		return err
+	}
+	if err = pgCommand("pg_dump", *db.dsn, "--format=custom", "--no-owner", "--file="+dump.Name()).Run(); err != nil {
+		return err
+	}
+	return addFile(tw, backupDatabasesDir+db.name+".dump", dump.Name())
+}
+
+// restore restores an archive onto this machine. It won't replace the keys
+// of an existing node, as the node would lose its identity. The databases
+// have to exist already, as they would for a new node, but whatever they
+// hold is replaced.
+func (b *backup) restore(archive string) error {
+	signingFile := filepath.Join(b.dataDir, SigningKeyFileName)
+	for _, file := range []string{b.identityFile, signingFile} {
+		if _, err := os.Stat(file); err == nil {
+			return fmt.Errorf("%s already exists, so there is already a node here", file)
+		}
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint: errcheck
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+
+	header, err := tr.Next()
+	if err != nil {
+		return err
+	}
+	if header.Name != backupManifestName {
+		return fmt.Errorf("%s isn't a backup", archive)
+	}
+	var manifest backupManifest
+	if err = json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return err
+	}
+	if manifest.Version > BackupVersion {
+		return fmt.Errorf("the backup is version %d, which is newer than we can restore", manifest.Version)
+	}
+	dsns := make(map[string]config.DataSource)
+	for _, db := range b.databases {
+		dsns[db.name] = *db.dsn
+	}
+
+	// The keys are put in place last, so that a restore that fails part way
+	// through can be tried again.
+	keyFiles := map[string]string{
+		backupDataDir + PrivateKeyFileName: b.identityFile,
+		backupDataDir + SigningKeyFileName: signingFile,
+	}
+	var restoredKeys []string
+	defer func() {
+		for _, file := range restoredKeys {
+			os.Remove(file + ".restoring") // nolint: errcheck
+		}
+	}()
+	skippedMedia := false
+	for {
+		header, err = tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := header.Name
+		switch {
+		case keyFiles[name] != "":
+			restoredKeys = append(restoredKeys, keyFiles[name])
+			err = extractFile(tr, header, keyFiles[name]+".restoring")
+		case strings.HasPrefix(name, backupDataDir):
+			err = extractInto(tr, header, b.dataDir, strings.TrimPrefix(name, backupDataDir))
+		case strings.HasPrefix(name, backupMediaDir):
+			if b.mediaDir == "" {
+				skippedMedia = true
+				continue
+			}
+			err = extractInto(tr, header, b.mediaDir, strings.TrimPrefix(name, backupMediaDir))
+		case strings.HasPrefix(name, backupDatabasesDir):
+			dbName := strings.TrimSuffix(strings.TrimPrefix(name, backupDatabasesDir), ".dump")
+			dsn, ok := dsns[dbName]
+			if !ok {
+				return fmt.Errorf("the backup has a database that we don't: %s", dbName)
+			}
+			logrus.Infof("Restoring the %s database", dbName)
+			if err = restoreDatabase(tr, dsn); err != nil {
+				err = fmt.Errorf("failed to restore the %s database: %s", dbName, err)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if skippedMedia {
+		logrus.Warn("The backup has media files, but they weren't restored as there is no media directory")
+	}
+	for _, file := range restoredKeys {
+		if err = os.Rename(file+".restoring", file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractInto extracts a file to a path relative to a directory, refusing
+// paths that would take it out of the directory.
+func extractInto(r io.Reader, header *tar.Header, dir, name string) error {
+	name = path.Clean("/" + name)[1:]
+	if name == "" {
+		return fmt.Errorf("invalid file name in backup: %s", header.Name)
+	}
+	return extractFile(r, header, filepath.Join(dir, filepath.FromSlash(name)))
+}
+
+func extractFile(r io.Reader, header *tar.Header, file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(header.Mode)&os.ModePerm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close() // nolint: errcheck
+		return err
+	}
+	return f.Close()
+}
+
+// restoreDatabase restores a database from a pg_dump dump with pg_restore,
+// replacing the tables that it already has.
+func restoreDatabase(r io.Reader, dsn config.DataSource) error {
+	dump, err := ioutil.TempFile("", "dendrite-p2p-restore")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dump.Name()) // nolint: errcheck
+	if _, err = io.Copy(dump, r); err != nil {
+		dump.Close() // nolint: errcheck
+		return err
+	}
+	if err = dump.Close(); err != nil {
+		return err
+	}
+	return pgCommand(
+		"pg_restore", dsn, "--clean", "--if-exists", "--no-owner", "--single-transaction", dump.Name(),
+	).Run()
+}
+
+// pgCommand runs one of the Postgres tools against a database. The password
+// is given in the environment rather than the arguments, where anyone on
+// the machine could see it.
+func pgCommand(program string, dsn config.DataSource, args ...string) *exec.Cmd {
+	env := os.Environ()
+	dbname := string(dsn)
+	if u, err := url.Parse(dbname); err == nil && u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			env = append(env, "PGPASSWORD="+password)
+			u.User = url.User(u.User.Username())
+			dbname = u.String()
+		}
+	}
+	cmd := exec.Command(program, append([]string{"--dbname=" + dbname}, args...)...)
+	cmd.Env = env
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd
+}
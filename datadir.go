@@ -0,0 +1,70 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/matrix-org/dendrite-p2p-demo/p2pnode"
+	"github.com/sirupsen/logrus"
+)
+
+// DataDirName is the name of our directory under $XDG_DATA_HOME.
+const DataDirName = "dendrite-p2p"
+
+// legacyFileNames are the files that used to be kept directly in the home
+// directory, before there was a data directory.
+var legacyFileNames = []string{
+	PrivateKeyFileName,
+	SigningKeyFileName,
+	p2pnode.PeerStoreFileName,
+	p2pnode.PeerGateFileName,
+	p2pnode.AdminTokenFileName,
+	p2pnode.TorOnionKeyFileName,
+}
+
+// defaultDataDir returns $XDG_DATA_HOME/dendrite-p2p, where $XDG_DATA_HOME
+// defaults to ~/.local/share as the XDG base directory spec says.
+func defaultDataDir(homeDir string) string {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if !filepath.IsAbs(dataHome) {
+		dataHome = filepath.Join(homeDir, ".local", "share")
+	}
+	return filepath.Join(dataHome, DataDirName)
+}
+
+// migrateLegacyFiles moves any files from the home directory into the data
+// directory, unless the data directory already has its own copy.
+func migrateLegacyFiles(homeDir, dataDir string) error {
+	for _, name := range legacyFileNames {
+		from, to := filepath.Join(homeDir, name), filepath.Join(dataDir, name)
+		if from == to {
+			continue
+		}
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		if _, err := os.Stat(to); err == nil {
+			logrus.Warnf("Not moving %s to %s, which already exists", from, to)
+			continue
+		}
+		logrus.Infof("Moving %s to %s", from, to)
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
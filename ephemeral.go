@@ -0,0 +1,101 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+
+	// Import the postgres database driver.
+	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// ephemeral is the state of a throwaway node: a temporary data directory,
+// and a set of databases with a random suffix so that any number of nodes
+// can share the same Postgres.
+type ephemeral struct {
+	dataDir   string
+	dbbase    string
+	suffix    string
+	databases []string
+}
+
+// newEphemeral creates the data directory. The databases are created one at
+// a time by database.
+func newEphemeral(dbbase string) (*ephemeral, error) {
+	dataDir, err := ioutil.TempDir("", "dendrite-p2p-")
+	if err != nil {
+		return nil, err
+	}
+	var suffix [4]byte
+	if _, err = rand.Read(suffix[:]); err != nil {
+		return nil, err
+	}
+	return &ephemeral{
+		dataDir: dataDir,
+		dbbase:  dbbase,
+		suffix:  "_" + hex.EncodeToString(suffix[:]),
+	}, nil
+}
+
+// database creates a new database, which needs the Postgres user to have the
+// CREATEDB privilege, and returns its name.
+func (e *ephemeral) database(name string) (string, error) {
+	name += e.suffix
+	db, err := sql.Open("postgres", e.dbbase+"/postgres?sslmode=disable")
+	if err != nil {
+		return "", err
+	}
+	defer db.Close() // nolint: errcheck
+	// Database names can't be query parameters, but we made this one.
+	if _, err = db.Exec("CREATE DATABASE " + name); err != nil {
+		return "", err
+	}
+	e.databases = append(e.databases, name)
+	return name, nil
+}
+
+// terminateSessionsSQL disconnects everything that is still connected to a
+// database, which Postgres won't drop while anything is.
+const terminateSessionsSQL = "" +
+	"SELECT pg_terminate_backend(pid) FROM pg_stat_activity" +
+	" WHERE datname = $1 AND pid <> pg_backend_pid()"
+
+// cleanup drops the databases and removes the data directory. It should be
+// called once the node has stopped, which closes the node's own connections
+// to the databases. Dendrite's components open theirs when they are set up
+// and never close them, nor give us a way to, so those are disconnected
+// first.
+func (e *ephemeral) cleanup() {
+	db, err := sql.Open("postgres", e.dbbase+"/postgres?sslmode=disable")
+	if err == nil {
+		defer db.Close() // nolint: errcheck
+		for _, name := range e.databases {
+			if _, err = db.Exec(terminateSessionsSQL, name); err != nil {
+				logrus.WithError(err).Warnf("Failed to disconnect from database %s", name)
+			}
+			if _, err = db.Exec("DROP DATABASE IF EXISTS " + name); err != nil {
+				logrus.WithError(err).Warnf("Failed to drop database %s", name)
+			}
+		}
+	}
+	if err = os.RemoveAll(e.dataDir); err != nil {
+		logrus.WithError(err).Warnf("Failed to remove %s", e.dataDir)
+	}
+}
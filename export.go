@@ -0,0 +1,66 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/sirupsen/logrus"
+)
+
+// exportDatabases copies the databases of a node into new databases under
+// a Postgres URL for a Dendrite deployment, e.g. on another machine, and
+// points the config at the copies. As with a new node, the databases have to
+// exist already. The tables that only the node uses are left behind.
+func exportDatabases(databases []componentDatabase, postgres string) error {
+	copies := make(map[config.DataSource]config.DataSource)
+	for _, db := range databases {
+		if to, ok := copies[*db.dsn]; ok {
+			*db.dsn = to
+			continue
+		}
+		to := config.DataSource(strings.TrimSuffix(postgres, "/") + "/dendrite_" + db.name + "?sslmode=disable")
+		logrus.Infof("Copying the %s database", db.name)
+		if err := copyDatabase(*db.dsn, to); err != nil {
+			return fmt.Errorf("failed to copy the %s database: %s", db.name, err)
+		}
+		copies[*db.dsn] = to
+		*db.dsn = to
+	}
+	return nil
+}
+
+func copyDatabase(from, to config.DataSource) error {
+	dump, err := ioutil.TempFile("", "dendrite-p2p-export")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dump.Name()) // nolint: errcheck
+	if err = dump.Close(); err != nil {
+		return err
+	}
+	if err = pgCommand(
+		"pg_dump", from, "--format=custom", "--no-owner", "--exclude-table=p2p_*", "--file="+dump.Name(),
+	).Run(); err != nil {
+		return err
+	}
+	return pgCommand(
+		"pg_restore", to, "--clean", "--if-exists", "--no-owner", "--single-transaction", dump.Name(),
+	).Run()
+}
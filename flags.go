@@ -0,0 +1,227 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/dendrite-p2p-demo/p2pnode"
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+// peerAddrsFlag is a repeatable command line flag which collects peer
+// multiaddrs, checking that each one is valid as it is given.
+type peerAddrsFlag []string
+
+// String implements flag.Value
+func (f *peerAddrsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Set implements flag.Value
+func (f *peerAddrsFlag) Set(value string) error {
+	if _, err := p2pnode.ParsePeerAddr(value); err != nil {
+		return err
+	}
+	for _, addr := range *f {
+		if addr == value {
+			return nil
+		}
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// connectFlag is a repeatable command line flag which collects invites from
+// other nodes, checking that each one is valid as it is given.
+type connectFlag []peer.AddrInfo
+
+// String implements flag.Value
+func (f *connectFlag) String() string {
+	return ""
+}
+
+// Set implements flag.Value
+func (f *connectFlag) Set(value string) error {
+	info, err := p2pnode.ParseInvite(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, *info)
+	return nil
+}
+
+// appServiceFlag is a repeatable command line flag which collects the paths
+// of application service registration files, checking that each one is
+// there as it is given. The registrations themselves are checked once they
+// are all loaded.
+type appServiceFlag []string
+
+// String implements flag.Value
+func (f *appServiceFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Set implements flag.Value
+func (f *appServiceFlag) Set(value string) error {
+	path, err := filepath.Abs(value)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(path); err != nil {
+		return err
+	}
+	for _, existing := range *f {
+		if existing == path {
+			return nil
+		}
+	}
+	*f = append(*f, path)
+	return nil
+}
+
+// accountFlag is a command line flag which holds an account to create, given
+// as <user>:<password>.
+type accountFlag struct {
+	localpart, password string
+}
+
+// String implements flag.Value
+func (f *accountFlag) String() string {
+	return f.localpart
+}
+
+// Set implements flag.Value
+func (f *accountFlag) Set(value string) (err error) {
+	f.localpart, f.password, err = p2pnode.ParseAccount(value)
+	return
+}
+
+// thumbnailSizesFlag is a repeatable command line flag which collects the
+// sizes of the thumbnails to make of every image, checking that each one is
+// valid as it is given.
+type thumbnailSizesFlag []config.ThumbnailSize
+
+// String implements flag.Value
+func (f *thumbnailSizesFlag) String() string {
+	sizes := make([]string, len(*f))
+	for i, size := range *f {
+		sizes[i] = fmt.Sprintf("%dx%d:%s", size.Width, size.Height, size.ResizeMethod)
+	}
+	return strings.Join(sizes, ",")
+}
+
+// Set implements flag.Value
+func (f *thumbnailSizesFlag) Set(value string) error {
+	size, err := p2pnode.ParseThumbnailSize(value)
+	if err != nil {
+		return err
+	}
+	for _, existing := range *f {
+		if existing == size {
+			return nil
+		}
+	}
+	*f = append(*f, size)
+	return nil
+}
+
+// tenantsFlag is a repeatable command line flag which collects the tenants
+// to host, given as <name>=<host>, checking that each one is valid as it is
+// given.
+type tenantsFlag []p2pnode.Tenant
+
+// String implements flag.Value
+func (f *tenantsFlag) String() string {
+	tenants := make([]string, len(*f))
+	for i, t := range *f {
+		tenants[i] = t.Name + "=" + t.Host
+	}
+	return strings.Join(tenants, ",")
+}
+
+// Set implements flag.Value
+func (f *tenantsFlag) Set(value string) error {
+	t, err := p2pnode.ParseTenant(value)
+	if err != nil {
+		return err
+	}
+	for _, existing := range *f {
+		if existing == t {
+			return nil
+		}
+	}
+	*f = append(*f, t)
+	return nil
+}
+
+// seedFlag is a command line flag which holds a seed, which may be any
+// number including 0, or nil if the flag wasn't given.
+type seedFlag struct {
+	seed *int64
+}
+
+// String implements flag.Value
+func (f *seedFlag) String() string {
+	if f.seed == nil {
+		return ""
+	}
+	return strconv.FormatInt(*f.seed, 10)
+}
+
+// Set implements flag.Value
+func (f *seedFlag) Set(value string) error {
+	seed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return err
+	}
+	f.seed = &seed
+	return nil
+}
+
+// applyEnvToFlags sets every flag that wasn't given on the command line from
+// its environment variable, if there is one. The variable for a flag is
+// p2pnode.EnvPrefix followed by its name in upper case, with dashes replaced
+// by underscores, e.g. DENDRITE_P2P_MAX_PEERS for -max-peers. If any names
+// are given then only those flags are set.
+func applyEnvToFlags(names ...string) error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	only := make(map[string]bool, len(names))
+	for _, name := range names {
+		only[name] = true
+	}
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil || (len(only) > 0 && !only[f.Name]) {
+			return
+		}
+		envName := p2pnode.EnvPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value, ok := os.LookupEnv(envName); ok {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("invalid value for %s: %s", envName, setErr)
+			}
+		}
+	})
+	return err
+}
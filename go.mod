@@ -8,15 +8,43 @@ require (
 	github.com/eapache/go-resiliency v0.0.0-20160104191539-b86b1ec0dd42 // indirect
 	github.com/eapache/go-xerial-snappy v0.0.0-20160609142408-bb955e01b934 // indirect
 	github.com/eapache/queue v1.1.0 // indirect
+	github.com/gorilla/mux v1.7.3
+	github.com/ipfs/go-cid v0.0.4
+	github.com/ipfs/go-log v0.0.1
 	github.com/klauspost/crc32 v0.0.0-20161016154125-cb6bfca970f6 // indirect
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
+	github.com/lib/pq v1.2.0
+	github.com/libp2p/go-libp2p-autonat v0.1.1
+	github.com/libp2p/go-libp2p-circuit v0.1.4
+	github.com/libp2p/go-libp2p-connmgr v0.2.1
+	github.com/libp2p/go-libp2p-core v0.3.0
+	github.com/libp2p/go-libp2p-discovery v0.2.0
 	github.com/libp2p/go-libp2p-gostream v0.2.0
+	github.com/libp2p/go-libp2p-http v0.1.4
+	github.com/libp2p/go-libp2p-kad-dht v0.5.0
+	github.com/libp2p/go-libp2p-pubsub v0.2.5
+	github.com/libp2p/go-libp2p-transport-upgrader v0.1.1
 	github.com/matrix-org/dendrite v0.0.0-20200202120312-6f0905c5868e
+	github.com/matrix-org/go-libp2p v0.5.1-0.20200131141255-120fb4b4f73a
+	github.com/matrix-org/gomatrixserverlib v0.0.0-20200124100636-0c2ec91d1df5
+	github.com/matrix-org/util v0.0.0-20171127121716-2e2df66af2f5
+	github.com/multiformats/go-multiaddr v0.2.0
+	github.com/multiformats/go-multiaddr-fmt v0.1.0
+	github.com/multiformats/go-multiaddr-net v0.1.1
+	github.com/multiformats/go-multihash v0.0.10
+	github.com/opentracing/opentracing-go v1.0.2
 	github.com/pierrec/lz4 v0.0.0-20161206202305-5c9560bfa9ac // indirect
 	github.com/pierrec/xxHash v0.0.0-20160112165351-5a004441f897 // indirect
 	github.com/prometheus/client_golang v1.4.0
 	github.com/rcrowley/go-metrics v0.0.0-20161128210544-1f30fe9094a5 // indirect
 	github.com/sirupsen/logrus v1.4.2
 	github.com/uber-go/atomic v1.3.0 // indirect
+	github.com/uber/jaeger-client-go v2.15.0+incompatible
+	github.com/whyrusleeping/go-logging v0.0.1
 	go.uber.org/atomic v1.3.0 // indirect
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
+	gopkg.in/Shopify/sarama.v1 v1.11.0
+	gopkg.in/yaml.v2 v2.2.5
+	rsc.io/qr v0.2.0
 )
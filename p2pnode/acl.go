@@ -0,0 +1,342 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// ServerACLEventType is the type of the state event that lists the servers
+// that may take part in a room.
+const ServerACLEventType = "m.room.server_acl"
+
+// aclRoomPathPrefixes are the federation APIs whose next path segment is a
+// room ID. Requests to them from servers that the room's ACL denies are
+// refused.
+var aclRoomPathPrefixes = []string{
+	"/_matrix/federation/v1/state/",
+	"/_matrix/federation/v1/state_ids/",
+	"/_matrix/federation/v1/make_join/",
+	"/_matrix/federation/v1/make_leave/",
+	"/_matrix/federation/v1/get_missing_events/",
+	"/_matrix/federation/v1/backfill/",
+	"/_matrix/federation/v1/exchange_third_party_invite/",
+	"/_matrix/federation/v1/invite/",
+	"/_matrix/federation/v2/send_join/",
+	"/_matrix/federation/v2/send_leave/",
+	SpaceHierarchyFederationPathPrefix,
+}
+
+// serverACLContent is the content of an m.room.server_acl event.
+type serverACLContent struct {
+	Allow           []string `json:"allow"`
+	Deny            []string `json:"deny"`
+	AllowIPLiterals *bool    `json:"allow_ip_literals"`
+}
+
+// serverACL is the server ACL of a room, with the globs compiled.
+type serverACL struct {
+	allow           []*regexp.Regexp
+	deny            []*regexp.Regexp
+	allowIPLiterals bool
+}
+
+func newServerACL(content []byte) (*serverACL, error) {
+	var c serverACLContent
+	if err := json.Unmarshal(content, &c); err != nil {
+		return nil, err
+	}
+	acl := &serverACL{allowIPLiterals: c.AllowIPLiterals == nil || *c.AllowIPLiterals}
+	for _, glob := range c.Allow {
+		acl.allow = append(acl.allow, compileServerGlob(glob))
+	}
+	for _, glob := range c.Deny {
+		acl.deny = append(acl.deny, compileServerGlob(glob))
+	}
+	return acl, nil
+}
+
+// compileServerGlob turns a glob from a server ACL, where * matches any
+// number of characters and ? matches one, into a regexp for the whole name.
+func compileServerGlob(glob string) *regexp.Regexp {
+	expr := regexp.QuoteMeta(glob)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	return regexp.MustCompile("^" + expr + "$")
+}
+
+// allowed reports whether the ACL lets a server take part in the room. The
+// port of the server name is ignored, as the spec says.
+func (acl *serverACL) allowed(server gomatrixserverlib.ServerName) bool {
+	if acl == nil {
+		return true
+	}
+	host := string(server)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if !acl.allowIPLiterals && net.ParseIP(host) != nil {
+		return false
+	}
+	for _, re := range acl.deny {
+		if re.MatchString(host) {
+			return false
+		}
+	}
+	for _, re := range acl.allow {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// serverACLs enforces the server ACLs of rooms on federation, both inbound
+// and outbound, so that room admins can ban abusive servers from their
+// rooms. The ACL of each room is looked up from the room server the first
+// time that it is needed, and forgotten whenever a new one is sent.
+type serverACLs struct {
+	query api.RoomserverQueryAPI
+
+	mu sync.RWMutex
+	// room ID -> ACL, or nil if the room doesn't have one
+	rooms map[string]*serverACL
+}
+
+func newServerACLs() *serverACLs {
+	return &serverACLs{rooms: make(map[string]*serverACL)}
+}
+
+// start consumes the room server output log, forgetting the ACL of a room
+// whenever a new one is sent in it.
+func (a *serverACLs) start(consumer sarama.Consumer, topic string) error {
+	c := common.ContinualConsumer{
+		Topic:          topic,
+		Consumer:       consumer,
+		PartitionStore: &memoryPartitionStore{},
+		ProcessMessage: a.onMessage,
+	}
+	return c.Start()
+}
+
+func (a *serverACLs) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		logrus.WithError(err).Error("Server ACLs: message parse failure")
+		return nil
+	}
+	if output.Type != api.OutputTypeNewRoomEvent {
+		return nil
+	}
+	ev := output.NewRoomEvent.Event
+	if ev.Type() != ServerACLEventType || ev.StateKey() == nil || *ev.StateKey() != "" {
+		return nil
+	}
+	a.mu.Lock()
+	delete(a.rooms, ev.RoomID())
+	a.mu.Unlock()
+	return nil
+}
+
+// acl returns the server ACL of a room, or nil if it doesn't have one.
+func (a *serverACLs) acl(ctx context.Context, roomID string) (*serverACL, error) {
+	a.mu.RLock()
+	acl, ok := a.rooms[roomID]
+	a.mu.RUnlock()
+	if ok || a.query == nil {
+		return acl, nil
+	}
+	req := api.QueryLatestEventsAndStateRequest{
+		RoomID:       roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{{EventType: ServerACLEventType, StateKey: ""}},
+	}
+	var res api.QueryLatestEventsAndStateResponse
+	if err := a.query.QueryLatestEventsAndState(ctx, &req, &res); err != nil {
+		return nil, err
+	}
+	for _, ev := range res.StateEvents {
+		if acl, err := newServerACL(ev.Content()); err != nil {
+			logrus.WithError(err).WithField("room_id", roomID).Warn("Ignoring malformed server ACL")
+		} else {
+			a.mu.Lock()
+			a.rooms[roomID] = acl
+			a.mu.Unlock()
+			return acl, nil
+		}
+	}
+	if res.RoomExists {
+		a.mu.Lock()
+		a.rooms[roomID] = nil
+		a.mu.Unlock()
+	}
+	return nil, nil
+}
+
+// allowed reports whether the ACL of a room lets a server take part in it.
+// Rooms whose ACL can't be looked up are taken to allow everyone.
+func (a *serverACLs) allowed(ctx context.Context, roomID string, server gomatrixserverlib.ServerName) bool {
+	if a == nil {
+		return true
+	}
+	acl, err := a.acl(ctx, roomID)
+	if err != nil {
+		logrus.WithError(err).WithField("room_id", roomID).Warn("Failed to look up server ACL")
+		return true
+	}
+	return acl.allowed(server)
+}
+
+// wrap refuses the federation requests about a room from servers that the
+// room's ACL denies. The origin is taken from the Authorization header
+// before the request has been verified, which is fine since the request
+// would be refused anyway if it were forged.
+func (a *serverACLs) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		roomID := aclRoomID(req.URL.Path)
+		origin := requestOrigin(req)
+		if roomID == "" || origin == "" || a.allowed(req.Context(), roomID, origin) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(jsonerror.Forbidden("Server is banned from this room"))
+	})
+}
+
+// aclRoomID returns the room ID that a federation request is about, or ""
+// if it isn't about a room.
+func aclRoomID(path string) string {
+	for _, prefix := range aclRoomPathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return strings.SplitN(strings.TrimPrefix(path, prefix), "/", 2)[0]
+		}
+	}
+	return ""
+}
+
+// requestOrigin returns the origin in the X-Matrix Authorization header of a
+// federation request, or "" if there isn't one.
+func requestOrigin(req *http.Request) gomatrixserverlib.ServerName {
+	scheme, params := "", req.Header.Get("Authorization")
+	if i := strings.IndexByte(params, ' '); i >= 0 {
+		scheme, params = params[:i], params[i+1:]
+	}
+	if scheme != "X-Matrix" {
+		return ""
+	}
+	for _, param := range strings.Split(params, ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 && kv[0] == "origin" {
+			return gomatrixserverlib.ServerName(strings.Trim(kv[1], `"`))
+		}
+	}
+	return ""
+}
+
+// aclTransport wraps the transport of the federation client, leaving the
+// events of rooms whose ACL denies the destination out of the transactions
+// sent to it. Transactions that have had events taken out are signed again.
+type aclTransport struct {
+	next       http.RoundTripper
+	acls       *serverACLs
+	serverName gomatrixserverlib.ServerName
+	keyID      gomatrixserverlib.KeyID
+	privateKey ed25519.PrivateKey
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *aclTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPut || !strings.HasPrefix(req.URL.Path, SendFederationPathPrefix) || req.Body == nil {
+		return t.next.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close() // nolint: errcheck
+	if err != nil {
+		return nil, err
+	}
+	destination := gomatrixserverlib.ServerName(req.URL.Host)
+	var txn map[string]json.RawMessage
+	var pdus []json.RawMessage
+	if err = json.Unmarshal(body, &txn); err == nil {
+		err = json.Unmarshal(txn["pdus"], &pdus)
+	}
+	if err != nil {
+		// We can't tell which rooms the transaction is about, so it goes as
+		// it is.
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return t.next.RoundTrip(req)
+	}
+	allowed := pdus[:0:0]
+	for _, pdu := range pdus {
+		var ev struct {
+			RoomID string `json:"room_id"`
+		}
+		if json.Unmarshal(pdu, &ev) == nil && !t.acls.allowed(req.Context(), ev.RoomID, destination) {
+			continue
+		}
+		allowed = append(allowed, pdu)
+	}
+	if len(allowed) == len(pdus) {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return t.next.RoundTrip(req)
+	}
+	logrus.WithFields(logrus.Fields{
+		"destination": destination,
+		"dropped":     len(pdus) - len(allowed),
+	}).Debug("Leaving events out of transaction for server denied by room ACL")
+	var edus []json.RawMessage
+	if len(allowed) == 0 && (json.Unmarshal(txn["edus"], &edus) != nil || len(edus) == 0) {
+		return sentResponse(req), nil
+	}
+	if txn["pdus"], err = json.Marshal(allowed); err != nil {
+		return nil, err
+	}
+	fedReq := gomatrixserverlib.NewFederationRequest(req.Method, destination, req.URL.RequestURI())
+	if err = fedReq.SetContent(txn); err != nil {
+		return nil, err
+	}
+	if err = fedReq.Sign(t.serverName, t.keyID, t.privateKey); err != nil {
+		return nil, err
+	}
+	signed, err := fedReq.HTTPRequest()
+	if err != nil {
+		return nil, err
+	}
+	signed = signed.WithContext(req.Context())
+	for key, values := range req.Header {
+		if key != "Authorization" {
+			signed.Header[key] = values
+		}
+	}
+	return t.next.RoundTrip(signed)
+}
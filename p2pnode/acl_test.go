@@ -0,0 +1,232 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestServerACLAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		server  gomatrixserverlib.ServerName
+		allowed bool
+	}{
+		{"no allow", `{}`, "example.com", false},
+		{"allow all", `{"allow":["*"]}`, "example.com", true},
+		{"denied", `{"allow":["*"],"deny":["evil.com"]}`, "evil.com", false},
+		{"deny wins", `{"allow":["evil.com"],"deny":["evil.com"]}`, "evil.com", false},
+		{"deny glob", `{"allow":["*"],"deny":["*.evil.com"]}`, "sub.evil.com", false},
+		{"deny glob on another server", `{"allow":["*"],"deny":["*.evil.com"]}`, "evil.com", true},
+		{"question mark", `{"allow":["server?.com"]}`, "server1.com", true},
+		{"question mark is one character", `{"allow":["server?.com"]}`, "server12.com", false},
+		{"dot is literal", `{"allow":["a.b"]}`, "axb", false},
+		{"port ignored", `{"allow":["*"],"deny":["evil.com"]}`, "evil.com:8448", false},
+		{"IP literal", `{"allow":["*"]}`, "192.0.2.1", true},
+		{"IP literal denied", `{"allow":["*"],"allow_ip_literals":false}`, "192.0.2.1:8448", false},
+		{"IPv6 literal denied", `{"allow":["*"],"allow_ip_literals":false}`, "[2001:db8::1]:8448", false},
+		{"name with IP literals denied", `{"allow":["*"],"allow_ip_literals":false}`, "example.com", true},
+		{"peer ID", `{"allow":["12D3KooW*"]}`, "12D3KooWExample", true},
+	}
+	for _, tt := range tests {
+		acl, err := newServerACL([]byte(tt.content))
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if got := acl.allowed(tt.server); got != tt.allowed {
+			t.Errorf("%s: %s got allowed %v, wanted %v", tt.name, tt.server, got, tt.allowed)
+		}
+	}
+	var acl *serverACL
+	if !acl.allowed("example.com") {
+		t.Error("room without an ACL doesn't allow everyone")
+	}
+}
+
+func TestACLRoomID(t *testing.T) {
+	tests := []struct {
+		path   string
+		roomID string
+	}{
+		{"/_matrix/federation/v1/state/!room:example.com", "!room:example.com"},
+		{"/_matrix/federation/v1/make_join/!room:example.com/@alice:example.com", "!room:example.com"},
+		{"/_matrix/federation/v2/send_join/!room:example.com/$event", "!room:example.com"},
+		{"/_matrix/federation/v1/invite/!room:example.com/$event", "!room:example.com"},
+		{SpaceHierarchyFederationPathPrefix + "!space:example.com", "!space:example.com"},
+		{"/_matrix/federation/v1/send/txn1", ""},
+		{"/_matrix/federation/v1/version", ""},
+	}
+	for _, tt := range tests {
+		if got := aclRoomID(tt.path); got != tt.roomID {
+			t.Errorf("%s: got room ID %q, wanted %q", tt.path, got, tt.roomID)
+		}
+	}
+}
+
+func TestRequestOrigin(t *testing.T) {
+	tests := []struct {
+		header string
+		origin gomatrixserverlib.ServerName
+	}{
+		{`X-Matrix origin=example.com,key="ed25519:1",sig="abc"`, "example.com"},
+		{`X-Matrix key="ed25519:1", origin="example.com", sig="abc"`, "example.com"},
+		{`Bearer origin=example.com`, ""},
+		{`X-Matrix key="ed25519:1",sig="abc"`, ""},
+		{``, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/federation/v1/version", nil)
+		req.Header.Set("Authorization", tt.header)
+		if got := requestOrigin(req); got != tt.origin {
+			t.Errorf("%q: got origin %q, wanted %q", tt.header, got, tt.origin)
+		}
+	}
+}
+
+func TestServerACLsWrap(t *testing.T) {
+	acl, err := newServerACL([]byte(`{"allow":["*"],"deny":["evil.com"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newServerACLs()
+	a.rooms["!room:example.com"] = acl
+	handler := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	tests := []struct {
+		name   string
+		path   string
+		origin string
+		status int
+	}{
+		{"allowed", "/_matrix/federation/v1/state/!room:example.com", "good.com", http.StatusOK},
+		{"denied", "/_matrix/federation/v1/state/!room:example.com", "evil.com", http.StatusForbidden},
+		{"invite denied", "/_matrix/federation/v1/invite/!room:example.com/$event", "evil.com", http.StatusForbidden},
+		{"invite allowed", "/_matrix/federation/v1/invite/!room:example.com/$event", "good.com", http.StatusOK},
+		{"not about a room", "/_matrix/federation/v1/version", "evil.com", http.StatusOK},
+		{"room without an ACL", "/_matrix/federation/v1/state/!other:example.com", "evil.com", http.StatusOK},
+		{"no origin", "/_matrix/federation/v1/state/!room:example.com", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.origin != "" {
+			req.Header.Set("Authorization", `X-Matrix origin=`+tt.origin+`,key="ed25519:1",sig="abc"`)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: got status %d, wanted %d", tt.name, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestACLTransport(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := newServerACL([]byte(`{"allow":["*"],"deny":["evil.com"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acls := newServerACLs()
+	acls.rooms["!banned:example.com"] = acl
+	acls.rooms["!open:example.com"] = nil
+
+	var sent []*http.Request
+	transport := &aclTransport{
+		next: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			sent = append(sent, req)
+			return sentResponse(req), nil
+		}),
+		acls:       acls,
+		serverName: "example.com",
+		keyID:      "ed25519:test",
+		privateKey: privateKey,
+	}
+	banned := `{"room_id":"!banned:example.com","type":"m.room.message"}`
+	open := `{"room_id":"!open:example.com","type":"m.room.message"}`
+	tests := []struct {
+		name        string
+		destination string
+		txn         string
+		sent        bool
+		pdus        int
+		resigned    bool
+	}{
+		{"allowed", "good.com", `{"pdus":[` + banned + `,` + open + `]}`, true, 2, false},
+		{"some denied", "evil.com", `{"pdus":[` + banned + `,` + open + `]}`, true, 1, true},
+		{"all denied", "evil.com", `{"pdus":[` + banned + `]}`, false, 0, false},
+		{"all denied with EDUs", "evil.com", `{"pdus":[` + banned + `],"edus":[{"edu_type":"m.typing"}]}`, true, 0, true},
+		{"not a transaction", "evil.com", `not json`, true, -1, false},
+	}
+	for _, tt := range tests {
+		sent = nil
+		req := httptest.NewRequest(http.MethodPut, "matrix://"+tt.destination+SendFederationPathPrefix+"txn1", strings.NewReader(tt.txn))
+		req.Header.Set("Authorization", "X-Matrix original")
+		res, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: got status %d", tt.name, res.StatusCode)
+		}
+		if !tt.sent {
+			if len(sent) != 0 {
+				t.Errorf("%s: transaction was sent", tt.name)
+			}
+			continue
+		}
+		if len(sent) != 1 {
+			t.Errorf("%s: got %d requests sent, wanted 1", tt.name, len(sent))
+			continue
+		}
+		if resigned := sent[0].Header.Get("Authorization") != "X-Matrix original"; resigned != tt.resigned {
+			t.Errorf("%s: got signed again %v, wanted %v", tt.name, resigned, tt.resigned)
+		}
+		body, err := ioutil.ReadAll(sent[0].Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var txn struct {
+			PDUs []json.RawMessage `json:"pdus"`
+		}
+		if tt.pdus < 0 {
+			if string(body) != tt.txn {
+				t.Errorf("%s: body was changed to %s", tt.name, body)
+			}
+		} else if err = json.Unmarshal(body, &txn); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		} else if len(txn.PDUs) != tt.pdus {
+			t.Errorf("%s: got %d PDUs, wanted %d", tt.name, len(txn.PDUs), tt.pdus)
+		}
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
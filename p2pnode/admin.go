@@ -0,0 +1,573 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// AdminPathPrefix is where the admin API is served. It is only served to
+// HTTP clients, never to other nodes over libp2p.
+const AdminPathPrefix = "/_dendrite/admin"
+
+// AdminTokenFileName is the name of the file, in the data directory, that
+// holds the access token for the admin API.
+const AdminTokenFileName = ".dendrite-p2p-admin-token"
+
+// RegistrationSecretFileName is the name of the file, in the data directory,
+// that holds the shared secret for registering accounts without going
+// through the usual registration flow, unless the config gives one.
+const RegistrationSecretFileName = ".dendrite-p2p-registration-secret"
+
+// AdminDialTimeout is how long the admin API waits to connect to a peer.
+const AdminDialTimeout = time.Second * 30
+
+// loadToken reads a secret token, e.g. the admin access token, from the
+// file, generating a new one if the file doesn't exist yet.
+func loadToken(filename string) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	token, err := auth.GenerateAccessToken()
+	if err != nil {
+		return "", err
+	}
+	return token, ioutil.WriteFile(filename, []byte(token+"\n"), 0600)
+}
+
+// makeAdminAPI turns a util.JSONRequestHandler function into an http.Handler
+// which checks that the request has the admin access token, given in the same
+// way as a Matrix access token.
+func (n *Node) makeAdminAPI(metricsName string, f func(*http.Request) util.JSONResponse) http.Handler {
+	return common.MakeExternalAPI(metricsName, func(req *http.Request) util.JSONResponse {
+		token, err := auth.ExtractAccessToken(req)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: jsonerror.MissingToken(err.Error()),
+			}
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(n.adminToken)) != 1 && !n.isAdminUser(req, token) {
+			return util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: jsonerror.UnknownToken("Unknown admin token"),
+			}
+		}
+		return f(req)
+	})
+}
+
+// adminDevices finds the device that an access token belongs to, which is
+// all that checking for admin users needs of the device database.
+type adminDevices interface {
+	GetDeviceByAccessToken(ctx context.Context, token string) (*authtypes.Device, error)
+}
+
+// isAdminUser returns whether an access token is one of an admin user's,
+// and hasn't expired.
+func (n *Node) isAdminUser(req *http.Request, token string) bool {
+	if len(n.adminUsers) == 0 || n.deviceDB == nil {
+		return false
+	}
+	if n.refreshTokens != nil && n.refreshTokens.expired(token) {
+		return false
+	}
+	device, err := n.deviceDB.GetDeviceByAccessToken(req.Context(), token)
+	if err != nil {
+		return false
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	return err == nil && n.adminUsers[localpart]
+}
+
+// ParseAccount parses an account to create, given as <user>:<password>,
+// returning the localpart of the user.
+func ParseAccount(value string) (localpart, password string, err error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid account %q: must be <user>:<password>", value)
+	}
+	localpart = strings.TrimPrefix(parts[0], "@")
+	if !validLocalpart.MatchString(localpart) {
+		return "", "", fmt.Errorf("invalid user %q: may only contain a-z, 0-9, -, ., _, = and /", parts[0])
+	}
+	return localpart, parts[1], nil
+}
+
+// validLocalpart matches the localparts that the client API lets users
+// register.
+var validLocalpart = regexp.MustCompile(`^[0-9a-z_\-=./]+$`)
+
+// CreateAccount creates an account with a password, if there isn't one
+// with the localpart already, so that scripts can run it every time that
+// the node starts. The password of an existing account is left as it is.
+func (n *Node) CreateAccount(ctx context.Context, localpart, password string) error {
+	account, err := n.accountDB.CreateAccount(ctx, localpart, password, "")
+	if err != nil {
+		return err
+	}
+	if account != nil {
+		logrus.WithField("user", localpart).Info("Created account")
+	}
+	return nil
+}
+
+// setupAdminAPI registers the admin API endpoints.
+func (n *Node) setupAdminAPI(router *mux.Router) {
+	r := router.PathPrefix(AdminPathPrefix).Subrouter()
+
+	r.Handle("/peers", n.makeAdminAPI("admin_peers", func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct {
+				Peers []PeerInfo `json:"peers"`
+			}{n.Peers()},
+		}
+	})).Methods(http.MethodGet)
+
+	r.Handle("/peers", n.makeAdminAPI("admin_peers_dial", func(req *http.Request) util.JSONResponse {
+		var body struct {
+			Addr   string `json:"addr"`
+			Invite string `json:"invite"`
+		}
+		if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+			return *resErr
+		}
+		var info *peer.AddrInfo
+		var err error
+		if body.Invite != "" {
+			info, err = ParseInvite(body.Invite)
+		} else {
+			info, err = ParsePeerAddr(body.Addr)
+		}
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid invite or peer multiaddr, which must include the peer ID: " + err.Error()),
+			}
+		}
+		if !n.Gate.Allowed(info.ID) {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("The peer isn't allowed by the gate"),
+			}
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), AdminDialTimeout)
+		defer cancel()
+		if err = connectPeer(ctx, n.Host, n.KeyDB, *info); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadGateway,
+				JSON: jsonerror.Unknown("Failed to connect to peer: " + err.Error()),
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: n.peerInfo(info.ID),
+		}
+	})).Methods(http.MethodPost)
+
+	r.Handle("/connect", n.makeAdminAPI("admin_connect", func(req *http.Request) util.JSONResponse {
+		var body struct {
+			Invite string `json:"invite"`
+		}
+		if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+			return *resErr
+		}
+		info, err := ParseInvite(body.Invite)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(err.Error()),
+			}
+		}
+		if !n.Gate.Allowed(info.ID) {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("The peer isn't allowed by the gate"),
+			}
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), AdminDialTimeout)
+		defer cancel()
+		if err = connectPeer(ctx, n.Host, n.KeyDB, *info); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadGateway,
+				JSON: jsonerror.Unknown("Failed to connect to peer: " + err.Error()),
+			}
+		}
+		if err = n.AddBootstrapPeer(*info); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to save bootstrap peer")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: n.peerInfo(info.ID),
+		}
+	})).Methods(http.MethodPost)
+
+	r.Handle("/peers/{peerID}", n.makeAdminAPI("admin_peers_disconnect", func(req *http.Request) util.JSONResponse {
+		id, err := peer.IDB58Decode(mux.Vars(req)["peerID"])
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid peer ID: " + err.Error()),
+			}
+		}
+		// Without a ban, the peer may well be connected to again straight
+		// away, by us or by it.
+		if req.URL.Query().Get("ban") == "true" {
+			if err = n.Gate.SetDenied(id, true); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("Failed to update peer gate")
+				return jsonerror.InternalServerError()
+			}
+		}
+		if err = n.Host.Network().ClosePeer(id); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to disconnect peer")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	})).Methods(http.MethodDelete)
+
+	r.Handle("/liveness", n.makeAdminAPI("admin_liveness", func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct {
+				Peers []PeerLiveness `json:"peers"`
+			}{n.Liveness()},
+		}
+	})).Methods(http.MethodGet)
+
+	r.Handle("/reputation", n.makeAdminAPI("admin_reputation", func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct {
+				Peers []PeerReputation `json:"peers"`
+			}{n.Reputations()},
+		}
+	})).Methods(http.MethodGet)
+
+	r.Handle("/invite", n.makeAdminAPI("admin_invite", func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct {
+				Invite string `json:"invite"`
+			}{n.Invite()},
+		}
+	})).Methods(http.MethodGet)
+
+	r.Handle("/dashboard", n.makeAdminAPI("admin_dashboard", func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: n.Dashboard(),
+		}
+	})).Methods(http.MethodGet)
+
+	r.Handle("/gate", n.makeAdminAPI("admin_gate", func(req *http.Request) util.JSONResponse {
+		allow, deny := n.Gate.Lists()
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: peerGateFile{
+				Allow: peerStrings(allow),
+				Deny:  peerStrings(deny),
+			},
+		}
+	})).Methods(http.MethodGet)
+
+	r.Handle("/gate/{list:allow|deny}/{peerID}", n.makeAdminAPI("admin_gate_peer", func(req *http.Request) util.JSONResponse {
+		vars := mux.Vars(req)
+		id, err := peer.IDB58Decode(vars["peerID"])
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid peer ID: " + err.Error()),
+			}
+		}
+		add := req.Method == http.MethodPut
+		if vars["list"] == "allow" {
+			err = n.Gate.SetAllowed(id, add)
+		} else {
+			err = n.Gate.SetDenied(id, add)
+		}
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to update peer gate")
+			return jsonerror.InternalServerError()
+		}
+		n.Gate.closeGated(n.Host)
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	})).Methods(http.MethodPut, http.MethodDelete)
+
+	r.Handle("/chaos", n.makeAdminAPI("admin_chaos", func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: n.Chaos.Settings(),
+		}
+	})).Methods(http.MethodGet)
+
+	r.Handle("/chaos", n.makeAdminAPI("admin_chaos_set", func(req *http.Request) util.JSONResponse {
+		var settings ChaosSettings
+		if req.Method == http.MethodPut {
+			if resErr := httputil.UnmarshalJSONRequest(req, &settings); resErr != nil {
+				return *resErr
+			}
+		}
+		ids := make([]peer.ID, len(settings.Partition))
+		for i, s := range settings.Partition {
+			id, err := peer.IDB58Decode(s)
+			if err != nil {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue("Invalid peer ID: " + err.Error()),
+				}
+			}
+			ids[i] = id
+		}
+		if settings.DelayMS < 0 || settings.DropRate < 0 || settings.DropRate > 1 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("delay_ms can't be negative and drop_rate must be between 0 and 1"),
+			}
+		}
+		n.Chaos.SetDelay(time.Duration(settings.DelayMS) * time.Millisecond)
+		n.Chaos.SetDropRate(settings.DropRate)
+		n.Chaos.Partition(ids)
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: n.Chaos.Settings(),
+		}
+	})).Methods(http.MethodPut, http.MethodDelete)
+
+	r.Handle("/federation_policy", n.makeAdminAPI("admin_federation_policy", func(req *http.Request) util.JSONResponse {
+		allow, deny := n.Policy.Lists()
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: federationPolicyFile{
+				Allow: allow,
+				Deny:  deny,
+			},
+		}
+	})).Methods(http.MethodGet)
+
+	r.Handle("/federation_policy/{list:allow|deny}/{pattern}", n.makeAdminAPI("admin_federation_policy_pattern", func(req *http.Request) util.JSONResponse {
+		vars := mux.Vars(req)
+		pattern := vars["pattern"]
+		if err := validateServerPattern(pattern); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(err.Error()),
+			}
+		}
+		add := req.Method == http.MethodPut
+		var err error
+		if vars["list"] == "allow" {
+			err = n.Policy.SetAllowed(pattern, add)
+		} else {
+			err = n.Policy.SetDenied(pattern, add)
+		}
+		if err == errPolicyInConfig {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("The pattern is set in the config file, so can't be removed here"),
+			}
+		}
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to update federation policy")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	})).Methods(http.MethodPut, http.MethodDelete)
+
+	r.Handle("/registration_tokens", n.makeAdminAPI("admin_registration_tokens", func(req *http.Request) util.JSONResponse {
+		tokens, err := n.registration.tokens(req.Context())
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to get registration tokens")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct {
+				Tokens []registrationToken `json:"registration_tokens"`
+			}{tokens},
+		}
+	})).Methods(http.MethodGet)
+
+	r.Handle("/registration_tokens", n.makeAdminAPI("admin_registration_tokens_new", func(req *http.Request) util.JSONResponse {
+		// A token can be used once unless it says otherwise, with null for
+		// any number of times.
+		uses := 1
+		token := registrationToken{UsesAllowed: &uses}
+		if resErr := httputil.UnmarshalJSONRequest(req, &token); resErr != nil {
+			return *resErr
+		}
+		if token.Token != "" && !validRegistrationToken.MatchString(token.Token) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("The token may only be up to 64 of A-Z, a-z, 0-9, ., _, ~ and -"),
+			}
+		}
+		if token.UsesAllowed != nil && *token.UsesAllowed < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("uses_allowed can't be negative"),
+			}
+		}
+		token.Completed = 0
+		created, err := n.registration.create(req.Context(), &token)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to create registration token")
+			return jsonerror.InternalServerError()
+		}
+		if !created {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("The token already exists"),
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: token,
+		}
+	})).Methods(http.MethodPost)
+
+	r.Handle("/registration_tokens/{token}", n.makeAdminAPI("admin_registration_tokens_delete", func(req *http.Request) util.JSONResponse {
+		deleted, err := n.registration.delete(req.Context(), mux.Vars(req)["token"])
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to delete registration token")
+			return jsonerror.InternalServerError()
+		}
+		if !deleted {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound("There is no such registration token"),
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	})).Methods(http.MethodDelete)
+
+	r.Handle("/users/{userID}/deactivate", n.makeAdminAPI("admin_users_deactivate", func(req *http.Request) util.JSONResponse {
+		localpart, domain, err := gomatrixserverlib.SplitID('@', mux.Vars(req)["userID"])
+		if err != nil || domain != n.Base.Cfg.Matrix.ServerName {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Not one of our users"),
+			}
+		}
+		var body struct {
+			Erase bool `json:"erase"`
+		}
+		if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+			return *resErr
+		}
+		account, err := n.accountDB.GetAccountByLocalpart(req.Context(), localpart)
+		if err == sql.ErrNoRows {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound("There is no such user"),
+			}
+		} else if err != nil || account == nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to get account")
+			return jsonerror.InternalServerError()
+		}
+		if err = n.deactivation.deactivate(req.Context(), localpart, body.Erase); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to deactivate account")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	})).Methods(http.MethodPost)
+
+	r.Handle("/rooms/{roomID}/purge_history", n.makeAdminAPI("admin_rooms_purge_history", func(req *http.Request) util.JSONResponse {
+		var body struct {
+			EventID string `json:"event_id"`
+		}
+		if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+			return *resErr
+		}
+		if body.EventID == "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("event_id is required"),
+			}
+		}
+		purged, err := n.retention.purgeBefore(req.Context(), mux.Vars(req)["roomID"], body.EventID)
+		if err == sql.ErrNoRows {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound("There is no such event in the room"),
+			}
+		} else if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to purge room history")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct {
+				Purged int `json:"purged"`
+			}{purged},
+		}
+	})).Methods(http.MethodPost)
+
+	r.Handle("/rooms/{roomID}", n.makeAdminAPI("admin_rooms_delete", func(req *http.Request) util.JSONResponse {
+		err := n.roomDeletion.delete(req.Context(), mux.Vars(req)["roomID"])
+		if err == errRoomNotFound {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound("There is no such room"),
+			}
+		} else if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to delete room")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	})).Methods(http.MethodDelete)
+}
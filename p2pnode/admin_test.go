@@ -0,0 +1,113 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/util"
+)
+
+// testAdminDevices maps access tokens to the users whose devices they are.
+type testAdminDevices map[string]string
+
+func (d testAdminDevices) GetDeviceByAccessToken(ctx context.Context, token string) (*authtypes.Device, error) {
+	userID, ok := d[token]
+	if !ok {
+		return nil, errors.New("unknown token")
+	}
+	return &authtypes.Device{UserID: userID, AccessToken: token}, nil
+}
+
+func TestMakeAdminAPI(t *testing.T) {
+	n := &Node{
+		adminToken: "admin-secret",
+		adminUsers: map[string]bool{"alice": true},
+		deviceDB: testAdminDevices{
+			"alice-token":   "@alice:example.com",
+			"alice-current": "@alice:example.com",
+			"alice-expired": "@alice:example.com",
+			"bob-token":     "@bob:example.com",
+		},
+		// alice-current and alice-expired came from logins with refresh
+		// tokens, so they expire.
+		refreshTokens: &refreshTokens{expiries: map[string]time.Time{
+			"alice-current": time.Now().Add(time.Minute),
+			"alice-expired": time.Now().Add(-time.Minute),
+		}},
+	}
+	tests := []struct {
+		name    string
+		header  string
+		query   string
+		status  int
+		errcode string
+	}{
+		{name: "admin token", header: "Bearer admin-secret", status: http.StatusOK},
+		{name: "admin token in query", query: "?access_token=admin-secret", status: http.StatusOK},
+		{name: "no token", status: http.StatusUnauthorized, errcode: "M_MISSING_TOKEN"},
+		{name: "wrong token", header: "Bearer admin-secre", status: http.StatusUnauthorized, errcode: "M_UNKNOWN_TOKEN"},
+		{name: "admin user", header: "Bearer alice-token", status: http.StatusOK},
+		{name: "admin user with refresh token", header: "Bearer alice-current", status: http.StatusOK},
+		{
+			name: "admin user after expiry", header: "Bearer alice-expired",
+			status: http.StatusUnauthorized, errcode: "M_UNKNOWN_TOKEN",
+		},
+		{name: "not an admin user", header: "Bearer bob-token", status: http.StatusUnauthorized, errcode: "M_UNKNOWN_TOKEN"},
+		{
+			name: "header and query", header: "Bearer admin-secret", query: "?access_token=admin-secret",
+			status: http.StatusUnauthorized, errcode: "M_MISSING_TOKEN",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called bool
+			handler := n.makeAdminAPI("test", func(req *http.Request) util.JSONResponse {
+				called = true
+				return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+			})
+			req := httptest.NewRequest(http.MethodGet, AdminPathPrefix+"/peers"+tt.query, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, wanted %d, with %s", rec.Code, tt.status, rec.Body)
+			}
+			if called != (tt.status == http.StatusOK) {
+				t.Errorf("handler was called: %t", called)
+			}
+			if tt.errcode != "" {
+				var res struct {
+					ErrCode string `json:"errcode"`
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+					t.Fatal(err)
+				}
+				if res.ErrCode != tt.errcode {
+					t.Errorf("got errcode %q, wanted %q", res.ErrCode, tt.errcode)
+				}
+			}
+		})
+	}
+}
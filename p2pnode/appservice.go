@@ -0,0 +1,112 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	p2phttp "github.com/libp2p/go-libp2p-http"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/sirupsen/logrus"
+)
+
+// AppServiceProtocol is the libp2p protocol that transactions and queries
+// are sent to application services on, for those whose URL is a libp2p URL
+// such as libp2p://QmPeerID, or a multiaddr that ends with the peer ID. The
+// requests are the same HTTP requests that any other application service
+// is sent, over a stream, so that a bridge on another device, e.g. a phone,
+// needs no HTTP reachability. The bridge can reach the client API over
+// MatrixProtocol in the same way.
+const AppServiceProtocol = "/matrix/appservice"
+
+// setupAppServicePeers points the application services that are reached
+// over libp2p at a proxy on a loopback port each, which sends their
+// requests on over libp2p, as the application service component only
+// talks HTTP. It must be called before the component is set up.
+func (n *Node) setupAppServicePeers(services []config.ApplicationService) error {
+	transport := &resolverTransport{
+		next:  p2phttp.NewTransport(n.Host, p2phttp.ProtocolOption(AppServiceProtocol)),
+		host:  n.Host,
+		dht:   n.DHT,
+		keyDB: n.KeyDB,
+		gate:  n.Gate,
+		idle:  n.idle,
+	}
+	for i := range services {
+		as := &services[i]
+		info, pathPrefix, err := appServicePeer(as.URL)
+		if err != nil {
+			return fmt.Errorf("invalid URL for application service %s: %s", as.ID, err)
+		}
+		if info == nil {
+			continue
+		}
+		// The addresses in a multiaddr are kept, so that the peer can be
+		// dialed without looking for it in the DHT.
+		id := info.ID
+		n.Host.Peerstore().AddAddrs(id, info.Addrs, peerstore.PermanentAddrTTL)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		proxy := &httputil.ReverseProxy{
+			Director: func(req *http.Request) {
+				req.URL.Scheme = LibP2PPushScheme
+				req.URL.Host = id.Pretty()
+				req.Host = id.Pretty()
+			},
+			Transport: transport,
+		}
+		server := &http.Server{Handler: proxy}
+		go server.Serve(listener) // nolint: errcheck
+		go func() {
+			<-n.ctx.Done()
+			server.Close() // nolint: errcheck
+		}()
+		as.URL = "http://" + listener.Addr().String() + pathPrefix
+		logrus.WithFields(logrus.Fields{"id": as.ID, "peer": id.Pretty()}).Info(
+			"Sending application service transactions over libp2p",
+		)
+	}
+	return nil
+}
+
+// appServicePeer returns the peer that an application service is reached
+// at, and the path of its API there, or nil if it's reached over HTTP.
+func appServicePeer(rawURL string) (*peer.AddrInfo, string, error) {
+	if strings.HasPrefix(rawURL, "/") {
+		info, err := ParsePeerAddr(rawURL)
+		return info, "", err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Scheme != LibP2PPushScheme {
+		return nil, "", nil
+	}
+	id, err := peer.IDB58Decode(u.Host)
+	if err != nil {
+		return nil, "", fmt.Errorf("the host of a libp2p URL must be a peer ID")
+	}
+	return &peer.AddrInfo{ID: id}, strings.TrimSuffix(u.Path, "/"), nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/dendrite/common/keydb"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/sirupsen/logrus"
+)
+
+// BootstrapInterval is how often we check that we are still connected to
+// each of the bootstrap peers.
+const BootstrapInterval = time.Second * 30
+
+// BootstrapPeersFileName is the name of the file, in the data directory,
+// that bootstrap peers added with AddBootstrapPeer are saved to, so that we stay
+// connected to them across restarts.
+const BootstrapPeersFileName = ".dendrite-p2p-bootstrap"
+
+// bootstrapPeers is the set of peers that we always try to stay connected
+// to: those from the config, and those that have been added since and saved
+// to the file.
+type bootstrapPeers struct {
+	mu         sync.Mutex
+	filename   string
+	configured []ma.Multiaddr
+	saved      []ma.Multiaddr
+	added      chan struct{}
+}
+
+// setupBootstrapPeers dials each of the given peer multiaddrs, and those
+// saved in the file, and then keeps redialling them whenever the connection
+// drops, until the context is cancelled.
+func setupBootstrapPeers(ctx context.Context, p2pHost host.Host, keyDB keydb.Database, addrs []string, filename string) (*bootstrapPeers, error) {
+	b := &bootstrapPeers{filename: filename, added: make(chan struct{}, 1)}
+	for _, addr := range addrs {
+		if _, err := ParsePeerAddr(addr); err != nil {
+			return nil, err
+		}
+		b.configured = append(b.configured, ma.StringCast(addr))
+	}
+	var saved []string
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		err = json.Unmarshal(data, &saved)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, addr := range saved {
+		if _, err = ParsePeerAddr(addr); err != nil {
+			logrus.WithError(err).Warnf("Ignoring invalid bootstrap peer %q in %s", addr, filename)
+			continue
+		}
+		b.saved = append(b.saved, ma.StringCast(addr))
+	}
+	go b.keepAlive(ctx, p2pHost, keyDB)
+	return b, nil
+}
+
+// peers returns every bootstrap peer, with the addresses of each peer
+// merged together.
+func (b *bootstrapPeers) peers() []peer.AddrInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	addrs := append(append([]ma.Multiaddr{}, b.configured...), b.saved...)
+	peers, err := peer.AddrInfosFromP2pAddrs(addrs...)
+	if err != nil {
+		// Every address was checked when it was added.
+		logrus.WithError(err).Error("Invalid bootstrap peer address")
+	}
+	return peers
+}
+
+// add saves the addresses of a peer as bootstrap peers, and connects to it
+// straight away if we aren't already.
+func (b *bootstrapPeers) add(info peer.AddrInfo) error {
+	addrs, err := peer.AddrInfoToP2pAddrs(&info)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	saved := make([]string, 0, len(b.saved)+len(addrs))
+	for _, addr := range b.saved {
+		saved = append(saved, addr.String())
+	}
+	for _, addr := range addrs {
+		if !containsAddr(b.saved, addr) && !containsAddr(b.configured, addr) {
+			b.saved = append(b.saved, addr)
+			saved = append(saved, addr.String())
+		}
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(b.filename+".tmp", data, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(b.filename+".tmp", b.filename); err != nil {
+		return err
+	}
+	select {
+	case b.added <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (b *bootstrapPeers) keepAlive(ctx context.Context, p2pHost host.Host, keyDB keydb.Database) {
+	ticker := time.NewTicker(BootstrapInterval)
+	defer ticker.Stop()
+	for {
+		for _, p := range b.peers() {
+			if p2pHost.Network().Connectedness(p.ID) == network.Connected {
+				continue
+			}
+			logger := logrus.WithField("peer", p.ID.String())
+			if err := connectPeer(ctx, p2pHost, keyDB, p); err != nil {
+				logger.WithError(err).Warn("Failed to connect to bootstrap peer")
+				continue
+			}
+			logger.WithField("addrs", p.Addrs).Info("Connected to bootstrap peer")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-b.added:
+		}
+	}
+}
+
+func containsAddr(addrs []ma.Multiaddr, addr ma.Multiaddr) bool {
+	for _, a := range addrs {
+		if a.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddBootstrapPeer makes a peer permanently one of our bootstrap peers, so
+// that we connect to it now and reconnect whenever the connection drops,
+// including after restarting.
+func (n *Node) AddBootstrapPeer(info peer.AddrInfo) error {
+	return n.bootstrap.add(info)
+}
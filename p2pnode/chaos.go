@@ -0,0 +1,151 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+// Chaos makes the network worse on purpose, for testing that rooms converge
+// again afterwards: it can partition us from peers, delay the Matrix streams
+// that other nodes open to us, and drop some of them. Unlike the gate it is
+// never saved, so a restart heals everything.
+type Chaos struct {
+	mu          sync.RWMutex
+	host        host.Host
+	partitioned map[peer.ID]struct{}
+	delay       time.Duration
+	dropRate    float64
+}
+
+// ChaosSettings is what Chaos is doing, as the admin API shows and sets it.
+type ChaosSettings struct {
+	// The peers that we are partitioned from.
+	Partition []string `json:"partition"`
+	// How long every incoming Matrix stream waits before it is served.
+	DelayMS int64 `json:"delay_ms"`
+	// The fraction of incoming Matrix streams that are closed straight away.
+	DropRate float64 `json:"drop_rate"`
+}
+
+// newChaos starts closing every new connection to a peer that we are
+// partitioned from, as the gate does for peers that it doesn't allow.
+func newChaos(p2pHost host.Host) *Chaos {
+	c := &Chaos{host: p2pHost, partitioned: make(map[peer.ID]struct{})}
+	p2pHost.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			if c.Partitioned(conn.RemotePeer()) {
+				_ = conn.Close()
+			}
+		},
+	})
+	return c
+}
+
+// Partitioned returns whether we are partitioned from the peer.
+func (c *Chaos) Partitioned(id peer.ID) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.partitioned[id]
+	return ok
+}
+
+// Partition partitions us from the peers, instead of from whichever peers we
+// were partitioned from before, and disconnects them. No peers heals the
+// partition, after which we reconnect to the peers that we share rooms with
+// as usual.
+func (c *Chaos) Partition(ids []peer.ID) {
+	c.mu.Lock()
+	c.partitioned = make(map[peer.ID]struct{}, len(ids))
+	for _, id := range ids {
+		c.partitioned[id] = struct{}{}
+	}
+	c.mu.Unlock()
+	if len(ids) > 0 {
+		logrus.Warnf("Partitioned from %d peers", len(ids))
+	} else {
+		logrus.Info("Healed the partition")
+	}
+	for _, id := range ids {
+		_ = c.host.Network().ClosePeer(id)
+	}
+}
+
+// SetDelay sets how long every incoming Matrix stream waits before it is
+// served, or 0 not to delay them.
+func (c *Chaos) SetDelay(delay time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.delay = delay
+}
+
+// SetDropRate sets the fraction of incoming Matrix streams, between 0 and 1,
+// that are closed without being served.
+func (c *Chaos) SetDropRate(rate float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropRate = rate
+}
+
+// Settings returns what Chaos is doing.
+func (c *Chaos) Settings() ChaosSettings {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return ChaosSettings{
+		Partition: peerStrings(sortedPeers(c.partitioned)),
+		DelayMS:   int64(c.delay / time.Millisecond),
+		DropRate:  c.dropRate,
+	}
+}
+
+// stream decides what happens to an incoming Matrix stream from a peer,
+// returning the stream to serve, which may be delayed, or nil if it is to be
+// closed.
+func (c *Chaos) stream(id peer.ID, conn net.Conn) net.Conn {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, ok := c.partitioned[id]; ok {
+		return nil
+	}
+	if c.dropRate > 0 && rand.Float64() < c.dropRate {
+		return nil
+	}
+	if c.delay > 0 {
+		return &delayedConn{Conn: conn, delay: c.delay}
+	}
+	return conn
+}
+
+// delayedConn waits before the first read of a stream, which holds up the
+// request in it without holding up accepting other streams.
+type delayedConn struct {
+	net.Conn
+	delay time.Duration
+	once  sync.Once
+}
+
+// Read implements net.Conn
+func (c *delayedConn) Read(b []byte) (int, error) {
+	c.once.Do(func() { time.Sleep(c.delay) })
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// federationRouter sends federation requests for servers whose name is a
+// peer ID over libp2p, and requests for any other server over HTTPS, as an
+// ordinary homeserver would. If clearnet is nil, only p2p servers can be
+// reached.
+type federationRouter struct {
+	p2p      http.RoundTripper
+	clearnet http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *federationRouter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, err := peer.IDB58Decode(req.URL.Host); err == nil {
+		return t.p2p.RoundTrip(req)
+	}
+	if t.clearnet == nil {
+		return nil, fmt.Errorf("server %q isn't a p2p node and clearnet federation is disabled", req.URL.Host)
+	}
+	return t.clearnet.RoundTrip(req)
+}
+
+// clearnetTransport finds servers using .well-known and SRV lookups and
+// sends requests to them over HTTPS, in the same way as the default
+// transport of the federation client does.
+type clearnetTransport struct {
+	mu sync.Mutex
+	// transports holds one transport for each TLS server name, as the
+	// server name for SNI can't be set per connection.
+	transports map[string]http.RoundTripper
+}
+
+func newClearnetTransport() *clearnetTransport {
+	return &clearnetTransport{transports: make(map[string]http.RoundTripper)}
+}
+
+func (t *clearnetTransport) transport(tlsServerName string) http.RoundTripper {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tr, ok := t.transports[tlsServerName]
+	if !ok {
+		tr = &http.Transport{
+			TLSClientConfig: &tls.Config{
+				ServerName: tlsServerName,
+				// Federation certificates aren't checked yet by Dendrite
+				// either, as many servers still have self-signed ones.
+				InsecureSkipVerify: true,
+			},
+		}
+		t.transports[tlsServerName] = tr
+	}
+	return tr
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *clearnetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	serverName := gomatrixserverlib.ServerName(req.URL.Host)
+	results, err := gomatrixserverlib.ResolveServer(serverName)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no address found for server %s", serverName)
+	}
+	for _, result := range results {
+		u := *req.URL
+		u.Scheme = "https"
+		u.Host = result.Destination
+		r := req.Clone(req.Context())
+		r.URL = &u
+		r.Host = string(result.Host)
+		var resp *http.Response
+		if resp, err = t.transport(result.TLSServerName).RoundTrip(r); err == nil {
+			return resp, nil
+		}
+		util.GetLogger(req.Context()).WithError(err).Warnf("Failed to send request to %s", u.String())
+	}
+	return nil, err
+}
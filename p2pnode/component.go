@@ -0,0 +1,276 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/basecomponent"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/syncapi"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// The Dendrite components that can be run apart from the node, in processes
+// of their own, with Config.Component.
+const (
+	ComponentSyncAPI  = "syncapi"
+	ComponentMediaAPI = "mediaapi"
+)
+
+// FederationProxyPath is where the node takes the federation requests of the
+// components that are run apart from it, which aren't on libp2p, and sends
+// them on as its own. It is only served on the internal API address.
+const FederationProxyPath = "/_p2p/internal/federation/"
+
+// syncAPIClientPaths are the client APIs, under /_matrix/client/r0, that the
+// sync API serves.
+var syncAPIClientPaths = []string{
+	"/sync",
+	"/rooms/{roomID}/state",
+	"/rooms/{roomID}/state/{type}",
+	"/rooms/{roomID}/state/{type}/{stateKey}",
+	"/rooms/{roomID}/messages",
+}
+
+// Component is a Dendrite component running apart from the node, which it
+// talks to over Kafka and the node's internal APIs.
+type Component struct {
+	Base   *basecomponent.BaseDendrite
+	server *http.Server
+}
+
+// NewComponent sets up cfg.Component and serves its API at its address in
+// dendrite.listen, or dendrite.bind if that is given, for the node to pass
+// requests for it on to. The config is that of the node, whose keys it signs
+// federation requests with.
+func NewComponent(cfg *Config) (*Component, error) {
+	dendriteCfg := &cfg.Dendrite
+	var componentName string
+	var listen, bind config.Address
+	switch cfg.Component {
+	case ComponentSyncAPI:
+		componentName, listen, bind = "SyncAPI", dendriteCfg.Listen.SyncAPI, dendriteCfg.Bind.SyncAPI
+	case ComponentMediaAPI:
+		componentName, listen, bind = "MediaAPI", dendriteCfg.Listen.MediaAPI, dendriteCfg.Bind.MediaAPI
+	default:
+		return nil, fmt.Errorf("there is no component called %q, only %s and %s", cfg.Component, ComponentSyncAPI, ComponentMediaAPI)
+	}
+	if listen == "" {
+		return nil, fmt.Errorf("the config has no address for the %s in dendrite.listen", cfg.Component)
+	}
+	if err := checkSplitComponents(dendriteCfg); err != nil {
+		return nil, err
+	}
+	serverName, err := ServerName(cfg.IdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	dendriteCfg.Matrix.ServerName = serverName
+	dendriteCfg.Matrix.PrivateKey = cfg.SigningKeys.PrivateKey
+	dendriteCfg.Matrix.KeyID = cfg.SigningKeys.KeyID
+	setDendriteDefaults(dendriteCfg)
+	if err = dendriteCfg.Derive(); err != nil {
+		return nil, err
+	}
+
+	base := basecomponent.NewBaseDendrite(dendriteCfg, componentName)
+	if err = setupLogrus(cfg); err != nil {
+		base.Close() // nolint: errcheck
+		return nil, err
+	}
+	c := &Component{Base: base}
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", &federationProxyTransport{
+		next: http.DefaultTransport,
+		node: string(dendriteCfg.Listen.RoomServer),
+	})
+	federation := gomatrixserverlib.NewFederationClientWithTransport(
+		serverName, dendriteCfg.Matrix.KeyID, dendriteCfg.Matrix.PrivateKey, tr,
+	)
+	deviceDB := base.CreateDeviceDB()
+	if cfg.Component == ComponentSyncAPI {
+		_, _, query := base.CreateHTTPRoomserverAPIs()
+		syncapi.SetupSyncAPIComponent(base, deviceDB, base.CreateAccountsDB(), query, federation, dendriteCfg)
+	} else if _, err = setupMediaAPI(base, deviceDB, &federation.Client); err != nil {
+		c.Close() // nolint: errcheck
+		return nil, err
+	}
+	addr := bindAddress(bind, listen)
+	listener, err := net.Listen("tcp", string(addr))
+	if err != nil {
+		c.Close() // nolint: errcheck
+		return nil, err
+	}
+	c.server = &http.Server{Handler: common.WrapHandlerInCORS(base.APIMux)}
+	go c.server.Serve(listener) // nolint: errcheck
+	logrus.WithField("server_name", serverName).Infof("Serving the %s on %s", cfg.Component, addr)
+	return c, nil
+}
+
+// Close stops serving the component's API, and then closes Kafka and the base
+// component.
+func (c *Component) Close() error {
+	var err error
+	if c.server != nil {
+		err = c.server.Close()
+	}
+	if c.Base.KafkaProducer != nil {
+		if perr := c.Base.KafkaProducer.Close(); err == nil {
+			err = perr
+		}
+	}
+	if berr := c.Base.Close(); err == nil {
+		err = berr
+	}
+	return err
+}
+
+// splitComponents returns whether any of the components are run apart from
+// the node, which the config says by giving them addresses.
+func splitComponents(cfg *config.Dendrite) bool {
+	return cfg.Listen.SyncAPI != "" || cfg.Listen.MediaAPI != ""
+}
+
+// checkSplitComponents checks that, if any components are run apart from the
+// node, they can reach each other: through Kafka, as naffka only works within
+// a process, and through the node's internal APIs.
+func checkSplitComponents(cfg *config.Dendrite) error {
+	if !splitComponents(cfg) {
+		return nil
+	}
+	if len(cfg.Kafka.Addresses) == 0 {
+		return errors.New("components run apart from the node need Kafka, in dendrite.kafka.addresses")
+	}
+	if cfg.Listen.RoomServer == "" {
+		return errors.New("components run apart from the node need its internal APIs, at dendrite.listen.room_server")
+	}
+	return nil
+}
+
+// bindAddress returns the address to listen on for a component, as Dendrite
+// does: bind if it is given, otherwise listen.
+func bindAddress(bind, listen config.Address) config.Address {
+	if bind != "" {
+		return bind
+	}
+	return listen
+}
+
+// componentProxy passes requests on to a component that is run apart from the
+// node.
+func componentProxy(addr config.Address) http.Handler {
+	return httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: string(addr)})
+}
+
+// setupSplitComponents passes requests for the components that are run apart
+// from the node on to them, in place of setting them up, and serves the
+// internal APIs that they need.
+func (n *Node) setupSplitComponents() error {
+	cfg := n.Base.Cfg
+	if cfg.Listen.SyncAPI != "" {
+		proxy := componentProxy(cfg.Listen.SyncAPI)
+		r0 := n.Base.APIMux.PathPrefix("/_matrix/client/r0").Subrouter()
+		for _, path := range syncAPIClientPaths {
+			r0.Handle(path, proxy).Methods(http.MethodGet, http.MethodOptions)
+		}
+	}
+	if cfg.Listen.MediaAPI != "" {
+		n.Base.APIMux.PathPrefix("/_matrix/media/").Handler(componentProxy(cfg.Listen.MediaAPI))
+	}
+
+	// The roomserver's internal APIs were registered on the default mux when
+	// it was set up.
+	internal := http.NewServeMux()
+	internal.HandleFunc(FederationProxyPath, n.serveFederationProxy)
+	internal.Handle("/", http.DefaultServeMux)
+	listener, err := net.Listen("tcp", string(bindAddress(cfg.Bind.RoomServer, cfg.Listen.RoomServer)))
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: internal}
+	go server.Serve(listener) // nolint: errcheck
+	go func() {
+		<-n.ctx.Done()
+		server.Close() // nolint: errcheck
+	}()
+	logrus.Info("Serving internal APIs for the components run apart from the node on ", listener.Addr())
+	return nil
+}
+
+// serveFederationProxy sends a federation request of a component on as our
+// own, to the server named in the path after FederationProxyPath. The request
+// is already signed, with our key.
+func (n *Node) serveFederationProxy(w http.ResponseWriter, req *http.Request) {
+	rest := strings.TrimPrefix(req.URL.EscapedPath(), FederationProxyPath)
+	slash := strings.IndexByte(rest, '/')
+	if slash <= 0 {
+		http.Error(w, "No destination server in the path", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse("matrix://" + rest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u.RawQuery = req.URL.RawQuery
+	out, err := http.NewRequest(req.Method, u.String(), req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	out.Header = req.Header.Clone()
+	out.ContentLength = req.ContentLength
+	res, err := n.federationTransport.RoundTrip(out.WithContext(req.Context()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close() // nolint: errcheck
+	for key, values := range res.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body) // nolint: errcheck
+}
+
+// federationProxyTransport sends the federation requests of a component that
+// is run apart from the node to the node, to send on over libp2p.
+type federationProxyTransport struct {
+	next http.RoundTripper
+	// The address of the node's internal APIs.
+	node string
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *federationProxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, err := url.Parse("http://" + t.node + FederationProxyPath + req.URL.Host + req.URL.EscapedPath())
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = req.URL.RawQuery
+	out := req.Clone(req.Context())
+	out.URL, out.Host = u, t.node
+	return t.next.RoundTrip(out)
+}
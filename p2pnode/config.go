@@ -0,0 +1,337 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config holds everything needed to start a node.
+type Config struct {
+	// The ed25519 key that is the libp2p identity of the node. Our peer ID,
+	// and so our server name, is derived from it.
+	IdentityKey ed25519.PrivateKey `yaml:"-"`
+	// The ed25519 keys that the node signs Matrix events with.
+	SigningKeys SigningKeys `yaml:"-"`
+	// The prometheus registry that the node registers its metrics with and
+	// serves on /metrics, or nil for the default registry. Dendrite registers
+	// the metrics of its components with the default registerer whatever
+	// this is, so it has to be this registry while the node is started for
+	// them to be served.
+	Metrics *prometheus.Registry `yaml:"-"`
+	// The directory that the node keeps its own state in, e.g. known peers.
+	DataDir string `yaml:"data_dir"`
+	// The configuration for the Dendrite components. Only the databases need
+	// to be filled in. The server name and signing key are always set up by
+	// the node itself, and Kafka is replaced with naffka unless components are
+	// run apart from the node, but anything else can be changed from the
+	// defaults. Application services, e.g.
+	// bridges, are attached by listing their registration files in
+	// application_services.config_files, relative to the config file.
+	Dendrite config.Dendrite `yaml:"dendrite"`
+	// The one Dendrite component, syncapi or mediaapi, that this process runs
+	// apart from the node, e.g. on another machine, or empty to run the node.
+	// The node and the components share a config, and so their databases,
+	// and find each other by dendrite.listen: each component is served at its
+	// own address there, for the node to pass requests on to, and the node
+	// serves its internal APIs at room_server. They talk over Kafka, which
+	// needs dendrite.kafka.addresses. A media API run apart needs the media
+	// base_path to be shared with the node as well, as the node reads the
+	// files to serve them to other nodes.
+	Component string `yaml:"component"`
+	// Multiaddrs of peers to dial at startup and stay connected to. Each must
+	// include the peer ID, e.g. /ip4/1.2.3.4/tcp/4001/p2p/QmPeerID.
+	BootstrapPeers []string `yaml:"bootstrap_peers"`
+	// Multiaddr to accept WebSocket connections on, so that peers running in
+	// a browser can dial us. Leave empty to disable.
+	WebSocketListenAddr string `yaml:"websocket_listen_addr"`
+	// Whether to relay connections for other peers that aren't publicly
+	// reachable. This should only be turned on for nodes that are.
+	RelayServer bool `yaml:"relay_server"`
+	// Whether to stop trying to open a port on the router using UPnP or
+	// NAT-PMP, e.g. for networks where doing so isn't allowed.
+	DisableNATPortMap bool `yaml:"disable_nat_port_map"`
+	// Path to a libp2p pre-shared key file. If set, we will only talk to
+	// peers with the same key, which makes a private network.
+	PSKFile string `yaml:"psk_file"`
+	// Once there are more than MaxPeers connections, the least useful ones
+	// are closed until there are MinPeers left. Peers that we share rooms
+	// with are never disconnected. Zero means no limit.
+	MinPeers int `yaml:"min_peers"`
+	MaxPeers int `yaml:"max_peers"`
+	// Address of a Tor SOCKS proxy, e.g. 127.0.0.1:9050. If set, every
+	// connection is made through Tor and local network discovery is turned
+	// off, so that other nodes can't learn where we are.
+	TorSOCKSAddr string `yaml:"tor_socks_addr"`
+	// Address of the Tor control port, e.g. 127.0.0.1:9051. If set along
+	// with TorSOCKSAddr, we listen as an onion service so that other nodes
+	// can dial us. Otherwise we can only dial out.
+	TorControlAddr string `yaml:"tor_control_addr"`
+	// How long a connection that was dialed to send a federation request is
+	// kept open once it is idle, unless we share rooms with the server on
+	// the other end. Zero leaves such connections to the connection manager.
+	FederationIdleTimeout time.Duration `yaml:"federation_idle_timeout"`
+	// Peer IDs of trusted peers that hold the transactions sent to us while
+	// we are offline, until we come back and drain them. Each one must list
+	// us in its postbox_clients.
+	PostboxPeers []string `yaml:"postbox_peers"`
+	// Peer IDs of the nodes that we hold transactions for while they are
+	// offline, as one of their postbox peers.
+	PostboxClients []string `yaml:"postbox_clients"`
+	// Whether to stop federating with servers that aren't p2p nodes, over
+	// HTTPS with DNS, so that we only ever talk to other nodes over libp2p.
+	// Clearnet federation is always off when using Tor, as the DNS lookups
+	// would give away where we are.
+	DisableClearnetFederation bool `yaml:"disable_clearnet_federation"`
+	// Patterns of the server names and peer IDs that we federate with at
+	// all, where * matches any number of characters and ? matches one. If
+	// FederationAllow isn't empty then only servers that match one of its
+	// patterns are federated with, while servers that match FederationDeny
+	// never are. More can be added through the admin API.
+	FederationAllow []string `yaml:"federation_allow"`
+	FederationDeny  []string `yaml:"federation_deny"`
+	// Whether to make previews of the links that users send. The pages are
+	// fetched by the node itself, unless URLPreviewPeer is the peer ID of a
+	// trusted node to fetch them through, so that websites see its address
+	// rather than ours. URLPreviewClients are the peer IDs of the nodes that
+	// we fetch previews for in turn.
+	URLPreviews       bool     `yaml:"url_previews"`
+	URLPreviewPeer    string   `yaml:"url_preview_peer"`
+	URLPreviewClients []string `yaml:"url_preview_clients"`
+	// Remote media is deleted, least recently downloaded first, once there
+	// is more than MediaCacheMaxSizeMB of it, or once it hasn't been
+	// downloaded for MediaCacheMaxAge. Zero means no limit. Media uploaded to
+	// the node is always kept.
+	MediaCacheMaxSizeMB int           `yaml:"media_cache_max_size_mb"`
+	MediaCacheMaxAge    time.Duration `yaml:"media_cache_max_age"`
+	// Events older than MaxRetention are purged, as are those older than
+	// the m.room.retention policy of their room says to keep them for,
+	// though never sooner than MinRetention, which defaults to 24h. Zero
+	// MaxRetention means to keep events for as long as their room says.
+	// State events, and the latest event of each room, are always kept.
+	MaxRetention time.Duration `yaml:"max_retention"`
+	MinRetention time.Duration `yaml:"min_retention"`
+	// If MediaS3Bucket is set, media files are kept in that bucket of the
+	// S3-compatible object store at MediaS3Endpoint, e.g.
+	// https://s3.eu-west-1.amazonaws.com, rather than on the local disk,
+	// which then only holds the files that have been used lately. The keys
+	// are best given with the DENDRITE_P2P_MEDIA_S3_ACCESS_KEY_ID and
+	// DENDRITE_P2P_MEDIA_S3_SECRET_ACCESS_KEY environment variables.
+	MediaS3Endpoint        string `yaml:"media_s3_endpoint"`
+	MediaS3Bucket          string `yaml:"media_s3_bucket"`
+	MediaS3Region          string `yaml:"media_s3_region"`
+	MediaS3AccessKeyID     string `yaml:"media_s3_access_key_id"`
+	MediaS3SecretAccessKey string `yaml:"media_s3_secret_access_key"`
+	// URL of a content scanner that every file of media is sent through
+	// before it is served, with flagged files being refused and deleted.
+	// An icap:// URL is an ICAP service, e.g. c-icap with ClamAV, while an
+	// http:// or https:// URL is sent each file in a POST, and answers with
+	// {"clean": true} or {"clean": false, "info": "<why>"}.
+	MediaScannerURL string `yaml:"media_scanner_url"`
+	// The SMTP server to send emails through, as host:port, e.g. to confirm
+	// the email addresses that users add and to reset their passwords with.
+	// Port 465 is spoken to over TLS, and others with STARTTLS if the server
+	// offers it. Emails are sent from SMTPFrom, and the password is best
+	// given in the DENDRITE_P2P_SMTP_PASSWORD environment variable.
+	SMTPAddr     string `yaml:"smtp_addr"`
+	SMTPFrom     string `yaml:"smtp_from"`
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password"`
+	// The OpenID Connect provider to log users in with, by its issuer URL,
+	// e.g. that of an organisation's identity provider. Users get an account,
+	// named after the OIDCLocalpartClaim of their userinfo, which defaults to
+	// preferred_username, the first time that they log in. The client is
+	// registered with the provider with <public base URL>/_dendrite/oidc/callback
+	// as its redirect URI, and its secret is best given in the
+	// DENDRITE_P2P_OIDC_CLIENT_SECRET environment variable.
+	OIDCIssuer         string `yaml:"oidc_issuer"`
+	OIDCClientID       string `yaml:"oidc_client_id"`
+	OIDCClientSecret   string `yaml:"oidc_client_secret"`
+	OIDCLocalpartClaim string `yaml:"oidc_localpart_claim"`
+	// Stops users logging in with a password once OIDC is set up, so that
+	// the provider decides who can log in.
+	DisablePasswordLogin bool `yaml:"disable_password_login"`
+	// How long the access tokens of clients that ask for a refresh token when
+	// they log in last before they have to refresh them. Defaults to 5m.
+	AccessTokenLifetime time.Duration `yaml:"access_token_lifetime"`
+	// Who can register accounts: "open" for anyone who can reach the node,
+	// which is the default, "token" for those with a registration token
+	// from the admin API, or "disabled" for nobody. Application services
+	// and the registration shared secret can always register users.
+	Registration string `yaml:"registration"`
+	// Localparts of the users who can use the admin API with their own
+	// access token, as well as with the admin token.
+	AdminUsers []string `yaml:"admin_users"`
+	// The lowest level of logs to write: one of panic, fatal, error, warn,
+	// info, debug or trace. Defaults to info.
+	LogLevel string `yaml:"log_level"`
+	// The lowest level of logs from libp2p to write, which uses the go-log
+	// levels: critical, error, warning, notice, info or debug. Defaults to
+	// error, as libp2p is very noisy.
+	LibP2PLogLevel string `yaml:"libp2p_log_level"`
+	// Whether to write logs as text or json. Defaults to text.
+	LogFormat string `yaml:"log_format"`
+	// The file to write logs to. Defaults to standard error.
+	LogFile string `yaml:"log_file"`
+	// The log file is rotated once it is bigger than LogMaxSizeMB, or a day
+	// old. Rotated files are deleted once they are older than LogMaxAgeDays
+	// or there are more than LogMaxBackups of them. Zero means no limit.
+	LogMaxSizeMB  int `yaml:"log_max_size_mb"`
+	LogMaxAgeDays int `yaml:"log_max_age_days"`
+	LogMaxBackups int `yaml:"log_max_backups"`
+	// Address of a Jaeger agent, e.g. 127.0.0.1:6831, to send a trace of
+	// every request to, including requests to and from other nodes. Leave
+	// empty to use the tracing section of the Dendrite config instead.
+	JaegerAgentAddr string `yaml:"jaeger_agent_addr"`
+	// A directory holding a build of Element Web, or any other static web
+	// client, to serve at / instead of the minimal client that is built in.
+	WebClientDir string `yaml:"web_client_dir"`
+	// The URL that the node's HTTP APIs are reachable at from elsewhere, e.g.
+	// https://p2p.example.com, for the well-known documents. Leave empty to
+	// use whichever URL each request was made to.
+	PublicBaseURL string `yaml:"public_base_url"`
+	// Other nodes to host in the same process, e.g. so that one always-on
+	// machine can serve a node for everyone in a household. Each is set up
+	// like the node, apart from anything that is the node's own, such as its
+	// admin users, application services, public URL and the addresses that
+	// it listens on, and is served over HTTP to requests for its host.
+	Tenants []Tenant `yaml:"tenants"`
+}
+
+// LoadConfig reads a YAML config file over the top of cfg, so that anything
+// which isn't in the file keeps the value that it already had.
+func LoadConfig(filename string, cfg *Config) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if err = yaml.Unmarshal(data, cfg); err != nil {
+		return err
+	}
+	// Application service registrations are found relative to the config
+	// file, as they normally sit next to it.
+	files := cfg.Dendrite.ApplicationServices.ConfigFiles
+	for i, file := range files {
+		if !filepath.IsAbs(file) {
+			files[i] = filepath.Join(filepath.Dir(filename), file)
+		}
+	}
+	return nil
+}
+
+// EnvPrefix is the prefix of the environment variables that ApplyEnv reads.
+const EnvPrefix = "DENDRITE_P2P_"
+
+// ApplyEnv overrides config values with any environment variables that are
+// set for them. The name of the variable for a value is EnvPrefix followed by
+// the path of YAML keys down to it, in upper case and joined by underscores,
+// e.g. DENDRITE_P2P_MAX_PEERS or DENDRITE_P2P_DENDRITE_DATABASE_ACCOUNT. The
+// values are parsed as YAML, so lists can be given as e.g. "[a, b]".
+func ApplyEnv(cfg *Config) error {
+	return applyEnv(reflect.ValueOf(cfg).Elem(), strings.TrimSuffix(EnvPrefix, "_"))
+}
+
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" || field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		envName := prefix + "_" + strings.ToUpper(name)
+		fv := v.Field(i)
+		if _, ok := fv.Addr().Interface().(yaml.Unmarshaler); !ok && fv.Kind() == reflect.Struct {
+			if err := applyEnv(fv, envName); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+		if err := yaml.Unmarshal([]byte(value), fv.Addr().Interface()); err != nil {
+			return fmt.Errorf("invalid value for %s: %s", envName, err)
+		}
+	}
+	return nil
+}
+
+// setDendriteDefaults fills in the parts of the Dendrite config that aren't
+// set by the node itself, but that Dendrite would normally default when it
+// loads its own config file.
+func setDendriteDefaults(cfg *config.Dendrite) {
+	if cfg.Matrix.KeyValidityPeriod == 0 {
+		cfg.Matrix.KeyValidityPeriod = 24 * time.Hour
+	}
+	if cfg.Matrix.TrustedIDServers == nil {
+		cfg.Matrix.TrustedIDServers = []string{}
+	}
+	if cfg.Media.MaxThumbnailGenerators == 0 {
+		cfg.Media.MaxThumbnailGenerators = 10
+	}
+	if cfg.Media.ThumbnailSizes == nil {
+		cfg.Media.ThumbnailSizes = append([]config.ThumbnailSize(nil), defaultThumbnailSizes...)
+	}
+	for i := range cfg.Media.ThumbnailSizes {
+		if cfg.Media.ThumbnailSizes[i].ResizeMethod == "" {
+			cfg.Media.ThumbnailSizes[i].ResizeMethod = types.Scale
+		}
+	}
+	if cfg.Media.MaxFileSizeBytes == nil {
+		maxFileSizeBytes := config.FileSizeBytes(10485760)
+		cfg.Media.MaxFileSizeBytes = &maxFileSizeBytes
+	}
+	topics := &cfg.Kafka.Topics
+	if topics.OutputRoomEvent == "" {
+		topics.OutputRoomEvent = "roomserverOutput"
+	}
+	if topics.OutputClientData == "" {
+		topics.OutputClientData = "clientapiOutput"
+	}
+	if topics.OutputTypingEvent == "" {
+		topics.OutputTypingEvent = "typingServerOutput"
+	}
+	if topics.UserUpdates == "" {
+		topics.UserUpdates = "userUpdates"
+	}
+}
+
+// ParsePeerAddr parses a multiaddr that includes a peer ID.
+func ParsePeerAddr(value string) (*peer.AddrInfo, error) {
+	addr, err := ma.NewMultiaddr(value)
+	if err != nil {
+		return nil, err
+	}
+	return peer.AddrInfoFromP2pAddr(addr)
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// testPeerID returns the peer ID of a new identity key.
+func testPeerID(t *testing.T) peer.ID {
+	t.Helper()
+	_, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestParsePeerAddr(t *testing.T) {
+	id := testPeerID(t)
+	tests := []struct {
+		name  string
+		value string
+		addrs int
+		ok    bool
+	}{
+		{"address", "/ip4/192.0.2.1/tcp/4001/p2p/" + id.Pretty(), 1, true},
+		{"ipfs", "/ip4/192.0.2.1/tcp/4001/ipfs/" + id.Pretty(), 1, true},
+		{"peer ID only", "/p2p/" + id.Pretty(), 0, true},
+		{"no peer ID", "/ip4/192.0.2.1/tcp/4001", 0, false},
+		{"invalid peer ID", "/ip4/192.0.2.1/tcp/4001/p2p/nobody", 0, false},
+		{"not a multiaddr", "192.0.2.1:4001", 0, false},
+		{"empty", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := ParsePeerAddr(tt.value)
+			if !tt.ok {
+				if err == nil {
+					t.Errorf("invalid address was accepted as %s", info)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.ID != id || len(info.Addrs) != tt.addrs {
+				t.Errorf("got %s, wanted %s with %d addresses", info, id, tt.addrs)
+			}
+		})
+	}
+}
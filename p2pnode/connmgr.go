@@ -0,0 +1,65 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"fmt"
+	"time"
+
+	connmgr "github.com/libp2p/go-libp2p-connmgr"
+	coreconnmgr "github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// SharedRoomsTag is the connection manager tag that protects connections to
+// peers that we share rooms with, so that they are never pruned.
+const SharedRoomsTag = "matrix-shared-rooms"
+
+// ConnManagerGracePeriod is how long a new connection is left alone by the
+// connection manager before it can be pruned.
+const ConnManagerGracePeriod = time.Minute
+
+// createConnManager creates a connection manager that prunes connections
+// down to MinPeers once there are more than MaxPeers of them, or nil if
+// there is no limit.
+func createConnManager(cfg *Config) (coreconnmgr.ConnManager, error) {
+	if cfg.MaxPeers == 0 {
+		return nil, nil
+	}
+	if cfg.MinPeers > cfg.MaxPeers {
+		return nil, fmt.Errorf("minimum peers (%d) is more than the maximum (%d)", cfg.MinPeers, cfg.MaxPeers)
+	}
+	return connmgr.NewConnManager(cfg.MinPeers, cfg.MaxPeers, ConnManagerGracePeriod), nil
+}
+
+// protectSharedRoomPeers stops the connection manager from ever pruning
+// connections to peers that we share rooms with. Idle strangers, e.g. from
+// the DHT, are pruned first.
+func protectSharedRoomPeers(cm coreconnmgr.ConnManager, memberships *RoomMemberships, self peer.ID) {
+	memberships.OnChange(func(server gomatrixserverlib.ServerName, rooms int) {
+		id, err := serverNamePeer(server)
+		if err != nil || id == self {
+			return
+		}
+		if rooms > 0 {
+			cm.TagPeer(id, SharedRoomsTag, rooms)
+			cm.Protect(id, SharedRoomsTag)
+		} else {
+			cm.UntagPeer(id, SharedRoomsTag)
+			cm.Unprotect(id, SharedRoomsTag)
+		}
+	})
+}
@@ -0,0 +1,408 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// UnstableKeysClientPathPrefix starts the same client APIs for keys as
+// KeysClientPathPrefix, under the prefix that clients use for cross-signing.
+const UnstableKeysClientPathPrefix = "/_matrix/client/unstable/keys/"
+
+// MSigningKeyUpdate is the type of the EDU that tells other servers about a
+// change to the cross-signing keys of one of our users.
+const MSigningKeyUpdate = "m.signing_key_update"
+
+// The types of cross-signing key.
+const (
+	crossSigningMaster = "master"
+	crossSigningSelf   = "self_signing"
+	crossSigningUser   = "user_signing"
+)
+
+// loginTypePassword is the only stage of user-interactive auth needed to
+// replace cross-signing keys. Dendrite has no constant for it.
+const loginTypePassword authtypes.LoginType = "m.login.password"
+
+const crossSigningSchema = `
+-- The cross-signing keys of our users, by type.
+CREATE TABLE IF NOT EXISTS p2p_cross_signing_keys (
+    user_id TEXT NOT NULL,
+    key_type TEXT NOT NULL,
+    key_json TEXT NOT NULL,
+    PRIMARY KEY (user_id, key_type)
+);
+
+-- The signatures that our users have uploaded, of their own devices and
+-- cross-signing keys and of the master keys of other users. The key ID of a
+-- device is its device ID, and that of a cross-signing key is the key.
+CREATE TABLE IF NOT EXISTS p2p_key_signatures (
+    origin_user_id TEXT NOT NULL,
+    origin_key_id TEXT NOT NULL,
+    target_user_id TEXT NOT NULL,
+    target_key_id TEXT NOT NULL,
+    signature TEXT NOT NULL,
+    PRIMARY KEY (origin_user_id, origin_key_id, target_user_id, target_key_id)
+);
+`
+
+const upsertCrossSigningKeySQL = "" +
+	"INSERT INTO p2p_cross_signing_keys (user_id, key_type, key_json) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (user_id, key_type) DO UPDATE SET key_json = $3"
+
+const selectCrossSigningKeysSQL = "" +
+	"SELECT key_type, key_json FROM p2p_cross_signing_keys WHERE user_id = $1"
+
+const upsertKeySignatureSQL = "" +
+	"INSERT INTO p2p_key_signatures (origin_user_id, origin_key_id, target_user_id, target_key_id, signature)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (origin_user_id, origin_key_id, target_user_id, target_key_id) DO UPDATE SET signature = $5"
+
+// Signatures by the user of their own keys are for everyone, but those of the
+// keys of other users are only for the user who made them.
+const selectKeySignaturesSQL = "" +
+	"SELECT origin_user_id, origin_key_id, target_key_id, signature FROM p2p_key_signatures" +
+	" WHERE target_user_id = $1 AND (origin_user_id = $1 OR origin_user_id = $2)"
+
+// crossSigningKey is a cross-signing key as uploaded by a client.
+type crossSigningKey struct {
+	UserID string            `json:"user_id"`
+	Usage  []string          `json:"usage"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// signingKeyUpdate is the content of an m.signing_key_update EDU.
+type signingKeyUpdate struct {
+	UserID         string          `json:"user_id"`
+	MasterKey      json.RawMessage `json:"master_key,omitempty"`
+	SelfSigningKey json.RawMessage `json:"self_signing_key,omitempty"`
+}
+
+// keySignatures holds signatures by user ID and then key ID.
+type keySignatures map[string]map[string]string
+
+// uploadSigningKeys stores the cross-signing keys of one of our users. The
+// password is needed to replace existing keys, but not to upload the first.
+func (k *e2eKeys) uploadSigningKeys(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	var body struct {
+		MasterKey      json.RawMessage `json:"master_key"`
+		SelfSigningKey json.RawMessage `json:"self_signing_key"`
+		UserSigningKey json.RawMessage `json:"user_signing_key"`
+		Auth           *struct {
+			Type     string `json:"type"`
+			Password string `json:"password"`
+		} `json:"auth"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	ctx := req.Context()
+	existing, err := k.crossSigningKeys(ctx, device.UserID, device.UserID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if len(existing) > 0 {
+		if body.Auth == nil || body.Auth.Type != string(loginTypePassword) {
+			return passwordAuthRequired(nil)
+		}
+		localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if _, err = k.accountDB.GetAccountByPassword(ctx, localpart, body.Auth.Password); err != nil {
+			return passwordAuthRequired(jsonerror.Forbidden("Invalid password"))
+		}
+	}
+
+	keys := map[string]json.RawMessage{
+		crossSigningMaster: body.MasterKey,
+		crossSigningSelf:   body.SelfSigningKey,
+		crossSigningUser:   body.UserSigningKey,
+	}
+	for keyType, keyJSON := range keys {
+		if len(keyJSON) == 0 || string(keyJSON) == "null" {
+			delete(keys, keyType)
+			continue
+		}
+		var key crossSigningKey
+		if err = json.Unmarshal(keyJSON, &key); err != nil {
+			return util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.BadJSON(err.Error())}
+		}
+		if key.UserID != device.UserID || len(key.Keys) != 1 || len(key.Usage) == 0 || key.Usage[0] != keyType {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Invalid %s key", keyType)),
+			}
+		}
+	}
+	if len(keys) > 0 && keys[crossSigningMaster] == nil && existing[crossSigningMaster] == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("A master key is needed first"),
+		}
+	}
+	for keyType, keyJSON := range keys {
+		if _, err = k.db.ExecContext(ctx, upsertCrossSigningKeySQL, device.UserID, keyType, string(keyJSON)); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+	}
+	if err = k.signingKeysChanged(ctx, device.UserID); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+}
+
+// passwordAuthRequired asks the client to authenticate with the password of
+// the user, as user-interactive auth with a single stage.
+func passwordAuthRequired(matrixErr *jsonerror.MatrixError) util.JSONResponse {
+	res := map[string]interface{}{
+		"flows":   []authtypes.Flow{{Stages: []authtypes.LoginType{loginTypePassword}}},
+		"params":  map[string]interface{}{},
+		"session": util.RandomString(16),
+	}
+	if matrixErr != nil {
+		res["errcode"] = matrixErr.ErrCode
+		res["error"] = matrixErr.Err
+	}
+	return util.JSONResponse{Code: http.StatusUnauthorized, JSON: res}
+}
+
+// uploadSignatures stores signatures by one of our users of their own
+// devices and cross-signing keys and of the master keys of other users. The
+// signatures aren't checked here: clients check them before trusting a key.
+func (k *e2eKeys) uploadSignatures(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	var body map[string]map[string]json.RawMessage
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	ctx := req.Context()
+	failures := make(map[string]map[string]*jsonerror.MatrixError)
+	fail := func(userID, keyID string, err *jsonerror.MatrixError) {
+		if failures[userID] == nil {
+			failures[userID] = make(map[string]*jsonerror.MatrixError)
+		}
+		failures[userID][keyID] = err
+	}
+	ownDevices, err := k.deviceKeys(ctx, device.UserID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	signingKeysChanged := false
+	for userID, objects := range body {
+		for keyID, object := range objects {
+			var signed struct {
+				Signatures keySignatures `json:"signatures"`
+			}
+			if err = json.Unmarshal(object, &signed); err != nil || len(signed.Signatures[device.UserID]) == 0 {
+				fail(userID, keyID, jsonerror.InvalidArgumentValue("No signatures by the user"))
+				continue
+			}
+			for signerKeyID, signature := range signed.Signatures[device.UserID] {
+				if _, err = k.db.ExecContext(ctx, upsertKeySignatureSQL, device.UserID, signerKeyID, userID, keyID, signature); err != nil {
+					return httputil.LogThenError(req, err)
+				}
+			}
+			if userID != device.UserID {
+				continue
+			}
+			if keys, ok := ownDevices[keyID]; ok {
+				if keys, err = mergeSignatures(keys, signed.Signatures); err == nil {
+					err = k.changed(ctx, userID, keyID, keys)
+				}
+				if err != nil {
+					return httputil.LogThenError(req, err)
+				}
+			} else {
+				signingKeysChanged = true
+			}
+		}
+	}
+	if signingKeysChanged {
+		if err = k.signingKeysChanged(ctx, device.UserID); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+	}
+	return util.JSONResponse{Code: http.StatusOK, JSON: map[string]interface{}{"failures": failures}}
+}
+
+// signingKeysChanged records a change to the cross-signing keys of one of our
+// users and tells the servers that share rooms with them.
+func (k *e2eKeys) signingKeysChanged(ctx context.Context, userID string) error {
+	if _, err := k.db.ExecContext(ctx, upsertDeviceListSQL, userID); err != nil {
+		return err
+	}
+	roomIDs := k.memberships.UserRooms(userID)
+	if len(roomIDs) == 0 || k.edus == nil {
+		return nil
+	}
+	keys, err := k.crossSigningKeys(ctx, userID, "")
+	if err != nil {
+		return err
+	}
+	update := signingKeyUpdate{
+		UserID:         userID,
+		MasterKey:      keys[crossSigningMaster],
+		SelfSigningKey: keys[crossSigningSelf],
+	}
+	edu := gomatrixserverlib.EDU{Type: MSigningKeyUpdate}
+	if edu.Content, err = json.Marshal(update); err != nil {
+		return err
+	}
+	k.edus.sendToRooms(roomIDs, &edu)
+	return nil
+}
+
+// addCrossSigning adds the cross-signing keys of one of our users to the
+// response to a key query, and the signatures that the requester can see
+// to the keys. The requester is empty for other servers, which see only
+// the signatures that the user made of their own keys.
+func (k *e2eKeys) addCrossSigning(ctx context.Context, res *keysQueryResponse, userID, requester string) error {
+	signatures, err := k.keySignatures(ctx, userID, requester)
+	if err != nil {
+		return err
+	}
+	for deviceID, keys := range res.DeviceKeys[userID] {
+		if signatures[deviceID] != nil {
+			if res.DeviceKeys[userID][deviceID], err = mergeSignatures(keys, signatures[deviceID]); err != nil {
+				return err
+			}
+		}
+	}
+	keys, err := k.crossSigningKeys(ctx, userID, requester)
+	if err != nil {
+		return err
+	}
+	add := func(m *map[string]json.RawMessage, key json.RawMessage) {
+		if key == nil {
+			return
+		}
+		if *m == nil {
+			*m = make(map[string]json.RawMessage)
+		}
+		(*m)[userID] = key
+	}
+	add(&res.MasterKeys, keys[crossSigningMaster])
+	add(&res.SelfSigningKeys, keys[crossSigningSelf])
+	// The user-signing key is only for the user's own devices.
+	if requester == userID {
+		add(&res.UserSigningKeys, keys[crossSigningUser])
+	}
+	return nil
+}
+
+// crossSigningKeys returns the cross-signing keys of one of our users by
+// type, with the signatures that the requester can see.
+func (k *e2eKeys) crossSigningKeys(ctx context.Context, userID, requester string) (map[string]json.RawMessage, error) {
+	rows, err := k.db.QueryContext(ctx, selectCrossSigningKeysSQL, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	keys := make(map[string]json.RawMessage)
+	for rows.Next() {
+		var keyType, keyJSON string
+		if err = rows.Scan(&keyType, &keyJSON); err != nil {
+			return nil, err
+		}
+		keys[keyType] = json.RawMessage(keyJSON)
+	}
+	if err = rows.Err(); err != nil || len(keys) == 0 {
+		return keys, err
+	}
+
+	signatures, err := k.keySignatures(ctx, userID, requester)
+	if err != nil {
+		return nil, err
+	}
+	for keyType, keyJSON := range keys {
+		var key crossSigningKey
+		if err = json.Unmarshal(keyJSON, &key); err != nil {
+			return nil, err
+		}
+		for keyID := range key.Keys {
+			// Signatures are by the key itself, without the algorithm.
+			public := keyID[strings.Index(keyID, ":")+1:]
+			if signatures[public] != nil {
+				if keys[keyType], err = mergeSignatures(keyJSON, signatures[public]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return keys, nil
+}
+
+// keySignatures returns the signatures of the keys of one of our users that
+// the requester can see, by key ID.
+func (k *e2eKeys) keySignatures(ctx context.Context, userID, requester string) (map[string]keySignatures, error) {
+	rows, err := k.db.QueryContext(ctx, selectKeySignaturesSQL, userID, requester)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	signatures := make(map[string]keySignatures)
+	for rows.Next() {
+		var originUserID, originKeyID, targetKeyID, signature string
+		if err = rows.Scan(&originUserID, &originKeyID, &targetKeyID, &signature); err != nil {
+			return nil, err
+		}
+		if signatures[targetKeyID] == nil {
+			signatures[targetKeyID] = make(keySignatures)
+		}
+		if signatures[targetKeyID][originUserID] == nil {
+			signatures[targetKeyID][originUserID] = make(map[string]string)
+		}
+		signatures[targetKeyID][originUserID][originKeyID] = signature
+	}
+	return signatures, rows.Err()
+}
+
+// mergeSignatures adds signatures to a signed JSON object.
+func mergeSignatures(object json.RawMessage, signatures keySignatures) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(object, &fields); err != nil {
+		return nil, err
+	}
+	existing := make(keySignatures)
+	if raw, ok := fields["signatures"]; ok {
+		if err := json.Unmarshal(raw, &existing); err != nil {
+			return nil, err
+		}
+	}
+	for userID, byKey := range signatures {
+		if existing[userID] == nil {
+			existing[userID] = make(map[string]string)
+		}
+		for keyID, signature := range byKey {
+			existing[userID][keyID] = signature
+		}
+	}
+	var err error
+	if fields["signatures"], err = json.Marshal(existing); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
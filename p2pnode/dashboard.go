@@ -0,0 +1,152 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+
+	autonat "github.com/libp2p/go-libp2p-autonat"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// DashboardPath is where the dashboard page is served. The page gets
+// everything that it shows from the admin API, so it asks for the admin
+// token rather than the page itself needing one.
+const DashboardPath = "/_dendrite/dashboard"
+
+// DashboardEventCount is how many of the most recent room events the
+// dashboard shows.
+const DashboardEventCount = 50
+
+// DashboardEvent is a room event, as shown on the dashboard.
+type DashboardEvent struct {
+	EventID        string                       `json:"event_id"`
+	Type           string                       `json:"type"`
+	RoomID         string                       `json:"room_id"`
+	Sender         string                       `json:"sender"`
+	Origin         gomatrixserverlib.ServerName `json:"origin"`
+	OriginServerTS gomatrixserverlib.Timestamp  `json:"origin_server_ts"`
+}
+
+// DashboardPeer is a connected peer, along with the rooms that we share with
+// it.
+type DashboardPeer struct {
+	PeerInfo
+	SharedRooms []string `json:"shared_rooms"`
+}
+
+// Dashboard is everything that the dashboard shows.
+type Dashboard struct {
+	PeerID       string           `json:"peer_id"`
+	Addrs        []string         `json:"addrs"`
+	Reachability string           `json:"reachability"`
+	Peers        []DashboardPeer  `json:"peers"`
+	Events       []DashboardEvent `json:"events"`
+}
+
+// eventFlow keeps the most recent room events, from the room server output
+// log, for the dashboard.
+type eventFlow struct {
+	mu     sync.Mutex
+	events []DashboardEvent
+}
+
+// start consumes the room server output log from the beginning.
+func (f *eventFlow) start(consumer sarama.Consumer, topic string) error {
+	c := common.ContinualConsumer{
+		Topic:          topic,
+		Consumer:       consumer,
+		PartitionStore: &memoryPartitionStore{},
+		ProcessMessage: f.onMessage,
+	}
+	return c.Start()
+}
+
+func (f *eventFlow) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		logrus.WithError(err).Error("Dashboard event flow: message parse failure")
+		return nil
+	}
+	if output.Type != api.OutputTypeNewRoomEvent {
+		return nil
+	}
+	ev := output.NewRoomEvent.Event
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, DashboardEvent{
+		EventID:        ev.EventID(),
+		Type:           ev.Type(),
+		RoomID:         ev.RoomID(),
+		Sender:         ev.Sender(),
+		Origin:         ev.Origin(),
+		OriginServerTS: ev.OriginServerTS(),
+	})
+	if len(f.events) > DashboardEventCount {
+		f.events = f.events[len(f.events)-DashboardEventCount:]
+	}
+	return nil
+}
+
+// recent returns the most recent events, newest first.
+func (f *eventFlow) recent() []DashboardEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	events := make([]DashboardEvent, len(f.events))
+	for i, ev := range f.events {
+		events[len(events)-1-i] = ev
+	}
+	return events
+}
+
+// Dashboard returns what the dashboard shows about the node right now.
+func (n *Node) Dashboard() Dashboard {
+	d := Dashboard{
+		PeerID:       n.Host.ID().Pretty(),
+		Addrs:        addrStrings(n.Host.Addrs()),
+		Reachability: "unknown",
+		Peers:        []DashboardPeer{},
+		Events:       n.events.recent(),
+	}
+	switch n.AutoNAT.Status() {
+	case autonat.NATStatusPublic:
+		d.Reachability = "public"
+	case autonat.NATStatusPrivate:
+		d.Reachability = "private"
+	}
+	for _, info := range n.Peers() {
+		rooms := n.Memberships.SharedRooms(gomatrixserverlib.ServerName(info.PeerID))
+		if rooms == nil {
+			rooms = []string{}
+		}
+		d.Peers = append(d.Peers, DashboardPeer{PeerInfo: info, SharedRooms: rooms})
+	}
+	return d
+}
+
+// setupDashboard registers the dashboard page.
+func (n *Node) setupDashboard(mux *http.ServeMux) {
+	mux.HandleFunc(DashboardPath, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, dashboardHTML)
+	})
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+// dashboardHTML is the dashboard page. It polls the admin API for the
+// dashboard and draws this node in the middle with its peers around it.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Dendrite P2P dashboard</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+code { font-size: 0.85em; }
+#layout { display: flex; flex-wrap: wrap; gap: 2em; }
+#mesh { border: 1px solid #ddd; border-radius: 4px; }
+table { border-collapse: collapse; font-size: 0.9em; }
+td, th { text-align: left; padding: 0.2em 0.8em 0.2em 0; vertical-align: top; }
+.public { color: #080; } .private { color: #a60; } .unknown { color: #888; }
+#error { color: #c00; }
+</style>
+</head>
+<body>
+<h1>Dendrite P2P dashboard</h1>
+<p id="error"></p>
+<p>Peer ID: <code id="peer-id"></code><br>
+Reachability: <span id="reachability"></span><br>
+Addresses: <code id="addrs"></code></p>
+<div id="layout">
+<svg id="mesh" width="480" height="480"></svg>
+<div>
+<h2>Peers</h2>
+<table><thead><tr><th>Peer</th><th>Connections</th><th>Shared rooms</th></tr></thead><tbody id="peers"></tbody></table>
+</div>
+</div>
+<h2>Recent events</h2>
+<table><thead><tr><th>Time</th><th>Type</th><th>Room</th><th>Sender</th></tr></thead><tbody id="events"></tbody></table>
+<script>
+"use strict";
+var tokenKey = "dendrite-p2p-admin-token";
+var svgNS = "http://www.w3.org/2000/svg";
+
+function token() {
+  var t = localStorage.getItem(tokenKey);
+  if (!t) {
+    t = prompt("Admin access token (from the admin token file in the data directory)");
+    if (t) { localStorage.setItem(tokenKey, t); }
+  }
+  return t;
+}
+
+function short(id) { return id.length > 16 ? id.slice(0, 6) + "…" + id.slice(-6) : id; }
+
+function cell(row, text, title) {
+  var td = document.createElement("td");
+  td.textContent = text;
+  if (title) { td.title = title; }
+  row.appendChild(td);
+}
+
+function svg(name, attrs) {
+  var el = document.createElementNS(svgNS, name);
+  for (var k in attrs) { el.setAttribute(k, attrs[k]); }
+  return el;
+}
+
+function drawMesh(d) {
+  var mesh = document.getElementById("mesh");
+  while (mesh.firstChild) { mesh.removeChild(mesh.firstChild); }
+  var cx = 240, cy = 240, r = 180;
+  d.peers.forEach(function(p, i) {
+    var a = 2 * Math.PI * i / d.peers.length;
+    var x = cx + r * Math.cos(a), y = cy + r * Math.sin(a);
+    var shared = p.shared_rooms.length > 0;
+    mesh.appendChild(svg("line", {x1: cx, y1: cy, x2: x, y2: y, stroke: shared ? "#36c" : "#ccc", "stroke-width": shared ? 2 : 1}));
+    var node = svg("circle", {cx: x, cy: y, r: 8, fill: shared ? "#36c" : "#999"});
+    var title = svg("title", {});
+    title.textContent = p.peer_id + "\n" + p.shared_rooms.length + " shared rooms";
+    node.appendChild(title);
+    mesh.appendChild(node);
+  });
+  mesh.appendChild(svg("circle", {cx: cx, cy: cy, r: 14, fill: "#0a0"}));
+}
+
+function render(d) {
+  document.getElementById("peer-id").textContent = d.peer_id;
+  var reach = document.getElementById("reachability");
+  reach.textContent = d.reachability;
+  reach.className = d.reachability;
+  document.getElementById("addrs").textContent = d.addrs.join(" ");
+
+  var peers = document.getElementById("peers");
+  peers.innerHTML = "";
+  d.peers.forEach(function(p) {
+    var row = document.createElement("tr");
+    cell(row, short(p.peer_id), p.peer_id);
+    cell(row, p.connections.map(function(c) { return c.direction + " " + c.addr; }).join("\n"));
+    cell(row, String(p.shared_rooms.length), p.shared_rooms.join("\n"));
+    peers.appendChild(row);
+  });
+
+  var events = document.getElementById("events");
+  events.innerHTML = "";
+  d.events.forEach(function(ev) {
+    var row = document.createElement("tr");
+    cell(row, new Date(ev.origin_server_ts).toLocaleTimeString());
+    cell(row, ev.type);
+    cell(row, short(ev.room_id), ev.room_id);
+    cell(row, short(ev.sender), ev.sender);
+    events.appendChild(row);
+  });
+  drawMesh(d);
+}
+
+function refresh() {
+  var t = token();
+  if (!t) { return; }
+  fetch("` + AdminPathPrefix + `/dashboard", {headers: {"Authorization": "Bearer " + t}})
+    .then(function(res) {
+      if (res.status === 401) { localStorage.removeItem(tokenKey); throw new Error("The admin token was wrong"); }
+      if (!res.ok) { throw new Error("The node returned " + res.status); }
+      return res.json();
+    })
+    .then(function(d) { document.getElementById("error").textContent = ""; render(d); })
+    .catch(function(err) { document.getElementById("error").textContent = err.message; });
+}
+
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
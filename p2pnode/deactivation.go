@@ -0,0 +1,504 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// DeactivateClientPath is where users deactivate their accounts.
+const DeactivateClientPath = "/_matrix/client/r0/account/deactivate"
+
+// MErasure is the type of the EDU that asks the other p2p nodes in the rooms
+// of a user who has been erased to delete their copies of the user's media.
+const MErasure = "org.matrix.dendrite.p2p.erasure"
+
+// ErasureInterval is how often the rooms of deactivated users are left and
+// erased users' events and media are deleted, for the deactivations that
+// haven't been finished, e.g. because the node stopped part way through.
+const ErasureInterval = time.Minute
+
+const deactivationsSchema = `
+-- The users whose accounts have been deactivated, and whether everything
+-- that they sent is to be erased too. Deactivation is done once their rooms
+-- have been left and, if they are being erased, their events redacted and
+-- their media deleted.
+CREATE TABLE IF NOT EXISTS p2p_deactivated_users (
+    localpart TEXT PRIMARY KEY,
+    erase BOOLEAN NOT NULL,
+    deactivated_ts BIGINT NOT NULL,
+    done BOOLEAN NOT NULL DEFAULT FALSE
+);
+`
+
+// A user who was deactivated without being erased can still be erased.
+const upsertDeactivatedUserSQL = "" +
+	"INSERT INTO p2p_deactivated_users (localpart, erase, deactivated_ts) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (localpart) DO UPDATE SET erase = TRUE, done = FALSE WHERE $2 AND NOT p2p_deactivated_users.erase"
+
+const selectDeactivatedUserSQL = "" +
+	"SELECT 1 FROM p2p_deactivated_users WHERE localpart = $1"
+
+const selectUnfinishedDeactivationsSQL = "" +
+	"SELECT localpart, erase FROM p2p_deactivated_users WHERE NOT done ORDER BY deactivated_ts"
+
+const updateDeactivationDoneSQL = "" +
+	"UPDATE p2p_deactivated_users SET done = TRUE WHERE localpart = $1 AND erase = $2"
+
+const selectUserEventsSQL = "" +
+	"SELECT event_id, room_id, event_json FROM syncapi_output_room_events WHERE sender = $1 ORDER BY id"
+
+const updateSyncEventJSONSQL = "" +
+	"UPDATE syncapi_output_room_events SET event_json = $2 WHERE event_id = $1"
+
+const updateRoomserverEventJSONSQL = "" +
+	"UPDATE roomserver_event_json SET event_json = $2" +
+	" WHERE event_nid = (SELECT event_nid FROM roomserver_events WHERE event_id = $1)"
+
+const selectUserMediaSQL = "" +
+	"SELECT media_id FROM mediaapi_media_repository WHERE user_id = $1 AND media_origin = $2"
+
+const selectMediaHashSQL = "" +
+	"SELECT base64hash FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2"
+
+const countMediaByHashSQL = "" +
+	"SELECT COUNT(*) FROM mediaapi_media_repository WHERE base64hash = $1"
+
+var deleteMediaByIDSQLs = []string{
+	"DELETE FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2",
+	"DELETE FROM p2p_media_access WHERE media_id = $1 AND media_origin = $2",
+	"DELETE FROM p2p_media WHERE media_id = $1 AND media_origin = $2",
+	"DELETE FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2",
+}
+
+// erasureContent is the content of an org.matrix.dendrite.p2p.erasure EDU.
+type erasureContent struct {
+	UserID   string   `json:"user_id"`
+	MediaIDs []string `json:"media_ids"`
+}
+
+// accountDeactivation lets users deactivate their accounts, which logs them
+// out, stops them logging in again, and leaves their rooms. They can ask to
+// be erased too, for which every event that they sent is redacted, both by
+// sending redactions to the other servers in their rooms and by redacting
+// our own copies, and the media that they uploaded is deleted, along with
+// the copies of it on the other p2p nodes in their rooms. As there could be
+// a lot to do, the rooms are left and the user erased in the background,
+// carrying on after a restart until it is done.
+type accountDeactivation struct {
+	db           *sql.DB
+	syncDB       *sql.DB
+	roomserverDB *sql.DB
+	mediaDB      *sql.DB
+	accountDB    *accounts.Database
+	deviceDB     *devices.Database
+	authData     auth.Data
+	cfg          *config.Dendrite
+	query        api.RoomserverQueryAPI
+	producer     *producers.RoomserverProducer
+	memberships  *RoomMemberships
+	edus         *eduGossip
+	// wake starts the next deactivation straight away.
+	wake chan struct{}
+}
+
+func newAccountDeactivation(
+	cfg *config.Dendrite, accountDB *accounts.Database, deviceDB *devices.Database, authData auth.Data,
+	query api.RoomserverQueryAPI, input api.RoomserverInputAPI, memberships *RoomMemberships,
+) (*accountDeactivation, error) {
+	var dbs [4]*sql.DB
+	for i, dataSource := range []config.DataSource{
+		cfg.Database.Account, cfg.Database.SyncAPI, cfg.Database.RoomServer, cfg.Database.MediaAPI,
+	} {
+		db, err := sql.Open("postgres", string(dataSource))
+		if err != nil {
+			return nil, err
+		}
+		dbs[i] = db
+	}
+	if _, err := dbs[0].Exec(deactivationsSchema); err != nil {
+		return nil, err
+	}
+	return &accountDeactivation{
+		db:           dbs[0],
+		syncDB:       dbs[1],
+		roomserverDB: dbs[2],
+		mediaDB:      dbs[3],
+		accountDB:    accountDB,
+		deviceDB:     deviceDB,
+		authData:     authData,
+		cfg:          cfg,
+		query:        query,
+		producer:     producers.NewRoomserverProducer(input),
+		memberships:  memberships,
+		wake:         make(chan struct{}, 1),
+	}, nil
+}
+
+// setup registers the client API.
+func (d *accountDeactivation) setup(mux *http.ServeMux) {
+	mux.Handle(DeactivateClientPath, common.WrapHandlerInCORS(common.MakeAuthAPI(
+		"account_deactivate", d.authData, d.serveDeactivate,
+	)))
+}
+
+// serveDeactivate deactivates the account of a user who gives their
+// password. erase isn't in the spec, but is what clients send to Synapse to
+// ask to be forgotten.
+func (d *accountDeactivation) serveDeactivate(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	var body struct {
+		Erase bool `json:"erase"`
+		Auth  *struct {
+			Type     string `json:"type"`
+			Password string `json:"password"`
+		} `json:"auth"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if body.Auth == nil || body.Auth.Type != string(loginTypePassword) {
+		return passwordAuthRequired(nil)
+	}
+	if _, err = d.accountDB.GetAccountByPassword(req.Context(), localpart, body.Auth.Password); err != nil {
+		return passwordAuthRequired(jsonerror.Forbidden("Invalid password"))
+	}
+	if err = d.deactivate(req.Context(), localpart, body.Erase); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]string{"id_server_unbind_result": "no-support"},
+	}
+}
+
+// deactivate stops a user logging in, logs out all of their devices, and
+// removes their email addresses. Their rooms are left, and they are erased
+// if they asked to be, in the background.
+func (d *accountDeactivation) deactivate(ctx context.Context, localpart string, erase bool) error {
+	_, err := d.db.ExecContext(
+		ctx, upsertDeactivatedUserSQL, localpart, erase, int64(gomatrixserverlib.AsTimestamp(time.Now())),
+	)
+	if err != nil {
+		return err
+	}
+	if _, err = d.db.ExecContext(ctx, updatePasswordHashSQL, nil, localpart); err != nil {
+		return err
+	}
+	if err = d.deviceDB.RemoveAllDevices(ctx, localpart); err != nil {
+		return err
+	}
+	threepids, err := d.accountDB.GetThreePIDsForLocalpart(ctx, localpart)
+	if err != nil {
+		return err
+	}
+	for _, threepid := range threepids {
+		if err = d.accountDB.RemoveThreePIDAssociation(ctx, threepid.Address, threepid.Medium); err != nil {
+			return err
+		}
+	}
+	logrus.WithFields(logrus.Fields{"user": localpart, "erase": erase}).Info("Deactivated account")
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// deactivated returns whether a user's account has been deactivated.
+func (d *accountDeactivation) deactivated(ctx context.Context, localpart string) (bool, error) {
+	var one int
+	err := d.db.QueryRowContext(ctx, selectDeactivatedUserSQL, localpart).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// start finishes the deactivations that haven't been, every ErasureInterval
+// or once a user is deactivated, until the context is done.
+func (d *accountDeactivation) start(ctx context.Context) {
+	ticker := time.NewTicker(ErasureInterval)
+	defer ticker.Stop()
+	for {
+		if err := d.finishAll(ctx); err != nil {
+			logrus.WithError(err).Warn("Failed to finish deactivating accounts")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+func (d *accountDeactivation) finishAll(ctx context.Context) error {
+	rows, err := d.db.QueryContext(ctx, selectUnfinishedDeactivationsSQL)
+	if err != nil {
+		return err
+	}
+	type deactivation struct {
+		localpart string
+		erase     bool
+	}
+	var pending []deactivation
+	for rows.Next() {
+		var p deactivation
+		if err = rows.Scan(&p.localpart, &p.erase); err != nil {
+			rows.Close() // nolint: errcheck
+			return err
+		}
+		pending = append(pending, p)
+	}
+	rows.Close() // nolint: errcheck
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, p := range pending {
+		if err = d.finish(ctx, p.localpart, p.erase); err != nil {
+			return err
+		}
+		if _, err = d.db.ExecContext(ctx, updateDeactivationDoneSQL, p.localpart, p.erase); err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{"user": p.localpart, "erase": p.erase}).Info("Finished deactivating account")
+	}
+	return nil
+}
+
+// finish erases a user if they are to be, then leaves their rooms and
+// clears their profile. It is safe to do again if it was interrupted.
+func (d *accountDeactivation) finish(ctx context.Context, localpart string, erase bool) error {
+	userID := fmt.Sprintf("@%s:%s", localpart, d.cfg.Matrix.ServerName)
+	rooms := d.memberships.UserRooms(userID)
+	if erase {
+		mediaIDs, err := d.userMedia(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if err = d.redactEvents(ctx, userID); err != nil {
+			return err
+		}
+		// The other nodes are told while the user is still in the rooms
+		// that it is gossiped in.
+		if len(mediaIDs) > 0 && len(rooms) > 0 && d.edus != nil {
+			edu := gomatrixserverlib.EDU{Type: MErasure}
+			if edu.Content, err = json.Marshal(erasureContent{UserID: userID, MediaIDs: mediaIDs}); err != nil {
+				return err
+			}
+			d.edus.sendToRooms(rooms, &edu)
+		}
+		for _, mediaID := range mediaIDs {
+			if err = d.eraseMedia(ctx, d.cfg.Matrix.ServerName, mediaID); err != nil {
+				return err
+			}
+		}
+	}
+	for _, roomID := range rooms {
+		leave := gomatrixserverlib.EventBuilder{
+			Sender:   userID,
+			RoomID:   roomID,
+			Type:     gomatrixserverlib.MRoomMember,
+			StateKey: &userID,
+		}
+		if err := leave.SetContent(map[string]string{"membership": "leave"}); err != nil {
+			return err
+		}
+		if err := d.send(ctx, &leave); err != nil {
+			return fmt.Errorf("failed to leave room %s: %s", roomID, err)
+		}
+	}
+	if err := d.accountDB.SetDisplayName(ctx, localpart, ""); err != nil {
+		return err
+	}
+	return d.accountDB.SetAvatarURL(ctx, localpart, "")
+}
+
+// redactEvents redacts the events that a user sent. Those in rooms that
+// the user is still in are redacted for everyone else in them too. State
+// events are only redacted if they are the user's own membership, as the
+// state of a room that the user set, e.g. its name, belongs to the room.
+func (d *accountDeactivation) redactEvents(ctx context.Context, userID string) error {
+	rows, err := d.syncDB.QueryContext(ctx, selectUserEventsSQL, userID)
+	if err != nil {
+		return err
+	}
+	type userEvent struct {
+		eventID string
+		roomID  string
+		event   gomatrixserverlib.Event
+	}
+	var events []userEvent
+	for rows.Next() {
+		var e userEvent
+		var eventJSON []byte
+		if err = rows.Scan(&e.eventID, &e.roomID, &eventJSON); err != nil {
+			rows.Close() // nolint: errcheck
+			return err
+		}
+		if e.event, err = gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false); err != nil {
+			continue
+		}
+		events = append(events, e)
+	}
+	rows.Close() // nolint: errcheck
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, e := range events {
+		stateKey := e.event.StateKey()
+		if e.event.Type() == gomatrixserverlib.MRoomRedaction ||
+			(stateKey != nil && (e.event.Type() != gomatrixserverlib.MRoomMember || *stateKey != userID)) {
+			continue
+		}
+		redacted := e.event.Redact()
+		if string(redacted.JSON()) == string(e.event.JSON()) {
+			// It was redacted already, the last time around.
+			continue
+		}
+		if d.memberships.Joined(e.roomID, userID) {
+			redaction := gomatrixserverlib.EventBuilder{
+				Sender:  userID,
+				RoomID:  e.roomID,
+				Type:    gomatrixserverlib.MRoomRedaction,
+				Redacts: e.eventID,
+			}
+			if err = redaction.SetContent(map[string]string{"reason": "The user asked to be erased"}); err != nil {
+				return err
+			}
+			if err = d.send(ctx, &redaction); err != nil {
+				return fmt.Errorf("failed to redact event %s: %s", e.eventID, err)
+			}
+		}
+		if _, err = d.syncDB.ExecContext(ctx, updateSyncEventJSONSQL, e.eventID, string(redacted.JSON())); err != nil {
+			return err
+		}
+		if _, err = d.roomserverDB.ExecContext(ctx, updateRoomserverEventJSONSQL, e.eventID, string(redacted.JSON())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send sends an event as one of our users to the rooms server, which sends
+// it on to the other servers in the room.
+func (d *accountDeactivation) send(ctx context.Context, builder *gomatrixserverlib.EventBuilder) error {
+	event, err := common.BuildEvent(ctx, builder, *d.cfg, time.Now(), d.query, nil)
+	if err != nil {
+		return err
+	}
+	_, err = d.producer.SendEvents(ctx, []gomatrixserverlib.Event{*event}, d.cfg.Matrix.ServerName, nil)
+	return err
+}
+
+func (d *accountDeactivation) userMedia(ctx context.Context, userID string) ([]string, error) {
+	rows, err := d.mediaDB.QueryContext(ctx, selectUserMediaSQL, userID, string(d.cfg.Matrix.ServerName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	var mediaIDs []string
+	for rows.Next() {
+		var mediaID string
+		if err = rows.Scan(&mediaID); err != nil {
+			return nil, err
+		}
+		mediaIDs = append(mediaIDs, mediaID)
+	}
+	return mediaIDs, rows.Err()
+}
+
+// eraseMedia deletes a piece of media, along with its file unless the file
+// is also stored under another media ID, e.g. because someone else uploaded
+// the same file.
+func (d *accountDeactivation) eraseMedia(ctx context.Context, origin gomatrixserverlib.ServerName, mediaID string) error {
+	txn, err := d.mediaDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback() // nolint: errcheck
+	var hash string
+	err = txn.QueryRowContext(ctx, selectMediaHashSQL, mediaID, string(origin)).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var count int
+	if err = txn.QueryRowContext(ctx, countMediaByHashSQL, hash).Scan(&count); err != nil {
+		return err
+	}
+	if count > 1 {
+		for _, query := range deleteMediaByIDSQLs {
+			if _, err = txn.ExecContext(ctx, query, mediaID, string(origin)); err != nil {
+				return err
+			}
+		}
+		return txn.Commit()
+	}
+	if err = deleteMediaByHash(ctx, txn, types.Base64Hash(hash)); err != nil {
+		return err
+	}
+	if err = txn.Commit(); err != nil {
+		return err
+	}
+	path, err := fileutils.GetPathFromBase64Hash(types.Base64Hash(hash), d.cfg.Media.AbsBasePath)
+	if err != nil {
+		return err
+	}
+	// The thumbnails are in the same directory as the file.
+	return os.RemoveAll(filepath.Dir(path))
+}
+
+// onRemote deletes our copies of the media of a user on another server who
+// has been erased. Only the server of the user can ask for them to be.
+func (d *accountDeactivation) onRemote(ctx context.Context, origin gomatrixserverlib.ServerName, content *erasureContent) error {
+	for _, mediaID := range content.MediaIDs {
+		if err := d.eraseMedia(ctx, origin, mediaID); err != nil {
+			return err
+		}
+	}
+	logrus.WithFields(logrus.Fields{"user_id": content.UserID, "media": len(content.MediaIDs)}).Info(
+		"Deleted media of erased user",
+	)
+	return nil
+}
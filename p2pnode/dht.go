@@ -0,0 +1,100 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	discovery "github.com/libp2p/go-libp2p-discovery"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/matrix-org/dendrite/common/keydb"
+	"github.com/sirupsen/logrus"
+)
+
+// DHTRendezvous is the namespace that Matrix nodes advertise themselves
+// under in the DHT. It matches the protocol that we serve the Matrix APIs on.
+const DHTRendezvous = MatrixProtocol
+
+// DHTDiscoveryInterval is how often we look for other Matrix nodes in the DHT.
+const DHTDiscoveryInterval = time.Minute
+
+// setupDHTDiscovery joins the public DHT by connecting to the default
+// bootstrap peers, then advertises this node under the Matrix rendezvous and
+// periodically looks for other nodes advertising the same. In a private
+// network the public bootstrap peers are unreachable, so the DHT is made up
+// of whichever private peers we find by other means.
+func setupDHTDiscovery(ctx context.Context, p2pHost host.Host, p2pDHT *dht.IpfsDHT, keyDB keydb.Database, private bool) error {
+	bootstrapPeers := dht.DefaultBootstrapPeers
+	if private {
+		bootstrapPeers = nil
+	}
+	for _, addr := range bootstrapPeers {
+		info, err := peer.AddrInfoFromP2pAddr(addr)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := p2pHost.Connect(ctx, *info); err != nil {
+				logrus.WithError(err).WithField("peer", info.ID.String()).Debug("Failed to connect to DHT bootstrap peer")
+			}
+		}()
+	}
+	if err := p2pDHT.Bootstrap(ctx); err != nil {
+		return err
+	}
+
+	routingDiscovery := discovery.NewRoutingDiscovery(p2pDHT)
+	discovery.Advertise(ctx, routingDiscovery, DHTRendezvous)
+	go findDHTPeers(ctx, p2pHost, routingDiscovery, keyDB)
+	return nil
+}
+
+// findDHTPeers connects to any Matrix nodes advertised in the DHT that we
+// aren't already connected to, until the context is cancelled.
+func findDHTPeers(ctx context.Context, p2pHost host.Host, d discovery.Discoverer, keyDB keydb.Database) {
+	ticker := time.NewTicker(DHTDiscoveryInterval)
+	defer ticker.Stop()
+	for {
+		peers, err := d.FindPeers(ctx, DHTRendezvous)
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to find peers in the DHT")
+		} else {
+			for p := range peers {
+				if p.ID == p2pHost.ID() || len(p.Addrs) == 0 {
+					continue
+				}
+				if p2pHost.Network().Connectedness(p.ID) == network.Connected {
+					continue
+				}
+				logger := logrus.WithField("peer", p.ID.String())
+				if err := connectPeer(ctx, p2pHost, keyDB, p); err != nil {
+					logger.WithError(err).Debug("Failed to connect to peer found via DHT")
+					continue
+				}
+				logger.WithField("addrs", p.Addrs).Info("Connected to peer found via DHT")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
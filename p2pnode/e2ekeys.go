@@ -0,0 +1,841 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// KeysClientPathPrefix starts the client APIs for end-to-end encryption
+	// keys: /upload, /query, /claim and /changes.
+	KeysClientPathPrefix = "/_matrix/client/r0/keys/"
+	// KeysQueryFederationPath is where other servers fetch the device keys
+	// of our users.
+	KeysQueryFederationPath = "/_matrix/federation/v1/user/keys/query"
+	// KeysClaimFederationPath is where other servers claim one-time keys of
+	// our users' devices.
+	KeysClaimFederationPath = "/_matrix/federation/v1/user/keys/claim"
+	// UserDevicesFederationPathPrefix starts the federation API for the
+	// device list of one of our users. The user ID follows it.
+	UserDevicesFederationPathPrefix = "/_matrix/federation/v1/user/devices/"
+)
+
+// MDeviceListUpdate is the type of the EDU that tells other servers about a
+// change to the devices of one of our users.
+const MDeviceListUpdate = "m.device_list_update"
+
+// KeysFederationTimeout is how long a key query or claim waits for other
+// servers if the client doesn't say, as in the spec.
+const KeysFederationTimeout = time.Second * 10
+
+// DeviceListPruneInterval is how often the keys of devices that have been
+// deleted are removed. Dendrite doesn't say when a device is deleted, so we
+// look.
+const DeviceListPruneInterval = time.Minute
+
+const e2eKeysSchema = `
+-- The device keys of our users' devices.
+CREATE TABLE IF NOT EXISTS p2p_device_keys (
+    user_id TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    key_json TEXT NOT NULL,
+    PRIMARY KEY (user_id, device_id)
+);
+
+-- The one-time keys of our users' devices that haven't been claimed yet.
+CREATE TABLE IF NOT EXISTS p2p_one_time_keys (
+    user_id TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    key_id TEXT NOT NULL,
+    algorithm TEXT NOT NULL,
+    key_json TEXT NOT NULL,
+    PRIMARY KEY (user_id, device_id, key_id)
+);
+
+CREATE SEQUENCE IF NOT EXISTS p2p_device_list_id;
+
+-- The latest change to the devices of each user, ours or from another
+-- server. The ID goes up with every change, so that /sync can tell which
+-- users have changed since a device last called it.
+CREATE TABLE IF NOT EXISTS p2p_device_lists (
+    user_id TEXT PRIMARY KEY,
+    id BIGINT NOT NULL DEFAULT nextval('p2p_device_list_id')
+);
+`
+
+const upsertDeviceKeysSQL = "" +
+	"INSERT INTO p2p_device_keys (user_id, device_id, key_json) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (user_id, device_id) DO UPDATE SET key_json = $3" +
+	" WHERE p2p_device_keys.key_json <> $3"
+
+const selectDeviceKeysSQL = "" +
+	"SELECT device_id, key_json FROM p2p_device_keys WHERE user_id = $1"
+
+const selectDeviceKeyUsersSQL = "" +
+	"SELECT DISTINCT user_id FROM p2p_device_keys"
+
+const deleteDeviceKeysSQL = "" +
+	"DELETE FROM p2p_device_keys WHERE user_id = $1 AND device_id = $2"
+
+const upsertOneTimeKeySQL = "" +
+	"INSERT INTO p2p_one_time_keys (user_id, device_id, key_id, algorithm, key_json) VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (user_id, device_id, key_id) DO UPDATE SET key_json = $5"
+
+const countOneTimeKeysSQL = "" +
+	"SELECT algorithm, COUNT(*) FROM p2p_one_time_keys WHERE user_id = $1 AND device_id = $2 GROUP BY algorithm"
+
+const claimOneTimeKeySQL = "" +
+	"DELETE FROM p2p_one_time_keys WHERE (user_id, device_id, key_id) IN (" +
+	"SELECT user_id, device_id, key_id FROM p2p_one_time_keys" +
+	" WHERE user_id = $1 AND device_id = $2 AND algorithm = $3 LIMIT 1 FOR UPDATE SKIP LOCKED" +
+	") RETURNING key_id, key_json"
+
+const deleteOneTimeKeysSQL = "" +
+	"DELETE FROM p2p_one_time_keys WHERE user_id = $1 AND device_id = $2"
+
+const upsertDeviceListSQL = "" +
+	"INSERT INTO p2p_device_lists (user_id) VALUES ($1)" +
+	" ON CONFLICT (user_id) DO UPDATE SET id = nextval('p2p_device_list_id')" +
+	" RETURNING id"
+
+const selectDeviceListIDSQL = "" +
+	"SELECT id FROM p2p_device_lists WHERE user_id = $1"
+
+const selectDeviceListsSQL = "" +
+	"SELECT user_id, id FROM p2p_device_lists WHERE user_id = ANY($1) AND id > $2"
+
+// deviceListUpdate is the content of an m.device_list_update EDU.
+type deviceListUpdate struct {
+	UserID   string          `json:"user_id"`
+	DeviceID string          `json:"device_id"`
+	StreamID int64           `json:"stream_id"`
+	PrevID   []int64         `json:"prev_id"`
+	Deleted  bool            `json:"deleted,omitempty"`
+	Keys     json.RawMessage `json:"keys,omitempty"`
+}
+
+// keysQueryRequest is the body of a key query, from a client or a server.
+type keysQueryRequest struct {
+	DeviceKeys map[string][]string `json:"device_keys"`
+	Timeout    int64               `json:"timeout,omitempty"`
+}
+
+// keysQueryResponse is the response to a key query. Device keys are by user
+// ID and device ID, and cross-signing keys by user ID.
+type keysQueryResponse struct {
+	DeviceKeys      map[string]map[string]json.RawMessage `json:"device_keys"`
+	MasterKeys      map[string]json.RawMessage            `json:"master_keys,omitempty"`
+	SelfSigningKeys map[string]json.RawMessage            `json:"self_signing_keys,omitempty"`
+	UserSigningKeys map[string]json.RawMessage            `json:"user_signing_keys,omitempty"`
+	Failures        map[string]interface{}                `json:"failures,omitempty"`
+}
+
+// keysClaimRequest is the body of a key claim, from a client or a server. It
+// holds the algorithm to claim a key of, by user ID and device ID.
+type keysClaimRequest struct {
+	OneTimeKeys map[string]map[string]string `json:"one_time_keys"`
+	Timeout     int64                        `json:"timeout,omitempty"`
+}
+
+// keysClaimResponse is the response to a key claim. It holds the claimed key
+// by user ID, device ID and key ID.
+type keysClaimResponse struct {
+	OneTimeKeys map[string]map[string]map[string]json.RawMessage `json:"one_time_keys"`
+	Failures    map[string]interface{}                           `json:"failures,omitempty"`
+}
+
+// e2eKeys stores the end-to-end encryption keys of our users' devices and
+// their cross-signing keys, and keeps track of whose keys have changed so
+// that clients know to fetch them again. Dendrite has none of this. Changes
+// to our users' keys are gossiped along with the other ephemeral events of
+// their rooms.
+type e2eKeys struct {
+	db          *sql.DB
+	cfg         *config.Dendrite
+	federation  *gomatrixserverlib.FederationClient
+	deviceDB    *devices.Database
+	accountDB   *accounts.Database
+	authData    auth.Data
+	memberships *RoomMemberships
+	edus        *eduGossip
+
+	mu sync.Mutex
+	// delivered holds the device list ID that each device has been sent
+	// changes up to in /sync, by user ID and device ID.
+	delivered map[string]int64
+}
+
+func newE2EKeys(
+	dataSourceName string, cfg *config.Dendrite, federation *gomatrixserverlib.FederationClient,
+	deviceDB *devices.Database, accountDB *accounts.Database, authData auth.Data, memberships *RoomMemberships,
+) (*e2eKeys, error) {
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(e2eKeysSchema); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(crossSigningSchema); err != nil {
+		return nil, err
+	}
+	return &e2eKeys{
+		db:          db,
+		cfg:         cfg,
+		federation:  federation,
+		deviceDB:    deviceDB,
+		accountDB:   accountDB,
+		authData:    authData,
+		memberships: memberships,
+		delivered:   make(map[string]int64),
+	}, nil
+}
+
+// setup registers the client and federation APIs, and starts removing the
+// keys of deleted devices until the context is done.
+func (k *e2eKeys) setup(ctx context.Context, mux *http.ServeMux, keyRing gomatrixserverlib.KeyRing) {
+	keysAPI := common.WrapHandlerInCORS(common.MakeAuthAPI("keys", k.authData,
+		func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			// Everything after /keys/, for either prefix.
+			path := req.URL.Path[strings.Index(req.URL.Path, "/keys/")+len("/keys/"):]
+			switch path {
+			case "upload":
+				return k.upload(req, device)
+			case "device_signing/upload":
+				return k.uploadSigningKeys(req, device)
+			case "signatures/upload":
+				return k.uploadSignatures(req, device)
+			case "query":
+				var body keysQueryRequest
+				if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+					return *resErr
+				}
+				res, err := k.query(req.Context(), &body, device.UserID)
+				if err != nil {
+					return httputil.LogThenError(req, err)
+				}
+				return util.JSONResponse{Code: http.StatusOK, JSON: res}
+			case "claim":
+				var body keysClaimRequest
+				if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+					return *resErr
+				}
+				res, err := k.claim(req.Context(), &body)
+				if err != nil {
+					return httputil.LogThenError(req, err)
+				}
+				return util.JSONResponse{Code: http.StatusOK, JSON: res}
+			case "changes":
+				// Sync tokens are the sync API's, so every change is listed.
+				changed, _, err := k.changesSince(req.Context(), device.UserID, 0)
+				if err != nil {
+					return httputil.LogThenError(req, err)
+				}
+				return util.JSONResponse{
+					Code: http.StatusOK,
+					JSON: map[string][]string{"changed": changed, "left": {}},
+				}
+			default:
+				return util.JSONResponse{
+					Code: http.StatusNotFound,
+					JSON: jsonerror.NotFound("Unknown keys API"),
+				}
+			}
+		},
+	))
+	mux.Handle(KeysClientPathPrefix, keysAPI)
+	mux.Handle(UnstableKeysClientPathPrefix, keysAPI)
+	serverName := k.cfg.Matrix.ServerName
+	mux.Handle(KeysQueryFederationPath, common.MakeFedAPI("federation_keys_query", serverName, keyRing,
+		func(req *http.Request, fedReq *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			var body keysQueryRequest
+			if err := json.Unmarshal(fedReq.Content(), &body); err != nil {
+				return util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.BadJSON(err.Error())}
+			}
+			res, err := k.queryLocal(req.Context(), body.DeviceKeys, "")
+			if err != nil {
+				return httputil.LogThenError(req, err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: res}
+		},
+	))
+	mux.Handle(KeysClaimFederationPath, common.MakeFedAPI("federation_keys_claim", serverName, keyRing,
+		func(req *http.Request, fedReq *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			var body keysClaimRequest
+			if err := json.Unmarshal(fedReq.Content(), &body); err != nil {
+				return util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.BadJSON(err.Error())}
+			}
+			res, err := k.claimLocal(req.Context(), body.OneTimeKeys)
+			if err != nil {
+				return httputil.LogThenError(req, err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: res}
+		},
+	))
+	// This replaces the federation API's own, which leaves out the keys.
+	mux.Handle(UserDevicesFederationPathPrefix, common.MakeFedAPI("federation_user_devices", serverName, keyRing,
+		func(req *http.Request, _ *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			return k.userDevices(req, strings.TrimPrefix(req.URL.Path, UserDevicesFederationPathPrefix))
+		},
+	))
+	go k.prune(ctx)
+}
+
+// upload stores the device keys and one-time keys of one of our devices.
+func (k *e2eKeys) upload(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	var body struct {
+		DeviceKeys  json.RawMessage            `json:"device_keys"`
+		OneTimeKeys map[string]json.RawMessage `json:"one_time_keys"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	ctx := req.Context()
+	if len(body.DeviceKeys) > 0 && string(body.DeviceKeys) != "null" {
+		var keys struct {
+			UserID   string `json:"user_id"`
+			DeviceID string `json:"device_id"`
+		}
+		if err := json.Unmarshal(body.DeviceKeys, &keys); err != nil {
+			return util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.BadJSON(err.Error())}
+		}
+		if keys.UserID != device.UserID || keys.DeviceID != device.ID {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("The device keys are for another device"),
+			}
+		}
+		res, err := k.db.ExecContext(ctx, upsertDeviceKeysSQL, device.UserID, device.ID, string(body.DeviceKeys))
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if rows, err := res.RowsAffected(); err == nil && rows > 0 {
+			if err = k.changed(ctx, device.UserID, device.ID, body.DeviceKeys); err != nil {
+				return httputil.LogThenError(req, err)
+			}
+		}
+	}
+	for keyID, key := range body.OneTimeKeys {
+		algorithm := strings.SplitN(keyID, ":", 2)[0]
+		if _, err := k.db.ExecContext(ctx, upsertOneTimeKeySQL, device.UserID, device.ID, keyID, algorithm, string(key)); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+	}
+	counts, err := k.oneTimeKeyCounts(ctx, device)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	return util.JSONResponse{Code: http.StatusOK, JSON: map[string]interface{}{"one_time_key_counts": counts}}
+}
+
+// oneTimeKeyCounts returns the number of one-time keys of the device that
+// haven't been claimed, by algorithm.
+func (k *e2eKeys) oneTimeKeyCounts(ctx context.Context, device *authtypes.Device) (map[string]int, error) {
+	rows, err := k.db.QueryContext(ctx, countOneTimeKeysSQL, device.UserID, device.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	counts := make(map[string]int)
+	for rows.Next() {
+		var algorithm string
+		var count int
+		if err = rows.Scan(&algorithm, &count); err != nil {
+			return nil, err
+		}
+		counts[algorithm] = count
+	}
+	return counts, rows.Err()
+}
+
+// query returns the device keys and cross-signing keys of users for the
+// requester, asking their servers for those that aren't ours.
+func (k *e2eKeys) query(ctx context.Context, body *keysQueryRequest, requester string) (*keysQueryResponse, error) {
+	local, remote := k.splitUsers(body.DeviceKeys)
+	res, err := k.queryLocal(ctx, local, requester)
+	if err != nil {
+		return nil, err
+	}
+	res.Failures = make(map[string]interface{})
+
+	type result struct {
+		server gomatrixserverlib.ServerName
+		res    *keysQueryResponse
+		err    error
+	}
+	ctx, cancel := context.WithTimeout(ctx, k.timeout(body.Timeout))
+	defer cancel()
+	results := make(chan result, len(remote))
+	for server, users := range remote {
+		go func(server gomatrixserverlib.ServerName, users map[string][]string) {
+			var res keysQueryResponse
+			err := k.federationRequest(ctx, server, KeysQueryFederationPath, &keysQueryRequest{DeviceKeys: users}, &res)
+			results <- result{server: server, res: &res, err: err}
+		}(server, users)
+	}
+	for range remote {
+		r := <-results
+		if r.err != nil {
+			logrus.WithError(r.err).WithField("server", r.server).Debug("Failed to query keys")
+			res.Failures[string(r.server)] = map[string]string{"message": r.err.Error()}
+			continue
+		}
+		// Servers can only answer for their own users.
+		own := func(userID string) bool {
+			_, domain, err := gomatrixserverlib.SplitID('@', userID)
+			return err == nil && domain == r.server
+		}
+		for userID, keys := range r.res.DeviceKeys {
+			if own(userID) {
+				res.DeviceKeys[userID] = keys
+			}
+		}
+		for userID, key := range r.res.MasterKeys {
+			if own(userID) {
+				if res.MasterKeys == nil {
+					res.MasterKeys = make(map[string]json.RawMessage)
+				}
+				res.MasterKeys[userID] = key
+			}
+		}
+		for userID, key := range r.res.SelfSigningKeys {
+			if own(userID) {
+				if res.SelfSigningKeys == nil {
+					res.SelfSigningKeys = make(map[string]json.RawMessage)
+				}
+				res.SelfSigningKeys[userID] = key
+			}
+		}
+	}
+	return res, nil
+}
+
+// queryLocal returns the device keys and cross-signing keys of our own users
+// for the requester, who is empty for other servers. An empty list of
+// devices means all of them.
+func (k *e2eKeys) queryLocal(ctx context.Context, users map[string][]string, requester string) (*keysQueryResponse, error) {
+	res := &keysQueryResponse{DeviceKeys: make(map[string]map[string]json.RawMessage)}
+	for userID, deviceIDs := range users {
+		if _, domain, err := gomatrixserverlib.SplitID('@', userID); err != nil || domain != k.cfg.Matrix.ServerName {
+			continue
+		}
+		keys, err := k.deviceKeys(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if len(deviceIDs) > 0 {
+			wanted := make(map[string]json.RawMessage, len(deviceIDs))
+			for _, deviceID := range deviceIDs {
+				if key, ok := keys[deviceID]; ok {
+					wanted[deviceID] = key
+				}
+			}
+			keys = wanted
+		}
+		res.DeviceKeys[userID] = keys
+		if err = k.addCrossSigning(ctx, res, userID, requester); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// deviceKeys returns the device keys of each device of one of our users.
+func (k *e2eKeys) deviceKeys(ctx context.Context, userID string) (map[string]json.RawMessage, error) {
+	rows, err := k.db.QueryContext(ctx, selectDeviceKeysSQL, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	keys := make(map[string]json.RawMessage)
+	for rows.Next() {
+		var deviceID, keyJSON string
+		if err = rows.Scan(&deviceID, &keyJSON); err != nil {
+			return nil, err
+		}
+		keys[deviceID] = json.RawMessage(keyJSON)
+	}
+	return keys, rows.Err()
+}
+
+// claim claims one-time keys of devices, asking their servers for those
+// that aren't ours.
+func (k *e2eKeys) claim(ctx context.Context, body *keysClaimRequest) (*keysClaimResponse, error) {
+	local := make(map[string]map[string]string)
+	remote := make(map[gomatrixserverlib.ServerName]map[string]map[string]string)
+	for userID, devices := range body.OneTimeKeys {
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			continue
+		}
+		if domain == k.cfg.Matrix.ServerName {
+			local[userID] = devices
+			continue
+		}
+		if remote[domain] == nil {
+			remote[domain] = make(map[string]map[string]string)
+		}
+		remote[domain][userID] = devices
+	}
+	res, err := k.claimLocal(ctx, local)
+	if err != nil {
+		return nil, err
+	}
+	res.Failures = make(map[string]interface{})
+
+	type result struct {
+		server gomatrixserverlib.ServerName
+		res    *keysClaimResponse
+		err    error
+	}
+	ctx, cancel := context.WithTimeout(ctx, k.timeout(body.Timeout))
+	defer cancel()
+	results := make(chan result, len(remote))
+	for server, users := range remote {
+		go func(server gomatrixserverlib.ServerName, users map[string]map[string]string) {
+			var res keysClaimResponse
+			err := k.federationRequest(ctx, server, KeysClaimFederationPath, &keysClaimRequest{OneTimeKeys: users}, &res)
+			results <- result{server: server, res: &res, err: err}
+		}(server, users)
+	}
+	for range remote {
+		r := <-results
+		if r.err != nil {
+			logrus.WithError(r.err).WithField("server", r.server).Debug("Failed to claim keys")
+			res.Failures[string(r.server)] = map[string]string{"message": r.err.Error()}
+			continue
+		}
+		for userID, keys := range r.res.OneTimeKeys {
+			if _, domain, err := gomatrixserverlib.SplitID('@', userID); err == nil && domain == r.server {
+				res.OneTimeKeys[userID] = keys
+			}
+		}
+	}
+	return res, nil
+}
+
+// claimLocal claims one-time keys of our own users' devices. Devices with no
+// keys left of the algorithm are left out.
+func (k *e2eKeys) claimLocal(ctx context.Context, users map[string]map[string]string) (*keysClaimResponse, error) {
+	res := &keysClaimResponse{OneTimeKeys: make(map[string]map[string]map[string]json.RawMessage)}
+	for userID, devices := range users {
+		if _, domain, err := gomatrixserverlib.SplitID('@', userID); err != nil || domain != k.cfg.Matrix.ServerName {
+			continue
+		}
+		for deviceID, algorithm := range devices {
+			var keyID, keyJSON string
+			err := k.db.QueryRowContext(ctx, claimOneTimeKeySQL, userID, deviceID, algorithm).Scan(&keyID, &keyJSON)
+			if err == sql.ErrNoRows {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if res.OneTimeKeys[userID] == nil {
+				res.OneTimeKeys[userID] = make(map[string]map[string]json.RawMessage)
+			}
+			res.OneTimeKeys[userID][deviceID] = map[string]json.RawMessage{keyID: json.RawMessage(keyJSON)}
+		}
+	}
+	return res, nil
+}
+
+// userDevices serves the device list of one of our users to another server.
+func (k *e2eKeys) userDevices(req *http.Request, userID string) util.JSONResponse {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil || domain != k.cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("The user isn't on this server"),
+		}
+	}
+	userDevices, err := k.deviceDB.GetDevicesByLocalpart(req.Context(), localpart)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	keys, err := k.deviceKeys(req.Context(), userID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	var streamID int64
+	_ = k.db.QueryRowContext(req.Context(), selectDeviceListIDSQL, userID).Scan(&streamID)
+
+	type userDevice struct {
+		DeviceID    string          `json:"device_id"`
+		Keys        json.RawMessage `json:"keys,omitempty"`
+		DisplayName string          `json:"device_display_name,omitempty"`
+	}
+	res := struct {
+		UserID   string       `json:"user_id"`
+		StreamID int64        `json:"stream_id"`
+		Devices  []userDevice `json:"devices"`
+	}{UserID: userID, StreamID: streamID, Devices: []userDevice{}}
+	for _, d := range userDevices {
+		res.Devices = append(res.Devices, userDevice{DeviceID: d.ID, Keys: keys[d.ID]})
+	}
+	return util.JSONResponse{Code: http.StatusOK, JSON: res}
+}
+
+// changed records a change to the devices of one of our users and tells the
+// servers that share rooms with them. Keys are nil if the device was
+// deleted.
+func (k *e2eKeys) changed(ctx context.Context, userID, deviceID string, keys json.RawMessage) error {
+	var streamID int64
+	if err := k.db.QueryRowContext(ctx, upsertDeviceListSQL, userID).Scan(&streamID); err != nil {
+		return err
+	}
+	roomIDs := k.memberships.UserRooms(userID)
+	if len(roomIDs) == 0 || k.edus == nil {
+		return nil
+	}
+	update := deviceListUpdate{
+		UserID:   userID,
+		DeviceID: deviceID,
+		StreamID: streamID,
+		PrevID:   []int64{},
+		Deleted:  keys == nil,
+		Keys:     keys,
+	}
+	edu := gomatrixserverlib.EDU{Type: MDeviceListUpdate}
+	var err error
+	if edu.Content, err = json.Marshal(update); err != nil {
+		return err
+	}
+	k.edus.sendToRooms(roomIDs, &edu)
+	return nil
+}
+
+// onRemote records a change to the devices or cross-signing keys of a user
+// on another server, from an EDU that has already been checked.
+func (k *e2eKeys) onRemote(ctx context.Context, userID string) error {
+	_, err := k.db.ExecContext(ctx, upsertDeviceListSQL, userID)
+	return err
+}
+
+// changesSince returns the users sharing a room with the user whose devices
+// have changed since the device list ID, along with the latest ID.
+func (k *e2eKeys) changesSince(ctx context.Context, userID string, since int64) ([]string, int64, error) {
+	var users []string
+	for member := range k.memberships.SharedUsers(userID) {
+		users = append(users, member)
+	}
+	rows, err := k.db.QueryContext(ctx, selectDeviceListsSQL, pq.StringArray(users), since)
+	if err != nil {
+		return nil, since, err
+	}
+	defer rows.Close() // nolint: errcheck
+	changed := []string{}
+	latest := since
+	for rows.Next() {
+		var member string
+		var id int64
+		if err = rows.Scan(&member, &id); err != nil {
+			return nil, since, err
+		}
+		changed = append(changed, member)
+		if id > latest {
+			latest = id
+		}
+	}
+	return changed, latest, rows.Err()
+}
+
+// wrapSync adds the users whose devices have changed, and the number of
+// one-time keys that the device has left, to the /sync response.
+func (k *e2eKeys) wrapSync(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		device, req := syncDevice(req, k.authData)
+		if device == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		rec := &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+		next.ServeHTTP(rec, req)
+		var res map[string]json.RawMessage
+		if rec.code != http.StatusOK || json.Unmarshal(rec.body.Bytes(), &res) != nil {
+			rec.writeTo(w)
+			return
+		}
+
+		ctx := req.Context()
+		logger := util.GetLogger(ctx)
+		key := device.UserID + "/" + device.ID
+		k.mu.Lock()
+		since := k.delivered[key]
+		k.mu.Unlock()
+		changed, latest, err := k.changesSince(ctx, device.UserID, since)
+		if err != nil {
+			logger.WithError(err).Error("Failed to add device list changes to /sync")
+		}
+		k.mu.Lock()
+		if latest > k.delivered[key] {
+			k.delivered[key] = latest
+		}
+		k.mu.Unlock()
+		// An initial sync has no changes, as the client has no keys yet.
+		if req.URL.Query().Get("since") == "" || changed == nil {
+			changed = []string{}
+		}
+		counts, err := k.oneTimeKeyCounts(ctx, device)
+		if err != nil {
+			logger.WithError(err).Error("Failed to add one-time key counts to /sync")
+		}
+
+		if res["device_lists"], err = json.Marshal(map[string][]string{"changed": changed, "left": {}}); err != nil {
+			rec.writeTo(w)
+			return
+		}
+		if res["device_one_time_keys_count"], err = json.Marshal(counts); err != nil {
+			rec.writeTo(w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	})
+}
+
+// prune removes the keys of our users' devices that have been deleted,
+// until the context is done.
+func (k *e2eKeys) prune(ctx context.Context) {
+	ticker := time.NewTicker(DeviceListPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.pruneDeleted(ctx); err != nil {
+				logrus.WithError(err).Error("Failed to remove keys of deleted devices")
+			}
+		}
+	}
+}
+
+func (k *e2eKeys) pruneDeleted(ctx context.Context) error {
+	rows, err := k.db.QueryContext(ctx, selectDeviceKeyUsersSQL)
+	if err != nil {
+		return err
+	}
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err = rows.Scan(&userID); err != nil {
+			rows.Close() // nolint: errcheck
+			return err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close() // nolint: errcheck
+
+	for _, userID := range userIDs {
+		localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil || domain != k.cfg.Matrix.ServerName {
+			continue
+		}
+		userDevices, err := k.deviceDB.GetDevicesByLocalpart(ctx, localpart)
+		if err != nil {
+			return err
+		}
+		exists := make(map[string]bool, len(userDevices))
+		for _, d := range userDevices {
+			exists[d.ID] = true
+		}
+		keys, err := k.deviceKeys(ctx, userID)
+		if err != nil {
+			return err
+		}
+		for deviceID := range keys {
+			if exists[deviceID] {
+				continue
+			}
+			if _, err = k.db.ExecContext(ctx, deleteDeviceKeysSQL, userID, deviceID); err != nil {
+				return err
+			}
+			if _, err = k.db.ExecContext(ctx, deleteOneTimeKeysSQL, userID, deviceID); err != nil {
+				return err
+			}
+			if err = k.changed(ctx, userID, deviceID, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// splitUsers splits a key query into our own users and those of each other
+// server.
+func (k *e2eKeys) splitUsers(users map[string][]string) (map[string][]string, map[gomatrixserverlib.ServerName]map[string][]string) {
+	local := make(map[string][]string)
+	remote := make(map[gomatrixserverlib.ServerName]map[string][]string)
+	for userID, deviceIDs := range users {
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			continue
+		}
+		if domain == k.cfg.Matrix.ServerName {
+			local[userID] = deviceIDs
+			continue
+		}
+		if remote[domain] == nil {
+			remote[domain] = make(map[string][]string)
+		}
+		remote[domain][userID] = deviceIDs
+	}
+	return local, remote
+}
+
+// timeout returns how long to wait for other servers, given the timeout in
+// milliseconds from the client.
+func (k *e2eKeys) timeout(ms int64) time.Duration {
+	if ms <= 0 {
+		return KeysFederationTimeout
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// federationRequest POSTs a signed request to another server.
+func (k *e2eKeys) federationRequest(ctx context.Context, server gomatrixserverlib.ServerName, path string, content, res interface{}) error {
+	fedReq := gomatrixserverlib.NewFederationRequest("POST", server, path)
+	if err := fedReq.SetContent(content); err != nil {
+		return err
+	}
+	if err := fedReq.Sign(k.cfg.Matrix.ServerName, k.cfg.Matrix.KeyID, k.cfg.Matrix.PrivateKey); err != nil {
+		return err
+	}
+	req, err := fedReq.HTTPRequest()
+	if err != nil {
+		return err
+	}
+	return k.federation.DoRequestAndParseResponse(ctx, req, res)
+}
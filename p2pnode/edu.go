@@ -0,0 +1,407 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/matrix-org/dendrite/common"
+	typingAPI "github.com/matrix-org/dendrite/typingserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// EDUTopicPrefix starts the name of the pubsub topic that the ephemeral
+// events of a room are gossiped on. The room ID follows it.
+const EDUTopicPrefix = "/matrix/edu/"
+
+// EDUSendTimeout is how long we spend sending an ephemeral event to a server
+// that isn't a p2p node, as there's no point retrying it later.
+const EDUSendTimeout = time.Second * 30
+
+// DefaultTypingTimeout is how long a user from another server is shown as
+// typing for, if the server didn't say.
+const DefaultTypingTimeout = time.Second * 30
+
+// unusedTypingTopic is given to the federation sender in place of the typing
+// server's output log, so that it never sends typing notifications itself.
+const unusedTypingTopic = "p2pUnusedTypingServerOutput"
+
+// typingContent is the content of an m.typing EDU.
+type typingContent struct {
+	RoomID string `json:"room_id"`
+	UserID string `json:"user_id"`
+	Typing bool   `json:"typing"`
+	// How long the user should be shown as typing for, in milliseconds.
+	// This isn't in the federation spec, which leaves it to the receiving
+	// server, but nodes that gossip typing notifications include it.
+	Timeout int64 `json:"timeout,omitempty"`
+}
+
+// eduRoom is our subscription to the topic for a room.
+type eduRoom struct {
+	topic *pubsub.Topic
+	sub   *pubsub.Subscription
+}
+
+// eduGossip sends the ephemeral events of our users to the other servers in
+// each room. Rather than sending a transaction to every one of them, they are
+// published to a pubsub topic for the room, which every p2p node with users
+// in the room is subscribed to. Servers that aren't p2p nodes still get a
+// transaction each.
+type eduGossip struct {
+	ctx          context.Context
+	pubsub       *pubsub.PubSub
+	self         peer.ID
+	serverName   gomatrixserverlib.ServerName
+	federation   *gomatrixserverlib.FederationClient
+	typing       typingAPI.TypingServerInputAPI
+	presence     *presenceTracker
+	receipts     *receipts
+	e2eKeys      *e2eKeys
+	deactivation *accountDeactivation
+	memberships  *RoomMemberships
+	reputation   *reputation
+	policy       *FederationPolicy
+	startedAt    time.Time
+
+	mu    sync.Mutex
+	rooms map[string]*eduRoom
+	txnID int64
+}
+
+// start subscribes to the topics of the rooms that we are in, as we join and
+// leave them, and consumes the typing server output log to send our own
+// users' typing notifications.
+func (g *eduGossip) start(consumer sarama.Consumer, typingTopic string) error {
+	g.rooms = make(map[string]*eduRoom)
+	g.startedAt = time.Now()
+	g.memberships.OnChange(func(server gomatrixserverlib.ServerName, rooms int) {
+		if server == g.serverName {
+			g.updateRooms()
+		}
+	})
+	g.updateRooms()
+	c := common.ContinualConsumer{
+		Topic:          typingTopic,
+		Consumer:       consumer,
+		PartitionStore: &memoryPartitionStore{},
+		ProcessMessage: g.onTypingMessage,
+	}
+	return c.Start()
+}
+
+// updateRooms subscribes to the topics of the rooms that we have users in,
+// and unsubscribes from the rest.
+func (g *eduGossip) updateRooms() {
+	joined := make(map[string]bool)
+	for _, roomID := range g.memberships.SharedRooms(g.serverName) {
+		joined[roomID] = true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for roomID, room := range g.rooms {
+		if !joined[roomID] {
+			room.sub.Cancel()
+			_ = room.topic.Close()
+			delete(g.rooms, roomID)
+		}
+	}
+	for roomID := range joined {
+		if g.rooms[roomID] != nil {
+			continue
+		}
+		topic, err := g.pubsub.Join(EDUTopicPrefix + roomID)
+		if err != nil {
+			logrus.WithError(err).WithField("room_id", roomID).Error("Failed to join EDU topic")
+			continue
+		}
+		sub, err := topic.Subscribe()
+		if err != nil {
+			_ = topic.Close()
+			logrus.WithError(err).WithField("room_id", roomID).Error("Failed to subscribe to EDU topic")
+			continue
+		}
+		g.rooms[roomID] = &eduRoom{topic: topic, sub: sub}
+		go g.receive(roomID, sub)
+	}
+}
+
+// receive handles the ephemeral events gossiped in a room until the
+// subscription is cancelled.
+func (g *eduGossip) receive(roomID string, sub *pubsub.Subscription) {
+	for {
+		msg, err := sub.Next(g.ctx)
+		if err != nil {
+			return
+		}
+		from := msg.GetFrom()
+		if from == g.self || !g.policy.Allowed(peerServerName(from)) {
+			continue
+		}
+		logger := logrus.WithFields(logrus.Fields{"peer": from.String(), "room_id": roomID})
+		var edu gomatrixserverlib.EDU
+		if err = json.Unmarshal(msg.GetData(), &edu); err != nil {
+			logger.WithError(err).Debug("Ignoring invalid gossiped EDU")
+			g.reputation.penalise(from, malformed)
+			continue
+		}
+		if err = g.onEDU(roomID, peerServerName(from), &edu); err != nil {
+			logger.WithError(err).Debug("Ignoring gossiped EDU")
+		}
+	}
+}
+
+// onEDU handles an ephemeral event gossiped by a server. Messages are signed
+// by the peer that published them, so the server must be the publisher.
+func (g *eduGossip) onEDU(roomID string, origin gomatrixserverlib.ServerName, edu *gomatrixserverlib.EDU) error {
+	switch edu.Type {
+	case gomatrixserverlib.MTyping:
+		return g.onTyping(roomID, origin, edu.Content)
+	case MPresence:
+		return g.onPresence(roomID, origin, edu.Content)
+	case MReceipt:
+		return g.onReceipt(roomID, origin, edu.Content)
+	case MDeviceListUpdate:
+		return g.onDeviceListUpdate(roomID, origin, edu.Content)
+	case MSigningKeyUpdate:
+		return g.onSigningKeyUpdate(roomID, origin, edu.Content)
+	case MErasure:
+		return g.onErasure(roomID, origin, edu.Content)
+	default:
+		return fmt.Errorf("unsupported EDU type %q", edu.Type)
+	}
+}
+
+// onTyping passes a typing notification on to the typing server.
+func (g *eduGossip) onTyping(roomID string, origin gomatrixserverlib.ServerName, data []byte) error {
+	var content typingContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return err
+	}
+	if content.RoomID != roomID {
+		return fmt.Errorf("EDU for room %s was gossiped in another room", content.RoomID)
+	}
+	if _, domain, err := gomatrixserverlib.SplitID('@', content.UserID); err != nil || domain != origin {
+		return fmt.Errorf("user %s isn't on the server that published the EDU", content.UserID)
+	}
+	if !g.memberships.Joined(roomID, content.UserID) {
+		return fmt.Errorf("user %s isn't in the room", content.UserID)
+	}
+	if content.Typing && content.Timeout <= 0 {
+		content.Timeout = int64(DefaultTypingTimeout / time.Millisecond)
+	}
+	return g.typing.InputTypingEvent(g.ctx, &typingAPI.InputTypingEventRequest{
+		InputTypingEvent: typingAPI.InputTypingEvent{
+			UserID:         content.UserID,
+			RoomID:         roomID,
+			Typing:         content.Typing,
+			Timeout:        content.Timeout,
+			OriginServerTS: gomatrixserverlib.AsTimestamp(time.Now()),
+		},
+	}, &typingAPI.InputTypingEventResponse{})
+}
+
+// onPresence records the presence of users from another server. Only users
+// in the room that it was gossiped in are accepted, so that a server can't
+// tell us about users that we share no rooms with.
+func (g *eduGossip) onPresence(roomID string, origin gomatrixserverlib.ServerName, data []byte) error {
+	var content presenceContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return err
+	}
+	for _, update := range content.Push {
+		if _, domain, err := gomatrixserverlib.SplitID('@', update.UserID); err != nil || domain != origin {
+			return fmt.Errorf("user %s isn't on the server that published the EDU", update.UserID)
+		}
+		if !g.memberships.Joined(roomID, update.UserID) {
+			return fmt.Errorf("user %s isn't in the room", update.UserID)
+		}
+	}
+	for _, update := range content.Push {
+		g.presence.onRemote(update)
+	}
+	return nil
+}
+
+// onReceipt stores the read receipts of users from another server in the
+// room that they were gossiped in.
+func (g *eduGossip) onReceipt(roomID string, origin gomatrixserverlib.ServerName, data []byte) error {
+	var content receiptContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return err
+	}
+	for receiptRoomID, types := range content {
+		if receiptRoomID != roomID {
+			return fmt.Errorf("EDU for room %s was gossiped in another room", receiptRoomID)
+		}
+		for _, users := range types {
+			for userID := range users {
+				if _, domain, err := gomatrixserverlib.SplitID('@', userID); err != nil || domain != origin {
+					return fmt.Errorf("user %s isn't on the server that published the EDU", userID)
+				}
+				if !g.memberships.Joined(roomID, userID) {
+					return fmt.Errorf("user %s isn't in the room", userID)
+				}
+			}
+		}
+	}
+	g.receipts.onRemote(g.ctx, content)
+	return nil
+}
+
+// onDeviceListUpdate records that the devices of a user from another server
+// in the room have changed.
+func (g *eduGossip) onDeviceListUpdate(roomID string, origin gomatrixserverlib.ServerName, data []byte) error {
+	var update deviceListUpdate
+	if err := json.Unmarshal(data, &update); err != nil {
+		return err
+	}
+	if _, domain, err := gomatrixserverlib.SplitID('@', update.UserID); err != nil || domain != origin {
+		return fmt.Errorf("user %s isn't on the server that published the EDU", update.UserID)
+	}
+	if !g.memberships.Joined(roomID, update.UserID) {
+		return fmt.Errorf("user %s isn't in the room", update.UserID)
+	}
+	return g.e2eKeys.onRemote(g.ctx, update.UserID)
+}
+
+// onSigningKeyUpdate records that the cross-signing keys of a user from
+// another server in the room have changed.
+func (g *eduGossip) onSigningKeyUpdate(roomID string, origin gomatrixserverlib.ServerName, data []byte) error {
+	var update signingKeyUpdate
+	if err := json.Unmarshal(data, &update); err != nil {
+		return err
+	}
+	if _, domain, err := gomatrixserverlib.SplitID('@', update.UserID); err != nil || domain != origin {
+		return fmt.Errorf("user %s isn't on the server that published the EDU", update.UserID)
+	}
+	if !g.memberships.Joined(roomID, update.UserID) {
+		return fmt.Errorf("user %s isn't in the room", update.UserID)
+	}
+	return g.e2eKeys.onRemote(g.ctx, update.UserID)
+}
+
+// onErasure deletes our copies of the media of a user from another server
+// in the room who has been erased.
+func (g *eduGossip) onErasure(roomID string, origin gomatrixserverlib.ServerName, data []byte) error {
+	var content erasureContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return err
+	}
+	if _, domain, err := gomatrixserverlib.SplitID('@', content.UserID); err != nil || domain != origin {
+		return fmt.Errorf("user %s isn't on the server that published the EDU", content.UserID)
+	}
+	if !g.memberships.Joined(roomID, content.UserID) {
+		return fmt.Errorf("user %s isn't in the room", content.UserID)
+	}
+	return g.deactivation.onRemote(g.ctx, origin, &content)
+}
+
+// onTypingMessage sends a typing notification from one of our own users.
+func (g *eduGossip) onTypingMessage(msg *sarama.ConsumerMessage) error {
+	// The log is read from the start, so skip everything from before we
+	// started, which has long since expired.
+	if msg.Timestamp.Before(g.startedAt) {
+		return nil
+	}
+	var output typingAPI.OutputTypingEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		logrus.WithError(err).Error("EDU gossip: typing server output log: message parse failure")
+		return nil
+	}
+	// The typing server logs notifications from other servers too.
+	if _, domain, err := gomatrixserverlib.SplitID('@', output.Event.UserID); err != nil || domain != g.serverName {
+		return nil
+	}
+	content := typingContent{
+		RoomID: output.Event.RoomID,
+		UserID: output.Event.UserID,
+		Typing: output.Event.Typing,
+	}
+	if output.ExpireTime != nil {
+		content.Timeout = int64(time.Until(*output.ExpireTime) / time.Millisecond)
+	}
+	edu := gomatrixserverlib.EDU{Type: gomatrixserverlib.MTyping}
+	var err error
+	if edu.Content, err = json.Marshal(content); err != nil {
+		return err
+	}
+	g.send(content.RoomID, &edu)
+	return nil
+}
+
+// send publishes an ephemeral event to the topic of the room, and sends it
+// in a transaction to each server in the room that isn't a p2p node.
+func (g *eduGossip) send(roomID string, edu *gomatrixserverlib.EDU) {
+	g.sendToRooms([]string{roomID}, edu)
+}
+
+// sendToRooms publishes an ephemeral event to the topics of several rooms,
+// and sends it in a single transaction to each server in any of them that
+// isn't a p2p node.
+func (g *eduGossip) sendToRooms(roomIDs []string, edu *gomatrixserverlib.EDU) {
+	data, err := json.Marshal(edu)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to encode EDU")
+		return
+	}
+	servers := make(map[gomatrixserverlib.ServerName]bool)
+	for _, roomID := range roomIDs {
+		g.mu.Lock()
+		room := g.rooms[roomID]
+		g.mu.Unlock()
+		if room != nil {
+			if err = room.topic.Publish(g.ctx, data); err != nil {
+				logrus.WithError(err).WithField("room_id", roomID).Warn("Failed to gossip EDU")
+			}
+		}
+		for _, server := range g.memberships.RoomServers(roomID) {
+			servers[server] = true
+		}
+	}
+	g.mu.Lock()
+	g.txnID++
+	txnID := g.txnID
+	g.mu.Unlock()
+
+	for server := range servers {
+		if _, err = serverNamePeer(server); err == nil || server == g.serverName {
+			continue
+		}
+		t := gomatrixserverlib.Transaction{
+			TransactionID:  gomatrixserverlib.TransactionID(fmt.Sprintf("edu-%d-%d", g.startedAt.UnixNano(), txnID)),
+			Origin:         g.serverName,
+			Destination:    server,
+			OriginServerTS: gomatrixserverlib.AsTimestamp(time.Now()),
+			PDUs:           []gomatrixserverlib.Event{},
+			EDUs:           []gomatrixserverlib.EDU{*edu},
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(g.ctx, EDUSendTimeout)
+			defer cancel()
+			if _, err := g.federation.SendTransaction(ctx, t); err != nil {
+				logrus.WithError(err).WithField("server", t.Destination).Warn("Failed to send EDU")
+			}
+		}()
+	}
+}
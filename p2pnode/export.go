@@ -0,0 +1,169 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The files that ExportDendriteConfig writes, which are named as in
+// Dendrite's own example config.
+const (
+	DendriteConfigFileName  = "dendrite.yaml"
+	DendriteKeyFileName     = "matrix_key.pem"
+	DendriteTLSCertFileName = "server.crt"
+	DendriteTLSKeyFileName  = "server.key"
+)
+
+// DendriteTLSCertLifetime is how long the self-signed federation certificate
+// of an exported config is valid for.
+const DendriteTLSCertLifetime = time.Hour * 24 * 365
+
+// ServerName returns the server name of a node, which is its peer ID.
+func ServerName(identityKey []byte) (gomatrixserverlib.ServerName, error) {
+	p2pKey, err := crypto.UnmarshalEd25519PrivateKey(identityKey)
+	if err != nil {
+		return "", err
+	}
+	id, err := peer.IDFromPrivateKey(p2pKey)
+	if err != nil {
+		return "", err
+	}
+	return peerServerName(id), nil
+}
+
+// ExportDendriteConfig writes a config for running the node's databases,
+// media and signing key with a standard Dendrite monolith, along with the
+// signing key as matrix_key.pem and a self-signed federation certificate,
+// into a directory. The server name stays our peer ID, as every user ID and
+// event of ours is under it. The client API's own features work as they
+// did, but what only the node keeps, in its p2p_ tables, e.g. end-to-end
+// keys, key backups, pushers and receipts, has no place in Dendrite.
+func ExportDendriteConfig(cfg *Config, dir string) error {
+	serverName, err := ServerName(cfg.IdentityKey)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	dendriteCfg := cfg.Dendrite
+	setDendriteDefaults(&dendriteCfg)
+	dendriteCfg.Version = config.Version
+	dendriteCfg.Matrix.ServerName = serverName
+	dendriteCfg.Matrix.PrivateKeyPath = DendriteKeyFileName
+	dendriteCfg.Matrix.FederationCertificatePaths = []config.Path{DendriteTLSCertFileName}
+	dendriteCfg.Matrix.RegistrationDisabled = cfg.Registration != "" && cfg.Registration != RegistrationOpen
+	if dendriteCfg.Matrix.RegistrationSharedSecret == "" {
+		secret, err := ioutil.ReadFile(filepath.Join(cfg.DataDir, RegistrationSecretFileName))
+		if err == nil {
+			dendriteCfg.Matrix.RegistrationSharedSecret = strings.TrimSpace(string(secret))
+		}
+	}
+	// The media are where the node kept them, which is relative to where it
+	// was run from unless the config said otherwise.
+	mediaPath, err := filepath.Abs(string(dendriteCfg.Media.BasePath))
+	if err != nil {
+		return err
+	}
+	dendriteCfg.Media.BasePath = config.Path(mediaPath)
+	dendriteCfg.Kafka.UseNaffka = true
+	dendriteCfg.Kafka.Addresses = nil
+
+	if err = SaveSigningKeys(filepath.Join(dir, DendriteKeyFileName), &cfg.SigningKeys, nil); err != nil {
+		return err
+	}
+	if err = writeSelfSignedCert(dir, serverName); err != nil {
+		return err
+	}
+	return writeDendriteConfig(filepath.Join(dir, DendriteConfigFileName), &dendriteCfg)
+}
+
+// writeDendriteConfig writes a Dendrite config file. What Dendrite derives
+// from the config when it loads it would otherwise be written out too.
+func writeDendriteConfig(filename string, cfg *config.Dendrite) error {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	var fields yaml.MapSlice
+	if err = yaml.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	kept := fields[:0]
+	for _, field := range fields {
+		if field.Key != "derived" {
+			kept = append(kept, field)
+		}
+	}
+	if data, err = yaml.Marshal(kept); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0600)
+}
+
+// writeSelfSignedCert writes a certificate and key for Dendrite to serve
+// federation with, which its config needs one of.
+func writeSelfSignedCert(dir string, serverName gomatrixserverlib.ServerName) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: string(serverName)},
+		DNSNames:     []string{string(serverName)},
+		NotBefore:    now,
+		NotAfter:     now.Add(DendriteTLSCertLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	if err = ioutil.WriteFile(filepath.Join(dir, DendriteTLSCertFileName), certPEM, 0644); err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return ioutil.WriteFile(filepath.Join(dir, DendriteTLSKeyFileName), keyPEM, 0600)
+}
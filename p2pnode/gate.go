@@ -0,0 +1,224 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+// PeerGateFileName is the name of the file, in the data directory, that the
+// peer allowlist and denylist are saved to.
+const PeerGateFileName = ".dendrite-p2p-gate"
+
+// PeerGate decides which peers we are willing to talk to at all. Peers on
+// the denylist are always refused. If the allowlist isn't empty then only
+// peers on it are accepted, which also cuts us off from the public DHT.
+type PeerGate struct {
+	mu       sync.RWMutex
+	filename string
+	allow    map[peer.ID]struct{}
+	deny     map[peer.ID]struct{}
+}
+
+// peerGateFile is how the lists are represented on disk.
+type peerGateFile struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// loadPeerGate reads the lists from the file, if there is one.
+func loadPeerGate(filename string) (*PeerGate, error) {
+	var f peerGateFile
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		err = json.Unmarshal(data, &f)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	g := &PeerGate{filename: filename}
+	if g.allow, err = peerSet(f.Allow); err != nil {
+		return nil, err
+	}
+	if g.deny, err = peerSet(f.Deny); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Allowed returns whether we are willing to talk to the peer.
+func (g *PeerGate) Allowed(id peer.ID) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if _, ok := g.deny[id]; ok {
+		return false
+	}
+	if len(g.allow) == 0 {
+		return true
+	}
+	_, ok := g.allow[id]
+	return ok
+}
+
+// Lists returns the peers on the allowlist and the denylist.
+func (g *PeerGate) Lists() (allow, deny []peer.ID) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return sortedPeers(g.allow), sortedPeers(g.deny)
+}
+
+// SetAllowed adds a peer to the allowlist, or removes it from it, and saves
+// the lists.
+func (g *PeerGate) SetAllowed(id peer.ID, allowed bool) error {
+	return g.set(&g.allow, id, allowed)
+}
+
+// SetDenied adds a peer to the denylist, or removes it from it, and saves
+// the lists.
+func (g *PeerGate) SetDenied(id peer.ID, denied bool) error {
+	return g.set(&g.deny, id, denied)
+}
+
+func (g *PeerGate) set(list *map[peer.ID]struct{}, id peer.ID, add bool) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	updated := make(map[peer.ID]struct{}, len(*list)+1)
+	for existing := range *list {
+		updated[existing] = struct{}{}
+	}
+	if add {
+		updated[id] = struct{}{}
+	} else {
+		delete(updated, id)
+	}
+	old := *list
+	*list = updated
+	if err := g.save(); err != nil {
+		// The change only takes effect once it has been saved.
+		*list = old
+		return err
+	}
+	return nil
+}
+
+// save writes the lists to the file. The lock must be held.
+func (g *PeerGate) save() error {
+	data, err := json.MarshalIndent(peerGateFile{
+		Allow: peerStrings(sortedPeers(g.allow)),
+		Deny:  peerStrings(sortedPeers(g.deny)),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(g.filename+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(g.filename+".tmp", g.filename)
+}
+
+// enforce closes every connection to a peer that isn't allowed, both now and
+// as soon as any new connection is made. The Matrix listener also checks the
+// gate, so that nothing sent before the connection is closed gets processed.
+func (g *PeerGate) enforce(p2pHost host.Host) {
+	p2pHost.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			if !g.Allowed(conn.RemotePeer()) {
+				logrus.WithField("peer", conn.RemotePeer().String()).Debug("Closing connection to gated peer")
+				_ = conn.Close()
+			}
+		},
+	})
+	g.closeGated(p2pHost)
+}
+
+// closeGated closes all existing connections to peers that aren't allowed.
+func (g *PeerGate) closeGated(p2pHost host.Host) {
+	for _, id := range p2pHost.Network().Peers() {
+		if !g.Allowed(id) {
+			_ = p2pHost.Network().ClosePeer(id)
+		}
+	}
+}
+
+// gatedListener wraps the Matrix protocol listener so that streams from
+// peers that aren't allowed by the gate or the federation policy, that have
+// been disconnected for misbehaving, or that are over their rate limit, are
+// closed before they are served, as are those that chaos drops.
+type gatedListener struct {
+	net.Listener
+	gate       *PeerGate
+	chaos      *Chaos
+	policy     *FederationPolicy
+	reputation *reputation
+	limiter    *rateLimiter
+}
+
+// Accept implements net.Listener
+func (l *gatedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		id, err := peer.IDB58Decode(conn.RemoteAddr().String())
+		if err == nil && l.gate.Allowed(id) && l.policy.Allowed(peerServerName(id)) &&
+			!l.reputation.disconnected(id) && !l.limiter.limited(id) {
+			if conn := l.chaos.stream(id, conn); conn != nil {
+				return conn, nil
+			}
+		}
+		_ = conn.Close()
+	}
+}
+
+func peerSet(strs []string) (map[peer.ID]struct{}, error) {
+	set := make(map[peer.ID]struct{}, len(strs))
+	for _, s := range strs {
+		id, err := peer.IDB58Decode(s)
+		if err != nil {
+			return nil, err
+		}
+		set[id] = struct{}{}
+	}
+	return set, nil
+}
+
+func sortedPeers(set map[peer.ID]struct{}) []peer.ID {
+	peers := make([]peer.ID, 0, len(set))
+	for id := range set {
+		peers = append(peers, id)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+	return peers
+}
+
+func peerStrings(peers []peer.ID) []string {
+	strs := make([]string, len(peers))
+	for i, id := range peers {
+		strs[i] = id.Pretty()
+	}
+	return strs
+}
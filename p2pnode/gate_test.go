@@ -0,0 +1,199 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestPeerGate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pnode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	filename := filepath.Join(dir, PeerGateFileName)
+
+	alice, bob, carol := testPeerID(t), testPeerID(t), testPeerID(t)
+	tests := []struct {
+		name  string
+		allow []peer.ID
+		deny  []peer.ID
+		want  map[peer.ID]bool
+	}{
+		{"empty", nil, nil, map[peer.ID]bool{alice: true, bob: true, carol: true}},
+		{"denylist", nil, []peer.ID{bob}, map[peer.ID]bool{alice: true, bob: false, carol: true}},
+		{"allowlist", []peer.ID{alice}, nil, map[peer.ID]bool{alice: true, bob: false, carol: false}},
+		{"both", []peer.ID{alice, bob}, []peer.ID{bob}, map[peer.ID]bool{alice: true, bob: false, carol: false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.RemoveAll(filename); err != nil {
+				t.Fatal(err)
+			}
+			g, err := loadPeerGate(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range tt.allow {
+				if err = g.SetAllowed(id, true); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, id := range tt.deny {
+				if err = g.SetDenied(id, true); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// The lists must survive being saved and loaded again.
+			if g, err = loadPeerGate(filename); err != nil {
+				t.Fatal(err)
+			}
+			for id, want := range tt.want {
+				if got := g.Allowed(id); got != want {
+					t.Errorf("%s: got allowed %v, wanted %v", id, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPeerGateSetFailed(t *testing.T) {
+	g, err := loadPeerGate(filepath.Join("/nonexistent", PeerGateFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := testPeerID(t)
+	if err = g.SetDenied(id, true); err == nil {
+		t.Fatal("saving to a missing directory succeeded")
+	}
+	if !g.Allowed(id) {
+		t.Error("change that failed to save took effect")
+	}
+	if allow, deny := g.Lists(); len(allow) != 0 || len(deny) != 0 {
+		t.Errorf("change that failed to save is listed: %v, %v", allow, deny)
+	}
+}
+
+func TestGatedListenerAccept(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pnode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	allowed, denied, blocked, limited, partitioned := testPeerID(t), testPeerID(t), testPeerID(t), testPeerID(t), testPeerID(t)
+	gate, err := loadPeerGate(filepath.Join(dir, PeerGateFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gate.SetDenied(denied, true); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := loadFederationPolicy(filepath.Join(dir, FederationPolicyFileName), "self", federationPolicyFile{
+		Deny: []string{blocked.String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := newRateLimiter()
+	limiter.buckets[limited] = &tokenBucket{updated: time.Now()}
+	chaos := &Chaos{partitioned: map[peer.ID]struct{}{partitioned: {}}}
+
+	tests := []struct {
+		name     string
+		remote   string
+		accepted bool
+	}{
+		{"allowed", allowed.String(), true},
+		{"denied by the gate", denied.String(), false},
+		{"blocked by the policy", blocked.String(), false},
+		{"rate limited", limited.String(), false},
+		{"partitioned", partitioned.String(), false},
+		{"not a peer ID", "127.0.0.1:8008", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &testConn{remote: tt.remote}
+			l := &gatedListener{
+				Listener: &testListener{conns: []net.Conn{conn}},
+				gate:     gate,
+				chaos:    chaos,
+				policy:   policy,
+				limiter:  limiter,
+			}
+			got, err := l.Accept()
+			if tt.accepted {
+				if err != nil || got != conn {
+					t.Fatalf("stream wasn't accepted: %v", err)
+				}
+				if conn.closed {
+					t.Error("accepted stream was closed")
+				}
+				return
+			}
+			if err != errTestListenerDone {
+				t.Fatalf("got %v, %v, wanted the stream to be skipped", got, err)
+			}
+			if !conn.closed {
+				t.Error("refused stream wasn't closed")
+			}
+		})
+	}
+}
+
+var errTestListenerDone = errors.New("no more streams")
+
+// testListener accepts the streams that it is given, and then fails.
+type testListener struct {
+	net.Listener
+	conns []net.Conn
+}
+
+func (l *testListener) Accept() (net.Conn, error) {
+	if len(l.conns) == 0 {
+		return nil, errTestListenerDone
+	}
+	conn := l.conns[0]
+	l.conns = l.conns[1:]
+	return conn, nil
+}
+
+// testConn is a stream from a remote address that remembers being closed.
+type testConn struct {
+	net.Conn
+	remote string
+	closed bool
+}
+
+func (c *testConn) RemoteAddr() net.Addr { return testAddr(c.remote) }
+
+func (c *testConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+type testAddr string
+
+func (a testAddr) Network() string { return "test" }
+func (a testAddr) String() string  { return string(a) }
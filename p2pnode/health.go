@@ -0,0 +1,160 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/util"
+)
+
+// HealthzPath is where the liveness check is served. It succeeds for as long
+// as the node is able to answer HTTP requests at all.
+const HealthzPath = "/healthz"
+
+// ReadyzPath is where the readiness check is served. It only succeeds when
+// every database can be reached and the libp2p host is running.
+const ReadyzPath = "/readyz"
+
+// HealthCheckTimeout is how long the readiness check waits for each check.
+const HealthCheckTimeout = 5 * time.Second
+
+// healthStatusOK is the status of a check which passed.
+const healthStatusOK = "ok"
+
+// healthResponse is the response body of the health checks. Checks holds
+// healthStatusOK or an error for each thing that was checked.
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+	Peers  int               `json:"peers,omitempty"`
+}
+
+// healthChecker pings the databases of every component. The components don't
+// expose their own connections, so it has one of its own for each database.
+type healthChecker struct {
+	databases map[string]*sql.DB
+	// Whether the host should have addresses to listen on. It doesn't when
+	// using Tor without an onion service.
+	listening bool
+}
+
+func newHealthChecker(cfg *Config) (*healthChecker, error) {
+	dbs := cfg.Dendrite.Database
+	sources := map[string]config.DataSource{
+		"account":          dbs.Account,
+		"device":           dbs.Device,
+		"mediaapi":         dbs.MediaAPI,
+		"syncapi":          dbs.SyncAPI,
+		"roomserver":       dbs.RoomServer,
+		"serverkey":        dbs.ServerKey,
+		"federationsender": dbs.FederationSender,
+		"appservice":       dbs.AppService,
+		"publicroomsapi":   dbs.PublicRoomsAPI,
+		"naffka":           dbs.Naffka,
+	}
+	h := &healthChecker{
+		databases: make(map[string]*sql.DB, len(sources)),
+		listening: cfg.TorSOCKSAddr == "" || cfg.TorControlAddr != "",
+	}
+	for name, source := range sources {
+		db, err := sql.Open("postgres", string(source))
+		if err != nil {
+			h.close() // nolint: errcheck
+			return nil, err
+		}
+		db.SetMaxOpenConns(1)
+		h.databases[name] = db
+	}
+	return h, nil
+}
+
+// close closes the connections to the databases.
+func (h *healthChecker) close() error {
+	var err error
+	for _, db := range h.databases {
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// checkHealth runs every readiness check.
+func (n *Node) checkHealth(ctx context.Context) healthResponse {
+	res := healthResponse{
+		Status: healthStatusOK,
+		Checks: make(map[string]string),
+		Peers:  len(n.Host.Network().Peers()),
+	}
+	fail := func(name string, err error) {
+		res.Status = "failing"
+		res.Checks[name] = err.Error()
+	}
+
+	for name, db := range n.health.databases {
+		ctx, cancel := context.WithTimeout(ctx, HealthCheckTimeout)
+		if err := db.PingContext(ctx); err != nil {
+			fail("database/"+name, err)
+		} else {
+			res.Checks["database/"+name] = healthStatusOK
+		}
+		cancel()
+	}
+
+	switch {
+	case n.ctx.Err() != nil:
+		fail("libp2p", n.ctx.Err())
+	case n.health.listening && len(n.Host.Network().ListenAddresses()) == 0:
+		fail("libp2p", errors.New("not listening on any addresses"))
+	default:
+		res.Checks["libp2p"] = healthStatusOK
+	}
+
+	// The components are all set up before the node is returned and don't
+	// report anything about themselves after that, so there is nothing more
+	// to check about them than that they exist.
+	if n.handler == nil {
+		fail("components", errors.New("not set up yet"))
+	} else {
+		res.Checks["components"] = healthStatusOK
+	}
+	return res
+}
+
+// setupHealthAPI registers the health checks. They don't need the admin
+// token, so that supervisors can use them without one.
+func (n *Node) setupHealthAPI(mux *http.ServeMux) {
+	mux.Handle(HealthzPath, common.MakeExternalAPI("healthz", func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: healthResponse{Status: healthStatusOK},
+		}
+	}))
+	mux.Handle(ReadyzPath, common.MakeExternalAPI("readyz", func(req *http.Request) util.JSONResponse {
+		res := n.checkHealth(req.Context())
+		code := http.StatusOK
+		if res.Status != healthStatusOK {
+			code = http.StatusServiceUnavailable
+		}
+		return util.JSONResponse{Code: code, JSON: res}
+	}))
+}
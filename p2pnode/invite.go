@@ -0,0 +1,152 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+	"rsc.io/qr"
+)
+
+// InvitePrefix starts every invite, so that it can be told apart from a
+// multiaddr.
+const InvitePrefix = "dendrite-p2p:"
+
+// Invite returns an invite for the node: a single string holding our peer
+// ID and the addresses that other nodes can dial us on, so that they can
+// join the mesh through us by pasting it into -connect. Loopback addresses are
+// left out unless there are no others, as they are no use to anyone else.
+func (n *Node) Invite() string {
+	var addrs, loopback []ma.Multiaddr
+	for _, addr := range n.Host.Addrs() {
+		if manet.IsIPLoopback(addr) {
+			loopback = append(loopback, addr)
+		} else {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = loopback
+	}
+	return EncodeInvite(peer.AddrInfo{ID: n.Host.ID(), Addrs: addrs})
+}
+
+// EncodeInvite encodes a peer ID and its addresses as an invite. The binary
+// forms of the peer ID and each address are length prefixed and the whole
+// lot is base64 encoded, which is far shorter than the text multiaddrs.
+func EncodeInvite(info peer.AddrInfo) string {
+	var buf bytes.Buffer
+	writeField := func(b []byte) {
+		var n [binary.MaxVarintLen64]byte
+		buf.Write(n[:binary.PutUvarint(n[:], uint64(len(b)))])
+		buf.Write(b)
+	}
+	writeField([]byte(info.ID))
+	for _, addr := range info.Addrs {
+		writeField(addr.Bytes())
+	}
+	return InvitePrefix + base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
+
+// ParseInvite decodes an invite made by EncodeInvite.
+func ParseInvite(invite string) (*peer.AddrInfo, error) {
+	invite = strings.TrimSpace(invite)
+	if !strings.HasPrefix(invite, InvitePrefix) {
+		return nil, fmt.Errorf("invite doesn't start with %s", InvitePrefix)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(invite, InvitePrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid invite: %s", err)
+	}
+	r := bytes.NewReader(data)
+	readField := func() ([]byte, error) {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if size > uint64(r.Len()) {
+			return nil, fmt.Errorf("invalid invite: field is truncated")
+		}
+		b := make([]byte, size)
+		_, err = r.Read(b)
+		return b, err
+	}
+	idBytes, err := readField()
+	if err != nil {
+		return nil, fmt.Errorf("invalid invite: %s", err)
+	}
+	id, err := peer.IDFromBytes(idBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invite: %s", err)
+	}
+	info := &peer.AddrInfo{ID: id}
+	for r.Len() > 0 {
+		addrBytes, err := readField()
+		if err != nil {
+			return nil, fmt.Errorf("invalid invite: %s", err)
+		}
+		addr, err := ma.NewMultiaddrBytes(addrBytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid invite: %s", err)
+		}
+		info.Addrs = append(info.Addrs, addr)
+	}
+	return info, nil
+}
+
+// InviteQR renders an invite as a QR code made of block characters, to be
+// printed to a terminal. Each character is two modules high, so the code
+// comes out roughly square.
+func InviteQR(invite string) (string, error) {
+	code, err := qr.Encode(invite, qr.L)
+	if err != nil {
+		return "", err
+	}
+	// Light modules are drawn as blocks and dark ones as spaces, which suits
+	// the usual light text on a dark background. The QR spec wants a quiet
+	// zone of four light modules all round.
+	const quiet = 4
+	black := func(x, y int) bool {
+		if x < 0 || y < 0 || x >= code.Size || y >= code.Size {
+			return false
+		}
+		return code.Black(x, y)
+	}
+	var sb strings.Builder
+	for y := -quiet; y < code.Size+quiet; y += 2 {
+		for x := -quiet; x < code.Size+quiet; x++ {
+			top, bottom := !black(x, y), !black(x, y+1)
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestParseInvite(t *testing.T) {
+	id := testPeerID(t)
+	addrs := []ma.Multiaddr{
+		ma.StringCast("/ip4/192.0.2.1/tcp/4001"),
+		ma.StringCast("/ip6/2001:db8::1/udp/4001/quic"),
+	}
+	encode := func(b []byte) string {
+		return InvitePrefix + base64.RawURLEncoding.EncodeToString(b)
+	}
+	tests := []struct {
+		name   string
+		invite string
+		addrs  int
+		ok     bool
+	}{
+		{"addresses", EncodeInvite(peer.AddrInfo{ID: id, Addrs: addrs}), 2, true},
+		{"no addresses", EncodeInvite(peer.AddrInfo{ID: id}), 0, true},
+		{"whitespace", " " + EncodeInvite(peer.AddrInfo{ID: id, Addrs: addrs[:1]}) + "\n", 1, true},
+		{"no prefix", EncodeInvite(peer.AddrInfo{ID: id})[len(InvitePrefix):], 0, false},
+		{"multiaddr", "/ip4/192.0.2.1/tcp/4001/p2p/" + id.Pretty(), 0, false},
+		{"not base64", InvitePrefix + "!!!", 0, false},
+		{"empty", InvitePrefix, 0, false},
+		{"truncated", encode([]byte{10, 1, 2}), 0, false},
+		{"invalid peer ID", encode([]byte{3, 1, 2, 3}), 0, false},
+		{"invalid address", encode(append(append([]byte{byte(len(id))}, id...), 2, 0xff, 0xff)), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := ParseInvite(tt.invite)
+			if !tt.ok {
+				if err == nil {
+					t.Errorf("invalid invite was accepted as %s", info)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.ID != id || len(info.Addrs) != tt.addrs {
+				t.Fatalf("got %s, wanted %s with %d addresses", info, id, tt.addrs)
+			}
+			for i, addr := range info.Addrs {
+				if !addr.Equal(addrs[i]) {
+					t.Errorf("got address %s, wanted %s", addr, addrs[i])
+				}
+			}
+		})
+	}
+}
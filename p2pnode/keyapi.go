@@ -0,0 +1,96 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/keydb"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// KeyAPIPath is where our server keys are published. Dendrite's own handler
+// for it only knows about the current key, so we serve it ourselves.
+const KeyAPIPath = "/_matrix/key/v2/server"
+
+// setupKeyAPI registers our handler for the server keys, which includes the
+// old verify keys, both with and without a key ID on the end.
+func (n *Node) setupKeyAPI(mux *http.ServeMux) {
+	h := common.MakeExternalAPI("localkeys", func(req *http.Request) util.JSONResponse {
+		keys, err := n.localKeys(time.Now().Add(n.Base.Cfg.Matrix.KeyValidityPeriod))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return util.JSONResponse{Code: http.StatusOK, JSON: keys}
+	})
+	mux.Handle(KeyAPIPath, h)
+	mux.Handle(KeyAPIPath+"/", h)
+}
+
+func (n *Node) localKeys(validUntil time.Time) (*gomatrixserverlib.ServerKeys, error) {
+	cfg := n.Base.Cfg
+	var keys gomatrixserverlib.ServerKeys
+
+	keys.ServerName = cfg.Matrix.ServerName
+	keys.VerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{
+		n.signingKeys.KeyID: {
+			Key: gomatrixserverlib.Base64String(n.signingKeys.PrivateKey.Public().(ed25519.PublicKey)),
+		},
+	}
+	keys.TLSFingerprints = cfg.Matrix.TLSFingerPrints
+	keys.OldVerifyKeys = n.signingKeys.OldVerifyKeys
+	if keys.OldVerifyKeys == nil {
+		keys.OldVerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey{}
+	}
+	keys.ValidUntilTS = gomatrixserverlib.AsTimestamp(validUntil)
+
+	toSign, err := json.Marshal(keys.ServerKeyFields)
+	if err != nil {
+		return nil, err
+	}
+	keys.Raw, err = gomatrixserverlib.SignJSON(
+		string(cfg.Matrix.ServerName), n.signingKeys.KeyID, n.signingKeys.PrivateKey, toSign,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &keys, nil
+}
+
+// storeOldVerifyKeys stores our own old keys in the key database, so that
+// we can still check our older events ourselves.
+func storeOldVerifyKeys(ctx context.Context, keyDB keydb.Database, serverName gomatrixserverlib.ServerName, keys *SigningKeys) error {
+	results := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult)
+	for keyID, old := range keys.OldVerifyKeys {
+		results[gomatrixserverlib.PublicKeyLookupRequest{
+			ServerName: serverName,
+			KeyID:      keyID,
+		}] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    old.VerifyKey,
+			ExpiredTS:    old.ExpiredTS,
+			ValidUntilTS: gomatrixserverlib.PublicKeyNotValid,
+		}
+	}
+	if len(results) == 0 {
+		return nil
+	}
+	return keyDB.StoreKeys(ctx, results)
+}
@@ -0,0 +1,295 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/keydb"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// KeyCacheMaxEntries is the most server keys that are kept in memory.
+const KeyCacheMaxEntries = 10000
+
+// KeyPrefetchInterval is how often the keys of every server that we share
+// rooms with are fetched again, which also retries the servers that we
+// couldn't fetch keys from before.
+const KeyPrefetchInterval = time.Hour
+
+// KeyPrefetchTimeout is how long we wait for a server to give us its keys.
+const KeyPrefetchTimeout = time.Second * 30
+
+// KeyPrefetchWorkers is how many servers we fetch keys from at once.
+const KeyPrefetchWorkers = 4
+
+// keyCache keeps the server keys that go in and out of the key database in
+// memory, so that checking the signatures of a large room's events doesn't
+// query the database for every batch of them.
+type keyCache struct {
+	keydb.Database
+
+	mu   sync.RWMutex
+	keys map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult
+}
+
+func newKeyCache(db keydb.Database) *keyCache {
+	return &keyCache{
+		Database: db,
+		keys:     make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult),
+	}
+}
+
+// FetcherName implements gomatrixserverlib.KeyFetcher
+func (c *keyCache) FetcherName() string {
+	return "p2pKeyCache"
+}
+
+// FetchKeys implements gomatrixserverlib.KeyFetcher, only asking the database
+// for the keys that aren't in memory or weren't valid at the time asked.
+func (c *keyCache) FetchKeys(
+	ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, len(requests))
+	missing := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp)
+	c.mu.RLock()
+	for req, ts := range requests {
+		if res, ok := c.keys[req]; ok && res.WasValidAt(ts) {
+			results[req] = res
+		} else {
+			missing[req] = ts
+		}
+	}
+	c.mu.RUnlock()
+	if len(missing) == 0 {
+		return results, nil
+	}
+	fetched, err := c.Database.FetchKeys(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	c.add(fetched)
+	for req, res := range fetched {
+		results[req] = res
+	}
+	return results, nil
+}
+
+// StoreKeys implements gomatrixserverlib.KeyDatabase
+func (c *keyCache) StoreKeys(
+	ctx context.Context, keys map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	if err := c.Database.StoreKeys(ctx, keys); err != nil {
+		return err
+	}
+	c.add(keys)
+	return nil
+}
+
+// add keeps keys in memory. If there are too many, arbitrary ones are
+// forgotten to make room, and will be read from the database again when they
+// are next needed.
+func (c *keyCache) add(keys map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for req, res := range keys {
+		if _, ok := c.keys[req]; !ok && len(c.keys) >= KeyCacheMaxEntries {
+			for old := range c.keys {
+				delete(c.keys, old)
+				break
+			}
+		}
+		c.keys[req] = res
+	}
+}
+
+// peerIDKeys answers requests for the P2PKeyID keys of servers that are
+// named after a peer ID from the name itself, since the peer ID is the
+// public key, unless the peer has since rotated that key out and said when
+// it expired in its old_verify_keys, which the key database keeps. Only
+// those retired keys, the keys of other servers and the other keys of peers
+// come from the key database, which keeps them in memory.
+type peerIDKeys struct {
+	keydb.Database
+}
+
+// FetchKeys implements gomatrixserverlib.KeyFetcher
+func (k peerIDKeys) FetchKeys(
+	ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	peerKeys := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult)
+	for req := range requests {
+		if req.KeyID != P2PKeyID {
+			continue
+		}
+		if id, err := serverNamePeer(req.ServerName); err == nil {
+			if key, err := peerKey(id); err == nil {
+				peerKeys[req] = key
+			}
+		}
+	}
+	results, err := k.Database.FetchKeys(ctx, requests)
+	if err != nil {
+		return nil, err
+	}
+	for req, key := range peerKeys {
+		if res, ok := results[req]; !ok || !retiredKey(res) {
+			results[req] = key
+		}
+	}
+	return results, nil
+}
+
+// retiredKey returns whether a key has been rotated out by its server, which
+// then says when it expired.
+func retiredKey(res gomatrixserverlib.PublicKeyLookupResult) bool {
+	return res.ExpiredTS != gomatrixserverlib.PublicKeyNotExpired
+}
+
+// keyPrefetcher fetches the keys of every server as soon as we share a room
+// with it, several servers at a time, so that checking the signatures of its
+// events doesn't have to wait for its keys to be fetched one server after
+// another, or for a flaky peer to time out in the middle of it. The keys of
+// peers whose only key is the one in their peer ID are already known, but
+// peers can have other signing keys.
+type keyPrefetcher struct {
+	client      *gomatrixserverlib.Client
+	keyDB       keydb.Database
+	memberships *RoomMemberships
+	serverName  gomatrixserverlib.ServerName
+	queue       chan gomatrixserverlib.ServerName
+
+	mu sync.Mutex
+	// When we last fetched keys from each server, or are fetching them now.
+	fetched map[gomatrixserverlib.ServerName]time.Time
+}
+
+func newKeyPrefetcher(
+	client *gomatrixserverlib.Client, keyDB keydb.Database, memberships *RoomMemberships, serverName gomatrixserverlib.ServerName,
+) *keyPrefetcher {
+	p := &keyPrefetcher{
+		client:      client,
+		keyDB:       keyDB,
+		memberships: memberships,
+		serverName:  serverName,
+		queue:       make(chan gomatrixserverlib.ServerName, KeyCacheMaxEntries),
+		fetched:     make(map[gomatrixserverlib.ServerName]time.Time),
+	}
+	memberships.OnChange(func(server gomatrixserverlib.ServerName, rooms int) {
+		if rooms > 0 {
+			p.enqueue(server, false)
+		}
+	})
+	return p
+}
+
+// start fetches keys from the queued servers, until the context is done.
+// Every KeyPrefetchInterval, every server that we share rooms with is queued
+// again.
+func (p *keyPrefetcher) start(ctx context.Context) {
+	for i := 0; i < KeyPrefetchWorkers; i++ {
+		go p.work(ctx)
+	}
+	ticker := time.NewTicker(KeyPrefetchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for server := range p.memberships.Servers() {
+				p.enqueue(server, true)
+			}
+		}
+	}
+}
+
+// enqueue queues a server to fetch keys from, unless we already have lately
+// or the queue is full. If refresh is set then the server is queued as long
+// as we fetched from it at least KeyPrefetchInterval ago.
+func (p *keyPrefetcher) enqueue(server gomatrixserverlib.ServerName, refresh bool) {
+	if server == p.serverName {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if last, ok := p.fetched[server]; ok && (!refresh || time.Since(last) < KeyPrefetchInterval) {
+		return
+	}
+	select {
+	case p.queue <- server:
+		p.fetched[server] = time.Now()
+	default:
+	}
+}
+
+func (p *keyPrefetcher) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case server := <-p.queue:
+			if err := p.prefetch(ctx, server); err != nil {
+				// Forget that we tried, so that the next time the server
+				// joins a room that we are in, or the next refresh, tries
+				// again.
+				p.mu.Lock()
+				delete(p.fetched, server)
+				p.mu.Unlock()
+				logrus.WithError(err).WithField("server", server).Debug("Failed to prefetch server keys")
+			}
+		}
+	}
+}
+
+// prefetch fetches the keys of a server from it and stores them if they are
+// signed properly.
+func (p *keyPrefetcher) prefetch(ctx context.Context, server gomatrixserverlib.ServerName) error {
+	ctx, cancel := context.WithTimeout(ctx, KeyPrefetchTimeout)
+	defer cancel()
+	keys, err := p.client.GetServerKeys(ctx, server)
+	if err != nil {
+		return err
+	}
+	if checks, _ := gomatrixserverlib.CheckKeys(server, time.Unix(0, 0), keys); !checks.AllChecksOK {
+		return fmt.Errorf("keys from %q failed checks", server)
+	}
+	results := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult)
+	for keyID, key := range keys.VerifyKeys {
+		if keyID == P2PKeyID {
+			// We already have this key from the peer ID, for as long as
+			// the peer keeps it. Once the peer rotates it out, it is in
+			// the old verify keys below with when it expired.
+			continue
+		}
+		results[gomatrixserverlib.PublicKeyLookupRequest{ServerName: server, KeyID: keyID}] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    key,
+			ValidUntilTS: keys.ValidUntilTS,
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+		}
+	}
+	for keyID, key := range keys.OldVerifyKeys {
+		results[gomatrixserverlib.PublicKeyLookupRequest{ServerName: server, KeyID: keyID}] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    key.VerifyKey,
+			ValidUntilTS: gomatrixserverlib.PublicKeyNotValid,
+			ExpiredTS:    key.ExpiredTS,
+		}
+	}
+	return p.keyDB.StoreKeys(ctx, results)
+}
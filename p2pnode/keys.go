@@ -0,0 +1,342 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/scrypt"
+)
+
+// matrixKeyPEMType is the PEM block type that Dendrite uses for Matrix
+// signing keys, so the signing key file is interchangeable with the
+// matrix_key.pem of an ordinary Dendrite server.
+const matrixKeyPEMType = "MATRIX PRIVATE KEY"
+
+// oldVerifyKeyPEMType is the PEM block type of the public half of a signing
+// key that we no longer sign with.
+const oldVerifyKeyPEMType = "MATRIX OLD VERIFY KEY"
+
+// encryptedKeyPEMType is the PEM block type of a key file that has been
+// encrypted with a passphrase.
+const encryptedKeyPEMType = "DENDRITE P2P ENCRYPTED KEY"
+
+// The scrypt parameters used to derive the AES key from the passphrase.
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptSaltSz = 16
+)
+
+// Passphrase says how key files are protected. A nil *Passphrase means that
+// key files are written unencrypted, and encrypted ones can't be read.
+type Passphrase struct {
+	// Whether to encrypt key files when they are written, including key
+	// files that are found unencrypted.
+	Encrypt bool
+	// Get returns the passphrase, e.g. by prompting for it. It is only
+	// called if a key file needs to be encrypted or decrypted, and at most
+	// once.
+	Get func() ([]byte, error)
+
+	value []byte
+}
+
+func (p *Passphrase) get() ([]byte, error) {
+	if p.value == nil {
+		value, err := p.Get()
+		if err != nil {
+			return nil, err
+		}
+		if len(value) == 0 {
+			return nil, errors.New("the passphrase is empty")
+		}
+		p.value = value
+	}
+	return p.value, nil
+}
+
+// readKeyFile reads a key file, decrypting it if it has been encrypted. If
+// the key files should be encrypted but this one isn't then it is rewritten.
+func readKeyFile(filename string, pass *Passphrase) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != encryptedKeyPEMType {
+		if pass != nil && pass.Encrypt {
+			logrus.Infof("Encrypting %s", filename)
+			err = writeKeyFile(filename, data, pass)
+		}
+		return data, err
+	}
+	if pass == nil {
+		return nil, fmt.Errorf("%s is encrypted, but no passphrase was given", filename)
+	}
+	passphrase, err := pass.get()
+	if err != nil {
+		return nil, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("%s has an invalid salt: %s", filename, err)
+	}
+	aead, err := keyFileCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(block.Bytes) < aead.NonceSize() {
+		return nil, fmt.Errorf("%s is too short", filename)
+	}
+	nonce, ciphertext := block.Bytes[:aead.NonceSize()], block.Bytes[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s, is the passphrase right?", filename)
+	}
+	return plaintext, nil
+}
+
+// writeKeyFile writes a key file, encrypting it if key files should be.
+func writeKeyFile(filename string, data []byte, pass *Passphrase) error {
+	if pass == nil || !pass.Encrypt {
+		return ioutil.WriteFile(filename, data, 0600)
+	}
+	passphrase, err := pass.get()
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, scryptSaltSz)
+	if _, err = rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := keyFileCipher(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{
+		Type:    encryptedKeyPEMType,
+		Headers: map[string]string{"Salt": base64.RawStdEncoding.EncodeToString(salt)},
+		Bytes:   aead.Seal(nonce, nonce, data, nil),
+	}), 0600)
+}
+
+func keyFileCipher(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// LoadIdentityKey reads the libp2p identity key from the file, which holds
+// the raw ed25519 private key unless it is encrypted. A new key is generated
+// and written to the file if it doesn't exist yet. As our server name is our
+// peer ID, changing this key makes the node into a different Matrix server.
+func LoadIdentityKey(filename string, pass *Passphrase) (ed25519.PrivateKey, error) {
+	data, err := readKeyFile(filename, pass)
+	if err == nil {
+		if len(data) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("%s is not an ed25519 private key", filename)
+		}
+		return ed25519.PrivateKey(data), nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	return key, writeKeyFile(filename, key, pass)
+}
+
+// SigningKeys are the keys that the node signs Matrix events with.
+type SigningKeys struct {
+	KeyID      gomatrixserverlib.KeyID
+	PrivateKey ed25519.PrivateKey
+	// The keys that we used to sign with before, and when we stopped. They
+	// are still published so that our older events can be checked.
+	OldVerifyKeys map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey
+}
+
+// LoadSigningKeys reads the Matrix signing keys from the file, which is in
+// the same PEM format as Dendrite's matrix_key.pem, with a block for each of
+// the old keys after the current one. If the file doesn't exist yet then, if
+// there is an identity key in legacyFilename, it becomes the signing key under
+// P2PKeyID, since that is what nodes signed with before the keys were
+// separate. Otherwise a new key is generated.
+func LoadSigningKeys(filename, legacyFilename string, pass *Passphrase) (*SigningKeys, error) {
+	data, err := readKeyFile(filename, pass)
+	if err == nil {
+		return decodeSigningKeys(filename, data)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	keys := &SigningKeys{}
+	legacy, err := readKeyFile(legacyFilename, pass)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(legacy) == ed25519.PrivateKeySize {
+		logrus.Infof("Migrating the signing key from %s to %s", legacyFilename, filename)
+		keys.KeyID, keys.PrivateKey = P2PKeyID, ed25519.PrivateKey(legacy)
+	} else if keys.KeyID, keys.PrivateKey, err = generateSigningKey(); err != nil {
+		return nil, err
+	}
+	return keys, SaveSigningKeys(filename, keys, pass)
+}
+
+// SaveSigningKeys writes the signing keys to the file.
+func SaveSigningKeys(filename string, keys *SigningKeys, pass *Passphrase) error {
+	data := pem.EncodeToMemory(&pem.Block{
+		Type:    matrixKeyPEMType,
+		Headers: map[string]string{"Key-ID": string(keys.KeyID)},
+		Bytes:   keys.PrivateKey.Seed(),
+	})
+	for keyID, old := range keys.OldVerifyKeys {
+		data = append(data, pem.EncodeToMemory(&pem.Block{
+			Type: oldVerifyKeyPEMType,
+			Headers: map[string]string{
+				"Key-ID":     string(keyID),
+				"Expired-TS": strconv.FormatUint(uint64(old.ExpiredTS), 10),
+			},
+			Bytes: old.Key,
+		})...)
+	}
+	return writeKeyFile(filename, data, pass)
+}
+
+// Rotate replaces the signing key with a new one with a new key ID. The old
+// key is kept as an old verify key, which expired now.
+func (k *SigningKeys) Rotate() error {
+	keyID, key, err := generateSigningKey()
+	if err != nil {
+		return err
+	}
+	if k.OldVerifyKeys == nil {
+		k.OldVerifyKeys = make(map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey)
+	}
+	k.OldVerifyKeys[k.KeyID] = gomatrixserverlib.OldVerifyKey{
+		VerifyKey: gomatrixserverlib.VerifyKey{
+			Key: gomatrixserverlib.Base64String(k.PrivateKey.Public().(ed25519.PublicKey)),
+		},
+		ExpiredTS: gomatrixserverlib.AsTimestamp(time.Now()),
+	}
+	k.KeyID, k.PrivateKey = keyID, key
+	return nil
+}
+
+func generateSigningKey() (gomatrixserverlib.KeyID, ed25519.PrivateKey, error) {
+	var id [3]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", nil, err
+	}
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return "", nil, err
+	}
+	// Key IDs appear in URLs, so stick to characters that don't need escaping.
+	return gomatrixserverlib.KeyID("ed25519:" + hex.EncodeToString(id[:])), key, nil
+}
+
+// WriteSeededKeys writes an identity key and a signing key derived from a
+// seed and the index of the node among those sharing the seed, unless the
+// node has keys already, so that it has the same peer ID and key ID every
+// time, e.g. to replay a simulation. Anyone who knows the seed has the keys.
+func WriteSeededKeys(identityFile, signingFile string, seed int64, index int, pass *Passphrase) error {
+	for _, filename := range []string{identityFile, signingFile} {
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			return err
+		}
+	}
+	derive := func(purpose string) []byte {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("dendrite-p2p %s %d %d", purpose, seed, index)))
+		return sum[:]
+	}
+	if err := writeKeyFile(identityFile, ed25519.NewKeyFromSeed(derive("identity")), pass); err != nil {
+		return err
+	}
+	return SaveSigningKeys(signingFile, &SigningKeys{
+		KeyID:      gomatrixserverlib.KeyID("ed25519:" + hex.EncodeToString(derive("key ID")[:3])),
+		PrivateKey: ed25519.NewKeyFromSeed(derive("signing")),
+	}, pass)
+}
+
+func decodeSigningKeys(filename string, data []byte) (*SigningKeys, error) {
+	keys := &SigningKeys{
+		OldVerifyKeys: make(map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey),
+	}
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		keyID := block.Headers["Key-ID"]
+		if !strings.HasPrefix(keyID, "ed25519:") {
+			return nil, fmt.Errorf("%s has key ID %q, which isn't an ed25519 key ID", filename, keyID)
+		}
+		switch block.Type {
+		case matrixKeyPEMType:
+			if keys.PrivateKey != nil {
+				return nil, fmt.Errorf("%s has more than one current signing key", filename)
+			}
+			_, key, err := ed25519.GenerateKey(bytes.NewReader(block.Bytes))
+			if err != nil {
+				return nil, err
+			}
+			keys.KeyID, keys.PrivateKey = gomatrixserverlib.KeyID(keyID), key
+		case oldVerifyKeyPEMType:
+			expired, err := strconv.ParseUint(block.Headers["Expired-TS"], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s has an invalid expiry time for %s: %s", filename, keyID, err)
+			}
+			keys.OldVerifyKeys[gomatrixserverlib.KeyID(keyID)] = gomatrixserverlib.OldVerifyKey{
+				VerifyKey: gomatrixserverlib.VerifyKey{Key: block.Bytes},
+				ExpiredTS: gomatrixserverlib.Timestamp(expired),
+			}
+		}
+	}
+	if keys.PrivateKey == nil {
+		return nil, fmt.Errorf("no Matrix signing key in %s", filename)
+	}
+	return keys, nil
+}
@@ -0,0 +1,309 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestSigningKeysRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pnode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	filename := filepath.Join(dir, "matrix_key.pem")
+
+	keys := &SigningKeys{KeyID: "ed25519:first", PrivateKey: ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))}
+	if err = keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err = SaveSigningKeys(filename, keys, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeSigningKeys(filename, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.KeyID != keys.KeyID || !bytes.Equal(decoded.PrivateKey, keys.PrivateKey) {
+		t.Errorf("got key %s, wanted %s", decoded.KeyID, keys.KeyID)
+	}
+	old, ok := decoded.OldVerifyKeys["ed25519:first"]
+	if !ok || len(decoded.OldVerifyKeys) != 1 {
+		t.Fatalf("got old keys %v, wanted ed25519:first", decoded.OldVerifyKeys)
+	}
+	if want := keys.OldVerifyKeys["ed25519:first"]; !bytes.Equal(old.Key, want.Key) || old.ExpiredTS != want.ExpiredTS {
+		t.Errorf("got old key %+v, wanted %+v", old, want)
+	}
+}
+
+func TestDecodeSigningKeys(t *testing.T) {
+	seed := make([]byte, ed25519.SeedSize)
+	block := func(typ string, headers map[string]string, b []byte) string {
+		return string(pem.EncodeToMemory(&pem.Block{Type: typ, Headers: headers, Bytes: b}))
+	}
+	current := block(matrixKeyPEMType, map[string]string{"Key-ID": "ed25519:a"}, seed)
+	tests := []struct {
+		name  string
+		data  string
+		keyID gomatrixserverlib.KeyID
+		old   int
+		ok    bool
+	}{{
+		name:  "current only",
+		data:  current,
+		keyID: "ed25519:a",
+		ok:    true,
+	}, {
+		name: "with old key",
+		data: current + block(oldVerifyKeyPEMType, map[string]string{
+			"Key-ID": "ed25519:b", "Expired-TS": "1000",
+		}, seed),
+		keyID: "ed25519:a",
+		old:   1,
+		ok:    true,
+	}, {
+		name: "old key first",
+		data: block(oldVerifyKeyPEMType, map[string]string{
+			"Key-ID": "ed25519:b", "Expired-TS": "1000",
+		}, seed) + current,
+		keyID: "ed25519:a",
+		old:   1,
+		ok:    true,
+	}, {
+		name: "empty",
+	}, {
+		name: "no current key",
+		data: block(oldVerifyKeyPEMType, map[string]string{"Key-ID": "ed25519:b", "Expired-TS": "1000"}, seed),
+	}, {
+		name: "two current keys",
+		data: current + block(matrixKeyPEMType, map[string]string{"Key-ID": "ed25519:b"}, seed),
+	}, {
+		name: "not ed25519",
+		data: block(matrixKeyPEMType, map[string]string{"Key-ID": "rsa:a"}, seed),
+	}, {
+		name: "no key ID",
+		data: block(matrixKeyPEMType, nil, seed),
+	}, {
+		name: "short seed",
+		data: block(matrixKeyPEMType, map[string]string{"Key-ID": "ed25519:a"}, seed[:16]),
+	}, {
+		name: "invalid expiry",
+		data: current + block(oldVerifyKeyPEMType, map[string]string{
+			"Key-ID": "ed25519:b", "Expired-TS": "soon",
+		}, seed),
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := decodeSigningKeys("matrix_key.pem", []byte(tt.data))
+			if !tt.ok {
+				if err == nil {
+					t.Error("invalid keys were accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keys.KeyID != tt.keyID || len(keys.OldVerifyKeys) != tt.old {
+				t.Errorf("got key %s and %d old keys, wanted %s and %d", keys.KeyID, len(keys.OldVerifyKeys), tt.keyID, tt.old)
+			}
+		})
+	}
+}
+
+func testPassphrase(passphrase string, encrypt bool) *Passphrase {
+	return &Passphrase{Encrypt: encrypt, Get: func() ([]byte, error) { return []byte(passphrase), nil }}
+}
+
+func TestKeyFileEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pnode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	filename := filepath.Join(dir, "identity.key")
+
+	key := []byte("an ed25519 private key")
+	if err = writeKeyFile(filename, key, testPassphrase("secret", true)); err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted, key) {
+		t.Fatal("encrypted key file holds the key")
+	}
+	block, _ := pem.Decode(encrypted)
+	if block == nil || block.Type != encryptedKeyPEMType {
+		t.Fatalf("got key file %q, wanted a %s block", encrypted, encryptedKeyPEMType)
+	}
+	withBytes := func(b []byte) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: block.Type, Headers: block.Headers, Bytes: b})
+	}
+	corrupted := append([]byte{}, block.Bytes...)
+	corrupted[len(corrupted)-1] ^= 1
+
+	tests := []struct {
+		name      string
+		data      []byte
+		pass      *Passphrase
+		ok        bool
+		encrypted bool // whether the file is encrypted after reading it
+	}{
+		{"round trip", encrypted, testPassphrase("secret", false), true, true},
+		{"wrong passphrase", encrypted, testPassphrase("guess", false), false, true},
+		{"empty passphrase", encrypted, testPassphrase("", false), false, true},
+		{"no passphrase", encrypted, nil, false, true},
+		{"truncated", withBytes(block.Bytes[:len(block.Bytes)-4]), testPassphrase("secret", false), false, true},
+		{"shorter than the nonce", withBytes(block.Bytes[:4]), testPassphrase("secret", false), false, true},
+		{"corrupted", withBytes(corrupted), testPassphrase("secret", false), false, true},
+		{"invalid salt", pem.EncodeToMemory(&pem.Block{
+			Type: block.Type, Headers: map[string]string{"Salt": "!"}, Bytes: block.Bytes,
+		}), testPassphrase("secret", false), false, true},
+		{"old unencrypted file", key, nil, true, false},
+		{"old unencrypted file with a passphrase", key, testPassphrase("secret", false), true, false},
+		{"old unencrypted file being encrypted", key, testPassphrase("secret", true), true, true},
+	}
+	for _, tt := range tests {
+		if err = ioutil.WriteFile(filename, tt.data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readKeyFile(filename, tt.pass)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: key file was read", tt.name)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, key) {
+			t.Errorf("%s: got %q, %v, wanted %q", tt.name, got, err, key)
+			continue
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block, _ := pem.Decode(data); (block != nil && block.Type == encryptedKeyPEMType) != tt.encrypted {
+			t.Errorf("%s: got encrypted %v, wanted %v", tt.name, !tt.encrypted, tt.encrypted)
+		}
+		if got, err = readKeyFile(filename, testPassphrase("secret", false)); err != nil || !bytes.Equal(got, key) {
+			t.Errorf("%s: got %q, %v after reading, wanted %q", tt.name, got, err, key)
+		}
+	}
+}
+
+func TestKeyFileCipher(t *testing.T) {
+	salt, otherSalt := make([]byte, scryptSaltSz), make([]byte, scryptSaltSz)
+	otherSalt[0] = 1
+	aead, err := keyFileCipher([]byte("secret"), salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	sealed := aead.Seal(nil, nonce, []byte("key"), nil)
+
+	tests := []struct {
+		name       string
+		passphrase string
+		salt       []byte
+		ok         bool
+	}{
+		{"same passphrase and salt", "secret", salt, true},
+		{"other passphrase", "guess", salt, false},
+		{"other salt", "secret", otherSalt, false},
+	}
+	for _, tt := range tests {
+		aead, err := keyFileCipher([]byte(tt.passphrase), tt.salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = aead.Open(nil, nonce, sealed, nil); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, wanted opened %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestLoadIdentityKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pnode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	identityFile := filepath.Join(dir, "identity.key")
+	signingFile := filepath.Join(dir, "matrix_key.pem")
+
+	key, err := LoadIdentityKey(identityFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := LoadIdentityKey(identityFile, nil); err != nil || !bytes.Equal(again, key) {
+		t.Fatalf("got a different identity key, %v, after loading it again", err)
+	}
+
+	// Nodes used to sign with their identity key, which becomes the signing
+	// key under P2PKeyID until it is rotated.
+	keys, err := LoadSigningKeys(signingFile, identityFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.KeyID != P2PKeyID || !bytes.Equal(keys.PrivateKey, key) {
+		t.Errorf("got signing key %s, wanted the identity key under %s", keys.KeyID, P2PKeyID)
+	}
+	if err = keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err = SaveSigningKeys(signingFile, keys, nil); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := LoadIdentityKey(identityFile, nil); err != nil || !bytes.Equal(again, key) {
+		t.Errorf("rotating the signing key changed the identity key, %v", err)
+	}
+	if keys, err = LoadSigningKeys(signingFile, identityFile, nil); err != nil {
+		t.Fatal(err)
+	}
+	if keys.KeyID == P2PKeyID || bytes.Equal(keys.PrivateKey, key) {
+		t.Error("signing key wasn't rotated away from the identity key")
+	}
+
+	// New nodes have a signing key of their own.
+	newSigningFile := filepath.Join(dir, "new_matrix_key.pem")
+	if keys, err = LoadSigningKeys(newSigningFile, filepath.Join(dir, "missing.key"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if keys.KeyID == P2PKeyID || bytes.Equal(keys.PrivateKey, key) {
+		t.Errorf("new node got signing key %s from the identity key", keys.KeyID)
+	}
+
+	if err = ioutil.WriteFile(identityFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadIdentityKey(identityFile, nil); err == nil {
+		t.Error("invalid identity key was loaded")
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path/filepath"
+	"time"
+
+	circuit "github.com/libp2p/go-libp2p-circuit"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	dhtopts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/matrix-org/dendrite/common/keydb"
+	"github.com/matrix-org/go-libp2p"
+	p2pdisc "github.com/matrix-org/go-libp2p/p2p/discovery"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// MDNSServiceTag is the service tag that we advertise and browse for on the
+// local network. Only nodes using the same tag will find each other.
+const MDNSServiceTag = "_matrix-dendrite-p2p._tcp"
+
+// MDNSInterval is how often we query the local network for other nodes.
+const MDNSInterval = time.Second * 10
+
+// MatrixProtocol is the libp2p protocol that the Matrix APIs are served on.
+const MatrixProtocol = "/matrix"
+
+// P2PKeyID is the key ID that demo nodes signed their events with when the
+// signing key was also the libp2p identity of the node. As the key ID is the
+// same everywhere and the server name tells us which key it is, we can store
+// that key for any peer without asking it. Nodes with a separate signing key
+// use a different key ID, and their keys are fetched over federation.
+const P2PKeyID = "ed25519:p2pdemo"
+
+// createLibP2PHost creates the libp2p host that the node listens and dials
+// on, along with the DHT that is used to route to peers that we don't have
+// addresses for. The bandwidth used by the host is logged to bandwidth.
+func createLibP2PHost(ctx context.Context, cfg *Config, bandwidth metrics.Reporter) (host.Host, *dht.IpfsDHT, error) {
+	p2pKey, err := crypto.UnmarshalEd25519PrivateKey(cfg.IdentityKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var p2pDHT *dht.IpfsDHT
+	opts := []libp2p.Option{
+		libp2p.Identity(p2pKey),
+		libp2p.Routing(func(h host.Host) (r routing.PeerRouting, err error) {
+			p2pDHT, err = dht.New(ctx, h,
+				dhtopts.NamespacedValidator(MailboxNamespace, mailboxValidator{}),
+				dhtopts.NamespacedValidator(PostboxNamespace, postboxValidator{}),
+				dhtopts.NamespacedValidator(MediaNamespace, mediaValidator{}),
+			)
+			return p2pDHT, err
+		}),
+		// With hop enabled, autorelay advertises us as a relay in the DHT.
+		// Without it, autorelay finds relays in the DHT and, if autonat decides
+		// that we aren't publicly reachable, advertises relayed addresses.
+		libp2p.EnableAutoRelay(),
+		libp2p.BandwidthReporter(bandwidth),
+	}
+	if cfg.RelayServer {
+		opts = append(opts, libp2p.EnableRelay(circuit.OptHop))
+	} else {
+		opts = append(opts, libp2p.EnableRelay())
+	}
+	cm, err := createConnManager(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cm != nil {
+		opts = append(opts, libp2p.ConnectionManager(cm))
+	}
+	if cfg.PSKFile != "" {
+		psk, err := loadPSK(cfg.PSKFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, libp2p.PrivateNetwork(newPSKProtector(psk)))
+	}
+	onion := &onionService{}
+	if cfg.TorSOCKSAddr != "" {
+		// Everything goes through Tor, and the only address we advertise is
+		// our onion address, if we have one.
+		opts = append(opts,
+			libp2p.Transport(newTorTransport(cfg.TorSOCKSAddr)),
+			libp2p.AddrsFactory(onion.Addrs),
+		)
+		if cfg.TorControlAddr != "" {
+			opts = append(opts, libp2p.ListenAddrStrings(TorListenAddr))
+		} else {
+			opts = append(opts, libp2p.NoListenAddrs)
+		}
+	} else {
+		opts = append(opts,
+			libp2p.DefaultListenAddrs,
+			// This includes the WebSocket transport as well as TCP.
+			libp2p.DefaultTransports,
+		)
+		if !cfg.DisableNATPortMap {
+			opts = append(opts, libp2p.NATPortMap())
+		}
+		if cfg.WebSocketListenAddr != "" {
+			opts = append(opts, libp2p.ListenAddrStrings(cfg.WebSocketListenAddr))
+		}
+	}
+
+	p2pHost, err := libp2p.New(ctx, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.TorSOCKSAddr != "" && cfg.TorControlAddr != "" {
+		keyFile := filepath.Join(cfg.DataDir, TorOnionKeyFileName)
+		if err = onion.start(ctx, cfg.TorControlAddr, keyFile, p2pHost.Network().ListenAddresses()[0]); err != nil {
+			p2pHost.Close() // nolint: errcheck
+			return nil, nil, err
+		}
+	}
+
+	return p2pHost, p2pDHT, nil
+}
+
+// createLibP2PPubSub creates the pubsub router used by components that
+// gossip with other nodes, e.g. the public rooms directory and ephemeral
+// events. Gossipsub still talks to peers that only speak floodsub.
+func createLibP2PPubSub(ctx context.Context, p2pHost host.Host) (*pubsub.PubSub, error) {
+	return pubsub.NewGossipSub(ctx, p2pHost, pubsub.WithMessageSigning(true), pubsub.WithStrictSignatureVerification(true))
+}
+
+// setupMDNS starts browsing for other nodes on the local network. Every peer
+// that is found is connected to and has its signing key stored in the key
+// database, so that we can federate with it straight away.
+func setupMDNS(ctx context.Context, p2pHost host.Host, keyDB keydb.Database) error {
+	serv, err := p2pdisc.NewMdnsService(ctx, p2pHost, MDNSInterval, MDNSServiceTag)
+	if err != nil {
+		return err
+	}
+	serv.RegisterNotifee(&mDNSNotifee{
+		ctx:   ctx,
+		host:  p2pHost,
+		keyDB: keyDB,
+	})
+	return nil
+}
+
+type mDNSNotifee struct {
+	ctx   context.Context
+	host  host.Host
+	keyDB keydb.Database
+}
+
+// HandlePeerFound implements p2pdisc.Notifee
+func (n *mDNSNotifee) HandlePeerFound(p peer.AddrInfo) {
+	if p.ID == n.host.ID() {
+		return
+	}
+	logger := logrus.WithField("peer", p.ID.String())
+	if err := connectPeer(n.ctx, n.host, n.keyDB, p); err != nil {
+		logger.WithError(err).Warn("Failed to connect to peer found via mDNS")
+		return
+	}
+	logger.WithField("addrs", p.Addrs).Info("Connected to peer found via mDNS")
+}
+
+// connectPeer connects to a peer and stores its signing key, so that the
+// federation client can route to it and we can verify its events.
+func connectPeer(ctx context.Context, p2pHost host.Host, keyDB keydb.Database, p peer.AddrInfo) error {
+	if err := p2pHost.Connect(ctx, p); err != nil {
+		dialFailures.Inc()
+		return err
+	}
+	return storePeerKey(ctx, keyDB, p.ID)
+}
+
+// storePeerKey stores the P2PKeyID signing key of a peer in the key database.
+// The key is embedded in the peer ID, so we never need to ask the peer for
+// it, and it doesn't expire until the peer rotates it out, which is left as
+// it is. Keys of peers with a separate signing key are fetched from the peer
+// when they are needed instead.
+func storePeerKey(ctx context.Context, keyDB keydb.Database, id peer.ID) error {
+	key, err := peerKey(id)
+	if err != nil {
+		return err
+	}
+	req := gomatrixserverlib.PublicKeyLookupRequest{
+		ServerName: peerServerName(id),
+		KeyID:      P2PKeyID,
+	}
+	stored, err := keyDB.FetchKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		req: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		return err
+	}
+	if res, ok := stored[req]; ok && retiredKey(res) {
+		return nil
+	}
+	return keyDB.StoreKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		req: key,
+	})
+}
+
+// peerServerName returns the Matrix server name of a peer, which is its
+// peer ID. Every node has its own name, and the signing key of the node can
+// be taken from it, so its events can be checked without asking it.
+func peerServerName(id peer.ID) gomatrixserverlib.ServerName {
+	return gomatrixserverlib.ServerName(id.Pretty())
+}
+
+// serverNamePeer returns the peer that a server name belongs to, or an error
+// if the server isn't a node.
+func serverNamePeer(server gomatrixserverlib.ServerName) (peer.ID, error) {
+	return peer.IDB58Decode(string(server))
+}
+
+// peerKey returns the P2PKeyID signing key of a peer, from its peer ID, as
+// valid for as long as the peer hasn't rotated it out.
+func peerKey(id peer.ID) (gomatrixserverlib.PublicKeyLookupResult, error) {
+	pubKey, err := id.ExtractPublicKey()
+	if err != nil {
+		return gomatrixserverlib.PublicKeyLookupResult{}, err
+	}
+	if pubKey.Type() != crypto.Ed25519 {
+		return gomatrixserverlib.PublicKeyLookupResult{}, fmt.Errorf("peer %s doesn't have an ed25519 key", id.Pretty())
+	}
+	raw, err := pubKey.Raw()
+	if err != nil {
+		return gomatrixserverlib.PublicKeyLookupResult{}, err
+	}
+	return gomatrixserverlib.PublicKeyLookupResult{
+		VerifyKey: gomatrixserverlib.VerifyKey{
+			Key: gomatrixserverlib.Base64String(raw),
+		},
+		ValidUntilTS: math.MaxUint64 >> 1,
+		ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+	}, nil
+}
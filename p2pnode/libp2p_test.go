@@ -0,0 +1,71 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestPeerServerName(t *testing.T) {
+	priv, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := peerServerName(id)
+	if server == peerServerName(testPeerID(t)) {
+		t.Fatal("two nodes have the same server name")
+	}
+
+	identityKey, err := priv.Raw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported, err := ServerName(identityKey); err != nil || exported != server {
+		t.Errorf("got exported server name %q, %v, wanted %q", exported, err, server)
+	}
+
+	// The signing key of the node comes from its server name alone.
+	got, err := serverNamePeer(server)
+	if err != nil || got != id {
+		t.Fatalf("got peer %s, %v, wanted %s", got, err, id)
+	}
+	key, err := peerKey(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := pub.Raw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key.Key, raw) {
+		t.Error("signing key from the server name isn't the node's key")
+	}
+
+	for _, other := range []gomatrixserverlib.ServerName{"p2p", "example.com", "example.com:8448", ""} {
+		if _, err := serverNamePeer(other); err == nil {
+			t.Errorf("%q was taken to be a node", other)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/go-libp2p/p2p/protocol/ping"
+	"github.com/sirupsen/logrus"
+)
+
+// LivenessInterval is how often we ping the peers that we share rooms with.
+const LivenessInterval = time.Second * 30
+
+// LivenessTimeout is how long we wait for a peer to answer a ping.
+const LivenessTimeout = time.Second * 10
+
+// LivenessMaxMissed is how many probes in a row a peer may miss before we
+// take it to be offline. A peer misses a probe if it doesn't answer the ping,
+// or if we aren't connected to it at all.
+const LivenessMaxMissed = 3
+
+// errPeerOffline is returned for requests to a peer that we think is offline.
+var errPeerOffline = errors.New("the node is offline")
+
+// PeerLiveness is what we know about whether a peer is online.
+type PeerLiveness struct {
+	PeerID string `json:"peer_id"`
+	Online bool   `json:"online"`
+	// The round trip time of the last ping that the peer answered, in
+	// milliseconds.
+	RTTMS int64 `json:"rtt_ms,omitempty"`
+	// When the peer last answered a ping, in milliseconds since the epoch,
+	// or zero if it never has.
+	LastSeenTS int64 `json:"last_seen_ts,omitempty"`
+	// How many probes in a row the peer has missed.
+	Missed int `json:"missed"`
+}
+
+// livenessState is the result of probing a peer.
+type livenessState struct {
+	rtt      time.Duration
+	lastSeen time.Time
+	missed   int
+}
+
+// liveness pings the peers that we share rooms with, so that we know which
+// are online. Transactions for peers that are offline go straight to their
+// postbox peers or the DHT mailbox rather than waiting for a dial to time
+// out first.
+type liveness struct {
+	host        host.Host
+	memberships *RoomMemberships
+
+	mu     sync.Mutex
+	states map[peer.ID]*livenessState
+}
+
+func newLiveness(p2pHost host.Host, memberships *RoomMemberships) *liveness {
+	l := &liveness{
+		host:        p2pHost,
+		memberships: memberships,
+		states:      make(map[peer.ID]*livenessState),
+	}
+	// A peer that we have just connected to is online, whatever the last
+	// probe said.
+	p2pHost.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			l.mu.Lock()
+			if state, ok := l.states[conn.RemotePeer()]; ok {
+				state.missed = 0
+			}
+			l.mu.Unlock()
+		},
+	})
+	return l
+}
+
+// start probes peers, until the context is done.
+func (l *liveness) start(ctx context.Context) {
+	ticker := time.NewTicker(LivenessInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.probeAll(ctx)
+		}
+	}
+}
+
+// probeAll pings every peer that we share rooms with at once, and forgets
+// the peers that we no longer do.
+func (l *liveness) probeAll(ctx context.Context) {
+	peers := make(map[peer.ID]struct{})
+	var wg sync.WaitGroup
+	for _, id := range l.memberships.Peers() {
+		if id == l.host.ID() {
+			continue
+		}
+		peers[id] = struct{}{}
+		wg.Add(1)
+		go func(id peer.ID) {
+			defer wg.Done()
+			l.probe(ctx, id)
+		}(id)
+	}
+	wg.Wait()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id := range l.states {
+		if _, ok := peers[id]; !ok {
+			delete(l.states, id)
+		}
+	}
+}
+
+// probe pings a peer, if we are connected to it. We don't dial peers just to
+// ping them, since the reconnector is already doing that.
+func (l *liveness) probe(ctx context.Context, id peer.ID) {
+	var res ping.Result
+	if l.host.Network().Connectedness(id) == network.Connected {
+		ctx, cancel := context.WithTimeout(ctx, LivenessTimeout)
+		var ok bool
+		if res, ok = <-ping.Ping(ctx, l.host, id); !ok {
+			// The ping timed out without a result.
+			res.Error = ctx.Err()
+		}
+		cancel()
+	} else {
+		res.Error = errors.New("not connected")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state, ok := l.states[id]
+	if !ok {
+		state = &livenessState{}
+		l.states[id] = state
+	}
+	if res.Error != nil {
+		state.missed++
+		if state.missed == LivenessMaxMissed {
+			logrus.WithError(res.Error).WithField("peer", id.String()).Info("Peer seems to be offline")
+		}
+		return
+	}
+	state.rtt = res.RTT
+	state.lastSeen = time.Now()
+	state.missed = 0
+}
+
+// offline reports whether a peer has missed too many probes. Peers that we
+// haven't probed are never taken to be offline.
+func (l *liveness) offline(id peer.ID) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state, ok := l.states[id]
+	return ok && state.missed >= LivenessMaxMissed
+}
+
+// Liveness returns what we know about whether each of the peers that we
+// share rooms with is online, sorted by peer ID.
+func (n *Node) Liveness() []PeerLiveness {
+	l := n.liveness
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	peers := make([]PeerLiveness, 0, len(l.states))
+	for id, state := range l.states {
+		info := PeerLiveness{
+			PeerID: id.Pretty(),
+			Online: state.missed < LivenessMaxMissed,
+			RTTMS:  int64(state.rtt / time.Millisecond),
+			Missed: state.missed,
+		}
+		if !state.lastSeen.IsZero() {
+			info.LastSeenTS = state.lastSeen.UnixNano() / int64(time.Millisecond)
+		}
+		peers = append(peers, info)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].PeerID < peers[j].PeerID })
+	return peers
+}
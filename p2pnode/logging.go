@@ -0,0 +1,107 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	golog "github.com/ipfs/go-log"
+	"github.com/sirupsen/logrus"
+	logging "github.com/whyrusleeping/go-logging"
+)
+
+// SetupLogging sends all logs, including those from libp2p, through logrus
+// with the configured level, format and destination. It should be called
+// as early as possible, before the node is started.
+func SetupLogging(cfg *Config) error {
+	if cfg.LogFile != "" {
+		if err := os.MkdirAll(filepath.Dir(cfg.LogFile), 0700); err != nil {
+			return err
+		}
+		f, err := newRotatingFile(
+			cfg.LogFile, int64(cfg.LogMaxSizeMB)<<20,
+			time.Duration(cfg.LogMaxAgeDays)*24*time.Hour, cfg.LogMaxBackups,
+		)
+		if err != nil {
+			return err
+		}
+		logrus.SetOutput(f)
+	}
+	if err := setupLogrus(cfg); err != nil {
+		return err
+	}
+
+	// libp2p logs through go-log, which has its own idea of levels and is
+	// very noisy below ERROR, so it gets a level of its own.
+	level := cfg.LibP2PLogLevel
+	if level == "" {
+		level = "error"
+	}
+	lvl, err := logging.LogLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid libp2p log level %q: %s", level, err)
+	}
+	logging.SetBackend(libp2pLogBackend{})
+	golog.SetAllLoggers(lvl)
+	return nil
+}
+
+// setupLogrus sets the level and format of logrus. The base component sets
+// its own formatter when it is created, so this is done again afterwards.
+func setupLogrus(cfg *Config) error {
+	if cfg.LogLevel != "" {
+		level, err := logrus.ParseLevel(cfg.LogLevel)
+		if err != nil {
+			return err
+		}
+		logrus.SetLevel(level)
+	}
+	switch cfg.LogFormat {
+	case "", "text":
+		logrus.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp:    true,
+			DisableColors:    cfg.LogFile != "",
+			QuoteEmptyFields: true,
+		})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", cfg.LogFormat)
+	}
+	return nil
+}
+
+// libp2pLogBackend is a go-logging backend which passes the logs from libp2p
+// on to logrus, with the subsystem that they came from.
+type libp2pLogBackend struct{}
+
+// Log implements logging.Backend
+func (libp2pLogBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	entry := logrus.WithField("subsystem", rec.Module)
+	switch level {
+	case logging.CRITICAL, logging.ERROR:
+		entry.Error(rec.Message())
+	case logging.WARNING:
+		entry.Warn(rec.Message())
+	case logging.NOTICE, logging.INFO:
+		entry.Info(rec.Message())
+	default:
+		entry.Debug(rec.Message())
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LogRotateInterval is how old the log file can get before it is rotated,
+// even if it hasn't reached the maximum size.
+const LogRotateInterval = 24 * time.Hour
+
+// rotatingFile is a log file which is rotated when it gets too big or too
+// old. Rotated files are renamed with the time that they were rotated at,
+// and deleted once there are too many of them or they are too old.
+type rotatingFile struct {
+	mu         sync.Mutex
+	filename   string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+	openedAt   time.Time
+}
+
+// newRotatingFile opens the log file. A maxSize, maxAge or maxBackups of
+// zero means that there is no limit.
+func newRotatingFile(filename string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		filename:   filename,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	f.removeOldBackups()
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close() // nolint: errcheck
+		return err
+	}
+	f.file, f.size, f.openedAt = file, info.Size(), time.Now()
+	return nil
+}
+
+// Write implements io.Writer
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tooBig := f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize
+	if tooBig || time.Since(f.openedAt) > LogRotateInterval {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	backup := f.filename + "." + time.Now().UTC().Format("2006-01-02T15-04-05.000")
+	if err := os.Rename(f.filename, backup); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	go f.removeOldBackups()
+	return nil
+}
+
+// removeOldBackups deletes the rotated files that are past the limits.
+func (f *rotatingFile) removeOldBackups() {
+	backups, err := filepath.Glob(f.filename + ".*")
+	if err != nil {
+		return
+	}
+	// The names sort by the time that they were rotated, newest last.
+	sort.Strings(backups)
+	for i, backup := range backups {
+		if f.maxBackups > 0 && i < len(backups)-f.maxBackups {
+			os.Remove(backup) // nolint: errcheck
+		} else if info, err := os.Stat(backup); err == nil && f.maxAge > 0 && time.Since(info.ModTime()) > f.maxAge {
+			os.Remove(backup) // nolint: errcheck
+		}
+	}
+}
@@ -0,0 +1,672 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/matrix-org/dendrite/common/keydb"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// MailboxNamespace is the DHT namespace of mailbox records. The record for
+// transactions from one node to another is at /matrix-mailbox/<to>/<from>,
+// by peer ID.
+const MailboxNamespace = "matrix-mailbox"
+
+// MailboxMaxSize is the most that the transactions in a mailbox record can
+// add up to. The oldest are dropped to make room for new ones, as the room
+// DAG lets the recipient fetch anything that it missed once it hears of a
+// later event.
+const MailboxMaxSize = 256 * 1024
+
+// MailboxCheckInterval is how often we look in the DHT for transactions that
+// were left for us while we were offline.
+const MailboxCheckInterval = time.Minute * 5
+
+// MailboxRepublishInterval is how often records that still hold transactions
+// are put in the DHT again, before the DHT forgets them.
+const MailboxRepublishInterval = time.Hour
+
+// MailboxTimeout is how long putting or getting a mailbox record may take.
+const MailboxTimeout = time.Minute
+
+// MailboxKeyValidity is how long the signing key that a mailbox record
+// carries is taken to be the sender's for, from when the record is picked
+// up, which is long enough to check the transactions in it.
+const MailboxKeyValidity = time.Hour
+
+// SendFederationPathPrefix starts the federation API that transactions are
+// sent to. The transaction ID follows it.
+const SendFederationPathPrefix = "/_matrix/federation/v1/send/"
+
+// mailboxRequest is a transaction that was left in a mailbox, as the signed
+// federation request that would have carried it.
+type mailboxRequest struct {
+	Path          string          `json:"path"`
+	Authorization string          `json:"authorization"`
+	Body          json.RawMessage `json:"body"`
+}
+
+// mailboxRecord is the value of a mailbox record in the DHT. The requests
+// are sealed to the recipient with an ephemeral key, and the record is
+// signed by the sender's identity key, from which its peer ID is derived.
+// The record also carries the signing key that the requests are signed
+// with, which the signature vouches for, so that the recipient can check
+// them without asking the sender, which is offline, for its keys.
+type mailboxRecord struct {
+	Seq          int64                          `json:"seq"`
+	KeyID        gomatrixserverlib.KeyID        `json:"key_id,omitempty"`
+	VerifyKey    gomatrixserverlib.Base64String `json:"verify_key,omitempty"`
+	EphemeralKey []byte                         `json:"ephemeral_key"`
+	Nonce        []byte                         `json:"nonce"`
+	Box          []byte                         `json:"box"`
+	Signature    []byte                         `json:"signature,omitempty"`
+}
+
+// signedBytes returns what the signature of the record at the key covers.
+func (r *mailboxRecord) signedBytes(key string) ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = nil
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(key+"\n"), data...), nil
+}
+
+// mailboxKey returns the DHT key of the record for transactions from one
+// node to another.
+func mailboxKey(to, from peer.ID) string {
+	return "/" + MailboxNamespace + "/" + to.Pretty() + "/" + from.Pretty()
+}
+
+// parseMailboxKey returns the recipient and sender of a mailbox record key.
+func parseMailboxKey(key string) (to, from peer.ID, err error) {
+	parts := strings.Split(strings.TrimPrefix(key, "/"+MailboxNamespace+"/"), "/")
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid mailbox key %q", key)
+	}
+	if to, err = peer.IDB58Decode(parts[0]); err != nil {
+		return "", "", err
+	}
+	if from, err = peer.IDB58Decode(parts[1]); err != nil {
+		return "", "", err
+	}
+	return to, from, nil
+}
+
+// mailboxValidator checks mailbox records in the DHT, for the records that
+// we store for other nodes as well as those that we fetch.
+type mailboxValidator struct{}
+
+// Validate implements record.Validator
+func (mailboxValidator) Validate(key string, value []byte) error {
+	_, from, err := parseMailboxKey(key)
+	if err != nil {
+		return err
+	}
+	if len(value) > MailboxMaxSize*2 {
+		return errors.New("mailbox record is too big")
+	}
+	var r mailboxRecord
+	if err = json.Unmarshal(value, &r); err != nil {
+		return err
+	}
+	if r.KeyID != "" && len(r.VerifyKey) != ed25519.PublicKeySize {
+		return errors.New("mailbox record has an invalid signing key")
+	}
+	pubKey, err := from.ExtractPublicKey()
+	if err != nil {
+		return err
+	}
+	signed, err := r.signedBytes(key)
+	if err != nil {
+		return err
+	}
+	if ok, err := pubKey.Verify(signed, r.Signature); err != nil || !ok {
+		return errors.New("mailbox record isn't signed by the sender")
+	}
+	return nil
+}
+
+// Select implements record.Validator, picking the latest record.
+func (mailboxValidator) Select(key string, values [][]byte) (int, error) {
+	best, bestSeq := -1, int64(-1)
+	for i, value := range values {
+		var r mailboxRecord
+		if json.Unmarshal(value, &r) == nil && r.Seq > bestSeq {
+			best, bestSeq = i, r.Seq
+		}
+	}
+	if best < 0 {
+		return 0, errors.New("no valid mailbox records")
+	}
+	return best, nil
+}
+
+// mailbox leaves transactions for nodes that can't be reached in the DHT,
+// where they can pick them up when they come back online, and picks up those
+// that other nodes left for us. Each record only holds the transactions from
+// one node to another, so a node that we share rooms with only has to look
+// up one record for each server that it shares rooms with.
+type mailbox struct {
+	host        host.Host
+	dht         *dht.IpfsDHT
+	keyDB       keydb.Database
+	memberships *RoomMemberships
+	// The signing key that our requests are signed with, which our records
+	// carry.
+	keyID     gomatrixserverlib.KeyID
+	verifyKey gomatrixserverlib.Base64String
+	// handler serves the federation API, for the transactions that we pick
+	// up. It is set once the components have been set up.
+	handler http.Handler
+
+	mu sync.Mutex
+	// pending holds the transactions that we have left for each node, which
+	// every new record for it must hold too.
+	pending map[peer.ID][]mailboxRequest
+	// collected holds the sequence number of the latest record that we have
+	// picked up from each node.
+	collected map[peer.ID]int64
+}
+
+func newMailbox(
+	p2pHost host.Host, p2pDHT *dht.IpfsDHT, keyDB keydb.Database, memberships *RoomMemberships, keys *SigningKeys,
+) *mailbox {
+	return &mailbox{
+		host:        p2pHost,
+		dht:         p2pDHT,
+		keyDB:       keyDB,
+		memberships: memberships,
+		keyID:       keys.KeyID,
+		verifyKey:   gomatrixserverlib.Base64String(keys.PrivateKey.Public().(ed25519.PublicKey)),
+		pending:     make(map[peer.ID][]mailboxRequest),
+		collected:   make(map[peer.ID]int64),
+	}
+}
+
+// start picks up transactions left for us, and republishes those that we
+// have left for others, until the context is done.
+func (m *mailbox) start(ctx context.Context) {
+	check := time.NewTicker(MailboxCheckInterval)
+	defer check.Stop()
+	republish := time.NewTicker(MailboxRepublishInterval)
+	defer republish.Stop()
+	// Give the DHT a moment to find some peers first.
+	first := time.After(DHTDiscoveryInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-first:
+			m.collectAll(ctx)
+		case <-check.C:
+			m.collectAll(ctx)
+		case <-republish.C:
+			m.republishAll(ctx)
+		}
+	}
+}
+
+// deposit leaves a transaction for a node that we can't reach.
+func (m *mailbox) deposit(ctx context.Context, to peer.ID, req mailboxRequest) error {
+	m.mu.Lock()
+	reqs := append(m.pending[to], req)
+	size := 0
+	for i := len(reqs) - 1; i >= 0; i-- {
+		if size += len(reqs[i].Body) + len(reqs[i].Authorization); size > MailboxMaxSize {
+			reqs = reqs[i+1:]
+			break
+		}
+	}
+	m.pending[to] = reqs
+	m.mu.Unlock()
+	return m.publish(ctx, to, reqs)
+}
+
+// delivered forgets the transactions that we left for a node, now that we
+// can reach it again, and empties its record so that it isn't left with
+// them forever.
+func (m *mailbox) delivered(to peer.ID) {
+	m.mu.Lock()
+	_, ok := m.pending[to]
+	delete(m.pending, to)
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), MailboxTimeout)
+		defer cancel()
+		if err := m.publish(ctx, to, nil); err != nil {
+			logrus.WithError(err).WithField("peer", to.String()).Debug("Failed to empty mailbox record")
+		}
+	}()
+}
+
+// publish puts the record of transactions for a node in the DHT.
+func (m *mailbox) publish(ctx context.Context, to peer.ID, reqs []mailboxRequest) error {
+	plaintext, err := json.Marshal(reqs)
+	if err != nil {
+		return err
+	}
+	toPubKey, err := to.ExtractPublicKey()
+	if err != nil {
+		return err
+	}
+	toRaw, err := toPubKey.Raw()
+	if err != nil {
+		return err
+	}
+	recipientKey, err := ed25519PublicToCurve25519(toRaw)
+	if err != nil {
+		return err
+	}
+	ephemeralPublic, ephemeralPrivate, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	var nonce [24]byte
+	if _, err = rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	r := mailboxRecord{
+		Seq:          time.Now().UnixNano(),
+		KeyID:        m.keyID,
+		VerifyKey:    m.verifyKey,
+		EphemeralKey: ephemeralPublic[:],
+		Nonce:        nonce[:],
+		Box:          box.Seal(nil, plaintext, &nonce, recipientKey, ephemeralPrivate),
+	}
+	key := mailboxKey(to, m.host.ID())
+	signed, err := r.signedBytes(key)
+	if err != nil {
+		return err
+	}
+	if r.Signature, err = m.host.Peerstore().PrivKey(m.host.ID()).Sign(signed); err != nil {
+		return err
+	}
+	value, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, MailboxTimeout)
+	defer cancel()
+	return m.dht.PutValue(ctx, key, value)
+}
+
+// republishAll puts the records that still hold transactions in the DHT
+// again.
+func (m *mailbox) republishAll(ctx context.Context) {
+	m.mu.Lock()
+	pending := make(map[peer.ID][]mailboxRequest, len(m.pending))
+	for to, reqs := range m.pending {
+		pending[to] = reqs
+	}
+	m.mu.Unlock()
+	for to, reqs := range pending {
+		if err := m.publish(ctx, to, reqs); err != nil {
+			logrus.WithError(err).WithField("peer", to.String()).Debug("Failed to republish mailbox record")
+		}
+	}
+}
+
+// collectAll picks up the transactions left for us by every node that we
+// share rooms with.
+func (m *mailbox) collectAll(ctx context.Context) {
+	for _, from := range m.memberships.Peers() {
+		if from == m.host.ID() {
+			continue
+		}
+		if err := m.collect(ctx, from); err != nil && err != context.Canceled {
+			logrus.WithError(err).WithField("peer", from.String()).Trace("No mailbox record picked up")
+		}
+	}
+}
+
+// collect picks up the transactions left for us by a node, if there are any
+// that we haven't picked up already, and passes them to the federation API
+// as if the node had sent them to us itself.
+func (m *mailbox) collect(ctx context.Context, from peer.ID) error {
+	getCtx, cancel := context.WithTimeout(ctx, MailboxTimeout)
+	defer cancel()
+	value, err := m.dht.GetValue(getCtx, mailboxKey(m.host.ID(), from))
+	if err != nil {
+		return err
+	}
+	var r mailboxRecord
+	if err = json.Unmarshal(value, &r); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	seen := r.Seq <= m.collected[from]
+	m.mu.Unlock()
+	if seen || m.handler == nil {
+		return nil
+	}
+
+	reqs, err := m.open(&r)
+	if err != nil {
+		return err
+	}
+	if err = storeMailboxKey(ctx, m.keyDB, from, &r); err != nil {
+		return err
+	}
+	if err = replayTransactions(ctx, m.handler, m.keyDB, from, reqs); err != nil {
+		return err
+	}
+	if len(reqs) > 0 {
+		logrus.WithFields(logrus.Fields{"peer": from.String(), "transactions": len(reqs)}).Info(
+			"Picked up transactions from the DHT mailbox",
+		)
+	}
+	m.mu.Lock()
+	if r.Seq > m.collected[from] {
+		m.collected[from] = r.Seq
+	}
+	m.mu.Unlock()
+	return nil
+}
+
+// replayTransactions passes transactions that a node sent while we were
+// offline to the federation API, as if the node had sent them to us itself.
+func replayTransactions(ctx context.Context, handler http.Handler, keyDB keydb.Database, from peer.ID, reqs []mailboxRequest) error {
+	// Nodes that still sign with the key in their peer ID say so in the
+	// requests, and we may not have stored it if we haven't connected to
+	// the node yet.
+	if err := storePeerKey(ctx, keyDB, from); err != nil {
+		return err
+	}
+	logger := logrus.WithField("peer", from.String())
+	for _, req := range reqs {
+		if !strings.HasPrefix(req.Path, SendFederationPathPrefix) {
+			continue
+		}
+		httpReq, err := http.NewRequest(http.MethodPut, req.Path, bytes.NewReader(req.Body))
+		if err != nil {
+			logger.WithError(err).Warn("Ignoring invalid transaction sent while we were offline")
+			continue
+		}
+		httpReq = httpReq.WithContext(ctx)
+		httpReq.RequestURI = req.Path
+		httpReq.Header.Set("Authorization", req.Authorization)
+		httpReq.Header.Set("Content-Type", "application/json")
+		httpReq.RemoteAddr = from.Pretty()
+		rec := &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+		handler.ServeHTTP(rec, httpReq)
+		if rec.code != http.StatusOK {
+			logger.WithField("code", rec.code).Warn("Transaction sent while we were offline was rejected")
+		}
+	}
+	return nil
+}
+
+// storeMailboxKey stores the signing key that a record carries as the key
+// of its sender, for the transactions in it to be checked against without
+// asking the sender, for MailboxKeyValidity unless we already know it to be
+// valid for longer. A key that the sender has since rotated out is left as
+// it is.
+func storeMailboxKey(ctx context.Context, keyDB keydb.Database, from peer.ID, r *mailboxRecord) error {
+	if r.KeyID == "" || r.KeyID == P2PKeyID {
+		return nil
+	}
+	req := gomatrixserverlib.PublicKeyLookupRequest{
+		ServerName: peerServerName(from),
+		KeyID:      r.KeyID,
+	}
+	now := time.Now()
+	stored, err := keyDB.FetchKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		req: gomatrixserverlib.AsTimestamp(now),
+	})
+	if err != nil {
+		return err
+	}
+	validUntil := gomatrixserverlib.AsTimestamp(now.Add(MailboxKeyValidity))
+	if res, ok := stored[req]; ok && (retiredKey(res) || res.ValidUntilTS >= validUntil) {
+		return nil
+	}
+	return keyDB.StoreKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		req: {
+			VerifyKey:    gomatrixserverlib.VerifyKey{Key: r.VerifyKey},
+			ValidUntilTS: validUntil,
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+		},
+	})
+}
+
+// open decrypts the requests in a record that was left for us.
+func (m *mailbox) open(r *mailboxRecord) ([]mailboxRequest, error) {
+	if len(r.EphemeralKey) != 32 || len(r.Nonce) != 24 {
+		return nil, errors.New("invalid mailbox record")
+	}
+	raw, err := m.host.Peerstore().PrivKey(m.host.ID()).Raw()
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := ed25519PrivateToCurve25519(raw)
+	if err != nil {
+		return nil, err
+	}
+	var ephemeralKey [32]byte
+	var nonce [24]byte
+	copy(ephemeralKey[:], r.EphemeralKey)
+	copy(nonce[:], r.Nonce)
+	plaintext, ok := box.Open(nil, r.Box, &nonce, &ephemeralKey, privateKey)
+	if !ok {
+		return nil, errors.New("mailbox record can't be decrypted")
+	}
+	var reqs []mailboxRequest
+	if err = json.Unmarshal(plaintext, &reqs); err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+// curve25519P is the prime that Curve25519 and Ed25519 are defined over.
+var curve25519P, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// ed25519PublicToCurve25519 converts an Ed25519 public key to the Curve25519
+// public key with the same private key, so that we can seal boxes to a node
+// knowing only its peer ID. The Montgomery u coordinate is (1+y)/(1-y).
+func ed25519PublicToCurve25519(pub []byte) (*[32]byte, error) {
+	if len(pub) != 32 {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+	// The key is little-endian, with the sign of x in the top bit.
+	le := make([]byte, 32)
+	copy(le, pub)
+	le[31] &= 0x7f
+	y := new(big.Int).SetBytes(reverse(le))
+	one := big.NewInt(1)
+	num := new(big.Int).Add(one, y)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, curve25519P)
+	if den.ModInverse(den, curve25519P) == nil {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+	u := num.Mul(num, den)
+	u.Mod(u, curve25519P)
+	var out [32]byte
+	b := u.Bytes()
+	copy(out[32-len(b):], b)
+	reversed := reverse(out[:])
+	copy(out[:], reversed)
+	return &out, nil
+}
+
+// ed25519PrivateToCurve25519 converts an Ed25519 private key, as the seed
+// followed by the public key, to the matching Curve25519 private key.
+func ed25519PrivateToCurve25519(priv []byte) (*[32]byte, error) {
+	if len(priv) != 64 {
+		return nil, errors.New("invalid ed25519 private key")
+	}
+	h := sha512.Sum512(priv[:32])
+	var out [32]byte
+	copy(out[:], h[:32])
+	out[0] &= 248
+	out[31] &= 127
+	out[31] |= 64
+	return &out, nil
+}
+
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+// mailboxTransport wraps the transport to other nodes so that transactions
+// for nodes that can't be reached are left with their postbox peers, or in
+// the DHT mailbox if they have none, or failing that queued to be retried,
+// and look to the federation sender as if they had been sent. Nodes that
+// are known to be offline aren't dialled at all.
+type mailboxTransport struct {
+	next     http.RoundTripper
+	postbox  *postbox
+	mailbox  *mailbox
+	queue    *outboundQueue
+	liveness *liveness
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *mailboxTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPut || !strings.HasPrefix(req.URL.Path, SendFederationPathPrefix) || req.Body == nil {
+		return t.next.RoundTrip(req)
+	}
+	to, err := peer.IDB58Decode(req.URL.Host)
+	if err != nil {
+		return t.next.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close() // nolint: errcheck
+	if err != nil {
+		return nil, err
+	}
+	mailed := mailboxRequest{Path: req.URL.RequestURI(), Authorization: req.Header.Get("Authorization"), Body: body}
+	// Transactions for a node that we are backing off from wait behind the
+	// ones that are already queued for it.
+	if t.queue.backingOff(req.Context(), to) {
+		if err = t.queue.push(req.Context(), to, mailed); err != nil {
+			return nil, err
+		}
+		return sentResponse(req), nil
+	}
+
+	// There's no point waiting for a dial to a node that we know is offline
+	// to time out.
+	err = errPeerOffline
+	if !t.liveness.offline(to) {
+		direct := req.Clone(req.Context())
+		direct.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var res *http.Response
+		if res, err = t.next.RoundTrip(direct); err == nil && res.StatusCode != http.StatusTooManyRequests {
+			t.mailbox.delivered(to)
+			return res, nil
+		}
+		if err == nil {
+			// The node is up, but we are sending to it too fast, so the
+			// transaction waits in the queue with backoff.
+			res.Body.Close() // nolint: errcheck
+			if err = t.queue.push(req.Context(), to, mailed); err != nil {
+				return nil, err
+			}
+			return sentResponse(req), nil
+		}
+	}
+	if leaveErr := t.leave(req.Context(), to, mailed, err); leaveErr != nil {
+		if queueErr := t.queue.push(req.Context(), to, mailed); queueErr != nil {
+			logrus.WithError(queueErr).WithField("peer", to.String()).Warn("Failed to queue transaction")
+			return nil, err
+		}
+		logrus.WithError(leaveErr).WithField("peer", to.String()).Info("Queued transaction for unreachable node")
+	}
+	return sentResponse(req), nil
+}
+
+// deliver sends a queued transaction to a node, or leaves it for the node if
+// it still can't be reached.
+func (t *mailboxTransport) deliver(ctx context.Context, to peer.ID, txn mailboxRequest) error {
+	req, err := http.NewRequest(http.MethodPut, "matrix://"+to.Pretty()+txn.Path, bytes.NewReader(txn.Body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", txn.Authorization)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return t.leave(ctx, to, txn, err)
+	}
+	res.Body.Close() // nolint: errcheck
+	if res.StatusCode == http.StatusTooManyRequests {
+		return errRateLimited
+	}
+	t.mailbox.delivered(to)
+	return nil
+}
+
+// leave leaves a transaction for a node that we couldn't send it to with its
+// postbox peers, or in the DHT mailbox if they won't take it.
+func (t *mailboxTransport) leave(ctx context.Context, to peer.ID, txn mailboxRequest, err error) error {
+	logger := logrus.WithError(err).WithField("peer", to.String())
+	holdErr := t.postbox.hold(ctx, to, txn)
+	if holdErr == nil {
+		return nil
+	}
+	logger = logger.WithField("postbox_error", holdErr.Error())
+	if mailErr := t.mailbox.deposit(ctx, to, txn); mailErr != nil {
+		logger.WithField("mailbox_error", mailErr.Error()).Debug("Failed to leave transaction for unreachable node")
+		return err
+	}
+	logger.Info("Left transaction for unreachable node in the DHT mailbox")
+	return nil
+}
+
+// sentResponse returns the response that the federation sender expects for a
+// transaction that it sent.
+func sentResponse(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(`{"pdus":{}}`)),
+		Request:    req,
+	}
+}
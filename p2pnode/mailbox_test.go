@@ -0,0 +1,200 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestEd25519ToCurve25519(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		curvePub, err := ed25519PublicToCurve25519(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		curvePriv, err := ed25519PrivateToCurve25519(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if curvePriv[0]&7 != 0 || curvePriv[31]&128 != 0 || curvePriv[31]&64 == 0 {
+			t.Fatalf("private key %x isn't clamped", curvePriv[:])
+		}
+		var derived [32]byte
+		curve25519.ScalarBaseMult(&derived, curvePriv)
+		if derived != *curvePub {
+			t.Fatalf("public key %x doesn't match private key, which has public key %x", curvePub[:], derived[:])
+		}
+
+		// A box sealed to the converted public key opens with the
+		// converted private key.
+		ephemeralPub, ephemeralPriv, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var nonce [24]byte
+		sealed := box.Seal(nil, []byte("hello"), &nonce, curvePub, ephemeralPriv)
+		opened, ok := box.Open(nil, sealed, &nonce, ephemeralPub, curvePriv)
+		if !ok || string(opened) != "hello" {
+			t.Fatalf("box didn't open, got %q", opened)
+		}
+	}
+}
+
+func TestEd25519ToCurve25519InvalidLength(t *testing.T) {
+	for _, size := range []int{0, 31, 33, 64} {
+		if _, err := ed25519PublicToCurve25519(make([]byte, size)); err == nil {
+			t.Errorf("public key of %d bytes was accepted", size)
+		}
+	}
+	for _, size := range []int{0, 32, 63, 65} {
+		if _, err := ed25519PrivateToCurve25519(make([]byte, size)); err == nil {
+			t.Errorf("private key of %d bytes was accepted", size)
+		}
+	}
+}
+
+// signedMailboxRecord returns a mailbox record from a new peer, and the key
+// that it is stored under.
+func signedMailboxRecord(t *testing.T, r mailboxRecord) (string, []byte) {
+	t.Helper()
+	priv, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := mailboxKey(from, from)
+	signed, err := r.signedBytes(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Signature, err = priv.Sign(signed); err != nil {
+		t.Fatal(err)
+	}
+	value, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, value
+}
+
+func TestMailboxValidatorValidate(t *testing.T) {
+	verifyKey := gomatrixserverlib.Base64String(make([]byte, ed25519.PublicKeySize))
+	tests := []struct {
+		name   string
+		record mailboxRecord
+		// tamper changes the key or the value after the record is signed.
+		tamper func(key string, value []byte) (string, []byte)
+		valid  bool
+	}{{
+		name:   "valid",
+		record: mailboxRecord{Seq: 1, Box: []byte("box")},
+		valid:  true,
+	}, {
+		name:   "valid with signing key",
+		record: mailboxRecord{Seq: 1, KeyID: "ed25519:abc", VerifyKey: verifyKey, Box: []byte("box")},
+		valid:  true,
+	}, {
+		name:   "invalid signing key",
+		record: mailboxRecord{Seq: 1, KeyID: "ed25519:abc", VerifyKey: verifyKey[:31], Box: []byte("box")},
+	}, {
+		name:   "tampered",
+		record: mailboxRecord{Seq: 1, Box: []byte("box")},
+		tamper: func(key string, value []byte) (string, []byte) {
+			return key, bytes.Replace(value, []byte(`"seq":1`), []byte(`"seq":2`), 1)
+		},
+	}, {
+		name:   "other sender",
+		record: mailboxRecord{Seq: 1, Box: []byte("box")},
+		tamper: func(key string, value []byte) (string, []byte) {
+			other, _ := signedMailboxRecord(t, mailboxRecord{})
+			return other, value
+		},
+	}, {
+		name:   "invalid key",
+		record: mailboxRecord{Seq: 1, Box: []byte("box")},
+		tamper: func(key string, value []byte) (string, []byte) {
+			return "/" + MailboxNamespace + "/nobody", value
+		},
+	}, {
+		name:   "too big",
+		record: mailboxRecord{Seq: 1, Box: []byte(strings.Repeat("x", MailboxMaxSize*2))},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, value := signedMailboxRecord(t, tt.record)
+			if tt.tamper != nil {
+				key, value = tt.tamper(key, value)
+			}
+			err := mailboxValidator{}.Validate(key, value)
+			if tt.valid && err != nil {
+				t.Errorf("valid record was rejected: %s", err)
+			} else if !tt.valid && err == nil {
+				t.Error("invalid record was accepted")
+			}
+		})
+	}
+}
+
+func TestMailboxValidatorSelect(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		best   int
+		ok     bool
+	}{
+		{"one", []string{`{"seq":3}`}, 0, true},
+		{"latest", []string{`{"seq":1}`, `{"seq":5}`, `{"seq":2}`}, 1, true},
+		{"first of equals", []string{`{"seq":4}`, `{"seq":4}`}, 0, true},
+		{"skips invalid", []string{`not json`, `{"seq":0}`}, 1, true},
+		{"none valid", []string{`not json`}, 0, false},
+		{"none", nil, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := make([][]byte, len(tt.values))
+			for i, v := range tt.values {
+				values[i] = []byte(v)
+			}
+			best, err := mailboxValidator{}.Select("", values)
+			if !tt.ok {
+				if err == nil {
+					t.Errorf("selected %d, wanted an error", best)
+				}
+				return
+			}
+			if err != nil || best != tt.best {
+				t.Errorf("selected %d, %v, wanted %d", best, err, tt.best)
+			}
+		})
+	}
+}
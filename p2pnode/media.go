@@ -0,0 +1,61 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/common/basecomponent"
+	"github.com/matrix-org/dendrite/mediaapi/routing"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// MediaV1DownloadPathPrefix is where other servers download our media from.
+// The media API only serves the r0 path, but gomatrixserverlib fetches
+// remote media from the v1 one.
+const MediaV1DownloadPathPrefix = "/_matrix/media/v1/download/"
+
+// mediaR0DownloadPathPrefix is where the media API serves downloads.
+const mediaR0DownloadPathPrefix = "/_matrix/media/r0/download/"
+
+// setupMediaAPI sets up the media API in the same way as the media API
+// component does, except that remote media is downloaded with the federation
+// client, so that media from other p2p nodes is fetched over libp2p rather
+// than over HTTPS after a DNS lookup that could never work. It returns the
+// media database, for the media exchange.
+func setupMediaAPI(
+	base *basecomponent.BaseDendrite, deviceDB *devices.Database, client *gomatrixserverlib.Client,
+) (storage.Database, error) {
+	mediaDB, err := storage.Open(string(base.Cfg.Database.MediaAPI))
+	if err != nil {
+		return nil, err
+	}
+	routing.Setup(base.APIMux, base.Cfg, mediaDB, deviceDB, client)
+	return mediaDB, nil
+}
+
+// mediaV1Handler serves downloads from the v1 path with the media API's r0
+// handler.
+func mediaV1Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r0 := req.Clone(req.Context())
+		r0.URL.Path = mediaR0DownloadPathPrefix + strings.TrimPrefix(req.URL.Path, MediaV1DownloadPathPrefix)
+		r0.URL.RawPath = ""
+		next.ServeHTTP(w, r0)
+	})
+}
@@ -0,0 +1,345 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// MediaEvictionInterval is how often the cached remote media is checked
+// against the limits, and when it was last downloaded is saved.
+const MediaEvictionInterval = time.Minute * 10
+
+// mediaEvictionBatch is how many of the least recently used files are
+// looked at at a time when evicting.
+const mediaEvictionBatch = 100
+
+const mediaCacheSchema = `
+-- When each piece of remote media was last downloaded from us, so that the
+-- least recently used can be evicted first. Media that has never been
+-- downloaded since it was fetched counts from when it was fetched.
+CREATE TABLE IF NOT EXISTS p2p_media_access (
+    media_origin TEXT NOT NULL,
+    media_id TEXT NOT NULL,
+    last_access_ts BIGINT NOT NULL,
+    PRIMARY KEY (media_origin, media_id)
+);
+`
+
+const upsertMediaAccessSQL = "" +
+	"INSERT INTO p2p_media_access (media_origin, media_id, last_access_ts) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (media_origin, media_id) DO UPDATE SET last_access_ts = GREATEST(p2p_media_access.last_access_ts, $3)"
+
+// Files are counted once however many media IDs they are stored under, and
+// are ours if any of those media IDs are.
+const selectMediaUsageSQL = "" +
+	"SELECT local, COUNT(*), COALESCE(SUM(size), 0) FROM (" +
+	"SELECT bool_or(media_origin = $1) AS local, MAX(file_size_bytes) AS size" +
+	" FROM mediaapi_media_repository GROUP BY base64hash) files GROUP BY local"
+
+const selectLeastRecentlyUsedMediaSQL = "" +
+	"SELECT m.base64hash, MAX(m.file_size_bytes), MAX(COALESCE(a.last_access_ts, m.creation_ts)) AS last_ts" +
+	" FROM mediaapi_media_repository m LEFT JOIN p2p_media_access a" +
+	" ON a.media_origin = m.media_origin AND a.media_id = m.media_id" +
+	" GROUP BY m.base64hash HAVING NOT bool_or(m.media_origin = $1)" +
+	" ORDER BY last_ts, m.base64hash LIMIT $2 OFFSET $3"
+
+const selectLocalMediaByHashSQL = "" +
+	"SELECT 1 FROM mediaapi_media_repository WHERE base64hash = $1 AND media_origin = $2 LIMIT 1"
+
+const deleteThumbnailsByHashSQL = "" +
+	"DELETE FROM mediaapi_thumbnail t USING mediaapi_media_repository m" +
+	" WHERE m.base64hash = $1 AND t.media_id = m.media_id AND t.media_origin = m.media_origin"
+
+const deleteMediaAccessByHashSQL = "" +
+	"DELETE FROM p2p_media_access a USING mediaapi_media_repository m" +
+	" WHERE m.base64hash = $1 AND a.media_id = m.media_id AND a.media_origin = m.media_origin"
+
+const deleteMediaByHashSQL = "" +
+	"DELETE FROM mediaapi_media_repository WHERE base64hash = $1"
+
+const deleteSharedMediaByHashSQL = "" +
+	"DELETE FROM p2p_media WHERE base64hash = $1"
+
+// mediaAccess identifies a piece of media whose last download is yet to be
+// saved.
+type mediaAccess struct {
+	origin  gomatrixserverlib.ServerName
+	mediaID types.MediaID
+}
+
+// mediaCache keeps the remote media that we have within a total size and
+// age, so that a node on a small disk doesn't fill it with every image that
+// was ever sent in its rooms. The least recently downloaded files are
+// deleted first, and are fetched again if they are asked for. Media that was
+// uploaded to us is never deleted, as there may be nowhere else to get it.
+type mediaCache struct {
+	db         *sql.DB
+	cfg        *config.Dendrite
+	serverName gomatrixserverlib.ServerName
+	// The most bytes of remote media to keep, and how long to keep remote
+	// media after it was last downloaded. Zero means no limit.
+	maxSize int64
+	maxAge  time.Duration
+
+	mu sync.Mutex
+	// When media was last downloaded, since it was last saved.
+	accessed map[mediaAccess]int64
+}
+
+func newMediaCache(cfg *config.Dendrite, maxSize int64, maxAge time.Duration) (*mediaCache, error) {
+	db, err := sql.Open("postgres", string(cfg.Database.MediaAPI))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(mediaCacheSchema); err != nil {
+		return nil, err
+	}
+	return &mediaCache{
+		db:         db,
+		cfg:        cfg,
+		serverName: cfg.Matrix.ServerName,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		accessed:   make(map[mediaAccess]int64),
+	}, nil
+}
+
+// wrap notes when remote media is downloaded, or thumbnailed, from the media
+// API. It is kept in memory until the next eviction, so that reading media
+// doesn't write to the disk every time.
+func (c *mediaCache) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origin, mediaID := mediaPathID(req.URL.Path)
+		if req.Method != http.MethodGet || mediaID == "" || origin == c.serverName {
+			next.ServeHTTP(w, req)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, req)
+		if rec.status == http.StatusOK {
+			c.mu.Lock()
+			c.accessed[mediaAccess{origin, mediaID}] = time.Now().UnixNano() / int64(time.Millisecond)
+			c.mu.Unlock()
+		}
+	})
+}
+
+// start saves when media was last downloaded and evicts remote media that
+// is over the limits every MediaEvictionInterval, until the context is done.
+func (c *mediaCache) start(ctx context.Context) {
+	ticker := time.NewTicker(MediaEvictionInterval)
+	defer ticker.Stop()
+	for {
+		if err := c.saveAccessed(ctx); err != nil {
+			logrus.WithError(err).Warn("Failed to save when media was last downloaded")
+		}
+		if err := c.evict(ctx); err != nil {
+			logrus.WithError(err).Warn("Failed to evict cached remote media")
+		}
+		if err := c.updateMetrics(ctx); err != nil {
+			logrus.WithError(err).Warn("Failed to measure media usage")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *mediaCache) saveAccessed(ctx context.Context) error {
+	c.mu.Lock()
+	accessed := c.accessed
+	c.accessed = make(map[mediaAccess]int64)
+	c.mu.Unlock()
+	for access, ts := range accessed {
+		if _, err := c.db.ExecContext(ctx, upsertMediaAccessSQL, string(access.origin), string(access.mediaID), ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usage returns how many files of remote media and of our own media we
+// have, and how big they are.
+func (c *mediaCache) usage(ctx context.Context) (localFiles, localBytes, remoteFiles, remoteBytes int64, err error) {
+	rows, err := c.db.QueryContext(ctx, selectMediaUsageSQL, string(c.serverName))
+	if err != nil {
+		return
+	}
+	defer rows.Close() // nolint: errcheck
+	for rows.Next() {
+		var local bool
+		var files, bytes int64
+		if err = rows.Scan(&local, &files, &bytes); err != nil {
+			return
+		}
+		if local {
+			localFiles, localBytes = files, bytes
+		} else {
+			remoteFiles, remoteBytes = files, bytes
+		}
+	}
+	err = rows.Err()
+	return
+}
+
+func (c *mediaCache) updateMetrics(ctx context.Context) error {
+	localFiles, localBytes, remoteFiles, remoteBytes, err := c.usage(ctx)
+	if err != nil {
+		return err
+	}
+	mediaCacheFiles.WithLabelValues("local").Set(float64(localFiles))
+	mediaCacheFiles.WithLabelValues("remote").Set(float64(remoteFiles))
+	mediaCacheBytes.WithLabelValues("local").Set(float64(localBytes))
+	mediaCacheBytes.WithLabelValues("remote").Set(float64(remoteBytes))
+	return nil
+}
+
+// evict deletes the least recently used files of remote media until the
+// rest are within the size limit and have all been used within the age
+// limit.
+func (c *mediaCache) evict(ctx context.Context) error {
+	if c.maxSize <= 0 && c.maxAge <= 0 {
+		return nil
+	}
+	_, _, _, remoteBytes, err := c.usage(ctx)
+	if err != nil {
+		return err
+	}
+	cutoff := int64(0)
+	if c.maxAge > 0 {
+		cutoff = time.Now().Add(-c.maxAge).UnixNano() / int64(time.Millisecond)
+	}
+	evicted, freed := 0, int64(0)
+	defer func() {
+		if evicted > 0 {
+			logrus.WithFields(logrus.Fields{"files": evicted, "bytes": freed}).Info("Evicted cached remote media")
+		}
+	}()
+	// Files that are skipped stay in the results, so the next batch starts
+	// after them.
+	for offset := 0; ; {
+		rows, err := c.db.QueryContext(
+			ctx, selectLeastRecentlyUsedMediaSQL, string(c.serverName), mediaEvictionBatch, offset,
+		)
+		if err != nil {
+			return err
+		}
+		type file struct {
+			hash         types.Base64Hash
+			size, lastTS int64
+		}
+		var files []file
+		for rows.Next() {
+			var f file
+			if err = rows.Scan(&f.hash, &f.size, &f.lastTS); err != nil {
+				rows.Close() // nolint: errcheck
+				return err
+			}
+			files = append(files, f)
+		}
+		rows.Close() // nolint: errcheck
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		for _, f := range files {
+			tooBig := c.maxSize > 0 && remoteBytes > c.maxSize
+			tooOld := c.maxAge > 0 && f.lastTS < cutoff
+			if !tooBig && !tooOld {
+				// The rest were all used more recently.
+				return nil
+			}
+			removed, err := c.remove(ctx, f.hash)
+			if err != nil {
+				return err
+			}
+			if !removed {
+				offset++
+				continue
+			}
+			remoteBytes -= f.size
+			evicted++
+			freed += f.size
+			mediaEvictions.Inc()
+		}
+		if len(files) < mediaEvictionBatch {
+			return nil
+		}
+	}
+}
+
+// remove deletes a file of remote media, its thumbnails, and every media ID
+// that it is stored under, returning false if it has become one of our own
+// media since it was picked.
+func (c *mediaCache) remove(ctx context.Context, hash types.Base64Hash) (removed bool, err error) {
+	path, err := fileutils.GetPathFromBase64Hash(hash, c.cfg.Media.AbsBasePath)
+	if err != nil {
+		return false, err
+	}
+	txn, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil || !removed {
+			txn.Rollback() // nolint: errcheck
+		}
+	}()
+	var one int
+	err = txn.QueryRowContext(ctx, selectLocalMediaByHashSQL, string(hash), string(c.serverName)).Scan(&one)
+	if err == nil {
+		return false, nil
+	} else if err != sql.ErrNoRows {
+		return false, err
+	}
+	if err = deleteMediaByHash(ctx, txn, hash); err != nil {
+		return false, err
+	}
+	if err = txn.Commit(); err != nil {
+		return false, err
+	}
+	// The thumbnails are in the same directory as the file.
+	if err = os.RemoveAll(filepath.Dir(path)); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// deleteMediaByHash deletes every media ID that a file is stored under,
+// along with their thumbnails, leaving the file itself to the caller.
+func deleteMediaByHash(ctx context.Context, txn *sql.Tx, hash types.Base64Hash) error {
+	for _, query := range []string{
+		deleteThumbnailsByHashSQL, deleteMediaAccessByHashSQL, deleteMediaByHashSQL, deleteSharedMediaByHashSQL,
+	} {
+		if _, err := txn.ExecContext(ctx, query, string(hash)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
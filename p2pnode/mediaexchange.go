@@ -0,0 +1,755 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/sirupsen/logrus"
+)
+
+// MediaExchangeProtocol is the libp2p protocol that nodes fetch media from
+// each other on, by the hash of its content. Each stream carries one JSON
+// request, and one JSON response that is followed by the media itself, or
+// that holds the record of one of the node's own media.
+const MediaExchangeProtocol = "/matrix/media"
+
+// MediaNamespace is the DHT namespace of the records that describe each
+// piece of media, at /matrix-media/<origin peer ID>/<media ID>. Records are
+// signed by the origin, but are republished by every node that has the
+// media, so that they outlive the origin being offline.
+const MediaNamespace = "matrix-media"
+
+// MediaProvideInterval is how often we announce in the DHT the media that
+// we have, and republish the records of it.
+const MediaProvideInterval = time.Hour * 12
+
+// MediaLookupTimeout is how long we look in the DHT for the record of a
+// piece of media, and then for the nodes that have it.
+const MediaLookupTimeout = time.Second * 10
+
+// MediaTransferTimeout is how long fetching media from one node may take.
+const MediaTransferTimeout = time.Minute * 2
+
+// MediaExchangePeers is the most nodes that are found in the DHT to fetch a
+// piece of media from, one after another.
+const MediaExchangePeers = 5
+
+// mediaExchangeMaxHeaderSize is the most that is read of a media exchange
+// request, or of the response before the media.
+const mediaExchangeMaxHeaderSize = 4096
+
+// Where the media API serves uploads, and the downloads and thumbnails of
+// media by server name and media ID.
+const (
+	mediaR0UploadPath          = "/_matrix/media/r0/upload"
+	mediaR0ThumbnailPathPrefix = "/_matrix/media/r0/thumbnail/"
+)
+
+const mediaExchangeSchema = `
+-- The media that we share with other nodes, with the origin's record of it.
+CREATE TABLE IF NOT EXISTS p2p_media (
+    media_origin TEXT NOT NULL,
+    media_id TEXT NOT NULL,
+    base64hash TEXT NOT NULL,
+    record TEXT NOT NULL,
+    PRIMARY KEY (media_origin, media_id)
+);
+
+CREATE INDEX IF NOT EXISTS p2p_media_hash_idx ON p2p_media (base64hash);
+`
+
+const upsertMediaSQL = "" +
+	"INSERT INTO p2p_media (media_origin, media_id, base64hash, record) VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (media_origin, media_id) DO UPDATE SET base64hash = $3, record = $4"
+
+const selectMediaByHashSQL = "" +
+	"SELECT 1 FROM p2p_media WHERE base64hash = $1 LIMIT 1"
+
+const selectMediaRecordSQL = "" +
+	"SELECT record FROM p2p_media WHERE media_origin = $1 AND media_id = $2"
+
+const selectAllMediaSQL = "" +
+	"SELECT media_origin, media_id, base64hash, record FROM p2p_media"
+
+// mediaRecord is the value of the record that describes a piece of media in
+// the DHT, signed by the identity key of the node that it was uploaded to.
+type mediaRecord struct {
+	Hash        types.Base64Hash `json:"hash"`
+	Size        int64            `json:"size"`
+	ContentType string           `json:"content_type"`
+	UploadName  string           `json:"upload_name,omitempty"`
+	Signature   []byte           `json:"signature,omitempty"`
+}
+
+// signedBytes returns what the signature of the record at the key covers.
+func (r *mediaRecord) signedBytes(key string) ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = nil
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(key+"\n"), data...), nil
+}
+
+// mediaKey returns the DHT key of the record that describes a piece of
+// media.
+func mediaKey(origin peer.ID, mediaID types.MediaID) string {
+	return "/" + MediaNamespace + "/" + origin.Pretty() + "/" + string(mediaID)
+}
+
+// mediaCid returns the content ID that the nodes which have media with the
+// hash provide in the DHT. It is the same as IPFS would give the media if it
+// were one raw block.
+func mediaCid(hash types.Base64Hash) (cid.Cid, error) {
+	sum, err := base64.RawURLEncoding.DecodeString(string(hash))
+	if err != nil {
+		return cid.Undef, err
+	}
+	if len(sum) != sha256.Size {
+		return cid.Undef, fmt.Errorf("invalid media hash %q", hash)
+	}
+	multihash, err := mh.Encode(sum, mh.SHA2_256)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.NewCidV1(cid.Raw, multihash), nil
+}
+
+// mediaValidator checks the records that describe media.
+type mediaValidator struct{}
+
+// Validate implements record.Validator
+func (mediaValidator) Validate(key string, value []byte) error {
+	parts := strings.SplitN(strings.TrimPrefix(key, "/"+MediaNamespace+"/"), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return errors.New("media record key has no media ID")
+	}
+	id, err := peer.IDB58Decode(parts[0])
+	if err != nil {
+		return err
+	}
+	var r mediaRecord
+	if err = json.Unmarshal(value, &r); err != nil {
+		return err
+	}
+	if _, err = mediaCid(r.Hash); err != nil {
+		return err
+	}
+	pubKey, err := id.ExtractPublicKey()
+	if err != nil {
+		return err
+	}
+	signed, err := r.signedBytes(key)
+	if err != nil {
+		return err
+	}
+	if ok, err := pubKey.Verify(signed, r.Signature); err != nil || !ok {
+		return errors.New("media record isn't signed by the origin")
+	}
+	return nil
+}
+
+// Select implements record.Validator. Media never changes, so every valid
+// record of it is as good as another.
+func (mediaValidator) Select(key string, values [][]byte) (int, error) {
+	if len(values) == 0 {
+		return 0, errors.New("no valid media records")
+	}
+	return 0, nil
+}
+
+// mediaExchangeRequest asks a node for the media with a hash, or for the
+// record of one of its own media by media ID.
+type mediaExchangeRequest struct {
+	Hash    types.Base64Hash `json:"hash,omitempty"`
+	MediaID types.MediaID    `json:"media_id,omitempty"`
+}
+
+// mediaExchangeResponse comes before the media itself. The error code is
+// empty if the media follows, or if the record is there.
+type mediaExchangeResponse struct {
+	jsonerror.MatrixError
+	Size   int64           `json:"size,omitempty"`
+	Record json.RawMessage `json:"record,omitempty"`
+}
+
+// mediaExchange shares media between nodes by the hash of its content, much
+// as Bitswap does for IPFS, though over a protocol of our own. Every node
+// that has a piece of media provides its hash in the DHT, so that when the
+// node it was uploaded to is offline, other nodes can fetch it from any that
+// has it, and popular media stays available. The DHT record of each piece
+// of media, signed by the origin, ties its media ID to its hash, so media
+// fetched from other nodes can be checked to be what the origin uploaded.
+//
+// Knowing the hash before fetching also means that media which is shared
+// again under another media ID, as images forwarded between rooms are, is
+// never fetched twice. The media API keeps files by hash, so the new media
+// ID is simply stored against the file that we already have.
+type mediaExchange struct {
+	db      *sql.DB
+	mediaDB storage.Database
+	host    host.Host
+	dht     *dht.IpfsDHT
+	cfg     *config.Dendrite
+	policy  *FederationPolicy
+	// thumbnails makes the thumbnails of the media that we store.
+	thumbnails *mediaThumbnails
+	// objects fetches files back from the object store, if there is one.
+	objects *mediaObjects
+	// ctx is for announcing media after the request that led to it is done.
+	// It is set by setup.
+	ctx context.Context
+
+	mu sync.Mutex
+	// The media being fetched from other nodes, by DHT key. The channel is
+	// closed once the fetch is done.
+	fetching map[string]chan struct{}
+}
+
+func newMediaExchange(
+	p2pHost host.Host, p2pDHT *dht.IpfsDHT, mediaDB storage.Database, cfg *config.Dendrite, policy *FederationPolicy,
+	thumbnails *mediaThumbnails, objects *mediaObjects,
+) (*mediaExchange, error) {
+	db, err := sql.Open("postgres", string(cfg.Database.MediaAPI))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(mediaExchangeSchema); err != nil {
+		return nil, err
+	}
+	return &mediaExchange{
+		db:         db,
+		mediaDB:    mediaDB,
+		host:       p2pHost,
+		dht:        p2pDHT,
+		cfg:        cfg,
+		policy:     policy,
+		thumbnails: thumbnails,
+		objects:    objects,
+		ctx:        context.Background(),
+		fetching:   make(map[string]chan struct{}),
+	}, nil
+}
+
+// setup handles the media exchange protocol, wraps the media API's uploads,
+// downloads and thumbnails, and announces the media that we have until the
+// context is done.
+func (e *mediaExchange) setup(ctx context.Context, mux *http.ServeMux, next http.Handler) {
+	e.ctx = ctx
+	e.host.SetStreamHandler(MediaExchangeProtocol, e.handleStream)
+	handler := e.wrap(next)
+	mux.Handle(mediaR0UploadPath, handler)
+	mux.Handle(mediaR0DownloadPathPrefix, handler)
+	mux.Handle(mediaR0ThumbnailPathPrefix, handler)
+	go e.provideAll(ctx)
+}
+
+// wrap announces the media uploaded to us, and looks for remote media that
+// we haven't got among the files that we have, and then, if the origin
+// isn't around to fetch it from, on other nodes. Either way, the media API
+// then serves the request.
+func (e *mediaExchange) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == mediaR0UploadPath {
+			rec := &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+			next.ServeHTTP(rec, req)
+			var res struct {
+				ContentURI string `json:"content_uri"`
+			}
+			if rec.code == http.StatusOK && json.Unmarshal(rec.body.Bytes(), &res) == nil {
+				parts := strings.SplitN(strings.TrimPrefix(res.ContentURI, "mxc://"), "/", 2)
+				if len(parts) == 2 && gomatrixserverlib.ServerName(parts[0]) == e.cfg.Matrix.ServerName {
+					go e.announce(e.cfg.Matrix.ServerName, types.MediaID(parts[1]))
+				}
+			}
+			rec.writeTo(w)
+			return
+		}
+
+		origin, mediaID := mediaPathID(req.URL.Path)
+		if req.Method != http.MethodGet || mediaID == "" || origin == e.cfg.Matrix.ServerName {
+			next.ServeHTTP(w, req)
+			return
+		}
+		logger := logrus.WithFields(logrus.Fields{"origin": origin, "media_id": mediaID})
+		metadata, err := e.mediaDB.GetMediaMetadata(req.Context(), mediaID, origin)
+		if err != nil || metadata != nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if id, err := serverNamePeer(origin); err == nil {
+			if err = e.fetch(req.Context(), id, mediaID); err != nil {
+				logger.WithError(err).Debug("Failed to fetch media without the media API")
+			}
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, req)
+		if rec.status == http.StatusOK {
+			// The media API either fetched the media from the origin, or
+			// served what we fetched, so we have it to share now.
+			go e.announce(origin, mediaID)
+		}
+	})
+}
+
+// mediaPathID returns the server name and media ID of a download or
+// thumbnail path, or an empty media ID for any other path.
+func mediaPathID(path string) (gomatrixserverlib.ServerName, types.MediaID) {
+	for _, prefix := range []string{mediaR0DownloadPathPrefix, mediaR0ThumbnailPathPrefix} {
+		if strings.HasPrefix(path, prefix) {
+			parts := strings.SplitN(strings.TrimPrefix(path, prefix), "/", 3)
+			if len(parts) >= 2 {
+				return gomatrixserverlib.ServerName(parts[0]), types.MediaID(parts[1])
+			}
+		}
+	}
+	return "", ""
+}
+
+// announce starts sharing a piece of media that we have. The record of our
+// own media is signed by us, while that of remote media comes from the
+// origin or the DHT, since only the origin can sign it.
+func (e *mediaExchange) announce(origin gomatrixserverlib.ServerName, mediaID types.MediaID) {
+	ctx, cancel := context.WithTimeout(e.ctx, MediaLookupTimeout*2)
+	defer cancel()
+	logger := logrus.WithFields(logrus.Fields{"origin": origin, "media_id": mediaID})
+	err := func() error {
+		id, err := serverNamePeer(origin)
+		if err != nil {
+			// Media from servers that aren't nodes can't be checked against
+			// a record, so it isn't shared.
+			return nil
+		}
+		metadata, err := e.mediaDB.GetMediaMetadata(ctx, mediaID, origin)
+		if err != nil || metadata == nil {
+			return err
+		}
+		key := mediaKey(id, mediaID)
+		var r *mediaRecord
+		if origin == e.cfg.Matrix.ServerName {
+			r = &mediaRecord{
+				Hash:        metadata.Base64Hash,
+				Size:        int64(metadata.FileSizeBytes),
+				ContentType: string(metadata.ContentType),
+				UploadName:  string(metadata.UploadName),
+			}
+			signed, err := r.signedBytes(key)
+			if err != nil {
+				return err
+			}
+			if r.Signature, err = e.host.Peerstore().PrivKey(e.host.ID()).Sign(signed); err != nil {
+				return err
+			}
+		} else if r, err = e.record(ctx, id, mediaID); err != nil {
+			return err
+		}
+		if r.Hash != metadata.Base64Hash {
+			return errors.New("the media doesn't match the origin's record of it")
+		}
+		value, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if _, err = e.db.ExecContext(ctx, upsertMediaSQL, string(origin), string(mediaID), string(r.Hash), string(value)); err != nil {
+			return err
+		}
+		return e.provide(ctx, key, value, r.Hash)
+	}()
+	if err != nil {
+		logger.WithError(err).Debug("Failed to announce media in the DHT")
+	}
+}
+
+// provide puts the record of a piece of media in the DHT, and announces
+// there that we have it.
+func (e *mediaExchange) provide(ctx context.Context, key string, value []byte, hash types.Base64Hash) error {
+	c, err := mediaCid(hash)
+	if err != nil {
+		return err
+	}
+	if err = e.dht.PutValue(ctx, key, value); err != nil {
+		return err
+	}
+	return e.dht.Provide(ctx, c, true)
+}
+
+// provideAll announces all of the media that we share every
+// MediaProvideInterval, until the context is done.
+func (e *mediaExchange) provideAll(ctx context.Context) {
+	ticker := time.NewTicker(MediaProvideInterval)
+	defer ticker.Stop()
+	// Give the DHT a moment to find some peers first.
+	first := time.After(DHTDiscoveryInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-first:
+		case <-ticker.C:
+		}
+		if err := e.provideShared(ctx); err != nil {
+			logrus.WithError(err).Warn("Failed to read shared media")
+		}
+	}
+}
+
+func (e *mediaExchange) provideShared(ctx context.Context) error {
+	rows, err := e.db.QueryContext(ctx, selectAllMediaSQL)
+	if err != nil {
+		return err
+	}
+	defer rows.Close() // nolint: errcheck
+	for rows.Next() {
+		var origin, mediaID, hash, value string
+		if err = rows.Scan(&origin, &mediaID, &hash, &value); err != nil {
+			return err
+		}
+		id, err := peer.IDB58Decode(origin)
+		if err != nil {
+			continue
+		}
+		provideCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		if err = e.provide(provideCtx, mediaKey(id, types.MediaID(mediaID)), []byte(value), types.Base64Hash(hash)); err != nil {
+			logrus.WithError(err).WithField("media_id", mediaID).Debug("Failed to announce media in the DHT")
+		}
+		cancel()
+	}
+	return rows.Err()
+}
+
+// record returns the origin's record of a piece of media. If we are
+// connected to the origin then it is asked for the record, which is quicker
+// than the DHT, and if it doesn't have one then neither does the DHT.
+func (e *mediaExchange) record(ctx context.Context, origin peer.ID, mediaID types.MediaID) (*mediaRecord, error) {
+	if e.host.Network().Connectedness(origin) != network.Connected {
+		return e.lookup(ctx, origin, mediaID)
+	}
+	ctx, cancel := context.WithTimeout(ctx, MediaLookupTimeout)
+	defer cancel()
+	s, err := e.host.NewStream(ctx, origin, MediaExchangeProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Reset() // nolint: errcheck
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+	if err = json.NewEncoder(s).Encode(&mediaExchangeRequest{MediaID: mediaID}); err != nil {
+		return nil, err
+	}
+	// Closing only closes our end, so that the peer knows that we're done.
+	if err = s.Close(); err != nil {
+		return nil, err
+	}
+	var res mediaExchangeResponse
+	if err = json.NewDecoder(io.LimitReader(s, mediaExchangeMaxHeaderSize)).Decode(&res); err != nil {
+		return nil, err
+	}
+	if res.ErrCode != "" {
+		return nil, &res.MatrixError
+	}
+	if err = (mediaValidator{}).Validate(mediaKey(origin, mediaID), res.Record); err != nil {
+		return nil, err
+	}
+	var r mediaRecord
+	if err = json.Unmarshal(res.Record, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// lookup returns the origin's record of a piece of media from the DHT.
+func (e *mediaExchange) lookup(ctx context.Context, origin peer.ID, mediaID types.MediaID) (*mediaRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, MediaLookupTimeout)
+	defer cancel()
+	value, err := e.dht.GetValue(ctx, mediaKey(origin, mediaID))
+	if err != nil {
+		return nil, err
+	}
+	var r mediaRecord
+	if err = json.Unmarshal(value, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// fetch stores a piece of remote media as though the media API had fetched
+// it from the origin, either against a file that we already have with the
+// same hash, or, if we aren't connected to the origin, by fetching it from
+// any node that has it, trying up to MediaExchangePeers of them. Requests
+// for media that is already being fetched wait for that instead.
+func (e *mediaExchange) fetch(ctx context.Context, origin peer.ID, mediaID types.MediaID) error {
+	key := mediaKey(origin, mediaID)
+	e.mu.Lock()
+	if done, ok := e.fetching[key]; ok {
+		e.mu.Unlock()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	done := make(chan struct{})
+	e.fetching[key] = done
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		delete(e.fetching, key)
+		e.mu.Unlock()
+		close(done)
+	}()
+
+	r, err := e.record(ctx, origin, mediaID)
+	if err != nil {
+		return err
+	}
+	server := peerServerName(origin)
+	if linked, err := e.link(ctx, server, mediaID, r); err != nil || linked {
+		return err
+	}
+	if e.host.Network().Connectedness(origin) == network.Connected {
+		// The media API will fetch it from the origin.
+		return nil
+	}
+	if r.Size > int64(*e.cfg.Media.MaxFileSizeBytes) {
+		return fmt.Errorf("the media is larger than the %d bytes allowed", *e.cfg.Media.MaxFileSizeBytes)
+	}
+	c, err := mediaCid(r.Hash)
+	if err != nil {
+		return err
+	}
+	findCtx, cancel := context.WithTimeout(ctx, MediaLookupTimeout)
+	defer cancel()
+	err = errors.New("no node has the media")
+	for info := range e.dht.FindProvidersAsync(findCtx, c, MediaExchangePeers) {
+		if info.ID == e.host.ID() || !e.policy.Allowed(peerServerName(info.ID)) {
+			continue
+		}
+		e.host.Peerstore().AddAddrs(info.ID, info.Addrs, time.Minute)
+		if err = e.fetchFrom(ctx, info.ID, server, mediaID, r); err == nil {
+			logrus.WithFields(logrus.Fields{
+				"origin":   origin.String(),
+				"media_id": mediaID,
+				"peer":     info.ID.String(),
+			}).Info("Fetched media from a node other than its origin")
+			return nil
+		}
+	}
+	return err
+}
+
+// link stores a piece of remote media against the file that we already have
+// with the same hash, if we have one, returning whether we do.
+func (e *mediaExchange) link(
+	ctx context.Context, origin gomatrixserverlib.ServerName, mediaID types.MediaID, r *mediaRecord,
+) (bool, error) {
+	path, err := fileutils.GetPathFromBase64Hash(r.Hash, e.cfg.Media.AbsBasePath)
+	if err != nil {
+		return false, err
+	}
+	if err = e.objects.restoreFile(ctx, path); err != nil {
+		return false, err
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != r.Size {
+		return false, nil
+	}
+	metadata := &types.MediaMetadata{
+		MediaID:           mediaID,
+		Origin:            origin,
+		ContentType:       types.ContentType(r.ContentType),
+		FileSizeBytes:     types.FileSizeBytes(r.Size),
+		CreationTimestamp: types.UnixMs(time.Now().UnixNano() / int64(time.Millisecond)),
+		UploadName:        types.Filename(r.UploadName),
+		Base64Hash:        r.Hash,
+	}
+	if err = e.mediaDB.StoreMediaMetadata(ctx, metadata); err != nil {
+		return false, err
+	}
+	e.thumbnails.generate(metadata)
+	logrus.WithFields(logrus.Fields{"origin": origin, "media_id": mediaID, "hash": r.Hash}).Info(
+		"Stored remote media against a file that we already have",
+	)
+	return true, nil
+}
+
+// fetchFrom fetches a piece of media from a node, checks that it matches
+// the origin's record of it, and stores it with the media API.
+func (e *mediaExchange) fetchFrom(
+	ctx context.Context, id peer.ID, origin gomatrixserverlib.ServerName, mediaID types.MediaID, r *mediaRecord,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, MediaTransferTimeout)
+	defer cancel()
+	s, err := e.host.NewStream(ctx, id, MediaExchangeProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Reset() // nolint: errcheck
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+	if err = json.NewEncoder(s).Encode(&mediaExchangeRequest{Hash: r.Hash}); err != nil {
+		return err
+	}
+	// Closing only closes our end, so that the peer knows that we're done.
+	if err = s.Close(); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(io.LimitReader(s, mediaExchangeMaxHeaderSize))
+	var res mediaExchangeResponse
+	if err = dec.Decode(&res); err != nil {
+		return err
+	}
+	if res.ErrCode != "" {
+		return &res.MatrixError
+	}
+	if res.Size != r.Size {
+		return errors.New("the node has media of the wrong size")
+	}
+
+	// The decoder may have read some of the media along with the response.
+	body := io.MultiReader(dec.Buffered(), io.LimitReader(s, r.Size))
+	logger := logrus.WithFields(logrus.Fields{"origin": origin, "media_id": mediaID, "peer": id.String()})
+	hash, size, tmpDir, err := fileutils.WriteTempFile(body, *e.cfg.Media.MaxFileSizeBytes, e.cfg.Media.AbsBasePath)
+	if err != nil {
+		fileutils.RemoveDir(tmpDir, logger)
+		return err
+	}
+	if hash != r.Hash || int64(size) != r.Size {
+		fileutils.RemoveDir(tmpDir, logger)
+		return errors.New("the node sent media that doesn't match the origin's record of it")
+	}
+	metadata := &types.MediaMetadata{
+		MediaID:           mediaID,
+		Origin:            origin,
+		ContentType:       types.ContentType(r.ContentType),
+		FileSizeBytes:     size,
+		CreationTimestamp: types.UnixMs(time.Now().UnixNano() / int64(time.Millisecond)),
+		UploadName:        types.Filename(r.UploadName),
+		Base64Hash:        hash,
+	}
+	if _, _, err = fileutils.MoveFileWithHashCheck(tmpDir, metadata, e.cfg.Media.AbsBasePath, logger); err != nil {
+		return err
+	}
+	if err = e.mediaDB.StoreMediaMetadata(ctx, metadata); err != nil {
+		return err
+	}
+	e.thumbnails.generate(metadata)
+	return nil
+}
+
+// handleStream sends a node the media with the hash that it asks for, if we
+// share any, or the record of one of our own media.
+func (e *mediaExchange) handleStream(s network.Stream) {
+	defer s.Close() // nolint: errcheck
+	_ = s.SetDeadline(time.Now().Add(MediaTransferTimeout))
+	from := s.Conn().RemotePeer()
+	logger := logrus.WithField("peer", from.String())
+	ctx, cancel := context.WithTimeout(context.Background(), MediaTransferTimeout)
+	defer cancel()
+
+	var res mediaExchangeResponse
+	var file *os.File
+	var req mediaExchangeRequest
+	if !e.policy.Allowed(peerServerName(from)) {
+		res.MatrixError = *jsonerror.Forbidden("This server doesn't federate with yours")
+	} else if err := json.NewDecoder(io.LimitReader(s, mediaExchangeMaxHeaderSize)).Decode(&req); err != nil {
+		res.MatrixError = *jsonerror.BadJSON(err.Error())
+	} else if req.MediaID != "" {
+		var record string
+		err = e.db.QueryRowContext(ctx, selectMediaRecordSQL, string(e.cfg.Matrix.ServerName), string(req.MediaID)).Scan(&record)
+		if err == sql.ErrNoRows {
+			res.MatrixError = *jsonerror.NotFound("We don't have that media")
+		} else if err != nil {
+			logger.WithError(err).Warn("Failed to read media record")
+			res.MatrixError = *jsonerror.Unknown("Internal server error")
+		} else {
+			res.Record = json.RawMessage(record)
+		}
+	} else if file, err = e.open(ctx, req.Hash); err != nil {
+		logger.WithError(err).Warn("Failed to open shared media")
+		res.MatrixError = *jsonerror.Unknown("Internal server error")
+	} else if file == nil {
+		res.MatrixError = *jsonerror.NotFound("We don't have that media")
+	} else {
+		defer file.Close() // nolint: errcheck
+		info, err := file.Stat()
+		if err != nil {
+			logger.WithError(err).Warn("Failed to open shared media")
+			res.MatrixError = *jsonerror.Unknown("Internal server error")
+		} else {
+			res.Size = info.Size()
+		}
+	}
+	if err := json.NewEncoder(s).Encode(&res); err != nil || file == nil || res.ErrCode != "" {
+		return
+	}
+	if _, err := io.Copy(s, file); err != nil {
+		logger.WithError(err).Debug("Failed to send media")
+	}
+}
+
+// open opens the file of the media with a hash, or returns nil if we don't
+// share any with that hash.
+func (e *mediaExchange) open(ctx context.Context, hash types.Base64Hash) (*os.File, error) {
+	if _, err := mediaCid(hash); err != nil {
+		return nil, nil
+	}
+	var one int
+	err := e.db.QueryRowContext(ctx, selectMediaByHashSQL, string(hash)).Scan(&one)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	path, err := fileutils.GetPathFromBase64Hash(hash, e.cfg.Media.AbsBasePath)
+	if err != nil {
+		return nil, err
+	}
+	if err = e.objects.restoreFile(ctx, path); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return file, err
+}
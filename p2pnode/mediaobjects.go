@@ -0,0 +1,363 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+)
+
+// MediaObjectSyncInterval is how often new media files are copied to the
+// object store, and the local copies of old ones are deleted.
+const MediaObjectSyncInterval = time.Minute
+
+// MediaObjectLocalTTL is how long the local copy of a file in the object
+// store is kept after it was last used.
+const MediaObjectLocalTTL = time.Minute * 10
+
+// mediaObjectSettleTime is how long a file has to be left alone before it
+// is copied to the object store, as thumbnails are written in place rather
+// than moved there once they are done.
+const mediaObjectSettleTime = time.Second * 30
+
+const mediaObjectsSchema = `
+-- The media files that are in the object store, by their path under the
+-- media directory, which is also their key in the bucket.
+CREATE TABLE IF NOT EXISTS p2p_media_objects (
+    object_key TEXT PRIMARY KEY,
+    base64hash TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS p2p_media_objects_hash ON p2p_media_objects (base64hash);
+`
+
+const insertMediaObjectSQL = "" +
+	"INSERT INTO p2p_media_objects (object_key, base64hash) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+
+const selectMediaObjectsSQL = "" +
+	"SELECT object_key FROM p2p_media_objects"
+
+// Objects are orphaned once every media ID of their file has been deleted,
+// e.g. by the media cache.
+const selectOrphanedMediaObjectsSQL = "" +
+	"SELECT object_key FROM p2p_media_objects o WHERE NOT EXISTS (" +
+	"SELECT 1 FROM mediaapi_media_repository m WHERE m.base64hash = o.base64hash)"
+
+const deleteMediaObjectSQL = "" +
+	"DELETE FROM p2p_media_objects WHERE object_key = $1"
+
+// mediaObjects keeps the media files in an S3-compatible object store
+// rather than on the local disk, so that a node on a cloud instance that
+// could go away at any time, along with its disk, doesn't lose them. The
+// media API still reads and writes files in the media directory, which
+// becomes a cache: new files are copied to the bucket once they are
+// written, local copies are deleted once they haven't been used for a
+// while, and files are fetched back before they are served.
+type mediaObjects struct {
+	db      *sql.DB
+	cfg     *config.Dendrite
+	mediaDB storage.Database
+	s3      *s3Client
+}
+
+func newMediaObjects(cfg *Config, mediaDB storage.Database) (*mediaObjects, error) {
+	transport := http.DefaultTransport
+	if cfg.TorSOCKSAddr != "" {
+		socks, err := proxy.SOCKS5("tcp", cfg.TorSOCKSAddr, nil, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		transport = &http.Transport{Dial: socks.Dial}
+	}
+	client, err := newS3Client(
+		cfg.MediaS3Endpoint, cfg.MediaS3Bucket, cfg.MediaS3Region,
+		cfg.MediaS3AccessKeyID, cfg.MediaS3SecretAccessKey, transport,
+	)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", string(cfg.Dendrite.Database.MediaAPI))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(mediaObjectsSchema); err != nil {
+		return nil, err
+	}
+	return &mediaObjects{
+		db:      db,
+		cfg:     &cfg.Dendrite,
+		mediaDB: mediaDB,
+		s3:      client,
+	}, nil
+}
+
+// wrap fetches the file and thumbnails of media from the object store
+// before the media API downloads or thumbnails it, if they aren't here.
+func (o *mediaObjects) wrap(next http.Handler) http.Handler {
+	if o == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origin, mediaID := mediaPathID(req.URL.Path)
+		if req.Method != http.MethodGet || mediaID == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		metadata, err := o.mediaDB.GetMediaMetadata(req.Context(), mediaID, origin)
+		if err == nil && metadata != nil {
+			err = o.restore(req.Context(), metadata)
+		}
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{"origin": origin, "media_id": mediaID}).Warn(
+				"Failed to fetch media from the object store",
+			)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// restore makes sure that the file of a piece of media and its thumbnails
+// are here.
+func (o *mediaObjects) restore(ctx context.Context, metadata *types.MediaMetadata) error {
+	if o == nil {
+		return nil
+	}
+	path, err := fileutils.GetPathFromBase64Hash(metadata.Base64Hash, o.cfg.Media.AbsBasePath)
+	if err != nil {
+		return err
+	}
+	if err = o.restoreFile(ctx, path); err != nil {
+		return err
+	}
+	thumbnails, err := o.mediaDB.GetThumbnails(ctx, metadata.MediaID, metadata.Origin)
+	if err != nil {
+		return err
+	}
+	for _, thumbnail := range thumbnails {
+		thumbPath := thumbnailer.GetThumbnailPath(types.Path(path), thumbnail.ThumbnailSize)
+		if err = o.restoreFile(ctx, string(thumbPath)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreFile fetches a file from the object store if it isn't here, or
+// marks it as used if it is. It isn't an error if it isn't in either.
+func (o *mediaObjects) restoreFile(ctx context.Context, path string) error {
+	if o == nil {
+		return nil
+	}
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	key, err := filepath.Rel(string(o.cfg.Media.AbsBasePath), path)
+	if err != nil {
+		return err
+	}
+	body, err := o.s3.get(ctx, filepath.ToSlash(key))
+	if err == errS3NotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer body.Close() // nolint: errcheck
+	if err = os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		return err
+	}
+	// The file is only moved into place once it has all been written, so
+	// that a half written file is never served. Names starting with a dot
+	// are never copied to the object store.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".restore-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // nolint: errcheck
+	if _, err = io.Copy(tmp, body); err != nil {
+		tmp.Close() // nolint: errcheck
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// start copies new files to the object store, deletes the local copies of
+// files that haven't been used lately, and deletes the objects of media
+// that has been deleted, every MediaObjectSyncInterval until the context
+// is done.
+func (o *mediaObjects) start(ctx context.Context) {
+	ticker := time.NewTicker(MediaObjectSyncInterval)
+	defer ticker.Stop()
+	for {
+		if err := o.sync(ctx); err != nil {
+			logrus.WithError(err).Warn("Failed to copy media to the object store")
+		}
+		if err := o.deleteOrphans(ctx); err != nil {
+			logrus.WithError(err).Warn("Failed to delete media from the object store")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *mediaObjects) sync(ctx context.Context) error {
+	stored, err := o.storedKeys(ctx)
+	if err != nil {
+		return err
+	}
+	base := string(o.cfg.Media.AbsBasePath)
+	now := time.Now()
+	uploaded, removed := 0, 0
+	defer func() {
+		if uploaded > 0 || removed > 0 {
+			logrus.WithFields(logrus.Fields{"uploaded": uploaded, "removed": removed}).Debug(
+				"Synced media with the object store",
+			)
+		}
+	}()
+	return filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// It was evicted while we were walking.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		key, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		key = filepath.ToSlash(key)
+		// Files are kept in <base>/<a>/<b>/<rest of hash>/, while uploads
+		// are written to <base>/tmp/ first.
+		parts := strings.Split(key, "/")
+		if info.IsDir() {
+			if key == "tmp" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if len(parts) != 4 || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		age := now.Sub(info.ModTime())
+		if !stored[key] {
+			if age < mediaObjectSettleTime {
+				return nil
+			}
+			if err = o.upload(ctx, path, key, types.Base64Hash(strings.Join(parts[:3], ""))); err != nil {
+				return err
+			}
+			uploaded++
+			return nil
+		}
+		if age > MediaObjectLocalTTL {
+			if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+}
+
+func (o *mediaObjects) storedKeys(ctx context.Context) (map[string]bool, error) {
+	rows, err := o.db.QueryContext(ctx, selectMediaObjectsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	stored := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		stored[key] = true
+	}
+	return stored, rows.Err()
+}
+
+func (o *mediaObjects) upload(ctx context.Context, path, key string, hash types.Base64Hash) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close() // nolint: errcheck
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err = o.s3.put(ctx, key, file, info.Size()); err != nil {
+		return err
+	}
+	_, err = o.db.ExecContext(ctx, insertMediaObjectSQL, key, string(hash))
+	return err
+}
+
+// deleteOrphans deletes the objects of the files that no media is stored
+// under any more.
+func (o *mediaObjects) deleteOrphans(ctx context.Context) error {
+	rows, err := o.db.QueryContext(ctx, selectOrphanedMediaObjectsSQL)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			rows.Close() // nolint: errcheck
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close() // nolint: errcheck
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err = o.s3.delete(ctx, key); err != nil {
+			return err
+		}
+		if _, err = o.db.ExecContext(ctx, deleteMediaObjectSQL, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,447 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+)
+
+// MediaScanTimeout is how long the content scanner may take to scan a file.
+const MediaScanTimeout = time.Minute
+
+// mediaScanMaxResponseSize is the most of a response from a content
+// scanner that is read.
+const mediaScanMaxResponseSize = 4096
+
+const mediaScanSchema = `
+-- What the content scanner made of each file of media, so that each one is
+-- only scanned once, and flagged files are refused straight away if they
+-- are uploaded or fetched again.
+CREATE TABLE IF NOT EXISTS p2p_media_scans (
+    base64hash TEXT PRIMARY KEY,
+    flagged BOOLEAN NOT NULL,
+    reason TEXT NOT NULL,
+    scanned_ts BIGINT NOT NULL
+);
+`
+
+const upsertMediaScanSQL = "" +
+	"INSERT INTO p2p_media_scans (base64hash, flagged, reason, scanned_ts) VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (base64hash) DO UPDATE SET flagged = $2, reason = $3, scanned_ts = $4"
+
+const selectMediaScanSQL = "" +
+	"SELECT flagged FROM p2p_media_scans WHERE base64hash = $1"
+
+// contentScanner scans a file for malware or anything else that shouldn't
+// be served, returning why if it should be refused.
+type contentScanner interface {
+	scan(ctx context.Context, content io.Reader, size int64, contentType string) (flagged bool, reason string, err error)
+}
+
+// newContentScanner returns a scanner for an icap:// URL of an ICAP
+// service, e.g. icap://127.0.0.1:1344/avscan for c-icap with ClamAV, or an
+// http:// or https:// URL to send files to as described on httpScanner.
+func newContentScanner(rawURL string, transport http.RoundTripper, dial proxy.Dialer) (contentScanner, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "icap":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "1344")
+		}
+		return &icapScanner{url: u, dial: dial}, nil
+	case "http", "https":
+		return &httpScanner{url: rawURL, client: &http.Client{Transport: transport, Timeout: MediaScanTimeout}}, nil
+	default:
+		return nil, fmt.Errorf("invalid content scanner URL %q: must be an icap, http or https URL", rawURL)
+	}
+}
+
+// mediaScanner sends media through a content scanner before it is served,
+// and refuses and deletes what is flagged, which matters on an open mesh
+// where media comes from anyone. Uploads are scanned before the media API
+// gets them. Remote media is scanned the first time that it is downloaded
+// or thumbnailed from us, whichever node it was fetched from, and so is
+// the media that we store ourselves, e.g. the images of URL previews.
+// Nothing is served if the scanner can't be reached.
+type mediaScanner struct {
+	db      *sql.DB
+	cfg     *config.Dendrite
+	mediaDB storage.Database
+	objects *mediaObjects
+	scanner contentScanner
+}
+
+func newMediaScanner(cfg *Config, mediaDB storage.Database, objects *mediaObjects) (*mediaScanner, error) {
+	transport := http.DefaultTransport
+	var dial proxy.Dialer = &net.Dialer{Timeout: MediaScanTimeout}
+	if cfg.TorSOCKSAddr != "" {
+		socks, err := proxy.SOCKS5("tcp", cfg.TorSOCKSAddr, nil, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		transport = &http.Transport{Dial: socks.Dial}
+		dial = socks
+	}
+	scanner, err := newContentScanner(cfg.MediaScannerURL, transport, dial)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", string(cfg.Dendrite.Database.MediaAPI))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(mediaScanSchema); err != nil {
+		return nil, err
+	}
+	return &mediaScanner{
+		db:      db,
+		cfg:     &cfg.Dendrite,
+		mediaDB: mediaDB,
+		objects: objects,
+		scanner: scanner,
+	}, nil
+}
+
+// wrap scans uploads before the media API stores them, and media before
+// the media API serves it.
+func (m *mediaScanner) wrap(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == mediaR0UploadPath && req.Method == http.MethodPost {
+			m.serveUpload(w, req, next)
+			return
+		}
+		origin, mediaID := mediaPathID(req.URL.Path)
+		if req.Method != http.MethodGet || mediaID == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		ctx := req.Context()
+		metadata, err := m.mediaDB.GetMediaMetadata(ctx, mediaID, origin)
+		if err != nil {
+			respondScanError(w, err)
+			return
+		}
+		var rec *bufferedResponse
+		if metadata == nil {
+			// The media API is yet to fetch it, so what it serves is kept
+			// until what it fetched has been scanned.
+			rec = &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+			next.ServeHTTP(rec, req)
+			if rec.code == http.StatusOK {
+				metadata, err = m.mediaDB.GetMediaMetadata(ctx, mediaID, origin)
+			}
+			if err != nil {
+				respondScanError(w, err)
+				return
+			}
+			if metadata == nil {
+				rec.writeTo(w)
+				return
+			}
+		}
+		flagged, err := m.check(ctx, metadata)
+		if err != nil {
+			respondScanError(w, err)
+			return
+		}
+		if flagged {
+			respondFlagged(w)
+			return
+		}
+		if rec != nil {
+			rec.writeTo(w)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// serveUpload writes an upload to a temporary file and scans it, before
+// passing it on to the media API if it is clean. Uploads that the media API
+// would refuse anyway are passed straight on.
+func (m *mediaScanner) serveUpload(w http.ResponseWriter, req *http.Request, next http.Handler) {
+	maxSize := *m.cfg.Media.MaxFileSizeBytes
+	if req.ContentLength <= 0 || (maxSize > 0 && req.ContentLength > int64(maxSize)) {
+		next.ServeHTTP(w, req)
+		return
+	}
+	ctx := req.Context()
+	logger := logrus.WithField("content_type", req.Header.Get("Content-Type"))
+	hash, size, tmpDir, err := fileutils.WriteTempFile(req.Body, maxSize, m.cfg.Media.AbsBasePath)
+	defer fileutils.RemoveDir(tmpDir, logger)
+	if err != nil {
+		respondScanError(w, err)
+		return
+	}
+	path := filepath.Join(string(tmpDir), "content")
+	flagged, err := m.verdict(ctx, hash)
+	if err == sql.ErrNoRows {
+		flagged, err = m.scanFile(ctx, hash, path, req.Header.Get("Content-Type"))
+	}
+	if err != nil {
+		respondScanError(w, err)
+		return
+	}
+	if flagged {
+		logger.WithField("hash", hash).Warn("Refused an upload that the content scanner flagged")
+		respondFlagged(w)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		respondScanError(w, err)
+		return
+	}
+	defer file.Close() // nolint: errcheck
+	req.Body = file
+	req.ContentLength = int64(size)
+	next.ServeHTTP(w, req)
+}
+
+// check returns whether a piece of media is flagged, scanning its file if
+// it hasn't been scanned yet. Flagged files are deleted.
+func (m *mediaScanner) check(ctx context.Context, metadata *types.MediaMetadata) (bool, error) {
+	flagged, err := m.verdict(ctx, metadata.Base64Hash)
+	if err != sql.ErrNoRows {
+		return flagged, err
+	}
+	path, err := fileutils.GetPathFromBase64Hash(metadata.Base64Hash, m.cfg.Media.AbsBasePath)
+	if err != nil {
+		return false, err
+	}
+	if err = m.objects.restoreFile(ctx, path); err != nil {
+		return false, err
+	}
+	if flagged, err = m.scanFile(ctx, metadata.Base64Hash, path, string(metadata.ContentType)); err != nil {
+		return false, err
+	}
+	if flagged {
+		logrus.WithFields(logrus.Fields{
+			"origin": metadata.Origin, "media_id": metadata.MediaID, "hash": metadata.Base64Hash,
+		}).Warn("Deleting media that the content scanner flagged")
+		if err = m.remove(ctx, metadata.Base64Hash, path); err != nil {
+			return true, err
+		}
+	}
+	return flagged, nil
+}
+
+// verdict returns whether a file was flagged when it was scanned, or
+// sql.ErrNoRows if it hasn't been.
+func (m *mediaScanner) verdict(ctx context.Context, hash types.Base64Hash) (flagged bool, err error) {
+	err = m.db.QueryRowContext(ctx, selectMediaScanSQL, string(hash)).Scan(&flagged)
+	return
+}
+
+// scanFile sends a file to the content scanner and saves what it made of it.
+func (m *mediaScanner) scanFile(ctx context.Context, hash types.Base64Hash, path, contentType string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close() // nolint: errcheck
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, MediaScanTimeout)
+	defer cancel()
+	flagged, reason, err := m.scanner.scan(ctx, file, info.Size(), contentType)
+	if err != nil {
+		mediaScans.WithLabelValues("error").Inc()
+		return false, err
+	}
+	if flagged {
+		mediaScans.WithLabelValues("flagged").Inc()
+		logrus.WithFields(logrus.Fields{"hash": hash, "reason": reason}).Info("Content scanner flagged media")
+	} else {
+		mediaScans.WithLabelValues("clean").Inc()
+	}
+	_, err = m.db.ExecContext(
+		ctx, upsertMediaScanSQL, string(hash), flagged, reason, time.Now().UnixNano()/int64(time.Millisecond),
+	)
+	return flagged, err
+}
+
+// remove deletes a flagged file, its thumbnails, and every media ID that it
+// is stored under. Its scan is kept so that it is refused if it comes back.
+func (m *mediaScanner) remove(ctx context.Context, hash types.Base64Hash, path string) error {
+	txn, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = deleteMediaByHash(ctx, txn, hash); err != nil {
+		txn.Rollback() // nolint: errcheck
+		return err
+	}
+	if err = txn.Commit(); err != nil {
+		return err
+	}
+	// The thumbnails are in the same directory as the file.
+	return os.RemoveAll(filepath.Dir(path))
+}
+
+func respondFlagged(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	_ = json.NewEncoder(w).Encode(jsonerror.Forbidden("The file was flagged by the content scanner"))
+}
+
+func respondScanError(w http.ResponseWriter, err error) {
+	logrus.WithError(err).Warn("Failed to scan media")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadGateway)
+	_ = json.NewEncoder(w).Encode(jsonerror.Unknown("Failed to scan the file"))
+}
+
+// httpScanner sends each file to a URL in the body of a POST, with its
+// content type. The scanner answers with a 200 and a JSON object, where
+// "clean" is whether the file can be served, and "info" is why if not.
+type httpScanner struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpScanner) scan(ctx context.Context, content io.Reader, size int64, contentType string) (bool, string, error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, content)
+	if err != nil {
+		return false, "", err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("content scanner returned %s", resp.Status)
+	}
+	var res struct {
+		Clean *bool  `json:"clean"`
+		Info  string `json:"info"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, mediaScanMaxResponseSize)).Decode(&res); err != nil {
+		return false, "", err
+	}
+	if res.Clean == nil {
+		return false, "", fmt.Errorf("content scanner didn't say whether the file is clean")
+	}
+	return !*res.Clean, res.Info, nil
+}
+
+// icapScanner sends each file to an ICAP service (RFC 3507) as the body of
+// an HTTP response to modify. We allow a 204 for files that the service
+// would leave as they are, so anything else that it answers with means
+// that it would have replaced the file, which is how virus scanners say
+// that it is infected.
+type icapScanner struct {
+	url  *url.URL
+	dial proxy.Dialer
+}
+
+func (s *icapScanner) scan(ctx context.Context, content io.Reader, size int64, contentType string) (bool, string, error) {
+	conn, err := s.dial.Dial("tcp", s.url.Host)
+	if err != nil {
+		return false, "", err
+	}
+	defer conn.Close() // nolint: errcheck
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	reqHeader := "GET /media HTTP/1.1\r\nHost: " + s.url.Hostname() + "\r\n\r\n"
+	resHeader := "HTTP/1.1 200 OK\r\nContent-Type: " + contentType +
+		"\r\nContent-Length: " + strconv.FormatInt(size, 10) + "\r\n\r\n"
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "RESPMOD %s ICAP/1.0\r\n", s.url.String())
+	fmt.Fprintf(w, "Host: %s\r\n", s.url.Host)
+	fmt.Fprintf(w, "Allow: 204\r\n")
+	fmt.Fprintf(w, "Encapsulated: req-hdr=0, res-hdr=%d, res-body=%d\r\n\r\n", len(reqHeader), len(reqHeader)+len(resHeader))
+	w.WriteString(reqHeader + resHeader) // nolint: errcheck
+	chunked := httputil.NewChunkedWriter(w)
+	if _, err = io.Copy(chunked, content); err != nil {
+		return false, "", err
+	}
+	if err = chunked.Close(); err != nil {
+		return false, "", err
+	}
+	// The last chunk is followed by an empty line, as there are no trailers.
+	w.WriteString("\r\n") // nolint: errcheck
+	if err = w.Flush(); err != nil {
+		return false, "", err
+	}
+
+	r := textproto.NewReader(bufio.NewReader(io.LimitReader(conn, mediaScanMaxResponseSize)))
+	status, err := r.ReadLine()
+	if err != nil {
+		return false, "", err
+	}
+	parts := strings.SplitN(status, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "ICAP/") {
+		return false, "", fmt.Errorf("invalid ICAP response %q", status)
+	}
+	header, err := r.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return false, "", err
+	}
+	switch parts[1] {
+	case "204":
+		return false, "", nil
+	case "200":
+		for _, name := range []string{"X-Infection-Found", "X-Virus-Id", "X-Violations-Found"} {
+			if reason := header.Get(name); reason != "" {
+				return true, reason, nil
+			}
+		}
+		return true, "the ICAP service would have modified the file", nil
+	default:
+		return false, "", fmt.Errorf("ICAP service returned %s", strings.Join(parts[1:], " "))
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "dendrite"
+	metricsSubsystem = "p2p"
+)
+
+// dialFailures counts the peers that we failed to connect to. Dials that
+// libp2p makes by itself, e.g. for the DHT, aren't included.
+var dialFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Subsystem: metricsSubsystem,
+	Name:      "dial_failures_total",
+	Help:      "Number of times that connecting to a peer that we found has failed.",
+})
+
+func init() {
+	prometheus.MustRegister(
+		dialFailures, federationTransactions, federationInFlight, federationLastSuccess,
+		mediaCacheBytes, mediaCacheFiles, mediaEvictions, mediaScans,
+	)
+}
+
+var (
+	protocolBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "protocol_bytes_total"),
+		"Bytes sent or received on libp2p streams, by protocol.",
+		[]string{"direction", "protocol"}, nil,
+	)
+	peerBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "peer_bytes_total"),
+		"Bytes sent to or received from each connected peer.",
+		[]string{"direction", "peer"}, nil,
+	)
+	streamsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "streams"),
+		"Number of open libp2p streams, by protocol.",
+		[]string{"protocol"}, nil,
+	)
+	connectionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "connections"),
+		"Number of open libp2p connections.",
+		nil, nil,
+	)
+)
+
+// libp2pCollector exports the bandwidth used by the host, and the streams
+// and connections that it has open, to Prometheus. The numbers are read from
+// the host whenever they are scraped.
+type libp2pCollector struct {
+	host      host.Host
+	bandwidth *metrics.BandwidthCounter
+}
+
+// Describe implements prometheus.Collector
+func (c *libp2pCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- protocolBytesDesc
+	ch <- peerBytesDesc
+	ch <- streamsDesc
+	ch <- connectionsDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *libp2pCollector) Collect(ch chan<- prometheus.Metric) {
+	for proto, stats := range c.bandwidth.GetBandwidthByProtocol() {
+		ch <- prometheus.MustNewConstMetric(protocolBytesDesc, prometheus.CounterValue, float64(stats.TotalIn), "in", string(proto))
+		ch <- prometheus.MustNewConstMetric(protocolBytesDesc, prometheus.CounterValue, float64(stats.TotalOut), "out", string(proto))
+	}
+
+	// Only peers that are still connected are reported, so that the number
+	// of series doesn't keep growing with every peer we have ever seen.
+	conns := c.host.Network().Conns()
+	connected := make(map[string]bool, len(conns))
+	streams := make(map[string]int)
+	for _, conn := range conns {
+		connected[conn.RemotePeer().Pretty()] = true
+		for _, stream := range conn.GetStreams() {
+			streams[string(stream.Protocol())]++
+		}
+	}
+	for id, stats := range c.bandwidth.GetBandwidthByPeer() {
+		if !connected[id.Pretty()] {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(peerBytesDesc, prometheus.CounterValue, float64(stats.TotalIn), "in", id.Pretty())
+		ch <- prometheus.MustNewConstMetric(peerBytesDesc, prometheus.CounterValue, float64(stats.TotalOut), "out", id.Pretty())
+	}
+	for proto, count := range streams {
+		ch <- prometheus.MustNewConstMetric(streamsDesc, prometheus.GaugeValue, float64(count), proto)
+	}
+	ch <- prometheus.MustNewConstMetric(connectionsDesc, prometheus.GaugeValue, float64(len(conns)))
+}
+
+var (
+	federationTransactions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "federation_transactions_total",
+		Help:      "Number of transactions sent to each destination, by whether they succeeded.",
+	}, []string{"destination", "result"})
+	federationInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "federation_transactions_in_flight",
+		Help:      "Number of transactions being sent to each destination.",
+	}, []string{"destination"})
+	federationLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "federation_last_success_timestamp_seconds",
+		Help:      "When a transaction was last sent to each destination successfully.",
+	}, []string{"destination"})
+)
+
+// federationSendPrefix is the path that transactions are sent to.
+const federationSendPrefix = "/_matrix/federation/v1/send/"
+
+// metricsTransport wraps the transport of the federation client, counting
+// the transactions sent to each destination. The federation sender doesn't
+// report anything about its queues itself. It only ever has one transaction
+// in flight for each destination, and everything queued for a destination
+// goes out in the next one, so this is as close as we can get.
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPut || !strings.HasPrefix(req.URL.Path, federationSendPrefix) {
+		return t.next.RoundTrip(req)
+	}
+	destination := req.URL.Host
+	inFlight := federationInFlight.WithLabelValues(destination)
+	inFlight.Inc()
+	defer inFlight.Dec()
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil || res.StatusCode >= 300 {
+		federationTransactions.WithLabelValues(destination, "failure").Inc()
+		return res, err
+	}
+	federationTransactions.WithLabelValues(destination, "success").Inc()
+	federationLastSuccess.WithLabelValues(destination).SetToCurrentTime()
+	return res, nil
+}
+
+var (
+	mediaCacheBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "media_bytes",
+		Help:      "Size of the media files that we have, not counting thumbnails, by whether they were uploaded to us or are cached remote media.",
+	}, []string{"origin"})
+	mediaCacheFiles = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "media_files",
+		Help:      "Number of media files that we have, by whether they were uploaded to us or are cached remote media.",
+	}, []string{"origin"})
+	mediaEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "media_evicted_files_total",
+		Help:      "Number of cached remote media files that have been deleted to keep within the media cache limits.",
+	})
+	mediaScans = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "media_scans_total",
+		Help:      "Number of media files sent to the content scanner, by whether they were clean, flagged, or couldn't be scanned.",
+	}, []string{"result"})
+)
@@ -0,0 +1,61 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"time"
+
+	autonat "github.com/libp2p/go-libp2p-autonat"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/sirupsen/logrus"
+)
+
+// ReachabilityInterval is how often we check whether autonat has changed its
+// mind about whether we are publicly reachable.
+const ReachabilityInterval = time.Second * 30
+
+// setupAutoNAT starts asking the peers that we are connected to whether they
+// can dial us back, and logs whenever the answer changes so that users can
+// see why other nodes can't reach them.
+func setupAutoNAT(ctx context.Context, p2pHost host.Host) autonat.AutoNAT {
+	nat := autonat.NewAutoNAT(ctx, p2pHost, nil)
+	go func() {
+		ticker := time.NewTicker(ReachabilityInterval)
+		defer ticker.Stop()
+		status := autonat.NATStatusUnknown
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if nat.Status() == status {
+				continue
+			}
+			status = nat.Status()
+			switch status {
+			case autonat.NATStatusPublic:
+				addr, _ := nat.PublicAddr()
+				logrus.WithField("addr", addr).Info("We are publicly reachable")
+			case autonat.NATStatusPrivate:
+				logrus.Warn("We are not publicly reachable, other nodes will only be able to reach us through a relay or on the local network")
+			default:
+				logrus.Info("Our public reachability is unknown")
+			}
+		}
+	}()
+	return nat
+}
@@ -0,0 +1,676 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package p2pnode runs a complete Dendrite monolith which federates with
+// other nodes over libp2p. It can be embedded in anything that is able to
+// serve an http.Handler, not just the dendrite-p2p-demo command.
+package p2pnode
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+	autonat "github.com/libp2p/go-libp2p-autonat"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/metrics"
+	gostream "github.com/libp2p/go-libp2p-gostream"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/matrix-org/dendrite/appservice"
+	"github.com/matrix-org/dendrite/clientapi"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/basecomponent"
+	"github.com/matrix-org/dendrite/common/keydb"
+	"github.com/matrix-org/dendrite/common/transactions"
+	"github.com/matrix-org/dendrite/federationapi"
+	"github.com/matrix-org/dendrite/federationsender"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/publicroomsapi"
+	"github.com/matrix-org/dendrite/roomserver"
+	"github.com/matrix-org/dendrite/syncapi"
+	"github.com/matrix-org/dendrite/typingserver"
+	"github.com/matrix-org/dendrite/typingserver/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// Node is a running Dendrite monolith and the libp2p host that it federates
+// over.
+type Node struct {
+	Base    *basecomponent.BaseDendrite
+	Host    host.Host
+	DHT     *dht.IpfsDHT
+	PubSub  *pubsub.PubSub
+	AutoNAT autonat.AutoNAT
+	KeyDB   keydb.Database
+	// Which users are joined to which rooms, used to find the peers that we
+	// share rooms with.
+	Memberships *RoomMemberships
+	// Which peers we are willing to talk to.
+	Gate *PeerGate
+	// Policy decides which servers we federate with.
+	Policy *FederationPolicy
+	// Chaos partitions us from peers and delays or drops streams, for
+	// testing.
+	Chaos *Chaos
+
+	ctx           context.Context
+	cancel        context.CancelFunc
+	signingKeys   *SigningKeys
+	adminToken    string
+	adminUsers    map[string]bool
+	accountDB     *accounts.Database
+	deviceDB      adminDevices
+	registration  *registrationPolicy
+	deactivation  *accountDeactivation
+	retention     *retention
+	roomDeletion  *roomDeletion
+	health        *healthChecker
+	transports    []string
+	collector     *libp2pCollector
+	registerer    prometheus.Registerer
+	gatherer      prometheus.Gatherer
+	conns         *connTracker
+	events        *eventFlow
+	webClientDir  string
+	bootstrap     *bootstrapPeers
+	clearnet      bool
+	publicBaseURL *url.URL
+	edus          *eduGossip
+	mailbox       *mailbox
+	refreshTokens *refreshTokens
+	postbox       *postbox
+	outbound      *outboundQueue
+	idle          *idleConns
+	liveness      *liveness
+	reputation    *reputation
+	limiter       *rateLimiter
+	acls          *serverACLs
+	// The connection pools that the node's features opened for themselves,
+	// which are closed along with the node.
+	databases []*sql.DB
+	// What the federation client sends requests with, which components run
+	// apart from the node send theirs through as well.
+	federationTransport http.RoundTripper
+	handler             http.Handler
+	libp2pHandler       http.Handler
+}
+
+// New starts the libp2p host and sets up every Dendrite component. As with
+// the Dendrite components themselves, failures to set up a component are
+// fatal and will panic.
+func New(cfg *Config) (*Node, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	bandwidth := metrics.NewBandwidthCounter()
+	p2pHost, p2pDHT, err := createLibP2PHost(ctx, cfg, bandwidth)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	p2pPubSub, err := createLibP2PPubSub(ctx, p2pHost)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	dendriteCfg := &cfg.Dendrite
+	dendriteCfg.Matrix.ServerName = peerServerName(p2pHost.ID())
+	dendriteCfg.Matrix.PrivateKey = cfg.SigningKeys.PrivateKey
+	dendriteCfg.Matrix.KeyID = cfg.SigningKeys.KeyID
+	// naffka only works within a process, so components run apart from the
+	// node need Kafka.
+	dendriteCfg.Kafka.UseNaffka = !splitComponents(dendriteCfg)
+	setDendriteDefaults(dendriteCfg)
+	if err = checkSplitComponents(dendriteCfg); err != nil {
+		cancel()
+		p2pHost.Close() // nolint: errcheck
+		return nil, err
+	}
+	if cfg.JaegerAgentAddr != "" {
+		setupJaeger(dendriteCfg, cfg.JaegerAgentAddr)
+	}
+	if err = dendriteCfg.Derive(); err != nil {
+		cancel()
+		p2pHost.Close() // nolint: errcheck
+		return nil, err
+	}
+	for _, as := range dendriteCfg.Derived.ApplicationServices {
+		logrus.WithFields(logrus.Fields{"id": as.ID, "url": as.URL, "sender": as.SenderLocalpart}).Info(
+			"Registered application service",
+		)
+	}
+
+	base := basecomponent.NewBaseDendrite(dendriteCfg, "Monolith")
+	if err = setupLogrus(cfg); err != nil {
+		base.Close() // nolint: errcheck
+		cancel()
+		p2pHost.Close() // nolint: errcheck
+		return nil, err
+	}
+
+	// The server name isn't "p2p" so the base component won't have created a
+	// libp2p host of its own. Give it ours, so that the federation client and
+	// public rooms API will use it.
+	base.LibP2P = p2pHost
+	base.LibP2PContext = ctx
+	base.LibP2PCancel = cancel
+	base.LibP2PDHT = p2pDHT
+	base.LibP2PPubsub = p2pPubSub
+
+	logrus.WithFields(logrus.Fields{
+		"peer_id": p2pHost.ID(),
+		"addrs":   p2pHost.Addrs(),
+	}).Info("Started libp2p host")
+
+	n := &Node{
+		Base:         base,
+		Host:         p2pHost,
+		DHT:          p2pDHT,
+		PubSub:       p2pPubSub,
+		Memberships:  newRoomMemberships(),
+		ctx:          ctx,
+		cancel:       cancel,
+		signingKeys:  &cfg.SigningKeys,
+		transports:   enabledTransports(cfg),
+		conns:        trackConns(p2pHost),
+		events:       &eventFlow{},
+		webClientDir: cfg.WebClientDir,
+		clearnet:     !cfg.DisableClearnetFederation && cfg.TorSOCKSAddr == "",
+	}
+	n.registerer, n.gatherer = prometheus.DefaultRegisterer, prometheus.DefaultGatherer
+	if cfg.Metrics != nil {
+		n.registerer, n.gatherer = cfg.Metrics, cfg.Metrics
+	}
+	collector := &libp2pCollector{host: p2pHost, bandwidth: bandwidth}
+	if err = n.registerer.Register(collector); err != nil {
+		n.Close() // nolint: errcheck
+		return nil, err
+	}
+	n.collector = collector
+	n.logVersion()
+	if cfg.PublicBaseURL != "" {
+		if n.publicBaseURL, err = parsePublicBaseURL(cfg.PublicBaseURL); err != nil {
+			n.Close() // nolint: errcheck
+			return nil, err
+		}
+	}
+	if n.Gate, err = loadPeerGate(filepath.Join(cfg.DataDir, PeerGateFileName)); err != nil {
+		n.Close() // nolint: errcheck
+		return nil, err
+	}
+	n.Gate.enforce(p2pHost)
+	n.Chaos = newChaos(p2pHost)
+	n.Policy, err = loadFederationPolicy(
+		filepath.Join(cfg.DataDir, FederationPolicyFileName), dendriteCfg.Matrix.ServerName,
+		federationPolicyFile{Allow: cfg.FederationAllow, Deny: cfg.FederationDeny},
+	)
+	if err != nil {
+		n.Close() // nolint: errcheck
+		return nil, err
+	}
+	protectSharedRoomPeers(p2pHost.ConnManager(), n.Memberships, p2pHost.ID())
+	n.reputation = newReputation(p2pHost)
+	go n.reputation.start(ctx)
+	n.limiter = newRateLimiter()
+	go n.limiter.start(ctx)
+	n.idle = newIdleConns(p2pHost, n.Memberships, cfg.FederationIdleTimeout)
+	go n.idle.start(ctx)
+	n.liveness = newLiveness(p2pHost, n.Memberships)
+	go n.liveness.start(ctx)
+	n.AutoNAT = setupAutoNAT(ctx, p2pHost)
+	if err = n.setupPeers(cfg); err != nil {
+		n.Close() // nolint: errcheck
+		return nil, err
+	}
+	adminTokenFile := filepath.Join(cfg.DataDir, AdminTokenFileName)
+	if n.adminToken, err = loadToken(adminTokenFile); err != nil {
+		n.Close() // nolint: errcheck
+		return nil, err
+	}
+	logrus.Info("The access token for the admin API is in ", adminTokenFile)
+	n.adminUsers = make(map[string]bool, len(cfg.AdminUsers))
+	for _, localpart := range cfg.AdminUsers {
+		n.adminUsers[strings.TrimPrefix(localpart, "@")] = true
+	}
+	if dendriteCfg.Matrix.RegistrationSharedSecret == "" {
+		secretFile := filepath.Join(cfg.DataDir, RegistrationSecretFileName)
+		if dendriteCfg.Matrix.RegistrationSharedSecret, err = loadToken(secretFile); err != nil {
+			n.Close() // nolint: errcheck
+			return nil, err
+		}
+		logrus.Info("The shared secret for registering accounts is in ", secretFile)
+	}
+	if n.health, err = newHealthChecker(cfg); err != nil {
+		n.Close() // nolint: errcheck
+		return nil, err
+	}
+	resolver := &resolverTransport{host: p2pHost, dht: p2pDHT, keyDB: n.KeyDB, gate: n.Gate, chaos: n.Chaos, idle: n.idle}
+	go newReconnector(p2pHost, n.Memberships, resolver, n.reputation).start(ctx)
+	n.postbox, err = newPostbox(
+		string(cfg.Dendrite.Database.SyncAPI), p2pHost, p2pDHT, n.KeyDB, resolver,
+		cfg.PostboxPeers, cfg.PostboxClients,
+	)
+	if err != nil {
+		n.Close() // nolint: errcheck
+		return nil, err
+	}
+	n.databases = append(n.databases, n.postbox.db)
+	if n.outbound, err = newOutboundQueue(string(cfg.Dendrite.Database.FederationSender)); err != nil {
+		n.Close() // nolint: errcheck
+		return nil, err
+	}
+	n.databases = append(n.databases, n.outbound.db)
+	if err = n.setupComponents(cfg); err != nil {
+		n.Close() // nolint: errcheck
+		return nil, err
+	}
+	return n, nil
+}
+
+// setupPeers creates the key database and starts all of the ways that we
+// find and connect to other nodes.
+func (n *Node) setupPeers(cfg *Config) error {
+	// We create the key database ourselves rather than using the base
+	// component, so that we are in control of how peers are discovered.
+	keyDB, err := keydb.NewDatabase(
+		string(cfg.Dendrite.Database.ServerKey), cfg.Dendrite.Matrix.ServerName,
+		cfg.SigningKeys.PrivateKey.Public().(ed25519.PublicKey), cfg.Dendrite.Matrix.KeyID,
+	)
+	if err != nil {
+		return err
+	}
+	// The keys of peers are taken from their peer IDs, and the rest are
+	// cached in memory on the way in and out of the database.
+	n.KeyDB = peerIDKeys{newKeyCache(keyDB)}
+	if err = storeOldVerifyKeys(n.ctx, n.KeyDB, cfg.Dendrite.Matrix.ServerName, &cfg.SigningKeys); err != nil {
+		return err
+	}
+
+	// mDNS would tell everyone on the local network that we are here.
+	if cfg.TorSOCKSAddr == "" {
+		if err = setupMDNS(n.ctx, n.Host, keyDB); err != nil {
+			return err
+		}
+	}
+	if err = setupDHTDiscovery(n.ctx, n.Host, n.DHT, keyDB, cfg.PSKFile != ""); err != nil {
+		return err
+	}
+	bootstrapFile := filepath.Join(cfg.DataDir, BootstrapPeersFileName)
+	if n.bootstrap, err = setupBootstrapPeers(n.ctx, n.Host, keyDB, cfg.BootstrapPeers, bootstrapFile); err != nil {
+		return err
+	}
+	return setupPeerStore(n.ctx, n.Host, keyDB, filepath.Join(cfg.DataDir, PeerStoreFileName))
+}
+
+// setupComponents wires up the Dendrite components as a monolith.
+func (n *Node) setupComponents(cfg *Config) error {
+	base := n.Base
+	accountDB := base.CreateAccountsDB()
+	deviceDB := base.CreateDeviceDB()
+	n.accountDB, n.deviceDB = accountDB, deviceDB
+	n.mailbox = newMailbox(n.Host, n.DHT, n.KeyDB, n.Memberships, &cfg.SigningKeys)
+	n.acls = newServerACLs()
+	federation := n.createFederationClient()
+	keyRing := keydb.CreateKeyRing(federation.Client, n.KeyDB)
+	go newKeyPrefetcher(&federation.Client, n.KeyDB, n.Memberships, base.Cfg.Matrix.ServerName).start(n.ctx)
+
+	alias, input, query := roomserver.SetupRoomServerComponent(base)
+	n.acls.query = query
+	typingInputAPI := typingserver.SetupTypingServerComponent(base, cache.NewTypingCache())
+	if err := n.setupAppServicePeers(base.Cfg.Derived.ApplicationServices); err != nil {
+		return err
+	}
+	asQuery := appservice.SetupAppServiceAPIComponent(
+		base, accountDB, deviceDB, federation, alias, query, transactions.New(),
+	)
+	// Typing notifications are gossiped by n.edus rather than sent to every
+	// server in the room by the federation sender, so it is given a topic
+	// that nothing is written to instead of the typing server's.
+	typingTopic := base.Cfg.Kafka.Topics.OutputTypingEvent
+	base.Cfg.Kafka.Topics.OutputTypingEvent = unusedTypingTopic
+	fedSenderAPI := federationsender.SetupFederationSenderComponent(base, federation, query)
+	base.Cfg.Kafka.Topics.OutputTypingEvent = typingTopic
+
+	clientapi.SetupClientAPIComponent(
+		base, deviceDB, accountDB,
+		federation, &keyRing, alias, input, query,
+		typingInputAPI, asQuery, transactions.New(), fedSenderAPI,
+	)
+	federationapi.SetupFederationAPIComponent(base, accountDB, deviceDB, federation, &keyRing, alias, input, query, asQuery, fedSenderAPI)
+	var mediaDB storage.Database
+	var err error
+	if base.Cfg.Listen.MediaAPI != "" {
+		mediaDB, err = storage.Open(string(base.Cfg.Database.MediaAPI))
+	} else {
+		mediaDB, err = setupMediaAPI(base, deviceDB, &federation.Client)
+	}
+	if err != nil {
+		return err
+	}
+	publicroomsapi.SetupPublicRoomsAPIComponent(base, deviceDB, query)
+	if base.Cfg.Listen.SyncAPI == "" {
+		syncapi.SetupSyncAPIComponent(base, deviceDB, accountDB, query, federation, base.Cfg)
+	}
+	if splitComponents(base.Cfg) {
+		if err = n.setupSplitComponents(); err != nil {
+			return err
+		}
+	}
+
+	// Set up the API endpoints we handle. The admin API is only for HTTP
+	// clients, so it isn't served to other nodes over libp2p, and neither
+	// are the metrics, which count requests and bandwidth by peer, the
+	// health checks, version, dashboard or topology.
+	libp2pMux := http.NewServeMux()
+	n.setupKeyAPI(libp2pMux)
+	if n.registration, err = newRegistrationPolicy(string(base.Cfg.Database.Account), cfg.Registration); err != nil {
+		return err
+	}
+	n.databases = append(n.databases, n.registration.db)
+	refreshTokens, err := newRefreshTokens(string(base.Cfg.Database.Device), cfg.AccessTokenLifetime)
+	if err != nil {
+		return err
+	}
+	n.databases = append(n.databases, refreshTokens.db)
+	n.refreshTokens = refreshTokens
+	refreshTokens.setup(libp2pMux)
+	go refreshTokens.start(n.ctx)
+	n.registration.setup(libp2pMux, refreshTokens.wrapLogin(base.APIMux))
+	var oidc *oidcLogin
+	if cfg.OIDCIssuer != "" {
+		if oidc, err = newOIDCLogin(cfg, accountDB, deviceDB, n.baseURL); err != nil {
+			return err
+		}
+		n.databases = append(n.databases, oidc.db)
+		oidc.setup(libp2pMux)
+	}
+	libp2pMux.Handle(LoginClientPath, common.WrapHandlerInCORS(refreshTokens.wrapLogin(oidc.wrapLogin(base.APIMux))))
+	var mediaObjects *mediaObjects
+	if cfg.MediaS3Bucket != "" {
+		if mediaObjects, err = newMediaObjects(cfg, mediaDB); err != nil {
+			return err
+		}
+		n.databases = append(n.databases, mediaObjects.db)
+		go mediaObjects.start(n.ctx)
+	}
+	var mediaScanner *mediaScanner
+	if cfg.MediaScannerURL != "" {
+		if mediaScanner, err = newMediaScanner(cfg, mediaDB, mediaObjects); err != nil {
+			return err
+		}
+		n.databases = append(n.databases, mediaScanner.db)
+	}
+	thumbnails := newMediaThumbnails(base.Cfg, mediaDB, mediaObjects)
+	mediaExchange, err := newMediaExchange(n.Host, n.DHT, mediaDB, base.Cfg, n.Policy, thumbnails, mediaObjects)
+	if err != nil {
+		return err
+	}
+	n.databases = append(n.databases, mediaExchange.db)
+	mediaCache, err := newMediaCache(base.Cfg, int64(cfg.MediaCacheMaxSizeMB)<<20, cfg.MediaCacheMaxAge)
+	if err != nil {
+		return err
+	}
+	n.databases = append(n.databases, mediaCache.db)
+	mediaExchange.setup(n.ctx, libp2pMux, mediaCache.wrap(common.WrapHandlerInCORS(
+		mediaScanner.wrap(mediaObjects.wrap(base.APIMux)),
+	)))
+	go mediaCache.start(n.ctx)
+	if n.retention, err = newRetention(base.Cfg, cfg.MaxRetention, cfg.MinRetention); err != nil {
+		return err
+	}
+	go n.retention.start(n.ctx)
+	publicRooms, err := newPublicRoomsFanout(n.Host, federation, base.Cfg)
+	if err != nil {
+		return err
+	}
+	publicRooms.setup(libp2pMux, base.APIMux, base.Cfg.Matrix.ServerName, keyRing)
+	userDirectory, err := newUserDirectory(n.Host, n.DHT, federation, base.Cfg)
+	if err != nil {
+		return err
+	}
+	n.databases = append(n.databases, userDirectory.db)
+	authData := auth.Data{AccountDB: accountDB, DeviceDB: deviceDB, AppServices: base.Cfg.Derived.ApplicationServices}
+	userDirectory.setup(n.ctx, libp2pMux, authData, keyRing)
+	threePIDs, err := newThreePIDs(cfg, accountDB, deviceDB, authData, n.baseURL)
+	if err != nil {
+		return err
+	}
+	n.databases = append(n.databases, threePIDs.db)
+	threePIDs.setup(libp2pMux)
+	if n.deactivation, err = newAccountDeactivation(base.Cfg, accountDB, deviceDB, authData, query, input, n.Memberships); err != nil {
+		return err
+	}
+	d := n.deactivation
+	n.databases = append(n.databases, d.db, d.syncDB, d.roomserverDB, d.mediaDB)
+	n.deactivation.setup(libp2pMux)
+	if n.roomDeletion, err = newRoomDeletion(base.Cfg, n.Memberships, n.deactivation); err != nil {
+		return err
+	}
+	rd := n.roomDeletion
+	n.databases = append(n.databases, rd.syncDB, rd.roomserverDB, rd.publicRoomsDB)
+	synapseJoins, err := newSynapseJoins(base.Cfg, federation, keyRing, query, alias, input, accountDB, n.Memberships)
+	if err != nil {
+		return err
+	}
+	n.databases = append(n.databases, synapseJoins.db)
+	go synapseJoins.start(n.ctx)
+	presence := newPresenceTracker(base.Cfg.Matrix.ServerName, n.Memberships, authData)
+	presence.setup(libp2pMux)
+	receipts, err := newReceipts(string(base.Cfg.Database.SyncAPI), n.Memberships, authData)
+	if err != nil {
+		return err
+	}
+	n.databases = append(n.databases, receipts.db)
+	upgrades, err := newRoomUpgrades(base.Cfg, publicRooms.db, authData, query, alias, input)
+	if err != nil {
+		return err
+	}
+	n.databases = append(n.databases, upgrades.syncDB)
+	upgrades.setup(libp2pMux, base.APIMux)
+	spaces, err := newSpaces(base.Cfg, federation, n.Memberships, authData)
+	if err != nil {
+		return err
+	}
+	n.databases = append(n.databases, spaces.db)
+	spaces.setup(libp2pMux, keyRing, n.acls)
+	publicRooms.spaces = spaces
+	publicRooms.gossip = newRoomDirectoryGossip(n.PubSub, n.Host.ID(), publicRooms, n.Policy, n.reputation)
+	if err = publicRooms.gossip.start(n.ctx); err != nil {
+		return err
+	}
+	libp2pMux.Handle(RoomsClientPathPrefix, common.WrapHandlerInCORS(receipts.wrapRooms(upgrades.wrapRooms(base.APIMux))))
+	resolver := &resolverTransport{host: n.Host, dht: n.DHT, keyDB: n.KeyDB, gate: n.Gate, chaos: n.Chaos, idle: n.idle}
+	urlPreviews, err := newURLPreviews(cfg, n.Host, resolver, mediaDB, thumbnails)
+	if err != nil {
+		return err
+	}
+	urlPreviews.setup(libp2pMux, authData)
+	toDevice, err := newToDevice(
+		string(base.Cfg.Database.SyncAPI), n.Host, resolver, federation, deviceDB,
+		authData, base.Cfg.Matrix.ServerName,
+	)
+	if err != nil {
+		return err
+	}
+	n.databases = append(n.databases, toDevice.db)
+	toDevice.setup(libp2pMux)
+	e2eKeys, err := newE2EKeys(string(base.Cfg.Database.SyncAPI), base.Cfg, federation, deviceDB, accountDB, authData, n.Memberships)
+	if err != nil {
+		return err
+	}
+	n.databases = append(n.databases, e2eKeys.db)
+	e2eKeys.setup(n.ctx, libp2pMux, keyRing)
+	roomKeys, err := newRoomKeys(string(base.Cfg.Database.SyncAPI), authData)
+	if err != nil {
+		return err
+	}
+	n.databases = append(n.databases, roomKeys.db)
+	roomKeys.setup(libp2pMux)
+	pushers, err := newPushers(
+		string(base.Cfg.Database.SyncAPI), n.Host, resolver, authData, n.Memberships, base.Cfg.Matrix.ServerName,
+	)
+	if err != nil {
+		return err
+	}
+	n.databases = append(n.databases, pushers.db)
+	pushers.setup(libp2pMux)
+	newFederationSend(base.Cfg.Matrix.ServerName, query, input, keyRing, federation, n.acls).setup(libp2pMux)
+	libp2pMux.Handle(MediaV1DownloadPathPrefix, common.WrapHandlerInCORS(mediaV1Handler(
+		mediaScanner.wrap(mediaObjects.wrap(base.APIMux)),
+	)))
+	libp2pMux.Handle("/_matrix/federation/", common.WrapHandlerInCORS(n.acls.wrap(base.APIMux)))
+	libp2pMux.Handle(SyncClientPath, common.WrapHandlerInCORS(
+		presence.wrapSync(receipts.wrapSync(e2eKeys.wrapSync(toDevice.wrapSync(spaces.wrapSync(base.APIMux))))),
+	))
+	libp2pMux.Handle("/", common.WrapHandlerInCORS(base.APIMux))
+	federated := n.Policy.wrap(refreshTokens.wrap(libp2pMux))
+	n.libp2pHandler = tracingHandler(n.reputation.wrap(n.limiter.wrap(federated)))
+	// Transactions that were left for us while we were offline arrive all at
+	// once, so they aren't rate limited or counted against the sender.
+	replayHandler := tracingHandler(federated)
+	n.mailbox.handler = replayHandler
+	go n.mailbox.start(n.ctx)
+	n.postbox.handler = replayHandler
+	go n.postbox.start(n.ctx)
+	go n.outbound.start(n.ctx)
+
+	adminRouter := mux.NewRouter()
+	n.setupAdminAPI(adminRouter)
+	httpMux := http.NewServeMux()
+	httpMux.Handle(AdminPathPrefix+"/", common.WrapHandlerInCORS(adminRouter))
+	// /metrics is for prometheus, so unlike everything else it isn't
+	// wrapped by CORS.
+	httpMux.Handle("/metrics", promhttp.InstrumentMetricHandler(
+		n.registerer, promhttp.HandlerFor(n.gatherer, promhttp.HandlerOpts{}),
+	))
+	n.setupHealthAPI(httpMux)
+	n.setupVersionAPI(httpMux)
+	n.setupDashboard(httpMux)
+	n.setupTopologyAPI(httpMux)
+	n.setupWellKnown(httpMux)
+	threePIDs.setupSubmitToken(httpMux)
+	oidc.setupCallback(httpMux)
+	httpMux.Handle("/", webClientHandler(n.webClientDir, n.baseURL, federated))
+	n.handler = httpMux
+
+	outputRoomEvent := string(base.Cfg.Kafka.Topics.OutputRoomEvent)
+	if err := n.events.start(base.KafkaConsumer, outputRoomEvent); err != nil {
+		return err
+	}
+	if err := pushers.start(base.KafkaConsumer, outputRoomEvent); err != nil {
+		return err
+	}
+	if err := n.acls.start(base.KafkaConsumer, outputRoomEvent); err != nil {
+		return err
+	}
+	if err := upgrades.start(base.KafkaConsumer, outputRoomEvent); err != nil {
+		return err
+	}
+	n.edus = &eduGossip{
+		ctx:          n.ctx,
+		pubsub:       n.PubSub,
+		self:         n.Host.ID(),
+		serverName:   base.Cfg.Matrix.ServerName,
+		federation:   federation,
+		typing:       typingInputAPI,
+		presence:     presence,
+		receipts:     receipts,
+		e2eKeys:      e2eKeys,
+		deactivation: n.deactivation,
+		memberships:  n.Memberships,
+		reputation:   n.reputation,
+		policy:       n.Policy,
+	}
+	presence.edus = n.edus
+	receipts.edus = n.edus
+	e2eKeys.edus = n.edus
+	n.deactivation.edus = n.edus
+	go presence.start(n.ctx)
+	go n.deactivation.start(n.ctx)
+	if err := n.edus.start(base.KafkaConsumer, string(typingTopic)); err != nil {
+		return err
+	}
+	return n.Memberships.start(base.KafkaConsumer, outputRoomEvent)
+}
+
+// Handler returns the handler for all of the APIs that the node serves to
+// HTTP clients.
+func (n *Node) Handler() http.Handler {
+	return n.handler
+}
+
+// LibP2PHandler returns the handler for the APIs that the node serves to
+// other nodes over libp2p. This doesn't include the admin API.
+func (n *Node) LibP2PHandler() http.Handler {
+	return n.libp2pHandler
+}
+
+// ListenLibP2P returns a listener for incoming "/matrix" streams from other
+// nodes, which can be served with LibP2PHandler just like a TCP listener.
+// Streams from peers that the gate doesn't allow, that have been
+// disconnected for misbehaving, or that are over their rate limit, are never
+// returned.
+func (n *Node) ListenLibP2P() (net.Listener, error) {
+	listener, err := gostream.Listen(n.Host, MatrixProtocol)
+	if err != nil {
+		return nil, err
+	}
+	return &gatedListener{Listener: listener, gate: n.Gate, chaos: n.Chaos, policy: n.Policy, reputation: n.reputation, limiter: n.limiter}, nil
+}
+
+// Close stops the libp2p host, so that no more requests arrive from other
+// nodes, and then closes naffka, the base component and the databases that
+// the node opened itself. Everything is closed even if something fails, and
+// the first error is returned.
+func (n *Node) Close() error {
+	n.cancel()
+	if n.collector != nil {
+		n.registerer.Unregister(n.collector)
+	}
+	err := n.Host.Close()
+	if n.Base.KafkaProducer != nil {
+		if perr := n.Base.KafkaProducer.Close(); err == nil {
+			err = perr
+		}
+	}
+	if berr := n.Base.Close(); err == nil {
+		err = berr
+	}
+	if n.health != nil {
+		if herr := n.health.close(); err == nil {
+			err = herr
+		}
+	}
+	if n.retention != nil {
+		if rerr := n.retention.close(); err == nil {
+			err = rerr
+		}
+	}
+	for _, db := range n.databases {
+		if derr := db.Close(); err == nil {
+			err = derr
+		}
+	}
+	return err
+}
@@ -0,0 +1,598 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// LoginClientPath is where clients find out how to log in, and log in.
+	LoginClientPath = "/_matrix/client/r0/login"
+	// SSORedirectClientPath is where clients send users to log in with the
+	// OpenID Connect provider.
+	SSORedirectClientPath = "/_matrix/client/r0/login/sso/redirect"
+	// OIDCCallbackPath is where the provider sends users back to once they
+	// have logged in, which is the redirect URI to register with it.
+	OIDCCallbackPath = "/_dendrite/oidc/callback"
+)
+
+// OIDCTimeout is how long a request to the OpenID Connect provider may take.
+const OIDCTimeout = time.Second * 30
+
+// SSOSessionLifetime is how long users have to log in with the provider.
+const SSOSessionLifetime = time.Minute * 10
+
+// LoginTokenLifetime is how long the client has to log in with the token
+// that it is sent back with once the user has logged in with the provider.
+const LoginTokenLifetime = time.Minute * 2
+
+// The types of login that OIDC adds.
+const (
+	loginTypeSSO   = "m.login.sso"
+	loginTypeToken = "m.login.token"
+)
+
+// oidcSessionCookie holds the state of a login with the provider, so that
+// the callback is only accepted by the browser that started it.
+const oidcSessionCookie = "dendrite_oidc_session"
+
+// oidcMaxResponseSize is the biggest response from the provider that is
+// read.
+const oidcMaxResponseSize = 1 << 20
+
+const oidcSchema = `
+-- The logins with the provider that have been started, by their state.
+CREATE TABLE IF NOT EXISTS p2p_sso_sessions (
+    state TEXT PRIMARY KEY,
+    redirect_url TEXT NOT NULL,
+    created_ts BIGINT NOT NULL
+);
+
+-- The accounts of the users of the provider, by their subject, which
+-- never changes, unlike their names.
+CREATE TABLE IF NOT EXISTS p2p_sso_users (
+    subject TEXT PRIMARY KEY,
+    localpart TEXT NOT NULL
+);
+
+-- The tokens that clients log in with once the user has logged in with the
+-- provider. Each can only be used once.
+CREATE TABLE IF NOT EXISTS p2p_login_tokens (
+    token TEXT PRIMARY KEY,
+    localpart TEXT NOT NULL,
+    created_ts BIGINT NOT NULL
+);
+`
+
+const insertSSOSessionSQL = "" +
+	"INSERT INTO p2p_sso_sessions (state, redirect_url, created_ts) VALUES ($1, $2, $3)"
+
+const deleteSSOSessionSQL = "" +
+	"DELETE FROM p2p_sso_sessions WHERE state = $1 AND created_ts > $2 RETURNING redirect_url"
+
+const deleteExpiredSSOSessionsSQL = "" +
+	"DELETE FROM p2p_sso_sessions WHERE created_ts <= $1"
+
+// A user whose account has been deactivated gets a new one if they log in
+// again.
+const selectSSOUserSQL = "" +
+	"SELECT localpart FROM p2p_sso_users WHERE subject = $1" +
+	" AND localpart NOT IN (SELECT localpart FROM p2p_deactivated_users)"
+
+const insertSSOUserSQL = "" +
+	"INSERT INTO p2p_sso_users (subject, localpart) VALUES ($1, $2)" +
+	" ON CONFLICT (subject) DO UPDATE SET localpart = $2"
+
+const insertLoginTokenSQL = "" +
+	"INSERT INTO p2p_login_tokens (token, localpart, created_ts) VALUES ($1, $2, $3)"
+
+const deleteLoginTokenSQL = "" +
+	"DELETE FROM p2p_login_tokens WHERE token = $1 AND created_ts > $2 RETURNING localpart"
+
+const deleteExpiredLoginTokensSQL = "" +
+	"DELETE FROM p2p_login_tokens WHERE created_ts <= $1"
+
+// oidcProvider is the part of the provider's discovery document that is
+// needed to log users in.
+type oidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// oidcLogin lets users log in with an OpenID Connect provider, e.g. that of
+// their organisation, with the SSO login of the client API. Users are sent
+// to the provider by the authorization code flow, and once they are back
+// are given a login token for their client to log in with. Users get an
+// account, without a password, the first time that they log in. Who they
+// are is asked of the userinfo endpoint, over TLS, rather than read from
+// the ID token, so that its signature doesn't need checking.
+type oidcLogin struct {
+	db             *sql.DB
+	accountDB      *accounts.Database
+	deviceDB       *devices.Database
+	serverName     gomatrixserverlib.ServerName
+	baseURL        func(*http.Request) *url.URL
+	client         *http.Client
+	issuer         string
+	clientID       string
+	clientSecret   string
+	localpartClaim string
+	passwordLogin  bool
+	// provider is found from the issuer the first time that it is needed,
+	// so that the node can start while the provider is down.
+	providerMu sync.Mutex
+	provider   *oidcProvider
+}
+
+func newOIDCLogin(
+	cfg *Config, accountDB *accounts.Database, deviceDB *devices.Database, baseURL func(*http.Request) *url.URL,
+) (*oidcLogin, error) {
+	if cfg.OIDCClientID == "" {
+		return nil, errors.New("no OIDC client ID given")
+	}
+	transport := http.DefaultTransport
+	if cfg.TorSOCKSAddr != "" {
+		socks, err := proxy.SOCKS5("tcp", cfg.TorSOCKSAddr, nil, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		transport = &http.Transport{Dial: socks.Dial}
+	}
+	localpartClaim := cfg.OIDCLocalpartClaim
+	if localpartClaim == "" {
+		localpartClaim = "preferred_username"
+	}
+	db, err := sql.Open("postgres", string(cfg.Dendrite.Database.Account))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(oidcSchema); err != nil {
+		return nil, err
+	}
+	return &oidcLogin{
+		db:             db,
+		accountDB:      accountDB,
+		deviceDB:       deviceDB,
+		serverName:     cfg.Dendrite.Matrix.ServerName,
+		baseURL:        baseURL,
+		client:         &http.Client{Transport: transport, Timeout: OIDCTimeout},
+		issuer:         strings.TrimSuffix(cfg.OIDCIssuer, "/"),
+		clientID:       cfg.OIDCClientID,
+		clientSecret:   cfg.OIDCClientSecret,
+		localpartClaim: localpartClaim,
+		passwordLogin:  !cfg.DisablePasswordLogin,
+	}, nil
+}
+
+// setup registers the API that starts SSO logins.
+func (o *oidcLogin) setup(mux *http.ServeMux) {
+	mux.Handle(SSORedirectClientPath, http.HandlerFunc(o.serveRedirect))
+}
+
+// setupCallback registers the page that the provider sends users back to.
+// It is only for browsers, so it isn't served over libp2p.
+func (o *oidcLogin) setupCallback(mux *http.ServeMux) {
+	if o == nil {
+		return
+	}
+	mux.Handle(OIDCCallbackPath, http.HandlerFunc(o.serveCallback))
+}
+
+// wrapLogin adds SSO to the ways of logging in, and logs in with login
+// tokens, which the client API doesn't know about.
+func (o *oidcLogin) wrapLogin(next http.Handler) http.Handler {
+	if o == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			var flows []map[string]string
+			if o.passwordLogin {
+				flows = append(flows, map[string]string{"type": string(loginTypePassword)})
+			}
+			flows = append(flows, map[string]string{"type": loginTypeSSO}, map[string]string{"type": loginTypeToken})
+			respondJSON(w, util.JSONResponse{Code: http.StatusOK, JSON: map[string]interface{}{"flows": flows}})
+			return
+		case http.MethodPost:
+		default:
+			next.ServeHTTP(w, req)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, authMaxRequestSize))
+		if err != nil {
+			respondJSON(w, util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.BadJSON(err.Error())})
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var r struct {
+			Type               string  `json:"type"`
+			Token              string  `json:"token"`
+			DeviceID           *string `json:"device_id"`
+			InitialDisplayName *string `json:"initial_device_display_name"`
+		}
+		if err = json.Unmarshal(body, &r); err != nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if r.Type == loginTypeToken {
+			respondJSON(w, o.tokenLogin(req, r.Token, r.DeviceID, r.InitialDisplayName))
+			return
+		}
+		if !o.passwordLogin {
+			respondJSON(w, util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("Log in with single sign-on instead"),
+			})
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// tokenLogin logs a client in with a login token, as a new device.
+func (o *oidcLogin) tokenLogin(req *http.Request, token string, deviceID, displayName *string) util.JSONResponse {
+	ctx := req.Context()
+	now := time.Now()
+	if _, err := o.db.ExecContext(ctx, deleteExpiredLoginTokensSQL, int64(gomatrixserverlib.AsTimestamp(now.Add(-LoginTokenLifetime)))); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	var localpart string
+	err := o.db.QueryRowContext(
+		ctx, deleteLoginTokenSQL, token, int64(gomatrixserverlib.AsTimestamp(now.Add(-LoginTokenLifetime))),
+	).Scan(&localpart)
+	if err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Invalid login token"),
+		}
+	} else if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	accessToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	dev, err := o.deviceDB.CreateDevice(ctx, localpart, deviceID, accessToken, displayName)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: jsonerror.Unknown("failed to create device: " + err.Error()),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"user_id":      dev.UserID,
+			"access_token": dev.AccessToken,
+			"home_server":  o.serverName,
+			"device_id":    dev.ID,
+		},
+	}
+}
+
+// serveRedirect sends the user to the provider to log in, remembering where
+// to send them back to once they have.
+func (o *oidcLogin) serveRedirect(w http.ResponseWriter, req *http.Request) {
+	redirectURL, err := url.Parse(req.URL.Query().Get("redirectUrl"))
+	if err != nil || !redirectURL.IsAbs() {
+		respondJSON(w, util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Missing or invalid redirectUrl"),
+		})
+		return
+	}
+	ctx := req.Context()
+	provider, err := o.discover(ctx)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to find OIDC provider")
+		respondJSON(w, util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("Failed to reach the identity provider"),
+		})
+		return
+	}
+	state, err := auth.GenerateAccessToken()
+	if err == nil {
+		now := time.Now()
+		_, err = o.db.ExecContext(ctx, deleteExpiredSSOSessionsSQL, int64(gomatrixserverlib.AsTimestamp(now.Add(-SSOSessionLifetime))))
+		if err == nil {
+			_, err = o.db.ExecContext(ctx, insertSSOSessionSQL, state, redirectURL.String(), int64(gomatrixserverlib.AsTimestamp(now)))
+		}
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Failed to start SSO login")
+		respondJSON(w, jsonerror.InternalServerError())
+		return
+	}
+	authURL, err := url.Parse(provider.AuthorizationEndpoint)
+	if err != nil {
+		logrus.WithError(err).Warn("Invalid OIDC authorization endpoint")
+		respondJSON(w, jsonerror.InternalServerError())
+		return
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", o.clientID)
+	query.Set("redirect_uri", o.callbackURL(req))
+	query.Set("scope", "openid profile")
+	query.Set("state", state)
+	authURL.RawQuery = query.Encode()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcSessionCookie,
+		Value:    state,
+		Path:     OIDCCallbackPath,
+		MaxAge:   int(SSOSessionLifetime / time.Second),
+		HttpOnly: true,
+		Secure:   o.baseURL(req).Scheme == "https",
+	})
+	http.Redirect(w, req, authURL.String(), http.StatusFound)
+}
+
+// serveCallback finds out who the user is, once the provider has sent them
+// back, and asks them to continue to their client with a login token.
+func (o *oidcLogin) serveCallback(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if e := query.Get("error"); e != "" {
+		ssoError(w, http.StatusForbidden, "The identity provider didn't log you in: "+e+" "+query.Get("error_description"))
+		return
+	}
+	state := query.Get("state")
+	cookie, err := req.Cookie(oidcSessionCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		ssoError(w, http.StatusBadRequest, "This login wasn't started in this browser. Go back to your client and try again.")
+		return
+	}
+	ctx := req.Context()
+	var redirectURL string
+	err = o.db.QueryRowContext(
+		ctx, deleteSSOSessionSQL, state, int64(gomatrixserverlib.AsTimestamp(time.Now().Add(-SSOSessionLifetime))),
+	).Scan(&redirectURL)
+	if err == sql.ErrNoRows {
+		ssoError(w, http.StatusBadRequest, "This login has expired. Go back to your client and try again.")
+		return
+	} else if err != nil {
+		logrus.WithError(err).Error("Failed to finish SSO login")
+		ssoError(w, http.StatusInternalServerError, "Something went wrong.")
+		return
+	}
+	claims, err := o.userinfo(ctx, query.Get("code"), o.callbackURL(req))
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to get user from OIDC provider")
+		ssoError(w, http.StatusBadGateway, "The identity provider couldn't say who you are.")
+		return
+	}
+	localpart, err := o.account(ctx, claims)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to find account for SSO login")
+		ssoError(w, http.StatusInternalServerError, "Something went wrong.")
+		return
+	}
+	token, err := auth.GenerateAccessToken()
+	if err == nil {
+		_, err = o.db.ExecContext(ctx, insertLoginTokenSQL, token, localpart, int64(gomatrixserverlib.AsTimestamp(time.Now())))
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Failed to create login token")
+		ssoError(w, http.StatusInternalServerError, "Something went wrong.")
+		return
+	}
+	continueURL, err := url.Parse(redirectURL)
+	if err != nil {
+		ssoError(w, http.StatusBadRequest, "Invalid redirect URL.")
+		return
+	}
+	q := continueURL.Query()
+	q.Set("loginToken", token)
+	continueURL.RawQuery = q.Encode()
+	// The user is asked before being sent on, as anyone could have made the
+	// link that started the login, to send the token to themselves.
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = ssoContinueTemplate.Execute(w, map[string]string{
+		"UserID": fmt.Sprintf("@%s:%s", localpart, o.serverName),
+		"Host":   continueURL.Host,
+		"URL":    continueURL.String(),
+	})
+}
+
+// callbackURL is the redirect URI of the node, which must be the same on
+// the way to the provider and back.
+func (o *oidcLogin) callbackURL(req *http.Request) string {
+	u := *o.baseURL(req)
+	u.Path += OIDCCallbackPath
+	return u.String()
+}
+
+// discover returns the endpoints of the provider from its discovery
+// document.
+func (o *oidcLogin) discover(ctx context.Context) (*oidcProvider, error) {
+	o.providerMu.Lock()
+	defer o.providerMu.Unlock()
+	if o.provider != nil {
+		return o.provider, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, o.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var provider oidcProvider
+	if err = o.do(req.WithContext(ctx), &provider); err != nil {
+		return nil, err
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.UserinfoEndpoint == "" {
+		return nil, errors.New("the discovery document is missing endpoints")
+	}
+	o.provider = &provider
+	return o.provider, nil
+}
+
+// userinfo swaps the authorization code for an access token, and returns
+// the claims about the user that it gets.
+func (o *oidcLogin) userinfo(ctx context.Context, code, redirectURI string) (map[string]interface{}, error) {
+	provider, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURI},
+	}
+	req, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.clientID), url.QueryEscape(o.clientSecret))
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err = o.do(req.WithContext(ctx), &token); err != nil {
+		return nil, err
+	}
+	if token.AccessToken == "" {
+		return nil, errors.New("no access token in the token response")
+	}
+	if req, err = http.NewRequest(http.MethodGet, provider.UserinfoEndpoint, nil); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	var claims map[string]interface{}
+	if err = o.do(req.WithContext(ctx), &claims); err != nil {
+		return nil, err
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("no subject in the userinfo response")
+	}
+	return claims, nil
+}
+
+func (o *oidcLogin) do(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %s", req.Method, req.URL, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponseSize)).Decode(v)
+}
+
+// account returns the localpart of the account of a user of the provider,
+// creating one the first time that they log in. It is named after the
+// localpart claim, with a number after it if that is taken.
+func (o *oidcLogin) account(ctx context.Context, claims map[string]interface{}) (string, error) {
+	sub := claims["sub"].(string)
+	var localpart string
+	err := o.db.QueryRowContext(ctx, selectSSOUserSQL, sub).Scan(&localpart)
+	if err != sql.ErrNoRows {
+		return localpart, err
+	}
+	name, _ := claims[o.localpartClaim].(string)
+	base := ssoLocalpart(name)
+	for i := 0; ; i++ {
+		localpart = base
+		if i > 0 {
+			localpart += strconv.Itoa(i)
+		}
+		account, err := o.accountDB.CreateAccount(ctx, localpart, "", "")
+		if err != nil {
+			return "", err
+		}
+		if account != nil {
+			break
+		}
+	}
+	if _, err = o.db.ExecContext(ctx, insertSSOUserSQL, sub, localpart); err != nil {
+		return "", err
+	}
+	if displayName, _ := claims["name"].(string); displayName != "" {
+		if err = o.accountDB.SetDisplayName(ctx, localpart, displayName); err != nil {
+			return "", err
+		}
+	}
+	logrus.WithField("user", localpart).Info("Created account for SSO user")
+	return localpart, nil
+}
+
+// ssoLocalpart makes a localpart out of a name from the provider, keeping
+// only the characters that localparts can have.
+func ssoLocalpart(name string) string {
+	name = strings.ToLower(name)
+	if i := strings.Index(name, "@"); i > 0 {
+		// An email address.
+		name = name[:i]
+	}
+	var b strings.Builder
+	for _, c := range name {
+		if validLocalpart.MatchString(string(c)) {
+			b.WriteRune(c)
+		}
+	}
+	if b.Len() == 0 {
+		return "user"
+	}
+	return b.String()
+}
+
+func ssoError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintln(w, message)
+}
+
+var ssoContinueTemplate = template.Must(template.New("sso").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Continue to your client</title>
+<style>body { font-family: sans-serif; max-width: 32em; margin: 2em auto; }</style>
+</head>
+<body>
+<p>You have logged in as <code>{{.UserID}}</code>.</p>
+<p>Continue to <strong>{{.Host}}</strong> to finish logging in. If you didn't ask to log in there, close this page instead.</p>
+<p><a href="{{.URL}}">Continue</a></p>
+</body>
+</html>
+`))
@@ -0,0 +1,261 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testOIDCProvider serves the discovery document, token endpoint and
+// userinfo endpoint of a provider that knows of one authorization code.
+func testOIDCProvider(discovery map[string]string, claims map[string]interface{}) *httptest.Server {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		doc := map[string]string{
+			"authorization_endpoint": srv.URL + "/authorize",
+			"token_endpoint":         srv.URL + "/token",
+			"userinfo_endpoint":      srv.URL + "/userinfo",
+		}
+		for k, v := range discovery {
+			doc[k] = v
+		}
+		_ = json.NewEncoder(w).Encode(doc)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		id, secret, _ := req.BasicAuth()
+		if id != "client" || secret != "secret" || req.PostFormValue("redirect_uri") != "https://node.example.com"+OIDCCallbackPath {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.PostFormValue("code") != "good-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"access_token": "provider-token"})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer provider-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(claims)
+	})
+	return srv
+}
+
+func testOIDCLogin(issuer string) *oidcLogin {
+	return &oidcLogin{
+		baseURL:        func(*http.Request) *url.URL { return &url.URL{Scheme: "https", Host: "node.example.com"} },
+		client:         http.DefaultClient,
+		issuer:         issuer,
+		clientID:       "client",
+		clientSecret:   "secret",
+		localpartClaim: "preferred_username",
+		passwordLogin:  true,
+	}
+}
+
+func TestOIDCCallbackState(t *testing.T) {
+	o := testOIDCLogin("http://127.0.0.1:0")
+	tests := []struct {
+		name   string
+		query  string
+		cookie string
+		status int
+	}{
+		{"provider error", "?error=access_denied&state=abc", "abc", http.StatusForbidden},
+		{"no cookie", "?code=good-code&state=abc", "", http.StatusBadRequest},
+		{"cookie for another login", "?code=good-code&state=abc", "def", http.StatusBadRequest},
+		{"no state", "?code=good-code", "abc", http.StatusBadRequest},
+		{"no state or cookie value", "?code=good-code", "-", http.StatusBadRequest},
+		{"state with a prefix of the cookie", "?code=good-code&state=ab", "abc", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, OIDCCallbackPath+tt.query, nil)
+		if tt.cookie == "-" {
+			req.Header.Set("Cookie", oidcSessionCookie+"=")
+		} else if tt.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: oidcSessionCookie, Value: tt.cookie})
+		}
+		rec := httptest.NewRecorder()
+		// The login must be turned away before the sessions are looked up,
+		// which would panic as there is no database.
+		o.serveCallback(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: got status %d, wanted %d: %s", tt.name, rec.Code, tt.status, rec.Body)
+		}
+	}
+}
+
+func TestOIDCRedirectURL(t *testing.T) {
+	o := testOIDCLogin("http://127.0.0.1:0")
+	for _, redirectURL := range []string{"", "/relative", "not a url%"} {
+		req := httptest.NewRequest(http.MethodGet, SSORedirectClientPath+"?redirectUrl="+url.QueryEscape(redirectURL), nil)
+		rec := httptest.NewRecorder()
+		o.serveRedirect(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: got status %d, wanted %d", redirectURL, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestOIDCDiscover(t *testing.T) {
+	tests := []struct {
+		name      string
+		discovery map[string]string
+		ok        bool
+	}{
+		{"complete", nil, true},
+		{"no authorization endpoint", map[string]string{"authorization_endpoint": ""}, false},
+		{"no token endpoint", map[string]string{"token_endpoint": ""}, false},
+		{"no userinfo endpoint", map[string]string{"userinfo_endpoint": ""}, false},
+	}
+	for _, tt := range tests {
+		srv := testOIDCProvider(tt.discovery, nil)
+		o := testOIDCLogin(srv.URL)
+		provider, err := o.discover(context.Background())
+		if tt.ok && err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%s: incomplete discovery document was accepted", tt.name)
+		}
+		srv.Close()
+		if !tt.ok {
+			continue
+		}
+		// The provider is remembered, so that it isn't asked every time.
+		if again, err := o.discover(context.Background()); err != nil || again != provider {
+			t.Errorf("%s: provider wasn't remembered: %v", tt.name, err)
+		}
+	}
+	o := testOIDCLogin("http://127.0.0.1:0/missing")
+	if _, err := o.discover(context.Background()); err == nil {
+		t.Error("unreachable provider was accepted")
+	}
+}
+
+func TestOIDCUserinfo(t *testing.T) {
+	tests := []struct {
+		name        string
+		code        string
+		redirectURI string
+		claims      map[string]interface{}
+		ok          bool
+	}{
+		{"valid", "good-code", "https://node.example.com" + OIDCCallbackPath, map[string]interface{}{"sub": "1234"}, true},
+		{"bad code", "bad-code", "https://node.example.com" + OIDCCallbackPath, map[string]interface{}{"sub": "1234"}, false},
+		{"wrong redirect URI", "good-code", "https://evil.example.com" + OIDCCallbackPath, map[string]interface{}{"sub": "1234"}, false},
+		{"no subject", "good-code", "https://node.example.com" + OIDCCallbackPath, map[string]interface{}{"name": "Alice"}, false},
+	}
+	for _, tt := range tests {
+		srv := testOIDCProvider(nil, tt.claims)
+		o := testOIDCLogin(srv.URL)
+		// The redirect URI must be the same on the way back from the provider
+		// as on the way to it, or the provider refuses to swap the code.
+		if got := o.callbackURL(httptest.NewRequest(http.MethodGet, "/", nil)); got != "https://node.example.com"+OIDCCallbackPath {
+			t.Fatalf("got callback URL %q", got)
+		}
+		claims, err := o.userinfo(context.Background(), tt.code, tt.redirectURI)
+		srv.Close()
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: got claims %v, wanted an error", tt.name, claims)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		} else if claims["sub"] != tt.claims["sub"] {
+			t.Errorf("%s: got claims %v", tt.name, claims)
+		}
+	}
+}
+
+func TestSSOLocalpart(t *testing.T) {
+	tests := []struct {
+		name      string
+		localpart string
+	}{
+		{"alice", "alice"},
+		{"Alice", "alice"},
+		{"alice@example.com", "alice"},
+		{"@alice", "alice"},
+		{"Alice Smith", "alicesmith"},
+		{"élodie", "lodie"},
+		{"", "user"},
+		{"日本", "user"},
+	}
+	for _, tt := range tests {
+		if got := ssoLocalpart(tt.name); got != tt.localpart {
+			t.Errorf("%q: got localpart %q, wanted %q", tt.name, got, tt.localpart)
+		}
+	}
+}
+
+func TestOIDCWrapLogin(t *testing.T) {
+	tests := []struct {
+		name          string
+		passwordLogin bool
+		method        string
+		body          string
+		status        int
+		next          bool
+	}{
+		{"flows", true, http.MethodGet, "", http.StatusOK, false},
+		{"password", true, http.MethodPost, `{"type":"m.login.password"}`, http.StatusOK, true},
+		{"password disabled", false, http.MethodPost, `{"type":"m.login.password"}`, http.StatusForbidden, false},
+		{"not JSON", false, http.MethodPost, `not json`, http.StatusOK, true},
+		{"options", false, http.MethodOptions, "", http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		o := testOIDCLogin("http://127.0.0.1:0")
+		o.passwordLogin = tt.passwordLogin
+		var next bool
+		handler := o.wrapLogin(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			next = true
+		}))
+		req := httptest.NewRequest(tt.method, LoginClientPath, strings.NewReader(tt.body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status || next != tt.next {
+			t.Errorf("%s: got status %d and passed on %v, wanted %d and %v", tt.name, rec.Code, next, tt.status, tt.next)
+		}
+		if tt.method != http.MethodGet {
+			continue
+		}
+		var res struct {
+			Flows []struct {
+				Type string `json:"type"`
+			} `json:"flows"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		var types []string
+		for _, flow := range res.Flows {
+			types = append(types, flow.Type)
+		}
+		if got, want := strings.Join(types, ","), "m.login.password,m.login.sso,m.login.token"; got != want {
+			t.Errorf("%s: got flows %s, wanted %s", tt.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+// OutboundRetryInterval is how often the outbound queue looks for nodes that
+// are due another try.
+const OutboundRetryInterval = time.Second * 30
+
+// OutboundMinBackoff is how long we wait before the first retry of a node
+// that we couldn't send a transaction to. The wait doubles with every
+// failure after that, up to OutboundMaxBackoff.
+const OutboundMinBackoff = time.Minute
+
+// OutboundMaxBackoff is the longest that we wait between retries of a node.
+const OutboundMaxBackoff = time.Hour * 6
+
+// OutboundMaxQueued is the most transactions that are queued for a node. The
+// oldest are dropped to make room for new ones.
+const OutboundMaxQueued = 1000
+
+// OutboundRetryBatch is the most transactions that are read from the queue
+// at a time when retrying a node.
+const OutboundRetryBatch = 50
+
+const outboundSchema = `
+-- The transactions that we couldn't send, even by way of a postbox peer or
+-- the DHT mailbox, in the order that they were sent in.
+CREATE TABLE IF NOT EXISTS p2p_outbound_transactions (
+    id BIGSERIAL PRIMARY KEY,
+    destination TEXT NOT NULL,
+    request TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS p2p_outbound_transactions_destination_idx
+    ON p2p_outbound_transactions (destination, id);
+
+-- When each node with queued transactions is next tried, and how many times
+-- in a row it has failed.
+CREATE TABLE IF NOT EXISTS p2p_outbound_backoff (
+    destination TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    retry_at BIGINT NOT NULL
+);
+`
+
+const insertOutboundSQL = "" +
+	"INSERT INTO p2p_outbound_transactions (destination, request) VALUES ($1, $2)"
+
+// Only the newest OutboundMaxQueued transactions of a node are kept.
+const pruneOutboundSQL = "" +
+	"DELETE FROM p2p_outbound_transactions WHERE destination = $1 AND id NOT IN (" +
+	"SELECT id FROM p2p_outbound_transactions WHERE destination = $1 ORDER BY id DESC LIMIT $2)"
+
+const selectOutboundSQL = "" +
+	"SELECT id, request FROM p2p_outbound_transactions WHERE destination = $1 ORDER BY id LIMIT $2"
+
+const deleteOutboundSQL = "" +
+	"DELETE FROM p2p_outbound_transactions WHERE id = $1"
+
+// A node that is already backing off keeps its place.
+const insertOutboundBackoffSQL = "" +
+	"INSERT INTO p2p_outbound_backoff (destination, failures, retry_at) VALUES ($1, 1, $2)" +
+	" ON CONFLICT (destination) DO NOTHING"
+
+const updateOutboundBackoffSQL = "" +
+	"UPDATE p2p_outbound_backoff SET failures = $2, retry_at = $3 WHERE destination = $1"
+
+// The backoff is only forgotten once nothing more has been queued.
+const deleteOutboundBackoffSQL = "" +
+	"DELETE FROM p2p_outbound_backoff WHERE destination = $1" +
+	" AND NOT EXISTS (SELECT 1 FROM p2p_outbound_transactions WHERE destination = $1)"
+
+const selectOutboundBackoffSQL = "" +
+	"SELECT 1 FROM p2p_outbound_backoff WHERE destination = $1"
+
+const selectDueOutboundBackoffSQL = "" +
+	"SELECT destination, failures FROM p2p_outbound_backoff WHERE retry_at <= $1"
+
+// outboundQueue keeps the transactions that we couldn't send to other nodes
+// in the database, and retries them with backoff, so that they aren't lost
+// when either node restarts. Transactions for a node that is backing off are
+// queued behind the others, so that they are sent in order.
+type outboundQueue struct {
+	db *sql.DB
+	// deliver sends a transaction to a node. It is set once the federation
+	// client has been created.
+	deliver func(ctx context.Context, to peer.ID, txn mailboxRequest) error
+}
+
+func newOutboundQueue(dataSourceName string) (*outboundQueue, error) {
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(outboundSchema); err != nil {
+		return nil, err
+	}
+	return &outboundQueue{db: db}, nil
+}
+
+// start retries the nodes that are due, until the context is done.
+func (q *outboundQueue) start(ctx context.Context) {
+	ticker := time.NewTicker(OutboundRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			q.retryAll(ctx)
+		}
+	}
+}
+
+// backingOff reports whether we have transactions queued for a node.
+func (q *outboundQueue) backingOff(ctx context.Context, to peer.ID) bool {
+	var one int
+	return q.db.QueryRowContext(ctx, selectOutboundBackoffSQL, to.Pretty()).Scan(&one) == nil
+}
+
+// push queues a transaction for a node, which starts backing off if it isn't
+// already.
+func (q *outboundQueue) push(ctx context.Context, to peer.ID, txn mailboxRequest) error {
+	data, err := json.Marshal(txn)
+	if err != nil {
+		return err
+	}
+	if _, err = q.db.ExecContext(ctx, insertOutboundSQL, to.Pretty(), string(data)); err != nil {
+		return err
+	}
+	if _, err = q.db.ExecContext(ctx, pruneOutboundSQL, to.Pretty(), OutboundMaxQueued); err != nil {
+		return err
+	}
+	retryAt := time.Now().Add(OutboundMinBackoff).UnixNano()
+	_, err = q.db.ExecContext(ctx, insertOutboundBackoffSQL, to.Pretty(), retryAt)
+	return err
+}
+
+// retryAll retries every node that is due.
+func (q *outboundQueue) retryAll(ctx context.Context) {
+	if q.deliver == nil {
+		return
+	}
+	due, err := q.due(ctx)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to look up queued transactions")
+		return
+	}
+	for to, failures := range due {
+		if err = q.retry(ctx, to); err == nil {
+			continue
+		}
+		failures++
+		backoff := outboundBackoff(failures)
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"peer":     to.String(),
+			"failures": failures,
+			"backoff":  backoff,
+		}).Debug("Failed to send queued transactions")
+		retryAt := time.Now().Add(backoff).UnixNano()
+		if _, err = q.db.ExecContext(ctx, updateOutboundBackoffSQL, to.Pretty(), failures, retryAt); err != nil {
+			logrus.WithError(err).Warn("Failed to store backoff")
+		}
+	}
+}
+
+// outboundBackoff returns how long to wait before trying a node that has
+// failed so many times in a row.
+func outboundBackoff(failures int) time.Duration {
+	backoff := OutboundMinBackoff
+	for i := 1; i < failures && backoff < OutboundMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > OutboundMaxBackoff {
+		backoff = OutboundMaxBackoff
+	}
+	return backoff
+}
+
+// due returns the nodes that are due another try, with how many times in a
+// row each has failed.
+func (q *outboundQueue) due(ctx context.Context) (map[peer.ID]int, error) {
+	rows, err := q.db.QueryContext(ctx, selectDueOutboundBackoffSQL, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	due := make(map[peer.ID]int)
+	for rows.Next() {
+		var destination string
+		var failures int
+		if err = rows.Scan(&destination, &failures); err != nil {
+			return nil, err
+		}
+		if to, err := peer.IDB58Decode(destination); err == nil {
+			due[to] = failures
+		}
+	}
+	return due, rows.Err()
+}
+
+// retry sends the transactions queued for a node in order, stopping at the
+// first that fails, and forgets the node's backoff once they have all gone.
+func (q *outboundQueue) retry(ctx context.Context, to peer.ID) error {
+	sent := 0
+	for {
+		ids, txns, err := q.queued(ctx, to)
+		if err != nil {
+			return err
+		}
+		if len(txns) == 0 {
+			break
+		}
+		for i, txn := range txns {
+			if err = q.deliver(ctx, to, txn); err != nil {
+				return err
+			}
+			if _, err = q.db.ExecContext(ctx, deleteOutboundSQL, ids[i]); err != nil {
+				return err
+			}
+			sent++
+		}
+	}
+	logrus.WithFields(logrus.Fields{"peer": to.String(), "transactions": sent}).Info(
+		"Sent queued transactions",
+	)
+	_, err := q.db.ExecContext(ctx, deleteOutboundBackoffSQL, to.Pretty())
+	return err
+}
+
+// queued returns the oldest transactions queued for a node.
+func (q *outboundQueue) queued(ctx context.Context, to peer.ID) ([]int64, []mailboxRequest, error) {
+	rows, err := q.db.QueryContext(ctx, selectOutboundSQL, to.Pretty(), OutboundRetryBatch)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	var ids []int64
+	var txns []mailboxRequest
+	for rows.Next() {
+		var id int64
+		var data string
+		if err = rows.Scan(&id, &data); err != nil {
+			return nil, nil, err
+		}
+		var txn mailboxRequest
+		if json.Unmarshal([]byte(data), &txn) != nil {
+			// There's no way that this will ever send, so drop it.
+			_, err = q.db.ExecContext(ctx, deleteOutboundSQL, id)
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		ids = append(ids, id)
+		txns = append(txns, txn)
+	}
+	return ids, txns, rows.Err()
+}
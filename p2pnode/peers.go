@@ -0,0 +1,135 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// PeerInfo describes a peer that we are connected to.
+type PeerInfo struct {
+	PeerID string `json:"peer_id"`
+	// The protocols that the peer told us it supports when we identified it.
+	Protocols   []string   `json:"protocols"`
+	Connections []ConnInfo `json:"connections"`
+}
+
+// ConnInfo describes one connection to a peer.
+type ConnInfo struct {
+	Addr      string `json:"addr"`
+	Direction string `json:"direction"`
+	// How long the connection has been open for, or zero if it was opened
+	// before we started keeping track.
+	AgeSeconds int64 `json:"age_seconds"`
+	// The protocols of the streams open on the connection.
+	Streams []string `json:"streams"`
+}
+
+// connTracker remembers when each connection was opened, which libp2p
+// doesn't.
+type connTracker struct {
+	mu     sync.Mutex
+	opened map[network.Conn]time.Time
+}
+
+func trackConns(p2pHost host.Host) *connTracker {
+	t := &connTracker{opened: make(map[network.Conn]time.Time)}
+	p2pHost.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			t.mu.Lock()
+			t.opened[conn] = time.Now()
+			t.mu.Unlock()
+		},
+		DisconnectedF: func(_ network.Network, conn network.Conn) {
+			t.mu.Lock()
+			delete(t.opened, conn)
+			t.mu.Unlock()
+		},
+	})
+	return t
+}
+
+func (t *connTracker) age(conn network.Conn) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if opened, ok := t.opened[conn]; ok {
+		return time.Since(opened)
+	}
+	return 0
+}
+
+// Peers returns every peer that we are connected to, sorted by peer ID.
+func (n *Node) Peers() []PeerInfo {
+	ids := n.Host.Network().Peers()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	peers := make([]PeerInfo, 0, len(ids))
+	for _, id := range ids {
+		peers = append(peers, n.peerInfo(id))
+	}
+	return peers
+}
+
+// peerInfo describes the connections that we have to a peer.
+func (n *Node) peerInfo(id peer.ID) PeerInfo {
+	info := PeerInfo{
+		PeerID:      id.Pretty(),
+		Protocols:   []string{},
+		Connections: []ConnInfo{},
+	}
+	if protocols, err := n.Host.Peerstore().GetProtocols(id); err == nil && protocols != nil {
+		sort.Strings(protocols)
+		info.Protocols = protocols
+	}
+	for _, conn := range n.Host.Network().ConnsToPeer(id) {
+		ci := ConnInfo{
+			Addr:       conn.RemoteMultiaddr().String(),
+			Direction:  directionString(conn.Stat().Direction),
+			AgeSeconds: int64(n.conns.age(conn) / time.Second),
+			Streams:    []string{},
+		}
+		for _, stream := range conn.GetStreams() {
+			ci.Streams = append(ci.Streams, string(stream.Protocol()))
+		}
+		sort.Strings(ci.Streams)
+		info.Connections = append(info.Connections, ci)
+	}
+	return info
+}
+
+func addrStrings(addrs []ma.Multiaddr) []string {
+	strs := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		strs = append(strs, addr.String())
+	}
+	return strs
+}
+
+func directionString(dir network.Direction) string {
+	switch dir {
+	case network.DirInbound:
+		return "inbound"
+	case network.DirOutbound:
+		return "outbound"
+	default:
+		return "unknown"
+	}
+}
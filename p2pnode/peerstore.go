@@ -0,0 +1,157 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/matrix-org/dendrite/common/keydb"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/sirupsen/logrus"
+)
+
+// PeerStoreFileName is the name of the file, next to the private key, that
+// the Matrix peers we know about are saved to.
+const PeerStoreFileName = ".dendrite-p2p-peers"
+
+// PeerStoreSaveInterval is how often the known peers are saved to disk.
+const PeerStoreSaveInterval = time.Minute
+
+// storedPeer is how a single peer is represented in the peer store file.
+type storedPeer struct {
+	ID        string   `json:"id"`
+	Addrs     []string `json:"addrs"`
+	Protocols []string `json:"protocols,omitempty"`
+}
+
+// setupPeerStore loads the peers saved by a previous run into the libp2p
+// peerstore and dials them, then saves the Matrix peers that we know about
+// back to the file periodically until the context is cancelled.
+func setupPeerStore(ctx context.Context, p2pHost host.Host, keyDB keydb.Database, filename string) error {
+	peers, err := loadPeerStore(filename, p2pHost.Peerstore())
+	if err != nil {
+		return err
+	}
+	logrus.WithField("count", len(peers)).Info("Loaded known peers from ", filename)
+
+	for _, p := range peers {
+		go func(p peer.AddrInfo) {
+			logger := logrus.WithField("peer", p.ID.String())
+			if err := connectPeer(ctx, p2pHost, keyDB, p); err != nil {
+				logger.WithError(err).Debug("Failed to reconnect to known peer")
+				return
+			}
+			logger.WithField("addrs", p.Addrs).Info("Reconnected to known peer")
+		}(p)
+	}
+
+	go func() {
+		ticker := time.NewTicker(PeerStoreSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := savePeerStore(filename, p2pHost.Peerstore()); err != nil {
+					logrus.WithError(err).Warn("Failed to save known peers to ", filename)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// loadPeerStore reads the peer store file, if there is one, and adds the
+// addresses and protocols in it to the libp2p peerstore.
+func loadPeerStore(filename string, ps peerstore.Peerstore) ([]peer.AddrInfo, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var stored []storedPeer
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+
+	peers := make([]peer.AddrInfo, 0, len(stored))
+	for _, sp := range stored {
+		id, err := peer.IDB58Decode(sp.ID)
+		if err != nil {
+			logrus.WithError(err).Warnf("Ignoring invalid peer ID %q in %s", sp.ID, filename)
+			continue
+		}
+		info := peer.AddrInfo{ID: id}
+		for _, a := range sp.Addrs {
+			addr, err := ma.NewMultiaddr(a)
+			if err != nil {
+				logrus.WithError(err).Warnf("Ignoring invalid address %q in %s", a, filename)
+				continue
+			}
+			info.Addrs = append(info.Addrs, addr)
+		}
+		ps.AddAddrs(id, info.Addrs, peerstore.AddressTTL)
+		if len(sp.Protocols) > 0 {
+			if err = ps.AddProtocols(id, sp.Protocols...); err != nil {
+				return nil, err
+			}
+		}
+		peers = append(peers, info)
+	}
+	return peers, nil
+}
+
+// savePeerStore writes out every peer in the libp2p peerstore that speaks
+// the Matrix protocol. Other peers, e.g. from the DHT, are not worth keeping.
+func savePeerStore(filename string, ps peerstore.Peerstore) error {
+	stored := []storedPeer{}
+	for _, id := range ps.PeersWithAddrs() {
+		supported, err := ps.SupportsProtocols(id, MatrixProtocol)
+		if err != nil {
+			return err
+		}
+		if len(supported) == 0 {
+			continue
+		}
+		sp := storedPeer{ID: id.Pretty()}
+		for _, addr := range ps.Addrs(id) {
+			sp.Addrs = append(sp.Addrs, addr.String())
+		}
+		if sp.Protocols, err = ps.GetProtocols(id); err != nil {
+			return err
+		}
+		stored = append(stored, sp)
+	}
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that a crash part way through
+	// doesn't leave us with a truncated peer store.
+	if err = ioutil.WriteFile(filename+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
@@ -0,0 +1,178 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/pnet"
+	"golang.org/x/crypto/salsa20/salsa"
+)
+
+// pskHeader is the first line of a libp2p pre-shared key file, as created
+// by e.g. ipfs-swarm-key-gen.
+const pskHeader = "/key/swarm/psk/1.0.0/"
+
+// loadPSK reads a pre-shared key file in the same format that go-ipfs uses
+// for private networks: the header line, an encoding line (/base16/,
+// /base64/ or /bin/) and then the 32 byte key in that encoding.
+func loadPSK(filename string) (*[32]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(bytes.NewReader(data))
+	header, err := r.ReadString('\n')
+	if err != nil || strings.TrimSpace(header) != pskHeader {
+		return nil, fmt.Errorf("%s is not a libp2p pre-shared key file", filename)
+	}
+	encoding, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("%s is missing the key encoding", filename)
+	}
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	switch strings.TrimSpace(encoding) {
+	case "/base16/":
+		key, err = hex.DecodeString(strings.TrimSpace(string(rest)))
+	case "/base64/":
+		key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(rest)))
+	case "/bin/":
+		key = rest
+	default:
+		return nil, fmt.Errorf("%s uses unknown key encoding %q", filename, strings.TrimSpace(encoding))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s contains a %d byte key, expected 32", filename, len(key))
+	}
+	var psk [32]byte
+	copy(psk[:], key)
+	return &psk, nil
+}
+
+// pskProtector implements pnet.Protector. Every connection is encrypted with
+// XSalsa20 keyed on the pre-shared key, so a peer without the key can't even
+// complete the security handshake.
+type pskProtector struct {
+	psk *[32]byte
+}
+
+func newPSKProtector(psk *[32]byte) pnet.Protector {
+	return &pskProtector{psk: psk}
+}
+
+// Protect implements pnet.Protector
+func (p *pskProtector) Protect(conn net.Conn) (net.Conn, error) {
+	return &pskConn{Conn: conn, psk: p.psk}, nil
+}
+
+// Fingerprint implements pnet.Protector
+func (p *pskProtector) Fingerprint() []byte {
+	sum := sha256.Sum256(p.psk[:])
+	return sum[:16]
+}
+
+// pskConn wraps a connection in XSalsa20. Each side picks a random nonce for
+// the direction that it writes in, and sends it before the first write.
+type pskConn struct {
+	net.Conn
+	psk    *[32]byte
+	reader *xsalsa20Stream
+	writer *xsalsa20Stream
+}
+
+func (c *pskConn) Read(out []byte) (int, error) {
+	if c.reader == nil {
+		nonce := make([]byte, 24)
+		if _, err := io.ReadFull(c.Conn, nonce); err != nil {
+			return 0, pnet.NewError("failed to read nonce: " + err.Error())
+		}
+		c.reader = newXSalsa20Stream(c.psk, nonce)
+	}
+	n, err := c.Conn.Read(out)
+	c.reader.XORKeyStream(out[:n], out[:n])
+	return n, err
+}
+
+func (c *pskConn) Write(in []byte) (int, error) {
+	if c.writer == nil {
+		nonce := make([]byte, 24)
+		if _, err := rand.Read(nonce); err != nil {
+			return 0, err
+		}
+		if _, err := c.Conn.Write(nonce); err != nil {
+			return 0, err
+		}
+		c.writer = newXSalsa20Stream(c.psk, nonce)
+	}
+	out := make([]byte, len(in))
+	c.writer.XORKeyStream(out, in)
+	return c.Conn.Write(out)
+}
+
+// xsalsa20Stream is a streaming XSalsa20 cipher, which the salsa20 package
+// doesn't provide: it only encrypts whole messages from a zero counter.
+type xsalsa20Stream struct {
+	key     [32]byte
+	counter [16]byte
+	block   [64]byte
+	used    int
+}
+
+func newXSalsa20Stream(psk *[32]byte, nonce []byte) *xsalsa20Stream {
+	s := &xsalsa20Stream{used: 64}
+	var hNonce [16]byte
+	copy(hNonce[:], nonce[:16])
+	salsa.HSalsa20(&s.key, &hNonce, psk, &salsa.Sigma)
+	copy(s.counter[:8], nonce[16:])
+	return s
+}
+
+// XORKeyStream XORs src with the next len(src) bytes of key stream.
+func (s *xsalsa20Stream) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if s.used == len(s.block) {
+			var zero [64]byte
+			salsa.XORKeyStream(s.block[:], zero[:], &s.counter, &s.key)
+			// The block counter is the little endian second half.
+			for j := 8; j < len(s.counter); j++ {
+				s.counter[j]++
+				if s.counter[j] != 0 {
+					break
+				}
+			}
+			s.used = 0
+		}
+		dst[i] = src[i] ^ s.block[s.used]
+		s.used++
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/salsa20"
+)
+
+func TestLoadPSK(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pnode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	key := bytes.Repeat([]byte{0xab}, 32)
+	tests := []struct {
+		name string
+		data string
+		ok   bool
+	}{
+		{"base16", pskHeader + "\n/base16/\n" + hex.EncodeToString(key) + "\n", true},
+		{"base64", pskHeader + "\n/base64/\n" + base64.StdEncoding.EncodeToString(key) + "\n", true},
+		{"bin", pskHeader + "\n/bin/\n" + string(key), true},
+		{"CRLF", pskHeader + "\r\n/base16/\r\n" + hex.EncodeToString(key) + "\r\n", true},
+		{"no header", "/base16/\n" + hex.EncodeToString(key) + "\n", false},
+		{"no encoding", pskHeader + "\n", false},
+		{"unknown encoding", pskHeader + "\n/base32/\n" + hex.EncodeToString(key) + "\n", false},
+		{"bad base16", pskHeader + "\n/base16/\nnot hex\n", false},
+		{"short key", pskHeader + "\n/base16/\n" + hex.EncodeToString(key[:16]) + "\n", false},
+		{"long key", pskHeader + "\n/bin/\n" + string(key) + "\n", false},
+	}
+	for _, tt := range tests {
+		filename := filepath.Join(dir, "swarm.key")
+		if err = ioutil.WriteFile(filename, []byte(tt.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		psk, err := loadPSK(filename)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: invalid key file was accepted", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: valid key file was rejected: %s", tt.name, err)
+		} else if !bytes.Equal(psk[:], key) {
+			t.Errorf("%s: got key %x, wanted %x", tt.name, psk[:], key)
+		}
+	}
+	if _, err = loadPSK(filepath.Join(dir, "missing.key")); err == nil {
+		t.Error("missing key file was accepted")
+	}
+}
+
+func TestXSalsa20Stream(t *testing.T) {
+	var psk [32]byte
+	copy(psk[:], "a pre-shared key of 32 bytes....")
+	nonce := []byte("a nonce that's 24 bytes.")
+	msg := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 20)
+
+	// Encrypting in pieces, across block boundaries, must give the same key
+	// stream as the salsa20 package does for the whole message at once.
+	want := make([]byte, len(msg))
+	salsa20.XORKeyStream(want, msg, nonce, &psk)
+	for _, size := range []int{1, 7, 63, 64, 65, 500, len(msg)} {
+		s := newXSalsa20Stream(&psk, nonce)
+		got := make([]byte, 0, len(msg))
+		for i := 0; i < len(msg); i += size {
+			end := i + size
+			if end > len(msg) {
+				end = len(msg)
+			}
+			out := make([]byte, end-i)
+			s.XORKeyStream(out, msg[i:end])
+			got = append(got, out...)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("pieces of %d bytes: key stream doesn't match XSalsa20", size)
+		}
+	}
+}
+
+func TestPSKConn(t *testing.T) {
+	var psk, other [32]byte
+	copy(psk[:], "a pre-shared key of 32 bytes....")
+	copy(other[:], "a different key that's 32 bytes.")
+	msg := []byte("GET /_matrix/federation/v1/version HTTP/1.1\r\n\r\n")
+
+	tests := []struct {
+		name   string
+		reader *[32]byte
+		ok     bool
+	}{
+		{"same key", &psk, true},
+		{"different key", &other, false},
+	}
+	for _, tt := range tests {
+		a, b := net.Pipe()
+		writer, _ := newPSKProtector(&psk).Protect(a)
+		reader, _ := newPSKProtector(tt.reader).Protect(b)
+		go func() {
+			// Twice, so that the key stream carries on across writes.
+			_, _ = writer.Write(msg)
+			_, _ = writer.Write(msg)
+			_ = writer.Close()
+		}()
+		got, err := ioutil.ReadAll(reader)
+		if err != nil && err != io.ErrClosedPipe {
+			t.Fatal(err)
+		}
+		if want := append(append([]byte{}, msg...), msg...); bytes.Equal(got, want) != tt.ok {
+			t.Errorf("%s: got %q", tt.name, got)
+		}
+		_ = reader.Close()
+	}
+
+	if bytes.Equal(newPSKProtector(&psk).Fingerprint(), newPSKProtector(&other).Fingerprint()) {
+		t.Error("different keys have the same fingerprint")
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// FederationPolicyFileName is the name of the file, in the data directory,
+// that the federation policy set through the admin API is saved to.
+const FederationPolicyFileName = ".dendrite-p2p-federation-policy"
+
+// errPolicyInConfig is returned for attempts to remove a pattern that is in
+// the config file through the admin API.
+var errPolicyInConfig = errors.New("the pattern is set in the config file")
+
+// FederationPolicy decides which servers we federate with at all, by server
+// name or peer ID, e.g. for a private mesh of family or team nodes. Patterns
+// can use * for any number of characters and ? for one. Servers that match
+// a deny pattern are always refused. If there are any allow patterns then
+// only servers that match one are accepted. Patterns come from the config
+// file and from the admin API, and only the latter can be changed while the
+// node is running.
+type FederationPolicy struct {
+	mu       sync.RWMutex
+	filename string
+	self     gomatrixserverlib.ServerName
+	config   federationPolicyFile
+	admin    federationPolicyFile
+	allow    []*regexp.Regexp
+	deny     []*regexp.Regexp
+}
+
+// federationPolicyFile is how the patterns are represented on disk and in
+// the admin API.
+type federationPolicyFile struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// loadFederationPolicy reads the patterns set through the admin API from the
+// file, if there is one, on top of the ones from the config.
+func loadFederationPolicy(filename string, self gomatrixserverlib.ServerName, config federationPolicyFile) (*FederationPolicy, error) {
+	var f federationPolicyFile
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		err = json.Unmarshal(data, &f)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, pattern := range append(append(append([]string{}, config.Allow...), config.Deny...), append(f.Allow, f.Deny...)...) {
+		if err = validateServerPattern(pattern); err != nil {
+			return nil, err
+		}
+	}
+	p := &FederationPolicy{filename: filename, self: self, config: config, admin: f}
+	p.compile()
+	return p, nil
+}
+
+// validateServerPattern checks that a pattern could match a server name.
+func validateServerPattern(pattern string) error {
+	if pattern == "" || strings.ContainsAny(pattern, " /\t\n") {
+		return fmt.Errorf("invalid server name pattern %q", pattern)
+	}
+	return nil
+}
+
+// compile compiles the patterns. The lock must be held for writing, or not
+// shared yet.
+func (p *FederationPolicy) compile() {
+	p.allow, p.deny = nil, nil
+	for _, glob := range append(append([]string{}, p.config.Allow...), p.admin.Allow...) {
+		p.allow = append(p.allow, compileServerGlob(glob))
+	}
+	for _, glob := range append(append([]string{}, p.config.Deny...), p.admin.Deny...) {
+		p.deny = append(p.deny, compileServerGlob(glob))
+	}
+}
+
+// Allowed returns whether we federate with the server. We always federate
+// with ourselves.
+func (p *FederationPolicy) Allowed(server gomatrixserverlib.ServerName) bool {
+	if p == nil || server == p.self {
+		return true
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if matchServer(p.deny, server) {
+		return false
+	}
+	return len(p.allow) == 0 || matchServer(p.allow, server)
+}
+
+// matchServer reports whether any of the patterns match the server name,
+// either as it is or without its port.
+func matchServer(patterns []*regexp.Regexp, server gomatrixserverlib.ServerName) bool {
+	name := string(server)
+	host := name
+	if h, _, err := net.SplitHostPort(name); err == nil {
+		host = h
+	}
+	for _, re := range patterns {
+		if re.MatchString(name) || re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lists returns the allow and deny patterns, from both the config and the
+// admin API.
+func (p *FederationPolicy) Lists() (allow, deny []string) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return mergePatterns(p.config.Allow, p.admin.Allow), mergePatterns(p.config.Deny, p.admin.Deny)
+}
+
+func mergePatterns(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	merged := []string{}
+	for _, pattern := range append(append([]string{}, a...), b...) {
+		if !seen[pattern] {
+			seen[pattern] = true
+			merged = append(merged, pattern)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// SetAllowed adds a pattern to the allow list, or removes it from it, and
+// saves the patterns set through the admin API.
+func (p *FederationPolicy) SetAllowed(pattern string, allowed bool) error {
+	return p.set(&p.admin.Allow, p.config.Allow, pattern, allowed)
+}
+
+// SetDenied adds a pattern to the deny list, or removes it from it, and
+// saves the patterns set through the admin API.
+func (p *FederationPolicy) SetDenied(pattern string, denied bool) error {
+	return p.set(&p.admin.Deny, p.config.Deny, pattern, denied)
+}
+
+func (p *FederationPolicy) set(list *[]string, config []string, pattern string, add bool) error {
+	if err := validateServerPattern(pattern); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var patterns []string
+	for _, existing := range *list {
+		if existing != pattern {
+			patterns = append(patterns, existing)
+		}
+	}
+	if add {
+		patterns = append(patterns, pattern)
+	} else {
+		for _, existing := range config {
+			if existing == pattern {
+				return errPolicyInConfig
+			}
+		}
+	}
+	sort.Strings(patterns)
+	old := *list
+	*list = patterns
+	if err := p.save(); err != nil {
+		// The change only takes effect once it has been saved.
+		*list = old
+		return err
+	}
+	p.compile()
+	return nil
+}
+
+// save writes the patterns set through the admin API to the file. The lock
+// must be held.
+func (p *FederationPolicy) save() error {
+	data, err := json.MarshalIndent(p.admin, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(p.filename+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(p.filename+".tmp", p.filename)
+}
+
+// wrap refuses federation requests from servers that we don't federate
+// with. The origin is taken from the Authorization header before the request
+// has been verified, which is fine since the request would be refused anyway
+// if it were forged. Requests without one, e.g. for our version, are left
+// to the handler.
+func (p *FederationPolicy) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origin := requestOrigin(req)
+		if !strings.HasPrefix(req.URL.Path, "/_matrix/federation/") || origin == "" || p.Allowed(origin) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(jsonerror.Forbidden("This server doesn't federate with yours"))
+	})
+}
+
+// policyTransport wraps the transport of the federation client so that no
+// requests are made of servers that we don't federate with. Transactions
+// for them are dropped, so that the federation sender doesn't keep retrying
+// them.
+type policyTransport struct {
+	next   http.RoundTripper
+	policy *FederationPolicy
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.policy.Allowed(gomatrixserverlib.ServerName(req.URL.Host)) {
+		return t.next.RoundTrip(req)
+	}
+	if req.Body != nil {
+		req.Body.Close() // nolint: errcheck
+	}
+	if req.Method == http.MethodPut && strings.HasPrefix(req.URL.Path, SendFederationPathPrefix) {
+		return sentResponse(req), nil
+	}
+	return nil, fmt.Errorf("federation with %q isn't allowed by the federation policy", req.URL.Host)
+}
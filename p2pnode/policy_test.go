@@ -0,0 +1,253 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestValidateServerPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		ok      bool
+	}{
+		{"example.com", true},
+		{"*.example.com", true},
+		{"12D3KooW*", true},
+		{"example.com:8448", true},
+		{"", false},
+		{"example .com", false},
+		{"example.com/path", false},
+		{"example.com\t", false},
+		{"example.com\n", false},
+	}
+	for _, tt := range tests {
+		if err := validateServerPattern(tt.pattern); tt.ok && err != nil {
+			t.Errorf("%q: valid pattern was rejected: %s", tt.pattern, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%q: invalid pattern was accepted", tt.pattern)
+		}
+	}
+}
+
+func TestFederationPolicySet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pnode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	filename := filepath.Join(dir, FederationPolicyFileName)
+	config := federationPolicyFile{Deny: []string{"config.example.com"}}
+
+	tests := []struct {
+		name    string
+		set     func(p *FederationPolicy) error
+		err     error
+		server  gomatrixserverlib.ServerName
+		allowed bool
+	}{
+		{"deny", func(p *FederationPolicy) error { return p.SetDenied("evil.com", true) }, nil, "evil.com", false},
+		{"undeny", func(p *FederationPolicy) error { return p.SetDenied("evil.com", false) }, nil, "evil.com", true},
+		{"allow", func(p *FederationPolicy) error { return p.SetAllowed("friend.com", true) }, nil, "other.com", false},
+		{"allowed", func(p *FederationPolicy) error { return nil }, nil, "friend.com", true},
+		{"disallow", func(p *FederationPolicy) error { return p.SetAllowed("friend.com", false) }, nil, "other.com", true},
+		{
+			"undeny config", func(p *FederationPolicy) error { return p.SetDenied("config.example.com", false) },
+			errPolicyInConfig, "config.example.com", false,
+		},
+	}
+	for _, tt := range tests {
+		p, err := loadFederationPolicy(filename, "self", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tt.set(p); err != tt.err {
+			t.Errorf("%s: got error %v, wanted %v", tt.name, err, tt.err)
+		}
+		if got := p.Allowed(tt.server); got != tt.allowed {
+			t.Errorf("%s: %s got allowed %v, wanted %v", tt.name, tt.server, got, tt.allowed)
+		}
+		// The change must survive being saved and loaded again.
+		if p, err = loadFederationPolicy(filename, "self", config); err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Allowed(tt.server); got != tt.allowed {
+			t.Errorf("%s: %s got allowed %v after loading, wanted %v", tt.name, tt.server, got, tt.allowed)
+		}
+	}
+
+	p, err := loadFederationPolicy(filename, "self", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.SetDenied("evil .com", true); err == nil {
+		t.Error("invalid pattern was accepted")
+	}
+}
+
+func TestFederationPolicySetFailed(t *testing.T) {
+	p, err := loadFederationPolicy(filepath.Join("/nonexistent", FederationPolicyFileName), "self", federationPolicyFile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.SetDenied("evil.com", true); err == nil {
+		t.Fatal("saving to a missing directory succeeded")
+	}
+	if !p.Allowed("evil.com") {
+		t.Error("change that failed to save took effect")
+	}
+	if _, deny := p.Lists(); len(deny) != 0 {
+		t.Errorf("change that failed to save is listed: %v", deny)
+	}
+}
+
+func TestFederationPolicyAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  federationPolicyFile
+		server  gomatrixserverlib.ServerName
+		allowed bool
+	}{
+		{"no patterns", federationPolicyFile{}, "example.com", true},
+		{"denied", federationPolicyFile{Deny: []string{"evil.com"}}, "evil.com", false},
+		{"not denied", federationPolicyFile{Deny: []string{"evil.com"}}, "example.com", true},
+		{"allowed", federationPolicyFile{Allow: []string{"friend.com"}}, "friend.com", true},
+		{"not allowed", federationPolicyFile{Allow: []string{"friend.com"}}, "example.com", false},
+		{"deny beats allow", federationPolicyFile{Allow: []string{"*"}, Deny: []string{"evil.com"}}, "evil.com", false},
+		{"ourselves", federationPolicyFile{Allow: []string{"friend.com"}, Deny: []string{"*"}}, "self", true},
+		{"port stripped", federationPolicyFile{Deny: []string{"evil.com"}}, "evil.com:8448", false},
+		{"pattern with port", federationPolicyFile{Deny: []string{"evil.com:8448"}}, "evil.com:8448", false},
+		{"pattern with another port", federationPolicyFile{Deny: []string{"evil.com:8448"}}, "evil.com:443", true},
+		{"star", federationPolicyFile{Deny: []string{"*.evil.com"}}, "sub.evil.com", false},
+		{"star needs the dot", federationPolicyFile{Deny: []string{"*.evil.com"}}, "evil.com", true},
+		{"peer IDs", federationPolicyFile{Allow: []string{"12D3KooW*"}}, "12D3KooWExample", true},
+		{"question mark", federationPolicyFile{Deny: []string{"node?.example.com"}}, "node1.example.com", false},
+		{"question mark is one character", federationPolicyFile{Deny: []string{"node?.example.com"}}, "node12.example.com", true},
+		{"dot is literal", federationPolicyFile{Deny: []string{"evil.com"}}, "evilxcom", true},
+	}
+	for _, tt := range tests {
+		p, err := loadFederationPolicy(filepath.Join("/nonexistent", FederationPolicyFileName), "self", tt.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Allowed(tt.server); got != tt.allowed {
+			t.Errorf("%s: %s got allowed %v, wanted %v", tt.name, tt.server, got, tt.allowed)
+		}
+	}
+	var p *FederationPolicy
+	if !p.Allowed("example.com") {
+		t.Error("no policy doesn't allow everyone")
+	}
+}
+
+func TestFederationPolicyWrap(t *testing.T) {
+	p, err := loadFederationPolicy(filepath.Join("/nonexistent", FederationPolicyFileName), "self", federationPolicyFile{
+		Deny: []string{"evil.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := p.wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	tests := []struct {
+		name   string
+		path   string
+		origin string
+		status int
+	}{
+		{"allowed", "/_matrix/federation/v1/send/txn1", "good.com", http.StatusOK},
+		{"denied", "/_matrix/federation/v1/send/txn1", "evil.com", http.StatusForbidden},
+		{"denied with port", "/_matrix/federation/v1/query/profile", "evil.com:8448", http.StatusForbidden},
+		{"no origin", "/_matrix/federation/v1/version", "", http.StatusOK},
+		{"not federation", "/_matrix/key/v2/server", "evil.com", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.origin != "" {
+			req.Header.Set("Authorization", `X-Matrix origin=`+tt.origin+`,key="ed25519:1",sig="abc"`)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: got status %d, wanted %d", tt.name, rec.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusForbidden {
+			continue
+		}
+		var res struct {
+			ErrCode string `json:"errcode"`
+		}
+		if err = json.NewDecoder(rec.Body).Decode(&res); err != nil || res.ErrCode != "M_FORBIDDEN" {
+			t.Errorf("%s: got errcode %q, %v, wanted M_FORBIDDEN", tt.name, res.ErrCode, err)
+		}
+	}
+}
+
+func TestPolicyTransport(t *testing.T) {
+	p, err := loadFederationPolicy(filepath.Join("/nonexistent", FederationPolicyFileName), "self", federationPolicyFile{
+		Deny: []string{"evil.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent int
+	transport := &policyTransport{
+		next: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			sent++
+			return sentResponse(req), nil
+		}),
+		policy: p,
+	}
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		sent   bool
+		err    bool
+	}{
+		{"allowed transaction", http.MethodPut, "matrix://good.com" + SendFederationPathPrefix + "txn1", true, false},
+		{"denied transaction", http.MethodPut, "matrix://evil.com" + SendFederationPathPrefix + "txn1", false, false},
+		{"allowed request", http.MethodGet, "matrix://good.com/_matrix/federation/v1/query/profile", true, false},
+		{"denied request", http.MethodGet, "matrix://evil.com/_matrix/federation/v1/query/profile", false, true},
+		{"denied with port", http.MethodGet, "matrix://evil.com:8448/_matrix/key/v2/server", false, true},
+	}
+	for _, tt := range tests {
+		sent = 0
+		req := httptest.NewRequest(tt.method, tt.url, strings.NewReader("{}"))
+		res, err := transport.RoundTrip(req)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: got error %v, wanted error %v", tt.name, err, tt.err)
+		}
+		if (sent == 1) != tt.sent {
+			t.Errorf("%s: got sent %v, wanted %v", tt.name, sent == 1, tt.sent)
+		}
+		// Transactions for denied servers look as if they were sent, so
+		// that the federation sender doesn't retry them.
+		if err == nil && res.StatusCode != http.StatusOK {
+			t.Errorf("%s: got status %d", tt.name, res.StatusCode)
+		}
+	}
+}
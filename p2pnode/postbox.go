@@ -0,0 +1,541 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/keydb"
+	"github.com/sirupsen/logrus"
+)
+
+// PostboxProtocol is the libp2p protocol that nodes talk to postbox peers
+// on. A postbox peer holds the transactions sent to a node that nominated it
+// while the node is offline, until the node drains them. Each stream carries
+// one JSON request and one JSON response.
+const PostboxProtocol = "/matrix/postbox"
+
+// PostboxNamespace is the DHT namespace of the records that list the postbox
+// peers of each node, at /matrix-postbox/<peer ID>.
+const PostboxNamespace = "matrix-postbox"
+
+// PostboxMaxHeld is the most transactions that a postbox peer holds for a
+// node. The oldest are dropped to make room for new ones.
+const PostboxMaxHeld = 1000
+
+// PostboxDrainBatch is the most transactions that one drain returns.
+const PostboxDrainBatch = 50
+
+// PostboxDrainInterval is how often a node drains its postbox peers, on top
+// of doing so when it starts.
+const PostboxDrainInterval = time.Minute * 5
+
+// PostboxLookupCacheTime is how long the postbox peers of another node are
+// remembered for once looked up in the DHT.
+const PostboxLookupCacheTime = time.Minute * 10
+
+// PostboxTimeout is how long any one exchange with a postbox peer may take.
+const PostboxTimeout = time.Second * 30
+
+// PostboxMaxSize is the most that is read of a postbox request or response.
+const PostboxMaxSize = 8 << 20
+
+// The operations of the postbox protocol.
+const (
+	// postboxHold asks a postbox peer to hold a transaction for a node.
+	postboxHold = "hold"
+	// postboxDrain asks a postbox peer for the transactions that it holds
+	// for us.
+	postboxDrain = "drain"
+	// postboxAck tells a postbox peer that we have the transactions, so it
+	// can forget them.
+	postboxAck = "ack"
+)
+
+const postboxSchema = `
+-- The transactions that we hold for the nodes that we are a postbox peer of.
+CREATE TABLE IF NOT EXISTS p2p_postbox (
+    id BIGSERIAL PRIMARY KEY,
+    recipient TEXT NOT NULL,
+    origin TEXT NOT NULL,
+    request TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS p2p_postbox_recipient_idx ON p2p_postbox (recipient, id);
+`
+
+const insertPostboxSQL = "" +
+	"INSERT INTO p2p_postbox (recipient, origin, request) VALUES ($1, $2, $3)"
+
+// Only the newest PostboxMaxHeld transactions of a node are kept.
+const prunePostboxSQL = "" +
+	"DELETE FROM p2p_postbox WHERE recipient = $1 AND id NOT IN (" +
+	"SELECT id FROM p2p_postbox WHERE recipient = $1 ORDER BY id DESC LIMIT $2)"
+
+const selectPostboxSQL = "" +
+	"SELECT id, origin, request FROM p2p_postbox WHERE recipient = $1 ORDER BY id LIMIT $2"
+
+const deletePostboxSQL = "" +
+	"DELETE FROM p2p_postbox WHERE recipient = $1 AND id = ANY($2)"
+
+// postboxRequest is a request to a postbox peer.
+type postboxRequest struct {
+	Op string `json:"op"`
+	// For postboxHold, the node that the transaction is for, and the
+	// transaction.
+	To          string          `json:"to,omitempty"`
+	Transaction *mailboxRequest `json:"transaction,omitempty"`
+	// For postboxAck, the IDs of the transactions that we have.
+	IDs []int64 `json:"ids,omitempty"`
+}
+
+// postboxItem is a transaction held by a postbox peer.
+type postboxItem struct {
+	ID          int64          `json:"id"`
+	Origin      string         `json:"origin"`
+	Transaction mailboxRequest `json:"transaction"`
+}
+
+// postboxResponse is the response of a postbox peer. The error code is empty
+// if it did what was asked.
+type postboxResponse struct {
+	jsonerror.MatrixError
+	Items []postboxItem `json:"items,omitempty"`
+}
+
+// postboxRecord is the value of the record that lists the postbox peers of a
+// node in the DHT, signed by the node's identity key.
+type postboxRecord struct {
+	Seq       int64    `json:"seq"`
+	Postboxes []string `json:"postboxes"`
+	Signature []byte   `json:"signature,omitempty"`
+}
+
+// signedBytes returns what the signature of the record at the key covers.
+func (r *postboxRecord) signedBytes(key string) ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = nil
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(key+"\n"), data...), nil
+}
+
+// postboxKey returns the DHT key of the record listing the postbox peers of
+// a node.
+func postboxKey(id peer.ID) string {
+	return "/" + PostboxNamespace + "/" + id.Pretty()
+}
+
+// postboxValidator checks the records that list the postbox peers of nodes.
+type postboxValidator struct{}
+
+// Validate implements record.Validator
+func (postboxValidator) Validate(key string, value []byte) error {
+	id, err := peer.IDB58Decode(strings.TrimPrefix(key, "/"+PostboxNamespace+"/"))
+	if err != nil {
+		return err
+	}
+	var r postboxRecord
+	if err = json.Unmarshal(value, &r); err != nil {
+		return err
+	}
+	pubKey, err := id.ExtractPublicKey()
+	if err != nil {
+		return err
+	}
+	signed, err := r.signedBytes(key)
+	if err != nil {
+		return err
+	}
+	if ok, err := pubKey.Verify(signed, r.Signature); err != nil || !ok {
+		return errors.New("postbox record isn't signed by the node")
+	}
+	return nil
+}
+
+// Select implements record.Validator, picking the latest record.
+func (postboxValidator) Select(key string, values [][]byte) (int, error) {
+	best, bestSeq := -1, int64(-1)
+	for i, value := range values {
+		var r postboxRecord
+		if json.Unmarshal(value, &r) == nil && r.Seq > bestSeq {
+			best, bestSeq = i, r.Seq
+		}
+	}
+	if best < 0 {
+		return 0, errors.New("no valid postbox records")
+	}
+	return best, nil
+}
+
+// postboxLookup is the postbox peers of another node, as last looked up.
+type postboxLookup struct {
+	postboxes []peer.ID
+	at        time.Time
+}
+
+// postbox lets a node nominate trusted peers to hold its inbound federation
+// traffic while it is offline, and holds traffic for the nodes that trust us
+// in turn. Nodes list their postbox peers in the DHT, so that other nodes
+// know where to send transactions when they can't reach them.
+type postbox struct {
+	db       *sql.DB
+	host     host.Host
+	dht      *dht.IpfsDHT
+	keyDB    keydb.Database
+	resolver *resolverTransport
+	// postboxes are the peers that hold our traffic.
+	postboxes []peer.ID
+	// clients are the nodes that we hold traffic for.
+	clients map[peer.ID]struct{}
+	// handler serves the federation API, for the transactions that we drain.
+	// It is set once the components have been set up.
+	handler http.Handler
+
+	mu      sync.Mutex
+	lookups map[peer.ID]postboxLookup
+}
+
+func newPostbox(
+	dataSourceName string, p2pHost host.Host, p2pDHT *dht.IpfsDHT, keyDB keydb.Database,
+	resolver *resolverTransport, postboxes []string, clients []string,
+) (*postbox, error) {
+	postboxSet, err := peerSet(postboxes)
+	if err != nil {
+		return nil, err
+	}
+	clientSet, err := peerSet(clients)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(postboxSchema); err != nil {
+		return nil, err
+	}
+	return &postbox{
+		db:        db,
+		host:      p2pHost,
+		dht:       p2pDHT,
+		keyDB:     keyDB,
+		resolver:  resolver,
+		postboxes: sortedPeers(postboxSet),
+		clients:   clientSet,
+		lookups:   make(map[peer.ID]postboxLookup),
+	}, nil
+}
+
+// start handles the postbox protocol, publishes our postbox peers and drains
+// them, until the context is done.
+func (p *postbox) start(ctx context.Context) {
+	p.host.SetStreamHandler(PostboxProtocol, p.handleStream)
+	drain := time.NewTicker(PostboxDrainInterval)
+	defer drain.Stop()
+	republish := time.NewTicker(MailboxRepublishInterval)
+	defer republish.Stop()
+	// Give the DHT a moment to find some peers first.
+	first := time.After(DHTDiscoveryInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-first:
+			p.publish(ctx)
+			p.drainAll(ctx)
+		case <-drain.C:
+			p.drainAll(ctx)
+		case <-republish.C:
+			p.publish(ctx)
+		}
+	}
+}
+
+// publish lists our postbox peers in the DHT. An empty list is published
+// too, so that other nodes stop using peers that we no longer trust.
+func (p *postbox) publish(ctx context.Context) {
+	r := postboxRecord{Seq: time.Now().UnixNano(), Postboxes: []string{}}
+	for _, id := range p.postboxes {
+		r.Postboxes = append(r.Postboxes, id.Pretty())
+	}
+	key := postboxKey(p.host.ID())
+	err := func() error {
+		signed, err := r.signedBytes(key)
+		if err != nil {
+			return err
+		}
+		if r.Signature, err = p.host.Peerstore().PrivKey(p.host.ID()).Sign(signed); err != nil {
+			return err
+		}
+		value, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(ctx, MailboxTimeout)
+		defer cancel()
+		return p.dht.PutValue(ctx, key, value)
+	}()
+	if err != nil {
+		logrus.WithError(err).Debug("Failed to publish postbox peers")
+	}
+}
+
+// lookup returns the postbox peers of another node.
+func (p *postbox) lookup(ctx context.Context, id peer.ID) []peer.ID {
+	p.mu.Lock()
+	cached, ok := p.lookups[id]
+	p.mu.Unlock()
+	if ok && time.Since(cached.at) < PostboxLookupCacheTime {
+		return cached.postboxes
+	}
+	lookup := postboxLookup{at: time.Now()}
+	ctx, cancel := context.WithTimeout(ctx, MailboxTimeout)
+	defer cancel()
+	if value, err := p.dht.GetValue(ctx, postboxKey(id)); err == nil {
+		var r postboxRecord
+		if json.Unmarshal(value, &r) == nil {
+			for _, s := range r.Postboxes {
+				if postboxID, err := peer.IDB58Decode(s); err == nil && postboxID != id {
+					lookup.postboxes = append(lookup.postboxes, postboxID)
+				}
+			}
+		}
+	}
+	p.mu.Lock()
+	p.lookups[id] = lookup
+	p.mu.Unlock()
+	return lookup.postboxes
+}
+
+// hold asks the postbox peers of a node that we can't reach to hold a
+// transaction for it, stopping at the first that takes it.
+func (p *postbox) hold(ctx context.Context, to peer.ID, txn mailboxRequest) error {
+	postboxes := p.lookup(ctx, to)
+	if len(postboxes) == 0 {
+		return errors.New("the node has no postbox peers")
+	}
+	err := errors.New("no postbox peer took the transaction")
+	for _, id := range postboxes {
+		if id == p.host.ID() {
+			// We are one of its postbox peers ourselves.
+			if err = p.store(ctx, to, p.host.ID(), &txn); err == nil {
+				return nil
+			}
+			continue
+		}
+		req := postboxRequest{Op: postboxHold, To: to.Pretty(), Transaction: &txn}
+		if _, err = p.request(ctx, id, &req); err == nil {
+			logrus.WithFields(logrus.Fields{"peer": to.String(), "postbox": id.String()}).Info(
+				"Left transaction for unreachable node with its postbox peer",
+			)
+			return nil
+		}
+	}
+	return err
+}
+
+// drainAll drains every one of our postbox peers.
+func (p *postbox) drainAll(ctx context.Context) {
+	if p.handler == nil {
+		return
+	}
+	for _, id := range p.postboxes {
+		if err := p.drain(ctx, id); err != nil {
+			logrus.WithError(err).WithField("postbox", id.String()).Debug("Failed to drain postbox peer")
+		}
+	}
+}
+
+// drain fetches the transactions that a postbox peer holds for us, passes
+// them to the federation API, and acknowledges them so that the peer can
+// forget them, until the peer holds no more.
+func (p *postbox) drain(ctx context.Context, id peer.ID) error {
+	for {
+		res, err := p.request(ctx, id, &postboxRequest{Op: postboxDrain})
+		if err != nil {
+			return err
+		}
+		if len(res.Items) == 0 {
+			return nil
+		}
+		ids := make([]int64, 0, len(res.Items))
+		byOrigin := make(map[peer.ID][]mailboxRequest)
+		for _, item := range res.Items {
+			ids = append(ids, item.ID)
+			origin, err := peer.IDB58Decode(item.Origin)
+			if err != nil {
+				continue
+			}
+			byOrigin[origin] = append(byOrigin[origin], item.Transaction)
+		}
+		for origin, txns := range byOrigin {
+			if err = replayTransactions(ctx, p.handler, p.keyDB, origin, txns); err != nil {
+				return err
+			}
+		}
+		logrus.WithFields(logrus.Fields{"postbox": id.String(), "transactions": len(ids)}).Info(
+			"Drained transactions from postbox peer",
+		)
+		if _, err = p.request(ctx, id, &postboxRequest{Op: postboxAck, IDs: ids}); err != nil {
+			return err
+		}
+		if len(res.Items) < PostboxDrainBatch {
+			return nil
+		}
+	}
+}
+
+// request sends a request to a postbox peer, connecting to it first if need
+// be, and returns its response.
+func (p *postbox) request(ctx context.Context, id peer.ID, req *postboxRequest) (*postboxResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, PostboxTimeout)
+	defer cancel()
+	if err := p.resolver.resolve(ctx, id); err != nil {
+		return nil, err
+	}
+	s, err := p.host.NewStream(ctx, id, PostboxProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Reset() // nolint: errcheck
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+	if err = json.NewEncoder(s).Encode(req); err != nil {
+		return nil, err
+	}
+	// Closing only closes our end, so that the peer knows that we're done.
+	if err = s.Close(); err != nil {
+		return nil, err
+	}
+	var res postboxResponse
+	if err = json.NewDecoder(io.LimitReader(s, PostboxMaxSize)).Decode(&res); err != nil {
+		return nil, err
+	}
+	if res.ErrCode != "" {
+		return nil, &res.MatrixError
+	}
+	return &res, nil
+}
+
+// handleStream answers a request from another node: to hold a transaction
+// for one of the nodes that trust us, or from such a node to drain or
+// acknowledge what we hold for it.
+func (p *postbox) handleStream(s network.Stream) {
+	defer s.Close() // nolint: errcheck
+	_ = s.SetDeadline(time.Now().Add(PostboxTimeout))
+	from := s.Conn().RemotePeer()
+	logger := logrus.WithField("peer", from.String())
+	ctx, cancel := context.WithTimeout(context.Background(), PostboxTimeout)
+	defer cancel()
+
+	var res postboxResponse
+	var req postboxRequest
+	if err := json.NewDecoder(io.LimitReader(s, PostboxMaxSize)).Decode(&req); err != nil {
+		res.MatrixError = *jsonerror.BadJSON(err.Error())
+	} else if err = p.answer(ctx, from, &req, &res); err != nil {
+		logger.WithError(err).WithField("op", req.Op).Warn("Failed to answer postbox request")
+		if matrixErr, ok := err.(*jsonerror.MatrixError); ok {
+			res.MatrixError = *matrixErr
+		} else {
+			res.MatrixError = *jsonerror.Unknown("Internal server error")
+		}
+	}
+	if err := json.NewEncoder(s).Encode(&res); err != nil {
+		logger.WithError(err).Debug("Failed to answer postbox request")
+	}
+}
+
+func (p *postbox) answer(ctx context.Context, from peer.ID, req *postboxRequest, res *postboxResponse) error {
+	switch req.Op {
+	case postboxHold:
+		to, err := peer.IDB58Decode(req.To)
+		if err != nil {
+			return jsonerror.InvalidArgumentValue("Invalid recipient")
+		}
+		if _, ok := p.clients[to]; !ok {
+			return jsonerror.Forbidden("We aren't a postbox peer of the recipient")
+		}
+		if req.Transaction == nil || !strings.HasPrefix(req.Transaction.Path, SendFederationPathPrefix) {
+			return jsonerror.InvalidArgumentValue("Only transactions can be held")
+		}
+		return p.store(ctx, to, from, req.Transaction)
+	case postboxDrain, postboxAck:
+		if _, ok := p.clients[from]; !ok {
+			return jsonerror.Forbidden("We aren't a postbox peer of yours")
+		}
+		if req.Op == postboxAck {
+			_, err := p.db.ExecContext(ctx, deletePostboxSQL, from.Pretty(), pq.Int64Array(req.IDs))
+			return err
+		}
+		items, err := p.held(ctx, from)
+		res.Items = items
+		return err
+	default:
+		return jsonerror.InvalidArgumentValue("Unknown postbox operation")
+	}
+}
+
+// store holds a transaction from a node for one of the nodes that trust us.
+func (p *postbox) store(ctx context.Context, to, origin peer.ID, txn *mailboxRequest) error {
+	data, err := json.Marshal(txn)
+	if err != nil {
+		return err
+	}
+	if _, err = p.db.ExecContext(ctx, insertPostboxSQL, to.Pretty(), origin.Pretty(), string(data)); err != nil {
+		return err
+	}
+	_, err = p.db.ExecContext(ctx, prunePostboxSQL, to.Pretty(), PostboxMaxHeld)
+	return err
+}
+
+// held returns the oldest transactions that we hold for a node.
+func (p *postbox) held(ctx context.Context, to peer.ID) ([]postboxItem, error) {
+	rows, err := p.db.QueryContext(ctx, selectPostboxSQL, to.Pretty(), PostboxDrainBatch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	var items []postboxItem
+	for rows.Next() {
+		var item postboxItem
+		var data string
+		if err = rows.Scan(&item.ID, &item.Origin, &data); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(data), &item.Transaction); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
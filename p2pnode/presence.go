@@ -0,0 +1,413 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// MPresence is the type of presence EDUs and of the presence events in /sync.
+const MPresence = "m.presence"
+
+// PresenceClientPathPrefix starts the client API for the presence of a user.
+// The user ID and then "/status" follow it.
+const PresenceClientPathPrefix = "/_matrix/client/r0/presence/"
+
+// PresenceOfflineTimeout is how long after they last called /sync one of our
+// users is marked as offline. Clients long-poll /sync every 30 seconds or so
+// for as long as they are running.
+const PresenceOfflineTimeout = time.Minute * 2
+
+// PresenceRefreshInterval is how often the presence of our users is sent
+// again while they are online, so that servers which missed it catch up.
+const PresenceRefreshInterval = time.Minute * 5
+
+// PresenceRemoteTimeout is how long a user from another server stays online
+// without us hearing from their server, which may have gone away without
+// saying so.
+const PresenceRemoteTimeout = PresenceRefreshInterval * 3
+
+// PresenceCheckInterval is how often users are checked for having timed out.
+const PresenceCheckInterval = time.Second * 30
+
+const (
+	presenceOnline      = "online"
+	presenceUnavailable = "unavailable"
+	presenceOffline     = "offline"
+)
+
+// presenceContent is the content of an m.presence EDU.
+type presenceContent struct {
+	Push []presenceUpdate `json:"push"`
+}
+
+// presenceUpdate is the presence of one user, as sent between servers.
+type presenceUpdate struct {
+	UserID          string `json:"user_id"`
+	Presence        string `json:"presence"`
+	StatusMsg       string `json:"status_msg,omitempty"`
+	LastActiveAgo   int64  `json:"last_active_ago"`
+	CurrentlyActive bool   `json:"currently_active"`
+}
+
+// presenceEventContent is the content of an m.presence event, as sent to
+// clients.
+type presenceEventContent struct {
+	Presence        string `json:"presence"`
+	StatusMsg       string `json:"status_msg,omitempty"`
+	LastActiveAgo   int64  `json:"last_active_ago,omitempty"`
+	CurrentlyActive bool   `json:"currently_active"`
+}
+
+// presenceEvent is an m.presence event in the presence section of /sync.
+type presenceEvent struct {
+	Type    string               `json:"type"`
+	Sender  string               `json:"sender"`
+	Content presenceEventContent `json:"content"`
+}
+
+// presenceState is what we know about the presence of a user.
+type presenceState struct {
+	presence   string
+	statusMsg  string
+	lastActive time.Time
+	// heard is when one of our users last called /sync, or when the server
+	// of a remote user last told us about them.
+	heard time.Time
+	// published is when the presence of one of our users was last sent.
+	published time.Time
+	// version is the value of presenceTracker.version when the presence or
+	// status message last changed.
+	version int64
+}
+
+// content returns the presence of the user as sent to clients.
+func (s *presenceState) content() presenceEventContent {
+	c := presenceEventContent{
+		Presence:        s.presence,
+		StatusMsg:       s.statusMsg,
+		CurrentlyActive: s.presence == presenceOnline,
+	}
+	if !s.lastActive.IsZero() {
+		c.LastActiveAgo = int64(time.Since(s.lastActive) / time.Millisecond)
+	}
+	return c
+}
+
+// update returns the presence of the user as sent to other servers.
+func (s *presenceState) update(userID string) presenceUpdate {
+	c := s.content()
+	return presenceUpdate{
+		UserID:          userID,
+		Presence:        c.Presence,
+		StatusMsg:       c.StatusMsg,
+		LastActiveAgo:   c.LastActiveAgo,
+		CurrentlyActive: c.CurrentlyActive,
+	}
+}
+
+// presenceTracker keeps the presence of our own users, which is driven by
+// their calls to /sync, and of the users on other servers that we share
+// rooms with, which is gossiped along with the other ephemeral events of
+// those rooms. Nothing is stored, so everyone starts off offline.
+type presenceTracker struct {
+	serverName  gomatrixserverlib.ServerName
+	memberships *RoomMemberships
+	edus        *eduGossip
+	authData    auth.Data
+
+	mu    sync.Mutex
+	users map[string]*presenceState
+	// version goes up whenever the presence of any user changes.
+	version int64
+	// delivered holds the version that each device has been sent presence up
+	// to in /sync, by user ID and device ID.
+	delivered map[string]int64
+}
+
+func newPresenceTracker(serverName gomatrixserverlib.ServerName, memberships *RoomMemberships, authData auth.Data) *presenceTracker {
+	return &presenceTracker{
+		serverName:  serverName,
+		memberships: memberships,
+		authData:    authData,
+		users:       make(map[string]*presenceState),
+		delivered:   make(map[string]int64),
+	}
+}
+
+// setup registers the client API for presence.
+func (p *presenceTracker) setup(mux *http.ServeMux) {
+	mux.Handle(PresenceClientPathPrefix, common.WrapHandlerInCORS(common.MakeAuthAPI("presence", p.authData,
+		func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			userID := strings.TrimPrefix(req.URL.Path, PresenceClientPathPrefix)
+			if !strings.HasSuffix(userID, "/status") {
+				return util.JSONResponse{
+					Code: http.StatusNotFound,
+					JSON: jsonerror.NotFound("Unknown presence API"),
+				}
+			}
+			userID = strings.TrimSuffix(userID, "/status")
+			if req.Method == http.MethodPut {
+				return p.putStatus(req, device, userID)
+			}
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			state := p.users[userID]
+			if state == nil {
+				return util.JSONResponse{
+					Code: http.StatusNotFound,
+					JSON: jsonerror.NotFound("Presence of the user is unknown"),
+				}
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: state.content()}
+		},
+	)))
+}
+
+// putStatus sets the presence of one of our users.
+func (p *presenceTracker) putStatus(req *http.Request, device *authtypes.Device, userID string) util.JSONResponse {
+	if userID != device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You can only set your own presence"),
+		}
+	}
+	var body struct {
+		Presence  string `json:"presence"`
+		StatusMsg string `json:"status_msg"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if !validPresence(body.Presence) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("presence must be online, unavailable or offline"),
+		}
+	}
+	p.setLocal(userID, body.Presence, &body.StatusMsg)
+	return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+}
+
+// wrapSync marks the user calling /sync as active, with the presence that
+// they asked for, and adds the presence of the users that they share rooms
+// with to the response. Presence that changes while a /sync is waiting for
+// events doesn't wake it, so it is sent with the next response instead.
+func (p *presenceTracker) wrapSync(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		device, req := syncDevice(req, p.authData)
+		if device == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		presence := req.URL.Query().Get("set_presence")
+		if !validPresence(presence) {
+			presence = presenceOnline
+		}
+		if presence != presenceOffline {
+			p.setLocal(device.UserID, presence, nil)
+		}
+
+		rec := &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+		next.ServeHTTP(rec, req)
+		var res map[string]json.RawMessage
+		if rec.code != http.StatusOK || json.Unmarshal(rec.body.Bytes(), &res) != nil {
+			rec.writeTo(w)
+			return
+		}
+		initial := req.URL.Query().Get("since") == ""
+		events := p.syncEvents(device.UserID, device.ID, initial)
+		if len(events) == 0 {
+			rec.writeTo(w)
+			return
+		}
+		var err error
+		if res["presence"], err = json.Marshal(map[string]interface{}{"events": events}); err != nil {
+			rec.writeTo(w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	})
+}
+
+// syncEvents returns the presence of the users that the device hasn't been
+// sent yet, out of those that share a room with its user.
+func (p *presenceTracker) syncEvents(userID, deviceID string, initial bool) []presenceEvent {
+	users := p.memberships.SharedUsers(userID)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := userID + "/" + deviceID
+	since := p.delivered[key]
+	if initial {
+		since = 0
+	}
+	p.delivered[key] = p.version
+	var events []presenceEvent
+	for member := range users {
+		if state := p.users[member]; state != nil && state.version > since {
+			events = append(events, presenceEvent{
+				Type:    MPresence,
+				Sender:  member,
+				Content: state.content(),
+			})
+		}
+	}
+	return events
+}
+
+// setLocal records the activity of one of our users, along with a new status
+// message if there is one, and sends their presence on if it changed or if
+// it hasn't been sent for a while.
+func (p *presenceTracker) setLocal(userID, presence string, statusMsg *string) {
+	now := time.Now()
+	p.mu.Lock()
+	state := p.stateLocked(userID)
+	state.heard = now
+	if presence == presenceOnline {
+		state.lastActive = now
+	}
+	changed := state.presence != presence
+	state.presence = presence
+	if statusMsg != nil && *statusMsg != state.statusMsg {
+		state.statusMsg = *statusMsg
+		changed = true
+	}
+	if changed {
+		p.version++
+		state.version = p.version
+	}
+	publish := changed || now.Sub(state.published) >= PresenceRefreshInterval
+	if publish {
+		state.published = now
+	}
+	update := state.update(userID)
+	p.mu.Unlock()
+
+	if publish {
+		p.publish(update)
+	}
+}
+
+// onRemote records the presence of a user on another server.
+func (p *presenceTracker) onRemote(update presenceUpdate) {
+	if !validPresence(update.Presence) {
+		return
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state := p.stateLocked(update.UserID)
+	state.heard = now
+	state.lastActive = now.Add(-time.Duration(update.LastActiveAgo) * time.Millisecond)
+	if state.presence != update.Presence || state.statusMsg != update.StatusMsg {
+		state.presence = update.Presence
+		state.statusMsg = update.StatusMsg
+		p.version++
+		state.version = p.version
+	}
+}
+
+// start marks users as offline once they time out, until the context is
+// done.
+func (p *presenceTracker) start(ctx context.Context) {
+	ticker := time.NewTicker(PresenceCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.expire()
+		}
+	}
+}
+
+// expire marks our users who have stopped calling /sync as offline, as well
+// as the users from other servers that we haven't heard about for too long.
+func (p *presenceTracker) expire() {
+	var updates []presenceUpdate
+	p.mu.Lock()
+	for userID, state := range p.users {
+		if state.presence == presenceOffline {
+			continue
+		}
+		timeout := PresenceRemoteTimeout
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		local := err == nil && domain == p.serverName
+		if local {
+			timeout = PresenceOfflineTimeout
+		}
+		if time.Since(state.heard) < timeout {
+			continue
+		}
+		state.presence = presenceOffline
+		p.version++
+		state.version = p.version
+		if local {
+			state.published = time.Now()
+			updates = append(updates, state.update(userID))
+		}
+	}
+	p.mu.Unlock()
+
+	for _, update := range updates {
+		p.publish(update)
+	}
+}
+
+// publish sends the presence of one of our users to every room that they
+// are in.
+func (p *presenceTracker) publish(update presenceUpdate) {
+	roomIDs := p.memberships.UserRooms(update.UserID)
+	if len(roomIDs) == 0 || p.edus == nil {
+		return
+	}
+	edu := gomatrixserverlib.EDU{Type: MPresence}
+	var err error
+	if edu.Content, err = json.Marshal(presenceContent{Push: []presenceUpdate{update}}); err != nil {
+		logrus.WithError(err).Error("Failed to encode presence")
+		return
+	}
+	p.edus.sendToRooms(roomIDs, &edu)
+}
+
+func (p *presenceTracker) stateLocked(userID string) *presenceState {
+	state := p.users[userID]
+	if state == nil {
+		state = &presenceState{presence: presenceOffline}
+		p.users[userID] = state
+	}
+	return state
+}
+
+func validPresence(presence string) bool {
+	return presence == presenceOnline || presence == presenceUnavailable || presence == presenceOffline
+}
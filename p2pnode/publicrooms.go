@@ -0,0 +1,376 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/publicroomsapi/storage/postgres"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// PublicRoomsClientPath is the client API for the room directory, which
+	// also lists the directories of the peers that we are connected to.
+	PublicRoomsClientPath = "/_matrix/client/r0/publicRooms"
+	// PublicRoomsFederationPath is where other nodes fetch our directory.
+	PublicRoomsFederationPath = "/_matrix/federation/v1/publicRooms"
+)
+
+// PublicRoomsFanoutPeers is the most peers that the directory of each is
+// fetched from for a single /publicRooms request.
+const PublicRoomsFanoutPeers = 20
+
+// PublicRoomsFanoutTimeout is how long a /publicRooms request waits for the
+// directories of peers. Peers that don't answer in time are left out.
+const PublicRoomsFanoutTimeout = time.Second * 5
+
+// PublicRoomsCacheTime is how long the directory of a peer is kept for
+// before it is fetched again. Failures are kept for as long, so that a
+// broken peer doesn't slow down every request.
+const PublicRoomsCacheTime = time.Minute
+
+// publicRoom is a room in a directory, with its type so that spaces can be
+// told apart from other rooms.
+type publicRoom struct {
+	gomatrixserverlib.PublicRoom
+	RoomType string `json:"room_type,omitempty"`
+}
+
+// publicRoomsResponse is a page of a directory.
+type publicRoomsResponse struct {
+	Chunk                  []publicRoom `json:"chunk"`
+	NextBatch              string       `json:"next_batch,omitempty"`
+	PrevBatch              string       `json:"prev_batch,omitempty"`
+	TotalRoomCountEstimate int          `json:"total_room_count_estimate,omitempty"`
+}
+
+// peerDirectory is the directory of a peer, as it was when we fetched it.
+type peerDirectory struct {
+	fetched time.Time
+	rooms   []publicRoom
+}
+
+// publicRoomsFanout merges the directories of our peers into the first page
+// of /publicRooms, and serves our own directory to them over federation.
+type publicRoomsFanout struct {
+	host       host.Host
+	federation *gomatrixserverlib.FederationClient
+	cfg        *config.Dendrite
+	db         *postgres.PublicRoomsServerDatabase
+	spaces     *spaces
+	gossip     *roomDirectoryGossip
+
+	mu    sync.Mutex
+	cache map[peer.ID]peerDirectory
+}
+
+func newPublicRoomsFanout(p2pHost host.Host, federation *gomatrixserverlib.FederationClient, cfg *config.Dendrite) (*publicRoomsFanout, error) {
+	// The public rooms API has its own handle on the database, but doesn't
+	// share it, so we open another.
+	db, err := postgres.NewPublicRoomsServerDatabase(string(cfg.Database.PublicRoomsAPI))
+	if err != nil {
+		return nil, err
+	}
+	return &publicRoomsFanout{
+		host:       p2pHost,
+		federation: federation,
+		cfg:        cfg,
+		db:         db,
+		cache:      make(map[peer.ID]peerDirectory),
+	}, nil
+}
+
+// setup registers the client API, which wraps the one from the public rooms
+// API, and the federation API.
+func (f *publicRoomsFanout) setup(mux *http.ServeMux, apiMux http.Handler, serverName gomatrixserverlib.ServerName, keyRing gomatrixserverlib.KeyRing) {
+	mux.Handle(PublicRoomsClientPath, common.WrapHandlerInCORS(f.wrap(apiMux)))
+	mux.Handle(PublicRoomsFederationPath, common.MakeFedAPI("federation_public_rooms", serverName, keyRing,
+		func(req *http.Request, _ *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			return f.serveFederation(req)
+		},
+	))
+}
+
+// serveFederation serves the rooms that were made public on this node.
+func (f *publicRoomsFanout) serveFederation(req *http.Request) util.JSONResponse {
+	limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+	offset, _ := strconv.ParseInt(req.URL.Query().Get("since"), 10, 64)
+	if limit < 0 || limit > 1024 {
+		limit = 1024
+	}
+	count, err := f.db.CountPublicRooms(req.Context())
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	rooms, err := f.rooms(req.Context(), offset, int16(limit))
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	res := publicRoomsResponse{
+		Chunk:                  rooms,
+		TotalRoomCountEstimate: int(count),
+	}
+	if offset > 0 {
+		res.PrevBatch = strconv.FormatInt(offset-1, 10)
+	}
+	if next := offset + int64(len(rooms)); limit > 0 && count > next {
+		res.NextBatch = strconv.FormatInt(next, 10)
+	}
+	return util.JSONResponse{Code: http.StatusOK, JSON: res}
+}
+
+// rooms returns a page of the rooms that were made public on this node.
+func (f *publicRoomsFanout) rooms(ctx context.Context, offset int64, limit int16) ([]publicRoom, error) {
+	rooms, err := f.db.GetPublicRooms(ctx, offset, limit, "")
+	if err != nil {
+		return nil, err
+	}
+	roomIDs := make([]string, len(rooms))
+	for i := range rooms {
+		roomIDs[i] = rooms[i].RoomID
+	}
+	roomTypes := f.spaces.roomTypes(ctx, roomIDs)
+	chunk := []publicRoom{}
+	for _, room := range rooms {
+		chunk = append(chunk, publicRoom{RoomType: roomTypes[room.RoomID], PublicRoom: gomatrixserverlib.PublicRoom{
+			Aliases:            room.Aliases,
+			CanonicalAlias:     room.CanonicalAlias,
+			Name:               room.Name,
+			JoinedMembersCount: int(room.NumJoinedMembers),
+			RoomID:             room.RoomID,
+			Topic:              room.Topic,
+			WorldReadable:      room.WorldReadable,
+			GuestCanJoin:       room.GuestCanJoin,
+			AvatarURL:          room.AvatarURL,
+		}})
+	}
+	return chunk, nil
+}
+
+// localRooms returns all of the rooms that were made public on this node.
+func (f *publicRoomsFanout) localRooms(ctx context.Context) ([]publicRoom, error) {
+	return f.rooms(ctx, 0, 1024)
+}
+
+// wrap adds the directories of our peers, and the rooms gossiped by other
+// nodes, to the first page of the response from the public rooms API. Later
+// pages are left alone, as their pagination tokens are offsets into the
+// local directory.
+func (f *publicRoomsFanout) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body []byte
+		var request struct {
+			Since  string `json:"since"`
+			Filter struct {
+				SearchTerms string `json:"generic_search_term"`
+			} `json:"filter"`
+		}
+		switch req.Method {
+		case http.MethodGet:
+			request.Since = req.URL.Query().Get("since")
+		case http.MethodPost:
+			var err error
+			if body, err = ioutil.ReadAll(req.Body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			_ = json.Unmarshal(body, &request)
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		if request.Since != "" || (req.Method != http.MethodGet && req.Method != http.MethodPost) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		// Fetch from peers while the public rooms API is answering.
+		peerRooms := make(chan []publicRoom, 1)
+		go func() {
+			peerRooms <- f.peerRooms(req.Context())
+		}()
+		rec := &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+		next.ServeHTTP(rec, req)
+		var res publicRoomsResponse
+		if rec.code != http.StatusOK || json.Unmarshal(rec.body.Bytes(), &res) != nil {
+			rec.writeTo(w)
+			return
+		}
+
+		seen := make(map[string]bool, len(res.Chunk))
+		roomIDs := make([]string, len(res.Chunk))
+		for i, room := range res.Chunk {
+			seen[room.RoomID] = true
+			roomIDs[i] = room.RoomID
+		}
+		roomTypes := f.spaces.roomTypes(req.Context(), roomIDs)
+		for i := range res.Chunk {
+			res.Chunk[i].RoomType = roomTypes[res.Chunk[i].RoomID]
+		}
+		for _, room := range append(<-peerRooms, f.gossip.rooms(time.Now())...) {
+			if !seen[room.RoomID] && matchesSearch(&room.PublicRoom, request.Filter.SearchTerms) {
+				seen[room.RoomID] = true
+				res.Chunk = append(res.Chunk, room)
+			}
+		}
+		if len(seen) > res.TotalRoomCountEstimate {
+			res.TotalRoomCountEstimate = len(seen)
+		}
+		if res.Chunk == nil {
+			res.Chunk = []publicRoom{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	})
+}
+
+// peerRooms returns the rooms in the directories of the Matrix nodes that we
+// are connected to, fetching those that aren't cached.
+func (f *publicRoomsFanout) peerRooms(ctx context.Context) []publicRoom {
+	ctx, cancel := context.WithTimeout(ctx, PublicRoomsFanoutTimeout)
+	defer cancel()
+
+	var peers []peer.ID
+	for _, id := range f.host.Network().Peers() {
+		if protos, err := f.host.Peerstore().SupportsProtocols(id, MatrixProtocol); err == nil && len(protos) > 0 {
+			peers = append(peers, id)
+		}
+		if len(peers) == PublicRoomsFanoutPeers {
+			break
+		}
+	}
+
+	results := make(chan []publicRoom, len(peers))
+	for _, id := range peers {
+		go func(id peer.ID) {
+			results <- f.directory(ctx, id)
+		}(id)
+	}
+	var rooms []publicRoom
+	for range peers {
+		select {
+		case r := <-results:
+			rooms = append(rooms, r...)
+		case <-ctx.Done():
+			return rooms
+		}
+	}
+	return rooms
+}
+
+// directory returns the directory of a peer, from the cache if it is recent
+// enough.
+func (f *publicRoomsFanout) directory(ctx context.Context, id peer.ID) []publicRoom {
+	f.mu.Lock()
+	cached, ok := f.cache[id]
+	f.mu.Unlock()
+	if ok && time.Since(cached.fetched) < PublicRoomsCacheTime {
+		return cached.rooms
+	}
+	res, err := f.requestDirectory(ctx, peerServerName(id))
+	if err != nil {
+		logrus.WithError(err).WithField("peer", id.String()).Debug("Failed to fetch public rooms of peer")
+		if ctx.Err() != nil {
+			// We gave up waiting, but it may well answer next time.
+			return nil
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for cachedID, d := range f.cache {
+		if time.Since(d.fetched) >= PublicRoomsCacheTime {
+			delete(f.cache, cachedID)
+		}
+	}
+	f.cache[id] = peerDirectory{fetched: time.Now(), rooms: res.Chunk}
+	return res.Chunk
+}
+
+// requestDirectory fetches the directory of another server. It is done by
+// hand, rather than with the federation client, to keep the room types.
+func (f *publicRoomsFanout) requestDirectory(ctx context.Context, server gomatrixserverlib.ServerName) (res publicRoomsResponse, err error) {
+	fedReq := gomatrixserverlib.NewFederationRequest("GET", server, PublicRoomsFederationPath+"?limit=0")
+	if err = fedReq.Sign(f.cfg.Matrix.ServerName, f.cfg.Matrix.KeyID, f.cfg.Matrix.PrivateKey); err != nil {
+		return
+	}
+	req, err := fedReq.HTTPRequest()
+	if err != nil {
+		return
+	}
+	err = f.federation.DoRequestAndParseResponse(ctx, req, &res)
+	return
+}
+
+// matchesSearch returns whether the room matches the search term of a
+// /publicRooms filter, in the same places that the public rooms API looks.
+func matchesSearch(room *gomatrixserverlib.PublicRoom, term string) bool {
+	if term == "" {
+		return true
+	}
+	term = strings.ToLower(term)
+	fields := append([]string{room.Name, room.Topic, room.CanonicalAlias}, room.Aliases...)
+	for _, field := range fields {
+		if strings.Contains(strings.ToLower(field), term) {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedResponse is an http.ResponseWriter that keeps the response, so
+// that it can be changed before it is written out.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+// Header implements http.ResponseWriter
+func (r *bufferedResponse) Header() http.Header {
+	return r.header
+}
+
+// WriteHeader implements http.ResponseWriter
+func (r *bufferedResponse) WriteHeader(code int) {
+	r.code = code
+}
+
+// Write implements http.ResponseWriter
+func (r *bufferedResponse) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+// writeTo writes the response out unchanged.
+func (r *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for k, v := range r.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(r.code)
+	_, _ = w.Write(r.body.Bytes())
+}
@@ -0,0 +1,492 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+const (
+	// PushersClientPath is where clients list the pushers of their user.
+	PushersClientPath = "/_matrix/client/r0/pushers"
+	// PushersSetClientPath is where clients add, change and remove pushers.
+	PushersSetClientPath = "/_matrix/client/r0/pushers/set"
+)
+
+// PushProtocol is the libp2p protocol that notifications are sent to
+// companion apps on, for pushers with a libp2p URL such as
+// libp2p://QmPeerID. The node sends the same JSON body as it would POST to a
+// push gateway, closes its end, and reads the gateway's response.
+const PushProtocol = "/matrix/push"
+
+// LibP2PPushScheme is the URL scheme of pushers that are sent notifications
+// over libp2p instead of HTTP. The host is the peer ID of the companion app.
+const LibP2PPushScheme = "libp2p"
+
+// PushSendTimeout is how long sending a notification to a push gateway or a
+// companion app may take.
+const PushSendTimeout = time.Second * 10
+
+// PushMaxResponseSize is the most that is read of a gateway's response.
+const PushMaxResponseSize = 1 << 16
+
+const pushersSchema = `
+-- The pushers of our users. Each one gets a notification for every event
+-- that the user should be told about.
+CREATE TABLE IF NOT EXISTS p2p_pushers (
+    user_id TEXT NOT NULL,
+    app_id TEXT NOT NULL,
+    pushkey TEXT NOT NULL,
+    pushkey_ts BIGINT NOT NULL,
+    kind TEXT NOT NULL,
+    app_display_name TEXT NOT NULL,
+    device_display_name TEXT NOT NULL,
+    profile_tag TEXT NOT NULL,
+    lang TEXT NOT NULL,
+    data TEXT NOT NULL,
+    PRIMARY KEY (app_id, pushkey, user_id)
+);
+`
+
+const upsertPusherSQL = "" +
+	"INSERT INTO p2p_pushers (user_id, app_id, pushkey, pushkey_ts, kind, app_display_name, device_display_name, profile_tag, lang, data)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)" +
+	" ON CONFLICT (app_id, pushkey, user_id) DO UPDATE SET kind = $5, app_display_name = $6," +
+	" device_display_name = $7, profile_tag = $8, lang = $9, data = $10"
+
+const selectPushersSQL = "" +
+	"SELECT app_id, pushkey, pushkey_ts, kind, app_display_name, device_display_name, profile_tag, lang, data" +
+	" FROM p2p_pushers WHERE user_id = $1"
+
+const deletePusherSQL = "" +
+	"DELETE FROM p2p_pushers WHERE user_id = $1 AND app_id = $2 AND pushkey = $3"
+
+// Without append, a pushkey belongs to one user only.
+const deleteOtherPushersSQL = "" +
+	"DELETE FROM p2p_pushers WHERE user_id <> $1 AND app_id = $2 AND pushkey = $3"
+
+// pusher is a pusher as clients set and list it.
+type pusher struct {
+	AppID             string          `json:"app_id"`
+	PushKey           string          `json:"pushkey"`
+	PushKeyTS         int64           `json:"pushkey_ts,omitempty"`
+	Kind              *string         `json:"kind"`
+	AppDisplayName    string          `json:"app_display_name"`
+	DeviceDisplayName string          `json:"device_display_name"`
+	ProfileTag        string          `json:"profile_tag,omitempty"`
+	Lang              string          `json:"lang"`
+	Data              json.RawMessage `json:"data"`
+}
+
+// pusherData is the part of a pusher's data that the node itself uses.
+type pusherData struct {
+	URL    string `json:"url"`
+	Format string `json:"format,omitempty"`
+}
+
+// pushDevice is a pusher in a notification to a push gateway.
+type pushDevice struct {
+	AppID     string                 `json:"app_id"`
+	PushKey   string                 `json:"pushkey"`
+	PushKeyTS int64                  `json:"pushkey_ts,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	Tweaks    map[string]interface{} `json:"tweaks,omitempty"`
+}
+
+// pushNotification is the body of a notification to a push gateway.
+type pushNotification struct {
+	Notification struct {
+		EventID      string          `json:"event_id,omitempty"`
+		RoomID       string          `json:"room_id,omitempty"`
+		Type         string          `json:"type,omitempty"`
+		Sender       string          `json:"sender,omitempty"`
+		Content      json.RawMessage `json:"content,omitempty"`
+		UserIsTarget bool            `json:"user_is_target,omitempty"`
+		Prio         string          `json:"prio,omitempty"`
+		Devices      []pushDevice    `json:"devices"`
+	} `json:"notification"`
+}
+
+// pushGatewayResponse is the response of a push gateway, holding the
+// pushkeys that it won't send to any more.
+type pushGatewayResponse struct {
+	Rejected []string `json:"rejected"`
+}
+
+// pushers stores the pushers of our users and sends them notifications of
+// new events in their rooms. Dendrite has no push support, and always serves
+// empty push rules, so the node notifies of what the default rules would:
+// messages and encrypted events from other users, and invites. Pushers are
+// sent notifications over HTTP to a push gateway, or over libp2p to a
+// companion app.
+type pushers struct {
+	db          *sql.DB
+	host        host.Host
+	resolver    *resolverTransport
+	client      *http.Client
+	authData    auth.Data
+	memberships *RoomMemberships
+	serverName  gomatrixserverlib.ServerName
+	startedAt   time.Time
+}
+
+func newPushers(
+	dataSourceName string, p2pHost host.Host, resolver *resolverTransport,
+	authData auth.Data, memberships *RoomMemberships, serverName gomatrixserverlib.ServerName,
+) (*pushers, error) {
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(pushersSchema); err != nil {
+		return nil, err
+	}
+	return &pushers{
+		db:          db,
+		host:        p2pHost,
+		resolver:    resolver,
+		client:      &http.Client{Timeout: PushSendTimeout},
+		authData:    authData,
+		memberships: memberships,
+		serverName:  serverName,
+	}, nil
+}
+
+// setup registers the client APIs.
+func (p *pushers) setup(mux *http.ServeMux) {
+	mux.Handle(PushersClientPath, common.WrapHandlerInCORS(common.MakeAuthAPI("pushers", p.authData,
+		func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			if req.Method != http.MethodGet {
+				return util.JSONResponse{Code: http.StatusMethodNotAllowed, JSON: jsonerror.NotFound("Bad method")}
+			}
+			userPushers, err := p.userPushers(req.Context(), device.UserID)
+			if err != nil {
+				return httputil.LogThenError(req, err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: map[string][]pusher{"pushers": userPushers}}
+		},
+	)))
+	mux.Handle(PushersSetClientPath, common.WrapHandlerInCORS(common.MakeAuthAPI("pushers_set", p.authData,
+		func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			if req.Method != http.MethodPost {
+				return util.JSONResponse{Code: http.StatusMethodNotAllowed, JSON: jsonerror.NotFound("Bad method")}
+			}
+			return p.set(req, device)
+		},
+	)))
+}
+
+// set adds, changes or removes a pusher of the user. A pusher with a null
+// kind is removed.
+func (p *pushers) set(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	var body struct {
+		pusher
+		Append bool `json:"append"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if body.AppID == "" || body.PushKey == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("The app_id and pushkey are needed"),
+		}
+	}
+	ctx := req.Context()
+	if body.Kind == nil {
+		if _, err := p.db.ExecContext(ctx, deletePusherSQL, device.UserID, body.AppID, body.PushKey); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	}
+	if *body.Kind != "http" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Only http pushers are supported"),
+		}
+	}
+	var data pusherData
+	if err := json.Unmarshal(body.Data, &data); err != nil {
+		return util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.BadJSON(err.Error())}
+	}
+	if err := validPushURL(data.URL); err != nil {
+		return util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.InvalidArgumentValue(err.Error())}
+	}
+	if !body.Append {
+		if _, err := p.db.ExecContext(ctx, deleteOtherPushersSQL, device.UserID, body.AppID, body.PushKey); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+	}
+	_, err := p.db.ExecContext(
+		ctx, upsertPusherSQL, device.UserID, body.AppID, body.PushKey, time.Now().Unix(), *body.Kind,
+		body.AppDisplayName, body.DeviceDisplayName, body.ProfileTag, body.Lang, string(body.Data),
+	)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+}
+
+// validPushURL checks that a pusher's URL is one that we can send to.
+func validPushURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" {
+			return fmt.Errorf("the push gateway URL has no host")
+		}
+	case LibP2PPushScheme:
+		if _, err = peer.IDB58Decode(u.Host); err != nil {
+			return fmt.Errorf("the host of a libp2p URL must be a peer ID")
+		}
+	default:
+		return fmt.Errorf("the URL must be http, https or %s", LibP2PPushScheme)
+	}
+	return nil
+}
+
+// userPushers returns the pushers of one of our users.
+func (p *pushers) userPushers(ctx context.Context, userID string) ([]pusher, error) {
+	rows, err := p.db.QueryContext(ctx, selectPushersSQL, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	userPushers := []pusher{}
+	for rows.Next() {
+		var pu pusher
+		var kind, data string
+		err = rows.Scan(
+			&pu.AppID, &pu.PushKey, &pu.PushKeyTS, &kind, &pu.AppDisplayName,
+			&pu.DeviceDisplayName, &pu.ProfileTag, &pu.Lang, &data,
+		)
+		if err != nil {
+			return nil, err
+		}
+		pu.Kind = &kind
+		pu.Data = json.RawMessage(data)
+		userPushers = append(userPushers, pu)
+	}
+	return userPushers, rows.Err()
+}
+
+// start consumes the room server output log, to send notifications of new
+// events.
+func (p *pushers) start(consumer sarama.Consumer, topic string) error {
+	p.startedAt = time.Now()
+	c := common.ContinualConsumer{
+		Topic:          topic,
+		Consumer:       consumer,
+		PartitionStore: &memoryPartitionStore{},
+		ProcessMessage: p.onMessage,
+	}
+	return c.Start()
+}
+
+func (p *pushers) onMessage(msg *sarama.ConsumerMessage) error {
+	// The log is read from the start, so skip everything from before we
+	// started, which users have long since been told about.
+	if msg.Timestamp.Before(p.startedAt) {
+		return nil
+	}
+	var output api.OutputEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		logrus.WithError(err).Error("Pushers: message parse failure")
+		return nil
+	}
+	if output.Type != api.OutputTypeNewRoomEvent {
+		return nil
+	}
+	ev := output.NewRoomEvent.Event
+	for userID, tweaks := range p.recipients(&ev) {
+		go p.notify(userID, &ev, tweaks)
+	}
+	return nil
+}
+
+// recipients returns which of our users should be told about an event, with
+// the tweaks for each, as the default push rules would.
+func (p *pushers) recipients(ev *gomatrixserverlib.Event) map[string]map[string]interface{} {
+	recipients := make(map[string]map[string]interface{})
+	switch ev.Type() {
+	case gomatrixserverlib.MRoomMember:
+		if ev.StateKey() == nil || *ev.StateKey() == ev.Sender() {
+			break
+		}
+		if membership, err := ev.Membership(); err != nil || membership != gomatrixserverlib.Invite {
+			break
+		}
+		if _, domain, err := gomatrixserverlib.SplitID('@', *ev.StateKey()); err == nil && domain == p.serverName {
+			recipients[*ev.StateKey()] = map[string]interface{}{"sound": "default"}
+		}
+	case "m.room.message", "m.room.encrypted":
+		members := p.memberships.RoomUsers(ev.RoomID())
+		for _, userID := range members {
+			if userID == ev.Sender() {
+				continue
+			}
+			if _, domain, err := gomatrixserverlib.SplitID('@', userID); err != nil || domain != p.serverName {
+				continue
+			}
+			// Only one-to-one rooms make a sound.
+			var tweaks map[string]interface{}
+			if len(members) == 2 {
+				tweaks = map[string]interface{}{"sound": "default"}
+			}
+			recipients[userID] = tweaks
+		}
+	}
+	return recipients
+}
+
+// notify sends a notification of an event to every pusher of one of our
+// users, removing those that the gateway rejects.
+func (p *pushers) notify(userID string, ev *gomatrixserverlib.Event, tweaks map[string]interface{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), PushSendTimeout)
+	defer cancel()
+	logger := logrus.WithFields(logrus.Fields{"user_id": userID, "event_id": ev.EventID()})
+	userPushers, err := p.userPushers(ctx, userID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to get pushers")
+		return
+	}
+	for _, pu := range userPushers {
+		var data pusherData
+		var deviceData map[string]interface{}
+		if json.Unmarshal(pu.Data, &data) != nil || json.Unmarshal(pu.Data, &deviceData) != nil {
+			continue
+		}
+		// The URL is for us, not the gateway.
+		delete(deviceData, "url")
+
+		var n pushNotification
+		n.Notification.EventID = ev.EventID()
+		n.Notification.RoomID = ev.RoomID()
+		n.Notification.Prio = "high"
+		if data.Format != "event_id_only" {
+			n.Notification.Type = ev.Type()
+			n.Notification.Sender = ev.Sender()
+			n.Notification.Content = ev.Content()
+			n.Notification.UserIsTarget = ev.StateKey() != nil && *ev.StateKey() == userID
+		}
+		n.Notification.Devices = []pushDevice{{
+			AppID:     pu.AppID,
+			PushKey:   pu.PushKey,
+			PushKeyTS: pu.PushKeyTS,
+			Data:      deviceData,
+			Tweaks:    tweaks,
+		}}
+
+		res, err := p.send(ctx, data.URL, &n)
+		if err != nil {
+			logger.WithError(err).WithField("app_id", pu.AppID).Warn("Failed to send push notification")
+			continue
+		}
+		for _, rejected := range res.Rejected {
+			if rejected != pu.PushKey {
+				continue
+			}
+			logger.WithField("app_id", pu.AppID).Info("Removing pusher rejected by its gateway")
+			if _, err = p.db.ExecContext(ctx, deletePusherSQL, userID, pu.AppID, pu.PushKey); err != nil {
+				logger.WithError(err).Error("Failed to remove rejected pusher")
+			}
+		}
+	}
+}
+
+// send sends a notification to a push gateway or a companion app.
+func (p *pushers) send(ctx context.Context, rawURL string, n *pushNotification) (*pushGatewayResponse, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+	var res pushGatewayResponse
+	if u.Scheme == LibP2PPushScheme {
+		return &res, p.sendStream(ctx, u.Host, body, &res)
+	}
+	req, err := http.NewRequest(http.MethodPost, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("push gateway returned %s", resp.Status)
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, PushMaxResponseSize)).Decode(&res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// sendStream sends a notification to a companion app over libp2p, connecting
+// to it first if need be.
+func (p *pushers) sendStream(ctx context.Context, peerID string, body []byte, res *pushGatewayResponse) error {
+	id, err := peer.IDB58Decode(peerID)
+	if err != nil {
+		return err
+	}
+	if err = p.resolver.resolve(ctx, id); err != nil {
+		return err
+	}
+	s, err := p.host.NewStream(ctx, id, PushProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Reset() // nolint: errcheck
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+	if _, err = s.Write(body); err != nil {
+		return err
+	}
+	// Closing only closes our end, so that the app knows that we're done.
+	if err = s.Close(); err != nil {
+		return err
+	}
+	return json.NewDecoder(io.LimitReader(s, PushMaxResponseSize)).Decode(res)
+}
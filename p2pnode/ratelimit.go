@@ -0,0 +1,149 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+)
+
+// RateLimitPerSecond is how many requests each peer may make of us a second
+// over the Matrix protocol, on average.
+const RateLimitPerSecond = 10
+
+// RateLimitBurst is how many requests each peer may make of us at once,
+// after being quiet for a while.
+const RateLimitBurst = 50
+
+// errRateLimited is returned for requests that another node turned away for
+// being over its rate limit.
+var errRateLimited = errors.New("the node is rate limiting us")
+
+// rateLimitSweepInterval is how often the buckets of peers that have been
+// quiet long enough to fill up again are forgotten.
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket holds the requests that a peer may still make. It fills up at
+// RateLimitPerSecond, to at most RateLimitBurst.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// fill adds the tokens that are due by now.
+func (b *tokenBucket) fill(now time.Time) {
+	b.tokens += now.Sub(b.updated).Seconds() * RateLimitPerSecond
+	if b.tokens > RateLimitBurst {
+		b.tokens = RateLimitBurst
+	}
+	b.updated = now
+}
+
+// rateLimiter limits how many requests each peer may make of us over the
+// Matrix protocol, so that one hostile or buggy peer can't flood the
+// roomserver with transactions.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[peer.ID]*tokenBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[peer.ID]*tokenBucket)}
+}
+
+// start forgets the buckets that have filled up, until the context is done.
+func (l *rateLimiter) start(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now()
+			l.mu.Lock()
+			for id, b := range l.buckets {
+				if b.fill(now); b.tokens >= RateLimitBurst {
+					delete(l.buckets, id)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// bucket returns the bucket of a peer, filled up to now. The lock must be
+// held.
+func (l *rateLimiter) bucket(id peer.ID, now time.Time) *tokenBucket {
+	b, ok := l.buckets[id]
+	if !ok {
+		b = &tokenBucket{tokens: RateLimitBurst, updated: now}
+		l.buckets[id] = b
+	}
+	b.fill(now)
+	return b
+}
+
+// take takes a token from the bucket of a peer for a request. If there are
+// none left it returns how long it will be until there is one.
+func (l *rateLimiter) take(id peer.ID) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.bucket(id, time.Now())
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / RateLimitPerSecond * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// limited reports whether a peer has no tokens left, without taking one.
+func (l *rateLimiter) limited(id peer.ID) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bucket(id, time.Now()).tokens < 1
+}
+
+// wrap rejects the requests of peers that have run out of tokens with
+// M_LIMIT_EXCEEDED.
+func (l *rateLimiter) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// gostream gives the peer ID of the remote node as its address.
+		id, err := peer.IDB58Decode(req.RemoteAddr)
+		if err != nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if ok, retryAfter := l.take(id); !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_ = json.NewEncoder(w).Encode(jsonerror.LimitExceeded(
+				"Too many requests", int64(retryAfter/time.Millisecond)+1,
+			))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
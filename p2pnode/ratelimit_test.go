@@ -0,0 +1,122 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketFill(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name    string
+		tokens  float64
+		elapsed time.Duration
+		want    float64
+	}{
+		{"no time", 0, 0, 0},
+		{"a tenth of a second", 0, 100 * time.Millisecond, 1},
+		{"a second", 2, time.Second, 2 + RateLimitPerSecond},
+		{"up to the burst", RateLimitBurst - 1, time.Second, RateLimitBurst},
+		{"after a long time", 0, time.Hour, RateLimitBurst},
+		{"already full", RateLimitBurst, time.Second, RateLimitBurst},
+	}
+	for _, tt := range tests {
+		b := &tokenBucket{tokens: tt.tokens, updated: start}
+		b.fill(start.Add(tt.elapsed))
+		if b.tokens < tt.want-1e-9 || b.tokens > tt.want+1e-9 {
+			t.Errorf("%s: got %v tokens, wanted %v", tt.name, b.tokens, tt.want)
+		}
+		if !b.updated.Equal(start.Add(tt.elapsed)) {
+			t.Errorf("%s: bucket wasn't updated to now", tt.name)
+		}
+	}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	l := newRateLimiter()
+	id, other := testPeerID(t), testPeerID(t)
+	for i := 0; i < RateLimitBurst; i++ {
+		if ok, _ := l.take(id); !ok {
+			t.Fatalf("request %d of the burst was limited", i+1)
+		}
+	}
+	ok, retryAfter := l.take(id)
+	if ok {
+		t.Fatal("request after the burst wasn't limited")
+	}
+	if retryAfter <= 0 || retryAfter > time.Second/RateLimitPerSecond {
+		t.Errorf("got retry after %s, wanted at most %s", retryAfter, time.Second/RateLimitPerSecond)
+	}
+	if !l.limited(id) {
+		t.Error("peer isn't limited after its burst")
+	}
+	if l.limited(other) {
+		t.Error("other peer is limited by the first one's burst")
+	}
+
+	// After a tenth of a second the bucket holds one more token.
+	l.buckets[id].updated = l.buckets[id].updated.Add(-time.Second / RateLimitPerSecond)
+	if ok, _ = l.take(id); !ok {
+		t.Error("request after the bucket refilled was limited")
+	}
+}
+
+func TestRateLimiterWrap(t *testing.T) {
+	l := newRateLimiter()
+	id := testPeerID(t)
+	handler := l.wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	tests := []struct {
+		name   string
+		remote string
+		status int
+	}{
+		{"not a peer", "127.0.0.1:8008", http.StatusOK},
+		{"peer with tokens", id.String(), http.StatusOK},
+		{"peer without tokens", id.String(), http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		if tt.status == http.StatusTooManyRequests {
+			l.buckets[id].tokens = 0
+		}
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/federation/v1/version", nil)
+		req.RemoteAddr = tt.remote
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: got status %d, wanted %d", tt.name, rec.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusTooManyRequests {
+			continue
+		}
+		var res struct {
+			ErrCode      string `json:"errcode"`
+			RetryAfterMS int64  `json:"retry_after_ms"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res.ErrCode != "M_LIMIT_EXCEEDED" || res.RetryAfterMS <= 0 {
+			t.Errorf("%s: got %+v, wanted M_LIMIT_EXCEEDED with a retry", tt.name, res)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// MReceipt is the type of receipt EDUs and of the receipt events in /sync.
+const MReceipt = "m.receipt"
+
+// mRead is the only type of receipt in the spec.
+const mRead = "m.read"
+
+// mFullyRead is the type of the room account data that holds the read
+// marker, which POST /read_markers sets along with the receipt.
+const mFullyRead = "m.fully_read"
+
+// RoomsClientPathPrefix starts the client APIs for rooms, of which we serve
+// /receipt and /read_markers and pass the rest on to the client API.
+const RoomsClientPathPrefix = "/_matrix/client/r0/rooms/"
+
+const receiptsSchema = `
+CREATE SEQUENCE IF NOT EXISTS p2p_receipt_id;
+
+-- The latest receipt of each type from each user in each room. The ID goes
+-- up whenever a receipt changes, so that /sync can send only new ones.
+CREATE TABLE IF NOT EXISTS p2p_receipts (
+    id BIGINT PRIMARY KEY DEFAULT nextval('p2p_receipt_id'),
+    room_id TEXT NOT NULL,
+    receipt_type TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    event_id TEXT NOT NULL,
+    receipt_ts BIGINT NOT NULL,
+    CONSTRAINT p2p_receipts_unique UNIQUE (room_id, receipt_type, user_id)
+);
+`
+
+const upsertReceiptSQL = "" +
+	"INSERT INTO p2p_receipts (room_id, receipt_type, user_id, event_id, receipt_ts) VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT ON CONSTRAINT p2p_receipts_unique DO UPDATE" +
+	" SET event_id = $4, receipt_ts = $5, id = nextval('p2p_receipt_id')" +
+	" WHERE p2p_receipts.event_id <> $4"
+
+const selectReceiptsSQL = "" +
+	"SELECT id, room_id, receipt_type, user_id, event_id, receipt_ts FROM p2p_receipts" +
+	" WHERE room_id = ANY($1) AND id > $2"
+
+// receiptContent is the content of an m.receipt EDU, by room ID, receipt type
+// and user ID.
+type receiptContent map[string]map[string]map[string]receiptUpdate
+
+// receiptUpdate is the receipt of one user, as sent between servers.
+type receiptUpdate struct {
+	EventIDs []string    `json:"event_ids"`
+	Data     receiptData `json:"data"`
+}
+
+// receiptData is when a receipt was sent.
+type receiptData struct {
+	TS gomatrixserverlib.Timestamp `json:"ts"`
+}
+
+// receiptEvent is an m.receipt event in the ephemeral section of a room in
+// /sync. The content is by event ID, receipt type and user ID.
+type receiptEvent struct {
+	Type    string                                       `json:"type"`
+	Content map[string]map[string]map[string]receiptData `json:"content"`
+}
+
+// receipts stores the read receipts of the users in the rooms that we are in.
+// Those of our users are gossiped along with the other ephemeral events of
+// the room, and those from every user are added to /sync. Dendrite doesn't
+// handle receipts at all, so they have a table of their own.
+type receipts struct {
+	db          *sql.DB
+	memberships *RoomMemberships
+	edus        *eduGossip
+	authData    auth.Data
+
+	mu sync.Mutex
+	// delivered holds the receipt ID that each device has been sent receipts
+	// up to in /sync, by user ID and device ID.
+	delivered map[string]int64
+}
+
+func newReceipts(dataSourceName string, memberships *RoomMemberships, authData auth.Data) (*receipts, error) {
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(receiptsSchema); err != nil {
+		return nil, err
+	}
+	return &receipts{
+		db:          db,
+		memberships: memberships,
+		authData:    authData,
+		delivered:   make(map[string]int64),
+	}, nil
+}
+
+// wrapRooms serves /receipt and /read_markers, and passes every other rooms
+// API on to the client API.
+func (r *receipts) wrapRooms(next http.Handler) http.Handler {
+	receiptAPI := common.MakeAuthAPI("rooms_receipt", r.authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		if req.Method != http.MethodPost {
+			return util.JSONResponse{
+				Code: http.StatusMethodNotAllowed,
+				JSON: jsonerror.NotFound("Bad method"),
+			}
+		}
+		// The path is /rooms/{roomID}/receipt/{receiptType}/{eventID}.
+		parts, err := roomPathParts(req)
+		if err != nil {
+			return util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.InvalidArgumentValue(err.Error())}
+		}
+		if parts[2] != mRead {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Receipt type must be " + mRead),
+			}
+		}
+		return r.setLocal(req, device, parts[0], parts[3])
+	})
+	readMarkersAPI := common.MakeAuthAPI("rooms_read_markers", r.authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		if req.Method != http.MethodPost {
+			return util.JSONResponse{
+				Code: http.StatusMethodNotAllowed,
+				JSON: jsonerror.NotFound("Bad method"),
+			}
+		}
+		// The path is /rooms/{roomID}/read_markers.
+		parts, err := roomPathParts(req)
+		if err != nil {
+			return util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.InvalidArgumentValue(err.Error())}
+		}
+		roomID := parts[0]
+		var body struct {
+			FullyRead string `json:"m.fully_read"`
+			Read      string `json:"m.read"`
+		}
+		if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+			return *resErr
+		}
+		if body.FullyRead != "" {
+			if res := r.setFullyRead(req, next, device, roomID, body.FullyRead); res.Code != http.StatusOK {
+				return res
+			}
+		}
+		if body.Read != "" {
+			return r.setLocal(req, device, roomID, body.Read)
+		}
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(req.URL.EscapedPath(), RoomsClientPathPrefix), "/")
+		switch {
+		case len(parts) == 4 && parts[1] == "receipt":
+			receiptAPI.ServeHTTP(w, req)
+		case len(parts) == 2 && parts[1] == "read_markers":
+			readMarkersAPI.ServeHTTP(w, req)
+		default:
+			next.ServeHTTP(w, req)
+		}
+	})
+}
+
+// roomPathParts returns the unescaped parts of the path of a rooms API,
+// which starts with the room ID.
+func roomPathParts(req *http.Request) ([]string, error) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.EscapedPath(), RoomsClientPathPrefix), "/")
+	for i, part := range parts {
+		var err error
+		if parts[i], err = url.PathUnescape(part); err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+// setFullyRead moves the read marker of the user, which is room account data,
+// by passing the request on to the account data API of the client API.
+func (r *receipts) setFullyRead(req *http.Request, next http.Handler, device *authtypes.Device, roomID, eventID string) util.JSONResponse {
+	body, err := json.Marshal(map[string]string{"event_id": eventID})
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	path := "/_matrix/client/r0/user/%s/rooms/%s/account_data/" + mFullyRead
+	put := req.Clone(req.Context())
+	put.Method = http.MethodPut
+	put.URL.Path = fmt.Sprintf(path, device.UserID, roomID)
+	put.URL.RawPath = fmt.Sprintf(path, url.PathEscape(device.UserID), url.PathEscape(roomID))
+	put.RequestURI = ""
+	put.Body = ioutil.NopCloser(bytes.NewReader(body))
+	put.ContentLength = int64(len(body))
+	rec := &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+	next.ServeHTTP(rec, put)
+	if rec.code != http.StatusOK {
+		return util.JSONResponse{Code: rec.code, JSON: json.RawMessage(rec.body.Bytes())}
+	}
+	return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+}
+
+// setLocal stores a read receipt from one of our users and sends it on to
+// the other servers in the room.
+func (r *receipts) setLocal(req *http.Request, device *authtypes.Device, roomID, eventID string) util.JSONResponse {
+	if !r.memberships.Joined(roomID, device.UserID) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room"),
+		}
+	}
+	ts := gomatrixserverlib.AsTimestamp(time.Now())
+	changed, err := r.store(req.Context(), roomID, mRead, device.UserID, eventID, ts)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if changed && r.edus != nil {
+		update := receiptUpdate{EventIDs: []string{eventID}, Data: receiptData{TS: ts}}
+		content := receiptContent{roomID: {mRead: {device.UserID: update}}}
+		edu := gomatrixserverlib.EDU{Type: MReceipt}
+		if edu.Content, err = json.Marshal(content); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		r.edus.send(roomID, &edu)
+	}
+	return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+}
+
+// onRemote stores the receipts from an EDU that has already been checked.
+func (r *receipts) onRemote(ctx context.Context, content receiptContent) {
+	for roomID, types := range content {
+		for receiptType, users := range types {
+			for userID, update := range users {
+				if len(update.EventIDs) == 0 {
+					continue
+				}
+				if _, err := r.store(ctx, roomID, receiptType, userID, update.EventIDs[0], update.Data.TS); err != nil {
+					logrus.WithError(err).WithField("room_id", roomID).Error("Failed to store receipt")
+				}
+			}
+		}
+	}
+}
+
+// store records a receipt, returning whether it was any different from the
+// receipt that the user already had.
+func (r *receipts) store(ctx context.Context, roomID, receiptType, userID, eventID string, ts gomatrixserverlib.Timestamp) (bool, error) {
+	res, err := r.db.ExecContext(ctx, upsertReceiptSQL, roomID, receiptType, userID, eventID, int64(ts))
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows > 0, err
+}
+
+// wrapSync adds the receipts in the rooms of the user calling /sync that
+// their device hasn't been sent yet to the response. Like presence, a new
+// receipt doesn't wake a /sync that is waiting for events.
+func (r *receipts) wrapSync(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		device, req := syncDevice(req, r.authData)
+		if device == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		rec := &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+		next.ServeHTTP(rec, req)
+		var res map[string]json.RawMessage
+		if rec.code != http.StatusOK || json.Unmarshal(rec.body.Bytes(), &res) != nil {
+			rec.writeTo(w)
+			return
+		}
+		initial := req.URL.Query().Get("since") == ""
+		events, err := r.syncEvents(req.Context(), device.UserID, device.ID, initial)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to add receipts to /sync")
+		}
+		if len(events) == 0 || addEphemeral(res, events) != nil {
+			rec.writeTo(w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	})
+}
+
+// syncEvents returns an m.receipt event for each room of the user, holding
+// the receipts that the device hasn't been sent yet.
+func (r *receipts) syncEvents(ctx context.Context, userID, deviceID string, initial bool) (map[string]*receiptEvent, error) {
+	roomIDs := r.memberships.UserRooms(userID)
+	if len(roomIDs) == 0 {
+		return nil, nil
+	}
+	key := userID + "/" + deviceID
+	r.mu.Lock()
+	since := r.delivered[key]
+	r.mu.Unlock()
+	if initial {
+		since = 0
+	}
+
+	rows, err := r.db.QueryContext(ctx, selectReceiptsSQL, pq.StringArray(roomIDs), since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	events := make(map[string]*receiptEvent)
+	latest := since
+	for rows.Next() {
+		var id, ts int64
+		var roomID, receiptType, receiptUserID, eventID string
+		if err = rows.Scan(&id, &roomID, &receiptType, &receiptUserID, &eventID, &ts); err != nil {
+			return nil, err
+		}
+		if id > latest {
+			latest = id
+		}
+		event := events[roomID]
+		if event == nil {
+			event = &receiptEvent{
+				Type:    MReceipt,
+				Content: make(map[string]map[string]map[string]receiptData),
+			}
+			events[roomID] = event
+		}
+		if event.Content[eventID] == nil {
+			event.Content[eventID] = make(map[string]map[string]receiptData)
+		}
+		if event.Content[eventID][receiptType] == nil {
+			event.Content[eventID][receiptType] = make(map[string]receiptData)
+		}
+		event.Content[eventID][receiptType][receiptUserID] = receiptData{TS: gomatrixserverlib.Timestamp(ts)}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	if latest > r.delivered[key] {
+		r.delivered[key] = latest
+	}
+	r.mu.Unlock()
+	return events, nil
+}
+
+// addEphemeral adds an ephemeral event to the joined rooms in a /sync
+// response, adding rooms that aren't in it already.
+func addEphemeral(res map[string]json.RawMessage, events map[string]*receiptEvent) error {
+	var rooms map[string]json.RawMessage
+	if raw, ok := res["rooms"]; ok {
+		if err := json.Unmarshal(raw, &rooms); err != nil {
+			return err
+		}
+	}
+	if rooms == nil {
+		rooms = make(map[string]json.RawMessage)
+	}
+	var join map[string]map[string]json.RawMessage
+	if raw, ok := rooms["join"]; ok {
+		if err := json.Unmarshal(raw, &join); err != nil {
+			return err
+		}
+	}
+	if join == nil {
+		join = make(map[string]map[string]json.RawMessage)
+	}
+
+	for roomID, event := range events {
+		room := join[roomID]
+		if room == nil {
+			// Clients expect every section of a joined room to be there.
+			room = map[string]json.RawMessage{
+				"state":        json.RawMessage(`{"events":[]}`),
+				"timeline":     json.RawMessage(`{"events":[],"limited":false,"prev_batch":""}`),
+				"account_data": json.RawMessage(`{"events":[]}`),
+			}
+			join[roomID] = room
+		}
+		var ephemeral struct {
+			Events []json.RawMessage `json:"events"`
+		}
+		if raw, ok := room["ephemeral"]; ok {
+			if err := json.Unmarshal(raw, &ephemeral); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		ephemeral.Events = append(ephemeral.Events, data)
+		if room["ephemeral"], err = json.Marshal(ephemeral); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if rooms["join"], err = json.Marshal(join); err != nil {
+		return err
+	}
+	res["rooms"], err = json.Marshal(rooms)
+	return err
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+// ReconnectInterval is how often we check that we are still connected to
+// the peers that we share rooms with.
+const ReconnectInterval = time.Second * 5
+
+// ReconnectMinBackoff is how long we wait before redialling a peer that we
+// couldn't reconnect to. The wait doubles with every failure after that, up
+// to ReconnectMaxBackoff, and is jittered so that every node on a network
+// that has just come back doesn't redial at once.
+const ReconnectMinBackoff = time.Second * 5
+
+// ReconnectMaxBackoff is the longest that we wait between redials of a peer.
+const ReconnectMaxBackoff = time.Minute * 15
+
+// reconnectState is how a peer that we have lost the connection to is being
+// redialled.
+type reconnectState struct {
+	failures int
+	next     time.Time
+	dialling bool
+}
+
+// reconnector redials the peers that we share rooms with whenever we lose
+// our connection to them, e.g. after a network blip, with jittered
+// exponential backoff, so that the mesh heals itself.
+type reconnector struct {
+	host        host.Host
+	memberships *RoomMemberships
+	resolver    *resolverTransport
+	reputation  *reputation
+
+	mu     sync.Mutex
+	states map[peer.ID]*reconnectState
+	// rand picks the jitter. It is seeded per node, for the jitter to spread
+	// nodes out rather than all picking the same waits.
+	rand *rand.Rand
+}
+
+func newReconnector(
+	p2pHost host.Host, memberships *RoomMemberships, resolver *resolverTransport, reputation *reputation,
+) *reconnector {
+	return &reconnector{
+		host:        p2pHost,
+		memberships: memberships,
+		resolver:    resolver,
+		reputation:  reputation,
+		states:      make(map[peer.ID]*reconnectState),
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// start redials peers that we have lost the connection to, until the context
+// is done.
+func (r *reconnector) start(ctx context.Context) {
+	ticker := time.NewTicker(ReconnectInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.check(ctx)
+		}
+	}
+}
+
+// check starts redialling every peer that we share rooms with and aren't
+// connected to, once it is due. Peers that were disconnected for
+// misbehaving are left alone.
+func (r *reconnector) check(ctx context.Context) {
+	wanted := make(map[peer.ID]struct{})
+	for _, id := range r.memberships.Peers() {
+		if id != r.host.ID() && r.host.Network().Connectedness(id) != network.Connected && !r.reputation.disconnected(id) {
+			wanted[id] = struct{}{}
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Forget the peers that we are connected to again, or no longer share
+	// any rooms with.
+	for id, state := range r.states {
+		if _, ok := wanted[id]; !ok && !state.dialling {
+			delete(r.states, id)
+		}
+	}
+	now := time.Now()
+	for id := range wanted {
+		state, ok := r.states[id]
+		if !ok {
+			state = &reconnectState{next: now}
+			r.states[id] = state
+		}
+		if state.dialling || now.Before(state.next) {
+			continue
+		}
+		state.dialling = true
+		go r.redial(ctx, id)
+	}
+}
+
+// redial tries to reconnect to a peer, and works out when to try again if
+// that fails.
+func (r *reconnector) redial(ctx context.Context, id peer.ID) {
+	err := r.resolver.resolve(ctx, id)
+	logger := logrus.WithField("peer", id.String())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state := r.states[id]
+	state.dialling = false
+	if err == nil {
+		logger.WithField("failures", state.failures).Info("Reconnected to peer")
+		delete(r.states, id)
+		return
+	}
+	state.failures++
+	backoff := reconnectBackoff(state.failures)
+	backoff = backoff/2 + time.Duration(r.rand.Int63n(int64(backoff/2)+1))
+	state.next = time.Now().Add(backoff)
+	logger.WithError(err).WithField("backoff", backoff).Debug("Failed to reconnect to peer")
+}
+
+// reconnectBackoff returns the most that we wait before redialling a peer
+// that has failed so many times in a row. Between half and all of it is
+// picked at random.
+func reconnectBackoff(failures int) time.Duration {
+	backoff := ReconnectMinBackoff
+	for i := 1; i < failures && backoff < ReconnectMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > ReconnectMaxBackoff {
+		backoff = ReconnectMaxBackoff
+	}
+	return backoff
+}
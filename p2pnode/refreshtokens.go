@@ -0,0 +1,356 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// RefreshClientPath is where clients swap a refresh token for a new
+	// access token.
+	RefreshClientPath = "/_matrix/client/v3/refresh"
+	// UnstableRefreshClientPath is the same, under the prefix of MSC2918,
+	// which some clients still use.
+	UnstableRefreshClientPath = "/_matrix/client/unstable/org.matrix.msc2918.refresh_token/refresh"
+)
+
+// DefaultAccessTokenLifetime is how long the access tokens of clients that
+// asked for a refresh token last, if the config doesn't say.
+const DefaultAccessTokenLifetime = time.Minute * 5
+
+// RefreshTokenPruneInterval is how often the refresh tokens of devices that
+// have been logged out are deleted.
+const RefreshTokenPruneInterval = time.Hour
+
+const refreshTokensSchema = `
+-- The refresh token of each device that asked for one when it logged in,
+-- and the access token that it was last given, which expires.
+CREATE TABLE IF NOT EXISTS p2p_refresh_tokens (
+    refresh_token TEXT PRIMARY KEY,
+    localpart TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    access_token TEXT NOT NULL,
+    expiry_ts BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS p2p_refresh_tokens_device ON p2p_refresh_tokens (localpart, device_id);
+`
+
+const upsertRefreshTokenSQL = "" +
+	"INSERT INTO p2p_refresh_tokens (refresh_token, localpart, device_id, access_token, expiry_ts)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (localpart, device_id) DO UPDATE SET refresh_token = $1, access_token = $4, expiry_ts = $5"
+
+const selectRefreshTokenSQL = "" +
+	"SELECT access_token FROM p2p_refresh_tokens WHERE refresh_token = $1 FOR UPDATE"
+
+const updateRefreshTokenSQL = "" +
+	"UPDATE p2p_refresh_tokens SET refresh_token = $2, access_token = $3, expiry_ts = $4 WHERE refresh_token = $1"
+
+const selectAccessTokenExpiriesSQL = "" +
+	"SELECT access_token, expiry_ts FROM p2p_refresh_tokens"
+
+// Devices that have been logged out are gone from the device database,
+// which the table is in.
+const deleteLoggedOutRefreshTokensSQL = "" +
+	"DELETE FROM p2p_refresh_tokens r WHERE NOT EXISTS (" +
+	"SELECT 1 FROM device_devices d WHERE d.localpart = r.localpart AND d.device_id = r.device_id)"
+
+// The client API can't change the access token of a device without logging
+// it out, which would delete its keys.
+const updateDeviceAccessTokenSQL = "" +
+	"UPDATE device_devices SET access_token = $2 WHERE access_token = $1"
+
+// refreshTokens gives the clients that ask for it a refresh token when they
+// log in or register, and an access token that expires, which they swap
+// the refresh token for a new one of before it does. A client whose access
+// token has expired is only soft logged out: the device is kept, along with
+// its keys, so that a phone that was offline for a while can carry on with
+// its encrypted rooms once it has refreshed, rather than being logged out
+// for good. Clients that don't ask for a refresh token get an access token
+// that never expires, as they always have.
+type refreshTokens struct {
+	db       *sql.DB
+	lifetime time.Duration
+	// expiries holds when each access token that expires does, so that
+	// requests don't have to look them up in the database.
+	mu       sync.RWMutex
+	expiries map[string]time.Time
+}
+
+func newRefreshTokens(dataSource string, lifetime time.Duration) (*refreshTokens, error) {
+	if lifetime <= 0 {
+		lifetime = DefaultAccessTokenLifetime
+	}
+	db, err := sql.Open("postgres", dataSource)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(refreshTokensSchema); err != nil {
+		return nil, err
+	}
+	t := &refreshTokens{db: db, lifetime: lifetime}
+	if err = t.load(context.Background()); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *refreshTokens) load(ctx context.Context) error {
+	rows, err := t.db.QueryContext(ctx, selectAccessTokenExpiriesSQL)
+	if err != nil {
+		return err
+	}
+	defer rows.Close() // nolint: errcheck
+	expiries := make(map[string]time.Time)
+	for rows.Next() {
+		var accessToken string
+		var expiryTS int64
+		if err = rows.Scan(&accessToken, &expiryTS); err != nil {
+			return err
+		}
+		expiries[accessToken] = time.Unix(0, expiryTS*int64(time.Millisecond))
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.expiries = expiries
+	t.mu.Unlock()
+	return nil
+}
+
+// start deletes the refresh tokens of devices that have been logged out
+// every RefreshTokenPruneInterval until the context is done.
+func (t *refreshTokens) start(ctx context.Context) {
+	ticker := time.NewTicker(RefreshTokenPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		_, err := t.db.ExecContext(ctx, deleteLoggedOutRefreshTokensSQL)
+		if err == nil {
+			err = t.load(ctx)
+		}
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to delete refresh tokens of logged out devices")
+		}
+	}
+}
+
+// setup registers the refresh APIs.
+func (t *refreshTokens) setup(mux *http.ServeMux) {
+	handler := common.WrapHandlerInCORS(common.MakeExternalAPI("refresh", t.serveRefresh))
+	mux.Handle(RefreshClientPath, handler)
+	mux.Handle(UnstableRefreshClientPath, handler)
+}
+
+// wrap soft logs out the clients whose access token has expired.
+func (t *refreshTokens) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token, err := auth.ExtractAccessToken(req)
+		if err == nil {
+			if t.expired(token) {
+				respondJSON(w, util.JSONResponse{
+					Code: http.StatusUnauthorized,
+					JSON: map[string]interface{}{
+						"errcode":     "M_UNKNOWN_TOKEN",
+						"error":       "Access token has expired",
+						"soft_logout": true,
+					},
+				})
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// expired returns whether an access token that came with a refresh token
+// has expired, so that its client has been soft logged out.
+func (t *refreshTokens) expired(token string) bool {
+	t.mu.RLock()
+	expiry, ok := t.expiries[token]
+	t.mu.RUnlock()
+	return ok && time.Now().After(expiry)
+}
+
+// wrapLogin adds a refresh token to the response to a login or registration
+// that asked for one, and makes its access token expire.
+func (t *refreshTokens) wrapLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			next.ServeHTTP(w, req)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, authMaxRequestSize))
+		if err != nil {
+			respondJSON(w, util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.BadJSON(err.Error())})
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var r struct {
+			RefreshToken         bool `json:"refresh_token"`
+			UnstableRefreshToken bool `json:"org.matrix.msc2918.refresh_token"`
+		}
+		if json.Unmarshal(body, &r) != nil || !(r.RefreshToken || r.UnstableRefreshToken) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		rec := &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+		next.ServeHTTP(rec, req)
+		var res map[string]interface{}
+		if rec.code != http.StatusOK || json.Unmarshal(rec.body.Bytes(), &res) != nil {
+			rec.writeTo(w)
+			return
+		}
+		userID, _ := res["user_id"].(string)
+		deviceID, _ := res["device_id"].(string)
+		accessToken, _ := res["access_token"].(string)
+		localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil || deviceID == "" || accessToken == "" {
+			// e.g. registration with inhibit_login.
+			rec.writeTo(w)
+			return
+		}
+		refreshToken, expiry, err := t.issue(req.Context(), localpart, deviceID, accessToken)
+		if err != nil {
+			// The client is logged in, just without a refresh token.
+			logrus.WithError(err).Error("Failed to issue refresh token")
+			rec.writeTo(w)
+			return
+		}
+		res["refresh_token"] = refreshToken
+		res["expires_in_ms"] = int64(time.Until(expiry) / time.Millisecond)
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		w.Header().Del("Content-Length")
+		respondJSON(w, util.JSONResponse{Code: http.StatusOK, JSON: res})
+	})
+}
+
+// issue gives a device a refresh token in place of any that it had, and
+// makes its access token expire.
+func (t *refreshTokens) issue(ctx context.Context, localpart, deviceID, accessToken string) (string, time.Time, error) {
+	refreshToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiry := time.Now().Add(t.lifetime)
+	_, err = t.db.ExecContext(
+		ctx, upsertRefreshTokenSQL, refreshToken, localpart, deviceID, accessToken,
+		int64(gomatrixserverlib.AsTimestamp(expiry)),
+	)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	t.mu.Lock()
+	t.expiries[accessToken] = expiry
+	t.mu.Unlock()
+	return refreshToken, expiry, nil
+}
+
+// serveRefresh swaps a refresh token for a new access token and refresh
+// token. Both of the old ones stop working.
+func (t *refreshTokens) serveRefresh(req *http.Request) util.JSONResponse {
+	if req.Method != http.MethodPost {
+		return util.JSONResponse{
+			Code: http.StatusMethodNotAllowed,
+			JSON: jsonerror.NotFound("Bad method"),
+		}
+	}
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	ctx := req.Context()
+	accessToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	refreshToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	expiry := time.Now().Add(t.lifetime)
+	var oldAccessToken string
+	err = common.WithTransaction(t.db, func(txn *sql.Tx) error {
+		if err := txn.QueryRowContext(ctx, selectRefreshTokenSQL, body.RefreshToken).Scan(&oldAccessToken); err != nil {
+			return err
+		}
+		res, err := txn.ExecContext(ctx, updateDeviceAccessTokenSQL, oldAccessToken, accessToken)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			// The device has been logged out, and the refresh token will be
+			// deleted by start.
+			return sql.ErrNoRows
+		}
+		_, err = txn.ExecContext(
+			ctx, updateRefreshTokenSQL, body.RefreshToken, refreshToken, accessToken,
+			int64(gomatrixserverlib.AsTimestamp(expiry)),
+		)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: map[string]interface{}{
+				"errcode":     "M_UNKNOWN_TOKEN",
+				"error":       "Unknown refresh token",
+				"soft_logout": false,
+			},
+		}
+	} else if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	t.mu.Lock()
+	delete(t.expiries, oldAccessToken)
+	t.expiries[accessToken] = expiry
+	t.mu.Unlock()
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"access_token":  accessToken,
+			"refresh_token": refreshToken,
+			"expires_in_ms": int64(t.lifetime / time.Millisecond),
+		},
+	}
+}
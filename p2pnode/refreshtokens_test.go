@@ -0,0 +1,71 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRefreshTokensWrap(t *testing.T) {
+	tokens := &refreshTokens{expiries: map[string]time.Time{
+		"expired": time.Now().Add(-time.Minute),
+		"current": time.Now().Add(time.Minute),
+	}}
+	tests := []struct {
+		name   string
+		header string
+		query  string
+		passed bool
+	}{
+		{name: "no token", passed: true},
+		{name: "token without refresh token", header: "Bearer forever", passed: true},
+		{name: "current", header: "Bearer current", passed: true},
+		{name: "expired", header: "Bearer expired"},
+		{name: "expired in query", query: "?access_token=expired"},
+		{name: "invalid header", header: "Basic expired", passed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var passed bool
+			next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { passed = true })
+			req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/sync"+tt.query, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			tokens.wrap(next).ServeHTTP(rec, req)
+			if passed != tt.passed {
+				t.Fatalf("got passed %t, wanted %t", passed, tt.passed)
+			}
+			if passed {
+				return
+			}
+			var res struct {
+				ErrCode    string `json:"errcode"`
+				SoftLogout bool   `json:"soft_logout"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusUnauthorized || res.ErrCode != "M_UNKNOWN_TOKEN" || !res.SoftLogout {
+				t.Errorf("got %d %s, wanted a soft logout", rec.Code, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,384 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// RegisterClientPath is where clients register accounts.
+	RegisterClientPath = "/_matrix/client/r0/register"
+	// LegacyRegisterClientPath is where clients register accounts with the
+	// v1 API, which scripts use for shared secret registration.
+	LegacyRegisterClientPath = "/_matrix/client/api/v1/register"
+	// RegistrationTokenValidityPath is where clients check a registration
+	// token before registering with it.
+	RegistrationTokenValidityPath = "/_matrix/client/v1/register/m.login.registration_token/validity"
+)
+
+// The ways that accounts can be registered.
+const (
+	// RegistrationOpen lets anyone who can reach the node register.
+	RegistrationOpen = "open"
+	// RegistrationToken only lets those with a registration token, from
+	// the admin API, register.
+	RegistrationToken = "token"
+	// RegistrationDisabled stops accounts from being registered at all,
+	// except by application services and with the shared secret.
+	RegistrationDisabled = "disabled"
+)
+
+// The registration token stage of user-interactive auth, and the name of it
+// that clients used before it was in the spec.
+const (
+	loginTypeRegistrationToken         = "m.login.registration_token"
+	loginTypeRegistrationTokenUnstable = "org.matrix.msc3231.login.registration_token"
+)
+
+// validRegistrationToken matches the tokens that clients can send, which
+// the spec limits to 64 of these characters.
+var validRegistrationToken = regexp.MustCompile(`^[A-Za-z0-9._~-]{1,64}$`)
+
+// authMaxRequestSize is the biggest registration or login request that is
+// read.
+const authMaxRequestSize = 65536
+
+const registrationTokensSchema = `
+-- The tokens that let people register while registration needs one. A
+-- token can be used uses_allowed times, or any number of times if that is
+-- NULL, until expiry_ts, if that isn't NULL.
+CREATE TABLE IF NOT EXISTS p2p_registration_tokens (
+    token TEXT PRIMARY KEY,
+    uses_allowed INTEGER,
+    completed INTEGER NOT NULL DEFAULT 0,
+    expiry_ts BIGINT
+);
+`
+
+const insertRegistrationTokenSQL = "" +
+	"INSERT INTO p2p_registration_tokens (token, uses_allowed, expiry_ts) VALUES ($1, $2, $3)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectRegistrationTokensSQL = "" +
+	"SELECT token, uses_allowed, completed, expiry_ts FROM p2p_registration_tokens ORDER BY token"
+
+// A token is used when registration with it starts, so that two people
+// can't both use the last use of it, and given back if registration fails.
+const useRegistrationTokenSQL = "" +
+	"UPDATE p2p_registration_tokens SET completed = completed + 1 WHERE token = $1" +
+	" AND (uses_allowed IS NULL OR completed < uses_allowed) AND (expiry_ts IS NULL OR expiry_ts > $2)"
+
+const unuseRegistrationTokenSQL = "" +
+	"UPDATE p2p_registration_tokens SET completed = completed - 1 WHERE token = $1 AND completed > 0"
+
+const selectRegistrationTokenValidSQL = "" +
+	"SELECT 1 FROM p2p_registration_tokens WHERE token = $1" +
+	" AND (uses_allowed IS NULL OR completed < uses_allowed) AND (expiry_ts IS NULL OR expiry_ts > $2)"
+
+const deleteRegistrationTokenSQL = "" +
+	"DELETE FROM p2p_registration_tokens WHERE token = $1"
+
+// registrationToken is a registration token, as the admin API shows it.
+type registrationToken struct {
+	Token       string `json:"token"`
+	UsesAllowed *int   `json:"uses_allowed"`
+	Completed   int    `json:"completed"`
+	// ExpiryTime is in milliseconds since the epoch.
+	ExpiryTime *int64 `json:"expiry_time"`
+}
+
+// registrationPolicy decides who can register accounts on the node, as a
+// node that is reachable over libp2p otherwise lets anyone use its
+// hardware. The client API only knows how to turn registration off
+// altogether, which stops application services registering their users
+// too, so registration requests are checked before it gets them.
+type registrationPolicy struct {
+	db   *sql.DB
+	mode string
+}
+
+func newRegistrationPolicy(dataSource, mode string) (*registrationPolicy, error) {
+	switch mode {
+	case "":
+		mode = RegistrationOpen
+	case RegistrationOpen, RegistrationToken, RegistrationDisabled:
+	default:
+		return nil, fmt.Errorf(
+			"invalid registration %q: must be %s, %s or %s", mode, RegistrationOpen, RegistrationToken, RegistrationDisabled,
+		)
+	}
+	db, err := sql.Open("postgres", dataSource)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(registrationTokensSchema); err != nil {
+		return nil, err
+	}
+	return &registrationPolicy{db: db, mode: mode}, nil
+}
+
+// setup registers the registration endpoints with the mux, in front of the
+// client API's.
+func (p *registrationPolicy) setup(mux *http.ServeMux, next http.Handler) {
+	mux.Handle(RegisterClientPath, common.WrapHandlerInCORS(p.wrap(next)))
+	mux.Handle(LegacyRegisterClientPath, common.WrapHandlerInCORS(p.wrapLegacy(next)))
+	mux.Handle(RegistrationTokenValidityPath, common.WrapHandlerInCORS(http.HandlerFunc(p.serveValidity)))
+}
+
+// wrap refuses registrations that the policy doesn't allow. With a token,
+// the token stage stands in for the client API's only stage, which is
+// completed for the client once the token has been used.
+func (p *registrationPolicy) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || p.mode == RegistrationOpen {
+			next.ServeHTTP(w, req)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, authMaxRequestSize))
+		if err != nil {
+			respondJSON(w, util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.BadJSON(err.Error())})
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var r struct {
+			Auth struct {
+				Type    string `json:"type"`
+				Session string `json:"session"`
+				Token   string `json:"token"`
+			} `json:"auth"`
+		}
+		if err = json.Unmarshal(body, &r); err != nil {
+			// The client API answers with the error.
+			next.ServeHTTP(w, req)
+			return
+		}
+		_, tokenErr := auth.ExtractAccessToken(req)
+		switch r.Auth.Type {
+		case authtypes.LoginTypeSharedSecret, authtypes.LoginTypeApplicationService:
+			next.ServeHTTP(w, req)
+			return
+		case "":
+			// Application services register their users with no auth type,
+			// but with their access token.
+			if tokenErr == nil {
+				next.ServeHTTP(w, req)
+				return
+			}
+		}
+		if p.mode == RegistrationDisabled {
+			respondJSON(w, util.MessageResponse(http.StatusForbidden, "Registration has been disabled"))
+			return
+		}
+
+		session := r.Auth.Session
+		if session == "" {
+			session = util.RandomString(16)
+		}
+		if r.Auth.Type != loginTypeRegistrationToken && r.Auth.Type != loginTypeRegistrationTokenUnstable {
+			respondJSON(w, registrationTokenRequired(session, nil))
+			return
+		}
+		ctx := req.Context()
+		used, err := p.use(ctx, r.Auth.Token)
+		if err != nil {
+			respondJSON(w, jsonerror.InternalServerError())
+			logrus.WithError(err).Error("Failed to use registration token")
+			return
+		}
+		if !used {
+			respondJSON(w, registrationTokenRequired(session, jsonerror.Forbidden("Invalid registration token")))
+			return
+		}
+		// The rest of the request is given to the client API as it is.
+		var fields map[string]interface{}
+		if err = json.Unmarshal(body, &fields); err != nil {
+			respondJSON(w, util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.BadJSON(err.Error())})
+			return
+		}
+		fields["auth"] = map[string]string{"type": string(authtypes.LoginTypeDummy), "session": session}
+		if body, err = json.Marshal(fields); err != nil {
+			respondJSON(w, jsonerror.InternalServerError())
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, req)
+		if rec.status != http.StatusOK {
+			if _, err = p.db.ExecContext(context.Background(), unuseRegistrationTokenSQL, r.Auth.Token); err != nil {
+				logrus.WithError(err).Warn("Failed to give back registration token")
+			}
+		}
+	})
+}
+
+// wrapLegacy refuses registrations with the v1 API, which has no
+// user-interactive auth to ask for a token with, unless registration is
+// open or they are with the shared secret.
+func (p *registrationPolicy) wrapLegacy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || p.mode == RegistrationOpen {
+			next.ServeHTTP(w, req)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, authMaxRequestSize))
+		if err != nil {
+			respondJSON(w, util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.BadJSON(err.Error())})
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var r struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(body, &r) == nil && r.Type == string(authtypes.LoginTypeSharedSecret) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		respondJSON(w, util.MessageResponse(http.StatusForbidden, "Registration has been disabled"))
+	})
+}
+
+// serveValidity tells clients whether a registration token can be used.
+func (p *registrationPolicy) serveValidity(w http.ResponseWriter, req *http.Request) {
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		respondJSON(w, util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.MissingArgument("Missing token")})
+		return
+	}
+	var one int
+	err := p.db.QueryRowContext(req.Context(), selectRegistrationTokenValidSQL, token, time.Now().UnixNano()/int64(time.Millisecond)).Scan(&one)
+	if err != nil && err != sql.ErrNoRows {
+		logrus.WithError(err).Error("Failed to check registration token")
+		respondJSON(w, jsonerror.InternalServerError())
+		return
+	}
+	respondJSON(w, util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Valid bool `json:"valid"`
+		}{err == nil},
+	})
+}
+
+// use uses up one use of a registration token, returning false if it can't
+// be used.
+func (p *registrationPolicy) use(ctx context.Context, token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	res, err := p.db.ExecContext(ctx, useRegistrationTokenSQL, token, time.Now().UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// tokens returns every registration token.
+func (p *registrationPolicy) tokens(ctx context.Context) ([]registrationToken, error) {
+	rows, err := p.db.QueryContext(ctx, selectRegistrationTokensSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	tokens := []registrationToken{}
+	for rows.Next() {
+		var t registrationToken
+		var usesAllowed sql.NullInt64
+		var expiry sql.NullInt64
+		if err = rows.Scan(&t.Token, &usesAllowed, &t.Completed, &expiry); err != nil {
+			return nil, err
+		}
+		if usesAllowed.Valid {
+			uses := int(usesAllowed.Int64)
+			t.UsesAllowed = &uses
+		}
+		if expiry.Valid {
+			t.ExpiryTime = &expiry.Int64
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// create adds a registration token, generating one that can't be guessed
+// if none is given. It returns false if there is already one with the
+// same token.
+func (p *registrationPolicy) create(ctx context.Context, t *registrationToken) (bool, error) {
+	if t.Token == "" {
+		token, err := auth.GenerateAccessToken()
+		if err != nil {
+			return false, err
+		}
+		t.Token = token
+	}
+	res, err := p.db.ExecContext(ctx, insertRegistrationTokenSQL, t.Token, t.UsesAllowed, t.ExpiryTime)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// delete deletes a registration token, returning false if there was none.
+func (p *registrationPolicy) delete(ctx context.Context, token string) (bool, error) {
+	res, err := p.db.ExecContext(ctx, deleteRegistrationTokenSQL, token)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// registrationTokenRequired asks the client for a registration token, as
+// user-interactive auth with a single stage, under either name for it.
+func registrationTokenRequired(session string, matrixErr *jsonerror.MatrixError) util.JSONResponse {
+	res := map[string]interface{}{
+		"flows": []authtypes.Flow{
+			{Stages: []authtypes.LoginType{loginTypeRegistrationToken}},
+			{Stages: []authtypes.LoginType{loginTypeRegistrationTokenUnstable}},
+		},
+		"params":  map[string]interface{}{},
+		"session": session,
+	}
+	if matrixErr != nil {
+		res["errcode"] = matrixErr.ErrCode
+		res["error"] = matrixErr.Err
+	}
+	return util.JSONResponse{Code: http.StatusUnauthorized, JSON: res}
+}
+
+func respondJSON(w http.ResponseWriter, res util.JSONResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.Code)
+	_ = json.NewEncoder(w).Encode(res.JSON)
+}
@@ -0,0 +1,159 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistrationPolicyWrap(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		method string
+		body   string
+		token  string
+		// passed is whether the request should reach the client API, and
+		// otherwise status and errcode are what we should answer with.
+		passed  bool
+		status  int
+		errcode string
+	}{
+		{name: "open", mode: RegistrationOpen, body: `{"username":"alice"}`, passed: true},
+		{name: "GET", mode: RegistrationDisabled, method: http.MethodGet, passed: true},
+		{name: "invalid JSON", mode: RegistrationDisabled, body: `{`, passed: true},
+		{name: "disabled", mode: RegistrationDisabled, body: `{"username":"alice"}`, status: http.StatusForbidden},
+		{
+			name: "disabled, dummy auth", mode: RegistrationDisabled,
+			body: `{"auth":{"type":"m.login.dummy"}}`, status: http.StatusForbidden,
+		},
+		{
+			name: "disabled, shared secret", mode: RegistrationDisabled,
+			body: `{"auth":{"type":"org.matrix.login.shared_secret"}}`, passed: true,
+		},
+		{
+			name: "disabled, application service", mode: RegistrationDisabled,
+			body: `{"auth":{"type":"m.login.application_service"}}`, passed: true,
+		},
+		{
+			name: "disabled, application service without auth type", mode: RegistrationDisabled,
+			body: `{"username":"_bridge_alice"}`, token: "as_token", passed: true,
+		},
+		{name: "token, no auth", mode: RegistrationToken, body: `{"username":"alice"}`, status: http.StatusUnauthorized},
+		{
+			name: "token, dummy auth", mode: RegistrationToken,
+			body: `{"auth":{"type":"m.login.dummy","session":"abc"}}`, status: http.StatusUnauthorized,
+		},
+		{
+			name: "token, empty token", mode: RegistrationToken,
+			body:   `{"auth":{"type":"m.login.registration_token","session":"abc"}}`,
+			status: http.StatusUnauthorized, errcode: "M_FORBIDDEN",
+		},
+		{
+			name: "token, shared secret", mode: RegistrationToken,
+			body: `{"auth":{"type":"org.matrix.login.shared_secret"}}`, passed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var passed bool
+			var passedBody string
+			next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				passed = true
+				b, _ := ioutil.ReadAll(req.Body)
+				passedBody = string(b)
+			})
+			method := tt.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, RegisterClientPath, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			p := &registrationPolicy{mode: tt.mode}
+			p.wrap(next).ServeHTTP(rec, req)
+
+			if passed != tt.passed {
+				t.Fatalf("got passed %t, wanted %t, with response %d %s", passed, tt.passed, rec.Code, rec.Body)
+			}
+			if passed {
+				// The client API gets the whole of the request.
+				if passedBody != tt.body {
+					t.Errorf("client API got body %q, wanted %q", passedBody, tt.body)
+				}
+				return
+			}
+			if rec.Code != tt.status {
+				t.Errorf("got status %d, wanted %d", rec.Code, tt.status)
+			}
+			var res struct {
+				ErrCode string `json:"errcode"`
+				Session string `json:"session"`
+				Flows   []struct {
+					Stages []string `json:"stages"`
+				} `json:"flows"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if tt.errcode != "" && res.ErrCode != tt.errcode {
+				t.Errorf("got errcode %q, wanted %q", res.ErrCode, tt.errcode)
+			}
+			if tt.status == http.StatusUnauthorized {
+				// The client is asked for a token under either name.
+				if len(res.Flows) != 2 || res.Session == "" {
+					t.Errorf("got flows %v and session %q, wanted the registration token flows", res.Flows, res.Session)
+				}
+			}
+		})
+	}
+}
+
+func TestRegistrationPolicyWrapLegacy(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		body   string
+		passed bool
+	}{
+		{"open", RegistrationOpen, `{"type":"m.login.password"}`, true},
+		{"shared secret", RegistrationToken, `{"type":"org.matrix.login.shared_secret"}`, true},
+		{"password", RegistrationToken, `{"type":"m.login.password"}`, false},
+		{"disabled", RegistrationDisabled, `{"type":"m.login.password"}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var passed bool
+			next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { passed = true })
+			req := httptest.NewRequest(http.MethodPost, LegacyRegisterClientPath, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			p := &registrationPolicy{mode: tt.mode}
+			p.wrapLegacy(next).ServeHTTP(rec, req)
+			if passed != tt.passed {
+				t.Errorf("got passed %t, wanted %t", passed, tt.passed)
+			}
+			if !passed && rec.Code != http.StatusForbidden {
+				t.Errorf("got status %d, wanted %d", rec.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+// ReputationTag is the connection manager tag that carries the reputation
+// score of a peer, so that connections to misbehaving peers are pruned
+// first.
+const ReputationTag = "matrix-reputation"
+
+// ReputationHalfLife is how long it takes for half of a peer's penalties to
+// be forgiven.
+const ReputationHalfLife = time.Hour
+
+// ReputationDisconnectScore is the score at or below which a peer is
+// disconnected, and its streams refused, until enough has been forgiven.
+const ReputationDisconnectScore = -100
+
+// ReputationFloodWindow and ReputationFloodLimit are how many requests a
+// peer may make of us in a while before every request after that counts
+// as flooding.
+const ReputationFloodWindow = time.Minute
+const ReputationFloodLimit = 600
+
+// The penalties for each kind of misbehaviour.
+const (
+	// ReputationInvalidSignaturePenalty is for a federation request that
+	// isn't signed properly by the server it claims to be from.
+	ReputationInvalidSignaturePenalty = 20
+	// ReputationMalformedPenalty is for a federation request or gossiped
+	// message that can't be parsed.
+	ReputationMalformedPenalty = 5
+	// ReputationFloodPenalty is for each request over the flood limit.
+	ReputationFloodPenalty = 1
+)
+
+// reputationSweepInterval is how often forgiven peers are forgotten.
+const reputationSweepInterval = time.Minute
+
+// The kinds of misbehaviour that we track.
+type misbehaviour int
+
+const (
+	invalidSignature misbehaviour = iota
+	malformed
+	flooding
+)
+
+// PeerReputation is how a peer has behaved towards us.
+type PeerReputation struct {
+	PeerID string `json:"peer_id"`
+	// The score of the peer, which is zero for a peer that has done nothing
+	// wrong and goes down with every penalty.
+	Score             float64 `json:"score"`
+	InvalidSignatures int     `json:"invalid_signatures"`
+	Malformed         int     `json:"malformed"`
+	Floods            int     `json:"floods"`
+	// Whether the peer is disconnected for its score.
+	Disconnected bool `json:"disconnected"`
+}
+
+// peerReputation is what we track of a peer's behaviour.
+type peerReputation struct {
+	score             float64
+	updated           time.Time
+	invalidSignatures int
+	malformed         int
+	floods            int
+	// The number of requests that the peer has made since windowStart.
+	windowStart time.Time
+	requests    int
+}
+
+// decay forgives the part of the score that is due by now.
+func (p *peerReputation) decay(now time.Time) {
+	if elapsed := now.Sub(p.updated); elapsed > 0 {
+		p.score *= math.Pow(0.5, float64(elapsed)/float64(ReputationHalfLife))
+	}
+	p.updated = now
+}
+
+// reputation scores the behaviour of other peers, so that misbehaving peers
+// are the first to be pruned by the connection manager, and are disconnected
+// altogether if they keep at it. Penalties are forgiven over time.
+type reputation struct {
+	host host.Host
+
+	mu    sync.Mutex
+	peers map[peer.ID]*peerReputation
+}
+
+func newReputation(p2pHost host.Host) *reputation {
+	return &reputation{host: p2pHost, peers: make(map[peer.ID]*peerReputation)}
+}
+
+// start forgets the peers whose penalties have all been forgiven, until the
+// context is done.
+func (r *reputation) start(ctx context.Context) {
+	ticker := time.NewTicker(reputationSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.sweep()
+		}
+	}
+}
+
+func (r *reputation) sweep() {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cm := r.host.ConnManager()
+	for id, p := range r.peers {
+		p.decay(now)
+		if p.score > -1 && now.Sub(p.windowStart) > ReputationFloodWindow {
+			delete(r.peers, id)
+			cm.UntagPeer(id, ReputationTag)
+			continue
+		}
+		cm.TagPeer(id, ReputationTag, int(p.score))
+	}
+}
+
+// lookup returns what we track of a peer. The lock must be held.
+func (r *reputation) lookup(id peer.ID, now time.Time) *peerReputation {
+	p, ok := r.peers[id]
+	if !ok {
+		p = &peerReputation{updated: now, windowStart: now}
+		r.peers[id] = p
+	}
+	p.decay(now)
+	return p
+}
+
+// penalise lowers the score of a peer for misbehaving, disconnecting it if
+// the score is now too low.
+func (r *reputation) penalise(id peer.ID, kind misbehaviour) {
+	if r == nil || id == r.host.ID() {
+		return
+	}
+	r.mu.Lock()
+	p := r.lookup(id, time.Now())
+	wasDisconnected := p.score <= ReputationDisconnectScore
+	switch kind {
+	case invalidSignature:
+		p.invalidSignatures++
+		p.score -= ReputationInvalidSignaturePenalty
+	case malformed:
+		p.malformed++
+		p.score -= ReputationMalformedPenalty
+	case flooding:
+		p.floods++
+		p.score -= ReputationFloodPenalty
+	}
+	score := p.score
+	r.mu.Unlock()
+
+	r.host.ConnManager().TagPeer(id, ReputationTag, int(score))
+	if score <= ReputationDisconnectScore {
+		if !wasDisconnected {
+			logrus.WithFields(logrus.Fields{"peer": id.String(), "score": score}).Warn(
+				"Disconnecting misbehaving peer",
+			)
+		}
+		if err := r.host.Network().ClosePeer(id); err != nil {
+			logrus.WithError(err).WithField("peer", id.String()).Debug("Failed to disconnect misbehaving peer")
+		}
+	}
+}
+
+// request counts a request from a peer, penalising it if it has made too
+// many lately.
+func (r *reputation) request(id peer.ID) {
+	now := time.Now()
+	r.mu.Lock()
+	p := r.lookup(id, now)
+	if now.Sub(p.windowStart) > ReputationFloodWindow {
+		p.windowStart = now
+		p.requests = 0
+	}
+	p.requests++
+	flooded := p.requests > ReputationFloodLimit
+	r.mu.Unlock()
+	if flooded {
+		r.penalise(id, flooding)
+	}
+}
+
+// disconnected reports whether a peer's score is too low for us to talk to
+// it.
+func (r *reputation) disconnected(id peer.ID) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.peers[id]
+	if !ok {
+		return false
+	}
+	p.decay(time.Now())
+	return p.score <= ReputationDisconnectScore
+}
+
+// wrap scores the requests that other nodes make of the handler. Federation
+// requests with a bad signature or that can't be parsed are penalised, as
+// is making too many requests.
+func (r *reputation) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// gostream gives the peer ID of the remote node as its address.
+		id, err := peer.IDB58Decode(req.RemoteAddr)
+		if err != nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		r.request(id)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, req)
+		if !strings.HasPrefix(req.URL.Path, "/_matrix/federation/") && !strings.HasPrefix(req.URL.Path, "/_matrix/key/") {
+			return
+		}
+		switch rec.status {
+		case http.StatusUnauthorized:
+			r.penalise(id, invalidSignature)
+		case http.StatusBadRequest:
+			r.penalise(id, malformed)
+		}
+	})
+}
+
+// Reputations returns how each peer that has misbehaved lately has behaved,
+// worst first.
+func (n *Node) Reputations() []PeerReputation {
+	r := n.reputation
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reps := make([]PeerReputation, 0, len(r.peers))
+	for id, p := range r.peers {
+		p.decay(now)
+		reps = append(reps, PeerReputation{
+			PeerID:            id.Pretty(),
+			Score:             p.score,
+			InvalidSignatures: p.invalidSignatures,
+			Malformed:         p.malformed,
+			Floods:            p.floods,
+			Disconnected:      p.score <= ReputationDisconnectScore,
+		})
+	}
+	sort.Slice(reps, func(i, j int) bool {
+		if reps[i].Score != reps[j].Score {
+			return reps[i].Score < reps[j].Score
+		}
+		return reps[i].PeerID < reps[j].PeerID
+	})
+	return reps
+}
@@ -0,0 +1,256 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// testHost is the part of a host that reputation uses, and remembers the
+// peers that were tagged and disconnected.
+type testHost struct {
+	host.Host
+	id      peer.ID
+	network *testNetwork
+	cm      *testConnManager
+}
+
+func (h *testHost) ID() peer.ID                      { return h.id }
+func (h *testHost) Network() network.Network         { return h.network }
+func (h *testHost) ConnManager() connmgr.ConnManager { return h.cm }
+
+type testNetwork struct {
+	network.Network
+	closed map[peer.ID]int
+}
+
+func (n *testNetwork) ClosePeer(id peer.ID) error {
+	n.closed[id]++
+	return nil
+}
+
+type testConnManager struct {
+	connmgr.NullConnMgr
+	tags map[peer.ID]int
+}
+
+func (cm *testConnManager) TagPeer(id peer.ID, tag string, value int) {
+	if tag == ReputationTag {
+		cm.tags[id] = value
+	}
+}
+
+func newTestReputation(t *testing.T) (*reputation, *testHost) {
+	h := &testHost{
+		id:      testPeerID(t),
+		network: &testNetwork{closed: make(map[peer.ID]int)},
+		cm:      &testConnManager{tags: make(map[peer.ID]int)},
+	}
+	return newReputation(h), h
+}
+
+func TestPeerReputationDecay(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		want    float64
+	}{
+		{"no time", 0, -100},
+		{"half-life", ReputationHalfLife, -50},
+		{"two half-lives", 2 * ReputationHalfLife, -25},
+		{"half a half-life", ReputationHalfLife / 2, -100 / math.Sqrt2},
+		{"clock went back", -time.Hour, -100},
+	}
+	for _, tt := range tests {
+		p := &peerReputation{score: -100, updated: start}
+		p.decay(start.Add(tt.elapsed))
+		if math.Abs(p.score-tt.want) > 1e-9 {
+			t.Errorf("%s: got score %v, wanted %v", tt.name, p.score, tt.want)
+		}
+		if !p.updated.Equal(start.Add(tt.elapsed)) {
+			t.Errorf("%s: reputation wasn't updated to now", tt.name)
+		}
+	}
+}
+
+func TestReputationPenalise(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    misbehaviour
+		penalty float64
+		count   func(p *peerReputation) int
+	}{
+		{"invalid signature", invalidSignature, ReputationInvalidSignaturePenalty, func(p *peerReputation) int { return p.invalidSignatures }},
+		{"malformed", malformed, ReputationMalformedPenalty, func(p *peerReputation) int { return p.malformed }},
+		{"flooding", flooding, ReputationFloodPenalty, func(p *peerReputation) int { return p.floods }},
+	}
+	for _, tt := range tests {
+		r, h := newTestReputation(t)
+		id := testPeerID(t)
+		r.penalise(id, tt.kind)
+		r.penalise(id, tt.kind)
+		p := r.peers[id]
+		if p == nil {
+			t.Errorf("%s: peer wasn't penalised", tt.name)
+			continue
+		}
+		if math.Abs(p.score+2*tt.penalty) > 1e-6 || tt.count(p) != 2 {
+			t.Errorf("%s: got score %v and count %d, wanted %v and 2", tt.name, p.score, tt.count(p), -2*tt.penalty)
+		}
+		if h.cm.tags[id] != int(p.score) {
+			t.Errorf("%s: got tag %d, wanted %d", tt.name, h.cm.tags[id], int(p.score))
+		}
+	}
+
+	r, h := newTestReputation(t)
+	r.penalise(h.id, invalidSignature)
+	if len(r.peers) != 0 {
+		t.Error("we were penalised")
+	}
+	var none *reputation
+	none.penalise(testPeerID(t), invalidSignature)
+}
+
+func TestReputationFlood(t *testing.T) {
+	r, _ := newTestReputation(t)
+	id := testPeerID(t)
+	for i := 0; i < ReputationFloodLimit; i++ {
+		r.request(id)
+	}
+	if p := r.peers[id]; p.floods != 0 || p.score != 0 {
+		t.Fatalf("got %d floods and score %v within the limit", p.floods, p.score)
+	}
+	r.request(id)
+	r.request(id)
+	if p := r.peers[id]; p.floods != 2 {
+		t.Errorf("got %d floods over the limit, wanted 2", p.floods)
+	}
+
+	// The count starts again once the window has passed.
+	r.peers[id].windowStart = time.Now().Add(-ReputationFloodWindow - time.Second)
+	r.request(id)
+	if p := r.peers[id]; p.floods != 2 || p.requests != 1 {
+		t.Errorf("got %d floods and %d requests in the new window, wanted 2 and 1", p.floods, p.requests)
+	}
+}
+
+func TestReputationDisconnected(t *testing.T) {
+	tests := []struct {
+		name         string
+		score        float64
+		age          time.Duration
+		disconnected bool
+	}{
+		{"no penalties", 0, 0, false},
+		{"above the threshold", ReputationDisconnectScore + 1, 0, false},
+		{"below the threshold", ReputationDisconnectScore - 1, 0, true},
+		{"well below the threshold", 2 * ReputationDisconnectScore, 0, true},
+		{"forgiven", 2*ReputationDisconnectScore + 1, ReputationHalfLife, false},
+	}
+	for _, tt := range tests {
+		r, _ := newTestReputation(t)
+		id := testPeerID(t)
+		r.peers[id] = &peerReputation{score: tt.score, updated: time.Now().Add(-tt.age)}
+		if got := r.disconnected(id); got != tt.disconnected {
+			t.Errorf("%s: got disconnected %v, wanted %v", tt.name, got, tt.disconnected)
+		}
+	}
+
+	r, h := newTestReputation(t)
+	if r.disconnected(testPeerID(t)) {
+		t.Error("unknown peer is disconnected")
+	}
+	var none *reputation
+	if none.disconnected(testPeerID(t)) {
+		t.Error("peer is disconnected without reputations")
+	}
+
+	// Penalising a peer past the threshold disconnects it. Some of the
+	// penalties have been forgiven by the last one, so it takes one more.
+	id := testPeerID(t)
+	for i := 0; i <= -ReputationDisconnectScore/ReputationInvalidSignaturePenalty; i++ {
+		if h.network.closed[id] != 0 {
+			t.Fatalf("peer was disconnected after %d invalid signatures", i)
+		}
+		r.penalise(id, invalidSignature)
+	}
+	if h.network.closed[id] == 0 {
+		t.Fatal("peer wasn't disconnected")
+	}
+	if !r.disconnected(id) {
+		t.Error("disconnected peer isn't reported as disconnected")
+	}
+}
+
+func TestReputationWrap(t *testing.T) {
+	id := testPeerID(t)
+	tests := []struct {
+		name       string
+		remote     string
+		path       string
+		status     int
+		signatures int
+		malformed  int
+	}{
+		{"federation", id.String(), "/_matrix/federation/v1/version", http.StatusOK, 0, 0},
+		{"federation unauthorised", id.String(), "/_matrix/federation/v1/send/1", http.StatusUnauthorized, 1, 0},
+		{"federation bad request", id.String(), "/_matrix/federation/v1/send/1", http.StatusBadRequest, 0, 1},
+		{"federation forbidden", id.String(), "/_matrix/federation/v1/send/1", http.StatusForbidden, 0, 0},
+		{"key unauthorised", id.String(), "/_matrix/key/v2/query", http.StatusUnauthorized, 1, 0},
+		{"key bad request", id.String(), "/_matrix/key/v2/query", http.StatusBadRequest, 0, 1},
+		{"client unauthorised", id.String(), "/_matrix/client/r0/sync", http.StatusUnauthorized, 0, 0},
+		{"client bad request", id.String(), "/_matrix/client/r0/sync", http.StatusBadRequest, 0, 0},
+		{"not a peer", "127.0.0.1:8008", "/_matrix/federation/v1/send/1", http.StatusUnauthorized, 0, 0},
+	}
+	for _, tt := range tests {
+		r, _ := newTestReputation(t)
+		status := tt.status
+		handler := r.wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(status)
+		}))
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.RemoteAddr = tt.remote
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: got status %d, wanted %d", tt.name, rec.Code, tt.status)
+		}
+		p, ok := r.peers[id]
+		if tt.remote != id.String() {
+			if len(r.peers) != 0 {
+				t.Errorf("%s: got reputations for %d peers, wanted none", tt.name, len(r.peers))
+			}
+			continue
+		}
+		if !ok || p.requests != 1 {
+			t.Errorf("%s: request wasn't counted", tt.name)
+			continue
+		}
+		if p.invalidSignatures != tt.signatures || p.malformed != tt.malformed {
+			t.Errorf("%s: got %d invalid signatures and %d malformed, wanted %d and %d",
+				tt.name, p.invalidSignatures, p.malformed, tt.signatures, tt.malformed)
+		}
+	}
+}
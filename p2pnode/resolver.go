@@ -0,0 +1,223 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/matrix-org/dendrite/common/keydb"
+	"github.com/sirupsen/logrus"
+)
+
+// ResolveTimeout is how long the federation client spends looking a server
+// up in the DHT and connecting to it before giving up on a request.
+const ResolveTimeout = time.Second * 30
+
+// FederationTag is the connection manager tag that protects connections to
+// servers that we have sent federation requests to recently, so that they
+// aren't pruned while they are still in use.
+const FederationTag = "matrix-federation"
+
+// resolverTransport wraps the libp2p HTTP transport so that requests to a
+// server that we aren't connected to first look the server up in the DHT,
+// using its server name as the peer ID, and connect to it. Connecting also
+// stores the signing key of the server, so we can check its responses.
+// There is no DNS involved at any point.
+type resolverTransport struct {
+	next  http.RoundTripper
+	host  host.Host
+	dht   *dht.IpfsDHT
+	keyDB keydb.Database
+	gate  *PeerGate
+	chaos *Chaos
+	idle  *idleConns
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *resolverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id, err := peer.IDB58Decode(req.URL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("server name %q isn't a peer ID: %s", req.URL.Host, err)
+	}
+	if err = t.resolve(req.Context(), id); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// resolve connects to the peer, if we aren't already connected to it. The
+// DHT is only asked for the peer's addresses if none of the ones that we
+// already know work.
+func (t *resolverTransport) resolve(ctx context.Context, id peer.ID) error {
+	if id == t.host.ID() {
+		return nil
+	}
+	if t.host.Network().Connectedness(id) == network.Connected {
+		t.idle.use(id, false)
+		return nil
+	}
+	if !t.gate.Allowed(id) {
+		return fmt.Errorf("server %s isn't allowed by the gate", id)
+	}
+	if t.chaos.Partitioned(id) {
+		return fmt.Errorf("server %s is partitioned from us", id)
+	}
+	ctx, cancel := context.WithTimeout(ctx, ResolveTimeout)
+	defer cancel()
+	logger := logrus.WithField("peer", id.String())
+	if addrs := t.host.Peerstore().Addrs(id); len(addrs) > 0 {
+		if err := connectPeer(ctx, t.host, t.keyDB, peer.AddrInfo{ID: id, Addrs: addrs}); err == nil {
+			t.idle.use(id, true)
+			return nil
+		}
+		logger.Debug("Failed to connect to server on known addresses, looking it up in the DHT")
+	}
+	info, err := t.dht.FindPeer(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to find server %s in the DHT: %s", id, err)
+	}
+	if err = connectPeer(ctx, t.host, t.keyDB, info); err != nil {
+		return fmt.Errorf("failed to connect to server %s: %s", id, err)
+	}
+	logger.WithField("addrs", info.Addrs).Info("Connected to server found in the DHT")
+	t.idle.use(id, true)
+	return nil
+}
+
+// idleConns keeps the connections that federation requests use open until
+// they have been idle for a while. Connections that were only dialed for
+// federation are closed then, unless we share rooms with the server, so
+// that we don't stay connected to every server that we have ever sent to.
+type idleConns struct {
+	host        host.Host
+	memberships *RoomMemberships
+	// timeout is how long a connection may be idle for. Zero means that
+	// connections are left to the connection manager.
+	timeout time.Duration
+
+	mu     sync.Mutex
+	used   map[peer.ID]time.Time
+	dialed map[peer.ID]bool
+}
+
+func newIdleConns(p2pHost host.Host, memberships *RoomMemberships, timeout time.Duration) *idleConns {
+	c := &idleConns{
+		host:        p2pHost,
+		memberships: memberships,
+		timeout:     timeout,
+		used:        make(map[peer.ID]time.Time),
+		dialed:      make(map[peer.ID]bool),
+	}
+	p2pHost.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			id := conn.RemotePeer()
+			if n.Connectedness(id) == network.Connected {
+				return
+			}
+			c.mu.Lock()
+			delete(c.dialed, id)
+			c.mu.Unlock()
+		},
+	})
+	return c
+}
+
+// use records that a federation request is using the connection to a peer,
+// which we dialed for the request if dialed is set.
+func (c *idleConns) use(id peer.ID, dialed bool) {
+	if c == nil || c.timeout == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.used[id]; !ok {
+		c.host.ConnManager().Protect(id, FederationTag)
+	}
+	c.used[id] = time.Now()
+	if dialed {
+		c.dialed[id] = true
+	}
+}
+
+// start closes connections once they are idle, until the context is done.
+func (c *idleConns) start(ctx context.Context) {
+	if c.timeout == 0 {
+		return
+	}
+	interval := c.timeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.closeIdle()
+		}
+	}
+}
+
+// closeIdle stops protecting the connections that federation hasn't used for
+// the timeout, and closes the ones that we only dialed for federation.
+func (c *idleConns) closeIdle() {
+	var closing []peer.ID
+	c.mu.Lock()
+	for id, used := range c.used {
+		if time.Since(used) < c.timeout {
+			continue
+		}
+		if c.busy(id) {
+			c.used[id] = time.Now()
+			continue
+		}
+		c.host.ConnManager().Unprotect(id, FederationTag)
+		delete(c.used, id)
+		if c.dialed[id] && len(c.memberships.SharedRooms(peerServerName(id))) == 0 {
+			closing = append(closing, id)
+		}
+		delete(c.dialed, id)
+	}
+	c.mu.Unlock()
+	for _, id := range closing {
+		logrus.WithField("peer", id.String()).Debug("Closing idle federation connection")
+		if err := c.host.Network().ClosePeer(id); err != nil {
+			logrus.WithError(err).WithField("peer", id.String()).Debug("Failed to close idle connection")
+		}
+	}
+}
+
+// busy reports whether a federation request to or from a peer is still in
+// flight.
+func (c *idleConns) busy(id peer.ID) bool {
+	for _, conn := range c.host.Network().ConnsToPeer(id) {
+		for _, s := range conn.GetStreams() {
+			if s.Protocol() == MatrixProtocol {
+				return true
+			}
+		}
+	}
+	return false
+}
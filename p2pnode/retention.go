@@ -0,0 +1,252 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/sirupsen/logrus"
+)
+
+// RetentionInterval is how often the events that have outlived the
+// retention policy of their room are purged.
+const RetentionInterval = time.Hour
+
+// DefaultMinRetention is the shortest that a room's retention policy can
+// have its events kept for unless the config says otherwise, so that
+// anyone who can set the policy of a room can't make us throw away its
+// history as soon as it arrives.
+const DefaultMinRetention = time.Hour * 24
+
+// PurgeBatchSize is how many events are purged at a time, to keep from
+// holding locks on the tables for long.
+const PurgeBatchSize = 1000
+
+const selectRoomRetentionsSQL = "" +
+	"SELECT c.room_id, (r.event_json::json)->'content'->>'max_lifetime'" +
+	" FROM syncapi_current_room_state c LEFT JOIN syncapi_current_room_state r" +
+	" ON r.room_id = c.room_id AND r.type = 'm.room.retention' AND r.state_key = ''" +
+	" WHERE c.type = 'm.room.create' AND c.state_key = ''"
+
+// The events of a room that were sent before a time. State events are never
+// purged, as they are needed to authorise other events, and neither are the
+// events that changed the state, which /sync works out the state from. The
+// latest event of each room is kept, so that the room still has a position.
+const deleteSyncEventsBeforeTSSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE id IN (" +
+	"SELECT id FROM syncapi_output_room_events WHERE room_id = $1" +
+	" AND id < (SELECT MAX(id) FROM syncapi_output_room_events WHERE room_id = $1)" +
+	" AND (event_json::json)->'state_key' IS NULL AND add_state_ids IS NULL AND remove_state_ids IS NULL" +
+	" AND ((event_json::json)->>'origin_server_ts')::BIGINT < $2" +
+	" ORDER BY id LIMIT $3) RETURNING event_id"
+
+// As with deleteSyncEventsBeforeTSSQL, but for the events before a position
+// in the stream rather than a time.
+const deleteSyncEventsBeforePositionSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE id IN (" +
+	"SELECT id FROM syncapi_output_room_events WHERE room_id = $1" +
+	" AND id < (SELECT MAX(id) FROM syncapi_output_room_events WHERE room_id = $1)" +
+	" AND (event_json::json)->'state_key' IS NULL AND add_state_ids IS NULL AND remove_state_ids IS NULL" +
+	" AND id < $2" +
+	" ORDER BY id LIMIT $3) RETURNING event_id"
+
+const selectEventPositionSQL = "" +
+	"SELECT id FROM syncapi_output_room_events WHERE room_id = $1 AND event_id = $2"
+
+const deleteSyncTopologySQL = "" +
+	"DELETE FROM syncapi_output_room_events_topology WHERE event_id = ANY($1)"
+
+// The latest events of a room are the prev_events of the next event sent in
+// it, so they are kept too.
+const deleteRoomserverEventsSQL = "" +
+	"WITH deleted AS (" +
+	"DELETE FROM roomserver_events e USING roomserver_rooms r" +
+	" WHERE e.event_id = ANY($1) AND e.event_state_key_nid = 0" +
+	" AND r.room_nid = e.room_nid AND NOT e.event_nid = ANY(r.latest_event_nids)" +
+	" RETURNING e.event_nid" +
+	") DELETE FROM roomserver_event_json WHERE event_nid IN (SELECT event_nid FROM deleted)"
+
+// retention purges the events of rooms once they are older than the room's
+// m.room.retention policy says to keep them for, or than the node keeps any
+// event for, whichever is shorter. Events are purged from the sync API and
+// the room server, but only those that nothing else depends on.
+type retention struct {
+	syncDB       *sql.DB
+	roomserverDB *sql.DB
+	// The longest that events are kept, or 0 for as long as their room says.
+	max time.Duration
+	// The shortest that a room can say to keep its events.
+	min time.Duration
+}
+
+func newRetention(cfg *config.Dendrite, max, min time.Duration) (*retention, error) {
+	syncDB, err := sql.Open("postgres", string(cfg.Database.SyncAPI))
+	if err != nil {
+		return nil, err
+	}
+	roomserverDB, err := sql.Open("postgres", string(cfg.Database.RoomServer))
+	if err != nil {
+		syncDB.Close() // nolint: errcheck
+		return nil, err
+	}
+	return &retention{syncDB: syncDB, roomserverDB: roomserverDB, max: max, min: min}, nil
+}
+
+// close closes the connections to the databases.
+func (r *retention) close() error {
+	err := r.syncDB.Close()
+	if rerr := r.roomserverDB.Close(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// start purges old events every RetentionInterval until the context is
+// done.
+func (r *retention) start(ctx context.Context) {
+	ticker := time.NewTicker(RetentionInterval)
+	defer ticker.Stop()
+	for {
+		if err := r.purgeExpired(ctx); err != nil {
+			logrus.WithError(err).Warn("Failed to purge expired events")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *retention) purgeExpired(ctx context.Context) error {
+	rows, err := r.syncDB.QueryContext(ctx, selectRoomRetentionsSQL)
+	if err != nil {
+		return err
+	}
+	lifetimes := make(map[string]time.Duration)
+	for rows.Next() {
+		var roomID string
+		var maxLifetime sql.NullString
+		if err = rows.Scan(&roomID, &maxLifetime); err != nil {
+			rows.Close() // nolint: errcheck
+			return err
+		}
+		if lifetime := r.lifetime(maxLifetime.String); lifetime > 0 {
+			lifetimes[roomID] = lifetime
+		}
+	}
+	rows.Close() // nolint: errcheck
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	now := time.Now()
+	for roomID, lifetime := range lifetimes {
+		purged, err := r.purge(ctx, roomID, now.Add(-lifetime))
+		if err != nil {
+			return err
+		}
+		if purged > 0 {
+			logrus.WithFields(logrus.Fields{"room_id": roomID, "events": purged}).Info("Purged expired events")
+		}
+	}
+	return nil
+}
+
+// lifetime returns how long to keep the events of a room with the given
+// max_lifetime in its retention policy, or 0 to keep them forever. A
+// max_lifetime that isn't a number of milliseconds is ignored.
+func (r *retention) lifetime(maxLifetime string) time.Duration {
+	lifetime := r.max
+	if ms, err := strconv.ParseInt(maxLifetime, 10, 64); err == nil && ms > 0 {
+		roomLifetime := time.Duration(ms) * time.Millisecond
+		if roomLifetime/time.Millisecond != time.Duration(ms) {
+			// It overflowed, and is forever in all but name.
+			roomLifetime = 0
+		} else if roomLifetime < r.min {
+			roomLifetime = r.min
+		}
+		if roomLifetime > 0 && (lifetime == 0 || roomLifetime < lifetime) {
+			lifetime = roomLifetime
+		}
+	}
+	return lifetime
+}
+
+// purge deletes the events of a room sent before a time that can be, and
+// returns how many were.
+func (r *retention) purge(ctx context.Context, roomID string, before time.Time) (int, error) {
+	return r.purgeAll(ctx, deleteSyncEventsBeforeTSSQL, roomID, before.UnixNano()/int64(time.Millisecond))
+}
+
+// purgeBefore deletes the events of a room that came before one of its
+// events that can be, and returns how many were. It returns sql.ErrNoRows
+// if we don't have the event.
+func (r *retention) purgeBefore(ctx context.Context, roomID, eventID string) (int, error) {
+	var position int64
+	if err := r.syncDB.QueryRowContext(ctx, selectEventPositionSQL, roomID, eventID).Scan(&position); err != nil {
+		return 0, err
+	}
+	return r.purgeAll(ctx, deleteSyncEventsBeforePositionSQL, roomID, position)
+}
+
+func (r *retention) purgeAll(ctx context.Context, query, roomID string, before int64) (int, error) {
+	purged := 0
+	for {
+		eventIDs, err := r.purgeBatch(ctx, query, roomID, before)
+		purged += len(eventIDs)
+		if err != nil || len(eventIDs) < PurgeBatchSize {
+			return purged, err
+		}
+	}
+}
+
+func (r *retention) purgeBatch(ctx context.Context, query, roomID string, before int64) ([]string, error) {
+	txn, err := r.syncDB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback() // nolint: errcheck
+	rows, err := txn.QueryContext(ctx, query, roomID, before, PurgeBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	var eventIDs []string
+	for rows.Next() {
+		var eventID string
+		if err = rows.Scan(&eventID); err != nil {
+			rows.Close() // nolint: errcheck
+			return nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	rows.Close() // nolint: errcheck
+	if err = rows.Err(); err != nil || len(eventIDs) == 0 {
+		return nil, err
+	}
+	if _, err = txn.ExecContext(ctx, deleteSyncTopologySQL, pq.StringArray(eventIDs)); err != nil {
+		return nil, err
+	}
+	// The room server's copies go first, so that if that fails the sync
+	// API's are still there to find them by next time.
+	if _, err = r.roomserverDB.ExecContext(ctx, deleteRoomserverEventsSQL, pq.StringArray(eventIDs)); err != nil {
+		return nil, err
+	}
+	return eventIDs, txn.Commit()
+}
@@ -0,0 +1,270 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// RoomDeletionLeaveTimeout is how long deleting a room waits for our users
+// to have left it.
+const RoomDeletionLeaveTimeout = time.Second * 30
+
+// errRoomNotFound is returned when deleting a room that we know nothing of.
+var errRoomNotFound = errors.New("no such room")
+
+// mxcURI matches the media that events refer to, e.g. in the url of an
+// m.image or the thumbnail_url of its info.
+var mxcURI = regexp.MustCompile(`mxc://([^/"]+)/([A-Za-z0-9_=-]+)`)
+
+const countLocalJoinsSQL = "" +
+	"SELECT COUNT(*) FROM syncapi_current_room_state" +
+	" WHERE room_id = $1 AND type = 'm.room.member' AND membership = 'join' AND state_key LIKE $2"
+
+const selectRoomURLEventsSQL = "" +
+	"SELECT event_json FROM syncapi_output_room_events WHERE room_id = $1 AND contains_url"
+
+const mediaReferencedElsewhereSQL = "" +
+	"SELECT EXISTS (SELECT 1 FROM syncapi_output_room_events" +
+	" WHERE room_id <> $1 AND contains_url AND strpos(event_json, $2) > 0)"
+
+var deleteSyncRoomSQLs = []string{
+	"DELETE FROM syncapi_output_room_events_topology WHERE room_id = $1",
+	"DELETE FROM syncapi_output_room_events WHERE room_id = $1",
+	"DELETE FROM syncapi_current_room_state WHERE room_id = $1",
+	"DELETE FROM syncapi_backward_extremities WHERE room_id = $1",
+	"DELETE FROM syncapi_invite_events WHERE room_id = $1",
+	"DELETE FROM syncapi_account_data_type WHERE room_id = $1",
+	"DELETE FROM p2p_receipts WHERE room_id = $1",
+}
+
+const selectRoomNIDSQL = "" +
+	"SELECT room_nid FROM roomserver_rooms WHERE room_id = $1"
+
+// The events go last, as the others are found through them.
+var deleteRoomserverRoomSQLs = []string{
+	"DELETE FROM roomserver_event_json WHERE event_nid IN (SELECT event_nid FROM roomserver_events WHERE room_nid = $1)",
+	"DELETE FROM roomserver_previous_events WHERE previous_event_id IN (SELECT event_id FROM roomserver_events WHERE room_nid = $1)",
+	"DELETE FROM roomserver_transactions WHERE event_id IN (SELECT event_id FROM roomserver_events WHERE room_nid = $1)",
+	"DELETE FROM roomserver_state_block WHERE state_block_nid IN (SELECT UNNEST(state_block_nids) FROM roomserver_state_snapshots WHERE room_nid = $1)",
+	"DELETE FROM roomserver_state_snapshots WHERE room_nid = $1",
+	"DELETE FROM roomserver_invites WHERE room_nid = $1",
+	"DELETE FROM roomserver_membership WHERE room_nid = $1",
+	"DELETE FROM roomserver_rooms WHERE room_nid = $1",
+	"DELETE FROM roomserver_events WHERE room_nid = $1",
+}
+
+const deleteRoomAliasesSQL = "" +
+	"DELETE FROM roomserver_room_aliases WHERE room_id = $1"
+
+const deletePublicRoomSQL = "" +
+	"DELETE FROM publicroomsapi_public_rooms WHERE room_id = $1"
+
+// roomDeletion deletes everything that we have of a room: its state and
+// events in the sync API and the room server, its aliases and directory
+// listing, and the media that only it refers to. Our users are made to leave
+// it first, so that the other servers in it stop sending us its events.
+type roomDeletion struct {
+	syncDB        *sql.DB
+	roomserverDB  *sql.DB
+	publicRoomsDB *sql.DB
+	cfg           *config.Dendrite
+	memberships   *RoomMemberships
+	deactivation  *accountDeactivation
+}
+
+func newRoomDeletion(
+	cfg *config.Dendrite, memberships *RoomMemberships, deactivation *accountDeactivation,
+) (*roomDeletion, error) {
+	var dbs [3]*sql.DB
+	for i, dsn := range []config.DataSource{cfg.Database.SyncAPI, cfg.Database.RoomServer, cfg.Database.PublicRoomsAPI} {
+		db, err := sql.Open("postgres", string(dsn))
+		if err != nil {
+			return nil, err
+		}
+		dbs[i] = db
+	}
+	return &roomDeletion{
+		syncDB:        dbs[0],
+		roomserverDB:  dbs[1],
+		publicRoomsDB: dbs[2],
+		cfg:           cfg,
+		memberships:   memberships,
+		deactivation:  deactivation,
+	}, nil
+}
+
+// delete deletes a room, returning errRoomNotFound if we have nothing of it.
+func (d *roomDeletion) delete(ctx context.Context, roomID string) error {
+	if err := d.leave(ctx, roomID); err != nil {
+		return err
+	}
+	media, err := d.media(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	found, err := d.deleteSync(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	foundRoomserver, err := d.deleteRoomserver(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if !found && !foundRoomserver {
+		return errRoomNotFound
+	}
+	if _, err = d.publicRoomsDB.ExecContext(ctx, deletePublicRoomSQL, roomID); err != nil {
+		return err
+	}
+	for _, m := range media {
+		if err = d.deactivation.eraseMedia(ctx, gomatrixserverlib.ServerName(m[1]), m[2]); err != nil {
+			return err
+		}
+	}
+	logrus.WithFields(logrus.Fields{"room_id": roomID, "media": len(media)}).Info("Deleted room")
+	return nil
+}
+
+// leave makes our users leave a room, and waits for the sync API to have
+// seen them go, so that their leaves aren't written after the room has been
+// deleted.
+func (d *roomDeletion) leave(ctx context.Context, roomID string) error {
+	suffix := ":" + string(d.cfg.Matrix.ServerName)
+	for _, userID := range d.memberships.RoomUsers(roomID) {
+		if !strings.HasSuffix(userID, suffix) {
+			continue
+		}
+		userID := userID
+		leave := gomatrixserverlib.EventBuilder{
+			Sender:   userID,
+			RoomID:   roomID,
+			Type:     gomatrixserverlib.MRoomMember,
+			StateKey: &userID,
+		}
+		if err := leave.SetContent(map[string]string{"membership": "leave"}); err != nil {
+			return err
+		}
+		if err := d.deactivation.send(ctx, &leave); err != nil {
+			return fmt.Errorf("failed to make %s leave: %s", userID, err)
+		}
+	}
+	deadline := time.Now().Add(RoomDeletionLeaveTimeout)
+	for {
+		var joined int
+		if err := d.syncDB.QueryRowContext(ctx, countLocalJoinsSQL, roomID, "%"+suffix).Scan(&joined); err != nil {
+			return err
+		}
+		if joined == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d of our users are still in the room", joined)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// media returns the media that the events of a room refer to, as matches of
+// mxcURI, leaving out any that the events of other rooms refer to as well.
+func (d *roomDeletion) media(ctx context.Context, roomID string) ([][]string, error) {
+	rows, err := d.syncDB.QueryContext(ctx, selectRoomURLEventsSQL, roomID)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string][]string)
+	for rows.Next() {
+		var eventJSON string
+		if err = rows.Scan(&eventJSON); err != nil {
+			rows.Close() // nolint: errcheck
+			return nil, err
+		}
+		for _, m := range mxcURI.FindAllStringSubmatch(eventJSON, -1) {
+			seen[m[0]] = m
+		}
+	}
+	rows.Close() // nolint: errcheck
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	var media [][]string
+	for uri, m := range seen {
+		var elsewhere bool
+		if err = d.syncDB.QueryRowContext(ctx, mediaReferencedElsewhereSQL, roomID, uri).Scan(&elsewhere); err != nil {
+			return nil, err
+		}
+		if !elsewhere {
+			media = append(media, m)
+		}
+	}
+	return media, nil
+}
+
+func (d *roomDeletion) deleteSync(ctx context.Context, roomID string) (bool, error) {
+	txn, err := d.syncDB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer txn.Rollback() // nolint: errcheck
+	found := false
+	for _, query := range deleteSyncRoomSQLs {
+		res, err := txn.ExecContext(ctx, query, roomID)
+		if err != nil {
+			return false, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			found = true
+		}
+	}
+	return found, txn.Commit()
+}
+
+func (d *roomDeletion) deleteRoomserver(ctx context.Context, roomID string) (bool, error) {
+	txn, err := d.roomserverDB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer txn.Rollback() // nolint: errcheck
+	if _, err = txn.ExecContext(ctx, deleteRoomAliasesSQL, roomID); err != nil {
+		return false, err
+	}
+	var roomNID int64
+	err = txn.QueryRowContext(ctx, selectRoomNIDSQL, roomID).Scan(&roomNID)
+	if err == sql.ErrNoRows {
+		return false, txn.Commit()
+	} else if err != nil {
+		return false, err
+	}
+	for _, query := range deleteRoomserverRoomSQLs {
+		if _, err = txn.ExecContext(ctx, query, roomNID); err != nil {
+			return false, err
+		}
+	}
+	return true, txn.Commit()
+}
@@ -0,0 +1,173 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/sirupsen/logrus"
+)
+
+// RoomDirectoryTopic is the gossipsub topic that nodes publish the rooms in
+// their directory to. The public rooms API also still gossips on its own
+// /matrix/publicRooms topic, which older nodes listen to.
+const RoomDirectoryTopic = "matrix-room-directory"
+
+// RoomDirectoryInterval is how often we publish the rooms in our directory.
+const RoomDirectoryInterval = time.Second * 10
+
+// RoomDirectoryLifetime is how long a gossiped room stays listed after it was
+// last published, so that rooms leave the directory once the nodes that
+// publish them have gone.
+const RoomDirectoryLifetime = time.Minute
+
+// gossipedRoom is a room that another node published, and when it did.
+type gossipedRoom struct {
+	published time.Time
+	room      publicRoom
+}
+
+// roomDirectoryGossip publishes the rooms in our directory to the
+// RoomDirectoryTopic, and lists the rooms that other nodes publish there in
+// /publicRooms, so that rooms can be found on nodes that we aren't
+// connected to.
+type roomDirectoryGossip struct {
+	pubsub     *pubsub.PubSub
+	self       peer.ID
+	local      func(ctx context.Context) ([]publicRoom, error)
+	policy     *FederationPolicy
+	reputation *reputation
+
+	mu    sync.Mutex
+	found map[string]gossipedRoom
+}
+
+func newRoomDirectoryGossip(
+	ps *pubsub.PubSub, self peer.ID, directory *publicRoomsFanout, policy *FederationPolicy, rep *reputation,
+) *roomDirectoryGossip {
+	return &roomDirectoryGossip{
+		pubsub:     ps,
+		self:       self,
+		local:      directory.localRooms,
+		policy:     policy,
+		reputation: rep,
+		found:      make(map[string]gossipedRoom),
+	}
+}
+
+// start subscribes to the topic and publishes our rooms to it every
+// RoomDirectoryInterval, until the context is done.
+func (g *roomDirectoryGossip) start(ctx context.Context) error {
+	topic, err := g.pubsub.Join(RoomDirectoryTopic)
+	if err != nil {
+		return err
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		_ = topic.Close()
+		return err
+	}
+	go g.receive(ctx, sub)
+	go func() {
+		defer topic.Close() // nolint: errcheck
+		defer sub.Cancel()
+		ticker := time.NewTicker(RoomDirectoryInterval)
+		defer ticker.Stop()
+		for {
+			g.publish(ctx, topic)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// publish publishes each of the rooms in our directory.
+func (g *roomDirectoryGossip) publish(ctx context.Context, topic *pubsub.Topic) {
+	rooms, err := g.local(ctx)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to get public rooms to gossip")
+		return
+	}
+	for _, room := range rooms {
+		data, err := json.Marshal(room)
+		if err == nil {
+			err = topic.Publish(ctx, data)
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("room_id", room.RoomID).Warn("Failed to gossip public room")
+		}
+	}
+}
+
+// receive lists the rooms that other nodes publish until the subscription
+// is cancelled.
+func (g *roomDirectoryGossip) receive(ctx context.Context, sub *pubsub.Subscription) {
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		g.onMessage(msg.GetFrom(), msg.GetData(), time.Now())
+	}
+}
+
+// onMessage lists a room published by a peer.
+func (g *roomDirectoryGossip) onMessage(from peer.ID, data []byte, now time.Time) {
+	if from == g.self || !g.policy.Allowed(peerServerName(from)) {
+		return
+	}
+	var room publicRoom
+	if err := json.Unmarshal(data, &room); err != nil || room.RoomID == "" {
+		logrus.WithField("peer", from.String()).Debug("Ignoring invalid gossiped public room")
+		g.reputation.penalise(from, malformed)
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for roomID, r := range g.found {
+		if now.Sub(r.published) >= RoomDirectoryLifetime {
+			delete(g.found, roomID)
+		}
+	}
+	g.found[room.RoomID] = gossipedRoom{published: now, room: room}
+}
+
+// rooms returns the rooms that other nodes have published recently enough,
+// in the order of their room IDs.
+func (g *roomDirectoryGossip) rooms(now time.Time) []publicRoom {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	rooms := make([]publicRoom, 0, len(g.found))
+	for _, r := range g.found {
+		if now.Sub(r.published) < RoomDirectoryLifetime {
+			rooms = append(rooms, r.room)
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].RoomID < rooms[j].RoomID })
+	return rooms
+}
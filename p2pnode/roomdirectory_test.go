@@ -0,0 +1,79 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestRoomDirectoryGossip(t *testing.T) {
+	self, friend, banned := testPeerID(t), testPeerID(t), testPeerID(t)
+	policy, err := loadFederationPolicy(filepath.Join("/nonexistent", FederationPolicyFileName), "self", federationPolicyFile{
+		Deny: []string{banned.String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &roomDirectoryGossip{self: self, policy: policy, found: make(map[string]gossipedRoom)}
+	start := time.Now()
+
+	tests := []struct {
+		name  string
+		from  peer.ID
+		data  string
+		at    time.Duration
+		rooms []string
+	}{
+		{"room", friend, `{"room_id":"!b:example.com","name":"B"}`, 0, []string{"!b:example.com"}},
+		{"another room", friend, `{"room_id":"!a:example.com"}`, time.Second, []string{"!a:example.com", "!b:example.com"}},
+		{"ourselves", self, `{"room_id":"!c:example.com"}`, time.Second, []string{"!a:example.com", "!b:example.com"}},
+		{"denied by the policy", banned, `{"room_id":"!c:example.com"}`, time.Second, []string{"!a:example.com", "!b:example.com"}},
+		{"malformed", friend, `not json`, time.Second, []string{"!a:example.com", "!b:example.com"}},
+		{"no room ID", friend, `{"name":"C"}`, time.Second, []string{"!a:example.com", "!b:example.com"}},
+		{"republished", friend, `{"room_id":"!b:example.com","name":"B2"}`, RoomDirectoryLifetime / 2, []string{"!a:example.com", "!b:example.com"}},
+		{"expired", friend, `{"room_id":"!c:example.com"}`, RoomDirectoryLifetime + time.Second, []string{"!b:example.com", "!c:example.com"}},
+	}
+	for _, tt := range tests {
+		now := start.Add(tt.at)
+		g.onMessage(tt.from, []byte(tt.data), now)
+		rooms := g.rooms(now)
+		var got []string
+		for _, room := range rooms {
+			got = append(got, room.RoomID)
+		}
+		if len(got) != len(tt.rooms) {
+			t.Errorf("%s: got rooms %v, wanted %v", tt.name, got, tt.rooms)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.rooms[i] {
+				t.Errorf("%s: got rooms %v, wanted %v", tt.name, got, tt.rooms)
+				break
+			}
+		}
+	}
+	if rooms := g.rooms(start.Add(RoomDirectoryLifetime / 2)); len(rooms) == 0 || rooms[0].Name != "B2" {
+		t.Errorf("republished room wasn't updated: %+v", rooms)
+	}
+
+	var none *roomDirectoryGossip
+	if rooms := none.rooms(start); len(rooms) != 0 {
+		t.Errorf("got rooms %v without gossip", rooms)
+	}
+}
@@ -0,0 +1,460 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// RoomKeysClientPathPrefix starts the client APIs for backing up room
+	// keys: /version and /keys.
+	RoomKeysClientPathPrefix = "/_matrix/client/r0/room_keys/"
+	// UnstableRoomKeysClientPathPrefix starts the same APIs under the prefix
+	// that some clients still use.
+	UnstableRoomKeysClientPathPrefix = "/_matrix/client/unstable/room_keys/"
+)
+
+const roomKeysSchema = `
+CREATE SEQUENCE IF NOT EXISTS p2p_key_backup_version;
+
+-- The key backup versions of our users. Versions are never reused, even
+-- once deleted. The etag goes up whenever the keys in the backup change.
+CREATE TABLE IF NOT EXISTS p2p_key_backup_versions (
+    version BIGINT PRIMARY KEY DEFAULT nextval('p2p_key_backup_version'),
+    user_id TEXT NOT NULL,
+    algorithm TEXT NOT NULL,
+    auth_data TEXT NOT NULL,
+    etag BIGINT NOT NULL DEFAULT 0
+);
+
+-- The room keys in each backup version. The session data is encrypted by
+-- the client, so the server only sees how good each key is.
+CREATE TABLE IF NOT EXISTS p2p_key_backups (
+    version BIGINT NOT NULL,
+    room_id TEXT NOT NULL,
+    session_id TEXT NOT NULL,
+    first_message_index BIGINT NOT NULL,
+    forwarded_count BIGINT NOT NULL,
+    is_verified BOOLEAN NOT NULL,
+    session_data TEXT NOT NULL,
+    PRIMARY KEY (version, room_id, session_id)
+);
+`
+
+const insertKeyBackupVersionSQL = "" +
+	"INSERT INTO p2p_key_backup_versions (user_id, algorithm, auth_data) VALUES ($1, $2, $3) RETURNING version"
+
+const selectLatestKeyBackupVersionSQL = "" +
+	"SELECT version, algorithm, auth_data, etag FROM p2p_key_backup_versions" +
+	" WHERE user_id = $1 ORDER BY version DESC LIMIT 1"
+
+const selectKeyBackupVersionSQL = "" +
+	"SELECT version, algorithm, auth_data, etag FROM p2p_key_backup_versions" +
+	" WHERE user_id = $1 AND version = $2"
+
+const updateKeyBackupVersionSQL = "" +
+	"UPDATE p2p_key_backup_versions SET auth_data = $3 WHERE user_id = $1 AND version = $2"
+
+const deleteKeyBackupVersionSQL = "" +
+	"DELETE FROM p2p_key_backup_versions WHERE user_id = $1 AND version = $2"
+
+const bumpKeyBackupEtagSQL = "" +
+	"UPDATE p2p_key_backup_versions SET etag = etag + 1 WHERE version = $1"
+
+// A key replaces the one in the backup only if it is better: verified, then
+// able to decrypt earlier messages, then forwarded fewer times.
+const upsertKeyBackupSQL = "" +
+	"INSERT INTO p2p_key_backups (version, room_id, session_id, first_message_index, forwarded_count, is_verified, session_data)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7)" +
+	" ON CONFLICT (version, room_id, session_id) DO UPDATE" +
+	" SET first_message_index = $4, forwarded_count = $5, is_verified = $6, session_data = $7" +
+	" WHERE (NOT p2p_key_backups.is_verified AND $6) OR (p2p_key_backups.is_verified = $6 AND" +
+	" ($4 < p2p_key_backups.first_message_index OR" +
+	" ($4 = p2p_key_backups.first_message_index AND $5 < p2p_key_backups.forwarded_count)))"
+
+// The room and session are optional: empty strings match everything.
+const selectKeyBackupsSQL = "" +
+	"SELECT room_id, session_id, first_message_index, forwarded_count, is_verified, session_data FROM p2p_key_backups" +
+	" WHERE version = $1 AND ($2::TEXT = '' OR room_id = $2) AND ($3::TEXT = '' OR session_id = $3)"
+
+const deleteKeyBackupsSQL = "" +
+	"DELETE FROM p2p_key_backups" +
+	" WHERE version = $1 AND ($2::TEXT = '' OR room_id = $2) AND ($3::TEXT = '' OR session_id = $3)"
+
+const countKeyBackupsSQL = "" +
+	"SELECT COUNT(*) FROM p2p_key_backups WHERE version = $1"
+
+// keyBackupVersion describes a key backup version to and from clients.
+type keyBackupVersion struct {
+	Algorithm string          `json:"algorithm"`
+	AuthData  json.RawMessage `json:"auth_data"`
+	Version   string          `json:"version,omitempty"`
+	Count     *int64          `json:"count,omitempty"`
+	ETag      string          `json:"etag,omitempty"`
+}
+
+// keyBackupData is a backed up room key. The session data is opaque.
+type keyBackupData struct {
+	FirstMessageIndex int64           `json:"first_message_index"`
+	ForwardedCount    int64           `json:"forwarded_count"`
+	IsVerified        bool            `json:"is_verified"`
+	SessionData       json.RawMessage `json:"session_data"`
+}
+
+// roomKeyBackup holds the keys of the sessions of a room in a backup.
+type roomKeyBackup struct {
+	Sessions map[string]keyBackupData `json:"sessions"`
+}
+
+// keyBackupKeys holds all of the keys in a backup, by room.
+type keyBackupKeys struct {
+	Rooms map[string]roomKeyBackup `json:"rooms"`
+}
+
+// roomKeys stores our users' backups of their room keys, encrypted by their
+// clients, so that a new device or a reinstalled node can still decrypt
+// history. Dendrite has no key backup.
+type roomKeys struct {
+	db       *sql.DB
+	authData auth.Data
+}
+
+func newRoomKeys(dataSourceName string, authData auth.Data) (*roomKeys, error) {
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(roomKeysSchema); err != nil {
+		return nil, err
+	}
+	return &roomKeys{db: db, authData: authData}, nil
+}
+
+// setup registers the client APIs, under both prefixes.
+func (r *roomKeys) setup(mux *http.ServeMux) {
+	handler := common.WrapHandlerInCORS(common.MakeAuthAPI("room_keys", r.authData,
+		func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			// Everything after /room_keys/, for either prefix.
+			path := req.URL.Path[strings.Index(req.URL.Path, "/room_keys/")+len("/room_keys/"):]
+			parts := strings.Split(path, "/")
+			switch {
+			case parts[0] == "version" && len(parts) <= 2:
+				version := ""
+				if len(parts) == 2 {
+					version = parts[1]
+				}
+				return r.serveVersion(req, device, version)
+			case parts[0] == "keys" && len(parts) <= 3:
+				roomID, sessionID := "", ""
+				if len(parts) > 1 {
+					roomID = parts[1]
+				}
+				if len(parts) > 2 {
+					sessionID = parts[2]
+				}
+				return r.serveKeys(req, device, roomID, sessionID)
+			default:
+				return util.JSONResponse{
+					Code: http.StatusNotFound,
+					JSON: jsonerror.NotFound("Unknown room keys API"),
+				}
+			}
+		},
+	))
+	mux.Handle(RoomKeysClientPathPrefix, handler)
+	mux.Handle(UnstableRoomKeysClientPathPrefix, handler)
+}
+
+// serveVersion creates, returns, updates and deletes backup versions. An
+// empty version means the latest.
+func (r *roomKeys) serveVersion(req *http.Request, device *authtypes.Device, version string) util.JSONResponse {
+	ctx := req.Context()
+	switch req.Method {
+	case http.MethodPost:
+		if version != "" {
+			break
+		}
+		var body keyBackupVersion
+		if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+			return *resErr
+		}
+		if body.Algorithm == "" || len(body.AuthData) == 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("The algorithm and auth_data are needed"),
+			}
+		}
+		var id int64
+		err := r.db.QueryRowContext(ctx, insertKeyBackupVersionSQL, device.UserID, body.Algorithm, string(body.AuthData)).Scan(&id)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		return util.JSONResponse{Code: http.StatusOK, JSON: map[string]string{"version": strconv.FormatInt(id, 10)}}
+	case http.MethodGet:
+		v, err := r.version(ctx, device.UserID, version)
+		if err == sql.ErrNoRows {
+			return noKeyBackup()
+		} else if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		return util.JSONResponse{Code: http.StatusOK, JSON: v}
+	case http.MethodPut:
+		if version == "" {
+			break
+		}
+		var body keyBackupVersion
+		if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+			return *resErr
+		}
+		v, err := r.version(ctx, device.UserID, version)
+		if err == sql.ErrNoRows {
+			return noKeyBackup()
+		} else if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		// Only the auth data can change.
+		if body.Algorithm != v.Algorithm || (body.Version != "" && body.Version != v.Version) || len(body.AuthData) == 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Only the auth_data of a backup can change"),
+			}
+		}
+		if _, err = r.db.ExecContext(ctx, updateKeyBackupVersionSQL, device.UserID, v.Version, string(body.AuthData)); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	case http.MethodDelete:
+		if version == "" {
+			break
+		}
+		v, err := r.version(ctx, device.UserID, version)
+		if err == sql.ErrNoRows {
+			return noKeyBackup()
+		} else if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if _, err = r.db.ExecContext(ctx, deleteKeyBackupsSQL, v.Version, "", ""); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if _, err = r.db.ExecContext(ctx, deleteKeyBackupVersionSQL, device.UserID, v.Version); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	}
+	return util.JSONResponse{Code: http.StatusMethodNotAllowed, JSON: jsonerror.NotFound("Bad method")}
+}
+
+// serveKeys stores, returns and deletes the keys in a backup, of every room
+// or of one room or session. Keys can only be stored in the latest version.
+func (r *roomKeys) serveKeys(req *http.Request, device *authtypes.Device, roomID, sessionID string) util.JSONResponse {
+	ctx := req.Context()
+	version := req.URL.Query().Get("version")
+	if version == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("The version is needed"),
+		}
+	}
+	v, err := r.version(ctx, device.UserID, version)
+	if err != nil && err != sql.ErrNoRows {
+		return httputil.LogThenError(req, err)
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		latest, err := r.version(ctx, device.UserID, "")
+		if err == sql.ErrNoRows {
+			return noKeyBackup()
+		} else if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if v == nil || v.Version != latest.Version {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: map[string]string{
+					"errcode":         "M_WRONG_ROOM_KEYS_VERSION",
+					"error":           "Keys can only be added to the latest backup",
+					"current_version": latest.Version,
+				},
+			}
+		}
+		var body keyBackupKeys
+		switch {
+		case sessionID != "":
+			var key keyBackupData
+			if resErr := httputil.UnmarshalJSONRequest(req, &key); resErr != nil {
+				return *resErr
+			}
+			body.Rooms = map[string]roomKeyBackup{roomID: {Sessions: map[string]keyBackupData{sessionID: key}}}
+		case roomID != "":
+			var room roomKeyBackup
+			if resErr := httputil.UnmarshalJSONRequest(req, &room); resErr != nil {
+				return *resErr
+			}
+			body.Rooms = map[string]roomKeyBackup{roomID: room}
+		default:
+			if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+				return *resErr
+			}
+		}
+		if err = r.store(ctx, v, &body); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if v, err = r.version(ctx, device.UserID, v.Version); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		return util.JSONResponse{Code: http.StatusOK, JSON: map[string]interface{}{"etag": v.ETag, "count": *v.Count}}
+	case http.MethodGet:
+		if v == nil {
+			return noKeyBackup()
+		}
+		keys, err := r.keys(ctx, v.Version, roomID, sessionID)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		switch {
+		case sessionID != "":
+			key, ok := keys.Rooms[roomID].Sessions[sessionID]
+			if !ok {
+				return util.JSONResponse{Code: http.StatusNotFound, JSON: jsonerror.NotFound("No key for the session")}
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: key}
+		case roomID != "":
+			room, ok := keys.Rooms[roomID]
+			if !ok {
+				room.Sessions = map[string]keyBackupData{}
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: room}
+		default:
+			return util.JSONResponse{Code: http.StatusOK, JSON: keys}
+		}
+	case http.MethodDelete:
+		if v == nil {
+			return noKeyBackup()
+		}
+		res, err := r.db.ExecContext(ctx, deleteKeyBackupsSQL, v.Version, roomID, sessionID)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if rows, err := res.RowsAffected(); err == nil && rows > 0 {
+			if _, err = r.db.ExecContext(ctx, bumpKeyBackupEtagSQL, v.Version); err != nil {
+				return httputil.LogThenError(req, err)
+			}
+		}
+		if v, err = r.version(ctx, device.UserID, v.Version); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		return util.JSONResponse{Code: http.StatusOK, JSON: map[string]interface{}{"etag": v.ETag, "count": *v.Count}}
+	}
+	return util.JSONResponse{Code: http.StatusMethodNotAllowed, JSON: jsonerror.NotFound("Bad method")}
+}
+
+// store adds keys to a backup, keeping the existing key of a session if it
+// is better, and moves the etag on if any key changed.
+func (r *roomKeys) store(ctx context.Context, v *keyBackupVersion, body *keyBackupKeys) error {
+	changed := false
+	for roomID, room := range body.Rooms {
+		for sessionID, key := range room.Sessions {
+			res, err := r.db.ExecContext(
+				ctx, upsertKeyBackupSQL, v.Version, roomID, sessionID,
+				key.FirstMessageIndex, key.ForwardedCount, key.IsVerified, string(key.SessionData),
+			)
+			if err != nil {
+				return err
+			}
+			if rows, err := res.RowsAffected(); err == nil && rows > 0 {
+				changed = true
+			}
+		}
+	}
+	if changed {
+		if _, err := r.db.ExecContext(ctx, bumpKeyBackupEtagSQL, v.Version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// version returns a backup version of the user, or the latest if the version
+// is empty. It returns sql.ErrNoRows if there is no such version.
+func (r *roomKeys) version(ctx context.Context, userID, version string) (*keyBackupVersion, error) {
+	var row *sql.Row
+	if version == "" {
+		row = r.db.QueryRowContext(ctx, selectLatestKeyBackupVersionSQL, userID)
+	} else {
+		id, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return nil, sql.ErrNoRows
+		}
+		row = r.db.QueryRowContext(ctx, selectKeyBackupVersionSQL, userID, id)
+	}
+	var id, etag, count int64
+	var v keyBackupVersion
+	var authData string
+	if err := row.Scan(&id, &v.Algorithm, &authData, &etag); err != nil {
+		return nil, err
+	}
+	if err := r.db.QueryRowContext(ctx, countKeyBackupsSQL, id).Scan(&count); err != nil {
+		return nil, err
+	}
+	v.AuthData = json.RawMessage(authData)
+	v.Version = strconv.FormatInt(id, 10)
+	v.ETag = strconv.FormatInt(etag, 10)
+	v.Count = &count
+	return &v, nil
+}
+
+// keys returns the keys in a backup, of every room or of one room or session.
+func (r *roomKeys) keys(ctx context.Context, version, roomID, sessionID string) (*keyBackupKeys, error) {
+	rows, err := r.db.QueryContext(ctx, selectKeyBackupsSQL, version, roomID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	keys := &keyBackupKeys{Rooms: make(map[string]roomKeyBackup)}
+	for rows.Next() {
+		var keyRoomID, keySessionID, sessionData string
+		var key keyBackupData
+		if err = rows.Scan(&keyRoomID, &keySessionID, &key.FirstMessageIndex, &key.ForwardedCount, &key.IsVerified, &sessionData); err != nil {
+			return nil, err
+		}
+		key.SessionData = json.RawMessage(sessionData)
+		room, ok := keys.Rooms[keyRoomID]
+		if !ok {
+			room.Sessions = make(map[string]keyBackupData)
+			keys.Rooms[keyRoomID] = room
+		}
+		room.Sessions[keySessionID] = key
+	}
+	return keys, rows.Err()
+}
+
+// noKeyBackup is the response when the user has no such backup version.
+func noKeyBackup() util.JSONResponse {
+	return util.JSONResponse{Code: http.StatusNotFound, JSON: jsonerror.NotFound("No such key backup")}
+}
@@ -0,0 +1,259 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// RoomMemberships keeps track of which users are joined to which rooms, so
+// that we know which peers we share rooms with. It is built by consuming the
+// room server's output log from the start every time the node starts, so it
+// doesn't need any storage of its own.
+type RoomMemberships struct {
+	mu sync.RWMutex
+	// room ID -> user ID -> true if joined
+	rooms map[string]map[string]bool
+	// server name -> number of rooms that it has joined users in
+	servers   map[gomatrixserverlib.ServerName]int
+	listeners []func(server gomatrixserverlib.ServerName, rooms int)
+}
+
+func newRoomMemberships() *RoomMemberships {
+	return &RoomMemberships{
+		rooms:   make(map[string]map[string]bool),
+		servers: make(map[gomatrixserverlib.ServerName]int),
+	}
+}
+
+// OnChange registers a function to call whenever the number of rooms that
+// we share with a server changes. It is called without any locks held.
+func (m *RoomMemberships) OnChange(f func(server gomatrixserverlib.ServerName, rooms int)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listeners = append(m.listeners, f)
+}
+
+// SharedRooms returns the IDs of the rooms that the server has users joined
+// to.
+func (m *RoomMemberships) SharedRooms(server gomatrixserverlib.ServerName) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var roomIDs []string
+	for roomID, users := range m.rooms {
+		for userID := range users {
+			if _, domain, err := gomatrixserverlib.SplitID('@', userID); err == nil && domain == server {
+				roomIDs = append(roomIDs, roomID)
+				break
+			}
+		}
+	}
+	return roomIDs
+}
+
+// Joined returns whether the user is joined to the room.
+func (m *RoomMemberships) Joined(roomID, userID string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.rooms[roomID][userID]
+}
+
+// UserRooms returns the IDs of the rooms that the user is joined to.
+func (m *RoomMemberships) UserRooms(userID string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var roomIDs []string
+	for roomID, users := range m.rooms {
+		if users[userID] {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	return roomIDs
+}
+
+// RoomUsers returns the IDs of the users joined to the room.
+func (m *RoomMemberships) RoomUsers(roomID string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	userIDs := make([]string, 0, len(m.rooms[roomID]))
+	for userID := range m.rooms[roomID] {
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs
+}
+
+// SharedUsers returns the IDs of the users that share at least one room with
+// the user, including the user.
+func (m *RoomMemberships) SharedUsers(userID string) map[string]bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	users := map[string]bool{userID: true}
+	for _, members := range m.rooms {
+		if members[userID] {
+			for member := range members {
+				users[member] = true
+			}
+		}
+	}
+	return users
+}
+
+// RoomServers returns every server that has users joined to the room.
+func (m *RoomMemberships) RoomServers(roomID string) []gomatrixserverlib.ServerName {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	seen := make(map[gomatrixserverlib.ServerName]bool)
+	var servers []gomatrixserverlib.ServerName
+	for userID := range m.rooms[roomID] {
+		if _, domain, err := gomatrixserverlib.SplitID('@', userID); err == nil && !seen[domain] {
+			seen[domain] = true
+			servers = append(servers, domain)
+		}
+	}
+	return servers
+}
+
+// ServerInRoom returns whether the server has users joined to the room.
+func (m *RoomMemberships) ServerInRoom(roomID string, server gomatrixserverlib.ServerName) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.serverInRoomLocked(roomID, server)
+}
+
+// Servers returns every server that we share at least one room with, along
+// with the number of rooms shared.
+func (m *RoomMemberships) Servers() map[gomatrixserverlib.ServerName]int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	servers := make(map[gomatrixserverlib.ServerName]int, len(m.servers))
+	for server, rooms := range m.servers {
+		servers[server] = rooms
+	}
+	return servers
+}
+
+// Peers returns the peer IDs of every server that we share at least one room
+// with. Servers that aren't named after a peer ID are ignored.
+func (m *RoomMemberships) Peers() []peer.ID {
+	var peers []peer.ID
+	for server := range m.Servers() {
+		if id, err := serverNamePeer(server); err == nil {
+			peers = append(peers, id)
+		}
+	}
+	return peers
+}
+
+// update records the membership of a user in a room.
+func (m *RoomMemberships) update(roomID, userID string, joined bool) {
+	_, server, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	before := m.serverInRoomLocked(roomID, server)
+	users := m.rooms[roomID]
+	if users == nil {
+		users = make(map[string]bool)
+		m.rooms[roomID] = users
+	}
+	if joined {
+		users[userID] = true
+	} else {
+		delete(users, userID)
+	}
+	after := m.serverInRoomLocked(roomID, server)
+	if before == after {
+		m.mu.Unlock()
+		return
+	}
+	if after {
+		m.servers[server]++
+	} else if m.servers[server]--; m.servers[server] <= 0 {
+		delete(m.servers, server)
+	}
+	rooms := m.servers[server]
+	listeners := m.listeners
+	m.mu.Unlock()
+
+	for _, f := range listeners {
+		f(server, rooms)
+	}
+}
+
+func (m *RoomMemberships) serverInRoomLocked(roomID string, server gomatrixserverlib.ServerName) bool {
+	for userID := range m.rooms[roomID] {
+		if _, domain, err := gomatrixserverlib.SplitID('@', userID); err == nil && domain == server {
+			return true
+		}
+	}
+	return false
+}
+
+// start consumes the room server output log from the beginning.
+func (m *RoomMemberships) start(consumer sarama.Consumer, topic string) error {
+	c := common.ContinualConsumer{
+		Topic:          topic,
+		Consumer:       consumer,
+		PartitionStore: &memoryPartitionStore{},
+		ProcessMessage: m.onMessage,
+	}
+	return c.Start()
+}
+
+func (m *RoomMemberships) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		logrus.WithError(err).Error("Room memberships: message parse failure")
+		return nil
+	}
+	if output.Type != api.OutputTypeNewRoomEvent {
+		return nil
+	}
+	ev := output.NewRoomEvent.Event
+	if ev.Type() != gomatrixserverlib.MRoomMember || ev.StateKey() == nil {
+		return nil
+	}
+	membership, err := ev.Membership()
+	if err != nil {
+		return nil
+	}
+	m.update(ev.RoomID(), *ev.StateKey(), membership == gomatrixserverlib.Join)
+	return nil
+}
+
+// memoryPartitionStore implements common.PartitionStorer without storing
+// anything, so that a consumer always starts from the beginning of the log.
+type memoryPartitionStore struct{}
+
+// PartitionOffsets implements common.PartitionStorer
+func (s *memoryPartitionStore) PartitionOffsets(ctx context.Context, topic string) ([]common.PartitionOffset, error) {
+	return nil, nil
+}
+
+// SetPartitionOffset implements common.PartitionStorer
+func (s *memoryPartitionStore) SetPartitionOffset(ctx context.Context, topic string, partition int32, offset int64) error {
+	return nil
+}
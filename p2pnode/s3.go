@@ -0,0 +1,217 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Timeout is how long a request to the object store may take, including
+// sending or receiving the object.
+const S3Timeout = time.Minute * 2
+
+// s3MaxErrorSize is the most of an error response from the object store
+// that is read to find out what went wrong.
+const s3MaxErrorSize = 4096
+
+// errS3NotFound is returned when there is no object with a key.
+var errS3NotFound = errors.New("s3: no such key")
+
+// s3Client is a small client for the part of the S3 API that is needed to
+// keep files in a bucket, which works with S3 itself as well as with
+// MinIO, Ceph and the other S3-compatible object stores. Buckets are
+// addressed by path rather than by host name, as not every store supports
+// the latter. Requests are signed with AWS Signature Version 4, without
+// signing the payload, so that files don't have to be read twice.
+type s3Client struct {
+	endpoint        *url.URL
+	bucket          string
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	client          *http.Client
+}
+
+func newS3Client(
+	endpoint, bucket, region, accessKeyID, secretAccessKey string, transport http.RoundTripper,
+) (*s3Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid object store endpoint %q: must be an http or https URL", endpoint)
+	}
+	if bucket == "" {
+		return nil, errors.New("no object store bucket given")
+	}
+	return &s3Client{
+		endpoint:        u,
+		bucket:          bucket,
+		region:          region,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		client:          &http.Client{Transport: transport, Timeout: S3Timeout},
+	}, nil
+}
+
+// put stores an object, replacing any with the same key.
+func (c *s3Client) put(ctx context.Context, key string, body io.Reader, size int64) error {
+	req, err := c.request(ctx, http.MethodPut, key, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// get returns the contents of an object, or errS3NotFound if there isn't
+// one with the key. The caller must close it.
+func (c *s3Client) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := c.request(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// delete deletes an object. Deleting one that doesn't exist isn't an error.
+func (c *s3Client) delete(ctx context.Context, key string) error {
+	req, err := c.request(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err == errS3NotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *s3Client) request(ctx context.Context, method, key string, body io.Reader) (*http.Request, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket + "/" + key
+	u.RawPath = s3EscapePath(u.Path)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(ctx), nil
+}
+
+// do signs and sends a request, returning an error for anything but a 2xx
+// response.
+func (c *s3Client) do(req *http.Request) (*http.Response, error) {
+	c.sign(req, time.Now().UTC())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errS3NotFound
+	}
+	var res struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.NewDecoder(io.LimitReader(resp.Body, s3MaxErrorSize)).Decode(&res) != nil || res.Code == "" {
+		return nil, fmt.Errorf("s3: %s %s returned %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return nil, fmt.Errorf("s3: %s %s returned %s: %s: %s", req.Method, req.URL.Path, resp.Status, res.Code, res.Message)
+}
+
+// sign adds the headers that sign a request with AWS Signature Version 4.
+// There is never a query string, as only objects are ever requested.
+func (c *s3Client) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + c.region + "/s3/aws4_request"
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), "", canonicalHeaders.String(), signedHeaders, "UNSIGNED-PAYLOAD",
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + c.secretAccessKey)
+	for _, part := range []string{now.Format("20060102"), c.region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part)) // nolint: errcheck
+		key = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKeyID, scope, signedHeaders, hex.EncodeToString(key),
+	))
+}
+
+// s3EscapePath escapes every byte of a path except for the unreserved
+// characters and slashes, which is how the signature expects it, and is a
+// valid escaping of the path for net/url to send as it is.
+func s3EscapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
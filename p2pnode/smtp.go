@@ -0,0 +1,177 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"time"
+
+	"github.com/matrix-org/util"
+	"golang.org/x/net/proxy"
+)
+
+// SMTPTimeout is how long sending an email may take.
+const SMTPTimeout = time.Second * 30
+
+// smtpMailer sends emails through an SMTP server. The server is spoken to
+// over TLS if it is on port 465, and otherwise with STARTTLS if it offers
+// it, which is needed to log in to it with a password unless it is on the
+// same host.
+type smtpMailer struct {
+	addr     string
+	host     string
+	from     *mail.Address
+	username string
+	password string
+	dialer   proxy.Dialer
+}
+
+func newSMTPMailer(cfg *Config) (*smtpMailer, error) {
+	host, port, err := net.SplitHostPort(cfg.SMTPAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP server %q: must be <host>:<port>", cfg.SMTPAddr)
+	}
+	if cfg.SMTPFrom == "" {
+		return nil, errors.New("no address given to send email from")
+	}
+	from, err := mail.ParseAddress(cfg.SMTPFrom)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address to send email from %q: %s", cfg.SMTPFrom, err)
+	}
+	var dialer proxy.Dialer = &net.Dialer{Timeout: SMTPTimeout}
+	if cfg.TorSOCKSAddr != "" {
+		if dialer, err = proxy.SOCKS5("tcp", cfg.TorSOCKSAddr, nil, proxy.Direct); err != nil {
+			return nil, err
+		}
+	}
+	if port == "465" {
+		dialer = &tlsDialer{next: dialer, config: &tls.Config{ServerName: host}}
+	}
+	return &smtpMailer{
+		addr:     cfg.SMTPAddr,
+		host:     host,
+		from:     from,
+		username: cfg.SMTPUsername,
+		password: cfg.SMTPPassword,
+		dialer:   dialer,
+	}, nil
+}
+
+// send sends a plain text email.
+func (m *smtpMailer) send(to, subject, body string) error {
+	rcpt, err := mail.ParseAddress(to)
+	if err != nil {
+		return err
+	}
+	msg, err := m.message(rcpt, subject, body)
+	if err != nil {
+		return err
+	}
+	conn, err := m.dialer.Dial("tcp", m.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() // nolint: errcheck
+	if err = conn.SetDeadline(time.Now().Add(SMTPTimeout)); err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		return err
+	}
+	defer c.Close() // nolint: errcheck
+	if _, isTLS := conn.(*tls.Conn); !isTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err = c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+				return err
+			}
+		}
+	}
+	if m.username != "" {
+		if err = c.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(m.from.Address); err != nil {
+		return err
+	}
+	if err = c.Rcpt(rcpt.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// message makes the headers and body of an email. The body is quoted
+// printable, so that lines can be of any length and in any language.
+func (m *smtpMailer) message(to *mail.Address, subject, body string) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", m.from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", util.RandomString(24), m.host)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	w := quotedprintable.NewWriter(&b)
+	if _, err := w.Write([]byte(body)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// tlsDialer dials TLS connections over another dialer.
+type tlsDialer struct {
+	next   proxy.Dialer
+	config *tls.Config
+}
+
+func (d *tlsDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.next.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, d.config)
+	// The deadline is set again once the connection is returned.
+	if err = conn.SetDeadline(time.Now().Add(SMTPTimeout)); err == nil {
+		err = tlsConn.Handshake()
+	}
+	if err != nil {
+		conn.Close() // nolint: errcheck
+		return nil, err
+	}
+	return tlsConn, nil
+}
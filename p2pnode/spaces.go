@@ -0,0 +1,656 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SpaceRoomType is the room type, in the content of the m.room.create
+	// event, of spaces.
+	SpaceRoomType = "m.space"
+	// SpaceChildEventType is the type of the state events that list the
+	// rooms in a space, with the room ID as the state key.
+	SpaceChildEventType = "m.space.child"
+)
+
+// SpaceHierarchyFederationPathPrefix is where other servers walk the spaces
+// that we are in.
+const SpaceHierarchyFederationPathPrefix = "/_matrix/federation/v1/hierarchy/"
+
+// SpaceHierarchyClientPathPrefixes start /rooms/{roomID}/hierarchy, which
+// Dendrite doesn't serve, so nothing else under them is passed on.
+var SpaceHierarchyClientPathPrefixes = []string{
+	"/_matrix/client/v1/rooms/",
+	"/_matrix/client/unstable/org.matrix.msc2946/rooms/",
+}
+
+const (
+	// SpaceHierarchyMaxRooms is the most rooms that a walk of a space goes
+	// through. Pages of the hierarchy are taken from the walk, which is done
+	// again for each page.
+	SpaceHierarchyMaxRooms = 500
+	// SpaceHierarchyDefaultLimit is how many rooms a page of the hierarchy
+	// has unless the client asks for fewer.
+	SpaceHierarchyDefaultLimit = 50
+	// SpaceHierarchyTimeout is how long to wait for another server to
+	// describe a room that we aren't in.
+	SpaceHierarchyTimeout = time.Second * 10
+	// SpaceHierarchyVias is the most servers asked about each room that we
+	// aren't in.
+	SpaceHierarchyVias = 3
+)
+
+// summaryStateTypes are the state events, with an empty state key, that a
+// room is described by.
+var summaryStateTypes = []string{
+	gomatrixserverlib.MRoomCreate,
+	gomatrixserverlib.MRoomJoinRules,
+	"m.room.name",
+	"m.room.topic",
+	"m.room.avatar",
+	"m.room.canonical_alias",
+	"m.room.history_visibility",
+	"m.room.guest_access",
+}
+
+// inviteStateTypes are the state events that clients are sent along with
+// an invite, so that they can show what the room is. Which are sent is up
+// to the server, and these are the ones that Synapse sends.
+var inviteStateTypes = []string{
+	gomatrixserverlib.MRoomCreate,
+	gomatrixserverlib.MRoomJoinRules,
+	"m.room.name",
+	"m.room.avatar",
+	"m.room.canonical_alias",
+	"m.room.encryption",
+}
+
+const selectRoomStateSQL = "" +
+	"SELECT event_json FROM syncapi_current_room_state WHERE room_id = $1" +
+	" AND ((state_key = '' AND type = ANY($2)) OR type = $3)"
+
+const countJoinedMembersSQL = "" +
+	"SELECT COUNT(*) FROM syncapi_current_room_state WHERE room_id = $1 AND type = 'm.room.member' AND membership = 'join'"
+
+const selectRoomTypesSQL = "" +
+	"SELECT room_id, (event_json::json)->'content'->>'type' FROM syncapi_current_room_state" +
+	" WHERE type = 'm.room.create' AND state_key = '' AND room_id = ANY($1)"
+
+// spaceChild is an m.space.child event, stripped down to what the hierarchy
+// API sends.
+type spaceChild struct {
+	Type           string                      `json:"type"`
+	StateKey       string                      `json:"state_key"`
+	Content        spaceChildContent           `json:"content"`
+	Sender         string                      `json:"sender"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
+}
+
+// spaceChildContent is the content of an m.space.child event. A child with
+// no via has been removed from the space.
+type spaceChildContent struct {
+	Via       []string `json:"via,omitempty"`
+	Order     string   `json:"order,omitempty"`
+	Suggested bool     `json:"suggested,omitempty"`
+}
+
+// spaceRoom describes a room in the hierarchy of a space.
+type spaceRoom struct {
+	RoomID             string       `json:"room_id"`
+	Name               string       `json:"name,omitempty"`
+	Topic              string       `json:"topic,omitempty"`
+	CanonicalAlias     string       `json:"canonical_alias,omitempty"`
+	AvatarURL          string       `json:"avatar_url,omitempty"`
+	JoinedMembersCount int          `json:"num_joined_members"`
+	WorldReadable      bool         `json:"world_readable"`
+	GuestCanJoin       bool         `json:"guest_can_join"`
+	JoinRule           string       `json:"join_rule,omitempty"`
+	RoomType           string       `json:"room_type,omitempty"`
+	ChildrenState      []spaceChild `json:"children_state"`
+}
+
+// public returns whether anyone may see the room without being in it.
+func (r *spaceRoom) public() bool {
+	return r.JoinRule == gomatrixserverlib.Public || r.WorldReadable
+}
+
+// federationHierarchy is the response to a federation hierarchy request.
+type federationHierarchy struct {
+	Room                 *spaceRoom  `json:"room"`
+	Children             []spaceRoom `json:"children"`
+	InaccessibleChildren []string    `json:"inaccessible_children"`
+}
+
+// spaces serves the hierarchy of spaces, walking through the rooms that we
+// are in using their state, and asking the servers that the space lists for
+// each room about the rooms that we aren't in. It also gives clients the
+// room type of the rooms that they are invited to, so that invites to
+// spaces can be shown as such.
+type spaces struct {
+	db          *sql.DB
+	cfg         *config.Dendrite
+	federation  *gomatrixserverlib.FederationClient
+	memberships *RoomMemberships
+	authData    auth.Data
+}
+
+func newSpaces(cfg *config.Dendrite, federation *gomatrixserverlib.FederationClient, memberships *RoomMemberships, authData auth.Data) (*spaces, error) {
+	db, err := sql.Open("postgres", string(cfg.Database.SyncAPI))
+	if err != nil {
+		return nil, err
+	}
+	return &spaces{
+		db:          db,
+		cfg:         cfg,
+		federation:  federation,
+		memberships: memberships,
+		authData:    authData,
+	}, nil
+}
+
+// setup registers the client and federation APIs. The federation API is
+// subject to the ACLs of the rooms.
+func (s *spaces) setup(mux *http.ServeMux, keyRing gomatrixserverlib.KeyRing, acls *serverACLs) {
+	hierarchyAPI := common.WrapHandlerInCORS(common.MakeAuthAPI("rooms_hierarchy", s.authData, s.serveHierarchy))
+	for _, prefix := range SpaceHierarchyClientPathPrefixes {
+		mux.Handle(prefix, hierarchyAPI)
+	}
+	mux.Handle(SpaceHierarchyFederationPathPrefix, acls.wrap(common.MakeFedAPI(
+		"federation_hierarchy", s.cfg.Matrix.ServerName, keyRing,
+		func(req *http.Request, fedReq *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			return s.serveFederation(req, fedReq.Origin())
+		},
+	)))
+}
+
+// serveHierarchy serves a page of the rooms in a space that the user can
+// see, in the order that they are walked through, breadth first.
+func (s *spaces) serveHierarchy(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	if req.Method != http.MethodGet {
+		return util.JSONResponse{
+			Code: http.StatusMethodNotAllowed,
+			JSON: jsonerror.NotFound("Bad method"),
+		}
+	}
+	roomID, ok := hierarchyRoomID(req)
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown API"),
+		}
+	}
+	query := req.URL.Query()
+	limit := SpaceHierarchyDefaultLimit
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l < limit {
+		limit = l
+	}
+	maxDepth := -1
+	if d, err := strconv.Atoi(query.Get("max_depth")); err == nil && d >= 0 {
+		maxDepth = d
+	}
+	from := 0
+	if f := query.Get("from"); f != "" {
+		var err error
+		if from, err = strconv.Atoi(f); err != nil || from < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid from token"),
+			}
+		}
+	}
+	suggestedOnly := query.Get("suggested_only") == "true"
+
+	rooms, err := s.walk(req.Context(), device.UserID, roomID, maxDepth, suggestedOnly)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if len(rooms) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You can't see the space"),
+		}
+	}
+	if from > len(rooms) {
+		from = len(rooms)
+	}
+	res := struct {
+		Rooms     []spaceRoom `json:"rooms"`
+		NextBatch string      `json:"next_batch,omitempty"`
+	}{Rooms: rooms[from:]}
+	if len(res.Rooms) > limit {
+		res.Rooms = res.Rooms[:limit]
+		res.NextBatch = strconv.Itoa(from + limit)
+	}
+	return util.JSONResponse{Code: http.StatusOK, JSON: res}
+}
+
+// hierarchyRoomID returns the room ID from a /rooms/{roomID}/hierarchy
+// path.
+func hierarchyRoomID(req *http.Request) (string, bool) {
+	for _, prefix := range SpaceHierarchyClientPathPrefixes {
+		if !strings.HasPrefix(req.URL.EscapedPath(), prefix) {
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(req.URL.EscapedPath(), prefix), "/")
+		if len(parts) != 2 || parts[1] != "hierarchy" {
+			return "", false
+		}
+		roomID, err := url.PathUnescape(parts[0])
+		return roomID, err == nil
+	}
+	return "", false
+}
+
+// walk returns the rooms in a space that a user can see, starting with the
+// space. The rooms in subspaces are included down to maxDepth, if it isn't
+// negative.
+func (s *spaces) walk(ctx context.Context, userID, roomID string, maxDepth int, suggestedOnly bool) ([]spaceRoom, error) {
+	type queued struct {
+		roomID string
+		depth  int
+		via    []string
+	}
+	queue := []queued{{roomID: roomID}}
+	seen := map[string]bool{roomID: true}
+	// The rooms that other servers have told us about as the children of
+	// the rooms that we asked them about.
+	known := make(map[string]*spaceRoom)
+	var rooms []spaceRoom
+	for len(queue) > 0 && len(rooms) < SpaceHierarchyMaxRooms {
+		q := queue[0]
+		queue = queue[1:]
+		room, err := s.room(ctx, userID, q.roomID, q.via, known)
+		if err != nil {
+			return nil, err
+		}
+		if room == nil {
+			continue
+		}
+		children := room.ChildrenState
+		if suggestedOnly {
+			children = children[:0:0]
+			for _, child := range room.ChildrenState {
+				if child.Content.Suggested {
+					children = append(children, child)
+				}
+			}
+		}
+		room.ChildrenState = children
+		rooms = append(rooms, *room)
+		if room.RoomType != SpaceRoomType || (maxDepth >= 0 && q.depth >= maxDepth) {
+			continue
+		}
+		for _, child := range children {
+			if !seen[child.StateKey] {
+				seen[child.StateKey] = true
+				queue = append(queue, queued{roomID: child.StateKey, depth: q.depth + 1, via: child.Content.Via})
+			}
+		}
+	}
+	return rooms, nil
+}
+
+// room describes a room in a space, or returns nil if the user can't see
+// it. Rooms that we aren't in are asked about over federation.
+func (s *spaces) room(ctx context.Context, userID, roomID string, via []string, known map[string]*spaceRoom) (*spaceRoom, error) {
+	if s.memberships.ServerInRoom(roomID, s.cfg.Matrix.ServerName) {
+		room, err := s.summary(ctx, roomID)
+		if err != nil || room == nil {
+			return nil, err
+		}
+		if !room.public() && !s.memberships.Joined(roomID, userID) {
+			return nil, nil
+		}
+		return room, nil
+	}
+	if room := known[roomID]; room != nil {
+		return room, nil
+	}
+	for i, server := range via {
+		if i == SpaceHierarchyVias {
+			break
+		}
+		res, err := s.requestHierarchy(ctx, gomatrixserverlib.ServerName(server), roomID)
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{"room_id": roomID, "server": server}).Debug(
+				"Failed to fetch space hierarchy",
+			)
+			continue
+		}
+		if res.Room == nil || res.Room.RoomID != roomID {
+			continue
+		}
+		for i := range res.Children {
+			known[res.Children[i].RoomID] = &res.Children[i]
+		}
+		return res.Room, nil
+	}
+	return nil, nil
+}
+
+func (s *spaces) requestHierarchy(ctx context.Context, server gomatrixserverlib.ServerName, roomID string) (*federationHierarchy, error) {
+	ctx, cancel := context.WithTimeout(ctx, SpaceHierarchyTimeout)
+	defer cancel()
+	fedReq := gomatrixserverlib.NewFederationRequest("GET", server, SpaceHierarchyFederationPathPrefix+url.PathEscape(roomID))
+	if err := fedReq.Sign(s.cfg.Matrix.ServerName, s.cfg.Matrix.KeyID, s.cfg.Matrix.PrivateKey); err != nil {
+		return nil, err
+	}
+	req, err := fedReq.HTTPRequest()
+	if err != nil {
+		return nil, err
+	}
+	var res federationHierarchy
+	if err = s.federation.DoRequestAndParseResponse(ctx, req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// serveFederation describes a room that we are in and its children to
+// another server, unless the room is private and the server isn't in it.
+func (s *spaces) serveFederation(req *http.Request, origin gomatrixserverlib.ServerName) util.JSONResponse {
+	roomID, err := url.PathUnescape(strings.TrimPrefix(req.URL.EscapedPath(), SpaceHierarchyFederationPathPrefix))
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Unknown room"),
+	}
+	if err != nil || !s.memberships.ServerInRoom(roomID, s.cfg.Matrix.ServerName) {
+		return notFound
+	}
+	room, err := s.summary(req.Context(), roomID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if room == nil || (!room.public() && !s.memberships.ServerInRoom(roomID, origin)) {
+		return notFound
+	}
+	res := federationHierarchy{Room: room, Children: []spaceRoom{}, InaccessibleChildren: []string{}}
+	for _, child := range room.ChildrenState {
+		if !s.memberships.ServerInRoom(child.StateKey, s.cfg.Matrix.ServerName) {
+			continue
+		}
+		childRoom, err := s.summary(req.Context(), child.StateKey)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		switch {
+		case childRoom == nil:
+		case childRoom.public() || s.memberships.ServerInRoom(child.StateKey, origin):
+			res.Children = append(res.Children, *childRoom)
+		default:
+			res.InaccessibleChildren = append(res.InaccessibleChildren, child.StateKey)
+		}
+	}
+	return util.JSONResponse{Code: http.StatusOK, JSON: res}
+}
+
+// summary describes a room from its current state, or returns nil if we
+// don't have it. The children of a space are in the order that the space
+// gives them.
+func (s *spaces) summary(ctx context.Context, roomID string) (*spaceRoom, error) {
+	state, err := s.state(ctx, roomID, summaryStateTypes, SpaceChildEventType)
+	if err != nil || len(state) == 0 {
+		return nil, err
+	}
+	room := spaceRoom{RoomID: roomID, ChildrenState: []spaceChild{}}
+	for _, ev := range state {
+		var content struct {
+			Type              string   `json:"type"`
+			Name              string   `json:"name"`
+			Topic             string   `json:"topic"`
+			Alias             string   `json:"alias"`
+			URL               string   `json:"url"`
+			JoinRule          string   `json:"join_rule"`
+			HistoryVisibility string   `json:"history_visibility"`
+			GuestAccess       string   `json:"guest_access"`
+			Via               []string `json:"via"`
+		}
+		if json.Unmarshal(ev.Content(), &content) != nil {
+			continue
+		}
+		switch ev.Type() {
+		case gomatrixserverlib.MRoomCreate:
+			room.RoomType = content.Type
+		case gomatrixserverlib.MRoomJoinRules:
+			room.JoinRule = content.JoinRule
+		case "m.room.name":
+			room.Name = content.Name
+		case "m.room.topic":
+			room.Topic = content.Topic
+		case "m.room.avatar":
+			room.AvatarURL = content.URL
+		case "m.room.canonical_alias":
+			room.CanonicalAlias = content.Alias
+		case "m.room.history_visibility":
+			room.WorldReadable = content.HistoryVisibility == "world_readable"
+		case "m.room.guest_access":
+			room.GuestCanJoin = content.GuestAccess == "can_join"
+		case SpaceChildEventType:
+			var child spaceChildContent
+			if json.Unmarshal(ev.Content(), &child) != nil || len(child.Via) == 0 {
+				continue
+			}
+			room.ChildrenState = append(room.ChildrenState, spaceChild{
+				Type:           SpaceChildEventType,
+				StateKey:       *ev.StateKey(),
+				Content:        child,
+				Sender:         ev.Sender(),
+				OriginServerTS: ev.OriginServerTS(),
+			})
+		}
+	}
+	if room.RoomType != SpaceRoomType {
+		room.ChildrenState = []spaceChild{}
+	}
+	sortSpaceChildren(room.ChildrenState)
+	if err = s.db.QueryRowContext(ctx, countJoinedMembersSQL, roomID).Scan(&room.JoinedMembersCount); err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+// sortSpaceChildren puts the children of a space in order: those with an
+// order first, by it, then by when they were added.
+func sortSpaceChildren(children []spaceChild) {
+	validOrder := func(order string) bool {
+		if len(order) == 0 || len(order) > 50 {
+			return false
+		}
+		for _, c := range order {
+			if c < 0x20 || c > 0x7e {
+				return false
+			}
+		}
+		return true
+	}
+	sort.SliceStable(children, func(i, j int) bool {
+		a, b := &children[i], &children[j]
+		aOrdered, bOrdered := validOrder(a.Content.Order), validOrder(b.Content.Order)
+		switch {
+		case aOrdered != bOrdered:
+			return aOrdered
+		case aOrdered && a.Content.Order != b.Content.Order:
+			return a.Content.Order < b.Content.Order
+		case a.OriginServerTS != b.OriginServerTS:
+			return a.OriginServerTS < b.OriginServerTS
+		default:
+			return a.StateKey < b.StateKey
+		}
+	})
+}
+
+// state returns the current state events of a room with the given types and
+// an empty state key, along with those of another type with any state key.
+func (s *spaces) state(ctx context.Context, roomID string, types []string, anyStateKey string) ([]gomatrixserverlib.Event, error) {
+	rows, err := s.db.QueryContext(ctx, selectRoomStateSQL, roomID, pq.StringArray(types), anyStateKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	var events []gomatrixserverlib.Event
+	for rows.Next() {
+		var eventJSON []byte
+		if err = rows.Scan(&eventJSON); err != nil {
+			return nil, err
+		}
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+// roomTypes returns the types of the rooms that have one, for the rooms that
+// we have the state of.
+func (s *spaces) roomTypes(ctx context.Context, roomIDs []string) map[string]string {
+	types := make(map[string]string)
+	if s == nil || len(roomIDs) == 0 {
+		return types
+	}
+	rows, err := s.db.QueryContext(ctx, selectRoomTypesSQL, pq.StringArray(roomIDs))
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to look up room types")
+		return types
+	}
+	defer rows.Close() // nolint: errcheck
+	for rows.Next() {
+		var roomID string
+		var roomType sql.NullString
+		if err = rows.Scan(&roomID, &roomType); err != nil {
+			logrus.WithError(err).Warn("Failed to look up room types")
+			return types
+		}
+		if roomType.Valid {
+			types[roomID] = roomType.String
+		}
+	}
+	return types
+}
+
+// wrapSync adds the state of the rooms that the user is invited to to the
+// invites in /sync, which Dendrite gives only the invite event. The state
+// comes from the invite, where the inviting server put it, or from our own
+// copy if we are in the room.
+func (s *spaces) wrapSync(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		device, req := syncDevice(req, s.authData)
+		if device == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		rec := &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+		next.ServeHTTP(rec, req)
+		var res map[string]json.RawMessage
+		if rec.code != http.StatusOK || json.Unmarshal(rec.body.Bytes(), &res) != nil {
+			rec.writeTo(w)
+			return
+		}
+		if changed, err := s.addInviteState(req.Context(), res); err != nil || !changed {
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("Failed to add invite state to /sync")
+			}
+			rec.writeTo(w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	})
+}
+
+// strippedEvent is a state event as it is sent along with an invite.
+type strippedEvent struct {
+	Type     string          `json:"type"`
+	StateKey string          `json:"state_key"`
+	Content  json.RawMessage `json:"content"`
+	Sender   string          `json:"sender"`
+}
+
+func (s *spaces) addInviteState(ctx context.Context, res map[string]json.RawMessage) (bool, error) {
+	var rooms map[string]json.RawMessage
+	var invites map[string]struct {
+		InviteState struct {
+			Events []json.RawMessage `json:"events"`
+		} `json:"invite_state"`
+	}
+	if json.Unmarshal(res["rooms"], &rooms) != nil || json.Unmarshal(rooms["invite"], &invites) != nil || len(invites) == 0 {
+		return false, nil
+	}
+	for roomID, invite := range invites {
+		if len(invite.InviteState.Events) != 1 {
+			// Either there is no invite event, or the state is there already.
+			continue
+		}
+		var inviteEvent struct {
+			Unsigned struct {
+				InviteRoomState []json.RawMessage `json:"invite_room_state"`
+			} `json:"unsigned"`
+		}
+		if err := json.Unmarshal(invite.InviteState.Events[0], &inviteEvent); err != nil {
+			return false, err
+		}
+		stripped := inviteEvent.Unsigned.InviteRoomState
+		if len(stripped) == 0 && s.memberships.ServerInRoom(roomID, s.cfg.Matrix.ServerName) {
+			state, err := s.state(ctx, roomID, inviteStateTypes, "")
+			if err != nil {
+				return false, err
+			}
+			for _, ev := range state {
+				b, err := json.Marshal(strippedEvent{
+					Type:     ev.Type(),
+					StateKey: *ev.StateKey(),
+					Content:  ev.Content(),
+					Sender:   ev.Sender(),
+				})
+				if err != nil {
+					return false, err
+				}
+				stripped = append(stripped, b)
+			}
+		}
+		invite.InviteState.Events = append(stripped, invite.InviteState.Events...)
+		invites[roomID] = invite
+	}
+	var err error
+	if rooms["invite"], err = json.Marshal(invites); err != nil {
+		return false, err
+	}
+	if res["rooms"], err = json.Marshal(rooms); err != nil {
+		return false, err
+	}
+	return true, nil
+}
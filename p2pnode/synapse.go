@@ -0,0 +1,396 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/routing"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// SynapseJoinInterval is how often the rooms that imported users were in on
+// Synapse are tried to be joined again, e.g. for when the servers in them
+// couldn't be reached.
+const SynapseJoinInterval = time.Minute * 10
+
+const synapseJoinsSchema = `
+-- The rooms that users imported from Synapse were joined to there, which
+-- they are joined to here once they can be.
+CREATE TABLE IF NOT EXISTS p2p_synapse_joins (
+    localpart TEXT NOT NULL,
+    room_id TEXT NOT NULL,
+    PRIMARY KEY (localpart, room_id)
+);
+`
+
+// Guests have no password to log in with again, and the users of
+// application services are the application service's to make.
+const selectSynapseUsersSQL = "" +
+	"SELECT name, password_hash, creation_ts FROM users" +
+	" WHERE COALESCE(is_guest, 0) = 0 AND COALESCE(deactivated, 0) = 0 AND appservice_id IS NULL"
+
+const selectSynapseProfileSQL = "" +
+	"SELECT displayname, avatar_url FROM profiles WHERE user_id = $1"
+
+const selectSynapseThreePIDsSQL = "" +
+	"SELECT medium, address FROM user_threepids WHERE user_id = $1"
+
+const selectSynapseAccountDataSQL = "" +
+	"SELECT '', account_data_type, content FROM account_data WHERE user_id = $1" +
+	" UNION ALL SELECT room_id, account_data_type, content FROM room_account_data WHERE user_id = $1"
+
+const selectSynapseJoinedRoomsSQL = "" +
+	"SELECT m.room_id FROM room_memberships m JOIN current_state_events c ON c.event_id = m.event_id" +
+	" WHERE m.user_id = $1 AND m.membership = 'join'"
+
+const insertImportedAccountSQL = "" +
+	"INSERT INTO account_accounts (localpart, created_ts, password_hash, appservice_id)" +
+	" VALUES ($1, $2, $3, NULL) ON CONFLICT DO NOTHING"
+
+const insertImportedProfileSQL = "" +
+	"INSERT INTO account_profiles (localpart, display_name, avatar_url) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (localpart) DO UPDATE SET display_name = $2, avatar_url = $3"
+
+const insertImportedThreePIDSQL = "" +
+	"INSERT INTO account_threepid (threepid, medium, localpart) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING"
+
+const insertImportedAccountDataSQL = "" +
+	"INSERT INTO account_data (localpart, room_id, type, content) VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (localpart, room_id, type) DO UPDATE SET content = $4"
+
+const insertSynapseJoinSQL = "" +
+	"INSERT INTO p2p_synapse_joins (localpart, room_id) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+
+const selectSynapseJoinsSQL = "" +
+	"SELECT localpart, room_id FROM p2p_synapse_joins"
+
+const deleteSynapseJoinSQL = "" +
+	"DELETE FROM p2p_synapse_joins WHERE localpart = $1 AND room_id = $2"
+
+// SynapseImport counts what ImportSynapse imported.
+type SynapseImport struct {
+	Users int
+	// Users who weren't imported, as we already have a user by their name.
+	Skipped int
+	// Rooms to join the users to once the node is running.
+	Rooms int
+}
+
+// ImportSynapse imports the accounts from a Synapse database: their names,
+// password hashes, profiles, third party IDs and account data. Their user
+// IDs are under our server name rather than Synapse's, which events signed
+// by Synapse can't be moved to, so the rooms that they were joined to are
+// joined again over federation once the node is running, which works for
+// those that anyone can join. Their devices aren't imported, as their
+// access tokens are Synapse's. Passwords carry over unless Synapse was set
+// up with a pepper, as both hash them with bcrypt.
+func ImportSynapse(ctx context.Context, cfg *Config, synapseDSN string) (*SynapseImport, error) {
+	serverName, err := ServerName(cfg.IdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	synapseDB, err := sql.Open("postgres", synapseDSN)
+	if err != nil {
+		return nil, err
+	}
+	defer synapseDB.Close() // nolint: errcheck
+	// Opening the database through Dendrite creates its tables, in case the
+	// node hasn't been run yet.
+	if _, err = accounts.NewDatabase(string(cfg.Dendrite.Database.Account), serverName); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", string(cfg.Dendrite.Database.Account))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close() // nolint: errcheck
+	if _, err = db.ExecContext(ctx, synapseJoinsSchema); err != nil {
+		return nil, err
+	}
+
+	rows, err := synapseDB.QueryContext(ctx, selectSynapseUsersSQL)
+	if err != nil {
+		return nil, err
+	}
+	type synapseUser struct {
+		userID       string
+		passwordHash sql.NullString
+		createdTS    int64
+	}
+	var users []synapseUser
+	for rows.Next() {
+		var u synapseUser
+		if err = rows.Scan(&u.userID, &u.passwordHash, &u.createdTS); err != nil {
+			rows.Close() // nolint: errcheck
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	rows.Close() // nolint: errcheck
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &SynapseImport{}
+	for _, u := range users {
+		localpart, _, err := gomatrixserverlib.SplitID('@', u.userID)
+		if err != nil {
+			logrus.WithError(err).Warnf("Not importing %s, which isn't a user ID", u.userID)
+			continue
+		}
+		rooms, err := importSynapseUser(ctx, synapseDB, db, u.userID, localpart, u.passwordHash, u.createdTS)
+		if err != nil {
+			return nil, fmt.Errorf("failed to import %s: %s", u.userID, err)
+		}
+		if rooms < 0 {
+			logrus.Warnf("Not importing %s, as there is already a user called %s", u.userID, localpart)
+			result.Skipped++
+			continue
+		}
+		result.Users++
+		result.Rooms += rooms
+	}
+	return result, nil
+}
+
+// importSynapseUser imports a user, returning how many rooms they are to be
+// joined to, or -1 if we already have a user by their name.
+func importSynapseUser(
+	ctx context.Context, synapseDB, db *sql.DB, userID, localpart string, passwordHash sql.NullString, createdTS int64,
+) (int, error) {
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer txn.Rollback() // nolint: errcheck
+	// Synapse's creation_ts is in seconds.
+	res, err := txn.ExecContext(ctx, insertImportedAccountSQL, localpart, createdTS*1000, passwordHash)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return -1, nil
+	}
+
+	var displayName, avatarURL sql.NullString
+	err = synapseDB.QueryRowContext(ctx, selectSynapseProfileSQL, localpart).Scan(&displayName, &avatarURL)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if _, err = txn.ExecContext(ctx, insertImportedProfileSQL, localpart, displayName.String, avatarURL.String); err != nil {
+		return 0, err
+	}
+
+	rows, err := synapseDB.QueryContext(ctx, selectSynapseThreePIDsSQL, userID)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var medium, address string
+		if err = rows.Scan(&medium, &address); err == nil {
+			_, err = txn.ExecContext(ctx, insertImportedThreePIDSQL, address, medium, localpart)
+		}
+		if err != nil {
+			rows.Close() // nolint: errcheck
+			return 0, err
+		}
+	}
+	rows.Close() // nolint: errcheck
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rows, err = synapseDB.QueryContext(ctx, selectSynapseAccountDataSQL, userID)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var roomID, dataType, content string
+		if err = rows.Scan(&roomID, &dataType, &content); err == nil {
+			_, err = txn.ExecContext(ctx, insertImportedAccountDataSQL, localpart, roomID, dataType, content)
+		}
+		if err != nil {
+			rows.Close() // nolint: errcheck
+			return 0, err
+		}
+	}
+	rows.Close() // nolint: errcheck
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rows, err = synapseDB.QueryContext(ctx, selectSynapseJoinedRoomsSQL, userID)
+	if err != nil {
+		return 0, err
+	}
+	rooms := 0
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err == nil {
+			_, err = txn.ExecContext(ctx, insertSynapseJoinSQL, localpart, roomID)
+		}
+		if err != nil {
+			rows.Close() // nolint: errcheck
+			return 0, err
+		}
+		rooms++
+	}
+	rows.Close() // nolint: errcheck
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	return rooms, txn.Commit()
+}
+
+// synapseJoins joins the users imported from Synapse to the rooms that they
+// were in there, through the servers of the rooms.
+type synapseJoins struct {
+	db          *sql.DB
+	cfg         *config.Dendrite
+	federation  *gomatrixserverlib.FederationClient
+	keyRing     gomatrixserverlib.KeyRing
+	query       api.RoomserverQueryAPI
+	alias       api.RoomserverAliasAPI
+	producer    *producers.RoomserverProducer
+	accountDB   *accounts.Database
+	memberships *RoomMemberships
+}
+
+func newSynapseJoins(
+	cfg *config.Dendrite, federation *gomatrixserverlib.FederationClient, keyRing gomatrixserverlib.KeyRing,
+	query api.RoomserverQueryAPI, alias api.RoomserverAliasAPI, input api.RoomserverInputAPI,
+	accountDB *accounts.Database, memberships *RoomMemberships,
+) (*synapseJoins, error) {
+	db, err := sql.Open("postgres", string(cfg.Database.Account))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(synapseJoinsSchema); err != nil {
+		return nil, err
+	}
+	return &synapseJoins{
+		db:          db,
+		cfg:         cfg,
+		federation:  federation,
+		keyRing:     keyRing,
+		query:       query,
+		alias:       alias,
+		producer:    producers.NewRoomserverProducer(input),
+		accountDB:   accountDB,
+		memberships: memberships,
+	}, nil
+}
+
+// start tries to join the rooms every SynapseJoinInterval until they have
+// all been joined or given up on, or the context is done.
+func (s *synapseJoins) start(ctx context.Context) {
+	ticker := time.NewTicker(SynapseJoinInterval)
+	defer ticker.Stop()
+	for {
+		remaining, err := s.joinAll(ctx)
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to join the rooms of users imported from Synapse")
+		} else if remaining == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// joinAll tries to join each of the rooms, returning how many are left to
+// try again.
+func (s *synapseJoins) joinAll(ctx context.Context) (int, error) {
+	rows, err := s.db.QueryContext(ctx, selectSynapseJoinsSQL)
+	if err != nil {
+		return 0, err
+	}
+	type join struct{ localpart, roomID string }
+	var joins []join
+	for rows.Next() {
+		var j join
+		if err = rows.Scan(&j.localpart, &j.roomID); err != nil {
+			rows.Close() // nolint: errcheck
+			return 0, err
+		}
+		joins = append(joins, j)
+	}
+	rows.Close() // nolint: errcheck
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	remaining := 0
+	for _, j := range joins {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		done, err := s.join(ctx, j.localpart, j.roomID)
+		if err != nil {
+			return 0, err
+		}
+		if !done {
+			remaining++
+			continue
+		}
+		if _, err = s.db.ExecContext(ctx, deleteSynapseJoinSQL, j.localpart, j.roomID); err != nil {
+			return 0, err
+		}
+	}
+	return remaining, nil
+}
+
+// join joins a user to a room, returning whether there is no need to try
+// again, either because they are in the room now or because they can't be.
+func (s *synapseJoins) join(ctx context.Context, localpart, roomID string) (bool, error) {
+	userID := fmt.Sprintf("@%s:%s", localpart, s.cfg.Matrix.ServerName)
+	if s.memberships.Joined(roomID, userID) {
+		return true, nil
+	}
+	req, err := http.NewRequest(http.MethodPost, "/", strings.NewReader("{}"))
+	if err != nil {
+		return false, err
+	}
+	res := routing.JoinRoomByIDOrAlias(
+		req.WithContext(ctx), &authtypes.Device{UserID: userID}, roomID, *s.cfg,
+		s.federation, s.producer, s.query, s.alias, s.keyRing, s.accountDB,
+	)
+	logger := logrus.WithFields(logrus.Fields{"user_id": userID, "room_id": roomID})
+	switch {
+	case res.Code == http.StatusOK:
+		logger.Info("Joined a room of a user imported from Synapse")
+		return true, nil
+	case res.Code == http.StatusForbidden || res.Code == http.StatusNotFound:
+		logger.Warnf("Can't join a room of a user imported from Synapse, who will need to be invited: %v", res.JSON)
+		return true, nil
+	default:
+		logger.Debugf("Failed to join a room of a user imported from Synapse: %v", res.JSON)
+		return false, nil
+	}
+}
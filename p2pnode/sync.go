@@ -0,0 +1,44 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+)
+
+// SyncClientPath is the client API for /sync, which is wrapped to record the
+// activity of our users and to add what Dendrite leaves out of it.
+const SyncClientPath = "/_matrix/client/r0/sync"
+
+type syncDeviceKey struct{}
+
+// syncDevice returns the device calling /sync, and the request to pass on,
+// which remembers the device so that the next wrapper doesn't have to look
+// the access token up again. The device is nil if the request isn't from a
+// user, in which case the request should be passed on untouched.
+func syncDevice(req *http.Request, data auth.Data) (*authtypes.Device, *http.Request) {
+	if device, ok := req.Context().Value(syncDeviceKey{}).(*authtypes.Device); ok {
+		return device, req
+	}
+	device, resErr := auth.VerifyUserFromRequest(req, data)
+	if resErr != nil || device.UserID == "" {
+		return nil, req
+	}
+	return device, req.WithContext(context.WithValue(req.Context(), syncDeviceKey{}, device))
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Tenant is another node hosted in the same process as the node, with a
+// server name, keys, data directory and databases of its own.
+type Tenant struct {
+	// The name of the tenant's data directory, inside that of the node, and
+	// part of the names of its databases, so it may only have lower case
+	// letters, digits and underscores.
+	Name string `yaml:"name"`
+	// The host that the tenant's clients reach its HTTP APIs at, e.g.
+	// alice.home.example. Requests for any other host are for the node.
+	Host string `yaml:"host"`
+}
+
+// tenantNameRegexp matches the names that can be used for a directory and
+// in the names of Postgres databases without quoting.
+var tenantNameRegexp = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// ParseTenant parses a tenant given as <name>=<host>.
+func ParseTenant(value string) (Tenant, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return Tenant{}, fmt.Errorf("tenant %q isn't of the form <name>=<host>", value)
+	}
+	t := Tenant{Name: parts[0], Host: strings.ToLower(parts[1])}
+	return t, CheckTenants([]Tenant{t})
+}
+
+// CheckTenants checks that every tenant has a name that can be used for its
+// data directory and databases and a host, and that no two tenants share
+// either.
+func CheckTenants(tenants []Tenant) error {
+	names := make(map[string]struct{}, len(tenants))
+	hosts := make(map[string]struct{}, len(tenants))
+	for _, t := range tenants {
+		if !tenantNameRegexp.MatchString(t.Name) {
+			return fmt.Errorf("tenant name %q may only have lower case letters, digits and underscores", t.Name)
+		}
+		if t.Host == "" {
+			return fmt.Errorf("tenant %s has no host", t.Name)
+		}
+		host := strings.ToLower(t.Host)
+		if _, ok := names[t.Name]; ok {
+			return fmt.Errorf("there is more than one tenant called %s", t.Name)
+		}
+		if _, ok := hosts[host]; ok {
+			return fmt.Errorf("there is more than one tenant at %s", host)
+		}
+		names[t.Name], hosts[host] = struct{}{}, struct{}{}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import "testing"
+
+func TestParseTenant(t *testing.T) {
+	tests := []struct {
+		value  string
+		tenant Tenant
+		ok     bool
+	}{
+		{"alice=alice.home.example", Tenant{Name: "alice", Host: "alice.home.example"}, true},
+		{"bob_2=Bob.Home.Example", Tenant{Name: "bob_2", Host: "bob.home.example"}, true},
+		{"alice=host=with=equals", Tenant{Name: "alice", Host: "host=with=equals"}, true},
+		{"alice", Tenant{}, false},
+		{"alice=", Tenant{}, false},
+		{"=alice.home.example", Tenant{}, false},
+		{"Alice=alice.home.example", Tenant{}, false},
+		{"al-ice=alice.home.example", Tenant{}, false},
+		{"../alice=alice.home.example", Tenant{}, false},
+	}
+	for _, tt := range tests {
+		tenant, err := ParseTenant(tt.value)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%q: invalid tenant was accepted as %+v", tt.value, tenant)
+			}
+			continue
+		}
+		if err != nil || tenant != tt.tenant {
+			t.Errorf("%q: got %+v, %v, wanted %+v", tt.value, tenant, err, tt.tenant)
+		}
+	}
+}
+
+func TestCheckTenants(t *testing.T) {
+	tests := []struct {
+		name    string
+		tenants []Tenant
+		ok      bool
+	}{
+		{"none", nil, true},
+		{"distinct", []Tenant{{"alice", "alice.example"}, {"bob", "bob.example"}}, true},
+		{"same name", []Tenant{{"alice", "alice.example"}, {"alice", "bob.example"}}, false},
+		{"same host", []Tenant{{"alice", "home.example"}, {"bob", "home.example"}}, false},
+		{"same host in other case", []Tenant{{"alice", "home.example"}, {"bob", "HOME.example"}}, false},
+		{"no host", []Tenant{{"alice", ""}}, false},
+		{"invalid name", []Tenant{{"alice smith", "alice.example"}}, false},
+	}
+	for _, tt := range tests {
+		if err := CheckTenants(tt.tenants); tt.ok && err != nil {
+			t.Errorf("%s: valid tenants were rejected: %s", tt.name, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%s: invalid tenants were accepted", tt.name)
+		}
+	}
+}
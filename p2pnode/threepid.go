@@ -0,0 +1,650 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// ThreePIDClientPath is where users list and add their email addresses.
+	ThreePIDClientPath = "/_matrix/client/r0/account/3pid"
+	// ThreePIDAddClientPath is where users add an email address once they
+	// have confirmed it, with their password.
+	ThreePIDAddClientPath = "/_matrix/client/r0/account/3pid/add"
+	// ThreePIDDeleteClientPath is where users remove an email address.
+	ThreePIDDeleteClientPath = "/_matrix/client/r0/account/3pid/delete"
+	// UnstableThreePIDDeleteClientPath is the same, under the prefix that
+	// some clients still use.
+	UnstableThreePIDDeleteClientPath = "/_matrix/client/unstable/account/3pid/delete"
+	// ThreePIDEmailTokenClientPath is where users ask to be sent a token to
+	// confirm an email address with.
+	ThreePIDEmailTokenClientPath = "/_matrix/client/r0/account/3pid/email/requestToken"
+	// PasswordClientPath is where users change their password.
+	PasswordClientPath = "/_matrix/client/r0/account/password"
+	// PasswordEmailTokenClientPath is where users who have forgotten their
+	// password ask to be sent a token to reset it with.
+	PasswordEmailTokenClientPath = "/_matrix/client/r0/account/password/email/requestToken"
+	// EmailSubmitTokenPath is where the tokens that are sent in emails are
+	// submitted, by following the link in the email or by the client.
+	EmailSubmitTokenPath = "/_dendrite/email/submit_token"
+)
+
+// EmailSessionLifetime is how long the token sent to an email address can
+// be used for, and how long after it was sent the address can then be
+// added or used to reset a password.
+const EmailSessionLifetime = time.Hour * 24
+
+// loginTypeEmail is the stage of user-interactive auth that proves that
+// the user has an email address. Dendrite has no constant for it.
+const loginTypeEmail authtypes.LoginType = "m.login.email.identity"
+
+// The lengths of passwords that the client API allows on registration.
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 512
+)
+
+// validClientSecret matches the client secrets that the spec allows.
+var validClientSecret = regexp.MustCompile(`^[0-9a-zA-Z.=_\-]{1,255}$`)
+
+const threePIDSessionsSchema = `
+-- The email addresses that tokens have been sent to, for confirming them
+-- or resetting passwords. The session is validated once the token has been
+-- submitted, and is deleted once it has been used.
+CREATE TABLE IF NOT EXISTS p2p_threepid_sessions (
+    session_id TEXT PRIMARY KEY,
+    client_secret TEXT NOT NULL,
+    address TEXT NOT NULL,
+    token TEXT NOT NULL,
+    send_attempt BIGINT NOT NULL,
+    validated BOOLEAN NOT NULL DEFAULT FALSE,
+    created_ts BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS p2p_threepid_sessions_secret ON p2p_threepid_sessions (client_secret, address);
+`
+
+const selectThreePIDSessionBySecretSQL = "" +
+	"SELECT session_id, send_attempt FROM p2p_threepid_sessions WHERE client_secret = $1 AND address = $2"
+
+const insertThreePIDSessionSQL = "" +
+	"INSERT INTO p2p_threepid_sessions (session_id, client_secret, address, token, send_attempt, created_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)"
+
+// Sending a token again gives the session more time, but keeps the token,
+// so that the link in the first email still works.
+const updateThreePIDSessionSendAttemptSQL = "" +
+	"UPDATE p2p_threepid_sessions SET send_attempt = $2, created_ts = $3 WHERE session_id = $1 RETURNING token"
+
+const validateThreePIDSessionSQL = "" +
+	"UPDATE p2p_threepid_sessions SET validated = TRUE" +
+	" WHERE session_id = $1 AND client_secret = $2 AND token = $3 AND created_ts > $4"
+
+const selectValidatedThreePIDSessionSQL = "" +
+	"SELECT address FROM p2p_threepid_sessions" +
+	" WHERE session_id = $1 AND client_secret = $2 AND validated AND created_ts > $3"
+
+const deleteThreePIDSessionSQL = "" +
+	"DELETE FROM p2p_threepid_sessions WHERE session_id = $1"
+
+const deleteExpiredThreePIDSessionsSQL = "" +
+	"DELETE FROM p2p_threepid_sessions WHERE created_ts <= $1"
+
+// Dendrite's account database can't change passwords.
+const updatePasswordHashSQL = "" +
+	"UPDATE account_accounts SET password_hash = $1 WHERE localpart = $2"
+
+// threePIDCreds are the credentials of a session that has been validated.
+// The spec has had both the camel case and snake case names for them.
+type threePIDCreds struct {
+	SessionID    string `json:"sid"`
+	ClientSecret string `json:"client_secret"`
+}
+
+// threePIDs lets users add email addresses to their accounts, which are
+// confirmed by emailing them a token, and then reset their password if
+// they forget it. Dendrite can only have an identity server confirm
+// addresses, which is no use to a node that might not be able to reach
+// one, and can't change passwords at all: a personal node with a forgotten
+// password would otherwise be lost.
+type threePIDs struct {
+	db         *sql.DB
+	accountDB  *accounts.Database
+	deviceDB   *devices.Database
+	authData   auth.Data
+	serverName gomatrixserverlib.ServerName
+	baseURL    func(*http.Request) *url.URL
+	// mailer is nil if no SMTP server is configured, in which case tokens
+	// can't be sent, but passwords can still be changed.
+	mailer *smtpMailer
+}
+
+func newThreePIDs(
+	cfg *Config, accountDB *accounts.Database, deviceDB *devices.Database, authData auth.Data,
+	baseURL func(*http.Request) *url.URL,
+) (*threePIDs, error) {
+	var mailer *smtpMailer
+	if cfg.SMTPAddr != "" {
+		var err error
+		if mailer, err = newSMTPMailer(cfg); err != nil {
+			return nil, err
+		}
+	}
+	db, err := sql.Open("postgres", string(cfg.Dendrite.Database.Account))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(threePIDSessionsSchema); err != nil {
+		return nil, err
+	}
+	return &threePIDs{
+		db:         db,
+		accountDB:  accountDB,
+		deviceDB:   deviceDB,
+		authData:   authData,
+		serverName: cfg.Dendrite.Matrix.ServerName,
+		baseURL:    baseURL,
+		mailer:     mailer,
+	}, nil
+}
+
+// setup registers the client APIs, which replace those of the client API
+// for email addresses.
+func (t *threePIDs) setup(mux *http.ServeMux) {
+	mux.Handle(ThreePIDClientPath, common.WrapHandlerInCORS(common.MakeAuthAPI("account_3pid", t.authData,
+		func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			if req.Method == http.MethodGet {
+				return t.list(req, device)
+			}
+			return t.add(req, device, false)
+		},
+	)))
+	mux.Handle(ThreePIDAddClientPath, common.WrapHandlerInCORS(common.MakeAuthAPI("account_3pid_add", t.authData,
+		func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return t.add(req, device, true)
+		},
+	)))
+	remove := common.WrapHandlerInCORS(common.MakeAuthAPI("account_3pid_delete", t.authData, t.remove))
+	mux.Handle(ThreePIDDeleteClientPath, remove)
+	mux.Handle(UnstableThreePIDDeleteClientPath, remove)
+	mux.Handle(ThreePIDEmailTokenClientPath, common.WrapHandlerInCORS(common.MakeExternalAPI(
+		"account_3pid_request_token", func(req *http.Request) util.JSONResponse {
+			return t.requestToken(req, false)
+		},
+	)))
+	mux.Handle(PasswordEmailTokenClientPath, common.WrapHandlerInCORS(common.MakeExternalAPI(
+		"account_password_request_token", func(req *http.Request) util.JSONResponse {
+			return t.requestToken(req, true)
+		},
+	)))
+	mux.Handle(PasswordClientPath, common.WrapHandlerInCORS(common.MakeExternalAPI("account_password", t.changePassword)))
+}
+
+// setupSubmitToken registers the page that the links in emails go to. It
+// is only for browsers, so it isn't served over libp2p.
+func (t *threePIDs) setupSubmitToken(mux *http.ServeMux) {
+	mux.Handle(EmailSubmitTokenPath, common.WrapHandlerInCORS(http.HandlerFunc(t.serveSubmitToken)))
+}
+
+// requestToken emails a token to an address, to confirm that it is the
+// user's before it is added, or to reset the password of the account that
+// it has been added to.
+func (t *threePIDs) requestToken(req *http.Request, passwordReset bool) util.JSONResponse {
+	var body struct {
+		ClientSecret string `json:"client_secret"`
+		Email        string `json:"email"`
+		SendAttempt  int64  `json:"send_attempt"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if t.mailer == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_MEDIUM_NOT_SUPPORTED",
+				Err:     "Email isn't set up on this server",
+			},
+		}
+	}
+	if !validClientSecret.MatchString(body.ClientSecret) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid client_secret"),
+		}
+	}
+	address, err := mail.ParseAddress(body.Email)
+	if err != nil || address.Name != "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid email address"),
+		}
+	}
+	email := strings.ToLower(address.Address)
+	ctx := req.Context()
+	localpart, err := t.accountDB.GetLocalpartForThreePID(ctx, email, "email")
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if passwordReset && localpart == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_NOT_FOUND",
+				Err:     "No account has this email address",
+			},
+		}
+	} else if !passwordReset && localpart != "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_IN_USE",
+				Err:     accounts.Err3PIDInUse.Error(),
+			},
+		}
+	}
+
+	now := time.Now()
+	if _, err = t.db.ExecContext(ctx, deleteExpiredThreePIDSessionsSQL, int64(gomatrixserverlib.AsTimestamp(now.Add(-EmailSessionLifetime)))); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	// Clients send the same request again with the same send_attempt if
+	// they didn't get the response, which mustn't send another email.
+	var sessionID, token string
+	var sendAttempt int64
+	err = t.db.QueryRowContext(ctx, selectThreePIDSessionBySecretSQL, body.ClientSecret, email).Scan(&sessionID, &sendAttempt)
+	switch {
+	case err == sql.ErrNoRows:
+		if token, err = auth.GenerateAccessToken(); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		sessionID = util.RandomString(24)
+		_, err = t.db.ExecContext(
+			ctx, insertThreePIDSessionSQL, sessionID, body.ClientSecret, email, token, body.SendAttempt, int64(gomatrixserverlib.AsTimestamp(now)),
+		)
+	case err == nil && body.SendAttempt > sendAttempt:
+		err = t.db.QueryRowContext(ctx, updateThreePIDSessionSendAttemptSQL, sessionID, body.SendAttempt, int64(gomatrixserverlib.AsTimestamp(now))).Scan(&token)
+	}
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	submitURL := *t.baseURL(req)
+	submitURL.Path += EmailSubmitTokenPath
+	if token != "" {
+		link := submitURL
+		link.RawQuery = url.Values{
+			"sid":           {sessionID},
+			"client_secret": {body.ClientSecret},
+			"token":         {token},
+		}.Encode()
+		subject, text := t.emailText(passwordReset, link.String())
+		if err = t.mailer.send(email, subject, text); err != nil {
+			logrus.WithError(err).Warn("Failed to send email")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: jsonerror.Unknown("Failed to send email"),
+			}
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]string{
+			"sid":        sessionID,
+			"submit_url": submitURL.String(),
+		},
+	}
+}
+
+func (t *threePIDs) emailText(passwordReset bool, link string) (subject, text string) {
+	if passwordReset {
+		return fmt.Sprintf("Reset your password on %s", t.serverName), fmt.Sprintf(
+			"Someone asked to reset the password of your account on %s.\n\n"+
+				"To reset it, follow this link, then go back to your client:\n\n%s\n\n"+
+				"If it wasn't you, you can ignore this email, and your password won't be changed.\n",
+			t.serverName, link,
+		)
+	}
+	return fmt.Sprintf("Confirm your email address on %s", t.serverName), fmt.Sprintf(
+		"Someone asked to add this email address to their account on %s.\n\n"+
+			"To confirm that it is yours, follow this link, then go back to your client:\n\n%s\n\n"+
+			"If it wasn't you, you can ignore this email.\n",
+		t.serverName, link,
+	)
+}
+
+// serveSubmitToken validates a session with the token that was emailed,
+// either from the link in the email or from the client.
+func (t *threePIDs) serveSubmitToken(w http.ResponseWriter, req *http.Request) {
+	var creds threePIDCreds
+	var token string
+	switch req.Method {
+	case http.MethodGet:
+		query := req.URL.Query()
+		creds = threePIDCreds{SessionID: query.Get("sid"), ClientSecret: query.Get("client_secret")}
+		token = query.Get("token")
+	case http.MethodPost:
+		var body struct {
+			threePIDCreds
+			Token string `json:"token"`
+		}
+		if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+			respondJSON(w, *resErr)
+			return
+		}
+		creds, token = body.threePIDCreds, body.Token
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	res, err := t.db.ExecContext(
+		req.Context(), validateThreePIDSessionSQL, creds.SessionID, creds.ClientSecret, token,
+		int64(gomatrixserverlib.AsTimestamp(time.Now().Add(-EmailSessionLifetime))),
+	)
+	var validated int64
+	if err == nil {
+		validated, err = res.RowsAffected()
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Failed to validate email session")
+		respondJSON(w, jsonerror.InternalServerError())
+		return
+	}
+	if req.Method == http.MethodPost {
+		respondJSON(w, util.JSONResponse{Code: http.StatusOK, JSON: map[string]bool{"success": validated == 1}})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if validated != 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "This link has expired, or has already been used. Ask your client to send another.")
+		return
+	}
+	fmt.Fprintln(w, "Your email address has been confirmed. You can go back to your client now.")
+}
+
+// validated returns the address of a session that the user has submitted
+// the token of, or "" if they haven't.
+func (t *threePIDs) validated(ctx context.Context, creds threePIDCreds) (string, error) {
+	var address string
+	err := t.db.QueryRowContext(
+		ctx, selectValidatedThreePIDSessionSQL, creds.SessionID, creds.ClientSecret,
+		int64(gomatrixserverlib.AsTimestamp(time.Now().Add(-EmailSessionLifetime))),
+	).Scan(&address)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return address, err
+}
+
+func (t *threePIDs) list(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	threepids, err := t.accountDB.GetThreePIDsForLocalpart(req.Context(), localpart)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			ThreePIDs []authtypes.ThreePID `json:"threepids"`
+		}{threepids},
+	}
+}
+
+// add adds an email address that the user has confirmed to their account.
+// The newer API needs the user's password too, while the older one has the
+// credentials in a different place. Addresses are never published to an
+// identity server.
+func (t *threePIDs) add(req *http.Request, device *authtypes.Device, withPassword bool) util.JSONResponse {
+	var body struct {
+		threePIDCreds
+		ThreePIDCreds      *threePIDCreds `json:"three_pid_creds"`
+		ThreePIDCredsCamel *threePIDCreds `json:"threePidCreds"`
+		Auth               *struct {
+			Type     string `json:"type"`
+			Password string `json:"password"`
+		} `json:"auth"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	creds := body.threePIDCreds
+	if !withPassword {
+		if body.ThreePIDCreds != nil {
+			creds = *body.ThreePIDCreds
+		} else if body.ThreePIDCredsCamel != nil {
+			creds = *body.ThreePIDCredsCamel
+		}
+	}
+	ctx := req.Context()
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if withPassword {
+		if body.Auth == nil || body.Auth.Type != string(loginTypePassword) {
+			return passwordAuthRequired(nil)
+		}
+		if _, err = t.accountDB.GetAccountByPassword(ctx, localpart, body.Auth.Password); err != nil {
+			return passwordAuthRequired(jsonerror.Forbidden("Invalid password"))
+		}
+	}
+	address, err := t.validated(ctx, creds)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if address == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_AUTH_FAILED",
+				Err:     "The email address hasn't been confirmed",
+			},
+		}
+	}
+	err = t.accountDB.SaveThreePIDAssociation(ctx, address, localpart, "email")
+	if err == accounts.Err3PIDInUse {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_IN_USE",
+				Err:     err.Error(),
+			},
+		}
+	} else if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if _, err = t.db.ExecContext(ctx, deleteThreePIDSessionSQL, creds.SessionID); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// remove removes an email address from the user's account. Unlike the
+// client API, it checks that the address is the user's first.
+func (t *threePIDs) remove(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	var body authtypes.ThreePID
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	ctx := req.Context()
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	owner, err := t.accountDB.GetLocalpartForThreePID(ctx, body.Address, body.Medium)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if owner != localpart {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_NOT_FOUND",
+				Err:     "Your account doesn't have this address",
+			},
+		}
+	}
+	if err = t.accountDB.RemoveThreePIDAssociation(ctx, body.Address, body.Medium); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]string{"id_server_unbind_result": "no-support"},
+	}
+}
+
+// changePassword changes the password of an account, for a user who is
+// logged in and knows their password, or one who has confirmed an email
+// address of the account and isn't. Every other device of the user is
+// logged out unless they ask for it not to be.
+func (t *threePIDs) changePassword(req *http.Request) util.JSONResponse {
+	var body struct {
+		NewPassword   string `json:"new_password"`
+		LogoutDevices *bool  `json:"logout_devices"`
+		Auth          *struct {
+			Type               string         `json:"type"`
+			Password           string         `json:"password"`
+			ThreePIDCreds      *threePIDCreds `json:"threepid_creds"`
+			ThreePIDCredsCamel *threePIDCreds `json:"threepidCreds"`
+		} `json:"auth"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	ctx := req.Context()
+	var localpart, deviceID string
+	switch {
+	case body.Auth != nil && body.Auth.Type == string(loginTypePassword):
+		device, resErr := auth.VerifyUserFromRequest(req, t.authData)
+		if resErr != nil {
+			return *resErr
+		}
+		var err error
+		if localpart, _, err = gomatrixserverlib.SplitID('@', device.UserID); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if _, err = t.accountDB.GetAccountByPassword(ctx, localpart, body.Auth.Password); err != nil {
+			return t.passwordChangeAuthRequired(jsonerror.Forbidden("Invalid password"))
+		}
+		deviceID = device.ID
+	case body.Auth != nil && body.Auth.Type == string(loginTypeEmail):
+		creds := body.Auth.ThreePIDCreds
+		if creds == nil {
+			creds = body.Auth.ThreePIDCredsCamel
+		}
+		if creds == nil {
+			return t.passwordChangeAuthRequired(jsonerror.MissingArgument("Missing threepid_creds"))
+		}
+		address, err := t.validated(ctx, *creds)
+		if err == nil && address != "" {
+			localpart, err = t.accountDB.GetLocalpartForThreePID(ctx, address, "email")
+		}
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if localpart == "" {
+			return t.passwordChangeAuthRequired(&jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_AUTH_FAILED",
+				Err:     "The email address hasn't been confirmed",
+			})
+		}
+		if _, err = t.db.ExecContext(ctx, deleteThreePIDSessionSQL, creds.SessionID); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+	default:
+		return t.passwordChangeAuthRequired(nil)
+	}
+
+	if len(body.NewPassword) < minPasswordLength || len(body.NewPassword) > maxPasswordLength {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.WeakPassword(fmt.Sprintf(
+				"The password must be between %d and %d characters long", minPasswordLength, maxPasswordLength,
+			)),
+		}
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(body.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if _, err = t.db.ExecContext(ctx, updatePasswordHashSQL, string(hash), localpart); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if body.LogoutDevices == nil || *body.LogoutDevices {
+		devices, err := t.deviceDB.GetDevicesByLocalpart(ctx, localpart)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		for _, device := range devices {
+			if device.ID == deviceID {
+				continue
+			}
+			if err = t.deviceDB.RemoveDevice(ctx, device.ID, localpart); err != nil {
+				return httputil.LogThenError(req, err)
+			}
+		}
+	}
+	logrus.WithField("user", localpart).Info("Changed password")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// passwordChangeAuthRequired asks the client for the user's password, or
+// for an email address that they have confirmed if email is set up.
+func (t *threePIDs) passwordChangeAuthRequired(matrixErr *jsonerror.MatrixError) util.JSONResponse {
+	flows := []authtypes.Flow{{Stages: []authtypes.LoginType{loginTypePassword}}}
+	if t.mailer != nil {
+		flows = append(flows, authtypes.Flow{Stages: []authtypes.LoginType{loginTypeEmail}})
+	}
+	res := map[string]interface{}{
+		"flows":   flows,
+		"params":  map[string]interface{}{},
+		"session": util.RandomString(16),
+	}
+	if matrixErr != nil {
+		res["errcode"] = matrixErr.ErrCode
+		res["error"] = matrixErr.Err
+	}
+	return util.JSONResponse{Code: http.StatusUnauthorized, JSON: res}
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultThumbnailSizes are the thumbnails that are made of every image as
+// soon as we have it, unless the config says otherwise. They are the sizes
+// that Synapse makes, which are the ones that clients ask for.
+var defaultThumbnailSizes = []config.ThumbnailSize{
+	{Width: 32, Height: 32, ResizeMethod: types.Crop},
+	{Width: 96, Height: 96, ResizeMethod: types.Crop},
+	{Width: 320, Height: 240, ResizeMethod: types.Scale},
+	{Width: 640, Height: 480, ResizeMethod: types.Scale},
+	{Width: 800, Height: 600, ResizeMethod: types.Scale},
+}
+
+// ParseThumbnailSize parses a thumbnail size of the form 320x240, which is
+// scaled to fit, or 96x96:crop, which is cropped to fill.
+func ParseThumbnailSize(value string) (config.ThumbnailSize, error) {
+	size := config.ThumbnailSize{ResizeMethod: types.Scale}
+	dims := value
+	if i := strings.IndexByte(value, ':'); i >= 0 {
+		dims, size.ResizeMethod = value[:i], value[i+1:]
+	}
+	if size.ResizeMethod != types.Scale && size.ResizeMethod != types.Crop {
+		return size, fmt.Errorf("invalid thumbnail resize method %q: must be scale or crop", size.ResizeMethod)
+	}
+	parts := strings.SplitN(dims, "x", 2)
+	if len(parts) != 2 {
+		return size, fmt.Errorf("invalid thumbnail size %q: must be <width>x<height>", dims)
+	}
+	var err error
+	if size.Width, err = strconv.Atoi(parts[0]); err != nil || size.Width <= 0 {
+		return size, fmt.Errorf("invalid thumbnail width %q", parts[0])
+	}
+	if size.Height, err = strconv.Atoi(parts[1]); err != nil || size.Height <= 0 {
+		return size, fmt.Errorf("invalid thumbnail height %q", parts[1])
+	}
+	return size, nil
+}
+
+// mediaThumbnails makes the thumbnails of the media that we store without
+// the media API, i.e. remote media fetched from nodes other than its origin
+// and the images of URL previews, as the media API does for uploads and for
+// the remote media that it fetches itself. Making them straight away means
+// that nobody waits while a slow device makes them when they scroll through
+// an image-heavy room.
+type mediaThumbnails struct {
+	cfg *config.Dendrite
+	db  storage.Database
+	// active is shared between our thumbnailers, but not with the media
+	// API's, which it keeps to itself. The worst that can happen is that
+	// both make the same thumbnail at once.
+	active *types.ActiveThumbnailGeneration
+	// objects fetches images back from the object store, if there is one.
+	objects *mediaObjects
+}
+
+func newMediaThumbnails(cfg *config.Dendrite, db storage.Database, objects *mediaObjects) *mediaThumbnails {
+	return &mediaThumbnails{
+		cfg:     cfg,
+		db:      db,
+		objects: objects,
+		active: &types.ActiveThumbnailGeneration{
+			PathToResult: make(map[string]*types.ThumbnailGenerationResult),
+		},
+	}
+}
+
+// generate makes the configured thumbnails of an image in the background.
+// Thumbnails that already exist, because the file is stored under another
+// media ID as well, are stored against this one.
+func (t *mediaThumbnails) generate(metadata *types.MediaMetadata) {
+	if t == nil || !strings.HasPrefix(string(metadata.ContentType), "image/") || len(t.cfg.Media.ThumbnailSizes) == 0 {
+		return
+	}
+	go func() {
+		ctx := context.Background()
+		logger := logrus.WithFields(logrus.Fields{"origin": metadata.Origin, "media_id": metadata.MediaID})
+		src, err := fileutils.GetPathFromBase64Hash(metadata.Base64Hash, t.cfg.Media.AbsBasePath)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to find media to make thumbnails of")
+			return
+		}
+		if err = t.objects.restoreFile(ctx, src); err != nil {
+			logger.WithError(err).Warn("Failed to fetch media to make thumbnails of")
+			return
+		}
+		if err = t.storeExisting(ctx, types.Path(src), metadata); err != nil {
+			logger.WithError(err).Warn("Failed to store existing thumbnails")
+		}
+		busy, err := thumbnailer.GenerateThumbnails(
+			ctx, types.Path(src), t.cfg.Media.ThumbnailSizes, metadata,
+			t.active, t.cfg.Media.MaxThumbnailGenerators, t.db, logger,
+		)
+		if err != nil {
+			logger.WithError(err).Warn("Error generating thumbnails")
+		}
+		if busy {
+			logger.Warn("Maximum number of active thumbnail generators reached. Skipping pre-generation.")
+		}
+	}()
+}
+
+// storeExisting stores the thumbnails that are already next to the file
+// against the media ID, which the thumbnailer would otherwise skip without
+// storing.
+func (t *mediaThumbnails) storeExisting(ctx context.Context, src types.Path, metadata *types.MediaMetadata) error {
+	for _, size := range t.cfg.Media.ThumbnailSizes {
+		info, err := os.Stat(string(thumbnailer.GetThumbnailPath(src, types.ThumbnailSize(size))))
+		if err != nil {
+			continue
+		}
+		existing, err := t.db.GetThumbnail(ctx, metadata.MediaID, metadata.Origin, size.Width, size.Height, size.ResizeMethod)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			continue
+		}
+		err = t.db.StoreThumbnail(ctx, &types.ThumbnailMetadata{
+			MediaMetadata: &types.MediaMetadata{
+				MediaID: metadata.MediaID,
+				Origin:  metadata.Origin,
+				// The thumbnailer always makes JPEGs.
+				ContentType:   "image/jpeg",
+				FileSizeBytes: types.FileSizeBytes(info.Size()),
+			},
+			ThumbnailSize: types.ThumbnailSize(size),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
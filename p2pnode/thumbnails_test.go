@@ -0,0 +1,187 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestParseThumbnailSize(t *testing.T) {
+	tests := []struct {
+		value string
+		size  config.ThumbnailSize
+		ok    bool
+	}{
+		{"320x240", config.ThumbnailSize{Width: 320, Height: 240, ResizeMethod: types.Scale}, true},
+		{"96x96:crop", config.ThumbnailSize{Width: 96, Height: 96, ResizeMethod: types.Crop}, true},
+		{"640x480:scale", config.ThumbnailSize{Width: 640, Height: 480, ResizeMethod: types.Scale}, true},
+		{"96x96:fill", config.ThumbnailSize{}, false},
+		{"96", config.ThumbnailSize{}, false},
+		{"96x", config.ThumbnailSize{}, false},
+		{"x96", config.ThumbnailSize{}, false},
+		{"0x96", config.ThumbnailSize{}, false},
+		{"96x-1", config.ThumbnailSize{}, false},
+		{"96x96x96", config.ThumbnailSize{}, false},
+		{"", config.ThumbnailSize{}, false},
+	}
+	for _, tt := range tests {
+		size, err := ParseThumbnailSize(tt.value)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%q: invalid size was accepted as %+v", tt.value, size)
+			}
+			continue
+		}
+		if err != nil || size != tt.size {
+			t.Errorf("%q: got %+v, %v, wanted %+v", tt.value, size, err, tt.size)
+		}
+	}
+}
+
+// testThumbnailDB keeps the thumbnails that are stored in memory.
+type testThumbnailDB struct {
+	storage.Database
+	mu         sync.Mutex
+	thumbnails []*types.ThumbnailMetadata
+}
+
+func (db *testThumbnailDB) StoreThumbnail(ctx context.Context, thumbnail *types.ThumbnailMetadata) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.thumbnails = append(db.thumbnails, thumbnail)
+	return nil
+}
+
+func (db *testThumbnailDB) GetThumbnail(
+	ctx context.Context, mediaID types.MediaID, origin gomatrixserverlib.ServerName, width, height int, resizeMethod string,
+) (*types.ThumbnailMetadata, error) {
+	for _, thumbnail := range db.stored(mediaID) {
+		size := thumbnail.ThumbnailSize
+		if thumbnail.MediaMetadata.Origin == origin && size.Width == width && size.Height == height && size.ResizeMethod == resizeMethod {
+			return thumbnail, nil
+		}
+	}
+	return nil, nil
+}
+
+// stored returns the thumbnails stored against a media ID.
+func (db *testThumbnailDB) stored(mediaID types.MediaID) []*types.ThumbnailMetadata {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var thumbnails []*types.ThumbnailMetadata
+	for _, thumbnail := range db.thumbnails {
+		if thumbnail.MediaMetadata.MediaID == mediaID {
+			thumbnails = append(thumbnails, thumbnail)
+		}
+	}
+	return thumbnails
+}
+
+func TestMediaThumbnailsGenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pnode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	cfg := &config.Dendrite{}
+	cfg.Media.AbsBasePath = config.Path(dir)
+	cfg.Media.MaxThumbnailGenerators = 10
+	cfg.Media.ThumbnailSizes = []config.ThumbnailSize{
+		{Width: 32, Height: 32, ResizeMethod: types.Scale},
+		{Width: 16, Height: 16, ResizeMethod: types.Crop},
+	}
+	const hash = types.Base64Hash("abcdefghijklmnop")
+	src, err := fileutils.GetPathFromBase64Hash(hash, cfg.Media.AbsBasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Dir(src), 0700); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = png.Encode(f, image.NewRGBA(image.Rect(0, 0, 64, 64)))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := &testThumbnailDB{}
+	thumbnails := newMediaThumbnails(cfg, db, nil)
+	media := func(mediaID types.MediaID, contentType types.ContentType) *types.MediaMetadata {
+		return &types.MediaMetadata{MediaID: mediaID, Origin: "example.com", ContentType: contentType, Base64Hash: hash}
+	}
+	waitForThumbnails := func(mediaID types.MediaID) []*types.ThumbnailMetadata {
+		deadline := time.Now().Add(10 * time.Second)
+		for len(db.stored(mediaID)) < len(cfg.Media.ThumbnailSizes) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return db.stored(mediaID)
+	}
+
+	// Other media and a node without thumbnails don't get any.
+	thumbnails.generate(media("text", "text/plain"))
+	var none *mediaThumbnails
+	none.generate(media("none", "image/png"))
+
+	thumbnails.generate(media("first", "image/png"))
+	if got := waitForThumbnails("first"); len(got) != len(cfg.Media.ThumbnailSizes) {
+		t.Fatalf("got %d thumbnails, wanted %d", len(got), len(cfg.Media.ThumbnailSizes))
+	}
+	for _, size := range cfg.Media.ThumbnailSizes {
+		if _, err = os.Stat(string(thumbnailer.GetThumbnailPath(types.Path(src), types.ThumbnailSize(size)))); err != nil {
+			t.Errorf("thumbnail %dx%d wasn't written: %s", size.Width, size.Height, err)
+		}
+	}
+
+	// The same file under another media ID has the existing thumbnails
+	// stored against it.
+	thumbnails.generate(media("second", "image/png"))
+	got := waitForThumbnails("second")
+	if len(got) != len(cfg.Media.ThumbnailSizes) {
+		t.Fatalf("got %d thumbnails of the same file, wanted %d", len(got), len(cfg.Media.ThumbnailSizes))
+	}
+	for _, thumbnail := range got {
+		if thumbnail.MediaMetadata.ContentType != "image/jpeg" || thumbnail.MediaMetadata.FileSizeBytes == 0 {
+			t.Errorf("got thumbnail %+v, wanted a JPEG", thumbnail.MediaMetadata)
+		}
+	}
+
+	for _, mediaID := range []types.MediaID{"text", "none"} {
+		if got := db.stored(mediaID); len(got) != 0 {
+			t.Errorf("%s: got %d thumbnails, wanted none", mediaID, len(got))
+		}
+	}
+}
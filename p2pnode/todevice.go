@@ -0,0 +1,549 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/transactions"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// ToDeviceProtocol is the libp2p protocol that to-device messages are sent
+// to other nodes on. Each stream carries one m.direct_to_device EDU, and the
+// peer that opened it is the server that sent it.
+const ToDeviceProtocol = "/matrix/to-device"
+
+// MDirectToDevice is the type of the EDU that carries to-device messages.
+const MDirectToDevice = "m.direct_to_device"
+
+// SendToDeviceClientPathPrefix starts the client API for sending to-device
+// messages. The event type and then the transaction ID follow it.
+const SendToDeviceClientPathPrefix = "/_matrix/client/r0/sendToDevice/"
+
+// ToDeviceSendTimeout is how long we spend sending to-device messages to a
+// server, and how long a server has to send them to us.
+const ToDeviceSendTimeout = time.Second * 30
+
+// ToDeviceMaxSize is the largest EDU that another node can send us.
+const ToDeviceMaxSize = 1 << 20
+
+// ToDeviceSyncLimit is the most to-device messages in a /sync response. The
+// rest follow in later responses.
+const ToDeviceSyncLimit = 100
+
+// wildcardDeviceID addresses a message to every device of a user.
+const wildcardDeviceID = "*"
+
+const toDeviceSchema = `
+-- The to-device messages waiting for our devices. Messages are deleted once
+-- the device calls /sync with the token of the response that they were in.
+CREATE TABLE IF NOT EXISTS p2p_send_to_device (
+    id BIGSERIAL PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    sender TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    content TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS p2p_send_to_device_idx ON p2p_send_to_device(user_id, device_id, id);
+`
+
+const insertToDeviceSQL = "" +
+	"INSERT INTO p2p_send_to_device (user_id, device_id, sender, event_type, content) VALUES ($1, $2, $3, $4, $5)"
+
+const selectToDeviceSQL = "" +
+	"SELECT id, sender, event_type, content FROM p2p_send_to_device" +
+	" WHERE user_id = $1 AND device_id = $2 ORDER BY id LIMIT $3"
+
+const deleteToDeviceSQL = "" +
+	"DELETE FROM p2p_send_to_device WHERE user_id = $1 AND device_id = $2 AND id <= $3"
+
+// toDeviceContent is the content of an m.direct_to_device EDU. Messages are
+// by user ID and device ID.
+type toDeviceContent struct {
+	Sender    string                                `json:"sender"`
+	Type      string                                `json:"type"`
+	MessageID string                                `json:"message_id"`
+	Messages  map[string]map[string]json.RawMessage `json:"messages"`
+}
+
+// toDeviceEvent is a to-device message in /sync.
+type toDeviceEvent struct {
+	Sender  string          `json:"sender"`
+	Type    string          `json:"type"`
+	Content json.RawMessage `json:"content"`
+}
+
+// toDeviceAck is the /sync response that a device was last sent messages
+// in: once the device calls /sync with its token, it has them.
+type toDeviceAck struct {
+	token string
+	upTo  int64
+}
+
+// toDevice sends to-device messages from our users to the devices of other
+// users, and keeps the ones for our own devices until they are collected in
+// /sync. Dendrite doesn't support them at all. Messages for p2p nodes are
+// sent straight to the node on a stream of their own, and messages for any
+// other server are sent in a transaction.
+type toDevice struct {
+	db         *sql.DB
+	host       host.Host
+	resolver   *resolverTransport
+	serverName gomatrixserverlib.ServerName
+	federation *gomatrixserverlib.FederationClient
+	deviceDB   *devices.Database
+	authData   auth.Data
+	txns       *transactions.Cache
+
+	mu   sync.Mutex
+	acks map[string]toDeviceAck
+	// waiters holds a channel for each /sync call that is waiting for
+	// events, by user ID and device ID, which is closed when a message
+	// arrives for the device.
+	waiters map[string][]chan struct{}
+	txnID   int64
+}
+
+func newToDevice(
+	dataSourceName string, p2pHost host.Host, resolver *resolverTransport,
+	federation *gomatrixserverlib.FederationClient, deviceDB *devices.Database,
+	authData auth.Data, serverName gomatrixserverlib.ServerName,
+) (*toDevice, error) {
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(toDeviceSchema); err != nil {
+		return nil, err
+	}
+	return &toDevice{
+		db:         db,
+		host:       p2pHost,
+		resolver:   resolver,
+		serverName: serverName,
+		federation: federation,
+		deviceDB:   deviceDB,
+		authData:   authData,
+		txns:       transactions.New(),
+		acks:       make(map[string]toDeviceAck),
+		waiters:    make(map[string][]chan struct{}),
+	}, nil
+}
+
+// setup registers the client API for /sendToDevice and the handler for
+// messages from other nodes.
+func (t *toDevice) setup(mux *http.ServeMux) {
+	mux.Handle(SendToDeviceClientPathPrefix, common.WrapHandlerInCORS(common.MakeAuthAPI("send_to_device", t.authData,
+		func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			if req.Method != http.MethodPut {
+				return util.JSONResponse{
+					Code: http.StatusMethodNotAllowed,
+					JSON: jsonerror.NotFound("Bad method"),
+				}
+			}
+			parts := strings.Split(strings.TrimPrefix(req.URL.EscapedPath(), SendToDeviceClientPathPrefix), "/")
+			if len(parts) != 2 {
+				return util.JSONResponse{
+					Code: http.StatusNotFound,
+					JSON: jsonerror.NotFound("Unknown send to device API"),
+				}
+			}
+			eventType, err := url.PathUnescape(parts[0])
+			if err != nil {
+				return util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.InvalidArgumentValue(err.Error())}
+			}
+			txnID, err := url.PathUnescape(parts[1])
+			if err != nil {
+				return util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.InvalidArgumentValue(err.Error())}
+			}
+			if res, ok := t.txns.FetchTransaction(device.AccessToken, txnID); ok {
+				return *res
+			}
+			res := t.send(req, device, eventType)
+			if res.Code == http.StatusOK {
+				t.txns.AddTransaction(device.AccessToken, txnID, &res)
+			}
+			return res
+		},
+	)))
+	t.host.SetStreamHandler(ToDeviceProtocol, t.handleStream)
+}
+
+// send delivers to-device messages from one of our users to our own devices
+// and sends the rest on to their servers.
+func (t *toDevice) send(req *http.Request, device *authtypes.Device, eventType string) util.JSONResponse {
+	var body struct {
+		Messages map[string]map[string]json.RawMessage `json:"messages"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	local := make(map[string]map[string]json.RawMessage)
+	remote := make(map[gomatrixserverlib.ServerName]map[string]map[string]json.RawMessage)
+	for userID, messages := range body.Messages {
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid user ID " + userID),
+			}
+		}
+		if domain == t.serverName {
+			local[userID] = messages
+			continue
+		}
+		if remote[domain] == nil {
+			remote[domain] = make(map[string]map[string]json.RawMessage)
+		}
+		remote[domain][userID] = messages
+	}
+
+	if err := t.deliver(req.Context(), device.UserID, eventType, local); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	for server, messages := range remote {
+		go t.sendRemote(server, &toDeviceContent{
+			Sender:    device.UserID,
+			Type:      eventType,
+			MessageID: util.RandomString(16),
+			Messages:  messages,
+		})
+	}
+	return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+}
+
+// sendRemote sends to-device messages to another server. Failures are only
+// logged, as the spec doesn't promise that the messages arrive.
+func (t *toDevice) sendRemote(server gomatrixserverlib.ServerName, content *toDeviceContent) {
+	ctx, cancel := context.WithTimeout(context.Background(), ToDeviceSendTimeout)
+	defer cancel()
+	logger := logrus.WithField("server", server)
+	if id, err := serverNamePeer(server); err == nil {
+		if err = t.sendStream(ctx, id, content); err != nil {
+			logger.WithError(err).Warn("Failed to send to-device messages")
+		}
+		return
+	}
+
+	edu := gomatrixserverlib.EDU{Type: MDirectToDevice}
+	var err error
+	if edu.Content, err = json.Marshal(content); err != nil {
+		logger.WithError(err).Error("Failed to encode to-device messages")
+		return
+	}
+	t.mu.Lock()
+	t.txnID++
+	txnID := t.txnID
+	t.mu.Unlock()
+	txn := gomatrixserverlib.Transaction{
+		TransactionID:  gomatrixserverlib.TransactionID(fmt.Sprintf("to-device-%s-%d", content.MessageID, txnID)),
+		Origin:         t.serverName,
+		Destination:    server,
+		OriginServerTS: gomatrixserverlib.AsTimestamp(time.Now()),
+		PDUs:           []gomatrixserverlib.Event{},
+		EDUs:           []gomatrixserverlib.EDU{edu},
+	}
+	if _, err = t.federation.SendTransaction(ctx, txn); err != nil {
+		logger.WithError(err).Warn("Failed to send to-device messages")
+	}
+}
+
+// sendStream sends to-device messages to a p2p node, connecting to it first
+// if need be, and waits for it to say whether it took them.
+func (t *toDevice) sendStream(ctx context.Context, id peer.ID, content *toDeviceContent) error {
+	if err := t.resolver.resolve(ctx, id); err != nil {
+		return err
+	}
+	s, err := t.host.NewStream(ctx, id, ToDeviceProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Reset() // nolint: errcheck
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+	if err = json.NewEncoder(s).Encode(content); err != nil {
+		return err
+	}
+	// Closing only closes our end, so that the node knows that we're done.
+	if err = s.Close(); err != nil {
+		return err
+	}
+	var res jsonerror.MatrixError
+	if err = json.NewDecoder(io.LimitReader(s, ToDeviceMaxSize)).Decode(&res); err != nil {
+		return err
+	}
+	if res.ErrCode != "" {
+		return &res
+	}
+	return nil
+}
+
+// handleStream takes to-device messages from another node.
+func (t *toDevice) handleStream(s network.Stream) {
+	defer s.Close() // nolint: errcheck
+	_ = s.SetDeadline(time.Now().Add(ToDeviceSendTimeout))
+	origin := peerServerName(s.Conn().RemotePeer())
+	logger := logrus.WithField("peer", origin)
+	ctx, cancel := context.WithTimeout(context.Background(), ToDeviceSendTimeout)
+	defer cancel()
+
+	var res interface{} = struct{}{}
+	var content toDeviceContent
+	if err := json.NewDecoder(io.LimitReader(s, ToDeviceMaxSize)).Decode(&content); err != nil {
+		logger.WithError(err).Debug("Ignoring invalid to-device messages")
+		res = jsonerror.BadJSON(err.Error())
+	} else if err = t.receive(ctx, origin, &content); err != nil {
+		logger.WithError(err).Warn("Failed to take to-device messages")
+		res = err
+	}
+	if err := json.NewEncoder(s).Encode(res); err != nil {
+		logger.WithError(err).Debug("Failed to answer to-device messages")
+	}
+}
+
+// receive delivers to-device messages from another server to our devices.
+func (t *toDevice) receive(ctx context.Context, origin gomatrixserverlib.ServerName, content *toDeviceContent) error {
+	if _, domain, err := gomatrixserverlib.SplitID('@', content.Sender); err != nil || domain != origin {
+		return jsonerror.Forbidden("The sender isn't on the server that sent the messages")
+	}
+	local := make(map[string]map[string]json.RawMessage)
+	for userID, messages := range content.Messages {
+		if _, domain, err := gomatrixserverlib.SplitID('@', userID); err == nil && domain == t.serverName {
+			local[userID] = messages
+		}
+	}
+	if err := t.deliver(ctx, content.Sender, content.Type, local); err != nil {
+		return jsonerror.Unknown(err.Error())
+	}
+	return nil
+}
+
+// deliver stores to-device messages for our own devices, by user ID and
+// device ID, and wakes any /sync calls that are waiting for them.
+func (t *toDevice) deliver(ctx context.Context, sender, eventType string, messages map[string]map[string]json.RawMessage) error {
+	var keys []string
+	for userID, byDevice := range messages {
+		localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			continue
+		}
+		all, ok := byDevice[wildcardDeviceID]
+		if ok {
+			userDevices, err := t.deviceDB.GetDevicesByLocalpart(ctx, localpart)
+			if err != nil {
+				return err
+			}
+			byDevice = make(map[string]json.RawMessage, len(userDevices))
+			for _, d := range userDevices {
+				byDevice[d.ID] = all
+			}
+		}
+		for deviceID, content := range byDevice {
+			if _, err = t.db.ExecContext(ctx, insertToDeviceSQL, userID, deviceID, sender, eventType, string(content)); err != nil {
+				return err
+			}
+			keys = append(keys, userID+"/"+deviceID)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, key := range keys {
+		for _, woken := range t.waiters[key] {
+			close(woken)
+		}
+		delete(t.waiters, key)
+	}
+	return nil
+}
+
+// wrapSync adds the to-device messages waiting for the device calling /sync
+// to the response. If there are none and the call waits for events, it also
+// waits for messages, and returns early with the same token if any arrive.
+func (t *toDevice) wrapSync(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		device, req := syncDevice(req, t.authData)
+		if device == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		logger := util.GetLogger(req.Context())
+		key := device.UserID + "/" + device.ID
+		since := req.URL.Query().Get("since")
+		// Wait for messages from before we look for them, so that none can
+		// arrive in between unnoticed.
+		woken, stopWaiting := t.wait(key)
+		defer stopWaiting()
+		if err := t.acknowledge(req.Context(), device, key, since); err != nil {
+			logger.WithError(err).Error("Failed to delete to-device messages")
+		}
+		events, upTo, err := t.pending(req.Context(), device)
+		if err != nil {
+			logger.WithError(err).Error("Failed to fetch to-device messages")
+		}
+
+		var rec *bufferedResponse
+		if len(events) == 0 && since != "" {
+			if rec = t.waitForSync(next, req, woken); rec == nil {
+				if events, upTo, err = t.pending(req.Context(), device); err != nil {
+					logger.WithError(err).Error("Failed to fetch to-device messages")
+				}
+				rec = emptySyncResponse(since)
+			}
+		} else {
+			rec = &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+			next.ServeHTTP(rec, req)
+		}
+
+		var res map[string]json.RawMessage
+		if len(events) == 0 || rec.code != http.StatusOK || json.Unmarshal(rec.body.Bytes(), &res) != nil {
+			rec.writeTo(w)
+			return
+		}
+		var token string
+		_ = json.Unmarshal(res["next_batch"], &token)
+		if res["to_device"], err = json.Marshal(map[string]interface{}{"events": events}); err != nil {
+			rec.writeTo(w)
+			return
+		}
+		t.mu.Lock()
+		t.acks[key] = toDeviceAck{token: token, upTo: upTo}
+		t.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	})
+}
+
+// wait returns a channel that is closed when a to-device message arrives for
+// the device, and a function to call once it is no longer needed.
+func (t *toDevice) wait(key string) (<-chan struct{}, func()) {
+	woken := make(chan struct{})
+	t.mu.Lock()
+	t.waiters[key] = append(t.waiters[key], woken)
+	t.mu.Unlock()
+	return woken, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		waiters := t.waiters[key]
+		for i, w := range waiters {
+			if w == woken {
+				t.waiters[key] = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(t.waiters[key]) == 0 {
+			delete(t.waiters, key)
+		}
+	}
+}
+
+// waitForSync passes a /sync call on, but gives up on it if a to-device
+// message arrives for the device first, in which case it returns nil.
+func (t *toDevice) waitForSync(next http.Handler, req *http.Request, woken <-chan struct{}) *bufferedResponse {
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	done := make(chan *bufferedResponse, 1)
+	go func() {
+		rec := &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+		next.ServeHTTP(rec, req.WithContext(ctx))
+		done <- rec
+	}()
+	select {
+	case rec := <-done:
+		return rec
+	case <-woken:
+		return nil
+	}
+}
+
+// acknowledge deletes the messages that the device was sent in the response
+// whose token it is calling /sync with.
+func (t *toDevice) acknowledge(ctx context.Context, device *authtypes.Device, key, since string) error {
+	t.mu.Lock()
+	ack, ok := t.acks[key]
+	if ok && ack.token == since {
+		delete(t.acks, key)
+	}
+	t.mu.Unlock()
+	if !ok || ack.token != since {
+		return nil
+	}
+	_, err := t.db.ExecContext(ctx, deleteToDeviceSQL, device.UserID, device.ID, ack.upTo)
+	return err
+}
+
+// pending returns the messages waiting for the device, along with the ID of
+// the last one.
+func (t *toDevice) pending(ctx context.Context, device *authtypes.Device) ([]toDeviceEvent, int64, error) {
+	rows, err := t.db.QueryContext(ctx, selectToDeviceSQL, device.UserID, device.ID, ToDeviceSyncLimit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close() // nolint: errcheck
+	var events []toDeviceEvent
+	var upTo int64
+	for rows.Next() {
+		var event toDeviceEvent
+		var content string
+		if err = rows.Scan(&upTo, &event.Sender, &event.Type, &content); err != nil {
+			return nil, 0, err
+		}
+		event.Content = json.RawMessage(content)
+		events = append(events, event)
+	}
+	return events, upTo, rows.Err()
+}
+
+// emptySyncResponse is a /sync response with nothing in it, which leaves
+// the client where it was.
+func emptySyncResponse(since string) *bufferedResponse {
+	rec := &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+	rec.header.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(&rec.body).Encode(map[string]interface{}{
+		"next_batch":   since,
+		"account_data": map[string]interface{}{"events": []interface{}{}},
+		"presence":     map[string]interface{}{"events": []interface{}{}},
+		"rooms": map[string]interface{}{
+			"join":   map[string]interface{}{},
+			"invite": map[string]interface{}{},
+			"leave":  map[string]interface{}{},
+		},
+	})
+	return rec
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// TopologyPath is where the topology of the network around the node is
+// served. It needs the admin token, as it shows who we talk to and in which
+// rooms.
+const TopologyPath = "/_dendrite/topology"
+
+// Topology is the part of the network graph that the node can see: itself,
+// the peers that it is connected to, and the connections between them. The
+// graphs from several nodes can be merged by peer ID to draw the whole mesh.
+type Topology struct {
+	Nodes []TopologyNode `json:"nodes"`
+	Edges []TopologyEdge `json:"edges"`
+}
+
+// TopologyNode is a node in the network graph.
+type TopologyNode struct {
+	PeerID string   `json:"peer_id"`
+	Self   bool     `json:"self"`
+	Addrs  []string `json:"addrs"`
+}
+
+// TopologyEdge is a connection from the node to a peer.
+type TopologyEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// The average round trip time to the peer, or zero if it hasn't been
+	// measured yet.
+	LatencyMS   float64  `json:"latency_ms"`
+	SharedRooms []string `json:"shared_rooms"`
+}
+
+// Topology returns the network graph as the node sees it right now.
+func (n *Node) Topology() Topology {
+	self := n.Host.ID()
+	t := Topology{
+		Nodes: []TopologyNode{{PeerID: self.Pretty(), Self: true, Addrs: addrStrings(n.Host.Addrs())}},
+		Edges: []TopologyEdge{},
+	}
+	for _, info := range n.Peers() {
+		id, err := peer.IDB58Decode(info.PeerID)
+		if err != nil {
+			continue
+		}
+		t.Nodes = append(t.Nodes, TopologyNode{
+			PeerID: info.PeerID,
+			Addrs:  addrStrings(n.Host.Peerstore().Addrs(id)),
+		})
+		rooms := n.Memberships.SharedRooms(gomatrixserverlib.ServerName(info.PeerID))
+		if rooms == nil {
+			rooms = []string{}
+		}
+		t.Edges = append(t.Edges, TopologyEdge{
+			From:        self.Pretty(),
+			To:          info.PeerID,
+			LatencyMS:   float64(n.Host.Peerstore().LatencyEWMA(id)) / float64(time.Millisecond),
+			SharedRooms: rooms,
+		})
+	}
+	return t
+}
+
+// setupTopologyAPI registers the topology endpoint. It allows CORS, so that
+// visualisers running in a browser can fetch it from many nodes.
+func (n *Node) setupTopologyAPI(mux *http.ServeMux) {
+	mux.Handle(TopologyPath, common.WrapHandlerInCORS(n.makeAdminAPI("topology", func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: n.Topology(),
+		}
+	})))
+}
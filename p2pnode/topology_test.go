@@ -0,0 +1,37 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTopologyAPICORS(t *testing.T) {
+	n := &Node{adminToken: "admin-secret"}
+	mux := http.NewServeMux()
+	n.setupTopologyAPI(mux)
+	for _, method := range []string{http.MethodOptions, http.MethodGet} {
+		req := httptest.NewRequest(method, TopologyPath, nil)
+		req.Header.Set("Origin", "https://visualiser.example")
+		req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if origins := rec.Result().Header["Access-Control-Allow-Origin"]; len(origins) != 1 || origins[0] != "*" {
+			t.Errorf("%s: got Access-Control-Allow-Origin %q, wanted one *", method, origins)
+		}
+	}
+}
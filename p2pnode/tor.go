@@ -0,0 +1,297 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/transport"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	ma "github.com/multiformats/go-multiaddr"
+	mafmt "github.com/multiformats/go-multiaddr-fmt"
+	manet "github.com/multiformats/go-multiaddr-net"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+)
+
+// TorListenAddr is the local address that the onion service forwards to.
+const TorListenAddr = "/ip4/127.0.0.1/tcp/0"
+
+// TorOnionPort is the port that the onion service is reachable on.
+const TorOnionPort = 4001
+
+// TorOnionKeyFileName is the name of the file, in the data directory, that
+// holds the private key of the onion service, so that our onion address
+// stays the same across restarts.
+const TorOnionKeyFileName = ".dendrite-p2p-onion"
+
+// torTransport is a libp2p transport which makes every connection through a
+// Tor SOCKS proxy. It can dial both onion addresses and ordinary TCP ones,
+// and it listens only on loopback for connections forwarded by our onion
+// service, so that nothing goes in or out of the node except through Tor.
+type torTransport struct {
+	upgrader *tptu.Upgrader
+	dialer   proxy.Dialer
+}
+
+var _ transport.Transport = &torTransport{}
+
+func newTorTransport(socksAddr string) func(*tptu.Upgrader) (*torTransport, error) {
+	return func(upgrader *tptu.Upgrader) (*torTransport, error) {
+		dialer, err := proxy.SOCKS5("tcp", socksAddr, nil, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		return &torTransport{upgrader: upgrader, dialer: dialer}, nil
+	}
+}
+
+// CanDial implements transport.Transport
+func (t *torTransport) CanDial(addr ma.Multiaddr) bool {
+	_, err := torDialAddr(addr)
+	return err == nil
+}
+
+// Dial implements transport.Transport
+func (t *torTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	addr, err := torDialAddr(raddr)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if d, ok := t.dialer.(proxy.ContextDialer); ok {
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = t.dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	laddr, err := manet.FromNetAddr(conn.LocalAddr())
+	if err != nil {
+		conn.Close() // nolint: errcheck
+		return nil, err
+	}
+	return t.upgrader.UpgradeOutbound(ctx, t, &torConn{Conn: conn, laddr: laddr, raddr: raddr}, p)
+}
+
+// Listen implements transport.Transport
+func (t *torTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	if !manet.IsIPLoopback(laddr) {
+		return nil, fmt.Errorf("refusing to listen on %s: only loopback addresses are allowed with Tor", laddr)
+	}
+	list, err := manet.Listen(laddr)
+	if err != nil {
+		return nil, err
+	}
+	return t.upgrader.UpgradeListener(t, list), nil
+}
+
+// Protocols implements transport.Transport
+func (t *torTransport) Protocols() []int {
+	return []int{ma.P_TCP, ma.P_ONION3}
+}
+
+// Proxy implements transport.Transport
+func (t *torTransport) Proxy() bool {
+	return false
+}
+
+func (t *torTransport) String() string {
+	return "Tor"
+}
+
+// torDialAddr converts a multiaddr into the host:port form that the SOCKS
+// proxy wants. Onion addresses are resolved by Tor rather than by us.
+func torDialAddr(addr ma.Multiaddr) (string, error) {
+	if value, err := addr.ValueForProtocol(ma.P_ONION3); err == nil {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 {
+			return "", fmt.Errorf("invalid onion3 address %s", addr)
+		}
+		return parts[0] + ".onion:" + parts[1], nil
+	}
+	if !mafmt.TCP.Matches(addr) {
+		return "", fmt.Errorf("can't dial %s through Tor", addr)
+	}
+	var host, port string
+	ma.ForEach(addr, func(c ma.Component) bool {
+		switch c.Protocol().Code {
+		case ma.P_IP4, ma.P_IP6, ma.P_DNS4, ma.P_DNS6:
+			host = c.Value()
+		case ma.P_TCP:
+			port = c.Value()
+		}
+		return true
+	})
+	return net.JoinHostPort(host, port), nil
+}
+
+// torConn is a connection made through the SOCKS proxy. Its remote address
+// is the one that we asked Tor for rather than the address of the proxy.
+type torConn struct {
+	net.Conn
+	laddr ma.Multiaddr
+	raddr ma.Multiaddr
+}
+
+func (c *torConn) LocalMultiaddr() ma.Multiaddr {
+	return c.laddr
+}
+
+func (c *torConn) RemoteMultiaddr() ma.Multiaddr {
+	return c.raddr
+}
+
+// onionService is an onion service that forwards to our libp2p listener. It
+// stays up for as long as the connection to the Tor control port is open.
+type onionService struct {
+	mu   sync.RWMutex
+	addr ma.Multiaddr
+}
+
+// Addrs returns the onion address, once the service has been started. It is
+// used as the address factory for the host, so that it never advertises any
+// of its real addresses.
+func (s *onionService) Addrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.addr == nil {
+		return nil
+	}
+	return []ma.Multiaddr{s.addr}
+}
+
+// start asks Tor to publish an onion service which forwards to the local
+// address. The service key is kept in keyFile.
+func (s *onionService) start(ctx context.Context, controlAddr, keyFile string, local ma.Multiaddr) error {
+	target, err := manet.ToNetAddr(local)
+	if err != nil {
+		return err
+	}
+	netConn, err := net.Dial("tcp", controlAddr)
+	if err != nil {
+		return err
+	}
+	conn := textproto.NewConn(netConn)
+	if err = torAuthenticate(conn); err != nil {
+		conn.Close() // nolint: errcheck
+		return err
+	}
+
+	keySpec := "NEW:ED25519-V3"
+	if data, err := ioutil.ReadFile(keyFile); err == nil {
+		keySpec = strings.TrimSpace(string(data))
+	} else if !os.IsNotExist(err) {
+		conn.Close() // nolint: errcheck
+		return err
+	}
+	lines, err := torCommand(conn, "ADD_ONION %s Port=%d,%s", keySpec, TorOnionPort, target)
+	if err != nil {
+		conn.Close() // nolint: errcheck
+		return err
+	}
+	var serviceID string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "ServiceID=") {
+			serviceID = strings.TrimPrefix(line, "ServiceID=")
+		} else if strings.HasPrefix(line, "PrivateKey=") {
+			key := strings.TrimPrefix(line, "PrivateKey=")
+			if err = ioutil.WriteFile(keyFile, []byte(key+"\n"), 0600); err != nil {
+				conn.Close() // nolint: errcheck
+				return err
+			}
+		}
+	}
+	addr, err := ma.NewMultiaddr(fmt.Sprintf("/onion3/%s:%d", serviceID, TorOnionPort))
+	if err != nil {
+		conn.Close() // nolint: errcheck
+		return err
+	}
+
+	s.mu.Lock()
+	s.addr = addr
+	s.mu.Unlock()
+	logrus.WithField("addr", addr).Info("Started onion service")
+
+	go func() {
+		<-ctx.Done()
+		conn.Close() // nolint: errcheck
+	}()
+	return nil
+}
+
+// torAuthenticate authenticates with the control port, using whichever of
+// the methods that don't need a password Tor will accept.
+func torAuthenticate(conn *textproto.Conn) error {
+	lines, err := torCommand(conn, "PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+	var methods, cookieFile string
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "AUTH ") {
+			continue
+		}
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "AUTH ")) {
+			if strings.HasPrefix(field, "METHODS=") {
+				methods = strings.TrimPrefix(field, "METHODS=")
+			} else if strings.HasPrefix(field, "COOKIEFILE=") {
+				cookieFile, _ = strconv.Unquote(strings.TrimPrefix(field, "COOKIEFILE="))
+			}
+		}
+	}
+	for _, method := range strings.Split(methods, ",") {
+		switch method {
+		case "NULL":
+			_, err = torCommand(conn, "AUTHENTICATE")
+			return err
+		case "COOKIE":
+			cookie, err := ioutil.ReadFile(cookieFile)
+			if err != nil {
+				return err
+			}
+			_, err = torCommand(conn, "AUTHENTICATE %s", hex.EncodeToString(cookie))
+			return err
+		}
+	}
+	return fmt.Errorf("tor control port needs an unsupported authentication method (%s)", methods)
+}
+
+// torCommand sends a command to the control port and returns the lines of
+// the reply, failing unless it was successful.
+func torCommand(conn *textproto.Conn, format string, args ...interface{}) ([]string, error) {
+	id, err := conn.Cmd(format, args...)
+	if err != nil {
+		return nil, err
+	}
+	conn.StartResponse(id)
+	defer conn.EndResponse(id)
+	_, message, err := conn.ReadResponse(250)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(message, "\n"), nil
+}
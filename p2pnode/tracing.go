@@ -0,0 +1,169 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"net/http"
+
+	p2phttp "github.com/libp2p/go-libp2p-http"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	jaegerconfig "github.com/uber/jaeger-client-go/config"
+)
+
+// setupJaeger points the Dendrite tracing config at a Jaeger agent, sampling
+// every request. Dendrite sets up the tracer itself, from this config, when
+// the base component is created.
+func setupJaeger(cfg *config.Dendrite, agentAddr string) {
+	cfg.Tracing.Jaeger.Disabled = false
+	cfg.Tracing.Jaeger.Sampler = &jaegerconfig.SamplerConfig{
+		Type:  "const",
+		Param: 1,
+	}
+	cfg.Tracing.Jaeger.Reporter = &jaegerconfig.ReporterConfig{
+		LocalAgentHostPort: agentAddr,
+	}
+}
+
+// createFederationClient creates the federation client in the same way as
+// the base component does, except that requests to other nodes are traced
+// and carry the trace with them, so that the span for handling the request
+// on the other node joins the same trace. Transactions are also counted for
+// the federation metrics. Servers that are p2p nodes are found through the
+// DHT rather than DNS, with transactions for those that can't be reached
+// left with their postbox peers or in the DHT mailbox, and the rest are reached over HTTPS unless
+// clearnet federation is disabled. Events are left out of the transactions
+// for servers that the room's server ACL denies, and nothing is sent to
+// servers that the federation policy doesn't allow.
+func (n *Node) createFederationClient() *gomatrixserverlib.FederationClient {
+	p2p := &mailboxTransport{
+		next: &resolverTransport{
+			next:  p2phttp.NewTransport(n.Host, p2phttp.ProtocolOption(MatrixProtocol)),
+			host:  n.Host,
+			dht:   n.DHT,
+			keyDB: n.KeyDB,
+			gate:  n.Gate,
+			idle:  n.idle,
+		},
+		postbox:  n.postbox,
+		mailbox:  n.mailbox,
+		queue:    n.outbound,
+		liveness: n.liveness,
+	}
+	n.outbound.deliver = p2p.deliver
+	router := &federationRouter{p2p: p2p}
+	if n.clearnet {
+		router.clearnet = newClearnetTransport()
+	}
+	cfg := n.Base.Cfg
+	tr := &http.Transport{}
+	tr.RegisterProtocol(
+		"matrix",
+		&policyTransport{
+			next: &aclTransport{
+				next:       &tracingTransport{next: &metricsTransport{next: router}},
+				acls:       n.acls,
+				serverName: cfg.Matrix.ServerName,
+				keyID:      cfg.Matrix.KeyID,
+				privateKey: cfg.Matrix.PrivateKey,
+			},
+			policy: n.Policy,
+		},
+	)
+	n.federationTransport = tr
+	return gomatrixserverlib.NewFederationClientWithTransport(
+		cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey, tr,
+	)
+}
+
+// tracingTransport wraps a transport with a client span for each request.
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tracer := opentracing.GlobalTracer()
+	opts := []opentracing.StartSpanOption{ext.SpanKindRPCClient}
+	if parent := opentracing.SpanFromContext(req.Context()); parent != nil {
+		opts = append(opts, opentracing.ChildOf(parent.Context()))
+	}
+	span := tracer.StartSpan("federation_request", opts...)
+	defer span.Finish()
+	ext.HTTPMethod.Set(span, req.Method)
+	ext.HTTPUrl.Set(span, req.URL.String())
+	span.SetTag("peer.id", req.URL.Host)
+
+	// The request mustn't be changed by a RoundTripper, so the headers are
+	// injected into a copy.
+	req = req.WithContext(opentracing.ContextWithSpan(req.Context(), span))
+	req.Header = cloneHeader(req.Header)
+	if err := tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header)); err != nil {
+		span.LogKV("event", "inject_failed", "error", err.Error())
+	}
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("error", err.Error())
+		return nil, err
+	}
+	ext.HTTPStatusCode.Set(span, uint16(res.StatusCode))
+	return res, nil
+}
+
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for k, v := range h {
+		clone[k] = append([]string(nil), v...)
+	}
+	return clone
+}
+
+// tracingHandler wraps the handler for requests from other nodes with a
+// server span for each request, which continues the trace of the node that
+// made it if it sent one.
+func tracingHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tracer := opentracing.GlobalTracer()
+		opts := []opentracing.StartSpanOption{ext.SpanKindRPCServer}
+		carrier := opentracing.HTTPHeadersCarrier(req.Header)
+		if clientContext, err := tracer.Extract(opentracing.HTTPHeaders, carrier); err == nil {
+			opts = append(opts, ext.RPCServerOption(clientContext))
+		}
+		span := tracer.StartSpan("libp2p_request", opts...)
+		defer span.Finish()
+		ext.HTTPMethod.Set(span, req.Method)
+		ext.HTTPUrl.Set(span, req.URL.String())
+		// gostream gives the peer ID of the remote node as its address.
+		span.SetTag("peer.id", req.RemoteAddr)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, req.WithContext(opentracing.ContextWithSpan(req.Context(), span)))
+		ext.HTTPStatusCode.Set(span, uint16(rec.status))
+	})
+}
+
+// statusRecorder remembers the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
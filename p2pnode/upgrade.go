@@ -0,0 +1,689 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/publicroomsapi/storage/postgres"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// CapabilitiesClientPath is where clients find out what the server can do,
+// including which room versions it can create rooms of.
+const CapabilitiesClientPath = "/_matrix/client/r0/capabilities"
+
+// CreateRoomClientPath is where clients create rooms.
+const CreateRoomClientPath = "/_matrix/client/r0/createRoom"
+
+// KnockClientPathPrefixes are where clients knock on rooms, asking to be
+// invited.
+var KnockClientPathPrefixes = []string{
+	"/_matrix/client/r0/knock/",
+	"/_matrix/client/unstable/xyz.amorgan.knock/knock/",
+}
+
+// TombstoneEventType is the type of the state event that closes a room that
+// has been upgraded, pointing at the room that replaced it.
+const TombstoneEventType = "m.room.tombstone"
+
+// DefaultRoomVersion is the version of the rooms that are created unless a
+// client asks for another.
+const DefaultRoomVersion = "1"
+
+// DirectoryTransferTimeout is how long to wait for a room that replaced one
+// in the room directory to turn up in it, so that it can be listed instead.
+const DirectoryTransferTimeout = time.Second * 10
+
+// roomVersions are the room versions that rooms can be created and upgraded
+// to, and how stable each is. Newer versions need a newer gomatrixserverlib,
+// for their event IDs and state resolution; until then upgrading a room
+// to a new room of the same version is still the way to recover it from a
+// state reset.
+var roomVersions = map[string]string{
+	"1": "stable",
+}
+
+// joinRuleVersions are the join rules that were added by room versions that
+// we don't support yet, and the first version with each. Restricted joins,
+// which let the members of a space join a room, need the server joining the
+// user to sign their join with join_authorised_via_users_server, which the
+// v1 auth rules don't check.
+var joinRuleVersions = map[string]string{
+	"knock":            "7",
+	"restricted":       "8",
+	"knock_restricted": "10",
+}
+
+// upgradeStateTypes are the types of the state events, with an empty state
+// key, that are copied from a room to the one that replaces it. Power levels
+// are copied separately, as they may need raising while the room is made.
+var upgradeStateTypes = []string{
+	"m.room.join_rules",
+	"m.room.history_visibility",
+	"m.room.guest_access",
+	"m.room.name",
+	"m.room.topic",
+	"m.room.avatar",
+	"m.room.encryption",
+	"m.room.canonical_alias",
+	ServerACLEventType,
+}
+
+// Bans are copied too, and the member event of the user upgrading the room
+// is needed to check that they are in it.
+const selectUpgradeStateSQL = "" +
+	"SELECT event_json FROM syncapi_current_room_state WHERE room_id = $1 AND (" +
+	"(state_key = '' AND type = ANY($2)) OR" +
+	" (type = 'm.room.member' AND (membership = 'ban' OR state_key = $3)))"
+
+// tombstoneContent is the content of an m.room.tombstone event.
+type tombstoneContent struct {
+	Body            string `json:"body"`
+	ReplacementRoom string `json:"replacement_room"`
+}
+
+// roomUpgrades upgrades rooms, by making a new room with the same state and
+// closing the old one with a tombstone that points clients at the new one,
+// which carries on from it. Local aliases are moved to the new room, and it
+// takes over the old room's place in the room directory.
+type roomUpgrades struct {
+	syncDB    *sql.DB
+	directory *postgres.PublicRoomsServerDatabase
+	cfg       *config.Dendrite
+	authData  auth.Data
+	query     api.RoomserverQueryAPI
+	alias     api.RoomserverAliasAPI
+	producer  *producers.RoomserverProducer
+}
+
+func newRoomUpgrades(
+	cfg *config.Dendrite, directory *postgres.PublicRoomsServerDatabase, authData auth.Data,
+	query api.RoomserverQueryAPI, alias api.RoomserverAliasAPI, input api.RoomserverInputAPI,
+) (*roomUpgrades, error) {
+	syncDB, err := sql.Open("postgres", string(cfg.Database.SyncAPI))
+	if err != nil {
+		return nil, err
+	}
+	return &roomUpgrades{
+		syncDB:    syncDB,
+		directory: directory,
+		cfg:       cfg,
+		authData:  authData,
+		query:     query,
+		alias:     alias,
+		producer:  producers.NewRoomserverProducer(input),
+	}, nil
+}
+
+// setup registers the capabilities API, and refuses to create rooms of
+// versions that we don't support rather than silently making them v1, or to
+// knock on rooms.
+func (u *roomUpgrades) setup(mux *http.ServeMux, next http.Handler) {
+	mux.Handle(CapabilitiesClientPath, common.WrapHandlerInCORS(common.MakeAuthAPI(
+		"capabilities", u.authData, u.serveCapabilities,
+	)))
+	mux.Handle(CreateRoomClientPath, common.WrapHandlerInCORS(u.wrapCreateRoom(next)))
+	for _, prefix := range KnockClientPathPrefixes {
+		mux.Handle(prefix, common.WrapHandlerInCORS(common.MakeAuthAPI("knock", u.authData, u.serveKnock)))
+	}
+}
+
+// serveKnock refuses to knock, which needs room version 7: the auth rules
+// of the versions that we support have neither the knock membership nor
+// join rule, so the room server would reject the knock event. Clients are
+// told why, rather than that the API doesn't exist.
+func (u *roomUpgrades) serveKnock(req *http.Request, _ *authtypes.Device) util.JSONResponse {
+	if req.Method != http.MethodPost {
+		return util.JSONResponse{
+			Code: http.StatusMethodNotAllowed,
+			JSON: jsonerror.NotFound("Bad method"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: jsonerror.MatrixError{
+			ErrCode: "M_UNSUPPORTED_ROOM_VERSION",
+			Err:     "Knocking needs room version 7, which this server doesn't support",
+		},
+	}
+}
+
+func (u *roomUpgrades) serveCapabilities(req *http.Request, _ *authtypes.Device) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"m.change_password": map[string]bool{"enabled": true},
+				"m.room_versions": map[string]interface{}{
+					"default":   DefaultRoomVersion,
+					"available": roomVersions,
+				},
+			},
+		},
+	}
+}
+
+func (u *roomUpgrades) wrapCreateRoom(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			next.ServeHTTP(w, req)
+			return
+		}
+		body, ok := peekBody(w, req)
+		if !ok {
+			return
+		}
+		var r struct {
+			RoomVersion  string `json:"room_version"`
+			InitialState []struct {
+				Type    string          `json:"type"`
+				Content json.RawMessage `json:"content"`
+			} `json:"initial_state"`
+		}
+		// Anything else wrong with the request is for the client API to say.
+		if json.Unmarshal(body, &r) == nil {
+			res := checkRoomVersion(r.RoomVersion)
+			for _, ev := range r.InitialState {
+				if res == nil && ev.Type == gomatrixserverlib.MRoomJoinRules {
+					res = checkJoinRule(ev.Content)
+				}
+			}
+			if res != nil {
+				respondJSON(w, *res)
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// peekBody reads the body of a request, leaving it to be read again. It
+// responds with an error if the body is too large.
+func peekBody(w http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, authMaxRequestSize))
+	if err != nil {
+		respondJSON(w, util.JSONResponse{
+			Code: http.StatusRequestEntityTooLarge,
+			JSON: jsonerror.BadJSON("The request body is too large"),
+		})
+		return nil, false
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+func checkRoomVersion(version string) *util.JSONResponse {
+	if _, ok := roomVersions[version]; ok || version == "" {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: jsonerror.MatrixError{
+			ErrCode: "M_UNSUPPORTED_ROOM_VERSION",
+			Err:     fmt.Sprintf("This server doesn't support room version %q", version),
+		},
+	}
+}
+
+// checkJoinRule refuses the join rules that the room versions that we
+// support don't have, which would otherwise make a room invite only.
+func checkJoinRule(content []byte) *util.JSONResponse {
+	var c gomatrixserverlib.JoinRuleContent
+	if json.Unmarshal(content, &c) != nil {
+		return nil
+	}
+	version, ok := joinRuleVersions[c.JoinRule]
+	if !ok {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: jsonerror.MatrixError{
+			ErrCode: "M_UNSUPPORTED_ROOM_VERSION",
+			Err:     fmt.Sprintf("The %s join rule needs room version %s, which this server doesn't support", c.JoinRule, version),
+		},
+	}
+}
+
+// wrapRooms serves /rooms/{roomID}/upgrade, refuses to set join rules that
+// the room's version doesn't have, and passes the rest of the rooms API on.
+func (u *roomUpgrades) wrapRooms(next http.Handler) http.Handler {
+	upgradeAPI := common.MakeAuthAPI("rooms_upgrade", u.authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		if req.Method != http.MethodPost {
+			return util.JSONResponse{
+				Code: http.StatusMethodNotAllowed,
+				JSON: jsonerror.NotFound("Bad method"),
+			}
+		}
+		parts, err := roomPathParts(req)
+		if err != nil {
+			return util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.InvalidArgumentValue(err.Error())}
+		}
+		return u.upgrade(req, device, parts[0])
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(req.URL.EscapedPath(), RoomsClientPathPrefix), "/")
+		switch {
+		case len(parts) == 2 && parts[1] == "upgrade":
+			upgradeAPI.ServeHTTP(w, req)
+			return
+		case req.Method == http.MethodPut && len(parts) >= 3 && len(parts) <= 4 &&
+			parts[1] == "state" && parts[2] == gomatrixserverlib.MRoomJoinRules:
+			body, ok := peekBody(w, req)
+			if !ok {
+				return
+			}
+			if res := checkJoinRule(body); res != nil {
+				respondJSON(w, *res)
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// upgrade replaces a room with a new one of the given version. The user
+// must be allowed to send a tombstone to the room.
+func (u *roomUpgrades) upgrade(req *http.Request, device *authtypes.Device, roomID string) util.JSONResponse {
+	var body struct {
+		NewVersion string `json:"new_version"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if body.NewVersion == "" {
+		return util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.MissingArgument("new_version is required")}
+	}
+	if res := checkRoomVersion(body.NewVersion); res != nil {
+		return *res
+	}
+	ctx := req.Context()
+	userID := device.UserID
+	state, err := u.state(ctx, roomID, userID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	var create, powerLevels, member *gomatrixserverlib.Event
+	var copied, bans []*gomatrixserverlib.Event
+	for _, ev := range state {
+		switch {
+		case ev.Type() == gomatrixserverlib.MRoomCreate:
+			create = ev
+		case ev.Type() == gomatrixserverlib.MRoomPowerLevels:
+			powerLevels = ev
+		case ev.Type() == gomatrixserverlib.MRoomMember && *ev.StateKey() == userID:
+			member = ev
+			if membership, _ := ev.Membership(); membership == gomatrixserverlib.Ban {
+				bans = append(bans, ev)
+			}
+		case ev.Type() == gomatrixserverlib.MRoomMember:
+			bans = append(bans, ev)
+		default:
+			copied = append(copied, ev)
+		}
+	}
+	if create == nil || member == nil || !isJoin(member) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't in the room"),
+		}
+	}
+	var plContent gomatrixserverlib.PowerLevelContent
+	if powerLevels != nil {
+		if err = json.Unmarshal(powerLevels.Content(), &plContent); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+	} else {
+		plContent = common.InitialPowerLevelsContent(create.Sender())
+	}
+
+	// The tombstone is made first, both to check that the user may upgrade
+	// the room and so that the new room can say which event it follows.
+	newRoomID := fmt.Sprintf("!%s:%s", util.RandomString(16), u.cfg.Matrix.ServerName)
+	tombstoneBuilder := gomatrixserverlib.EventBuilder{
+		Sender:   userID,
+		RoomID:   roomID,
+		Type:     TombstoneEventType,
+		StateKey: new(string),
+	}
+	err = tombstoneBuilder.SetContent(tombstoneContent{
+		Body:            "This room has been replaced",
+		ReplacementRoom: newRoomID,
+	})
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	tombstone, err := common.BuildEvent(ctx, &tombstoneBuilder, *u.cfg, time.Now(), u.query, nil)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	authEvents := gomatrixserverlib.NewAuthEvents(state)
+	if err = gomatrixserverlib.Allowed(*tombstone, &authEvents); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't allowed to upgrade the room"),
+		}
+	}
+
+	events, err := u.replacement(roomID, newRoomID, body.NewVersion, tombstone.EventID(), userID, create, member, plContent, copied, bans)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if _, err = u.producer.SendEvents(ctx, events, u.cfg.Matrix.ServerName, nil); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if _, err = u.producer.SendEvents(ctx, []gomatrixserverlib.Event{*tombstone}, u.cfg.Matrix.ServerName, nil); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	logger := util.GetLogger(ctx).WithFields(logrus.Fields{"room_id": roomID, "replacement_room": newRoomID})
+	logger.Info("Upgraded room")
+
+	// The rest is best effort, as the room has been upgraded either way.
+	if err = u.restrict(ctx, roomID, userID, plContent); err != nil {
+		logger.WithError(err).Warn("Failed to restrict the power levels of the old room")
+	}
+	if err = u.moveAliases(ctx, roomID, newRoomID, userID); err != nil {
+		logger.WithError(err).Warn("Failed to move the aliases of the old room")
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]string{"replacement_room": newRoomID},
+	}
+}
+
+// state returns the state of a room that an upgrade needs.
+func (u *roomUpgrades) state(ctx context.Context, roomID, userID string) ([]*gomatrixserverlib.Event, error) {
+	types := append([]string{gomatrixserverlib.MRoomCreate, gomatrixserverlib.MRoomPowerLevels}, upgradeStateTypes...)
+	rows, err := u.syncDB.QueryContext(ctx, selectUpgradeStateSQL, roomID, pq.StringArray(types), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	var state []*gomatrixserverlib.Event
+	for rows.Next() {
+		var eventJSON []byte
+		if err = rows.Scan(&eventJSON); err != nil {
+			return nil, err
+		}
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false)
+		if err != nil {
+			return nil, err
+		}
+		state = append(state, &ev)
+	}
+	return state, rows.Err()
+}
+
+// isJoin returns whether a member event is of a user joining the room.
+func isJoin(member *gomatrixserverlib.Event) bool {
+	membership, err := member.Membership()
+	return err == nil && membership == gomatrixserverlib.Join
+}
+
+// replacement makes the events that start the room that replaces another.
+// The user is given the highest power level in the room until the state
+// has been copied, then the old power levels are restored.
+func (u *roomUpgrades) replacement(
+	oldRoomID, roomID, version, tombstoneID, userID string, oldCreate, oldMember *gomatrixserverlib.Event,
+	plContent gomatrixserverlib.PowerLevelContent, copied, bans []*gomatrixserverlib.Event,
+) ([]gomatrixserverlib.Event, error) {
+	var createContent map[string]interface{}
+	if err := json.Unmarshal(oldCreate.Content(), &createContent); err != nil {
+		return nil, err
+	}
+	newCreateContent := map[string]interface{}{
+		"creator":      userID,
+		"room_version": version,
+		"predecessor":  map[string]string{"room_id": oldRoomID, "event_id": tombstoneID},
+	}
+	if federate, ok := createContent["m.federate"]; ok {
+		newCreateContent["m.federate"] = federate
+	}
+	var memberContent map[string]interface{}
+	if err := json.Unmarshal(oldMember.Content(), &memberContent); err != nil {
+		return nil, err
+	}
+	newMemberContent := map[string]interface{}{"membership": gomatrixserverlib.Join}
+	for _, key := range []string{"displayname", "avatar_url"} {
+		if value, ok := memberContent[key]; ok {
+			newMemberContent[key] = value
+		}
+	}
+	raised := plContent
+	raised.Users = make(map[string]int64, len(plContent.Users)+1)
+	for user, level := range plContent.Users {
+		raised.Users[user] = level
+	}
+	raised.Users[userID] = highestPowerLevel(&plContent)
+
+	type fledglingEvent struct {
+		eventType string
+		stateKey  string
+		content   interface{}
+	}
+	fledglings := []fledglingEvent{
+		{gomatrixserverlib.MRoomCreate, "", newCreateContent},
+		{gomatrixserverlib.MRoomMember, userID, newMemberContent},
+		{gomatrixserverlib.MRoomPowerLevels, "", raised},
+	}
+	for _, ev := range copied {
+		fledglings = append(fledglings, fledglingEvent{ev.Type(), "", json.RawMessage(ev.Content())})
+	}
+	for _, ev := range bans {
+		fledglings = append(fledglings, fledglingEvent{
+			gomatrixserverlib.MRoomMember, *ev.StateKey(), map[string]string{"membership": gomatrixserverlib.Ban},
+		})
+	}
+	if raised.Users[userID] != plContent.UserLevel(userID) {
+		fledglings = append(fledglings, fledglingEvent{gomatrixserverlib.MRoomPowerLevels, "", plContent})
+	}
+
+	now := time.Now()
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	events := make([]gomatrixserverlib.Event, 0, len(fledglings))
+	for i, f := range fledglings {
+		stateKey := f.stateKey
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   userID,
+			RoomID:   roomID,
+			Type:     f.eventType,
+			StateKey: &stateKey,
+			Depth:    int64(i + 1),
+		}
+		if err := builder.SetContent(f.content); err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			builder.PrevEvents = []gomatrixserverlib.EventReference{events[i-1].EventReference()}
+		}
+		needed, err := gomatrixserverlib.StateNeededForEventBuilder(&builder)
+		if err != nil {
+			return nil, err
+		}
+		if builder.AuthEvents, err = needed.AuthEventReferences(&authEvents); err != nil {
+			return nil, err
+		}
+		eventID := fmt.Sprintf("$%s:%s", util.RandomString(16), u.cfg.Matrix.ServerName)
+		ev, err := builder.Build(eventID, now, u.cfg.Matrix.ServerName, u.cfg.Matrix.KeyID, u.cfg.Matrix.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		if err = gomatrixserverlib.Allowed(ev, &authEvents); err != nil {
+			return nil, fmt.Errorf("%s event of the new room isn't allowed: %s", f.eventType, err)
+		}
+		if err = authEvents.AddEvent(&ev); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// highestPowerLevel returns the highest power level that anything in a room
+// needs, or that anyone in it has.
+func highestPowerLevel(c *gomatrixserverlib.PowerLevelContent) int64 {
+	highest := int64(100)
+	for _, level := range []int64{c.Ban, c.Invite, c.Kick, c.Redact, c.UsersDefault, c.EventsDefault, c.StateDefault} {
+		if level > highest {
+			highest = level
+		}
+	}
+	for _, levels := range []map[string]int64{c.Users, c.Events} {
+		for _, level := range levels {
+			if level > highest {
+				highest = level
+			}
+		}
+	}
+	return highest
+}
+
+// restrict stops the users of a room that has been upgraded from talking in
+// it or inviting anyone to it, so that they move to the new room.
+func (u *roomUpgrades) restrict(ctx context.Context, roomID, userID string, plContent gomatrixserverlib.PowerLevelContent) error {
+	level := plContent.UsersDefault + 1
+	if level < 50 {
+		level = 50
+	}
+	if plContent.EventsDefault >= level && plContent.Invite >= level {
+		return nil
+	}
+	if plContent.EventsDefault < level {
+		plContent.EventsDefault = level
+	}
+	if plContent.Invite < level {
+		plContent.Invite = level
+	}
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   userID,
+		RoomID:   roomID,
+		Type:     gomatrixserverlib.MRoomPowerLevels,
+		StateKey: new(string),
+	}
+	if err := builder.SetContent(plContent); err != nil {
+		return err
+	}
+	ev, err := common.BuildEvent(ctx, &builder, *u.cfg, time.Now(), u.query, nil)
+	if err != nil {
+		return err
+	}
+	_, err = u.producer.SendEvents(ctx, []gomatrixserverlib.Event{*ev}, u.cfg.Matrix.ServerName, nil)
+	return err
+}
+
+// moveAliases points our aliases for a room at the room that replaced it.
+func (u *roomUpgrades) moveAliases(ctx context.Context, oldRoomID, roomID, userID string) error {
+	var res api.GetAliasesForRoomIDResponse
+	if err := u.alias.GetAliasesForRoomID(ctx, &api.GetAliasesForRoomIDRequest{RoomID: oldRoomID}, &res); err != nil {
+		return err
+	}
+	for _, alias := range res.Aliases {
+		err := u.alias.RemoveRoomAlias(ctx, &api.RemoveRoomAliasRequest{UserID: userID, Alias: alias}, &api.RemoveRoomAliasResponse{})
+		if err != nil {
+			return err
+		}
+		var setRes api.SetRoomAliasResponse
+		err = u.alias.SetRoomAlias(ctx, &api.SetRoomAliasRequest{UserID: userID, Alias: alias, RoomID: roomID}, &setRes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start consumes the room server output log, taking rooms that have been
+// upgraded out of the room directory.
+func (u *roomUpgrades) start(consumer sarama.Consumer, topic string) error {
+	c := common.ContinualConsumer{
+		Topic:          topic,
+		Consumer:       consumer,
+		PartitionStore: &memoryPartitionStore{},
+		ProcessMessage: u.onMessage,
+	}
+	return c.Start()
+}
+
+func (u *roomUpgrades) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		logrus.WithError(err).Error("Room upgrades: message parse failure")
+		return nil
+	}
+	if output.Type != api.OutputTypeNewRoomEvent {
+		return nil
+	}
+	ev := output.NewRoomEvent.Event
+	if ev.Type() != TombstoneEventType || ev.StateKey() == nil || *ev.StateKey() != "" {
+		return nil
+	}
+	var content tombstoneContent
+	if err := json.Unmarshal(ev.Content(), &content); err != nil {
+		return nil
+	}
+	if err := u.transferListing(context.Background(), &ev, content.ReplacementRoom); err != nil {
+		logrus.WithError(err).WithField("room_id", ev.RoomID()).Warn("Failed to take upgraded room out of the room directory")
+	}
+	return nil
+}
+
+// transferListing takes a room that has been upgraded out of the room
+// directory. The room that replaced it is listed instead if it was our own
+// user who upgraded it, as otherwise its directory is their server's.
+func (u *roomUpgrades) transferListing(ctx context.Context, tombstone *gomatrixserverlib.Event, roomID string) error {
+	visible, err := u.directory.GetRoomVisibility(ctx, tombstone.RoomID())
+	if err == sql.ErrNoRows || (err == nil && !visible) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = u.directory.SetRoomVisibility(ctx, false, tombstone.RoomID()); err != nil {
+		return err
+	}
+	if _, domain, err := gomatrixserverlib.SplitID('@', tombstone.Sender()); err != nil || domain != u.cfg.Matrix.ServerName {
+		return nil
+	}
+	// The public rooms API adds the new room to the directory as it reads
+	// the same log, which it may not have got to yet.
+	for deadline := time.Now().Add(DirectoryTransferTimeout); ; time.Sleep(time.Second) {
+		if _, err = u.directory.GetRoomVisibility(ctx, roomID); err != sql.ErrNoRows || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return u.directory.SetRoomVisibility(ctx, true, roomID)
+}
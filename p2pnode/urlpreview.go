@@ -0,0 +1,564 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	// The formats that the sizes of preview images can be read from.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/util"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+	"golang.org/x/net/proxy"
+)
+
+// URLPreviewPath is the media API that clients get previews of links from.
+const URLPreviewPath = "/_matrix/media/r0/preview_url"
+
+// URLPreviewProtocol is the libp2p protocol that nodes ask a relay peer for
+// previews on, so that the websites that they link to see the relay's
+// address rather than theirs. Each stream carries one JSON request, and one
+// JSON response that is followed by the preview image, if there is one.
+const URLPreviewProtocol = "/matrix/url_preview"
+
+// URLPreviewCacheTime is how long a preview is kept for, so that everyone
+// in a room doesn't fetch the same page when a link is sent.
+const URLPreviewCacheTime = time.Hour
+
+// URLPreviewTimeout is how long making a preview may take, including
+// fetching its image.
+const URLPreviewTimeout = time.Second * 20
+
+// URLPreviewMaxPageSize is the most of a page that is read for its preview.
+const URLPreviewMaxPageSize = 1 << 20
+
+// urlPreviewMaxHeaderSize is the most that is read of a URL preview request,
+// or of the response before the image.
+const urlPreviewMaxHeaderSize = 64 << 10
+
+// urlPreviewMaxValueLength is the most characters that are kept of each
+// property of a page.
+const urlPreviewMaxValueLength = 500
+
+// urlPreviewUserAgent is who we say we are to the websites that we preview.
+const urlPreviewUserAgent = "Mozilla/5.0 (compatible; Dendrite P2P URL preview)"
+
+// urlPage is what a preview is made from: the Open Graph properties of a
+// page, and the image that they point to, if there is one. An image that is
+// linked to directly is its own preview.
+type urlPage struct {
+	OG        map[string]string `json:"og"`
+	ImageType string            `json:"image_type,omitempty"`
+	ImageSize int64             `json:"image_size,omitempty"`
+	image     []byte
+}
+
+// urlPreviewRequest asks a relay peer for a preview of a URL.
+type urlPreviewRequest struct {
+	URL string `json:"url"`
+}
+
+// urlPreviewResponse comes before the image of the preview, if there is
+// one. The error code is empty if the page is there.
+type urlPreviewResponse struct {
+	jsonerror.MatrixError
+	Page *urlPage `json:"page,omitempty"`
+}
+
+// urlPreviewEntry is a preview, as last made.
+type urlPreviewEntry struct {
+	preview map[string]interface{}
+	at      time.Time
+}
+
+// urlPreviews makes previews of the links that users send, from the Open
+// Graph properties of each page, which is as Synapse does it. Previews are
+// fetched from the website by the node, or, so that the website doesn't
+// learn the node's address, by a trusted relay peer. The image of a preview
+// is stored as media uploaded by the user who asked for it.
+type urlPreviews struct {
+	cfg      *config.Dendrite
+	host     host.Host
+	resolver *resolverTransport
+	mediaDB  storage.Database
+	// thumbnails makes the thumbnails of preview images.
+	thumbnails *mediaThumbnails
+	// enabled is whether our users can get previews. We may fetch them for
+	// other nodes either way.
+	enabled bool
+	// client fetches the pages and images that we preview, never from
+	// private addresses.
+	client *http.Client
+	// relay is the peer that fetches previews for us, if any.
+	relay peer.ID
+	// clients are the nodes that we fetch previews for.
+	clients map[peer.ID]struct{}
+
+	mu    sync.Mutex
+	cache map[string]urlPreviewEntry
+}
+
+func newURLPreviews(
+	cfg *Config, p2pHost host.Host, resolver *resolverTransport, mediaDB storage.Database, thumbnails *mediaThumbnails,
+) (*urlPreviews, error) {
+	clients, err := peerSet(cfg.URLPreviewClients)
+	if err != nil {
+		return nil, err
+	}
+	var relay peer.ID
+	if cfg.URLPreviewPeer != "" {
+		if relay, err = peer.IDB58Decode(cfg.URLPreviewPeer); err != nil {
+			return nil, err
+		}
+	}
+	dialer := &net.Dialer{Timeout: URLPreviewTimeout, Control: refusePrivateAddrs}
+	transport := &http.Transport{DialContext: dialer.DialContext}
+	if cfg.TorSOCKSAddr != "" {
+		// Pages are fetched through Tor as well, like everything else.
+		// Tor itself won't connect to private addresses.
+		socks, err := proxy.SOCKS5("tcp", cfg.TorSOCKSAddr, nil, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		transport = &http.Transport{Dial: socks.Dial}
+	}
+	return &urlPreviews{
+		cfg:        &cfg.Dendrite,
+		host:       p2pHost,
+		resolver:   resolver,
+		mediaDB:    mediaDB,
+		thumbnails: thumbnails,
+		enabled:    cfg.URLPreviews,
+		client:     &http.Client{Transport: transport, Timeout: URLPreviewTimeout},
+		relay:      relay,
+		clients:    clients,
+		cache:      make(map[string]urlPreviewEntry),
+	}, nil
+}
+
+// refusePrivateAddrs stops previews from being fetched from loopback,
+// private or unroutable addresses, so that users can't have the node
+// fetch pages from its own network and show them the result.
+func refusePrivateAddrs(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	var addr ma.Multiaddr
+	if ip := net.ParseIP(host); ip != nil {
+		addr, err = manet.FromIP(ip)
+	}
+	if addr == nil || err != nil || !manet.IsPublicAddr(addr) {
+		return fmt.Errorf("refusing to fetch a preview from %s", host)
+	}
+	return nil
+}
+
+// setup registers the preview API if previews are enabled, and handles the
+// URL preview protocol if we fetch previews for other nodes.
+func (p *urlPreviews) setup(mux *http.ServeMux, authData auth.Data) {
+	if len(p.clients) > 0 {
+		p.host.SetStreamHandler(URLPreviewProtocol, p.handleStream)
+	}
+	if !p.enabled {
+		return
+	}
+	mux.Handle(URLPreviewPath, common.WrapHandlerInCORS(common.MakeAuthAPI("preview_url", authData,
+		func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			rawURL := req.URL.Query().Get("url")
+			if rawURL == "" {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.MissingArgument("Missing url"),
+				}
+			}
+			preview, err := p.preview(req.Context(), rawURL, device.UserID)
+			if err == errUnpreviewable {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue(err.Error()),
+				}
+			} else if err != nil {
+				util.GetLogger(req.Context()).WithError(err).WithField("url", rawURL).Debug("Failed to preview URL")
+				return util.JSONResponse{
+					Code: http.StatusBadGateway,
+					JSON: jsonerror.Unknown("Failed to fetch a preview of the URL"),
+				}
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: preview}
+		},
+	)))
+}
+
+// errUnpreviewable is returned for URLs that we can't make a preview of.
+var errUnpreviewable = errors.New("only http and https URLs can be previewed")
+
+// preview returns the preview of a URL, from the cache if it was made
+// lately.
+func (p *urlPreviews) preview(ctx context.Context, rawURL, userID string) (map[string]interface{}, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errUnpreviewable
+	}
+	u.Fragment = ""
+	key := u.String()
+	p.mu.Lock()
+	cached, ok := p.cache[key]
+	p.mu.Unlock()
+	if ok && time.Since(cached.at) < URLPreviewCacheTime {
+		return cached.preview, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, URLPreviewTimeout)
+	defer cancel()
+	var page *urlPage
+	if p.relay != "" {
+		page, err = p.ask(ctx, key)
+	} else {
+		page, err = p.fetch(ctx, u)
+	}
+	if err != nil {
+		return nil, err
+	}
+	preview := make(map[string]interface{}, len(page.OG)+4)
+	for property, value := range page.OG {
+		preview[property] = value
+	}
+	// The image is only in the preview as our own media, never as the URL
+	// that it came from.
+	delete(preview, "og:image")
+	if len(page.image) > 0 {
+		contentURI, err := p.storeImage(ctx, page, userID)
+		if err != nil {
+			return nil, err
+		}
+		preview["og:image"] = contentURI
+		preview["og:image:type"] = page.ImageType
+		preview["matrix:image:size"] = len(page.image)
+		if config, _, err := image.DecodeConfig(bytes.NewReader(page.image)); err == nil {
+			preview["og:image:width"] = config.Width
+			preview["og:image:height"] = config.Height
+		}
+	}
+
+	p.mu.Lock()
+	for old, entry := range p.cache {
+		if time.Since(entry.at) >= URLPreviewCacheTime {
+			delete(p.cache, old)
+		}
+	}
+	p.cache[key] = urlPreviewEntry{preview: preview, at: time.Now()}
+	p.mu.Unlock()
+	return preview, nil
+}
+
+// fetch fetches a page itself, and the image of its preview.
+func (p *urlPreviews) fetch(ctx context.Context, u *url.URL) (*urlPage, error) {
+	res, err := p.get(ctx, u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	contentType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	page := &urlPage{OG: map[string]string{}}
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		if page.image, err = p.readImage(res.Body); err != nil {
+			return nil, err
+		}
+		page.ImageType = contentType
+	case contentType == "text/html" || contentType == "application/xhtml+xml":
+		page.OG = parseOpenGraph(io.LimitReader(res.Body, URLPreviewMaxPageSize), res.Request.URL)
+		if imageURL := page.OG["og:image"]; imageURL != "" {
+			// A preview without its image is better than none at all.
+			if page.ImageType, page.image, err = p.fetchImage(ctx, imageURL); err != nil {
+				logrus.WithError(err).WithField("url", imageURL).Debug("Failed to fetch preview image")
+			}
+		}
+	default:
+		return nil, fmt.Errorf("can't preview %q content", contentType)
+	}
+	page.ImageSize = int64(len(page.image))
+	return page, nil
+}
+
+func (p *urlPreviews) get(ctx context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", urlPreviewUserAgent)
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close() // nolint: errcheck
+		return nil, fmt.Errorf("%s returned %s", rawURL, res.Status)
+	}
+	return res, nil
+}
+
+func (p *urlPreviews) fetchImage(ctx context.Context, rawURL string) (string, []byte, error) {
+	res, err := p.get(ctx, rawURL)
+	if err != nil {
+		return "", nil, err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	contentType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if !strings.HasPrefix(contentType, "image/") {
+		return "", nil, fmt.Errorf("the image is %q content", contentType)
+	}
+	data, err := p.readImage(res.Body)
+	return contentType, data, err
+}
+
+// readImage reads an image, as long as it isn't bigger than the media API
+// allows.
+func (p *urlPreviews) readImage(r io.Reader) ([]byte, error) {
+	maxSize := int64(*p.cfg.Media.MaxFileSizeBytes)
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("the image is larger than the %d bytes allowed", maxSize)
+	}
+	return data, nil
+}
+
+// parseOpenGraph returns the Open Graph properties in the head of a page.
+// The title and description of the page fill in for those that are missing.
+func parseOpenGraph(body io.Reader, pageURL *url.URL) map[string]string {
+	og := map[string]string{}
+	var title, description string
+	inTitle := false
+	z := html.NewTokenizer(body)
+loop:
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			break loop
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			switch tok.Data {
+			case "title":
+				inTitle = tt == html.StartTagToken
+			case "meta":
+				var property, name, content string
+				for _, attr := range tok.Attr {
+					switch attr.Key {
+					case "property":
+						property = attr.Val
+					case "name":
+						name = attr.Val
+					case "content":
+						content = attr.Val
+					}
+				}
+				if property == "" && strings.HasPrefix(name, "og:") {
+					property = name
+				}
+				if _, ok := og[property]; !ok && strings.HasPrefix(property, "og:") && content != "" {
+					og[property] = truncateValue(content)
+				}
+				if name == "description" && description == "" {
+					description = truncateValue(content)
+				}
+			case "body":
+				break loop
+			}
+		case html.TextToken:
+			if inTitle && title == "" {
+				title = truncateValue(strings.TrimSpace(string(z.Text())))
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			if string(name) == "head" {
+				break loop
+			}
+			inTitle = false
+		}
+	}
+	if _, ok := og["og:title"]; !ok && title != "" {
+		og["og:title"] = title
+	}
+	if _, ok := og["og:description"]; !ok && description != "" {
+		og["og:description"] = description
+	}
+	if imageURL, ok := og["og:image"]; ok {
+		if u, err := pageURL.Parse(imageURL); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			og["og:image"] = u.String()
+		} else {
+			delete(og, "og:image")
+		}
+	}
+	return og
+}
+
+func truncateValue(value string) string {
+	if utf8.RuneCountInString(value) <= urlPreviewMaxValueLength {
+		return value
+	}
+	return string([]rune(value)[:urlPreviewMaxValueLength]) + "…"
+}
+
+// storeImage stores the image of a preview as media uploaded by the user,
+// in the same way as the media API does uploads, returning its content URI.
+func (p *urlPreviews) storeImage(ctx context.Context, page *urlPage, userID string) (string, error) {
+	logger := util.GetLogger(ctx)
+	hash, size, tmpDir, err := fileutils.WriteTempFile(
+		bytes.NewReader(page.image), *p.cfg.Media.MaxFileSizeBytes, p.cfg.Media.AbsBasePath,
+	)
+	if err != nil {
+		fileutils.RemoveDir(tmpDir, logger)
+		return "", err
+	}
+	metadata := &types.MediaMetadata{
+		MediaID:           types.MediaID(hash),
+		Origin:            p.cfg.Matrix.ServerName,
+		ContentType:       types.ContentType(page.ImageType),
+		FileSizeBytes:     size,
+		CreationTimestamp: types.UnixMs(time.Now().UnixNano() / int64(time.Millisecond)),
+		Base64Hash:        hash,
+		UserID:            types.MatrixUserID(userID),
+	}
+	contentURI := fmt.Sprintf("mxc://%s/%s", metadata.Origin, metadata.MediaID)
+	existing, err := p.mediaDB.GetMediaMetadata(ctx, metadata.MediaID, metadata.Origin)
+	if err != nil || existing != nil {
+		fileutils.RemoveDir(tmpDir, logger)
+		return contentURI, err
+	}
+	if _, _, err = fileutils.MoveFileWithHashCheck(tmpDir, metadata, p.cfg.Media.AbsBasePath, logger); err != nil {
+		return "", err
+	}
+	if err = p.mediaDB.StoreMediaMetadata(ctx, metadata); err != nil {
+		return "", err
+	}
+	p.thumbnails.generate(metadata)
+	return contentURI, nil
+}
+
+// ask asks our relay peer for a page and the image of its preview,
+// connecting to the relay first if need be.
+func (p *urlPreviews) ask(ctx context.Context, rawURL string) (*urlPage, error) {
+	if err := p.resolver.resolve(ctx, p.relay); err != nil {
+		return nil, err
+	}
+	s, err := p.host.NewStream(ctx, p.relay, URLPreviewProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Reset() // nolint: errcheck
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+	if err = json.NewEncoder(s).Encode(&urlPreviewRequest{URL: rawURL}); err != nil {
+		return nil, err
+	}
+	// Closing only closes our end, so that the peer knows that we're done.
+	if err = s.Close(); err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(io.LimitReader(s, urlPreviewMaxHeaderSize))
+	var res urlPreviewResponse
+	if err = dec.Decode(&res); err != nil {
+		return nil, err
+	}
+	if res.ErrCode != "" {
+		return nil, &res.MatrixError
+	}
+	if res.Page == nil {
+		return nil, errors.New("the relay sent no page")
+	}
+	if res.Page.OG == nil {
+		res.Page.OG = map[string]string{}
+	}
+	if res.Page.ImageSize > 0 {
+		// The decoder may have read some of the image along with the
+		// response.
+		body := io.MultiReader(dec.Buffered(), io.LimitReader(s, res.Page.ImageSize))
+		if res.Page.image, err = p.readImage(body); err != nil {
+			return nil, err
+		}
+		if int64(len(res.Page.image)) != res.Page.ImageSize {
+			return nil, errors.New("the relay sent a truncated image")
+		}
+	}
+	return res.Page, nil
+}
+
+// handleStream fetches a page, and the image of its preview, for one of the
+// nodes that we relay previews for.
+func (p *urlPreviews) handleStream(s network.Stream) {
+	defer s.Close() // nolint: errcheck
+	_ = s.SetDeadline(time.Now().Add(URLPreviewTimeout))
+	from := s.Conn().RemotePeer()
+	logger := logrus.WithField("peer", from.String())
+	ctx, cancel := context.WithTimeout(context.Background(), URLPreviewTimeout)
+	defer cancel()
+
+	var res urlPreviewResponse
+	var req urlPreviewRequest
+	if _, ok := p.clients[from]; !ok {
+		res.MatrixError = *jsonerror.Forbidden("We don't fetch previews for you")
+	} else if err := json.NewDecoder(io.LimitReader(s, urlPreviewMaxHeaderSize)).Decode(&req); err != nil {
+		res.MatrixError = *jsonerror.BadJSON(err.Error())
+	} else if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		res.MatrixError = *jsonerror.InvalidArgumentValue(errUnpreviewable.Error())
+	} else if res.Page, err = p.fetch(ctx, u); err != nil {
+		logger.WithError(err).WithField("url", req.URL).Debug("Failed to preview URL for peer")
+		res.MatrixError = *jsonerror.Unknown("Failed to fetch a preview of the URL")
+	}
+	if err := json.NewEncoder(s).Encode(&res); err != nil || res.Page == nil {
+		return
+	}
+	if _, err := s.Write(res.Page.image); err != nil {
+		logger.WithError(err).Debug("Failed to send preview image")
+	}
+}
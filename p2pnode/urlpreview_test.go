@@ -0,0 +1,48 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import "testing"
+
+func TestRefusePrivateAddrs(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		ok      bool
+	}{
+		{"public IPv4", "93.184.216.34:443", true},
+		{"public IPv6", "[2606:2800:220:1:248:1893:25c8:1946]:443", true},
+		{"IPv4 loopback", "127.0.0.1:80", false},
+		{"other IPv4 loopback", "127.1.2.3:80", false},
+		{"IPv6 loopback", "[::1]:80", false},
+		{"RFC1918 10/8", "10.0.0.1:80", false},
+		{"RFC1918 172.16/12", "172.16.5.4:80", false},
+		{"RFC1918 192.168/16", "192.168.1.1:80", false},
+		{"IPv4 link-local", "169.254.169.254:80", false},
+		{"IPv6 link-local", "[fe80::1]:80", false},
+		{"IPv6 ULA", "[fd00::1]:80", false},
+		{"unspecified", "0.0.0.0:80", false},
+		{"IPv4-mapped loopback", "[::ffff:127.0.0.1]:80", false},
+		{"hostname", "localhost:80", false},
+		{"no port", "93.184.216.34", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		err := refusePrivateAddrs("tcp", tt.address, nil)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, wanted allowed %v", tt.name, err, tt.ok)
+		}
+	}
+}
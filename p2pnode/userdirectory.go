@@ -0,0 +1,395 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	cid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// UserDirectorySearchPath is the client API for searching for users,
+	// both on this node and on other nodes.
+	UserDirectorySearchPath = "/_matrix/client/r0/user_directory/search"
+	// UserDirectoryFederationPath is where other nodes search our published
+	// users. There is no federation API for this in the spec.
+	UserDirectoryFederationPath = "/_matrix/federation/unstable/org.matrix.dendrite.p2p/user_directory/search"
+)
+
+// UserDirectoryAccountDataType is the type of the global account data that
+// users set to {"publish": true} to be found by users on other nodes. Users
+// are always found by other users on the same node.
+const UserDirectoryAccountDataType = "org.matrix.dendrite.p2p.user_directory"
+
+// UserDirectoryProvideInterval is how often we announce in the DHT the words
+// in the names of our published users, so that other nodes know to ask us
+// when they search for them.
+const UserDirectoryProvideInterval = time.Minute * 10
+
+// UserDirectorySearchTimeout is how long a search waits for other nodes.
+// Nodes that don't answer in time are left out.
+const UserDirectorySearchTimeout = time.Second * 5
+
+// UserDirectorySearchPeers is the most nodes that are asked for a search,
+// both from those that we are connected to and from those found in the DHT.
+const UserDirectorySearchPeers = 20
+
+// userDirectoryDefaultLimit is the number of results if the client doesn't
+// say, as in the spec.
+const userDirectoryDefaultLimit = 10
+
+// userDirectoryKeyPrefix starts the DHT key for each word, so that they
+// can't be mistaken for anything else in the DHT.
+const userDirectoryKeyPrefix = "/matrix/user_directory/"
+
+const searchUsersSQL = "" +
+	"SELECT p.localpart, p.display_name, p.avatar_url, d.content FROM account_profiles p" +
+	" LEFT JOIN account_data d ON d.localpart = p.localpart AND d.room_id = '' AND d.type = $2" +
+	" WHERE p.localpart ILIKE $1 OR p.display_name ILIKE $1" +
+	" ORDER BY p.localpart"
+
+const selectPublishedUsersSQL = "" +
+	"SELECT p.localpart, p.display_name, p.avatar_url, d.content FROM account_profiles p" +
+	" JOIN account_data d ON d.localpart = p.localpart AND d.room_id = '' AND d.type = $1"
+
+// UserDirectoryResult is a user found by a search.
+type UserDirectoryResult struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// userDirectoryResponse is the response to a search, over both the client
+// and federation APIs.
+type userDirectoryResponse struct {
+	Results []UserDirectoryResult `json:"results"`
+	Limited bool                  `json:"limited"`
+}
+
+// userDirectory searches for users by user ID and display name. It reads the
+// account database itself, as Dendrite has no user directory.
+type userDirectory struct {
+	db         *sql.DB
+	host       host.Host
+	dht        *dht.IpfsDHT
+	federation *gomatrixserverlib.FederationClient
+	cfg        *config.Dendrite
+}
+
+func newUserDirectory(p2pHost host.Host, p2pDHT *dht.IpfsDHT, federation *gomatrixserverlib.FederationClient, cfg *config.Dendrite) (*userDirectory, error) {
+	db, err := sql.Open("postgres", string(cfg.Database.Account))
+	if err != nil {
+		return nil, err
+	}
+	return &userDirectory{
+		db:         db,
+		host:       p2pHost,
+		dht:        p2pDHT,
+		federation: federation,
+		cfg:        cfg,
+	}, nil
+}
+
+// setup registers the client and federation APIs, and starts announcing our
+// published users in the DHT until the context is cancelled.
+func (d *userDirectory) setup(ctx context.Context, mux *http.ServeMux, authData auth.Data, keyRing gomatrixserverlib.KeyRing) {
+	mux.Handle(UserDirectorySearchPath, common.WrapHandlerInCORS(common.MakeAuthAPI("user_directory_search", authData,
+		func(req *http.Request, _ *authtypes.Device) util.JSONResponse {
+			var body struct {
+				SearchTerm string `json:"search_term"`
+				Limit      int    `json:"limit"`
+			}
+			if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+				return *resErr
+			}
+			if body.Limit <= 0 {
+				body.Limit = userDirectoryDefaultLimit
+			}
+			res, err := d.search(req.Context(), body.SearchTerm, body.Limit)
+			if err != nil {
+				return httputil.LogThenError(req, err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: res}
+		},
+	)))
+	mux.Handle(UserDirectoryFederationPath, common.MakeFedAPI("federation_user_directory_search", d.cfg.Matrix.ServerName, keyRing,
+		func(req *http.Request, _ *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+			if limit <= 0 {
+				limit = userDirectoryDefaultLimit
+			}
+			res, err := d.searchLocal(req.Context(), req.URL.Query().Get("search_term"), limit, true)
+			if err != nil {
+				return httputil.LogThenError(req, err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: res}
+		},
+	))
+	go d.provide(ctx)
+}
+
+// search looks for users on this node and on other nodes: those that we are
+// connected to, and those that the DHT says have users with the words of the
+// search term in their names.
+func (d *userDirectory) search(ctx context.Context, term string, limit int) (*userDirectoryResponse, error) {
+	res, err := d.searchLocal(ctx, term, limit, false)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, UserDirectorySearchTimeout)
+	defer cancel()
+
+	peers := d.searchPeers(ctx, term)
+	results := make(chan *userDirectoryResponse, len(peers))
+	for _, id := range peers {
+		go func(id peer.ID) {
+			results <- d.searchRemote(ctx, id, term, limit)
+		}(id)
+	}
+	seen := make(map[string]bool, len(res.Results))
+	for _, result := range res.Results {
+		seen[result.UserID] = true
+	}
+	for range peers {
+		var remote *userDirectoryResponse
+		select {
+		case remote = <-results:
+		case <-ctx.Done():
+			return res, nil
+		}
+		if remote == nil {
+			continue
+		}
+		res.Limited = res.Limited || remote.Limited
+		for _, result := range remote.Results {
+			if seen[result.UserID] {
+				continue
+			}
+			if len(res.Results) == limit {
+				res.Limited = true
+				break
+			}
+			seen[result.UserID] = true
+			res.Results = append(res.Results, result)
+		}
+	}
+	return res, nil
+}
+
+// searchLocal searches the users on this node. If published is set, only the
+// users who have published themselves are searched.
+func (d *userDirectory) searchLocal(ctx context.Context, term string, limit int, published bool) (*userDirectoryResponse, error) {
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(term) + "%"
+	rows, err := d.db.QueryContext(ctx, searchUsersSQL, pattern, UserDirectoryAccountDataType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	res := &userDirectoryResponse{Results: []UserDirectoryResult{}}
+	for rows.Next() {
+		result, isPublished, err := d.scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		if published && !isPublished {
+			continue
+		}
+		if len(res.Results) == limit {
+			res.Limited = true
+			break
+		}
+		res.Results = append(res.Results, result)
+	}
+	return res, rows.Err()
+}
+
+// scanUser reads a row of account_profiles along with the user directory
+// account data of the user.
+func (d *userDirectory) scanUser(rows *sql.Rows) (UserDirectoryResult, bool, error) {
+	var localpart string
+	var displayName, avatarURL, content sql.NullString
+	if err := rows.Scan(&localpart, &displayName, &avatarURL, &content); err != nil {
+		return UserDirectoryResult{}, false, err
+	}
+	var settings struct {
+		Publish bool `json:"publish"`
+	}
+	if content.Valid {
+		_ = json.Unmarshal([]byte(content.String), &settings)
+	}
+	return UserDirectoryResult{
+		UserID:      "@" + localpart + ":" + string(d.cfg.Matrix.ServerName),
+		DisplayName: displayName.String,
+		AvatarURL:   avatarURL.String,
+	}, settings.Publish, nil
+}
+
+// searchPeers returns the nodes to ask for a search.
+func (d *userDirectory) searchPeers(ctx context.Context, term string) []peer.ID {
+	seen := make(map[peer.ID]bool)
+	var peers []peer.ID
+	add := func(id peer.ID) {
+		if id != d.host.ID() && !seen[id] && len(peers) < 2*UserDirectorySearchPeers {
+			seen[id] = true
+			peers = append(peers, id)
+		}
+	}
+	for _, id := range d.host.Network().Peers() {
+		if protos, err := d.host.Peerstore().SupportsProtocols(id, MatrixProtocol); err == nil && len(protos) > 0 {
+			add(id)
+		}
+		if len(peers) == UserDirectorySearchPeers {
+			break
+		}
+	}
+	// The DHT only knows whole words, so look for the longest one in the
+	// search term, which should have the fewest nodes.
+	var longest string
+	for _, word := range nameWords(term) {
+		if len(word) > len(longest) {
+			longest = word
+		}
+	}
+	if longest != "" {
+		findCtx, cancel := context.WithTimeout(ctx, UserDirectorySearchTimeout/2)
+		defer cancel()
+		for info := range d.dht.FindProvidersAsync(findCtx, nameWordKey(longest), UserDirectorySearchPeers) {
+			d.host.Peerstore().AddAddrs(info.ID, info.Addrs, time.Minute)
+			add(info.ID)
+		}
+	}
+	return peers
+}
+
+// searchRemote searches the published users of another node, returning nil
+// if it fails.
+func (d *userDirectory) searchRemote(ctx context.Context, id peer.ID, term string, limit int) *userDirectoryResponse {
+	server := peerServerName(id)
+	query := url.Values{}
+	query.Set("search_term", term)
+	query.Set("limit", strconv.Itoa(limit))
+	fedReq := gomatrixserverlib.NewFederationRequest("GET", server, UserDirectoryFederationPath+"?"+query.Encode())
+	if err := fedReq.Sign(d.cfg.Matrix.ServerName, d.cfg.Matrix.KeyID, d.cfg.Matrix.PrivateKey); err != nil {
+		return nil
+	}
+	req, err := fedReq.HTTPRequest()
+	if err != nil {
+		return nil
+	}
+	var res userDirectoryResponse
+	if err = d.federation.DoRequestAndParseResponse(ctx, req, &res); err != nil {
+		logrus.WithError(err).WithField("peer", id.String()).Debug("Failed to search user directory of peer")
+		return nil
+	}
+	// Nodes can only answer for their own users.
+	results := res.Results[:0]
+	for _, result := range res.Results {
+		if _, domain, err := gomatrixserverlib.SplitID('@', result.UserID); err == nil && domain == server {
+			results = append(results, result)
+		}
+	}
+	res.Results = results
+	return &res
+}
+
+// provide announces in the DHT that we have users with each of the words in
+// the names of our published users, until the context is cancelled.
+func (d *userDirectory) provide(ctx context.Context) {
+	ticker := time.NewTicker(UserDirectoryProvideInterval)
+	defer ticker.Stop()
+	for {
+		words, err := d.publishedWords(ctx)
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to read published users")
+		}
+		for word := range words {
+			provideCtx, cancel := context.WithTimeout(ctx, time.Minute)
+			if err = d.dht.Provide(provideCtx, nameWordKey(word), true); err != nil {
+				logrus.WithError(err).WithField("word", word).Debug("Failed to announce user directory word in the DHT")
+			}
+			cancel()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishedWords returns the words in the localparts and display names of
+// the users who have published themselves.
+func (d *userDirectory) publishedWords(ctx context.Context) (map[string]bool, error) {
+	rows, err := d.db.QueryContext(ctx, selectPublishedUsersSQL, UserDirectoryAccountDataType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	words := make(map[string]bool)
+	for rows.Next() {
+		result, published, err := d.scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		if !published {
+			continue
+		}
+		localpart, _, _ := gomatrixserverlib.SplitID('@', result.UserID)
+		for _, word := range append(nameWords(localpart), nameWords(result.DisplayName)...) {
+			words[word] = true
+		}
+	}
+	return words, rows.Err()
+}
+
+// nameWords splits a name into lower case words, leaving out single letters.
+func nameWords(name string) []string {
+	var words []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len([]rune(word)) > 1 {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// nameWordKey returns the DHT key for a word in the names of users.
+func nameWordKey(word string) cid.Cid {
+	hash, _ := mh.Sum([]byte(userDirectoryKeyPrefix+word), mh.SHA2_256, -1)
+	return cid.NewCidV1(cid.Raw, hash)
+}
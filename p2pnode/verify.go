@@ -0,0 +1,227 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// VerifyMinBatch is the fewest signatures that are worth checking on a
+// goroutine of their own.
+const VerifyMinBatch = 16
+
+// parallelVerifier checks the signatures of JSON messages on every CPU at
+// once, by splitting them up between copies of the key ring. Checking
+// signatures is what takes longest when a node on a low-power device
+// receives a large room's worth of events.
+type parallelVerifier struct {
+	keyRing gomatrixserverlib.KeyRing
+}
+
+// VerifyJSONs implements gomatrixserverlib.JSONVerifier
+func (v parallelVerifier) VerifyJSONs(
+	ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest,
+) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	batches := runtime.NumCPU()
+	if most := len(requests) / VerifyMinBatch; most < batches {
+		batches = most
+	}
+	if batches <= 1 {
+		return v.keyRing.VerifyJSONs(ctx, requests)
+	}
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(requests))
+	errs := make([]error, batches)
+	size := (len(requests) + batches - 1) / batches
+	var wg sync.WaitGroup
+	for i := 0; i < batches; i++ {
+		start, end := i*size, (i+1)*size
+		if end > len(requests) {
+			end = len(requests)
+		}
+		if start >= end {
+			break
+		}
+		wg.Add(1)
+		go func(i, start, end int) {
+			defer wg.Done()
+			batch, err := v.keyRing.VerifyJSONs(ctx, requests[start:end])
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			copy(results[start:end], batch)
+		}(i, start, end)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// federationSend receives the transactions that other servers send us. It
+// takes the place of the federation API's own /send, which does the same
+// but checks the signatures of the events one by one.
+type federationSend struct {
+	serverName gomatrixserverlib.ServerName
+	query      api.RoomserverQueryAPI
+	producer   *producers.RoomserverProducer
+	keyRing    gomatrixserverlib.KeyRing
+	verifier   parallelVerifier
+	federation *gomatrixserverlib.FederationClient
+	acls       *serverACLs
+}
+
+func newFederationSend(
+	serverName gomatrixserverlib.ServerName, query api.RoomserverQueryAPI, input api.RoomserverInputAPI,
+	keyRing gomatrixserverlib.KeyRing, federation *gomatrixserverlib.FederationClient, acls *serverACLs,
+) *federationSend {
+	return &federationSend{
+		serverName: serverName,
+		query:      query,
+		producer:   producers.NewRoomserverProducer(input),
+		keyRing:    keyRing,
+		verifier:   parallelVerifier{keyRing: keyRing},
+		federation: federation,
+		acls:       acls,
+	}
+}
+
+// setup registers the /send endpoint.
+func (f *federationSend) setup(mux *http.ServeMux) {
+	mux.Handle(SendFederationPathPrefix, common.MakeFedAPI(
+		"federation_send", f.serverName, f.keyRing,
+		func(req *http.Request, fedReq *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			if req.Method != http.MethodPut {
+				return util.JSONResponse{
+					Code: http.StatusMethodNotAllowed,
+					JSON: jsonerror.NotFound("Bad method"),
+				}
+			}
+			txnID := strings.TrimPrefix(req.URL.Path, SendFederationPathPrefix)
+			return f.send(req, fedReq, gomatrixserverlib.TransactionID(txnID))
+		},
+	))
+}
+
+func (f *federationSend) send(
+	req *http.Request, fedReq *gomatrixserverlib.FederationRequest, txnID gomatrixserverlib.TransactionID,
+) util.JSONResponse {
+	var t gomatrixserverlib.Transaction
+	if err := json.Unmarshal(fedReq.Content(), &t); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	t.Origin = fedReq.Origin()
+	t.TransactionID = txnID
+	t.Destination = f.serverName
+
+	ctx := req.Context()
+	if err := gomatrixserverlib.VerifyAllEventSignatures(ctx, t.PDUs, f.verifier); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	results := map[string]gomatrixserverlib.PDUResult{}
+	for _, e := range t.PDUs {
+		if !f.acls.allowed(ctx, e.RoomID(), t.Origin) {
+			results[e.EventID()] = gomatrixserverlib.PDUResult{Error: "server is banned from this room"}
+			continue
+		}
+		err := f.processEvent(ctx, t.Origin, e)
+		switch err.(type) {
+		case nil:
+			results[e.EventID()] = gomatrixserverlib.PDUResult{}
+		case unknownRoomError, *gomatrixserverlib.NotAllowed:
+			// The event itself is bad, so we skip it and tell the sender.
+			results[e.EventID()] = gomatrixserverlib.PDUResult{Error: err.Error()}
+		default:
+			// Anything else is a problem on our side, so we give up on the
+			// whole transaction in the hope that the sender will retry.
+			return httputil.LogThenError(req, err)
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: gomatrixserverlib.RespSend{PDUs: results},
+	}
+}
+
+// unknownRoomError is returned for events in rooms that we aren't in.
+type unknownRoomError struct {
+	roomID string
+}
+
+func (e unknownRoomError) Error() string { return fmt.Sprintf("unknown room %q", e.roomID) }
+
+// processEvent passes an event to the roomserver, fetching the state of the
+// room at the event from the origin first if we are missing its previous
+// events.
+func (f *federationSend) processEvent(ctx context.Context, origin gomatrixserverlib.ServerName, e gomatrixserverlib.Event) error {
+	needed := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{e})
+	stateReq := api.QueryStateAfterEventsRequest{
+		RoomID:       e.RoomID(),
+		PrevEventIDs: e.PrevEventIDs(),
+		StateToFetch: needed.Tuples(),
+	}
+	var stateResp api.QueryStateAfterEventsResponse
+	if err := f.query.QueryStateAfterEvents(ctx, &stateReq, &stateResp); err != nil {
+		return err
+	}
+	if !stateResp.RoomExists {
+		return unknownRoomError{e.RoomID()}
+	}
+	if stateResp.PrevEventsExist {
+		_, err := f.producer.SendEvents(ctx, []gomatrixserverlib.Event{e}, api.DoNotSendToOtherServers, nil)
+		return err
+	}
+
+	// There is a gap in our view of the room, so we ask the origin for the
+	// state at the event. Checking the signatures of the state is the most
+	// work of all for a large room.
+	state, err := f.federation.LookupState(ctx, origin, e.RoomID(), e.EventID())
+	if err != nil {
+		return err
+	}
+	if err = state.Check(ctx, f.verifier); err != nil {
+		return err
+	}
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for i := range state.StateEvents {
+		if err = authEvents.AddEvent(&state.StateEvents[i]); err != nil {
+			return err
+		}
+	}
+	if err = gomatrixserverlib.Allowed(e, &authEvents); err != nil {
+		return err
+	}
+	return f.producer.SendEventWithState(ctx, state, e)
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Version is the version of the demo. Releases set it when building with
+// -ldflags "-X github.com/matrix-org/dendrite-p2p-demo/p2pnode.Version=...".
+var Version = "dev"
+
+// VersionPath is where the version information is served.
+const VersionPath = "/_dendrite/version"
+
+const (
+	dendriteModule = "github.com/matrix-org/dendrite"
+	libp2pModule   = "github.com/matrix-org/go-libp2p"
+)
+
+// VersionInfo describes what a node is running, for bug reports.
+type VersionInfo struct {
+	Version    string   `json:"version"`
+	Dendrite   string   `json:"dendrite"`
+	LibP2P     string   `json:"libp2p"`
+	Go         string   `json:"go"`
+	Transports []string `json:"transports"`
+	PeerID     string   `json:"peer_id"`
+}
+
+// Version returns the versions of the demo and the modules that it is built
+// from, along with which libp2p transports the node is using.
+func (n *Node) Version() VersionInfo {
+	info := VersionInfo{
+		Version:    Version,
+		Dendrite:   "unknown",
+		LibP2P:     "unknown",
+		Go:         runtime.Version(),
+		Transports: n.transports,
+		PeerID:     n.Host.ID().String(),
+	}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if info.Version == "dev" && build.Main.Version != "" && build.Main.Version != "(devel)" {
+		info.Version = build.Main.Version
+	}
+	for _, dep := range build.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		switch dep.Path {
+		case dendriteModule:
+			info.Dendrite = dep.Version
+		case libp2pModule:
+			info.LibP2P = dep.Version
+		}
+	}
+	return info
+}
+
+// enabledTransports lists the libp2p transports that createLibP2PHost sets up
+// for the config.
+func enabledTransports(cfg *Config) []string {
+	var transports []string
+	if cfg.TorSOCKSAddr != "" {
+		transports = append(transports, "tor")
+	} else {
+		transports = append(transports, "tcp", "ws")
+	}
+	if cfg.RelayServer {
+		transports = append(transports, "circuit-relay-hop")
+	} else {
+		transports = append(transports, "circuit-relay")
+	}
+	if cfg.PSKFile != "" {
+		transports = append(transports, "pnet")
+	}
+	return transports
+}
+
+// logVersion logs the version information when the node starts.
+func (n *Node) logVersion() {
+	info := n.Version()
+	logrus.WithFields(logrus.Fields{
+		"version":    info.Version,
+		"dendrite":   info.Dendrite,
+		"libp2p":     info.LibP2P,
+		"go":         info.Go,
+		"transports": info.Transports,
+		"peer_id":    info.PeerID,
+	}).Info("Dendrite P2P demo")
+}
+
+// setupVersionAPI registers the version endpoint. Like the health checks, it
+// is only served to HTTP clients.
+func (n *Node) setupVersionAPI(mux *http.ServeMux) {
+	mux.Handle(VersionPath, common.MakeExternalAPI("version", func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: n.Version(),
+		}
+	}))
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// webClientAPIPrefixes are the paths that belong to the node's own APIs, so
+// are never served from the web client.
+var webClientAPIPrefixes = []string{"/_matrix/", "/_dendrite/", "/metrics", HealthzPath, ReadyzPath}
+
+// webClientHandler serves a Matrix client for the node at /, with everything
+// else going to the APIs. If dir is set, it is a build of Element Web or any
+// other static client, and a config.json pointing the client at this node is
+// made up for it unless it has one of its own, using baseURL to find the
+// node. Otherwise a minimal client that is compiled into the binary is used.
+func webClientHandler(dir string, baseURL func(*http.Request) *url.URL, apis http.Handler) http.Handler {
+	var files http.Handler
+	if dir != "" {
+		files = http.FileServer(http.Dir(dir))
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, prefix := range webClientAPIPrefixes {
+			if strings.HasPrefix(req.URL.Path, prefix) {
+				apis.ServeHTTP(w, req)
+				return
+			}
+		}
+		if files == nil {
+			if req.URL.Path != "/" {
+				apis.ServeHTTP(w, req)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = io.WriteString(w, webClientHTML)
+			return
+		}
+		if req.URL.Path == "/config.json" {
+			if _, err := os.Stat(filepath.Join(dir, "config.json")); os.IsNotExist(err) {
+				serveWebClientConfig(w, baseURL(req))
+				return
+			}
+		}
+		files.ServeHTTP(w, req)
+	})
+}
+
+// serveWebClientConfig serves an Element Web config which uses the node at
+// the base URL as the homeserver.
+func serveWebClientConfig(w http.ResponseWriter, baseURL *url.URL) {
+	cfg := map[string]interface{}{
+		"default_server_config": map[string]interface{}{
+			"m.homeserver": map[string]string{
+				"base_url": baseURL.String(),
+			},
+		},
+		"disable_guests": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(cfg)
+}
@@ -0,0 +1,222 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+// webClientHTML is the minimal Matrix client that is served when there is no
+// other web client. It can register, log in, create and join rooms and send
+// and show text messages, using the client API of the node it came from.
+const webClientHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Dendrite P2P</title>
+<style>
+body { font-family: sans-serif; margin: 0; color: #222; }
+header { padding: 0.6em 1em; background: #36c; color: #fff; }
+#login, #main { padding: 1em; }
+#main { display: none; }
+#columns { display: flex; gap: 1em; }
+#rooms { width: 16em; list-style: none; padding: 0; margin: 0; }
+#rooms li { padding: 0.3em; cursor: pointer; border-radius: 3px; overflow: hidden; text-overflow: ellipsis; }
+#rooms li.selected { background: #dde6f7; }
+#room { flex: 1; }
+#timeline { height: 60vh; overflow-y: auto; border: 1px solid #ddd; padding: 0.5em; }
+.sender { color: #36c; font-weight: bold; margin-right: 0.5em; }
+#error { color: #c00; }
+input[type=text], input[type=password] { padding: 0.3em; }
+#composer input { width: 80%; }
+</style>
+</head>
+<body>
+<header>Dendrite P2P <span id="whoami"></span></header>
+<p id="error"></p>
+<div id="login">
+<p><input type="text" id="username" placeholder="Username"> <input type="password" id="password" placeholder="Password"></p>
+<p><button id="do-login">Log in</button> <button id="do-register">Register</button></p>
+</div>
+<div id="main">
+<p><input type="text" id="join-id" placeholder="Room ID or alias"> <button id="do-join">Join</button>
+<input type="text" id="create-name" placeholder="New room name"> <button id="do-create">Create</button>
+<button id="do-logout">Log out</button></p>
+<div id="columns">
+<ul id="rooms"></ul>
+<div id="room">
+<h3 id="room-name"></h3>
+<div id="timeline"></div>
+<form id="composer"><input type="text" id="message" placeholder="Message" autocomplete="off"> <button>Send</button></form>
+</div>
+</div>
+</div>
+<script>
+"use strict";
+var session = JSON.parse(localStorage.getItem("dendrite-p2p-session") || "null");
+var rooms = {};
+var current = null;
+var since = null;
+var txn = Date.now();
+
+function $(id) { return document.getElementById(id); }
+function showError(err) { $("error").textContent = err ? err.message || String(err) : ""; }
+
+function api(method, path, body) {
+  var headers = {"Content-Type": "application/json"};
+  if (session) { headers["Authorization"] = "Bearer " + session.access_token; }
+  return fetch("/_matrix/client/r0" + path, {method: method, headers: headers, body: body ? JSON.stringify(body) : undefined})
+    .then(function(res) {
+      return res.json().then(function(json) {
+        if (!res.ok) { var err = new Error(json.error || json.errcode || res.statusText); err.status = res.status; err.json = json; throw err; }
+        return json;
+      });
+    });
+}
+
+function loggedIn(json) {
+  session = {access_token: json.access_token, user_id: json.user_id};
+  localStorage.setItem("dendrite-p2p-session", JSON.stringify(session));
+  start();
+}
+
+function login() {
+  api("POST", "/login", {type: "m.login.password", user: $("username").value, password: $("password").value})
+    .then(loggedIn).catch(showError);
+}
+
+function register() {
+  var body = {username: $("username").value, password: $("password").value};
+  api("POST", "/register", body).then(loggedIn).catch(function(err) {
+    if (err.status !== 401 || !err.json.session) { throw err; }
+    body.auth = {type: "m.login.dummy", session: err.json.session};
+    return api("POST", "/register", body).then(loggedIn);
+  }).catch(showError);
+}
+
+function logout() {
+  session = null;
+  localStorage.removeItem("dendrite-p2p-session");
+  location.reload();
+}
+
+function room(id) {
+  if (!rooms[id]) { rooms[id] = {id: id, name: id, events: []}; }
+  return rooms[id];
+}
+
+function renderRooms() {
+  var list = $("rooms");
+  list.innerHTML = "";
+  Object.keys(rooms).forEach(function(id) {
+    var li = document.createElement("li");
+    li.textContent = rooms[id].name;
+    li.title = id;
+    if (id === current) { li.className = "selected"; }
+    li.onclick = function() { current = id; renderRooms(); renderTimeline(); };
+    list.appendChild(li);
+  });
+}
+
+function renderTimeline() {
+  var r = current && rooms[current];
+  $("room-name").textContent = r ? r.name : "";
+  var timeline = $("timeline");
+  timeline.innerHTML = "";
+  if (!r) { return; }
+  r.events.forEach(function(ev) {
+    var div = document.createElement("div");
+    var sender = document.createElement("span");
+    sender.className = "sender";
+    sender.textContent = ev.sender;
+    sender.title = new Date(ev.origin_server_ts).toLocaleString();
+    div.appendChild(sender);
+    div.appendChild(document.createTextNode(describe(ev)));
+    timeline.appendChild(div);
+  });
+  timeline.scrollTop = timeline.scrollHeight;
+}
+
+function describe(ev) {
+  switch (ev.type) {
+  case "m.room.message": return ev.content.body || "";
+  case "m.room.member": return ev.content.membership + " (" + ev.state_key + ")";
+  case "m.room.name": return "named the room " + ev.content.name;
+  case "m.room.create": return "created the room";
+  default: return ev.type;
+  }
+}
+
+function applySync(json) {
+  var join = (json.rooms && json.rooms.join) || {};
+  Object.keys(join).forEach(function(id) {
+    var r = room(id);
+    var state = (join[id].state && join[id].state.events) || [];
+    var timeline = (join[id].timeline && join[id].timeline.events) || [];
+    state.concat(timeline).forEach(function(ev) {
+      if (ev.type === "m.room.name" && ev.content.name) { r.name = ev.content.name; }
+    });
+    r.events = r.events.concat(timeline);
+    if (!current) { current = id; }
+  });
+  var leave = (json.rooms && json.rooms.leave) || {};
+  Object.keys(leave).forEach(function(id) { delete rooms[id]; if (current === id) { current = null; } });
+  renderRooms();
+  renderTimeline();
+}
+
+function sync() {
+  var path = "/sync?timeout=30000" + (since ? "&since=" + encodeURIComponent(since) : "");
+  api("GET", path).then(function(json) {
+    since = json.next_batch;
+    applySync(json);
+    showError(null);
+    sync();
+  }).catch(function(err) {
+    if (err.status === 401) { logout(); return; }
+    showError(err);
+    setTimeout(sync, 5000);
+  });
+}
+
+function start() {
+  $("login").style.display = "none";
+  $("main").style.display = "block";
+  $("whoami").textContent = session.user_id;
+  sync();
+}
+
+$("do-login").onclick = login;
+$("do-register").onclick = register;
+$("do-logout").onclick = logout;
+$("do-join").onclick = function() {
+  api("POST", "/join/" + encodeURIComponent($("join-id").value), {}).then(function(json) {
+    current = json.room_id; room(json.room_id); renderRooms(); $("join-id").value = "";
+  }).catch(showError);
+};
+$("do-create").onclick = function() {
+  var name = $("create-name").value;
+  api("POST", "/createRoom", name ? {name: name} : {}).then(function(json) {
+    current = json.room_id; room(json.room_id).name = name || json.room_id; renderRooms(); $("create-name").value = "";
+  }).catch(showError);
+};
+$("composer").onsubmit = function(e) {
+  e.preventDefault();
+  var body = $("message").value;
+  if (!current || !body) { return; }
+  api("PUT", "/rooms/" + encodeURIComponent(current) + "/send/m.room.message/" + (txn++), {msgtype: "m.text", body: body})
+    .then(function() { $("message").value = ""; }).catch(showError);
+};
+if (session) { start(); }
+</script>
+</body>
+</html>
+`
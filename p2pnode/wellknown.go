@@ -0,0 +1,102 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2pnode
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// WellKnownClientPath is where clients look up the base URL of the
+	// client API.
+	WellKnownClientPath = "/.well-known/matrix/client"
+	// WellKnownServerPath is where other servers look up where to send
+	// federation requests.
+	WellKnownServerPath = "/.well-known/matrix/server"
+)
+
+// wellKnownPeerIDKey is the key in both well-known documents that holds our
+// peer ID, which is also our server name, so that anything that finds the
+// node by its DNS name can tell which p2p node it is.
+const wellKnownPeerIDKey = "org.matrix.dendrite.p2p.peer_id"
+
+// parsePublicBaseURL checks the base URL that the node is reachable at.
+func parsePublicBaseURL(value string) (*url.URL, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("public base URL %q must be an absolute http or https URL", value)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return u, nil
+}
+
+// baseURL returns the base URL that the node is reachable at: the public
+// base URL if there is one, or else the URL that the request was made to.
+func (n *Node) baseURL(req *http.Request) *url.URL {
+	if n.publicBaseURL != nil {
+		return n.publicBaseURL
+	}
+	u := &url.URL{Scheme: "http", Host: req.Host}
+	if req.TLS != nil {
+		u.Scheme = "https"
+	}
+	return u
+}
+
+// setupWellKnown registers the well-known documents, which describe how to
+// reach the node when it has a DNS name. Like the rest of the node's own
+// APIs, they are only served to HTTP clients.
+func (n *Node) setupWellKnown(mux *http.ServeMux) {
+	mux.Handle(WellKnownClientPath, common.WrapHandlerInCORS(common.MakeExternalAPI("well_known_client", func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]interface{}{
+				"m.homeserver": map[string]string{
+					"base_url": n.baseURL(req).String(),
+				},
+				wellKnownPeerIDKey: n.Host.ID().String(),
+			},
+		}
+	})))
+	mux.Handle(WellKnownServerPath, common.MakeExternalAPI("well_known_server", func(req *http.Request) util.JSONResponse {
+		u := n.baseURL(req)
+		server := u.Host
+		if u.Port() == "" {
+			// Other servers would otherwise try port 8448.
+			port := "443"
+			if u.Scheme == "http" {
+				port = "80"
+			}
+			server = net.JoinHostPort(u.Hostname(), port)
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]interface{}{
+				"m.server":         server,
+				wellKnownPeerIDKey: n.Host.ID().String(),
+			},
+		}
+	}))
+}
@@ -0,0 +1,606 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/dendrite-p2p-demo/p2pnode"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// SimulationJoinTimeout is how long the simulated users have to join the
+// room, which they can't until the nodes have found each other.
+const SimulationJoinTimeout = 2 * time.Minute
+
+// SimulationDeliveryTimeout is how long every node has to receive every
+// message once the last one has been sent.
+const SimulationDeliveryTimeout = time.Minute
+
+// SimulationEpoch is when the clock that a deterministic simulation gives its
+// events timestamps from starts, in seconds since the Unix epoch. The clock
+// ticks by a second for every event.
+const SimulationEpoch = 1577836800
+
+// simulatedLocalpart is the user that is made on every simulated node.
+const simulatedLocalpart = "simulated"
+
+// simulationAppServiceID is the application service that a deterministic
+// simulation registers on every node, as only application services can give
+// the events they send a timestamp, with the ts query parameter.
+const simulationAppServiceID = "simulation"
+
+// simulationAppServiceFileName is the name of the registration of the
+// application service, in the node's data directory.
+const simulationAppServiceFileName = "simulation-appservice.yaml"
+
+// simulationAppServiceRegistration is the registration of the application
+// service, given its URL, its two tokens and the localpart of the user.
+const simulationAppServiceRegistration = `id: %s
+url: %s
+as_token: %s
+hs_token: %s
+sender_localpart: %s
+rate_limited: false
+namespaces:
+  users:
+    - exclusive: true
+      regex: "@%s:.*"
+`
+
+// simulation runs throwaway nodes in one process, connected to each other
+// over libp2p, with a user on each of them in a room that they take turns
+// sending messages to, and measures how long the messages take to arrive
+// at the other nodes.
+type simulation struct {
+	nodes  []*simulatedNode
+	roomID string
+	mu     sync.Mutex
+	// When each message was sent, by its index.
+	sent map[int]time.Time
+	// How long each message took to arrive, by the node that received it.
+	latencies []map[int]time.Duration
+	// The next timestamp to give an event, if the simulation is deterministic.
+	clock time.Time
+	// The timestamp of each message, by its index, as each node received it.
+	timestamps []map[int]gomatrixserverlib.Timestamp
+	// What the application service's requests are sent to, if the simulation
+	// is deterministic. It answers every one of them, and does nothing else.
+	appService    *http.Server
+	appServiceURL string
+}
+
+type simulatedNode struct {
+	node      *p2pnode.Node
+	throwaway *ephemeral
+	servers   []*http.Server
+	url       string
+	token     string
+	// The user's ID, and the token of the application service that the user
+	// was registered by, if the simulation is deterministic.
+	userID  string
+	asToken string
+}
+
+// simulationOptions are what simulate does.
+type simulationOptions struct {
+	nodes    int
+	messages int
+	// How long to wait after sending each message.
+	interval time.Duration
+	// How long to partition the first half of the nodes from the second
+	// half for, once a third of the messages have been sent, if at all.
+	partition time.Duration
+	// How long to delay every Matrix stream for, and the fraction of them
+	// to drop, on every node.
+	delay    time.Duration
+	dropRate float64
+	// What to derive the keys of the nodes from, and to give events
+	// timestamps from a clock instead of the time, if it isn't nil. Which
+	// node does what when still depends on how they are scheduled.
+	seed *int64
+}
+
+// simulate runs a simulation of a number of nodes which send a number of
+// messages between them, printing how long they took to be delivered. It
+// fails if any of the messages weren't delivered to every node, including
+// those sent during a partition once it has healed.
+func simulate(cfg p2pnode.Config, dbbase string, opts simulationOptions) error {
+	s := &simulation{sent: make(map[int]time.Time)}
+	defer s.close()
+	if err := s.run(cfg, dbbase, opts); err != nil {
+		return err
+	}
+	s.report(os.Stdout)
+	if lost := opts.messages*(opts.nodes-1) - s.delivered(); lost > 0 {
+		return fmt.Errorf("%d of %d deliveries didn't arrive within %s", lost, opts.messages*(opts.nodes-1), SimulationDeliveryTimeout)
+	}
+	return nil
+}
+
+// run starts the nodes and sends the messages between them, returning once
+// every message has been delivered or the delivery timeout has passed. The
+// nodes are left running until the simulation is closed.
+func (s *simulation) run(cfg p2pnode.Config, dbbase string, opts simulationOptions) error {
+	nodes, messages := opts.nodes, opts.messages
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if opts.seed != nil {
+		s.clock = time.Unix(SimulationEpoch, 0)
+		if err := s.serveAppService(); err != nil {
+			return err
+		}
+	}
+
+	// Every node is started before any of them serves anything, as starting
+	// a node swaps Dendrite's globals.
+	for i := 0; i < nodes; i++ {
+		if err := s.start(cfg, dbbase, opts.seed); err != nil {
+			return fmt.Errorf("failed to start node %d: %s", i, err)
+		}
+		s.latencies = append(s.latencies, make(map[int]time.Duration))
+		s.timestamps = append(s.timestamps, make(map[int]gomatrixserverlib.Timestamp))
+	}
+	for i, sn := range s.nodes {
+		if err := sn.serve(); err != nil {
+			return fmt.Errorf("failed to serve node %d: %s", i, err)
+		}
+		if err := sn.login(ctx, opts.seed != nil); err != nil {
+			return fmt.Errorf("failed to log in to node %d: %s", i, err)
+		}
+	}
+	// The nodes find each other through the first one, as they would through
+	// a bootstrap peer.
+	first := s.nodes[0].node.Host
+	for _, sn := range s.nodes[1:] {
+		if err := sn.node.AddBootstrapPeer(peer.AddrInfo{ID: first.ID(), Addrs: first.Addrs()}); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Started %d nodes", nodes)
+
+	if err := s.createRoom(ctx); err != nil {
+		return err
+	}
+	logrus.Infof("All of the simulated users have joined %s", s.roomID)
+	var ready sync.WaitGroup
+	for i := range s.nodes {
+		ready.Add(1)
+		go s.sync(ctx, i, &ready)
+	}
+	ready.Wait()
+
+	for _, sn := range s.nodes {
+		sn.node.Chaos.SetDelay(opts.delay)
+		sn.node.Chaos.SetDropRate(opts.dropRate)
+	}
+	healed := make(chan struct{})
+	if opts.partition == 0 {
+		close(healed)
+	}
+	for k := 0; k < messages; k++ {
+		if k == messages/3 && opts.partition > 0 {
+			s.partition(nodes / 2)
+			time.AfterFunc(opts.partition, func() {
+				s.partition(0)
+				close(healed)
+			})
+		}
+		if err := s.send(ctx, k); err != nil {
+			return err
+		}
+		time.Sleep(opts.interval)
+	}
+	<-healed
+	deadline := time.Now().Add(SimulationDeliveryTimeout)
+	for s.delivered() < messages*(nodes-1) && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+// serveAppService serves the application service that a deterministic
+// simulation registers on every node on a loopback port, answering every
+// transaction and query that the nodes send it.
+func (s *simulation) serveAppService() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.appService = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "{}") // nolint: errcheck
+	})}
+	go s.appService.Serve(listener) // nolint: errcheck
+	s.appServiceURL = "http://" + listener.Addr().String()
+	return nil
+}
+
+// start starts a node with new keys, derived from the seed if there is one,
+// and databases of its own.
+func (s *simulation) start(cfg p2pnode.Config, dbbase string, seed *int64) error {
+	throwaway, err := newEphemeral(dbbase)
+	if err != nil {
+		return err
+	}
+	sn := &simulatedNode{throwaway: throwaway}
+	s.nodes = append(s.nodes, sn)
+	cfg.DataDir = throwaway.dataDir
+	for _, db := range componentDatabases(&cfg.Dendrite) {
+		name, err := throwaway.database("dendrite_" + db.name)
+		if err != nil {
+			return err
+		}
+		*db.dsn = config.DataSource(dbbase + "/" + name + "?sslmode=disable")
+	}
+	identityFile := filepath.Join(cfg.DataDir, PrivateKeyFileName)
+	signingFile := filepath.Join(cfg.DataDir, SigningKeyFileName)
+	if seed != nil {
+		if err = p2pnode.WriteSeededKeys(identityFile, signingFile, *seed, len(s.nodes)-1, nil); err != nil {
+			return err
+		}
+	}
+	signingKeys, err := p2pnode.LoadSigningKeys(signingFile, identityFile, nil)
+	if err != nil {
+		return err
+	}
+	cfg.SigningKeys = *signingKeys
+	if cfg.IdentityKey, err = p2pnode.LoadIdentityKey(identityFile, nil); err != nil {
+		return err
+	}
+	cfg.BootstrapPeers = nil
+	cfg.DisableNATPortMap = true
+	cfg.Registration = p2pnode.RegistrationOpen
+	if seed != nil {
+		var hsToken string
+		if sn.asToken, err = randomToken(); err != nil {
+			return err
+		}
+		if hsToken, err = randomToken(); err != nil {
+			return err
+		}
+		registration := fmt.Sprintf(
+			simulationAppServiceRegistration, simulationAppServiceID, s.appServiceURL,
+			sn.asToken, hsToken, simulationAppServiceID, simulatedLocalpart,
+		)
+		file := filepath.Join(cfg.DataDir, simulationAppServiceFileName)
+		if err = ioutil.WriteFile(file, []byte(registration), 0600); err != nil {
+			return err
+		}
+		// The other nodes share the list of files.
+		files := append([]string(nil), cfg.Dendrite.ApplicationServices.ConfigFiles...)
+		cfg.Dendrite.ApplicationServices.ConfigFiles = append(files, file)
+	}
+
+	var restore func()
+	cfg.Metrics, restore = isolateDendrite()
+	defer restore()
+	sn.node, err = p2pnode.New(&cfg)
+	return err
+}
+
+// serve serves the node's APIs over libp2p, and its client API on a
+// loopback port.
+func (sn *simulatedNode) serve() error {
+	libp2pListener, err := sn.node.ListenLibP2P()
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	libp2pServer := &http.Server{Handler: sn.node.LibP2PHandler()}
+	server := &http.Server{Handler: sn.node.Handler()}
+	sn.servers = []*http.Server{libp2pServer, server}
+	go libp2pServer.Serve(libp2pListener) // nolint: errcheck
+	go server.Serve(listener)             // nolint: errcheck
+	sn.url = "http://" + listener.Addr().String()
+	return nil
+}
+
+// login makes the node's user and logs in as them. If the simulation is
+// deterministic, the user is registered by the node's application service.
+func (sn *simulatedNode) login(ctx context.Context, deterministic bool) error {
+	var login struct {
+		UserID      string `json:"user_id"`
+		AccessToken string `json:"access_token"`
+	}
+	if deterministic {
+		// The application service registers the user, so that it can send
+		// events as them. The user gets a device of their own to sync with.
+		err := sn.request(ctx, http.MethodPost, p2pnode.RegisterClientPath, sn.asToken, map[string]interface{}{
+			"username": simulatedLocalpart,
+			"auth":     map[string]string{"type": "m.login.application_service"},
+		}, &login)
+		sn.userID, sn.token = login.UserID, login.AccessToken
+		return err
+	}
+	password, err := randomToken()
+	if err != nil {
+		return err
+	}
+	if err = sn.node.CreateAccount(ctx, simulatedLocalpart, password); err != nil {
+		return err
+	}
+	err = sn.request(ctx, http.MethodPost, p2pnode.LoginClientPath, "", map[string]interface{}{
+		"type":       "m.login.password",
+		"identifier": map[string]string{"type": "m.id.user", "user": simulatedLocalpart},
+		"password":   password,
+	}, &login)
+	sn.userID, sn.token = login.UserID, login.AccessToken
+	return err
+}
+
+// randomToken returns a random hex string, for passwords and tokens.
+func randomToken() (string, error) {
+	var token [16]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token[:]), nil
+}
+
+// createRoom creates a public room on the first node and joins the users
+// of the others to it, retrying until the nodes have found each other.
+func (s *simulation) createRoom(ctx context.Context) error {
+	var created struct {
+		RoomID string `json:"room_id"`
+	}
+	path, token := s.eventRequest(s.nodes[0], p2pnode.CreateRoomClientPath)
+	err := s.nodes[0].request(ctx, http.MethodPost, path, token, map[string]string{"preset": "public_chat"}, &created)
+	if err != nil {
+		return err
+	}
+	s.roomID = created.RoomID
+	deadline := time.Now().Add(SimulationJoinTimeout)
+	for i, sn := range s.nodes[1:] {
+		// Every attempt has the same timestamp, so that the join's doesn't
+		// depend on how long the nodes take to find each other.
+		path, token := s.eventRequest(sn, "/_matrix/client/r0/join/"+url.PathEscape(s.roomID))
+		for {
+			err = sn.request(ctx, http.MethodPost, path, token, struct{}{}, nil)
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("node %d failed to join the room: %s", i+1, err)
+			}
+			time.Sleep(time.Second)
+		}
+	}
+	return nil
+}
+
+// eventRequest returns the path and access token of a request that sends an
+// event as the user of a node. If the simulation is deterministic, the
+// request is made by the application service as the user, with the time of
+// the clock as the event's timestamp, and the clock ticks.
+func (s *simulation) eventRequest(sn *simulatedNode, path string) (string, string) {
+	if s.clock.IsZero() {
+		return path, sn.token
+	}
+	query := url.Values{
+		"user_id": {sn.userID},
+		"ts":      {strconv.FormatUint(uint64(gomatrixserverlib.AsTimestamp(s.clock)), 10)},
+	}
+	s.clock = s.clock.Add(time.Second)
+	return path + "?" + query.Encode(), sn.asToken
+}
+
+// partition partitions the first of the nodes from the rest, or heals the
+// partition if first is 0.
+func (s *simulation) partition(first int) {
+	var before, after []peer.ID
+	for i, sn := range s.nodes {
+		if i < first {
+			before = append(before, sn.node.Host.ID())
+		} else {
+			after = append(after, sn.node.Host.ID())
+		}
+	}
+	for i, sn := range s.nodes {
+		switch {
+		case first == 0:
+			sn.node.Chaos.Partition(nil)
+		case i < first:
+			sn.node.Chaos.Partition(after)
+		default:
+			sn.node.Chaos.Partition(before)
+		}
+	}
+}
+
+// send sends a message as the user of one node after another.
+func (s *simulation) send(ctx context.Context, k int) error {
+	s.mu.Lock()
+	s.sent[k] = time.Now()
+	s.mu.Unlock()
+	sn := s.nodes[k%len(s.nodes)]
+	path, token := s.eventRequest(sn, p2pnode.RoomsClientPathPrefix+url.PathEscape(s.roomID)+"/send/m.room.message/"+strconv.Itoa(k))
+	return sn.request(ctx, http.MethodPut, path, token, map[string]interface{}{
+		"msgtype":       "m.text",
+		"body":          fmt.Sprintf("Simulated message %d", k),
+		"simulation_id": k,
+	}, nil)
+}
+
+// sync syncs the user of a node until the context is done, noting when each
+// message arrives. ready is marked done once the first sync has returned.
+func (s *simulation) sync(ctx context.Context, i int, ready *sync.WaitGroup) {
+	sn := s.nodes[i]
+	since := ""
+	for ctx.Err() == nil {
+		path := "/_matrix/client/r0/sync?timeout=30000"
+		if since != "" {
+			path += "&since=" + url.QueryEscape(since)
+		}
+		var res types.Response
+		if err := sn.request(ctx, http.MethodGet, path, sn.token, nil, &res); err != nil {
+			if ctx.Err() == nil {
+				logrus.WithError(err).Warnf("Failed to sync node %d", i)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		now := time.Now()
+		for _, ev := range res.Rooms.Join[s.roomID].Timeline.Events {
+			var content struct {
+				SimulationID *int `json:"simulation_id"`
+			}
+			if ev.Type != "m.room.message" || json.Unmarshal(ev.Content, &content) != nil || content.SimulationID == nil {
+				continue
+			}
+			k := *content.SimulationID
+			if k%len(s.nodes) == i {
+				continue
+			}
+			s.mu.Lock()
+			if _, ok := s.latencies[i][k]; !ok {
+				s.latencies[i][k] = now.Sub(s.sent[k])
+				s.timestamps[i][k] = ev.OriginServerTS
+			}
+			s.mu.Unlock()
+		}
+		if since == "" {
+			ready.Done()
+		}
+		since = res.NextBatch
+	}
+}
+
+// delivered returns how many messages have arrived at the nodes that didn't
+// send them.
+func (s *simulation) delivered() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, latencies := range s.latencies {
+		n += len(latencies)
+	}
+	return n
+}
+
+// report writes how many of the messages that each node should have received
+// it did, and how long they took, followed by the same for all of the nodes.
+func (s *simulation) report(out io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tPEER ID\tRECEIVED\tMIN\tMEDIAN\t95TH\tMAX")
+	var all []time.Duration
+	for i, sn := range s.nodes {
+		var latencies []time.Duration
+		expected := 0
+		for k := range s.sent {
+			if k%len(s.nodes) != i {
+				expected++
+			}
+		}
+		for _, latency := range s.latencies[i] {
+			latencies = append(latencies, latency)
+		}
+		all = append(all, latencies...)
+		fmt.Fprintf(w, "%d\t%s\t%d/%d\t%s\n", i, sn.node.Host.ID(), len(latencies), expected, formatLatencies(latencies))
+	}
+	fmt.Fprintf(w, "all\t\t%d/%d\t%s\n", len(all), len(s.sent)*(len(s.nodes)-1), formatLatencies(all))
+	w.Flush() // nolint: errcheck
+}
+
+// formatLatencies formats the minimum, median, 95th percentile and maximum of
+// some latencies as tab separated columns.
+func formatLatencies(latencies []time.Duration) string {
+	if len(latencies) == 0 {
+		return "-\t-\t-\t-"
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p int) time.Duration {
+		return latencies[(len(latencies)-1)*p/100].Round(time.Millisecond)
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s", percentile(0), percentile(50), percentile(95), percentile(100))
+}
+
+// close stops every node that was started and drops its databases.
+func (s *simulation) close() {
+	if s.appService != nil {
+		s.appService.Close() // nolint: errcheck
+	}
+	for _, sn := range s.nodes {
+		for _, server := range sn.servers {
+			server.Close() // nolint: errcheck
+		}
+		if sn.node != nil {
+			if err := sn.node.Close(); err != nil {
+				logrus.WithError(err).Warn("Failed to stop node")
+			}
+		}
+		sn.throwaway.cleanup()
+	}
+}
+
+// request makes a request of the node's client API with an access token if
+// there is one, with a JSON body if there is one, and decodes the JSON
+// response into res if it isn't nil.
+func (sn *simulatedNode) request(ctx context.Context, method, path, token string, body, res interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, sn.url+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, data)
+	}
+	if res == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
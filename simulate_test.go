@@ -0,0 +1,57 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite-p2p-demo/p2pnode"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestSimulateDeterministic(t *testing.T) {
+	dbbase := os.Getenv(testPostgresEnvVar)
+	if dbbase == "" {
+		t.Skip("$" + testPostgresEnvVar + " isn't set")
+	}
+	seed := int64(0)
+	opts := simulationOptions{nodes: 2, messages: 4, interval: 100 * time.Millisecond, seed: &seed}
+	s := &simulation{sent: make(map[int]time.Time)}
+	defer s.close()
+	if err := s.run(p2pnode.Config{}, dbbase, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// The room is created and joined by every node before the first message
+	// is sent, each of which ticks the clock.
+	for i := range s.nodes {
+		for k := 0; k < opts.messages; k++ {
+			if k%opts.nodes == i {
+				continue
+			}
+			ts, ok := s.timestamps[i][k]
+			if !ok {
+				t.Errorf("node %d didn't receive message %d", i, k)
+				continue
+			}
+			want := gomatrixserverlib.AsTimestamp(time.Unix(SimulationEpoch+int64(opts.nodes+k), 0))
+			if ts != want {
+				t.Errorf("node %d received message %d with timestamp %d, wanted %d", i, k, ts, want)
+			}
+		}
+	}
+}
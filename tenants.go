@@ -0,0 +1,267 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/matrix-org/dendrite-p2p-demo/p2pnode"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// TenantsDirName is the directory, inside the data directory of the node,
+// that the data directories of its tenants are kept in.
+const TenantsDirName = "tenants"
+
+// hostedTenant is the node of a tenant, running alongside ours.
+type hostedTenant struct {
+	p2pnode.Tenant
+	node         *p2pnode.Node
+	libp2pServer *http.Server
+}
+
+// tenantsOptions is what the tenants are set up with apart from the config
+// of the node.
+type tenantsOptions struct {
+	throwaway *ephemeral
+	pass      *p2pnode.Passphrase
+	// The seed that the node's keys were derived from, if there is one,
+	// which the tenants' keys are derived from too, offset by their index.
+	seed *int64
+}
+
+// startTenants starts a node for each of the tenants in cfg, with a config
+// made from that of the node, and has them bootstrap from the node. Their
+// databases are dendrite_<name>_<component>, on the same server and with the
+// same credentials and options as the node's own. It must be called before the node
+// serves anything, as the tenants are isolated from it by isolateDendrite.
+// Their APIs are only served over libp2p once every one has started.
+func startTenants(cfg p2pnode.Config, node *p2pnode.Node, opts tenantsOptions) ([]*hostedTenant, error) {
+	if len(cfg.Tenants) == 0 {
+		return nil, nil
+	}
+	if err := p2pnode.CheckTenants(cfg.Tenants); err != nil {
+		return nil, err
+	}
+	nodeInvite, err := p2pnode.ParseInvite(node.Invite())
+	if err != nil {
+		return nil, err
+	}
+	var tenants []*hostedTenant
+	for i, tenant := range cfg.Tenants {
+		ht, err := startTenant(cfg, tenant, i+1, opts)
+		if err == nil {
+			tenants = append(tenants, ht)
+			err = ht.node.AddBootstrapPeer(*nodeInvite)
+		}
+		if err != nil {
+			closeTenants(tenants)
+			return nil, err
+		}
+	}
+	for _, ht := range tenants {
+		if err = ht.serve(); err != nil {
+			closeTenants(tenants)
+			return nil, err
+		}
+	}
+	return tenants, nil
+}
+
+// startTenant starts the node of a tenant, whose keys are derived from the
+// seed and its index if there is a seed. Each tenant gets Dendrite's globals
+// to itself.
+func startTenant(cfg p2pnode.Config, tenant p2pnode.Tenant, index int, opts tenantsOptions) (*hostedTenant, error) {
+	cfg.DataDir = filepath.Join(cfg.DataDir, TenantsDirName, tenant.Name)
+	if err := os.MkdirAll(cfg.DataDir, 0700); err != nil {
+		return nil, err
+	}
+	// Anything that is the node's own, or which only one node can have, is
+	// left out. The rest of the Dendrite config is shared, apart from what
+	// the node derived from it.
+	var fresh config.Dendrite
+	cfg.Tenants = nil
+	cfg.Component = ""
+	cfg.AdminUsers = nil
+	cfg.PublicBaseURL = ""
+	cfg.WebSocketListenAddr = ""
+	cfg.TorControlAddr = ""
+	cfg.Dendrite.Derived = fresh.Derived
+	cfg.Dendrite.Listen, cfg.Dendrite.Bind = fresh.Listen, fresh.Bind
+	cfg.Dendrite.ApplicationServices = fresh.ApplicationServices
+	cfg.Dendrite.Media.BasePath = config.Path(filepath.Join(cfg.DataDir, "media"))
+	for _, db := range componentDatabases(&cfg.Dendrite) {
+		dbname := "dendrite_" + tenant.Name + "_" + db.name
+		if opts.throwaway != nil {
+			var err error
+			if dbname, err = opts.throwaway.database(dbname); err != nil {
+				return nil, err
+			}
+		}
+		dsn, err := renameDatabase(*db.dsn, dbname)
+		if err != nil {
+			return nil, fmt.Errorf("failed to name the %s database of tenant %s: %s", db.name, tenant.Name, err)
+		}
+		*db.dsn = dsn
+	}
+
+	identityFile := filepath.Join(cfg.DataDir, PrivateKeyFileName)
+	signingFile := filepath.Join(cfg.DataDir, SigningKeyFileName)
+	if opts.seed != nil {
+		if err := p2pnode.WriteSeededKeys(identityFile, signingFile, *opts.seed, index, opts.pass); err != nil {
+			return nil, err
+		}
+	}
+	signingKeys, err := p2pnode.LoadSigningKeys(signingFile, identityFile, opts.pass)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SigningKeys = *signingKeys
+	if cfg.IdentityKey, err = p2pnode.LoadIdentityKey(identityFile, opts.pass); err != nil {
+		return nil, err
+	}
+
+	ht := &hostedTenant{Tenant: tenant}
+	var restore func()
+	cfg.Metrics, restore = isolateDendrite()
+	defer restore()
+	if ht.node, err = p2pnode.New(&cfg); err != nil {
+		return nil, err
+	}
+	return ht, nil
+}
+
+// serve serves the tenant's APIs over libp2p.
+func (ht *hostedTenant) serve() error {
+	listener, err := ht.node.ListenLibP2P()
+	if err != nil {
+		return err
+	}
+	ht.libp2pServer = &http.Server{Handler: ht.node.LibP2PHandler()}
+	go func() {
+		if err := ht.libp2pServer.Serve(listener); err != http.ErrServerClosed {
+			logrus.Fatal(err)
+		}
+	}()
+	logrus.WithField("tenant", ht.Name).Infof("Hosting %s at %s", ht.node.Host.ID(), ht.Host)
+	return nil
+}
+
+// tenantDatabases returns the databases of every tenant in cfg, as they are
+// named in backups, which is <name>_<component>.
+func tenantDatabases(cfg *p2pnode.Config) ([]componentDatabase, error) {
+	if err := p2pnode.CheckTenants(cfg.Tenants); err != nil {
+		return nil, err
+	}
+	var databases []componentDatabase
+	for _, tenant := range cfg.Tenants {
+		for _, db := range componentDatabases(&cfg.Dendrite) {
+			dsn, err := renameDatabase(*db.dsn, "dendrite_"+tenant.Name+"_"+db.name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to name the %s database of tenant %s: %s", db.name, tenant.Name, err)
+			}
+			databases = append(databases, componentDatabase{name: tenant.Name + "_" + db.name, dsn: &dsn})
+		}
+	}
+	return databases, nil
+}
+
+// renameDatabase returns a Postgres URL that is the same as dsn apart from
+// naming another database.
+func renameDatabase(dsn config.DataSource, dbname string) (config.DataSource, error) {
+	u, err := url.Parse(string(dsn))
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		// The rest of it could hold a password, so it isn't repeated.
+		return "", fmt.Errorf("the data source isn't a postgres:// URL")
+	}
+	u.Path, u.RawPath = "/"+dbname, ""
+	return config.DataSource(u.String()), nil
+}
+
+// closeTenants stops the nodes of the tenants.
+func closeTenants(tenants []*hostedTenant) {
+	for _, ht := range tenants {
+		if ht.libp2pServer != nil {
+			ht.libp2pServer.Close() // nolint: errcheck
+		}
+		if err := ht.node.Close(); err != nil {
+			logrus.WithError(err).WithField("tenant", ht.Name).Warn("Failed to stop tenant")
+		}
+	}
+}
+
+// isolateDendrite gives the next node to be started a default HTTP mux and
+// prometheus registry of its own, as Dendrite registers its internal APIs
+// on the one and its metrics with the other, neither of which can be done
+// twice. It returns the registry, for the node to serve its metrics from,
+// and a function that puts back the ones from before.
+//
+// These are globals that any goroutine could read, so every node has to be
+// started, one at a time, before anything is served. Only starting a node
+// reads them: a node serves its metrics from the registry it was given.
+func isolateDendrite() (*prometheus.Registry, func()) {
+	mux, registerer, gatherer := http.DefaultServeMux, prometheus.DefaultRegisterer, prometheus.DefaultGatherer
+	http.DefaultServeMux = http.NewServeMux()
+	registry := prometheus.NewRegistry()
+	prometheus.DefaultRegisterer, prometheus.DefaultGatherer = registry, registry
+	return registry, func() {
+		http.DefaultServeMux = mux
+		prometheus.DefaultRegisterer, prometheus.DefaultGatherer = registerer, gatherer
+	}
+}
+
+// virtualHosts serves the HTTP APIs of each tenant to requests for its host,
+// and those of the node to every other request.
+type virtualHosts struct {
+	tenants map[string]http.Handler
+	node    http.Handler
+}
+
+// newVirtualHosts returns the node's handler as it is if there are no
+// tenants.
+func newVirtualHosts(node http.Handler, tenants []*hostedTenant) http.Handler {
+	if len(tenants) == 0 {
+		return node
+	}
+	v := &virtualHosts{tenants: make(map[string]http.Handler, len(tenants)), node: node}
+	for _, ht := range tenants {
+		v.tenants[strings.ToLower(ht.Host)] = ht.node.Handler()
+	}
+	return v
+}
+
+// ServeHTTP implements http.Handler
+func (v *virtualHosts) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if handler, ok := v.tenants[strings.ToLower(host)]; ok {
+		handler.ServeHTTP(w, req)
+		return
+	}
+	v.node.ServeHTTP(w, req)
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMECacheDirName is the directory, in the data directory, that certificates
+// from Let's Encrypt are kept in.
+const ACMECacheDirName = "acme"
+
+// setupTLS returns the TLS config for the HTTP listener, or nil if it should
+// serve plain HTTP. Either a certificate and key are given, or a list of
+// domains to get certificates for from Let's Encrypt, but not both.
+//
+// Let's Encrypt checks that we control a domain by connecting to it on port
+// 443 and using the tls-alpn-01 challenge, so -http-bind needs to be :443
+// from the outside for that to work.
+func setupTLS(certFile, keyFile, acmeDomains, dataDir string) (*tls.Config, error) {
+	switch {
+	case acmeDomains != "":
+		if certFile != "" || keyFile != "" {
+			return nil, fmt.Errorf("can't use a certificate file and Let's Encrypt at the same time")
+		}
+		var domains []string
+		for _, domain := range strings.Split(acmeDomains, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				domains = append(domains, domain)
+			}
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(filepath.Join(dataDir, ACMECacheDirName)),
+			HostPolicy: autocert.HostWhitelist(domains...),
+		}
+		return m.TLSConfig(), nil
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("both a certificate and a key are needed for TLS")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	default:
+		return nil, nil
+	}
+}